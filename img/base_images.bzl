@@ -1,10 +1,11 @@
 """Public API for building bespoke container base images.
 
 These rules describe the contents of a base image -- the directory skeleton,
-users and groups, the CA trust store, shared libraries, the standard files under
-`/etc` -- without building a layer. Each returns a `BaseImageContentInfo`
-carrying nothing but tar entry metadata (plus the files that metadata points
-at), so a description costs almost nothing to propagate through dependencies.
+users and groups, the CA trust store, shared libraries, time zones and locales,
+the standard files under `/etc`, the package database -- without building a
+layer. Each returns a `BaseImageContentInfo` carrying nothing but tar entry
+metadata (plus the files that metadata points at), so a description costs almost
+nothing to propagate through dependencies.
 
 `base_image_layer` is what finally materializes them: it takes any number of
 descriptions and merges them into a single flat layer.
@@ -55,8 +56,11 @@ load(
     _passwd_entry = "passwd_entry",
 )
 load("//img/private/base_images:linux_skeleton.bzl", _linux_skeleton = "linux_skeleton")
+load("//img/private/base_images:locales.bzl", _locales = "locales")
+load("//img/private/base_images:package_database.bzl", _package_database = "package_database")
 load("//img/private/base_images:system_libraries.bzl", _system_libraries = "system_libraries")
 load("//img/private/base_images:trust_store.bzl", _trust_store = "trust_store")
+load("//img/private/base_images:tzdata.bzl", _tzdata = "tzdata")
 
 # The terminal rule: turns content descriptions into a layer.
 base_image_layer = _base_image_layer
@@ -66,10 +70,13 @@ etc_environment = _etc_environment
 etc_hosts = _etc_hosts
 etc_release = _etc_release
 linux_skeleton = _linux_skeleton
+locales = _locales
+package_database = _package_database
 system_libraries = _system_libraries
 
 # Content rules, any Unix.
 etc_passwd = _etc_passwd
+tzdata = _tzdata
 
 # Content rules, any platform.
 trust_store = _trust_store
@@ -4,6 +4,7 @@ load("//img/private/common:build.bzl", "TOOLCHAINS")
 load("//img/private/common:layer_attrs.bzl", "layer_attrs")
 load("//img/private/common:tar_layer.bzl", "create_tar_layer", "resolve_layer_settings")
 load("//img/private/providers:base_image_content_info.bzl", "BaseImageContentInfo")
+load("//img/private/providers:layer_config_info.bzl", "ImageLayerConfigInfo")
 load("//img/private/providers:layers_info.bzl", "LayersInfo")
 
 def _base_image_layer_impl(ctx):
@@ -34,13 +35,28 @@ def _base_image_layer_impl(ctx):
     streams_args.add_all(metadata)
     extra_args.append(streams_args)
 
-    return create_tar_layer(
+    providers = create_tar_layer(
         ctx,
         settings,
         extra_args = extra_args,
         extra_inputs = [metadata, referenced_files],
     )
 
+    # Content that needs environment variables (the LANG of `locales`) hands
+    # them to image_manifest the way layer_from_binary hands over its
+    # entrypoint, with the same later-wins order as the files.
+    env = {}
+    for src in ctx.attr.srcs:
+        env.update(src[BaseImageContentInfo].env)
+    if env:
+        providers.append(ImageLayerConfigInfo(
+            entrypoint = None,
+            cmd = None,
+            env = env,
+            working_dir = None,
+        ))
+    return providers
+
 base_image_layer = rule(
     implementation = _base_image_layer_impl,
     doc = """Builds a single flat container image layer from base image content descriptions.
@@ -58,6 +74,10 @@ instead: that is a rule authoring mistake rather than a deliberate override.
 The resulting layer is an ordinary rules_img layer and supports the same
 compression, eStargz, SOCI and compact-stream settings as `image_layer`.
 
+Content that only takes effect through the environment -- the `LANG` of
+`locales` -- is passed on too: `image_manifest` adds the merged environment of
+the srcs to the image config, below its own `env`.
+
 Example:
 
 ```python
@@ -65,7 +65,7 @@ def empty_content():
     """
     return [
         DefaultInfo(files = depset()),
-        BaseImageContentInfo(metadata = depset(), files = depset()),
+        BaseImageContentInfo(metadata = depset(), files = depset(), env = {}),
     ]
 
 # Attributes every content rule needs: the target platform (for scope checks)
@@ -135,7 +135,7 @@ def expand_templates(ctx, templates):
         only_if_stamping = True,
     )
 
-def run_base_verb(ctx, verb, args, inputs = [], referenced_files = []):
+def run_base_verb(ctx, verb, args, inputs = [], referenced_files = [], env = {}):
     """Runs one `img base <verb>` action and returns the rule's providers.
 
     Args:
@@ -148,6 +148,8 @@ def run_base_verb(ctx, verb, args, inputs = [], referenced_files = []):
             emitted metadata. These are not action inputs (the action only
             records their paths); they are propagated so the layer action that
             eventually reads the metadata can open them.
+        env: Dict of environment variables the content needs in the image
+            config, passed on through `BaseImageContentInfo.env`.
 
     Returns:
         The list of providers the rule should return.
@@ -185,6 +187,7 @@ def run_base_verb(ctx, verb, args, inputs = [], referenced_files = []):
         BaseImageContentInfo(
             metadata = depset([output]),
             files = depset(transitive = referenced_files),
+            env = env,
         ),
     ]
 
@@ -203,3 +206,26 @@ def merge_sources(ctx, targets):
     for target in targets:
         files.extend(target[DefaultInfo].files.to_list())
     return files
+
+def package_relative_path(f):
+    """Returns the path of a file relative to the package it belongs to.
+
+    Rules that take the loose files of an extracted root filesystem (a sysroot,
+    a zoneinfo tree) place each file at this path, so the files of a repository
+    holding the extraction keep their layout: `@rootfs//:usr/lib/libc.so.6` is
+    `usr/lib/libc.so.6`.
+
+    Args:
+        f: A File.
+
+    Returns:
+        The path, without a leading slash.
+    """
+    short_path = f.short_path
+    if short_path.startswith("../"):
+        # ../<repository>/<path> for files of external repositories.
+        short_path = short_path.split("/", 2)[2]
+    package = f.owner.package
+    if package and short_path.startswith(package + "/"):
+        short_path = short_path[len(package) + 1:]
+    return short_path
@@ -0,0 +1,127 @@
+"""Rule describing the glibc locales of a base image."""
+
+load("//img/private/base_images:common.bzl", "SCOPE_LINUX", "base_content_attrs", "empty_content", "in_scope", "merge_sources", "package_relative_path", "run_base_verb")
+load("//img/private/common:build.bzl", "TOOLCHAINS")
+load("//img/private/providers:base_image_content_info.bzl", "BaseImageContentInfo")
+
+def _locale_file_name(f, locale_dir):
+    """Returns the LOCALE/FILE name of a loose file of a compiled locale.
+
+    That is its path relative to its package, minus the locale directory when
+    the package holds an extracted root filesystem.
+    """
+    name = package_relative_path(f)
+    prefix = locale_dir.strip("/") + "/"
+    if name.startswith(prefix):
+        name = name[len(prefix):]
+    return name
+
+def _locales_impl(ctx):
+    if not in_scope(ctx, SCOPE_LINUX):
+        return empty_content()
+
+    locales = merge_sources(ctx, ctx.attr.locales)
+    archive = ctx.file.archive
+    if not archive and not locales and not ctx.attr.lang:
+        fail("locales requires at least one of archive, locales or lang")
+
+    args = ctx.actions.args()
+    inputs = list(locales)
+    if archive:
+        args.add("--archive", archive)
+        inputs.append(archive)
+    for f in locales:
+        if f.is_directory:
+            # A directory is named after the locale it holds, like the
+            # directories localedef --no-archive writes.
+            args.add("--locale", "{}={}".format(f.basename, f.path))
+        else:
+            args.add("--locale-file", "{}={}".format(_locale_file_name(f, ctx.attr.locale_dir), f.path))
+    args.add("--locale-dir", ctx.attr.locale_dir)
+
+    env = {}
+    if ctx.attr.lang:
+        args.add("--lang", ctx.attr.lang)
+        env["LANG"] = ctx.attr.lang
+    if ctx.attr.mode:
+        args.add("--mode", ctx.attr.mode)
+
+    return run_base_verb(
+        ctx,
+        ["locales"],
+        args,
+        # The archive is read for the names of its locales, which lang is
+        # checked against, and everything is referenced by path.
+        inputs = [inputs],
+        referenced_files = [depset(inputs)],
+        env = env,
+    )
+
+locales = rule(
+    implementation = _locales_impl,
+    doc = """Describes the glibc locales of a Linux base image and its default locale.
+
+Locales are placed prebuilt, in either of the shapes glibc reads from
+`/usr/lib/locale`: a single `locale-archive` as `localedef` builds by default,
+or one directory per locale (`en_US.utf8/LC_CTYPE`, ...) as
+`localedef --no-archive` and Debian's `locales-all` produce. Nothing is
+compiled by this rule.
+
+`lang` selects the default locale. It becomes `LANG` in the environment of the
+image config -- `base_image_layer` passes it on to `image_manifest`, where the
+manifest's own `env` still wins -- and is recorded in `/etc/default/locale`.
+The name must be one of the placed locales (or `C` or `POSIX`, which glibc
+builds in), compared the way glibc looks it up: `en_US.UTF-8` is found as
+`en_US.utf8`. A typo fails the build instead of silently falling back to the
+`C` locale at runtime.
+
+musl ignores all of this: its locale support is built in. This rule only
+applies when targeting Linux. On any other platform it is a no-op that
+contributes nothing to the layer.
+
+Example:
+
+```python
+load("@rules_img//img:base_images.bzl", "locales")
+
+locales(
+    name = "locales",
+    archive = "//locales:locale-archive",
+    lang = "en_US.UTF-8",
+)
+```
+""",
+    attrs = base_content_attrs({
+        "archive": attr.label(
+            doc = """A prebuilt glibc `locale-archive`, placed as `<locale_dir>/locale-archive`.
+
+The archive must be built for the target's glibc; the format changes rarely,
+but does change between glibc releases.""",
+            allow_single_file = True,
+        ),
+        "locales": attr.label_list(
+            doc = """Compiled locale directories.
+
+Either directories (tree artifacts) named after the locale they hold, e.g.
+`en_US.utf8`, or loose files, named by their path relative to the package they
+belong to with any leading `locale_dir` removed:
+`@locales_deb//:usr/lib/locale/C.utf8/LC_CTYPE` is `C.utf8/LC_CTYPE`.""",
+            allow_files = True,
+        ),
+        "lang": attr.string(
+            doc = """The default locale, e.g. `en_US.UTF-8`.
+
+Set as `LANG` in the image config and written to `/etc/default/locale`. Must
+name a placed locale, or `C` or `POSIX`.""",
+        ),
+        "locale_dir": attr.string(
+            default = "/usr/lib/locale",
+            doc = "Directory glibc looks for locales in inside the image.",
+        ),
+        "mode": attr.string(
+            doc = """Octal mode of the placed locale files, e.g. `"0644"`. Defaults to `0644`.""",
+        ),
+    }),
+    toolchains = TOOLCHAINS,
+    provides = [BaseImageContentInfo],
+)
@@ -0,0 +1,119 @@
+"""Rule describing the package database entries of .deb, .rpm and .apk packages."""
+
+load("//img/private/base_images:common.bzl", "SCOPE_LINUX", "base_content_attrs", "empty_content", "in_scope", "merge_sources", "run_base_verb")
+load("//img/private/common:build.bzl", "TOOLCHAINS")
+load("//img/private/providers:base_image_content_info.bzl", "BaseImageContentInfo")
+
+def _package_database_impl(ctx):
+    if not in_scope(ctx, SCOPE_LINUX):
+        return empty_content()
+
+    debs = merge_sources(ctx, ctx.attr.debs)
+    rpms = merge_sources(ctx, ctx.attr.rpms)
+    apks = merge_sources(ctx, ctx.attr.apks)
+    if not debs and not rpms and not apks:
+        fail("package_database requires at least one of debs, rpms or apks")
+
+    args = ctx.actions.args()
+    args.add_all(debs, before_each = "--deb")
+    args.add_all(rpms, before_each = "--rpm")
+    args.add_all(apks, before_each = "--apk")
+    args.add("--dpkg-status-dir", ctx.attr.dpkg_status_dir)
+    args.add("--rpmdb-path", ctx.attr.rpmdb_path)
+    args.add("--apk-installed-path", ctx.attr.apk_installed_path)
+    if ctx.attr.mode:
+        args.add("--mode", ctx.attr.mode)
+
+    return run_base_verb(ctx, ["packages"], args, inputs = [debs + rpms + apks])
+
+package_database = rule(
+    implementation = _package_database_impl,
+    doc = """Describes the package database of a Linux base image.
+
+A base image assembled from files extracted out of `.deb`, `.rpm` or `.apk`
+packages has no package database, so vulnerability scanners (Trivy, Grype,
+Syft) see an unknown OS with no packages and report nothing. This rule records
+the packages in the database those scanners read, without installing anything:
+the packages' files are placed by other rules, and only the database entries
+describing them are written.
+
+- **Debian packages** are recorded the way distroless images do it: one file
+  per package under `/var/lib/dpkg/status.d`, holding the control paragraph the
+  package ships, next to a `<package>.md5sums` file listing its files.
+- **RPMs** are recorded in the `Packages` table of an rpm SQLite database
+  (`/var/lib/rpm/rpmdb.sqlite`), which holds each package's header as rpm
+  stores it. rpm's own index tables are not written; `rpm --rebuilddb` inside
+  the image regenerates them, should rpm itself ever run there.
+- **Alpine packages** are recorded in apk's installed database
+  (`/lib/apk/db/installed`): per package, the metadata of its `.PKGINFO` and
+  the checksum identifying it, followed by every directory and file it
+  installs with its owner, mode and SHA-1, in the format `apk add` writes.
+
+List the packages whose files the image actually holds: a scanner matches
+vulnerabilities against the recorded versions, so recording a package that is
+not there produces false reports, and leaving one out hides real ones. Only the
+control archive or header of a package is read, so xz-compressed payloads are
+no obstacle here.
+
+This rule only applies when targeting Linux. On any other platform it is a
+no-op that contributes nothing to the layer.
+
+Example:
+
+```python
+load("@rules_img//img:base_images.bzl", "package_database")
+
+package_database(
+    name = "dpkg_status",
+    debs = [
+        "@bookworm//base-files/amd64:data",
+        "@bookworm//libc6/amd64:data",
+        "@bookworm//ca-certificates/amd64:data",
+    ],
+)
+```
+""",
+    attrs = base_content_attrs({
+        "debs": attr.label_list(
+            doc = """Debian packages to record.
+
+Each gets a file named after the package under `dpkg_status_dir`. Two packages
+with the same name (say, two architectures of one library) are an error.""",
+            allow_files = True,
+        ),
+        "rpms": attr.label_list(
+            doc = """RPM packages to record.
+
+Rows are numbered in package name order, so the database does not depend on the
+order of this list.""",
+            allow_files = True,
+        ),
+        "apks": attr.label_list(
+            doc = """Alpine packages to record.
+
+Entries are written in package name order. Two packages with the same name are
+an error, as apk installs one package of a name.""",
+            allow_files = True,
+        ),
+        "apk_installed_path": attr.string(
+            default = "/lib/apk/db/installed",
+            doc = "Path of apk's installed database inside the image.",
+        ),
+        "dpkg_status_dir": attr.string(
+            default = "/var/lib/dpkg/status.d",
+            doc = "Directory of the per-package dpkg status files inside the image.",
+        ),
+        "rpmdb_path": attr.string(
+            default = "/var/lib/rpm/rpmdb.sqlite",
+            doc = """Path of the rpm database inside the image.
+
+Fedora 36 and later keep it at `/usr/lib/sysimage/rpm/rpmdb.sqlite`, with
+`/var/lib/rpm` a symlink to that directory.""",
+        ),
+        "mode": attr.string(
+            doc = """Octal mode of the written files, e.g. `"0644"`. Defaults to `0644`.""",
+        ),
+    }),
+    toolchains = TOOLCHAINS,
+    provides = [BaseImageContentInfo],
+)
@@ -1,6 +1,6 @@
 """Rule describing the shared libraries of a Linux base image."""
 
-load("//img/private/base_images:common.bzl", "SCOPE_LINUX", "base_content_attrs", "empty_content", "in_scope", "merge_sources", "run_base_verb")
+load("//img/private/base_images:common.bzl", "SCOPE_LINUX", "base_content_attrs", "empty_content", "in_scope", "merge_sources", "package_relative_path", "run_base_verb")
 load("//img/private/common:build.bzl", "TOOLCHAINS")
 load("//img/private/config:defs.bzl", "TargetPlatformInfo")
 load("//img/private/providers:base_image_content_info.bzl", "BaseImageContentInfo")
@@ -61,8 +61,9 @@ def _system_libraries_impl(ctx):
             ))
         by_name[library.basename] = library
 
-    if not by_name:
-        fail("system_libraries requires at least one file in libs")
+    executables = merge_sources(ctx, ctx.attr.executables)
+    if not by_name and not executables:
+        fail("system_libraries requires at least one file in libs or executables")
 
     args = ctx.actions.args()
     inputs = []
@@ -71,6 +72,22 @@ def _system_libraries_impl(ctx):
         args.add("--library", "{}={}".format(name, library.path))
         inputs.append(library)
 
+    # The executables are only read, for their dependencies; the libraries of
+    # the closure come out of the sysroot and are referenced from there.
+    sysroot = []
+    if executables:
+        sysroot = ctx.files.sysroot
+        if not sysroot:
+            fail("system_libraries needs a sysroot to resolve the dependencies of executables in")
+        args.add_all(executables, before_each = "--executable")
+        for f in sysroot:
+            if f.is_directory:
+                args.add("--sysroot", f.path)
+            else:
+                args.add("--sysroot-file", "/{}={}".format(package_relative_path(f), f.path))
+        args.add_all(ctx.attr.search_dirs, before_each = "--search-dir")
+        args.add("--usr-merged" if ctx.attr.usr_merged else "--usr-merged=false")
+
     args.add("--lib-dir", lib_dir)
     args.add("--ld-so-conf" if ctx.attr.ldso_conf else "--ld-so-conf=false")
     args.add("--ld-so-cache" if ctx.attr.ldso_cache else "--ld-so-cache=false")
@@ -89,9 +106,10 @@ def _system_libraries_impl(ctx):
         args,
         # The libraries are inputs to this action (their ELF headers are read to
         # find each SONAME) and are also referenced by path from the metadata,
-        # so the layer action needs them too.
-        inputs = [inputs],
-        referenced_files = [depset(inputs)],
+        # so the layer action needs them too. Any file of the sysroot may end
+        # up in the closure.
+        inputs = [inputs + executables + sysroot],
+        referenced_files = [depset(inputs + sysroot)],
     )
 
 system_libraries = rule(
@@ -108,6 +126,17 @@ An `/etc/ld.so.conf.d` fragment records the library directory, and a prebuilt
 `/etc/ld.so.cache` can be generated so the loader does not have to scan at
 startup.
 
+Instead of listing every library, name the `executables` the image runs and a
+`sysroot` to take libraries from: the shared library closure of the executables
+is resolved the way the dynamic linker resolves it (`DT_NEEDED`, `DT_RPATH` and
+`DT_RUNPATH`, then the standard library directories), and every library in it
+is placed like a listed one. The dynamic linker the executables name (their
+`PT_INTERP`, e.g. `/lib64/ld-linux-x86-64.so.2`) is placed at that path, under
+`/usr` when `usr_merged` makes `/lib64` a symlink. A dependency the sysroot
+does not hold fails the build with a list of every missing library and what
+needs it. The executables themselves are not placed; add them with a layer as
+usual.
+
 Every file in `libs` must be an ELF shared object; anything else fails the
 build. To pull the shared libraries out of a `cc_library`, name its output files
 directly, or use a `filegroup` with the relevant output group -- this rule takes
@@ -131,6 +160,18 @@ system_libraries(
     libdir_layout = "multiarch",
 )
 ```
+
+A minimal glibc base for a C++ binary, with libraries taken from an extracted
+Debian root filesystem:
+
+```python
+system_libraries(
+    name = "server_libs",
+    executables = ["//server"],
+    sysroot = ["@bookworm_rootfs//:files"],
+    ldso_cache = True,
+)
+```
 """,
     attrs = base_content_attrs({
         "libs": attr.label_list(
@@ -141,11 +182,38 @@ library are fine; two different files that would land at the same name are an
 error.""",
             allow_files = True,
         ),
+        "executables": attr.label_list(
+            doc = """Executables whose shared library closure is placed.
+
+Their `DT_NEEDED` entries are resolved, transitively, in `sysroot`. Libraries in
+`libs` are part of the closure too: they satisfy dependencies by their names,
+and their own dependencies are resolved.""",
+            allow_files = True,
+        ),
+        "sysroot": attr.label_list(
+            doc = """The root filesystem the dependencies of `executables` are taken from.
+
+Either directories (tree artifacts) laid out like the image, or loose files,
+whose path in the image is their path relative to the package they belong to:
+`@bookworm_rootfs//:usr/lib/x86_64-linux-gnu/libc.so.6` is
+`/usr/lib/x86_64-linux-gnu/libc.so.6`. Symlinks inside a directory resolve
+within it.""",
+            allow_files = True,
+        ),
+        "search_dirs": attr.string_list(
+            doc = """Directories of the sysroot searched for dependencies after an object's own `DT_RPATH` and `DT_RUNPATH`.
+
+Defaults to what the dynamic linker of a typical distribution searches: the
+Debian multiarch directories for the target's machine, `/lib64` and
+`/usr/lib64` on 64-bit machines, then `/lib` and `/usr/lib`.""",
+        ),
         "usr_merged": attr.bool(
             default = True,
             doc = """Whether the image uses the merged-`/usr` layout.
 
-When True, libraries go under `/usr/lib`; when False, under `/lib`.
+When True, libraries go under `/usr/lib`, and so does the dynamic linker of
+`executables` when its `PT_INTERP` names `/lib` or `/lib64`; when False, they
+go under `/lib`.
 
 Set the same value on `linux_skeleton`, which is what creates the
 `/lib -> usr/lib` symlink. Mismatching them fails the build: placing a library
@@ -172,7 +240,9 @@ whose libraries are unreachable.""",
 
 The cache is glibc-specific; musl ignores the file entirely. It saves the loader
 a directory scan at startup, at the cost of a file that must be regenerated
-whenever the library set changes -- which is why it is off by default.""",
+whenever the library set changes -- which is why it is off by default. With
+`executables`, the cache is written from the same closure as the libraries, so
+it cannot fall out of step with them.""",
         ),
         "default_metadata": attr.string(
             doc = """JSON-encoded metadata applied to every placed library.
@@ -13,13 +13,15 @@ def _trust_store_impl(ctx):
     certs = merge_sources(ctx, ctx.attr.certs)
     debs = merge_sources(ctx, ctx.attr.debs)
     rpms = merge_sources(ctx, ctx.attr.rpms)
-    if not certs and not debs and not rpms:
-        fail("trust_store requires at least one of certs, debs or rpms")
+    apks = merge_sources(ctx, ctx.attr.apks)
+    if not certs and not debs and not rpms and not apks:
+        fail("trust_store requires at least one of certs, debs, rpms or apks")
 
     args = ctx.actions.args()
     args.add_all(certs, before_each = "--cert")
     args.add_all(debs, before_each = "--deb")
     args.add_all(rpms, before_each = "--rpm")
+    args.add_all(apks, before_each = "--apk")
 
     args.add("--bundle" if ctx.attr.bundle else "--bundle=false")
     args.add("--bundle-path", ctx.attr.bundle_path)
@@ -31,7 +33,7 @@ def _trust_store_impl(ctx):
     if ctx.attr.mode:
         args.add("--mode", ctx.attr.mode)
 
-    return run_base_verb(ctx, ["trust-store"], args, inputs = [certs + debs + rpms])
+    return run_base_verb(ctx, ["trust-store"], args, inputs = [certs + debs + rpms + apks])
 
 trust_store = rule(
     implementation = _trust_store_impl,
@@ -92,6 +94,14 @@ Only files under the standard CA certificate directories are read.""",
 Only files under the standard CA certificate directories are read.""",
             allow_files = True,
         ),
+        "apks": attr.label_list(
+            doc = """Alpine (`.apk`) packages to harvest certificates from.
+
+Only files under the standard CA certificate directories are read. Alpine ships
+the individual certificates in `ca-certificates` and the concatenated bundle in
+`ca-certificates-bundle`; either will do.""",
+            allow_files = True,
+        ),
         "bundle": attr.bool(
             default = True,
             doc = "Whether to write a single concatenated PEM bundle.",
@@ -0,0 +1,151 @@
+"""Rule describing the time zone data of a base image."""
+
+load("//img/private/base_images:common.bzl", "SCOPE_UNIX", "base_content_attrs", "empty_content", "in_scope", "merge_sources", "package_relative_path", "run_base_verb")
+load("//img/private/common:build.bzl", "TOOLCHAINS")
+load("//img/private/providers:base_image_content_info.bzl", "BaseImageContentInfo")
+
+def _zoneinfo_name(f, zoneinfo_dir):
+    """Returns the zone name of a loose zoneinfo file.
+
+    That is its path relative to its package, minus the zoneinfo directory when
+    the package holds an extracted root filesystem.
+    """
+    name = package_relative_path(f)
+    prefix = zoneinfo_dir.strip("/") + "/"
+    if name.startswith(prefix):
+        name = name[len(prefix):]
+    return name
+
+def _tzdata_impl(ctx):
+    if not in_scope(ctx, SCOPE_UNIX):
+        return empty_content()
+
+    srcs = merge_sources(ctx, ctx.attr.srcs)
+    zoneinfo = merge_sources(ctx, ctx.attr.zoneinfo)
+    if srcs and zoneinfo:
+        fail("tzdata takes either srcs to compile or a compiled zoneinfo tree, not both")
+    if not srcs and not zoneinfo:
+        fail("tzdata requires srcs or zoneinfo")
+
+    args = ctx.actions.args()
+
+    # The zone tables (zone1970.tab and friends) ship next to the sources and
+    # are copied rather than compiled.
+    tables = [f for f in srcs if f.extension == "tab"]
+    sources = [f for f in srcs if f.extension != "tab"]
+    if srcs and not sources:
+        fail("tzdata srcs hold only .tab files; add the tz source files to compile, e.g. tzdata.zi")
+    args.add_all(sources, before_each = "--source")
+    args.add_all(tables, before_each = "--table")
+    for f in zoneinfo:
+        if f.is_directory:
+            args.add("--zoneinfo", f.path)
+        else:
+            args.add("--zoneinfo-file", "{}={}".format(_zoneinfo_name(f, ctx.attr.zoneinfo_dir), f.path))
+
+    args.add_all(ctx.attr.zones, before_each = "--zone")
+    args.add("--zoneinfo-dir", ctx.attr.zoneinfo_dir)
+    if ctx.attr.localtime:
+        args.add("--localtime", ctx.attr.localtime)
+    args.add("--timezone-file" if ctx.attr.timezone_file else "--timezone-file=false")
+    if ctx.attr.mode:
+        args.add("--mode", ctx.attr.mode)
+
+    return run_base_verb(
+        ctx,
+        ["tzdata"],
+        args,
+        # Compiled zones are written inline; the tables and a copied zoneinfo
+        # tree are referenced by path.
+        inputs = [srcs + zoneinfo],
+        referenced_files = [depset(tables + zoneinfo)],
+    )
+
+tzdata = rule(
+    implementation = _tzdata_impl,
+    doc = """Describes the time zone data of a base image and the zone it runs in.
+
+The zone files can be compiled from the text sources of the
+[IANA time zone database](https://www.iana.org/time-zones) -- the
+per-continent files (`africa`, `europe`, ..., `backward`) or the single
+`tzdata.zi` -- the way `zic` builds a distribution's tzdata package, with
+transitions through 2037 and a POSIX TZ string for every time after. Or an
+already compiled zoneinfo tree, e.g. out of a tzdata package, is copied as it
+is.
+
+`zones` narrows the tree to the zones the image actually uses; most images
+need a handful rather than the full database. Links among the selected names
+stay symlinks and bring their targets along.
+
+`localtime` sets the zone the image runs in: `/etc/localtime` becomes a
+symlink into the zoneinfo tree, and `/etc/timezone` names the zone for the
+readers that look there instead.
+
+This rule applies to any Unix target platform. On any other platform it is a
+no-op that contributes nothing to the layer.
+
+Example:
+
+```python
+load("@rules_img//img:base_images.bzl", "tzdata")
+
+tzdata(
+    name = "tz",
+    srcs = ["@tzdata//:tzdata.zi"],
+    zones = [
+        "Etc/UTC",
+        "Europe/Berlin",
+        "America/New_York",
+    ],
+    localtime = "Etc/UTC",
+)
+```
+""",
+    attrs = base_content_attrs({
+        "srcs": attr.label_list(
+            doc = """IANA tz source files to compile.
+
+Either the per-continent files (`africa`, `antarctica`, `asia`, `australasia`,
+`europe`, `northamerica`, `southamerica`, `etcetera`, `backward`) or the
+condensed `tzdata.zi`. Files ending in `.tab` (`zone1970.tab`, `iso3166.tab`)
+are copied into the zoneinfo directory instead. Leap second files are not
+supported. Mutually exclusive with `zoneinfo`.""",
+            allow_files = True,
+        ),
+        "zoneinfo": attr.label_list(
+            doc = """A compiled zoneinfo tree to copy.
+
+Either directories (tree artifacts) laid out like `/usr/share/zoneinfo`, or
+loose files, named by their path relative to the package they belong to with
+any leading `zoneinfo_dir` removed: `@tzdata_deb//:usr/share/zoneinfo/Europe/Berlin`
+is the zone `Europe/Berlin`. Mutually exclusive with `srcs`.""",
+            allow_files = True,
+        ),
+        "zones": attr.string_list(
+            doc = """Names of the zones to include, e.g. `Europe/Berlin`. Defaults to every zone.
+
+A link is included as a link, together with the zone it points at. The
+`localtime` zone is always included. With a copied tree, files that are not
+zones (the `.tab` tables) are kept regardless.""",
+        ),
+        "localtime": attr.string(
+            doc = """The zone the image runs in, e.g. `Etc/UTC`.
+
+`/etc/localtime` becomes a symlink to it. Left empty, neither `/etc/localtime`
+nor `/etc/timezone` is written, and programs fall back to UTC.""",
+        ),
+        "timezone_file": attr.bool(
+            default = True,
+            doc = "Whether to also write `/etc/timezone` naming the `localtime` zone, as Debian does.",
+        ),
+        "zoneinfo_dir": attr.string(
+            default = "/usr/share/zoneinfo",
+            doc = "Directory of the zoneinfo tree inside the image.",
+        ),
+        "mode": attr.string(
+            doc = """Octal mode of the zone files, e.g. `"0644"`. Defaults to `0644`.""",
+        ),
+    }),
+    toolchains = TOOLCHAINS,
+    provides = [BaseImageContentInfo],
+)
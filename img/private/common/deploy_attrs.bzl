@@ -226,6 +226,24 @@ when signing is enabled (see `sign`).
 """,
         providers = [SigningConfigInfo],
     ),
+    provenance = attr.string(
+        doc = """Whether `img deploy` attests the SLSA provenance of this image when signing it.
+
+- **`auto`** (default): defer to the global `--@rules_img//img/settings:provenance` flag.
+- **`enabled`**: attest provenance; requires signing (see `sign`).
+- **`disabled`**: never attest provenance.
+
+The attestation is an in-toto Statement with a SLSA v1 provenance predicate
+recording the builder ID (`--@rules_img//img/settings:provenance_builder_id`,
+overridable with `img deploy --provenance_builder_id`), the label of this
+target, the workspace status values of a stamped build and the digest of the
+pulled base image. It is signed by the signer plugin of `sign_setting` and
+attached as a referrer of the pushed root, next to its signature. See
+[image signing](/docs/image-signing.md#provenance-attestations).
+""",
+        default = "auto",
+        values = ["auto", "enabled", "disabled"],
+    ),
     push_at_build_time = attr.string(
         doc = """Whether image content is pushed to the registry *during the build*.
 
@@ -409,6 +427,14 @@ Only consulted when push at build time is active (see `push_at_build_time`).
         default = Label("//img/settings:sign_setting"),
         providers = [SigningConfigInfo],
     ),
+    _provenance = attr.label(
+        default = Label("//img/settings:provenance"),
+        providers = [BuildSettingInfo],
+    ),
+    _provenance_builder_id = attr.label(
+        default = Label("//img/settings:provenance_builder_id"),
+        providers = [BuildSettingInfo],
+    ),
     _push_settings = attr.label(
         default = Label("//img/private/settings:push"),
         providers = [PushSettingsInfo],
@@ -8,6 +8,7 @@ load("//img/private/providers:manifest_info.bzl", "ImageManifestInfo")
 load("//img/private/providers:push_at_build_time_settings_info.bzl", "PushAtBuildTimeSettingsInfo")
 load("//img/private/providers:push_settings_info.bzl", "PushSettingsInfo")
 load("//img/private/providers:signing_config_info.bzl", "SigningConfigInfo")
+load("//img/private/providers:stamp_setting_info.bzl", "StampSettingInfo")
 
 # Sentinel default for the per-target `push_at_build_time_blob_repository` and
 # `push_at_build_time_manifest_repository` string attributes. Left at this
@@ -324,19 +325,30 @@ def resolve_signing(ctx):
     """Resolve whether and how this push target is signed.
 
     Combines the per-target `sign` attribute (auto -> global //img/settings:sign)
-    with the `sign_setting` attribute (or global //img/settings:sign_setting).
+    with the `sign_setting` attribute (or global //img/settings:sign_setting),
+    and the `provenance` attribute (auto -> global //img/settings:provenance).
 
     Args:
-        ctx: Rule context with sign/sign_setting attributes and _sign/_sign_setting.
+        ctx: Rule context with sign/sign_setting/provenance attributes and
+            _sign/_sign_setting/_provenance/_provenance_builder_id/_stamp_settings.
 
     Returns:
-        A struct(config_info, best_effort, targets) when signing is active, or
-        None when signing is disabled or best-effort with no configured setting.
+        A struct(config_info, best_effort, targets, provenance) when signing is
+        active, or None when signing is disabled or best-effort with no
+        configured setting. provenance is None or a struct(builder_id, stamp)
+        telling the push metadata to record a provenance attestation; stamp is
+        whether to record the workspace status values.
     """
+    provenance_mode = ctx.attr.provenance
+    if provenance_mode == "auto":
+        provenance_mode = ctx.attr._provenance[BuildSettingInfo].value
+
     mode = ctx.attr.sign
     if mode == "auto":
         mode = ctx.attr._sign[BuildSettingInfo].value
     if mode == "disabled":
+        if ctx.attr.provenance == "enabled":
+            fail("provenance is 'enabled' but signing is disabled; provenance attestations are signed with the image's sign_setting, so set 'sign' or --@rules_img//img/settings:sign")
         return None
 
     config_info = ctx.attr.sign_setting[SigningConfigInfo] if ctx.attr.sign_setting != None else ctx.attr._sign_setting[SigningConfigInfo]
@@ -345,8 +357,18 @@ def resolve_signing(ctx):
             fail("sign is 'enabled' but no sign_setting is configured; set the 'sign_setting' attribute or --@rules_img//img/settings:sign_setting")
         return None  # best_effort with no configured setting: nothing to sign
 
+    provenance = None
+    if provenance_mode == "enabled":
+        stamp_settings = ctx.attr._stamp_settings[StampSettingInfo]
+        stamp = ctx.attr.stamp if ctx.attr.stamp != "auto" else stamp_settings.user_preference
+        provenance = struct(
+            builder_id = ctx.attr._provenance_builder_id[BuildSettingInfo].value,
+            stamp = stamp == "force" or (stamp == "auto" and stamp_settings.bazel_setting),
+        )
+
     return struct(
         config_info = config_info,
         best_effort = mode == "best_effort",
         targets = config_info.targets,
+        provenance = provenance,
     )
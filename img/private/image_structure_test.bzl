@@ -1,8 +1,9 @@
 """`image_structure_test`: validate an image's structure from its config + mtree.
 
 This provides a container-structure-test-compatible test rule that checks a
-container image using only its image config JSON and its mtree filesystem
-listing -- never the layer blobs. An aspect on the `image` attribute normalizes
+container image using its image config JSON and its mtree filesystem listing.
+The layer blobs (or compact streams) enter the test only when it opts into
+`layer_contents`, for `fileContentTests`, or `run_commands`, for `commandTests`. An aspect on the `image` attribute normalizes
 any supported image (a rules_img `image_manifest`/`image_index`, or an OCI image
 layout directory as produced by rules_oci) into an `ImageStructureTestInfo`, and
 the test rule wraps the `img image-structure-test` subcommand with the hermetic
@@ -67,6 +68,46 @@ def _manifest_image(manifest_info):
     )
     return image, files
 
+def _layer_contents(manifest_info):
+    """Layer entries + runfiles files for reading a rules_img manifest's file contents.
+
+    Each tar layer contributes its blob, or -- in compact-stream mode -- its
+    compact stream plus the content-addressed directory of its input files. A
+    layer with neither (a shallow base layer) is recorded as an empty entry, so
+    the test knows the paths it may have changed are unknown. Non-tar layers are
+    not part of the filesystem and are skipped.
+
+    Returns (layers_list, files_list).
+    """
+    layers = []
+    files = []
+    for layer in manifest_info.layers:
+        if "tar" not in (layer.media_type or ""):
+            continue
+        if layer.blob != None:
+            layers.append(struct(blob = launcher.to_rlocation_path(layer.blob)))
+            files.append(layer.blob)
+        elif layer.compact_stream != None and layer.layer_input_files_cas != None:
+            layers.append(struct(
+                compact_stream = launcher.to_rlocation_path(layer.compact_stream),
+                cas_dir = launcher.to_rlocation_path(layer.layer_input_files_cas),
+            ))
+            files.append(layer.compact_stream)
+            files.append(layer.layer_input_files_cas)
+        else:
+            layers.append(struct())
+    return layers, files
+
+def _with_layers(image, layers):
+    """Returns the spec entry `image` with its `layers` set."""
+    return struct(
+        platform = image.platform,
+        config = image.config,
+        mtree = image.mtree,
+        complete = image.complete,
+        layers = layers,
+    )
+
 def _has_output_group_pairs(target):
     """Whether `target` exposes both the `mtree` and `oci_image_config` output groups."""
     if OutputGroupInfo not in target:
@@ -129,28 +170,48 @@ def _oci_layout_metadata(ctx, name, layout_dir):
     return meta_tree
 
 def _image_structure_test_aspect_impl(target, ctx):
-    if ImageManifestInfo in target:
-        image, runfiles_files = _manifest_image(target[ImageManifestInfo])
-        spec = struct(images = [image])
-    elif ImageIndexInfo in target:
+    # The content spec additionally lists each image's layers, for tests with
+    # `layer_contents = True`; content_files are the layer files it references.
+    content_spec = None
+    content_files = []
+    if ImageManifestInfo in target or ImageIndexInfo in target:
+        if ImageManifestInfo in target:
+            manifest_infos = [target[ImageManifestInfo]]
+        else:
+            manifest_infos = target[ImageIndexInfo].manifests
         images = []
+        content_images = []
         runfiles_files = []
-        for manifest_info in target[ImageIndexInfo].manifests:
+        for manifest_info in manifest_infos:
             image, files = _manifest_image(manifest_info)
+            layers, layer_files = _layer_contents(manifest_info)
             images.append(image)
+            content_images.append(_with_layers(image, layers))
             runfiles_files.extend(files)
+            content_files.extend(layer_files)
         spec = struct(images = images)
+        content_spec = struct(images = content_images)
     elif _has_output_group_pairs(target):
         # A non-rules_img source that publishes prebuilt mtree + config JSON via
         # output groups. Preferred over extracting from an OCI layout directory.
+        # Output groups carry no layers, so there is no content spec.
         images, runfiles_files = _output_group_images(target)
         spec = struct(images = images)
     else:
         default_files = target[DefaultInfo].files.to_list()
         if len(default_files) == 1 and default_files[0].is_directory:
-            meta_tree = _oci_layout_metadata(ctx, "{}.structuretest".format(target.label.name), default_files[0])
+            layout_dir = default_files[0]
+            meta_tree = _oci_layout_metadata(ctx, "{}.structuretest".format(target.label.name), layout_dir)
             spec = struct(layout_trees = [launcher.to_rlocation_path(meta_tree)])
             runfiles_files = [meta_tree]
+
+            # The layer blob paths in the tree's images.json are relative to the
+            # layout, so the content spec ships the layout itself.
+            content_spec = struct(
+                layout_trees = [launcher.to_rlocation_path(meta_tree)],
+                layout_dirs = [launcher.to_rlocation_path(layout_dir)],
+            )
+            content_files = [layout_dir]
         else:
             fail("image_structure_test: `image` must provide ImageManifestInfo or " +
                  "ImageIndexInfo (rules_img image_manifest/image_index), expose `mtree` " +
@@ -160,7 +221,16 @@ def _image_structure_test_aspect_impl(target, ctx):
 
     spec_file = ctx.actions.declare_file("{}.image_structure_spec.json".format(target.label.name))
     ctx.actions.write(spec_file, json.encode(spec))
-    return [ImageStructureTestInfo(spec = spec_file, files = depset(runfiles_files))]
+    content_spec_file = spec_file
+    if content_spec != None:
+        content_spec_file = ctx.actions.declare_file("{}.image_structure_content_spec.json".format(target.label.name))
+        ctx.actions.write(content_spec_file, json.encode(content_spec))
+    return [ImageStructureTestInfo(
+        spec = spec_file,
+        files = depset(runfiles_files),
+        content_spec = content_spec_file,
+        content_files = depset(content_files),
+    )]
 
 _image_structure_test_aspect = aspect(
     implementation = _image_structure_test_aspect_impl,
@@ -173,18 +243,26 @@ _image_structure_test_aspect = aspect(
 def _image_structure_test_impl(ctx):
     input = ctx.attr.image[ImageStructureTestInfo]
     deploy_tool_info = ctx.attr._deploy_tool[DeployToolInfo]
+    spec = input.spec
+    transitive_files = [input.files]
+    if ctx.attr.layer_contents or ctx.attr.run_commands:
+        spec = input.content_spec
+        transitive_files.append(input.content_files)
 
-    request = ctx.actions.declare_file(ctx.label.name + ".request.json")
-    ctx.actions.write(request, json.encode(struct(
-        spec = launcher.to_rlocation_path(input.spec),
+    request = dict(
+        spec = launcher.to_rlocation_path(spec),
         configs = [launcher.to_rlocation_path(config) for config in ctx.files.configs],
-    )))
+    )
+    if ctx.attr.run_commands:
+        request["run_commands"] = True
+    request_file = ctx.actions.declare_file(ctx.label.name + ".request.json")
+    ctx.actions.write(request_file, json.encode(request))
 
     stub = ctx.actions.declare_file(ctx.label.name + ".exe")
     embedded_args, transformed_args = launcher.args_from_entrypoint(executable_file = deploy_tool_info.img_deploy_exe)
     embedded_args.extend(["image-structure-test", "--request"])
     embedded_args, transformed_args = launcher.append_runfile(
-        file = request,
+        file = request_file,
         embedded_args = embedded_args,
         transformed_args = transformed_args,
     )
@@ -197,8 +275,8 @@ def _image_structure_test_impl(ctx):
     )
 
     runfiles = ctx.runfiles(
-        files = [deploy_tool_info.img_deploy_exe, request, input.spec] + ctx.files.configs,
-        transitive_files = input.files,
+        files = [deploy_tool_info.img_deploy_exe, request_file, spec] + ctx.files.configs,
+        transitive_files = depset(transitive = transitive_files),
     )
     return [DefaultInfo(executable = stub, runfiles = runfiles)]
 
@@ -208,18 +286,44 @@ image_structure_test = rule(
 
 `image_structure_test` is a lightweight, hermetic analogue of
 [container-structure-test](https://github.com/GoogleContainerTools/container-structure-test):
-it accepts the same YAML/JSON config files, but validates the image using only its
-image config JSON and its mtree filesystem listing -- it never materializes the
-layer blobs into the test. Because of that, checks that require a running container
-or file contents are not supported and cause a clear failure (so a migrated config
+it accepts the same YAML/JSON config files, but validates the image using its
+image config JSON and its mtree filesystem listing -- by default it never
+materializes the layer blobs into the test. Checks that require a running
+container are not supported and cause a clear failure (so a migrated config
 tells you exactly what won't port):
 
 - **Supported** (`metadataTest`): env / envVars, labels, entrypoint, cmd,
   exposedPorts, volumes, workdir, user -- validated against the image config JSON.
 - **Supported** (`fileExistenceTests`): path, shouldExist, permissions, uid, gid,
   isExecutableBy -- validated against the image mtree.
-- **Rejected**: `commandTests` (require running the container), `fileContentTests`
-  (require file bytes), `licenseTests` (require scanning a running container).
+- **Supported with `layer_contents = True`** (`fileContentTests`): path,
+  expectedContents, excludedContents -- regexes matched against the file's bytes
+  in the merged filesystem of the image's layers (whiteouts applied, symlinks
+  followed).
+- **Supported with `run_commands = True`** (`commandTests`): command, args,
+  setup, teardown, envVars, exitCode, expectedOutput, excludedOutput,
+  expectedError, excludedError -- the command runs in the extracted image
+  filesystem, as the image's user, with its env and working directory.
+- **Rejected**: `licenseTests` (require scanning a running container).
+
+`layer_contents` adds each layer to the test runfiles: the layer blob, or for a
+compact-stream layer its `.cstream` plus the content-addressed directory of its
+input files (no full tar is rebuilt). A layer without content, such as a shallow
+base layer, leaves the files it may have changed unknown, and tests on them fail
+with a message saying so. A target exposing only `mtree` and `oci_image_config`
+output groups has no layers to offer.
+
+`run_commands` implies `layer_contents`. No container runtime or daemon is
+involved: for each command test, the merged filesystem is extracted into a fresh
+temporary directory, and `img` runs the command there in new unprivileged user,
+mount, PID, network, IPC and UTS namespaces: the command sees only its own
+processes in a fresh `/proc`, only a loopback network interface, and the
+hostname `localhost`, and the image's `/dev` gets the host's basic device nodes.
+This requires a Linux host that allows unprivileged user namespaces, and an
+image for the host's architecture; on other hosts, and for images of other
+platforms, the command tests are reported as skipped. Every layer must have
+content, so an image on a shallow base cannot run commands. All files belong to
+the image user, and device nodes in the layers are not created.
 
 The `image` may be a rules_img `image_manifest` or `image_index`, a target that
 exposes prebuilt `mtree` and `oci_image_config` output groups (paired positionally
@@ -237,6 +341,22 @@ image_structure_test(
     configs = ["testdata/hello.yaml"],
     image = ":hello",
 )
+
+# With fileContentTests in the config:
+image_structure_test(
+    name = "hello_content_test",
+    configs = ["testdata/hello_content.yaml"],
+    image = ":hello",
+    layer_contents = True,
+)
+
+# With commandTests in the config:
+image_structure_test(
+    name = "hello_command_test",
+    configs = ["testdata/hello_commands.yaml"],
+    image = ":hello",
+    run_commands = True,
+)
 ```
 """,
     attrs = {
@@ -250,6 +370,14 @@ image_structure_test(
             mandatory = True,
             allow_files = [".yaml", ".yml", ".json"],
         ),
+        "layer_contents": attr.bool(
+            doc = "Ship the image's layers (blobs, or compact streams plus their CAS directories) to the test so `fileContentTests` can read file contents.",
+            default = False,
+        ),
+        "run_commands": attr.bool(
+            doc = "Run `commandTests` in an unprivileged sandbox holding the extracted image filesystem (Linux hosts only; implies `layer_contents`).",
+            default = False,
+        ),
         "_deploy_tool": attr.label(
             default = Label("//img/deploy_tool/for_host"),
             providers = [DeployToolInfo],
@@ -25,6 +25,14 @@ An entry whose content comes from a real file records that file's path, so the
 file must be available to the action that builds the layer. Content generated by
 the rule itself is stored inline in the metadata instead and contributes nothing
 here.
+""",
+    env = """\
+Dict of environment variables the content needs in the image config.
+
+Some content only takes effect through the environment: a locale is selected by
+`LANG`, not by the files that define it. `base_image_layer` merges the `env` of
+its srcs, later srcs winning, and passes the result on to `image_manifest`. An
+empty dict for content that needs none.
 """,
 )
 
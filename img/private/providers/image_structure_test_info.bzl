@@ -13,6 +13,10 @@ FIELDS = dict(
            "or an OCI layout metadata tree to be read at run time.",
     files = "depset[File]: every config + mtree file (or the OCI layout metadata tree) " +
             "the spec references, to be placed in the test runfiles. Never contains layer blobs.",
+    content_spec = "File: the images spec JSON extended with each image's layers, for reading " +
+                   "file contents. The same File as `spec` when the image offers no layers.",
+    content_files = "depset[File]: the layer files (blobs, compact streams and CAS directories, " +
+                    "or the OCI layout directory) the content spec adds to `spec`.",
 )
 
 ImageStructureTestInfo = provider(
@@ -20,7 +20,7 @@ FIELDS = dict(
     stamp = "Stamp preference string ('auto', 'force', 'disabled').",
     stamp_settings = "StampSettingInfo provider for stamp resolution.",
     tracks_content = "Bool: when True, expose the image digest to templates and re-stamp tags on content change.",
-    signing = "struct(config_info, best_effort, targets) describing how to sign this push, or None.",
+    signing = "struct(config_info, best_effort, targets, provenance) describing how to sign this push (and whether to attest its provenance), or None.",
     blob_repository = "Resolved staging repository that image blobs are pushed to and cross-mounted from. At build time every blob (layers and config) is staged here; layers are cross-mounted into the image's real repository. Empty means blobs go to the image's own repository.",
     forbid_layer_push = "Bool: when True, `img deploy` refuses to upload layer blob bytes (layers must be cross-mounted or already present).",
     deduplicated_push = "Resolved deduplicated push mode: 'disabled', 'best_effort' or 'enabled'. When not 'disabled', `img deploy` pushes in phases -- check which manifests the registry already has, upload each blob that several repositories need to just one of them (the first alphabetically, or a staging/pinned repository), then cross-mount it into the others. For registries that keep a separate blob store per repository name. 'enabled' requires cross-repository blob mounting and fails a push where mounting is refused; 'best_effort' uploads the layer the ordinary way instead. See docs/registry-support.md.",
@@ -111,8 +111,8 @@ def compute_push_metadata(
         pull_info: PullInfo or None (for original registry/repository/tag/digest).
         destination_file: File containing {registry}/{repository}, or None.
         output_prefix: String prefix for declared output files.
-        signing: struct(config_info, best_effort, targets) to enable signing of
-            this push, or None.
+        signing: struct(config_info, best_effort, targets, provenance) to enable
+            signing (and provenance attestation) of this push, or None.
         blob_repository: Staging repository for layer blobs, or "" (recorded in the
             deploy manifest so both push-at-build-time and `bazel run` honor it).
         forbid_layer_push: When True, records in the deploy manifest that layer
@@ -249,6 +249,20 @@ def compute_push_metadata(
         for target in signing.targets:
             args.add("--sign-target", target)
 
+        # Provenance: record the build invocation the deploy tool attests for
+        # the pushed root. The workspace status files are only read when the
+        # build is stamped.
+        if signing.provenance != None:
+            args.add("--provenance")
+            args.add("--provenance-target", str(ctx.label))
+            if signing.provenance.builder_id:
+                args.add("--provenance-builder-id", signing.provenance.builder_id)
+            if signing.provenance.stamp:
+                for status_file in [ctx.info_file, ctx.version_file]:
+                    if status_file:
+                        inputs.append(status_file)
+                        args.add("--provenance-stamp-file", status_file.path)
+
     outputs = []
     layer_hints_file = layer_hints_for_deploy_metadata(
         ctx,
@@ -7,6 +7,7 @@ load("//img/private/platforms:constraints.bzl", "map_os_arch_to_constraints")
 load("//img/private/platforms:platforms.bzl", "has_constraint_setting")
 load(
     ":download.bzl",
+    _auth_environment = "auth_environment",
     _download_blob = "download_blob",
     _download_layers = "download_layers",
     _download_manifest_rctx = "download_manifest_rctx",
@@ -15,6 +16,32 @@ load(
 )
 load(":registry.bzl", "get_registries")
 
+def _verify_signature(rctx, *, registries, digest):
+    """Check the pulled digest for a valid signature using a host-installed signer plugin.
+
+    Args:
+        rctx: Repository context.
+        registries: Registries to pull from; the first one is asked for referrers.
+        digest: The digest of the image (or index) to verify.
+    """
+    tool = tool_for_repository_os(rctx)
+    subject = "{}/{}@{}".format(registries[0], rctx.attr.repository, digest)
+    args = [
+        rctx.path(tool),
+        "verify",
+        "--plugin=" + rctx.attr.verify_tool_command,
+    ] + ["--plugin_arg=" + arg for arg in rctx.attr.verify_args] + [subject]
+
+    # Relative paths in verify_args (public keys, trust roots) resolve against
+    # the main repository, like the paths in a signing_config.
+    result = rctx.execute(
+        args,
+        environment = _auth_environment(rctx),
+        working_directory = str(rctx.workspace_root),
+    )
+    if result.return_code != 0:
+        fail("signature verification of {} failed: {}".format(subject, result.stderr))
+
 def _pull_impl(rctx):
     """Pull an image from a registry and generate a BUILD file."""
     have_valid_digest = True
@@ -40,6 +67,13 @@ def _pull_impl(rctx):
     if len(reference) == 0:
         fail("either digest or tag must be specified")
 
+    if rctx.attr.verify_tool_command:
+        if not have_valid_digest:
+            fail("verify_tool_command requires a digest (or unsafe_allow_tag_without_digest to learn one): a signature is checked for a digest, not a tag")
+        _verify_signature(rctx, registries = registries, digest = digest)
+    elif rctx.attr.verify_args:
+        fail("verify_args requires verify_tool_command")
+
     if rctx.attr.downloader == "img_tool":
         # pre-download all files using the img tool
         # here if requested
@@ -299,6 +333,25 @@ pull(
 
 The `digest` parameter is recommended for reproducible builds. If omitted, the rule
 will resolve the tag to a digest at fetch time and print a warning.
+
+Set `verify_tool_command` to refuse images without a valid signature. Before
+anything is downloaded, the rule runs `img verify` with the given signer plugin,
+which checks the referrers of the digest (see [image signing](/docs/image-signing.md#verifying-signatures)):
+
+```starlark
+pull(
+    name = "distroless_static",
+    digest = "sha256:...",
+    registry = "gcr.io",
+    repository = "distroless/static",
+    verify_tool_command = "rules-img-cosign",
+    verify_args = [
+        "--certificate-identity=keyless@distroless.iam.gserviceaccount.com",
+        "--certificate-oidc-issuer=https://accounts.google.com",
+        "--trusted-root=sigstore/trusted_root.json",
+    ],
+)
+```
 """,
     attrs = {
         "registry": attr.string(
@@ -385,6 +438,18 @@ through other means (e.g., content-based tags).
 When enabled, the rule will resolve the tag to a digest at fetch time and use that
 digest, but will not fail if no digest is explicitly provided.""",
         ),
+        "verify_tool_command": attr.string(
+            doc = """Name or path of a host-installed signer plugin that must verify the image's signature.
+
+When set, the rule fails unless the plugin's `verify-oci-artifact` verb accepts one of the
+referrers of the pulled digest. The plugin is resolved on `$PATH`: Bazel-built plugins
+cannot run while repositories are fetched. Requires a digest.""",
+        ),
+        "verify_args": attr.string_list(
+            doc = """Arguments passed to `verify_tool_command` after the `verify-oci-artifact` subcommand.
+
+Relative paths are resolved against the main repository.""",
+        ),
     },
 )
 
@@ -0,0 +1,175 @@
+"""`image_sbom`: write an SPDX or CycloneDX SBOM of an image from its build inputs.
+
+The rule runs `img sbom` over what the build already knows about the image --
+its merged mtree, optionally its layer blobs, base metadata streams and the
+package files it was assembled from -- so no image is unpacked after the fact.
+The SBOM is attached to the image as an OCI referrer with the existing rules: an
+`image_manifest` whose `subject` is the image and whose single layer is the SBOM,
+passed to `image_push` via `referrers`.
+"""
+
+load("//img/private/common:build.bzl", "TOOLCHAIN", "TOOLCHAINS")
+load("//img/private/providers:manifest_info.bzl", "ImageManifestInfo")
+load("//img/private/providers:pull_info.bzl", "PullInfo")
+
+_EXTENSIONS = {
+    "cyclonedx": ".cdx.json",
+    "spdx": ".spdx.json",
+}
+
+def _base_image_reference(pull_info):
+    """The digest reference of a pulled base image, or "" when it is unknown."""
+    if not pull_info.digest:
+        return ""
+    registry = pull_info.registries[0] if pull_info.registries else "docker.io"
+    return "{}/{}@{}".format(registry, pull_info.repository, pull_info.digest)
+
+def _image_sbom_impl(ctx):
+    manifest_info = ctx.attr.image[ImageManifestInfo]
+    output = ctx.actions.declare_file(ctx.label.name + _EXTENSIONS[ctx.attr.format])
+
+    inputs = [manifest_info.manifest]
+    args = ctx.actions.args()
+    args.add("sbom")
+    args.add("--format", ctx.attr.format)
+    args.add("--output", output)
+    args.add("--name", ctx.attr.image_name or str(ctx.attr.image.label))
+    args.add("--manifest", manifest_info.manifest)
+    if ctx.attr.distro:
+        args.add("--distro", ctx.attr.distro)
+    if PullInfo in ctx.attr.image:
+        base_image = _base_image_reference(ctx.attr.image[PullInfo])
+        if base_image:
+            args.add("--base-image", base_image)
+
+    mtree = getattr(manifest_info, "mtree", None)
+    if mtree != None:
+        inputs.append(mtree)
+        args.add("--mtree", mtree)
+    if ctx.attr.scan_layers or mtree == None:
+        # Layer blobs are read in layer order so whiteouts apply; shallow base
+        # layers have no blob and are left out.
+        for layer in manifest_info.layers:
+            if layer.blob != None:
+                inputs.append(layer.blob)
+                args.add("--layer", layer.blob)
+    for f in ctx.files.base_metadata:
+        inputs.append(f)
+        args.add("--base-metadata", f)
+    for f in ctx.files.dpkg_status:
+        inputs.append(f)
+        args.add("--dpkg-status", f)
+    for f in ctx.files.packages:
+        inputs.append(f)
+        args.add("--" + f.extension, f)
+
+    img_toolchain_info = ctx.toolchains[TOOLCHAIN].imgtoolchaininfo
+    ctx.actions.run(
+        inputs = inputs,
+        outputs = [output],
+        executable = img_toolchain_info.tool_exe,
+        arguments = [args],
+        mnemonic = "ImageSBOM",
+        progress_message = "Writing SBOM of %{label}",
+    )
+    return [DefaultInfo(files = depset([output]))]
+
+image_sbom = rule(
+    implementation = _image_sbom_impl,
+    doc = """Writes a software bill of materials of an image as SPDX 2.3 or CycloneDX 1.5 JSON.
+
+The SBOM is computed from the image's build inputs rather than by scanning the
+finished image:
+
+- **Files**, with their sha256 digests and sizes, from the image's mtree (the
+  per-layer mtrees applied in layer order). With `scan_layers`, or when the image
+  has no mtree, the layer blobs are read as well, which also yields SHA1 digests.
+  SPDX requires a SHA1 of every file, so an SPDX document lists only the files
+  read from layer blobs or `base_metadata`, and none from the mtree alone.
+  Shallow base layers, whose blobs are never downloaded, contribute no files.
+- **Packages**, with names, versions and architectures, from the `.deb`, `.rpm`
+  and `.apk` files in `packages`, from dpkg status databases in `dpkg_status`,
+  and from the dpkg status database or apk installed database found in a
+  scanned layer or in `base_metadata`.
+- **The base image**, as the digest reference of the pulled image the image was
+  built on.
+
+The output is deterministic: the creation time is `SOURCE_DATE_EPOCH` when set,
+else the Unix epoch.
+
+To attach the SBOM to the image as an OCI referrer, wrap it in an artifact
+manifest whose subject is the image and push that manifest with the image:
+
+```python
+load("@rules_img//img:image.bzl", "image_manifest")
+load("@rules_img//img:oras.bzl", "oras_file_layer")
+load("@rules_img//img:push.bzl", "image_push")
+load("@rules_img//img:sbom.bzl", "image_sbom")
+
+image_sbom(
+    name = "app_sbom",
+    image = ":app",
+    format = "spdx",
+    image_name = "registry.example.com/team/app",
+    packages = ["@ca_certificates_deb//file"],
+)
+
+oras_file_layer(
+    name = "app_sbom_layer",
+    src = ":app_sbom",
+    media_type = "application/spdx+json",
+)
+
+image_manifest(
+    name = "app_sbom_manifest",
+    artifact_type = "application/spdx+json",
+    config_media_type = "application/vnd.oci.empty.v1+json",
+    layers = [":app_sbom_layer"],
+    subject = ":app",
+)
+
+image_push(
+    name = "push",
+    image = ":app",
+    referrers = [":app_sbom_manifest"],
+    registry = "registry.example.com",
+    repository = "team/app",
+)
+```
+""",
+    attrs = {
+        "image": attr.label(
+            doc = "The single-platform image (an `image_manifest`) the SBOM describes.",
+            mandatory = True,
+            providers = [ImageManifestInfo],
+        ),
+        "format": attr.string(
+            doc = "Format of the SBOM: `spdx` (SPDX 2.3 JSON, written to `<name>.spdx.json`) or `cyclonedx` (CycloneDX 1.5 JSON, written to `<name>.cdx.json`).",
+            default = "spdx",
+            values = ["spdx", "cyclonedx"],
+        ),
+        "image_name": attr.string(
+            doc = "Name of the image in the SBOM, typically its registry and repository. Defaults to the label of `image`.",
+        ),
+        "distro": attr.string(
+            doc = "Distribution used in the package URLs of the image's packages, e.g. `debian`. Defaults to the `ID` of the image's os-release, when a scanned layer or base metadata stream holds one.",
+        ),
+        "scan_layers": attr.bool(
+            doc = "Read the image's layer blobs, not just its mtree. This finds the packages of a dpkg status database or apk installed database in the layers and adds SHA1 digests, which SPDX requires of every file it lists, at the cost of reading every layer. Without it, an SPDX document leaves out the files known only from the mtree.",
+            default = False,
+        ),
+        "packages": attr.label_list(
+            doc = "Debian (`.deb`), RPM (`.rpm`) and Alpine (`.apk`) packages installed in the image.",
+            allow_files = [".deb", ".rpm", ".apk"],
+        ),
+        "dpkg_status": attr.label_list(
+            doc = "dpkg status databases (`var/lib/dpkg/status` or files of `var/lib/dpkg/status.d`) listing packages installed in the image.",
+            allow_files = True,
+        ),
+        "base_metadata": attr.label_list(
+            doc = "Base metadata streams (written by `img base`) whose files and packages the SBOM lists.",
+            allow_files = True,
+        ),
+    },
+    toolchains = TOOLCHAINS,
+)
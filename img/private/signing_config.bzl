@@ -33,6 +33,8 @@ def _signing_config_impl(ctx):
         config["tool"] = ctx.attr.tool_command
     if ctx.attr.args:
         config["args"] = ctx.attr.args
+    if ctx.attr.verify_args:
+        config["verify_args"] = ctx.attr.verify_args
     if ctx.attr.env:
         config["env"] = ctx.attr.env
 
@@ -63,6 +65,11 @@ push binary's runfiles) or as a host-installed command (`tool_command`, resolved
 on `$PATH` at deploy time). Secrets and signing hardware are provided by the
 environment `bazel run` executes in — never by Bazel.
 
+The same plugin verifies signatures for `img verify` and the pre-flight of
+`img deploy --verify`, invoked as `<tool> verify-oci-artifact [verify_args...]`.
+Verification usually needs different arguments than signing (a public key or a
+trusted identity instead of a signing key), hence the separate `verify_args`.
+
 Example:
 
 ```python
@@ -75,6 +82,14 @@ signing_config(
     args = ["--key", "release"],
 )
 
+# Sign with a private key, verify with the matching public key.
+signing_config(
+    name = "cosign",
+    tool = "@rules_img_signer_cosign",
+    args = ["--key", "env://COSIGN_KEY"],
+    verify_args = ["--key", "cosign.pub"],
+)
+
 # Use a host-installed tool.
 signing_config(
     name = "corp",
@@ -99,6 +114,9 @@ Signing is enabled with the `sign` attribute or the `//img/settings:sign` flag.
         "args": attr.string_list(
             doc = "Arguments passed to the plugin after the `sign-oci-artifact` subcommand.",
         ),
+        "verify_args": attr.string_list(
+            doc = "Arguments passed to the plugin after the `verify-oci-artifact` subcommand, when the plugin checks signatures for `img verify` or `img deploy --verify`.",
+        ),
         "env": attr.string_dict(
             doc = "Additional (non-secret) environment variables set for the plugin. Secrets should come from the deploy-time environment instead.",
         ),
@@ -0,0 +1,10 @@
+"""Public API for software bills of materials.
+
+```python
+load("@rules_img//img:sbom.bzl", "image_sbom")
+```
+"""
+
+load("//img/private:sbom.bzl", _image_sbom = "image_sbom")
+
+image_sbom = _image_sbom
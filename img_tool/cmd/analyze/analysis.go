@@ -0,0 +1,357 @@
+package analyze
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OCI layer whiteout markers (see the OCI image-spec layer changeset rules).
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Kinds of a WastedFile.
+const (
+	// wastedOverwritten is a file replaced by an entry of the same path in a
+	// later layer (or later in the same layer).
+	wastedOverwritten = "overwritten"
+	// wastedDeleted is a file removed by a whiteout of a later layer.
+	wastedDeleted = "deleted"
+)
+
+// Report is the result of `img analyze`. It is also the JSON output, so its
+// field names are part of the interface.
+type Report struct {
+	Layers []LayerReport `json:"layers"`
+	// TotalBytes is the content size of all files of all layers, and
+	// WastedBytes the part of it that does not contribute to the final
+	// filesystem: overwritten and deleted files, and duplicated content.
+	TotalBytes  int64   `json:"total_bytes"`
+	WastedBytes int64   `json:"wasted_bytes"`
+	Efficiency  float64 `json:"efficiency"`
+	// WastedFiles lists the overwritten and deleted files, largest first.
+	WastedFiles []WastedFile `json:"wasted_files"`
+	// Duplicates lists the content that more than one layer holds in the
+	// final filesystem, most wasteful first.
+	Duplicates []DuplicateContent `json:"duplicates"`
+	// LargeFiles lists the files at or above the large file threshold in
+	// volatile layers, largest first.
+	LargeFiles []LargeFile `json:"large_files"`
+	// Failures lists the thresholds the image does not meet.
+	Failures []string `json:"failures,omitempty"`
+}
+
+// LayerReport summarizes one layer.
+type LayerReport struct {
+	Index  int    `json:"index"`
+	Source string `json:"source"`
+	Files  int    `json:"files"`
+	Bytes  int64  `json:"bytes"`
+	// WastedBytes is the content of this layer that is overwritten, deleted
+	// or a duplicate of a lower layer.
+	WastedBytes int64 `json:"wasted_bytes"`
+	Volatile    bool  `json:"volatile"`
+}
+
+// WastedFile is a file of a layer that is not part of the final filesystem.
+type WastedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Kind string `json:"kind"`
+	// Layer is the layer holding the file and By the layer that overwrote
+	// or deleted it.
+	Layer int `json:"layer"`
+	By    int `json:"by"`
+	// SameContent is set for a file overwritten with identical content,
+	// e.g. to change its mode or owner.
+	SameContent bool `json:"same_content,omitempty"`
+}
+
+// DuplicateContent is file content that several layers hold.
+type DuplicateContent struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	Copies []Copy `json:"copies"`
+	// WastedBytes counts every layer's copy but that of the lowest layer.
+	WastedBytes int64 `json:"wasted_bytes"`
+}
+
+// Copy is where a layer holds duplicated content. Path is empty for content
+// only known from the layer's content manifest.
+type Copy struct {
+	Layer int    `json:"layer"`
+	Path  string `json:"path,omitempty"`
+}
+
+// LargeFile is a large file in a volatile layer.
+type LargeFile struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Layer int    `json:"layer"`
+}
+
+// analysisOptions configures analyze.
+type analysisOptions struct {
+	// volatile marks the layers expected to change often.
+	volatile map[int]bool
+	// largeFileThreshold is the size from which a file of a volatile layer
+	// is reported.
+	largeFileThreshold int64
+}
+
+// node is a path of the filesystem built by applying the layers in order.
+type node struct {
+	layer int
+	entry entry
+}
+
+// analyze applies the layers in order, as a container runtime would, and
+// accounts for every byte that does not make it into the final filesystem.
+func analyze(layers []*layerFiles, opts analysisOptions) *Report {
+	report := &Report{
+		Layers:      make([]LayerReport, len(layers)),
+		WastedFiles: []WastedFile{},
+		Duplicates:  []DuplicateContent{},
+		LargeFiles:  []LargeFile{},
+	}
+	sizeOf := make(map[string]int64)
+	for i, layer := range layers {
+		report.Layers[i] = LayerReport{Index: i, Source: layer.source, Volatile: opts.volatile[i]}
+		hardlinked := make(map[string]bool)
+		for _, e := range layer.entries {
+			if e.typ != "file" || isWhiteout(e.path) {
+				continue
+			}
+			report.Layers[i].Files++
+			if e.digest != "" {
+				sizeOf[e.digest] = e.size
+			}
+			// Hardlinks share their content, which the tar stores once.
+			if e.nlink > 1 && e.digest != "" {
+				if hardlinked[e.digest] {
+					continue
+				}
+				hardlinked[e.digest] = true
+			}
+			report.Layers[i].Bytes += e.size
+			if opts.volatile[i] && opts.largeFileThreshold > 0 && e.size >= opts.largeFileThreshold {
+				report.LargeFiles = append(report.LargeFiles, LargeFile{Path: e.path, Size: e.size, Layer: i})
+			}
+		}
+		report.TotalBytes += report.Layers[i].Bytes
+	}
+
+	fs := make(map[string]node)
+	waste := func(p string, n node, by int, kind string, sameContent bool) {
+		// A hardlinked file may stay reachable through another of its
+		// paths, so only files with a single link count as wasted.
+		if n.entry.typ != "file" || n.entry.size == 0 || n.entry.nlink > 1 {
+			return
+		}
+		report.WastedFiles = append(report.WastedFiles, WastedFile{
+			Path: p, Size: n.entry.size, Kind: kind, Layer: n.layer, By: by, SameContent: sameContent,
+		})
+		report.Layers[n.layer].WastedBytes += n.entry.size
+	}
+	removeTree := func(dir string, by int, kind string, lowerOnly bool) {
+		prefix := dir + "/"
+		if dir == "." {
+			prefix = ""
+		}
+		for p, n := range fs {
+			if strings.HasPrefix(p, prefix) && (!lowerOnly || n.layer < by) {
+				waste(p, n, by, kind, false)
+				delete(fs, p)
+			}
+		}
+	}
+	for i, layer := range layers {
+		for _, e := range layer.entries {
+			dir, base := path.Split(e.path)
+			dir = strings.TrimSuffix(dir, "/")
+			if dir == "" {
+				dir = "."
+			}
+			switch {
+			case base == whiteoutOpaque:
+				// An opaque whiteout hides the lower layers' entries of
+				// its directory, not those of its own layer.
+				removeTree(dir, i, wastedDeleted, true)
+				continue
+			case strings.HasPrefix(base, whiteoutPrefix):
+				target := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				if n, ok := fs[target]; ok && n.layer < i {
+					waste(target, n, i, wastedDeleted, false)
+					delete(fs, target)
+				}
+				removeTree(target, i, wastedDeleted, true)
+				continue
+			}
+			if existing, ok := fs[e.path]; ok {
+				if existing.entry.typ == "dir" && e.typ != "dir" {
+					removeTree(e.path, i, wastedOverwritten, false)
+				}
+				waste(e.path, existing, i, wastedOverwritten, existing.entry.digest != "" && existing.entry.digest == e.digest)
+			}
+			fs[e.path] = node{layer: i, entry: e}
+		}
+	}
+
+	// Content that several layers hold in the final filesystem.
+	copies := make(map[string][]Copy)
+	for p, n := range fs {
+		if n.entry.typ == "file" && n.entry.digest != "" && n.entry.size > 0 {
+			copies[n.entry.digest] = append(copies[n.entry.digest], Copy{Layer: n.layer, Path: p})
+		}
+	}
+	for i, layer := range layers {
+		if layer.blobs == nil || layerHasDigests(layer) {
+			continue
+		}
+		// The entries of this layer carry no digests (an mtree spec
+		// without sha256): its content manifest says what it holds.
+		for digest := range layer.blobs {
+			copies[digest] = append(copies[digest], Copy{Layer: i})
+		}
+	}
+	for digest, list := range copies {
+		size, ok := sizeOf[digest]
+		if !ok || size == 0 {
+			continue
+		}
+		sort.Slice(list, func(a, b int) bool {
+			if list[a].Layer != list[b].Layer {
+				return list[a].Layer < list[b].Layer
+			}
+			return list[a].Path < list[b].Path
+		})
+		duplicate := DuplicateContent{Digest: "sha256:" + digest, Size: size, Copies: list}
+		for j := 1; j < len(list); j++ {
+			if list[j].Layer != list[j-1].Layer {
+				duplicate.WastedBytes += size
+				report.Layers[list[j].Layer].WastedBytes += size
+			}
+		}
+		if duplicate.WastedBytes > 0 {
+			report.Duplicates = append(report.Duplicates, duplicate)
+		}
+	}
+
+	for _, file := range report.WastedFiles {
+		report.WastedBytes += file.Size
+	}
+	for _, duplicate := range report.Duplicates {
+		report.WastedBytes += duplicate.WastedBytes
+	}
+	report.Efficiency = 1
+	if report.TotalBytes > 0 {
+		report.Efficiency = max(0, float64(report.TotalBytes-report.WastedBytes)/float64(report.TotalBytes))
+	}
+
+	sort.Slice(report.WastedFiles, func(a, b int) bool {
+		x, y := report.WastedFiles[a], report.WastedFiles[b]
+		if x.Size != y.Size {
+			return x.Size > y.Size
+		}
+		if x.Path != y.Path {
+			return x.Path < y.Path
+		}
+		return x.Layer < y.Layer
+	})
+	sort.Slice(report.Duplicates, func(a, b int) bool {
+		x, y := report.Duplicates[a], report.Duplicates[b]
+		if x.WastedBytes != y.WastedBytes {
+			return x.WastedBytes > y.WastedBytes
+		}
+		return x.Digest < y.Digest
+	})
+	sort.Slice(report.LargeFiles, func(a, b int) bool {
+		x, y := report.LargeFiles[a], report.LargeFiles[b]
+		if x.Size != y.Size {
+			return x.Size > y.Size
+		}
+		return x.Path < y.Path
+	})
+	return report
+}
+
+// checkThresholds records the thresholds the report does not meet. A
+// negative threshold is disabled.
+func checkThresholds(report *Report, lowestEfficiency float64, highestWastedBytes int64) {
+	if lowestEfficiency >= 0 && report.Efficiency < lowestEfficiency {
+		report.Failures = append(report.Failures, fmt.Sprintf("efficiency %.4f is below the lowest efficiency %.4f", report.Efficiency, lowestEfficiency))
+	}
+	if highestWastedBytes >= 0 && report.WastedBytes > highestWastedBytes {
+		report.Failures = append(report.Failures, fmt.Sprintf("%d wasted bytes exceed the highest wasted bytes %d", report.WastedBytes, highestWastedBytes))
+	}
+}
+
+// parseLayerSet parses a comma-separated list of layer indices and ranges
+// ("2", "1-3", "2-" for the second layer and all above) for an image of n
+// layers. Negative indices count from the top: "-1" is the last layer.
+func parseLayerSet(spec string, n int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	index := func(s string) (int, error) {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid layer index %q", s)
+		}
+		if i < 0 {
+			i += n
+		}
+		if i < 0 || i >= n {
+			return 0, fmt.Errorf("layer index %s is out of range for %d layers", s, n)
+		}
+		return i, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part[1:], "-")
+		first = part[:1] + first
+		if !isRange {
+			i, err := index(part)
+			if err != nil {
+				return nil, err
+			}
+			set[i] = true
+			continue
+		}
+		from, err := index(first)
+		if err != nil {
+			return nil, err
+		}
+		to := n - 1
+		if last != "" {
+			if to, err = index(last); err != nil {
+				return nil, err
+			}
+		}
+		if from > to {
+			return nil, fmt.Errorf("empty layer range %q", part)
+		}
+		for i := from; i <= to; i++ {
+			set[i] = true
+		}
+	}
+	return set, nil
+}
+
+func isWhiteout(p string) bool {
+	return strings.HasPrefix(path.Base(p), whiteoutPrefix)
+}
+
+func layerHasDigests(layer *layerFiles) bool {
+	for _, e := range layer.entries {
+		if e.digest != "" {
+			return true
+		}
+	}
+	return false
+}
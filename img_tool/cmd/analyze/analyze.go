@@ -0,0 +1,117 @@
+// Package analyze implements `img analyze`: a report of the space an image
+// wastes in its layers, and a check of that waste against thresholds for use
+// in tests.
+//
+// The layers are given in order, as layer tars (gzip, zstd or uncompressed),
+// compact streams or mtree specs as written by `img mtree` or the mtree output
+// group of the layer rules. They are applied in order, with the whiteout
+// semantics of OCI layers, and every byte that does not make it into the
+// final filesystem is accounted for: files overwritten by a later layer (or a
+// later entry of the same layer), files deleted by a later layer's whiteouts,
+// and content held by more than one layer of the final filesystem, matched by
+// digest. A layer whose mtree spec has no content digests can be given with its
+// content manifest (`img layer --content-manifest`), whose blob digests then
+// stand in. Large files in the layers that change often are listed as well:
+// they are rebuilt, pushed and pulled every time.
+//
+// The efficiency of the image is the part of all file content that is not
+// wasted. With --lowest-efficiency or --highest-wasted-bytes, the command
+// exits with status 1 when the image does not meet them, after printing the
+// report. Nothing but the given files is read, so the check is hermetic.
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerinput"
+)
+
+func AnalyzeProcess(ctx context.Context, args []string) {
+	var inputs layerinput.List
+	var volatileLayers, format string
+	var largeFileThreshold, highestWastedBytes int64
+	var lowestEfficiency float64
+	var limit int
+
+	flagSet := flag.NewFlagSet("analyze", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Reports the space an image wastes in its layers: overwritten and deleted files,\n")
+		fmt.Fprintf(flagSet.Output(), "content duplicated across layers and large files in frequently changing layers.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img analyze [OPTIONS] (--tar <tar> | --cstream <cstream> | --mtree <mtree> [--content-manifest <file>])...\n\n")
+		fmt.Fprintf(flagSet.Output(), "Every --tar, --cstream and --mtree flag is a layer, from the lowest to the topmost.\n")
+		fmt.Fprintf(flagSet.Output(), "Exits with status 1 when a threshold is not met.\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img analyze --mtree base.mtree --mtree deps.mtree --mtree app.mtree",
+			"img analyze --tar base.tgz --cstream app.tgz.cstream --lowest-efficiency 0.95",
+			"img analyze --format json --highest-wasted-bytes 10485760 --mtree base.mtree --mtree app.mtree",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+	flagSet.Var(inputs.Flag(layerinput.Tar), "tar", "Add a layer tar blob (may be gzip- or zstd-compressed). Repeatable.")
+	flagSet.Var(inputs.Flag(layerinput.CStream), "cstream", "Add a layer compact stream (.cstream). Repeatable.")
+	flagSet.Var(inputs.Flag(layerinput.Mtree), "mtree", "Add a layer mtree spec, in tar layout. Repeatable.")
+	flagSet.Var(inputs.ContentManifestFlag(), "content-manifest", "Content manifest of the layer given by the flag before it, for finding duplicated content of mtree specs without sha256 digests.")
+	flagSet.StringVar(&volatileLayers, "volatile-layers", "-1", `Layers that change often, as comma-separated indices and ranges counting from 0 ("2", "1-3", "2-"); negative indices count from the top.`)
+	flagSet.Int64Var(&largeFileThreshold, "large-file-threshold", 10<<20, "Size in bytes from which files of volatile layers are reported. 0 disables the report.")
+	flagSet.Float64Var(&lowestEfficiency, "lowest-efficiency", -1, "Fail when the efficiency (between 0 and 1) is below this value. Negative disables the check.")
+	flagSet.Int64Var(&highestWastedBytes, "highest-wasted-bytes", -1, "Fail when more bytes than this are wasted. Negative disables the check.")
+	flagSet.StringVar(&format, "format", "human", `Output format: "human" or "json"`)
+	flagSet.IntVar(&limit, "limit", 20, "Maximum number of wasted files, duplicates and large files listed in the human output (0 for no limit)")
+
+	if err := flagSet.Parse(args); err != nil {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if len(inputs) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: at least one of --tar, --cstream, or --mtree is required\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if flagSet.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments %q\n", flagSet.Args())
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if format != "human" && format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: --format must be \"human\" or \"json\", not %q\n", format)
+		os.Exit(1)
+	}
+	volatile, err := parseLayerSet(volatileLayers, len(inputs))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --volatile-layers: %v\n", err)
+		os.Exit(1)
+	}
+
+	layers := make([]*layerFiles, len(inputs))
+	for i, input := range inputs {
+		if layers[i], err = loadLayer(ctx, input); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	report := analyze(layers, analysisOptions{volatile: volatile, largeFileThreshold: largeFileThreshold})
+	checkThresholds(report, lowestEfficiency, highestWastedBytes)
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		writeHuman(os.Stdout, report, limit)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(report.Failures) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,221 @@
+package analyze
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerinput"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
+)
+
+func TestAnalyze(t *testing.T) {
+	big := strings.Repeat("b", 1000)
+	dir := t.TempDir()
+	layerPaths := []string{
+		writeTar(t, dir, "base.tgz", []testimage.Entry{
+			{Name: "etc/", Typeflag: tar.TypeDir},
+			{Name: "etc/hosts", Content: strings.Repeat("h", 100)},
+			{Name: "usr/lib/big", Content: big},
+			{Name: "usr/share/doc/readme", Content: strings.Repeat("r", 50)},
+		}),
+		writeTar(t, dir, "deps.tgz", []testimage.Entry{
+			// Rewritten only to change its mode.
+			{Name: "etc/hosts", Content: strings.Repeat("h", 100), Mode: 0o600},
+			{Name: "usr/share/.wh.doc"},
+			{Name: "app/vendored/big", Content: big},
+		}),
+		writeTar(t, dir, "app.tgz", []testimage.Entry{
+			{Name: "app/data.bin", Content: strings.Repeat("d", 2000)},
+			{Name: "app/main", Content: "v1"},
+		}),
+	}
+
+	for _, kind := range []layerinput.Kind{layerinput.Tar, layerinput.Mtree} {
+		var inputs layerinput.List
+		for _, p := range layerPaths {
+			if kind == layerinput.Mtree {
+				p = writeMtree(t, p)
+			}
+			inputs = append(inputs, layerinput.Input{Kind: kind, Path: p})
+		}
+		layers := make([]*layerFiles, len(inputs))
+		for i, input := range inputs {
+			var err error
+			if layers[i], err = loadLayer(context.Background(), input); err != nil {
+				t.Fatal(err)
+			}
+		}
+		report := analyze(layers, analysisOptions{volatile: map[int]bool{2: true}, largeFileThreshold: 1500})
+
+		if report.TotalBytes != 1150+1100+2002 {
+			t.Errorf("total bytes = %d, want %d", report.TotalBytes, 1150+1100+2002)
+		}
+		if report.WastedBytes != 100+50+1000 {
+			t.Errorf("wasted bytes = %d, want %d", report.WastedBytes, 100+50+1000)
+		}
+		wantWasted := []WastedFile{
+			{Path: "etc/hosts", Size: 100, Kind: wastedOverwritten, Layer: 0, By: 1, SameContent: true},
+			{Path: "usr/share/doc/readme", Size: 50, Kind: wastedDeleted, Layer: 0, By: 1},
+		}
+		if len(report.WastedFiles) != len(wantWasted) {
+			t.Fatalf("wasted files = %+v, want %+v", report.WastedFiles, wantWasted)
+		}
+		for i, want := range wantWasted {
+			if report.WastedFiles[i] != want {
+				t.Errorf("wasted file %d = %+v, want %+v", i, report.WastedFiles[i], want)
+			}
+		}
+		if len(report.Duplicates) != 1 {
+			t.Fatalf("duplicates = %+v, want one", report.Duplicates)
+		}
+		duplicate := report.Duplicates[0]
+		if duplicate.WastedBytes != 1000 || len(duplicate.Copies) != 2 || duplicate.Copies[0] != (Copy{Layer: 0, Path: "usr/lib/big"}) || duplicate.Copies[1] != (Copy{Layer: 1, Path: "app/vendored/big"}) {
+			t.Errorf("duplicate = %+v", duplicate)
+		}
+		if len(report.LargeFiles) != 1 || report.LargeFiles[0] != (LargeFile{Path: "app/data.bin", Size: 2000, Layer: 2}) {
+			t.Errorf("large files = %+v, want app/data.bin", report.LargeFiles)
+		}
+		if report.Layers[0].WastedBytes != 150 || report.Layers[1].WastedBytes != 1000 || report.Layers[2].WastedBytes != 0 {
+			t.Errorf("layer wasted bytes = %d, %d, %d, want 150, 1000, 0", report.Layers[0].WastedBytes, report.Layers[1].WastedBytes, report.Layers[2].WastedBytes)
+		}
+
+		checkThresholds(report, 0.5, -1)
+		if len(report.Failures) != 0 {
+			t.Errorf("failures = %q, want none", report.Failures)
+		}
+		checkThresholds(report, 0.9, 1000)
+		if len(report.Failures) != 2 {
+			t.Errorf("failures = %q, want two", report.Failures)
+		}
+
+		var out bytes.Buffer
+		writeHuman(&out, report, 20)
+		for _, want := range []string{
+			"Wasted:       1.1 KiB",
+			"/etc/hosts  (layer #0, overwritten by layer #1, same content)",
+			"/usr/share/doc/readme  (layer #0, deleted by layer #1)",
+			"/usr/lib/big (layer #0), /app/vendored/big (layer #1)",
+			"/app/data.bin  (layer #2)",
+			"FAILED:",
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("human output lacks %q:\n%s", want, out.String())
+			}
+		}
+	}
+}
+
+func TestAnalyzeOpaqueWhiteout(t *testing.T) {
+	layers := []*layerFiles{
+		{entries: []entry{
+			{path: "var/cache", typ: "dir"},
+			{path: "var/cache/a", typ: "file", size: 10, nlink: 1},
+			{path: "var/cache/b", typ: "file", size: 20, nlink: 1},
+		}},
+		{entries: []entry{
+			{path: "var/cache/.wh..wh..opq", typ: "file", nlink: 1},
+			{path: "var/cache/c", typ: "file", size: 5, nlink: 1},
+		}},
+		{entries: []entry{
+			// A file replacing a directory takes its contents along.
+			{path: "var/cache", typ: "file", size: 1, nlink: 1},
+		}},
+	}
+	report := analyze(layers, analysisOptions{})
+	if report.WastedBytes != 35 {
+		t.Errorf("wasted bytes = %d, want 35: %+v", report.WastedBytes, report.WastedFiles)
+	}
+	byPath := make(map[string]WastedFile)
+	for _, file := range report.WastedFiles {
+		byPath[file.Path] = file
+	}
+	if byPath["var/cache/a"].Kind != wastedDeleted || byPath["var/cache/b"].By != 1 {
+		t.Errorf("wasted files = %+v, want var/cache/a and b deleted by layer 1", report.WastedFiles)
+	}
+	if file := byPath["var/cache/c"]; file.Kind != wastedOverwritten || file.By != 2 {
+		t.Errorf("var/cache/c = %+v, want overwritten by layer 2", file)
+	}
+}
+
+func TestParseLayerSet(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []int
+		wantErr bool
+	}{
+		{spec: "-1", want: []int{4}},
+		{spec: "0,2", want: []int{0, 2}},
+		{spec: "1-3", want: []int{1, 2, 3}},
+		{spec: "3-", want: []int{3, 4}},
+		{spec: "-2-", want: []int{3, 4}},
+		{spec: "", want: nil},
+		{spec: "5", wantErr: true},
+		{spec: "3-1", wantErr: true},
+		{spec: "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLayerSet(tt.spec, 5)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLayerSet(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseLayerSet(%q) = %v, want %v", tt.spec, got, tt.want)
+			continue
+		}
+		for _, i := range tt.want {
+			if !got[i] {
+				t.Errorf("parseLayerSet(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		}
+	}
+}
+
+// writeTar writes the entries to a gzip-compressed layer tar in dir.
+func writeTar(t *testing.T, dir, name string, entries []testimage.Entry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(testimage.Tar(t, entries)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// writeMtree renders the mtree spec of a layer tar, as the mtree output group
+// of the layer rules does.
+func writeMtree(t *testing.T, tarPath string) string {
+	t.Helper()
+	f, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := mtree.Decompress(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec bytes.Buffer
+	if err := mtree.Write(r, &spec, mtree.DefaultOptions(), mtree.HashContent); err != nil {
+		t.Fatal(err)
+	}
+	p := strings.TrimSuffix(tarPath, ".tgz") + ".mtree"
+	if err := os.WriteFile(p, spec.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
@@ -0,0 +1,100 @@
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeHuman renders the report for reading in a terminal or a test log.
+// Lists are cut at limit entries.
+func writeHuman(w io.Writer, report *Report, limit int) {
+	fmt.Fprintf(w, "Efficiency:   %.2f%%\n", report.Efficiency*100)
+	fmt.Fprintf(w, "Total:        %s\n", humanizeBytes(report.TotalBytes))
+	fmt.Fprintf(w, "Wasted:       %s\n", humanizeBytes(report.WastedBytes))
+
+	fmt.Fprintln(w, "\nLayers:")
+	for _, layer := range report.Layers {
+		volatile := ""
+		if layer.Volatile {
+			volatile = " (volatile)"
+		}
+		fmt.Fprintf(w, "  #%d %s%s: %d files, %s, %s wasted\n", layer.Index, layer.Source, volatile, layer.Files, humanizeBytes(layer.Bytes), humanizeBytes(layer.WastedBytes))
+	}
+
+	if len(report.WastedFiles) > 0 {
+		fmt.Fprintln(w, "\nOverwritten and deleted files:")
+		for i, file := range report.WastedFiles {
+			if limit > 0 && i == limit {
+				fmt.Fprintf(w, "  ... and %d more\n", len(report.WastedFiles)-limit)
+				break
+			}
+			note := ""
+			if file.SameContent {
+				note = ", same content"
+			}
+			fmt.Fprintf(w, "  %10s  /%s  (layer #%d, %s by layer #%d%s)\n", humanizeBytes(file.Size), file.Path, file.Layer, file.Kind, file.By, note)
+		}
+	}
+
+	if len(report.Duplicates) > 0 {
+		fmt.Fprintln(w, "\nContent duplicated across layers:")
+		for i, duplicate := range report.Duplicates {
+			if limit > 0 && i == limit {
+				fmt.Fprintf(w, "  ... and %d more\n", len(report.Duplicates)-limit)
+				break
+			}
+			copies := make([]string, len(duplicate.Copies))
+			for j, c := range duplicate.Copies {
+				if c.Path == "" {
+					copies[j] = fmt.Sprintf("layer #%d", c.Layer)
+				} else {
+					copies[j] = fmt.Sprintf("/%s (layer #%d)", c.Path, c.Layer)
+				}
+			}
+			fmt.Fprintf(w, "  %10s  %s: %s\n", humanizeBytes(duplicate.WastedBytes), shortDigest(duplicate.Digest), strings.Join(copies, ", "))
+		}
+	}
+
+	if len(report.LargeFiles) > 0 {
+		fmt.Fprintln(w, "\nLarge files in volatile layers:")
+		for i, file := range report.LargeFiles {
+			if limit > 0 && i == limit {
+				fmt.Fprintf(w, "  ... and %d more\n", len(report.LargeFiles)-limit)
+				break
+			}
+			fmt.Fprintf(w, "  %10s  /%s  (layer #%d)\n", humanizeBytes(file.Size), file.Path, file.Layer)
+		}
+	}
+
+	if len(report.Failures) > 0 {
+		fmt.Fprintln(w, "\nFAILED:")
+		for _, failure := range report.Failures {
+			fmt.Fprintf(w, "  %s\n", failure)
+		}
+	}
+}
+
+// shortDigest abbreviates a digest for display.
+func shortDigest(digest string) string {
+	if len(digest) > len("sha256:")+12 {
+		return digest[:len("sha256:")+12]
+	}
+	return digest
+}
+
+// humanizeBytes renders a byte count with a binary unit.
+func humanizeBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return fmt.Sprintf("%.1f PiB", value/unit)
+}
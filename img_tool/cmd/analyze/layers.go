@@ -0,0 +1,140 @@
+package analyze
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/contentmanifest"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerinput"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
+)
+
+// entryKeywords are the mtree fields the analysis needs.
+var entryKeywords = []string{"type", "size", "sha256", "link", "nlink"}
+
+// layerFiles is what the analysis knows about the entries of one layer.
+type layerFiles struct {
+	source  string
+	entries []entry
+	// blobs holds the content digests the layer's content manifest lists.
+	blobs map[string]bool
+}
+
+// entry is one tar entry of a layer, in tar order.
+type entry struct {
+	path string
+	typ  string
+	size int64
+	// digest is the hex sha256 of a regular file's content, when known.
+	digest string
+	// nlink is the number of paths sharing the content within the layer.
+	nlink int
+}
+
+// loadLayer reads the entries of a layer, and the blob digests of its content
+// manifest when given.
+func loadLayer(ctx context.Context, ref layerinput.Input) (*layerFiles, error) {
+	var spec bytes.Buffer
+	switch ref.Kind {
+	case layerinput.Mtree:
+		f, err := os.Open(ref.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := io.Copy(&spec, f); err != nil {
+			return nil, err
+		}
+	default:
+		if err := renderLayer(ctx, ref, &spec); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", ref.Path, err)
+		}
+	}
+	parsed, err := mtree.ParseEntries(&spec)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ref.Path, err)
+	}
+
+	layer := &layerFiles{source: ref.Path, entries: make([]entry, 0, len(parsed))}
+	for _, p := range parsed {
+		e := entry{path: p.Path, typ: p.Keywords["type"], digest: p.Keywords["sha256digest"], nlink: 1}
+		if e.typ == "" {
+			e.typ = "file"
+		}
+		if size, ok := p.Keywords["size"]; ok && e.typ == "file" {
+			if e.size, err = strconv.ParseInt(size, 10, 64); err != nil {
+				return nil, fmt.Errorf("%s: invalid size of %s: %w", ref.Path, p.Path, err)
+			}
+		}
+		if nlink, ok := p.Keywords["nlink"]; ok {
+			if e.nlink, err = strconv.Atoi(nlink); err != nil {
+				return nil, fmt.Errorf("%s: invalid nlink of %s: %w", ref.Path, p.Path, err)
+			}
+		}
+		layer.entries = append(layer.entries, e)
+	}
+
+	if ref.ContentManifest != "" {
+		layer.blobs = make(map[string]bool)
+		for hash, err := range contentmanifest.New(ref.ContentManifest, api.SHA256).BlobHashes() {
+			if err != nil {
+				return nil, fmt.Errorf("reading content manifest %s: %w", ref.ContentManifest, err)
+			}
+			if hash != nil {
+				layer.blobs[hex.EncodeToString(hash)] = true
+			}
+		}
+	}
+	return layer, nil
+}
+
+// renderLayer writes the mtree spec of a tar blob or compact stream, in tar
+// layout so that whiteouts stay entries of their own.
+func renderLayer(ctx context.Context, ref layerinput.Input, w io.Writer) error {
+	f, err := os.Open(ref.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opts := mtree.Options{PathPrefix: "./", Keywords: entryKeywords, Layout: mtree.LayoutTar}
+	if ref.Kind == layerinput.CStream {
+		reader, err := compactstream.NewReconstructingReader(ctx, f, compactstream.NullBlobStore{})
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		return mtree.Write(reader, w, opts, cstreamDigester(reader))
+	}
+	r, err := mtree.Decompress(f)
+	if err != nil {
+		return err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return mtree.Write(r, w, opts, mtree.HashContent)
+}
+
+// cstreamDigester takes the digest of a CAS-referenced file from the ref
+// table of the compact stream and hashes inlined content, like `img mtree`.
+func cstreamDigester(reader *compactstream.ReconstructingReader) mtree.ContentDigester {
+	return func(hdr *tar.Header, content io.Reader) ([]byte, error) {
+		if digest, ok := reader.RefDigestAt(reader.Offset(), hdr.Size); ok {
+			return digest, nil
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, content); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+}
@@ -15,6 +15,9 @@
 //	base etc passwd         describes /etc/passwd, /etc/group, /etc/shadow and home directories
 //	base trust-store        describes a CA certificate trust store
 //	base system-libraries   describes shared libraries and the dynamic loader configuration
+//	base packages           describes the dpkg, rpm or apk database entries of packages
+//	base tzdata             describes the zoneinfo tree and the local time zone
+//	base locales            describes glibc locales and the default locale
 //	base skeleton           describes an empty Linux directory skeleton
 package base
 
@@ -30,6 +33,9 @@ Subcommands:
   etc               describes files under /etc (subcommands: environment, hosts, release, passwd)
   trust-store       describes a CA certificate trust store
   system-libraries  describes shared libraries and the dynamic loader configuration
+  packages          describes the dpkg, rpm or apk database entries of packages
+  tzdata            describes the zoneinfo tree and the local time zone
+  locales           describes glibc locales and the default locale
   skeleton          describes an empty Linux directory skeleton`
 
 // BaseProcess dispatches to a base subcommand.
@@ -47,6 +53,12 @@ func BaseProcess(ctx context.Context, args []string) {
 		trustStoreProcess(ctx, rest)
 	case "system-libraries":
 		systemLibrariesProcess(ctx, rest)
+	case "packages":
+		packagesProcess(ctx, rest)
+	case "tzdata":
+		tzdataProcess(ctx, rest)
+	case "locales":
+		localesProcess(ctx, rest)
 	case "skeleton":
 		skeletonProcess(ctx, rest)
 	default:
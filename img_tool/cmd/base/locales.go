@@ -0,0 +1,163 @@
+package base
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta/locale"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/proto/baselayer"
+)
+
+// localesProcess implements `img base locales`.
+//
+// glibc finds a locale in one of two shapes, both under /usr/lib/locale: the
+// single locale-archive file localedef builds by default, or one directory per
+// locale (en_US.utf8/LC_CTYPE, ...), which is what localedef --no-archive and
+// Debian's locales-all produce. --archive places the former, --locale and
+// --locale-file the latter; nothing is compiled here.
+//
+// --lang names the default locale. It is written to /etc/default/locale for
+// PAM and the tools that read it, but a container runtime does not: the
+// locale only takes effect through the LANG variable of the image config,
+// which the Bazel rule sets. The name is checked against the locales placed,
+// so an image cannot ship a LANG that falls back to "C" at runtime.
+func localesProcess(_ context.Context, args []string) {
+	localeDirs := make(kvFlag)
+	localeFiles := make(kvFlag)
+	var outputPath, producer, archivePath, localeDir, lang, localeConfPath string
+	var mode modeFlag
+
+	flagSet := flag.NewFlagSet("base locales", flag.ExitOnError)
+	flagSet.StringVar(&archivePath, "archive", "", "Host path of a prebuilt glibc locale-archive.")
+	flagSet.Var(localeDirs, "locale", "A compiled locale directory as NAME=<host path>, e.g. en_US.utf8=path/to/dir. Can be repeated.")
+	flagSet.Var(localeFiles, "locale-file", "A file of a compiled locale as NAME/FILE=<host path>, e.g. en_US.utf8/LC_CTYPE=path. Can be repeated.")
+	flagSet.StringVar(&outputPath, "output", "", "Path of the base metadata stream to write.")
+	flagSet.StringVar(&producer, "producer", "", "Label of the rule producing this stream, used in conflict messages.")
+	flagSet.StringVar(&localeDir, "locale-dir", "/usr/lib/locale", "Directory glibc looks for locales in inside the image.")
+	flagSet.StringVar(&lang, "lang", "", "Default locale, e.g. en_US.UTF-8. Must be one of the placed locales, or C or POSIX.")
+	flagSet.StringVar(&localeConfPath, "locale-conf-path", "/etc/default/locale", "Path of the file recording the default locale inside the image.")
+	flagSet.Var(&mode, "mode", "Octal file mode of the placed locale files. Defaults to 0644.")
+	if err := flagSet.Parse(args); err != nil {
+		fail("locales", err)
+	}
+	if archivePath == "" && len(localeDirs) == 0 && len(localeFiles) == 0 && lang == "" {
+		fail("locales", fmt.Errorf("nothing to write: pass --archive, --locale, --locale-file or --lang"))
+	}
+
+	fileMode := mode.or(0o644)
+	var entries []*baselayer.BaseEntry
+	// The locales the image ends up with, for checking --lang. C and POSIX
+	// are built into glibc.
+	available := []string{"C", "POSIX"}
+
+	if archivePath != "" {
+		data, err := os.ReadFile(archivePath)
+		if err != nil {
+			fail("locales", err)
+		}
+		names, err := locale.ArchiveNames(data)
+		if err != nil {
+			fail("locales", fmt.Errorf("%s: %w", archivePath, err))
+		}
+		available = append(available, names...)
+		entries = append(entries, basemeta.FileFromPath(path.Join(localeDir, "locale-archive"), fileMode, archivePath))
+	}
+
+	for _, name := range localeDirs.keys() {
+		dirEntries, err := localeDirectoryEntries(path.Join(localeDir, name), localeDirs[name], fileMode)
+		if err != nil {
+			fail("locales", err)
+		}
+		if len(dirEntries) == 0 {
+			fail("locales", fmt.Errorf("locale directory %s for %s is empty", localeDirs[name], name))
+		}
+		available = append(available, name)
+		entries = append(entries, dirEntries...)
+	}
+
+	for _, name := range localeFiles.keys() {
+		rel := path.Clean(strings.TrimPrefix(name, "/"))
+		localeName, _, ok := strings.Cut(rel, "/")
+		if !ok || strings.HasPrefix(rel, "../") {
+			fail("locales", fmt.Errorf("--locale-file %s: the name must be LOCALE/FILE", name))
+		}
+		available = append(available, localeName)
+		entries = append(entries, basemeta.FileFromPath(path.Join(localeDir, rel), fileMode, localeFiles[name]))
+	}
+
+	if lang != "" {
+		if !localeAvailable(lang, available) {
+			fail("locales", fmt.Errorf("--lang %q is not among the placed locales (%s)", lang, strings.Join(uniqueSorted(available), ", ")))
+		}
+		entries = append(entries, basemeta.File(localeConfPath, 0o644, []byte("LANG="+lang+"\n")))
+	}
+
+	if err := writeStream(outputPath, producer, entries); err != nil {
+		fail("locales", err)
+	}
+}
+
+// localeDirectoryEntries describes a compiled locale directory placed at
+// imageDir. Symlinks inside it, which localedef uses to share identical
+// categories between locales, are kept as they are.
+func localeDirectoryEntries(imageDir, hostDir string, mode int64) ([]*baselayer.BaseEntry, error) {
+	var entries []*baselayer.BaseEntry
+	err := filepath.WalkDir(hostDir, func(hostPath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(hostDir, hostPath)
+		if err != nil {
+			return err
+		}
+		imagePath := path.Join(imageDir, filepath.ToSlash(rel))
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(hostPath)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, basemeta.Symlink(imagePath, target))
+			return nil
+		}
+		entries = append(entries, basemeta.FileFromPath(imagePath, mode, hostPath))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading locale directory %s: %w", hostDir, err)
+	}
+	return entries, nil
+}
+
+// localeAvailable reports whether setlocale would find name among the
+// available locales, trying it as given and normalized like glibc does.
+func localeAvailable(name string, available []string) bool {
+	normalized := locale.NormalizeName(name)
+	for _, candidate := range available {
+		if candidate == name || candidate == normalized || locale.NormalizeName(candidate) == normalized {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueSorted returns the distinct values of a list, sorted.
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
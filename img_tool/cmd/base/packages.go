@@ -0,0 +1,175 @@
+package base
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta/pkgfile"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta/rpmdb"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/proto/baselayer"
+)
+
+// packagesProcess implements `img base packages`.
+//
+// It records packages in the image's own package database, so that scanners
+// which identify an image by its installed packages (Trivy, Grype, Syft) see
+// the packages a bespoke base was assembled from. Nothing is installed: the
+// files of the packages are placed by other rules, and this verb only writes
+// the database entries describing them.
+//
+// Debian packages are recorded the way distroless images do it: one file per
+// package under /var/lib/dpkg/status.d holding the package's control
+// paragraph, next to a <package>.md5sums file listing its files. RPMs go into
+// the Packages table of an rpm SQLite database, and Alpine packages into apk's
+// installed database, a text file of one entry per package.
+func packagesProcess(_ context.Context, args []string) {
+	var debs, rpms, apks stringsFlag
+	var outputPath, producer, statusDir, rpmdbPath, apkInstalledPath string
+	var mode modeFlag
+
+	flagSet := flag.NewFlagSet("base packages", flag.ExitOnError)
+	flagSet.Var(&debs, "deb", "Path of a .deb package to record. Can be repeated.")
+	flagSet.Var(&rpms, "rpm", "Path of an .rpm package to record. Can be repeated.")
+	flagSet.Var(&apks, "apk", "Path of an Alpine .apk package to record. Can be repeated.")
+	flagSet.StringVar(&outputPath, "output", "", "Path of the base metadata stream to write.")
+	flagSet.StringVar(&producer, "producer", "", "Label of the rule producing this stream, used in conflict messages.")
+	flagSet.StringVar(&statusDir, "dpkg-status-dir", "/var/lib/dpkg/status.d", "Directory of the per-package dpkg status files inside the image.")
+	flagSet.StringVar(&rpmdbPath, "rpmdb-path", "/var/lib/rpm/rpmdb.sqlite", "Path of the rpm SQLite database inside the image.")
+	flagSet.StringVar(&apkInstalledPath, "apk-installed-path", "/lib/apk/db/installed", "Path of apk's installed database inside the image.")
+	flagSet.Var(&mode, "mode", "Octal file mode of the written database files. Defaults to 0644.")
+	if err := flagSet.Parse(args); err != nil {
+		fail("packages", err)
+	}
+	if len(debs) == 0 && len(rpms) == 0 && len(apks) == 0 {
+		fail("packages", fmt.Errorf("no packages given: pass --deb, --rpm or --apk"))
+	}
+
+	fileMode := mode.or(0o644)
+	var entries []*baselayer.BaseEntry
+
+	debEntries, err := dpkgStatusEntries(debs, statusDir, fileMode)
+	if err != nil {
+		fail("packages", err)
+	}
+	entries = append(entries, debEntries...)
+
+	if len(rpms) > 0 {
+		database, err := rpmDatabase(rpms)
+		if err != nil {
+			fail("packages", err)
+		}
+		entries = append(entries, basemeta.File(rpmdbPath, fileMode, database))
+	}
+
+	if len(apks) > 0 {
+		database, err := apkInstalledDatabase(apks)
+		if err != nil {
+			fail("packages", err)
+		}
+		entries = append(entries, basemeta.File(apkInstalledPath, fileMode, database))
+	}
+
+	if err := writeStream(outputPath, producer, entries); err != nil {
+		fail("packages", err)
+	}
+}
+
+// dpkgStatusEntries describes the status.d files of the given .deb packages.
+// A status.d file carries the control paragraph as the package ships it; dpkg
+// itself would add a Status field, which readers of status.d do not expect.
+func dpkgStatusEntries(debs []string, statusDir string, mode int64) ([]*baselayer.BaseEntry, error) {
+	if len(debs) == 0 {
+		return nil, nil
+	}
+	owners := make(map[string]string)
+	var records []*pkgfile.DebRecord
+	for _, debPath := range debs {
+		record, err := pkgfile.ReadDebRecord(debPath)
+		if err != nil {
+			return nil, err
+		}
+		// The file is named after the package alone, so two architectures of
+		// one package cannot both be recorded.
+		if owner, taken := owners[record.Info.Name]; taken {
+			return nil, fmt.Errorf("packages %s and %s are both named %q", owner, debPath, record.Info.Name)
+		}
+		owners[record.Info.Name] = debPath
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Info.Name < records[j].Info.Name })
+
+	entries := []*baselayer.BaseEntry{basemeta.Dir(statusDir, 0o755)}
+	for _, record := range records {
+		control := record.Control
+		if len(control) > 0 && control[len(control)-1] != '\n' {
+			control = append(control, '\n')
+		}
+		entries = append(entries, basemeta.File(path.Join(statusDir, record.Info.Name), mode, control))
+		if record.MD5Sums != nil {
+			entries = append(entries, basemeta.File(path.Join(statusDir, record.Info.Name+".md5sums"), mode, record.MD5Sums))
+		}
+	}
+	return entries, nil
+}
+
+// rpmDatabase renders the rpm database recording the given packages. Rows are
+// numbered in package name order, so the database does not depend on the
+// order the packages were passed in.
+func rpmDatabase(rpms []string) ([]byte, error) {
+	owners := make(map[string]string)
+	var records []*pkgfile.RPMRecord
+	for _, rpmPath := range rpms {
+		record, err := pkgfile.ReadRPMRecord(rpmPath)
+		if err != nil {
+			return nil, err
+		}
+		key := record.Info.Name + "." + record.Info.Architecture
+		if owner, taken := owners[key]; taken {
+			return nil, fmt.Errorf("packages %s and %s are both %s", owner, rpmPath, key)
+		}
+		owners[key] = rpmPath
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Info.Name != records[j].Info.Name {
+			return records[i].Info.Name < records[j].Info.Name
+		}
+		return records[i].Info.Architecture < records[j].Info.Architecture
+	})
+
+	headers := make([][]byte, len(records))
+	for i, record := range records {
+		headers[i] = record.Header
+	}
+	return rpmdb.Write(headers), nil
+}
+
+// apkInstalledDatabase renders apk's installed database recording the given
+// packages, in package name order. apk keeps one package of a name installed,
+// whatever its architecture.
+func apkInstalledDatabase(apks []string) ([]byte, error) {
+	owners := make(map[string]string)
+	var records []*pkgfile.APKRecord
+	for _, apkPath := range apks {
+		record, err := pkgfile.ReadAPKRecord(apkPath)
+		if err != nil {
+			return nil, err
+		}
+		if owner, taken := owners[record.Info.Name]; taken {
+			return nil, fmt.Errorf("packages %s and %s are both named %q", owner, apkPath, record.Info.Name)
+		}
+		owners[record.Info.Name] = apkPath
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Info.Name < records[j].Info.Name })
+
+	var database []byte
+	for _, record := range records {
+		database = append(database, record.Installed...)
+	}
+	return database, nil
+}
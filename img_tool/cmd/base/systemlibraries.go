@@ -7,7 +7,9 @@ import (
 	"flag"
 	"fmt"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta/elfinfo"
@@ -22,16 +24,30 @@ import (
 // library directory, its DT_SONAME becomes a symlink next to it (which is how a
 // dynamic linker finds it), and an /etc/ld.so.conf.d fragment records the
 // directory.
+//
+// With --executable, the libraries are found rather than listed: the shared
+// library closure of the executables is resolved in a sysroot (--sysroot and
+// --sysroot-file) by following DT_NEEDED the way the dynamic linker does, and
+// every library in it is placed like a listed one. The dynamic linker the
+// executables name in PT_INTERP is placed at that path. Dependencies missing
+// from the sysroot fail the verb, all of them listed at once.
 func systemLibrariesProcess(_ context.Context, args []string) {
 	libraries := make(kvFlag)
+	sysrootFiles := make(kvFlag)
+	var executables, sysrootDirs, searchDirs stringsFlag
 	var outputPath, producer, libDir, confPath, cachePath, byteOrderName string
-	var writeConf, writeCache bool
+	var writeConf, writeCache, usrMerged bool
 	var defaultMetadataJSON string
 	fileMetadata := make(kvFlag)
 	var mode modeFlag
 
 	flagSet := flag.NewFlagSet("base system-libraries", flag.ExitOnError)
 	flagSet.Var(libraries, "library", "A shared library as NAME=<host path>. Can be repeated.")
+	flagSet.Var(&executables, "executable", "Host path of an executable whose shared library closure is placed. Can be repeated.")
+	flagSet.Var(&sysrootDirs, "sysroot", "Directory holding the root filesystem --executable dependencies are resolved in. Can be repeated.")
+	flagSet.Var(sysrootFiles, "sysroot-file", "A file of the sysroot as IMAGE_PATH=<host path>. Can be repeated.")
+	flagSet.Var(&searchDirs, "search-dir", "Directory of the sysroot searched for dependencies, replacing the default search path. Can be repeated.")
+	flagSet.BoolVar(&usrMerged, "usr-merged", true, "Place the dynamic linker under /usr when PT_INTERP names /lib or /lib64, which are symlinks in a usr-merged image.")
 	flagSet.StringVar(&outputPath, "output", "", "Path of the base metadata stream to write.")
 	flagSet.StringVar(&producer, "producer", "", "Label of the rule producing this stream, used in conflict messages.")
 	flagSet.StringVar(&libDir, "lib-dir", "/usr/lib", "Directory the libraries are placed in.")
@@ -62,63 +78,73 @@ func systemLibrariesProcess(_ context.Context, args []string) {
 		fail("system-libraries", fmt.Errorf("parsing --default-metadata: %w", err))
 	}
 
-	var entries []*baselayer.BaseEntry
-	var cacheEntries []ldcache.Entry
-	// A SONAME shared by several libraries would produce two symlinks at the
-	// same path, which the merge would reject with a confusing message; catch
-	// it here where the file names are still at hand.
-	sonameOwners := make(map[string]string)
-
+	placer := &libraryPlacer{
+		libDir:       libDir,
+		mode:         mode.or(0o755),
+		defaults:     defaults,
+		fileMetadata: fileMetadata,
+		sonameOwners: make(map[string]string),
+		placed:       make(map[string]string),
+	}
 	for _, name := range libraries.keys() {
 		hostPath := libraries[name]
 		info, err := elfinfo.Read(hostPath)
 		if err != nil {
 			fail("system-libraries", err)
 		}
+		if err := placer.place(name, hostPath, info); err != nil {
+			fail("system-libraries", err)
+		}
+	}
 
-		imagePath := path.Join(libDir, name)
-		entry := basemeta.FileFromPath(imagePath, mode.or(0o755), hostPath)
-		if err := applyFileMetadata(entry, defaults); err != nil {
-			fail("system-libraries", fmt.Errorf("applying --default-metadata: %w", err))
+	if len(executables) > 0 {
+		if len(sysrootDirs) == 0 && len(sysrootFiles) == 0 {
+			fail("system-libraries", fmt.Errorf("--executable needs a sysroot to resolve dependencies in: pass --sysroot or --sysroot-file"))
 		}
-		if raw, ok := fileMetadata[imagePath]; ok {
-			override, err := parseFileMetadata(raw)
-			if err != nil {
-				fail("system-libraries", fmt.Errorf("parsing metadata for %s: %w", imagePath, err))
-			}
-			if err := applyFileMetadata(entry, override); err != nil {
-				fail("system-libraries", fmt.Errorf("applying metadata for %s: %w", imagePath, err))
+		sysroot := elfinfo.Sysroot{Dirs: sysrootDirs, Files: make(map[string]string)}
+		for imagePath, hostPath := range sysrootFiles {
+			sysroot.Files[path.Clean("/"+imagePath)] = hostPath
+		}
+		var roots []elfinfo.Object
+		for _, executable := range executables {
+			roots = append(roots, elfinfo.Object{HostPath: executable})
+		}
+		// Listed libraries are loaded too, so they satisfy dependencies by
+		// their names and bring in their own.
+		for _, name := range libraries.keys() {
+			roots = append(roots, elfinfo.Object{HostPath: libraries[name], Path: path.Join(libDir, name)})
+		}
+		closure, err := elfinfo.Resolve(roots, sysroot, searchDirs)
+		if err != nil {
+			fail("system-libraries", err)
+		}
+		for _, library := range closure.Libraries {
+			if err := placer.place(path.Base(library.Path), library.HostPath, library.Info); err != nil {
+				fail("system-libraries", err)
 			}
 		}
-		entries = append(entries, entry)
-
-		// The dynamic linker looks a dependency up by its SONAME, which is
-		// often a shorter, version-stable name than the real file
-		// ("libssl.so.3" next to "libssl.so.3.0.14"). Link one to the other so
-		// both resolve.
-		soname := info.SONAME
-		if soname == "" || soname == name {
-			cacheEntries = append(cacheEntries, ldcache.Entry{SONAME: name, Path: imagePath})
-			continue
+		interpreters := make([]string, 0, len(closure.Interpreters))
+		for interp := range closure.Interpreters {
+			interpreters = append(interpreters, interp)
 		}
-		if owner, taken := sonameOwners[soname]; taken {
-			fail("system-libraries", fmt.Errorf("libraries %s and %s both declare SONAME %q", owner, name, soname))
+		sort.Strings(interpreters)
+		for _, interp := range interpreters {
+			if err := placer.placeInterpreter(interpreterPath(interp, usrMerged), closure.Interpreters[interp]); err != nil {
+				fail("system-libraries", err)
+			}
 		}
-		sonameOwners[soname] = name
-
-		entries = append(entries, basemeta.Symlink(path.Join(libDir, soname), name))
-		cacheEntries = append(cacheEntries, ldcache.Entry{SONAME: soname, Path: path.Join(libDir, soname)})
 	}
 
-	if len(entries) == 0 {
-		fail("system-libraries", fmt.Errorf("no libraries given: pass --library NAME=PATH"))
+	if len(placer.entries) == 0 {
+		fail("system-libraries", fmt.Errorf("no libraries given: pass --library NAME=PATH or --executable"))
 	}
 
+	entries := placer.entries
 	if writeConf {
 		entries = append(entries, basemeta.File(confPath, 0o644, ldcache.ConfContent([]string{libDir})))
 	}
 	if writeCache {
-		entries = append(entries, basemeta.File(cachePath, 0o644, ldcache.Write(cacheEntries, byteOrder)))
+		entries = append(entries, basemeta.File(cachePath, 0o644, ldcache.Write(placer.cacheEntries, byteOrder)))
 	}
 
 	if err := writeStream(outputPath, producer, entries); err != nil {
@@ -126,6 +152,115 @@ func systemLibrariesProcess(_ context.Context, args []string) {
 	}
 }
 
+// libraryPlacer accumulates the entries of the placed libraries and the loader
+// cache records resolving them.
+type libraryPlacer struct {
+	libDir       string
+	mode         int64
+	defaults     *fileMetadataJSON
+	fileMetadata kvFlag
+
+	entries      []*baselayer.BaseEntry
+	cacheEntries []ldcache.Entry
+	// A SONAME shared by several libraries would produce two symlinks at the
+	// same path, which the merge would reject with a confusing message; catch
+	// it here where the file names are still at hand.
+	sonameOwners map[string]string
+	// placed maps the file names taken in the library directory to the host
+	// files placed there, so a library listed and also found in a closure is
+	// placed once.
+	placed map[string]string
+}
+
+// place puts a library into the library directory under name, next to its
+// SONAME symlink.
+func (p *libraryPlacer) place(name, hostPath string, info elfinfo.Info) error {
+	if owner, taken := p.placed[name]; taken {
+		if owner == hostPath {
+			return nil
+		}
+		return fmt.Errorf("two different files would both be placed at %s: %s and %s", path.Join(p.libDir, name), owner, hostPath)
+	}
+	p.placed[name] = hostPath
+
+	imagePath := path.Join(p.libDir, name)
+	entry, err := p.file(imagePath, hostPath)
+	if err != nil {
+		return err
+	}
+	p.entries = append(p.entries, entry)
+
+	// The dynamic linker looks a dependency up by its SONAME, which is often
+	// a shorter, version-stable name than the real file ("libssl.so.3" next
+	// to "libssl.so.3.0.14"). Link one to the other so both resolve.
+	soname := info.SONAME
+	if soname == "" || soname == name {
+		p.cacheEntries = append(p.cacheEntries, ldcache.Entry{SONAME: name, Path: imagePath})
+		return nil
+	}
+	if owner, taken := p.sonameOwners[soname]; taken {
+		return fmt.Errorf("libraries %s and %s both declare SONAME %q", owner, name, soname)
+	}
+	p.sonameOwners[soname] = name
+
+	p.entries = append(p.entries, basemeta.Symlink(path.Join(p.libDir, soname), name))
+	p.cacheEntries = append(p.cacheEntries, ldcache.Entry{SONAME: soname, Path: path.Join(p.libDir, soname)})
+	return nil
+}
+
+// placeInterpreter puts the dynamic linker at the path executables name it
+// by. It gets no SONAME symlink: libc asks for it by a name it already
+// answers to once loaded.
+func (p *libraryPlacer) placeInterpreter(imagePath string, interp elfinfo.Library) error {
+	entry, err := p.file(imagePath, interp.HostPath)
+	if err != nil {
+		return err
+	}
+	p.entries = append(p.entries, entry)
+	soname := interp.Info.SONAME
+	if soname == "" {
+		soname = path.Base(imagePath)
+	}
+	p.cacheEntries = append(p.cacheEntries, ldcache.Entry{SONAME: soname, Path: imagePath})
+	return nil
+}
+
+// file describes one placed file, with the default and per-file metadata
+// applied.
+func (p *libraryPlacer) file(imagePath, hostPath string) (*baselayer.BaseEntry, error) {
+	entry := basemeta.FileFromPath(imagePath, p.mode, hostPath)
+	if err := applyFileMetadata(entry, p.defaults); err != nil {
+		return nil, fmt.Errorf("applying --default-metadata: %w", err)
+	}
+	if raw, ok := p.fileMetadata[imagePath]; ok {
+		override, err := parseFileMetadata(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parsing metadata for %s: %w", imagePath, err)
+		}
+		if err := applyFileMetadata(entry, override); err != nil {
+			return nil, fmt.Errorf("applying metadata for %s: %w", imagePath, err)
+		}
+	}
+	return entry, nil
+}
+
+// usrMergedDirs are the top-level directories a usr-merged image makes
+// symlinks into /usr.
+var usrMergedDirs = map[string]bool{"bin": true, "sbin": true, "lib": true, "lib32": true, "lib64": true, "libx32": true}
+
+// interpreterPath is where the dynamic linker named by PT_INTERP is placed.
+// In a usr-merged image /lib64 is a symlink to usr/lib64, and a file cannot be
+// placed beneath a symlink, so the loader goes to the directory the symlink
+// points at; PT_INTERP still resolves to it at run time.
+func interpreterPath(interp string, usrMerged bool) string {
+	interp = path.Clean("/" + interp)
+	top, _, _ := strings.Cut(strings.TrimPrefix(interp, "/"), "/")
+	if usrMerged && usrMergedDirs[top] {
+		return "/usr" + interp
+	}
+	return interp
+}
+
 // parseFileMetadata decodes the JSON that the file_metadata() Starlark helper
 // produces. An empty string means "no metadata".
 func parseFileMetadata(raw string) (*fileMetadataJSON, error) {
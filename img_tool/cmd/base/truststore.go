@@ -14,11 +14,12 @@ import (
 )
 
 // certificatePaths are the locations distribution packages keep their CA
-// certificates in. Only files under these prefixes are harvested from a .deb or
-// .rpm; nothing else about the package is read.
+// certificates in. Only files under these prefixes are harvested from a .deb,
+// .rpm or .apk; nothing else about the package is read.
 var certificatePaths = pkgfile.PrefixMatcher(
 	// Debian / Ubuntu: ca-certificates ships PEM files here, and the
-	// concatenated bundle is generated into /etc/ssl/certs.
+	// concatenated bundle is generated into /etc/ssl/certs. Alpine uses the
+	// same layout, with the bundle shipped in ca-certificates-bundle.
 	"usr/share/ca-certificates",
 	"etc/ssl/certs",
 	// Fedora / RHEL / SUSE: ca-certificates ships extracted bundles here.
@@ -30,7 +31,7 @@ var certificatePaths = pkgfile.PrefixMatcher(
 
 // trustStoreProcess implements `img base trust-store`.
 func trustStoreProcess(_ context.Context, args []string) {
-	var certs, debs, rpms stringsFlag
+	var certs, debs, rpms, apks stringsFlag
 	var outputPath, producer string
 	var bundlePath, explodedDir, javaKeystorePath, javaKeystorePassword string
 	var writeBundle, writeExploded, writeJavaKeystore bool
@@ -40,6 +41,7 @@ func trustStoreProcess(_ context.Context, args []string) {
 	flagSet.Var(&certs, "cert", "Path of a certificate file (PEM, DER or PKCS#7). Can be repeated.")
 	flagSet.Var(&debs, "deb", "Path of a .deb package to harvest certificates from. Can be repeated.")
 	flagSet.Var(&rpms, "rpm", "Path of an .rpm package to harvest certificates from. Can be repeated.")
+	flagSet.Var(&apks, "apk", "Path of an Alpine .apk package to harvest certificates from. Can be repeated.")
 	flagSet.StringVar(&outputPath, "output", "", "Path of the base metadata stream to write.")
 	flagSet.StringVar(&producer, "producer", "", "Label of the rule producing this stream, used in conflict messages.")
 	flagSet.BoolVar(&writeBundle, "bundle", true, "Write a single concatenated PEM bundle.")
@@ -74,6 +76,11 @@ func trustStoreProcess(_ context.Context, args []string) {
 			fail("trust-store", err)
 		}
 	}
+	for _, apkPath := range apks {
+		if err := addPackageCertificates(collection, apkPath, pkgfile.ExtractAPK); err != nil {
+			fail("trust-store", err)
+		}
+	}
 
 	if collection.Len() == 0 {
 		fail("trust-store", fmt.Errorf("no certificates found in any input"))
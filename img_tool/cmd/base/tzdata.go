@@ -0,0 +1,282 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta/tzdata"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/proto/baselayer"
+)
+
+// tzdataProcess implements `img base tzdata`.
+//
+// The zone files come from one of two places. With --source, the text sources
+// of the IANA time zone database (the per-continent files or tzdata.zi) are
+// compiled into TZif files, which is how a distribution builds its tzdata
+// package. With --zoneinfo and --zoneinfo-file, an already compiled zoneinfo
+// tree -- out of a tzdata package, say -- is copied as it is.
+//
+// Either way --zone narrows the tree to the zones an image actually uses:
+// most need a handful, not the 600-odd of the full database. Links among the
+// selected names stay links, and their targets come along.
+//
+// --localtime sets the zone the image runs in: /etc/localtime becomes a
+// symlink into the zoneinfo tree, and /etc/timezone names the zone, for the
+// readers (Debian tooling, older JVMs) that look there instead.
+func tzdataProcess(_ context.Context, args []string) {
+	var sources, tables, zoneinfoDirs, zones stringsFlag
+	zoneinfoFiles := make(kvFlag)
+	var outputPath, producer, zoneinfoPath, localtime string
+	var writeTimezone bool
+	var mode modeFlag
+
+	flagSet := flag.NewFlagSet("base tzdata", flag.ExitOnError)
+	flagSet.Var(&sources, "source", "Path of an IANA tz source file to compile, e.g. europe or tzdata.zi. Can be repeated.")
+	flagSet.Var(&tables, "table", "Path of a file copied into the zoneinfo directory under its own name, e.g. zone1970.tab. Can be repeated.")
+	flagSet.Var(&zoneinfoDirs, "zoneinfo", "Directory holding a compiled zoneinfo tree to copy. Can be repeated.")
+	flagSet.Var(zoneinfoFiles, "zoneinfo-file", "A compiled zoneinfo file as NAME=<host path>, NAME relative to the zoneinfo directory. Can be repeated.")
+	flagSet.Var(&zones, "zone", "Name of a zone to include, e.g. Europe/Berlin. Can be repeated. Defaults to every zone.")
+	flagSet.StringVar(&outputPath, "output", "", "Path of the base metadata stream to write.")
+	flagSet.StringVar(&producer, "producer", "", "Label of the rule producing this stream, used in conflict messages.")
+	flagSet.StringVar(&zoneinfoPath, "zoneinfo-dir", "/usr/share/zoneinfo", "Directory of the zoneinfo tree inside the image.")
+	flagSet.StringVar(&localtime, "localtime", "", "Zone the image runs in, linked from /etc/localtime.")
+	flagSet.BoolVar(&writeTimezone, "timezone-file", true, "Also write /etc/timezone naming the --localtime zone.")
+	flagSet.Var(&mode, "mode", "Octal file mode of the written zone files. Defaults to 0644.")
+	if err := flagSet.Parse(args); err != nil {
+		fail("tzdata", err)
+	}
+
+	compiling := len(sources) > 0
+	copying := len(zoneinfoDirs) > 0 || len(zoneinfoFiles) > 0
+	switch {
+	case compiling && copying:
+		fail("tzdata", fmt.Errorf("pass either --source or --zoneinfo/--zoneinfo-file, not both"))
+	case !compiling && !copying:
+		fail("tzdata", fmt.Errorf("no time zone data given: pass --source, --zoneinfo or --zoneinfo-file"))
+	}
+	// The local time zone has to be in the tree for /etc/localtime to point
+	// at something.
+	if localtime != "" && len(zones) > 0 {
+		zones = append(zones, localtime)
+	}
+
+	fileMode := mode.or(0o644)
+	var tree *zoneTree
+	var err error
+	if compiling {
+		tree, err = compileZoneTree(sources, zones)
+	} else {
+		tree, err = readZoneTree(zoneinfoDirs, zoneinfoFiles, zoneinfoPath, zones)
+	}
+	if err != nil {
+		fail("tzdata", err)
+	}
+	for _, table := range tables {
+		tree.add(filepath.Base(table), zoneTreeEntry{hostPath: table})
+	}
+
+	var entries []*baselayer.BaseEntry
+	for _, name := range tree.names() {
+		entry := tree.entries[name]
+		imagePath := path.Join(zoneinfoPath, name)
+		switch {
+		case entry.link != "":
+			entries = append(entries, basemeta.Symlink(imagePath, entry.link))
+		case entry.hostPath != "":
+			entries = append(entries, basemeta.FileFromPath(imagePath, fileMode, entry.hostPath))
+		default:
+			entries = append(entries, basemeta.File(imagePath, fileMode, entry.content))
+		}
+	}
+
+	if localtime != "" {
+		if _, ok := tree.entries[localtime]; !ok {
+			fail("tzdata", fmt.Errorf("--localtime %q is not a zone of the time zone data", localtime))
+		}
+		entries = append(entries, basemeta.Symlink("/etc/localtime", relativeSymlinkTarget("/etc/localtime", path.Join(zoneinfoPath, localtime))))
+		if writeTimezone {
+			entries = append(entries, basemeta.File("/etc/timezone", 0o644, []byte(localtime+"\n")))
+		}
+	}
+
+	if err := writeStream(outputPath, producer, entries); err != nil {
+		fail("tzdata", err)
+	}
+}
+
+// zoneTreeEntry is one file of a zoneinfo tree: compiled content, a file on
+// the host, or a symlink, relative to the directory it is in.
+type zoneTreeEntry struct {
+	content  []byte
+	hostPath string
+	link     string
+}
+
+// zoneTree is a zoneinfo tree keyed by path relative to its root.
+type zoneTree struct {
+	entries map[string]zoneTreeEntry
+}
+
+func (t *zoneTree) add(name string, entry zoneTreeEntry) {
+	if t.entries == nil {
+		t.entries = make(map[string]zoneTreeEntry)
+	}
+	t.entries[name] = entry
+}
+
+func (t *zoneTree) names() []string {
+	names := make([]string, 0, len(t.entries))
+	for name := range t.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compileZoneTree compiles IANA sources into a zoneinfo tree holding the
+// selected zones, or all of them. A link becomes a symlink to the zone it
+// resolves to.
+func compileZoneTree(sources, selected []string) (*zoneTree, error) {
+	db := tzdata.NewDatabase()
+	for _, source := range sources {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		err = db.Parse(f, source)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	links := db.Links()
+	if len(selected) == 0 {
+		selected = db.Zones()
+		for name := range links {
+			selected = append(selected, name)
+		}
+	}
+
+	tree := &zoneTree{}
+	for _, name := range selected {
+		zone, err := db.Resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tree.entries[zone]; !ok {
+			data, err := db.Compile(zone)
+			if err != nil {
+				return nil, err
+			}
+			tree.add(zone, zoneTreeEntry{content: data})
+		}
+		if zone != name {
+			tree.add(name, zoneTreeEntry{link: relativeSymlinkTarget("/"+name, "/"+zone)})
+		}
+	}
+	return tree, nil
+}
+
+// readZoneTree collects a compiled zoneinfo tree from directories and loose
+// files, then narrows it to the selected zones when there are any. Files that
+// are not zones (zone1970.tab, iso3166.tab and the like) are small and read by
+// zone pickers, so they are always kept.
+func readZoneTree(dirs []string, files kvFlag, zoneinfoPath string, selected []string) (*zoneTree, error) {
+	all := &zoneTree{}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(hostPath string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, hostPath)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			if d.Type()&fs.ModeSymlink != 0 {
+				target, err := os.Readlink(hostPath)
+				if err != nil {
+					return err
+				}
+				all.add(name, zoneTreeEntry{link: target})
+				return nil
+			}
+			all.add(name, zoneTreeEntry{hostPath: hostPath})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading zoneinfo tree %s: %w", dir, err)
+		}
+	}
+	for _, name := range files.keys() {
+		all.add(path.Clean(strings.TrimPrefix(name, "/")), zoneTreeEntry{hostPath: files[name]})
+	}
+	if len(selected) == 0 {
+		return all, nil
+	}
+
+	tree := &zoneTree{}
+	for _, name := range all.names() {
+		entry := all.entries[name]
+		if entry.hostPath == "" {
+			continue
+		}
+		isZone, err := isTZif(entry.hostPath)
+		if err != nil {
+			return nil, err
+		}
+		if !isZone {
+			tree.add(name, entry)
+		}
+	}
+	for _, name := range selected {
+		// Follow a link to the file it ends at, keeping every link on the
+		// way. The bound guards against a loop of symlinks.
+		for hops := 0; ; hops++ {
+			entry, ok := all.entries[name]
+			if !ok {
+				return nil, fmt.Errorf("zone %q is not in the zoneinfo tree", name)
+			}
+			if hops > 40 {
+				return nil, fmt.Errorf("too many levels of symlinks resolving zone %q", name)
+			}
+			tree.add(name, entry)
+			if entry.link == "" {
+				break
+			}
+			name = zoneLinkTarget(name, entry.link, zoneinfoPath)
+		}
+	}
+	return tree, nil
+}
+
+// zoneLinkTarget resolves a symlink of a zoneinfo tree to the name it points
+// at, relative to the tree. An absolute target is taken as an image path.
+func zoneLinkTarget(name, target, zoneinfoPath string) string {
+	if path.IsAbs(target) {
+		return strings.TrimPrefix(path.Clean(target), path.Clean(zoneinfoPath)+"/")
+	}
+	return path.Join(path.Dir(name), target)
+}
+
+// isTZif reports whether a file is a compiled zone, by its magic.
+func isTZif(hostPath string) (bool, error) {
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	n, _ := f.Read(magic)
+	return bytes.Equal(magic[:n], []byte("TZif")), nil
+}
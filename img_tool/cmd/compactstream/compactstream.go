@@ -8,6 +8,7 @@
 //
 //	reconstruct   rebuild a layer tar from an index and a content-addressed directory
 //	list (ls)     print an index's header, contents, and statistics without reconstruction
+//	index         build the random access index that serves byte ranges of the layer
 package compactstreamcmd
 
 import (
@@ -20,7 +21,8 @@ const usage = `Usage: img compact-stream <subcommand> [args...]
 
 Subcommands:
   reconstruct   rebuilds a layer tar from a compact stream and a content-addressed directory
-  list, ls      prints a compact stream's header, contents, and statistics without reconstruction`
+  list, ls      prints a compact stream's header, contents, and statistics without reconstruction
+  index         builds the random access index that serves byte ranges of the layer`
 
 // CompactStreamProcess dispatches to a compact-stream subcommand.
 func CompactStreamProcess(ctx context.Context, args []string) {
@@ -35,6 +37,8 @@ func CompactStreamProcess(ctx context.Context, args []string) {
 		reconstructProcess(ctx, rest)
 	case "list", "ls":
 		listProcess(ctx, rest)
+	case "index":
+		indexProcess(ctx, rest)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown compact-stream subcommand %q\n\n", subcommand)
 		fmt.Fprintln(os.Stderr, usage)
@@ -0,0 +1,118 @@
+// index builds the random access index of a compact stream (.cstream), which
+// lets a reader serve any byte range of the reconstructed layer, compressed or
+// uncompressed, without reconstructing it from the start.
+//
+// The offsets of a compressed seekable (eStargz) layer come from the layer
+// blob, which is taken from --layer or, if it is not at hand, reconstructed
+// from --cas-dir into a temporary file first. The index is written next to the
+// compact stream (<cstream>.idx) unless --output says otherwise.
+package compactstreamcmd
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
+)
+
+func indexProcess(ctx context.Context, args []string) {
+	var compactStreamPath string
+	var layerPath string
+	var casDir string
+	var outputPath string
+
+	flagSet := flag.NewFlagSet("compact-stream index", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Builds the random access index of a compact stream.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img compact-stream index --compact-stream <cstream> [--layer <blob> | --cas-dir <dir>] [--output <index>]\n\n")
+		fmt.Fprintf(flagSet.Output(), "Compressed layers need the layer blob (--layer), or the content-addressed\n")
+		fmt.Fprintf(flagSet.Output(), "directory (--cas-dir) to reconstruct it from.\n\n")
+		flagSet.PrintDefaults()
+	}
+	flagSet.StringVar(&compactStreamPath, "compact-stream", "", "Path to the compact stream (.cstream) (required)")
+	flagSet.StringVar(&layerPath, "layer", "", "Path to the layer blob the compact stream reconstructs")
+	flagSet.StringVar(&casDir, "cas-dir", "", "Content-addressed directory (containing sha256/<hex>) to reconstruct the layer blob from when --layer is not given")
+	flagSet.StringVar(&outputPath, "output", "", "Path to write the index (default: <compact-stream>.idx)")
+
+	if err := flagSet.Parse(args); err != nil {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if compactStreamPath == "" {
+		fmt.Fprintf(os.Stderr, "Error: --compact-stream is required\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if outputPath == "" {
+		outputPath = compactStreamPath + ".idx"
+	}
+
+	compactStreamData, err := os.ReadFile(compactStreamPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading compact stream %s: %v\n", compactStreamPath, err)
+		os.Exit(1)
+	}
+
+	index, err := buildIndex(ctx, compactStreamData, layerPath, casDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error building random access index: %v\n", err)
+		os.Exit(1)
+	}
+
+	var encoded bytes.Buffer
+	if _, err := index.WriteTo(&encoded); err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding random access index: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(outputPath, encoded.Bytes(), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing random access index %s: %v\n", outputPath, err)
+		os.Exit(1)
+	}
+}
+
+// buildIndex builds the index from the layer blob at layerPath, from a blob
+// reconstructed with the content-addressed directory casDir, or, for an
+// uncompressed layer, from the compact stream alone.
+func buildIndex(ctx context.Context, compactStreamData []byte, layerPath, casDir string) (*compactstream.Index, error) {
+	header, err := compactstream.ReadHeader(bytes.NewReader(compactStreamData))
+	if err != nil {
+		return nil, err
+	}
+	if header.OriginalCompression.Compression == compactstream.OriginalCompressionNone {
+		return compactstream.BuildIndex(compactStreamData, nil, 0)
+	}
+
+	var blob *os.File
+	switch {
+	case layerPath != "":
+		blob, err = os.Open(layerPath)
+		if err != nil {
+			return nil, fmt.Errorf("opening layer: %w", err)
+		}
+	case casDir != "":
+		blob, err = os.CreateTemp("", "compact-stream-layer-*")
+		if err != nil {
+			return nil, fmt.Errorf("creating temporary layer file: %w", err)
+		}
+		defer os.Remove(blob.Name())
+		store := &dirStore{shaDir: filepath.Join(casDir, "sha256")}
+		if err := compactstream.Reconstruct(ctx, bytes.NewReader(compactStreamData), store, blob); err != nil {
+			blob.Close()
+			return nil, fmt.Errorf("reconstructing layer: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("the layer is compressed, so --layer or --cas-dir is required")
+	}
+	defer blob.Close()
+
+	size, err := blob.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return compactstream.BuildIndex(compactStreamData, blob, size)
+}
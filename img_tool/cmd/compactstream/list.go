@@ -66,8 +66,11 @@ func writeListing(w io.Writer, name string, info *compactstream.Info, indexSize
 	row(w, "Hash algorithm:", fmt.Sprintf("%s (%d-byte digests)", hashAlgoName(h.HashAlgo), h.HashSize))
 	row(w, "Stream compression:", streamCompressionName(h.StreamCompression))
 	row(w, "Layer compression:", describeOriginalCompression(h.OriginalCompression))
-	row(w, "Seekable (estargz):", yesNo(h.OriginalCompression.Seekable))
+	row(w, "Seekable:", seekableName(h.OriginalCompression))
 	row(w, "End padding:", humanizeBytes(uint64(h.OriginalCompression.EndPadding)))
+	if n := len(h.OriginalCompression.PrioritizedFiles); n > 0 {
+		row(w, "Prioritized files:", fmt.Sprintf("%d (written first, before the prefetch landmark)", n))
+	}
 	row(w, "Reference table:", fmt.Sprintf("%d entries at offset %d (%s)", h.RefCount(), h.RefTableOffset, humanizeBytes(h.RefTableSize)))
 	row(w, "Byte stream:", fmt.Sprintf("%s on disk, at offset %d", humanizeBytes(h.StreamSize), h.StreamOffset))
 	if h.HasCompressedStreamInfo {
@@ -178,6 +181,17 @@ func describeOriginalCompression(o compactstream.OriginalCompressionInfo) string
 	return fmt.Sprintf("%s (level %s, jobs %s)", name, level, jobs)
 }
 
+// seekableName names the seekable layout of the layer, if any.
+func seekableName(o compactstream.OriginalCompressionInfo) string {
+	switch {
+	case o.ZstdChunked:
+		return "yes (zstd:chunked)"
+	case o.Seekable:
+		return "yes (estargz)"
+	}
+	return "no"
+}
+
 // humanizeBytes renders a byte count as raw bytes plus a binary-unit
 // approximation once it reaches 1 KiB.
 func humanizeBytes(n uint64) string {
@@ -0,0 +1,153 @@
+package copycmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/imagecopy"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/prefetch"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+func CopyProcess(ctx context.Context, args []string) {
+	var tags stringSliceFlag
+	var jobs int
+	var referrers bool
+	var prefetchSize int
+
+	flagSet := flag.NewFlagSet("copy", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Copies an image or index, with its referrers (signatures, SBOMs, SOCI indexes, ...), from one registry reference to another.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img copy [OPTIONS] SOURCE DESTINATION\n\n")
+		fmt.Fprintf(flagSet.Output(), "SOURCE is a tag or digest reference. DESTINATION is a repository, or a tag or\n")
+		fmt.Fprintf(flagSet.Output(), "digest reference in it; the manifest keeps its digest, so a destination digest\n")
+		fmt.Fprintf(flagSet.Output(), "must be the source's. Within one registry the blobs are cross-mounted from the\n")
+		fmt.Fprintf(flagSet.Output(), "source repository; across registries they are streamed. Reads go through the\n")
+		fmt.Fprintf(flagSet.Output(), "pull gateway and writes through the push gateway, when configured.\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img copy staging.example.com/team/app@sha256:abc123... prod.example.com/team/app:v1.2.3",
+			"img copy --tag latest --tag v1.2.3 staging.example.com/team/app:candidate prod.example.com/team/app",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+
+	flagSet.Var(&tags, "tag", "Additional tag to write at the destination (can be specified multiple times)")
+	flagSet.IntVar(&jobs, "jobs", registryopts.DefaultJobs, "Number of blobs and manifests copied at once")
+	flagSet.BoolVar(&referrers, "referrers", true, "Copy the referrers of the image and of every manifest of an index, recursively")
+	flagSet.IntVar(&prefetchSize, "prefetch-size", prefetch.DefaultSize, "Bytes of a layer read ahead of the upload when copying across registries (0 disables read-ahead)")
+
+	if err := flagSet.Parse(args); err != nil {
+		// flag has already printed the error and the usage.
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+	if flagSet.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Error: expected SOURCE and DESTINATION\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	if err := run(ctx, flagSet.Arg(0), flagSet.Arg(1), tags, jobs, referrers, prefetchSize); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, source, destination string, tags []string, jobs int, referrers bool, prefetchSize int) error {
+	src, err := name.ParseReference(source, registryopts.NameOptions()...)
+	if err != nil {
+		return fmt.Errorf("parsing source: %w", err)
+	}
+	dst, dstTag, dstDigest, err := parseDestination(destination)
+	if err != nil {
+		return err
+	}
+	if dstTag != "" {
+		tags = append([]string{dstTag}, tags...)
+	}
+
+	pull, err := registryopts.Pull()
+	if err != nil {
+		return fmt.Errorf("configuring pull transport: %w", err)
+	}
+	push, err := registryopts.Push()
+	if err != nil {
+		return fmt.Errorf("configuring push transport: %w", err)
+	}
+	registryopts.LimitConcurrencyToJobs(jobs)
+	defer registryopts.LogConcurrencySummary(os.Stderr)
+	copier := imagecopy.NewBuilder().
+		WithSourceRemoteOptions(pull.WithJobs(jobs).Remote()...).
+		WithDestinationRemoteOptions(push.WithJobs(jobs).Remote()...).
+		WithJobs(jobs).
+		WithReferrers(referrers).
+		WithPrefetchSize(prefetchSize).
+		Build()
+
+	// A destination digest is checked before anything is written.
+	if dstDigest != "" {
+		resolved, err := copier.Resolve(ctx, src)
+		if err != nil {
+			return err
+		}
+		if resolved.Digest.String() != dstDigest {
+			return fmt.Errorf("destination digest %s does not match the source, which is %s", dstDigest, resolved.Digest)
+		}
+	}
+
+	result, err := copier.Copy(ctx, src, dst, tags)
+	if err != nil {
+		return err
+	}
+	how := "streamed"
+	if result.Mounted {
+		how = "cross-mounted"
+	}
+	fmt.Fprintf(os.Stderr, "copied %s (%s blobs, %d referrers)\n", result.Source, how, len(result.Referrers))
+	for _, ref := range result.References {
+		fmt.Println(ref.String())
+	}
+	return nil
+}
+
+// parseDestination splits a destination into its repository and the tag or
+// digest it names, if any.
+func parseDestination(destination string) (repository name.Repository, tag, digest string, err error) {
+	if repository, err := name.NewRepository(destination, registryopts.NameOptions()...); err == nil {
+		return repository, "", "", nil
+	}
+	ref, err := name.ParseReference(destination, registryopts.NameOptions(name.StrictValidation)...)
+	if err != nil {
+		return name.Repository{}, "", "", fmt.Errorf("parsing destination: %w", err)
+	}
+	switch ref := ref.(type) {
+	case name.Tag:
+		return ref.Context(), ref.TagStr(), "", nil
+	case name.Digest:
+		return ref.Context(), "", ref.DigestStr(), nil
+	}
+	return name.Repository{}, "", "", fmt.Errorf("parsing destination: unexpected reference %s", ref)
+}
+
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,33 @@
+package copycmd
+
+import "testing"
+
+func TestParseDestination(t *testing.T) {
+	for _, tc := range []struct {
+		destination, repository, tag, digest string
+		wantErr                              bool
+	}{
+		{destination: "prod.example.com/team/app", repository: "prod.example.com/team/app"},
+		{destination: "prod.example.com/team/app:v1.2.3", repository: "prod.example.com/team/app", tag: "v1.2.3"},
+		{destination: "localhost:5000/app", repository: "localhost:5000/app"},
+		{destination: "localhost:5000/app:latest", repository: "localhost:5000/app", tag: "latest"},
+		{
+			destination: "prod.example.com/team/app@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			repository:  "prod.example.com/team/app",
+			digest:      "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		},
+		{destination: "prod.example.com/Team/App", wantErr: true},
+	} {
+		repository, tag, digest, err := parseDestination(tc.destination)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseDestination(%q) error = %v, wantErr %v", tc.destination, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if repository.Name() != tc.repository || tag != tc.tag || digest != tc.digest {
+			t.Errorf("parseDestination(%q) = %q, %q, %q; want %q, %q, %q", tc.destination, repository.Name(), tag, digest, tc.repository, tc.tag, tc.digest)
+		}
+	}
+}
@@ -21,16 +21,25 @@ type result struct {
 	msg  string // failure detail (empty on pass)
 }
 
+// capabilities is what a run can validate beyond the config and mtree.
+type capabilities struct {
+	// contents is set when every image comes with its layer contents.
+	contents bool
+	// commands is set when the request opted into running commandTests (which
+	// also needs the layer contents).
+	commands bool
+}
+
 // unsupportedCategories returns the CST test categories present (non-empty) in st
-// that cannot be validated from the image config JSON + mtree. A non-empty return
-// means the whole config must be rejected with a clear error.
-func unsupportedCategories(st *StructureTest) []string {
+// that cannot be validated with caps. A non-empty return means the whole config
+// must be rejected with a clear error.
+func unsupportedCategories(st *StructureTest, caps capabilities) []string {
 	var cats []string
-	if len(st.CommandTests) > 0 {
-		cats = append(cats, fmt.Sprintf("commandTests (%d): require running the container", len(st.CommandTests)))
+	if len(st.CommandTests) > 0 && !caps.commands {
+		cats = append(cats, fmt.Sprintf("commandTests (%d): require running the container; set run_commands = True on the image_structure_test to run them in a sandbox (Linux only)", len(st.CommandTests)))
 	}
-	if len(st.FileContentTests) > 0 {
-		cats = append(cats, fmt.Sprintf("fileContentTests (%d): require reading file contents, which the mtree does not carry (only content digests)", len(st.FileContentTests)))
+	if len(st.FileContentTests) > 0 && !caps.contents {
+		cats = append(cats, fmt.Sprintf("fileContentTests (%d): require reading file contents, which the mtree does not carry (only content digests); set layer_contents = True on the image_structure_test to provide the layers", len(st.FileContentTests)))
 	}
 	if len(st.LicenseTests) > 0 {
 		cats = append(cats, fmt.Sprintf("licenseTests (%d): require scanning files inside a running container", len(st.LicenseTests)))
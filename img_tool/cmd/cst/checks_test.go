@@ -120,10 +120,16 @@ func TestUnsupportedCategories(t *testing.T) {
 		FileContentTests: []FileContentTest{{Name: "b"}},
 		LicenseTests:     []LicenseTest{{Debian: true}},
 	}
-	if cats := unsupportedCategories(st); len(cats) != 3 {
+	if cats := unsupportedCategories(st, capabilities{}); len(cats) != 3 {
 		t.Errorf("expected 3 unsupported categories, got %v", cats)
 	}
-	if cats := unsupportedCategories(&StructureTest{}); len(cats) != 0 {
+	if cats := unsupportedCategories(st, capabilities{contents: true}); len(cats) != 2 {
+		t.Errorf("expected 2 unsupported categories with layer contents, got %v", cats)
+	}
+	if cats := unsupportedCategories(st, capabilities{contents: true, commands: true}); len(cats) != 1 {
+		t.Errorf("expected 1 unsupported category with the command runner, got %v", cats)
+	}
+	if cats := unsupportedCategories(&StructureTest{}, capabilities{}); len(cats) != 0 {
 		t.Errorf("expected 0 unsupported categories, got %v", cats)
 	}
 }
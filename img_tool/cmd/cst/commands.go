@@ -0,0 +1,195 @@
+package cst
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// sandboxExecArg is the hidden first argument with which `img
+// image-structure-test` re-executes itself as the init process of a command
+// test's sandbox (see sandboxExec).
+const sandboxExecArg = "--internal-sandbox-exec"
+
+// A sandbox that fails before running the command exits with
+// sandboxErrorExitCode after writing sandboxErrorPrefix and the reason to
+// stderr; 125 is what `docker run` uses for its own failures. As with docker,
+// 126 means the command could not be executed and 127 that it was not found.
+const (
+	sandboxErrorExitCode = 125
+	sandboxErrorPrefix   = "image-structure-test sandbox: "
+)
+
+// defaultPath is the PATH a container runtime sets when the image has none.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// sandboxCommand is one command to run inside an extracted image root.
+type sandboxCommand struct {
+	rootfs  string
+	workdir string
+	argv    []string
+	env     []string
+	uid     int
+	gid     int
+}
+
+// commandOutput is what a sandboxed command produced.
+type commandOutput struct {
+	stdout   string
+	stderr   string
+	exitCode int
+}
+
+// commandSkipReason explains why commandTests cannot run for an image on this
+// host, or returns "" when they can. The commands execute natively, so the
+// image must be a Linux image for the host's architecture.
+func commandSkipReason(platform Platform, cf *v1.ConfigFile) string {
+	os_, arch := platform.OS, platform.Architecture
+	if os_ == "" {
+		os_ = cf.OS
+	}
+	if arch == "" {
+		arch = cf.Architecture
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Sprintf("commands run only on Linux hosts, not %s", runtime.GOOS)
+	}
+	if os_ != "linux" || arch != runtime.GOARCH {
+		return fmt.Sprintf("the image is %s/%s but the host is linux/%s", os_, arch, runtime.GOARCH)
+	}
+	return ""
+}
+
+// checkCommands runs each commandTest in a fresh copy of the image filesystem
+// and checks its exit code and output, like container-structure-test does
+// with a fresh container per test.
+func checkCommands(ctx context.Context, lfs *layerFS, cf *v1.ConfigFile, global []EnvVar, tests []CommandTest) []result {
+	var results []result
+	for _, t := range tests {
+		name := "command " + t.Name
+		if t.Name == "" {
+			name = "command " + t.Command
+		}
+		if msg := runCommandTest(ctx, lfs, cf, global, t); msg != "" {
+			results = append(results, result{name, false, msg})
+		} else {
+			results = append(results, result{name, true, ""})
+		}
+	}
+	return results
+}
+
+// runCommandTest runs one test's setup commands, command, and teardown
+// commands, returning a failure message or "" on success.
+func runCommandTest(ctx context.Context, lfs *layerFS, cf *v1.ConfigFile, global []EnvVar, t CommandTest) string {
+	if t.Command == "" {
+		return "command is empty"
+	}
+	rootfs, err := os.MkdirTemp("", "image-structure-test-rootfs-")
+	if err != nil {
+		return fmt.Sprintf("creating the image root: %v", err)
+	}
+	defer removeRootfs(rootfs)
+	if err := extractRootfs(ctx, lfs, rootfs); err != nil {
+		return fmt.Sprintf("extracting the image filesystem: %v", err)
+	}
+	uid, gid, home, err := resolveUser(rootfs, cf.Config.User)
+	if err != nil {
+		return fmt.Sprintf("resolving the image user: %v", err)
+	}
+	workdir := cf.Config.WorkingDir
+	if workdir == "" {
+		workdir = "/"
+	}
+	// A container runtime creates a missing working directory.
+	if err := mkdirRootfs(rootfs, canonicalPath(workdir)); err != nil {
+		return fmt.Sprintf("creating the working directory: %v", err)
+	}
+	env := commandEnv(cf.Config.Env, global, t.EnvVars, home)
+
+	run := func(argv []string) (commandOutput, error) {
+		return runSandboxed(ctx, sandboxCommand{rootfs: rootfs, workdir: workdir, argv: argv, env: env, uid: uid, gid: gid})
+	}
+	for _, setup := range t.Setup {
+		if msg := runAuxCommand("setup", setup, run); msg != "" {
+			return msg
+		}
+	}
+	out, err := run(append([]string{t.Command}, t.Args...))
+	if err != nil {
+		return err.Error()
+	}
+	var problems []string
+	if out.exitCode != t.ExitCode {
+		problems = append(problems, fmt.Sprintf("exit code %d, want %d", out.exitCode, t.ExitCode))
+	}
+	if msg := matchRegexes("output", []byte(out.stdout), t.ExpectedOutput, t.ExcludedOutput); msg != "" {
+		problems = append(problems, msg)
+	}
+	if msg := matchRegexes("error", []byte(out.stderr), t.ExpectedError, t.ExcludedError); msg != "" {
+		problems = append(problems, msg)
+	}
+	for _, teardown := range t.Teardown {
+		if msg := runAuxCommand("teardown", teardown, run); msg != "" {
+			problems = append(problems, msg)
+		}
+	}
+	if len(problems) > 0 && (out.stdout != "" || out.stderr != "") {
+		problems = append(problems, fmt.Sprintf("stdout: %q, stderr: %q", out.stdout, out.stderr))
+	}
+	return strings.Join(problems, "; ")
+}
+
+// runAuxCommand runs a setup or teardown command, which must succeed.
+func runAuxCommand(kind string, argv []string, run func([]string) (commandOutput, error)) string {
+	if len(argv) == 0 {
+		return kind + " command is empty"
+	}
+	out, err := run(argv)
+	if err != nil {
+		return fmt.Sprintf("%s command %q: %v", kind, argv, err)
+	}
+	if out.exitCode != 0 {
+		return fmt.Sprintf("%s command %q exited with %d: %s", kind, argv, out.exitCode, strings.TrimSpace(out.stderr))
+	}
+	return ""
+}
+
+// commandEnv is the image environment plus the config's globalEnvVars and the
+// test's envVars, in that order. Values may reference earlier variables as
+// $VAR or ${VAR}. PATH and HOME get a container runtime's defaults when unset.
+func commandEnv(imageEnv []string, global, local []EnvVar, home string) []string {
+	values := map[string]string{}
+	var order []string
+	set := func(k, v string) {
+		if _, ok := values[k]; !ok {
+			order = append(order, k)
+		}
+		values[k] = v
+	}
+	for _, e := range imageEnv {
+		k, v, _ := strings.Cut(e, "=")
+		set(k, v)
+	}
+	for _, e := range append(append([]EnvVar{}, global...), local...) {
+		set(e.Key, os.Expand(e.Value, func(k string) string { return values[k] }))
+	}
+	if _, ok := values["PATH"]; !ok {
+		set("PATH", defaultPath)
+	}
+	if _, ok := values["HOME"]; !ok {
+		if home == "" {
+			home = "/"
+		}
+		set("HOME", home)
+	}
+	env := make([]string, 0, len(order))
+	for _, k := range order {
+		env = append(env, k+"="+values[k])
+	}
+	return env
+}
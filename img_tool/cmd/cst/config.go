@@ -13,9 +13,9 @@ import (
 // config schema (github.com/GoogleContainerTools/container-structure-test,
 // pkg/types/v2). Every field CST supports is parsed so users can migrate their
 // existing YAML/JSON config files verbatim; categories that cannot be validated
-// from only the image config JSON and the image mtree (commandTests,
-// fileContentTests, licenseTests) are rejected with a clear error at run time --
-// see unsupportedCategories.
+// with what the test was given (fileContentTests without the layer contents,
+// commandTests without the sandbox runner, licenseTests always) are rejected
+// with a clear error at run time -- see unsupportedCategories.
 //
 // Fields carry both `yaml` and `json` struct tags with the CST key names, so the
 // same struct parses either format.
@@ -79,9 +79,9 @@ type FileExistenceTest struct {
 	IsExecutableBy string `yaml:"isExecutableBy" json:"isExecutableBy"`
 }
 
-// FileContentTest is parsed for migration compatibility but cannot be validated
-// from the mtree (which records content digests, not bytes) -- see
-// unsupportedCategories.
+// FileContentTest asserts on a file's bytes. The mtree records only content
+// digests, so these are validated against the layer contents, which the test
+// must be given (see unsupportedCategories and checkFileContent).
 type FileContentTest struct {
 	Name             string   `yaml:"name" json:"name"`
 	Path             string   `yaml:"path" json:"path"`
@@ -89,17 +89,21 @@ type FileContentTest struct {
 	ExcludedContents []string `yaml:"excludedContents" json:"excludedContents"`
 }
 
-// CommandTest is parsed for migration compatibility but requires running the
-// container -- see unsupportedCategories.
+// CommandTest runs a command in the image. It requires the opt-in sandbox
+// runner (see unsupportedCategories and checkCommands). Setup and teardown
+// commands run in the same filesystem before and after the command.
 type CommandTest struct {
-	Name           string   `yaml:"name" json:"name"`
-	Command        string   `yaml:"command" json:"command"`
-	Args           []string `yaml:"args" json:"args"`
-	ExpectedOutput []string `yaml:"expectedOutput" json:"expectedOutput"`
-	ExcludedOutput []string `yaml:"excludedOutput" json:"excludedOutput"`
-	ExpectedError  []string `yaml:"expectedError" json:"expectedError"`
-	ExcludedError  []string `yaml:"excludedError" json:"excludedError"`
-	ExitCode       int      `yaml:"exitCode" json:"exitCode"`
+	Name           string     `yaml:"name" json:"name"`
+	Setup          [][]string `yaml:"setup" json:"setup"`
+	Teardown       [][]string `yaml:"teardown" json:"teardown"`
+	EnvVars        []EnvVar   `yaml:"envVars" json:"envVars"`
+	Command        string     `yaml:"command" json:"command"`
+	Args           []string   `yaml:"args" json:"args"`
+	ExpectedOutput []string   `yaml:"expectedOutput" json:"expectedOutput"`
+	ExcludedOutput []string   `yaml:"excludedOutput" json:"excludedOutput"`
+	ExpectedError  []string   `yaml:"expectedError" json:"expectedError"`
+	ExcludedError  []string   `yaml:"excludedError" json:"excludedError"`
+	ExitCode       int        `yaml:"exitCode" json:"exitCode"`
 }
 
 // LicenseTest is parsed for migration compatibility but requires scanning files
@@ -0,0 +1,415 @@
+package cst
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
+)
+
+// OCI layer whiteout markers (see the OCI image-spec layer changeset rules).
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// maxSymlinkHops bounds symlink resolution, like the kernel's ELOOP limit.
+const maxSymlinkHops = 40
+
+// layerSource is one tar layer with its paths resolved. A layer with neither
+// a blob nor a compact stream has no available content.
+type layerSource struct {
+	blob          string
+	compactStream string
+	casDir        string
+}
+
+func (l layerSource) available() bool {
+	return l.blob != "" || l.compactStream != ""
+}
+
+// open returns the layer as an uncompressed tar stream. A compact stream is
+// reconstructed with its CAS references resolved against the CAS directory.
+func (l layerSource) open(ctx context.Context) (io.Reader, io.Closer, error) {
+	if l.blob != "" {
+		f, err := os.Open(l.blob)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening layer %s: %w", l.blob, err)
+		}
+		r, err := mtree.Decompress(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("decompressing layer %s: %w", l.blob, err)
+		}
+		return r, f, nil
+	}
+	f, err := os.Open(l.compactStream)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening compact stream %s: %w", l.compactStream, err)
+	}
+	r, err := compactstream.NewReconstructingReader(ctx, f, &dirStore{shaDir: filepath.Join(l.casDir, "sha256")})
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("reading compact stream %s: %w", l.compactStream, err)
+	}
+	return r, closers{r, f}, nil
+}
+
+// fsEntry is a path in the merged filesystem and the layer that placed it.
+type fsEntry struct {
+	layer    int
+	typeflag byte
+	// linkname is the symlink target as recorded, or the canonical path of the
+	// entry a hardlink points at (within the same layer).
+	linkname string
+}
+
+// layerFS is the merged filesystem of an image's tar layers. It is built from
+// the tar headers alone, applying the layers bottom to top with the OCI
+// whiteout rules; file contents are read back from the owning layer on demand.
+type layerFS struct {
+	layers  []layerSource
+	entries map[string]fsEntry // keyed by canonical path
+	// topUnavailable is the index of the topmost layer without content, or -1.
+	// Anything that layer might have changed cannot be known.
+	topUnavailable int
+}
+
+// buildLayerFS walks the headers of every available layer in order.
+func buildLayerFS(ctx context.Context, layers []layerSource) (*layerFS, error) {
+	fs := &layerFS{layers: layers, entries: map[string]fsEntry{}, topUnavailable: -1}
+	for i, layer := range layers {
+		if !layer.available() {
+			fs.topUnavailable = i
+			continue
+		}
+		if err := fs.apply(ctx, i, layer); err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+	return fs, nil
+}
+
+// apply adds the entries of layer i, removing what its whiteouts hide.
+func (fs *layerFS) apply(ctx context.Context, i int, layer layerSource) error {
+	r, c, err := layer.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		p := canonicalPath(hdr.Name)
+		if p == "." {
+			continue
+		}
+		dir, base := path.Split(p)
+		dir = canonicalPath(dir)
+		switch {
+		case base == whiteoutOpaque:
+			// Hide the directory's contents from lower layers only.
+			fs.removeBelow(dir, i, false)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			fs.removeBelow(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), i, true)
+			continue
+		}
+		if prev, ok := fs.entries[p]; ok && prev.typeflag == tar.TypeDir && hdr.Typeflag != tar.TypeDir {
+			// A non-directory replacing a directory hides its contents.
+			fs.removeBelow(p, i, false)
+		}
+		fs.addParents(dir, i)
+		entry := fsEntry{layer: i, typeflag: hdr.Typeflag}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			entry.linkname = hdr.Linkname
+		case tar.TypeLink:
+			entry.linkname = canonicalPath(hdr.Linkname)
+		}
+		fs.entries[p] = entry
+	}
+}
+
+// addParents records the directories above an entry that its layer does not
+// list itself, as extracting the layer would create them.
+func (fs *layerFS) addParents(dir string, layer int) {
+	for ; dir != "."; dir = path.Dir(dir) {
+		if e, ok := fs.entries[dir]; ok && e.typeflag == tar.TypeDir {
+			return
+		}
+		fs.entries[dir] = fsEntry{layer: layer, typeflag: tar.TypeDir}
+	}
+}
+
+// removeBelow deletes the entries under dir (and dir itself when self is set)
+// that were placed by a layer below layer.
+func (fs *layerFS) removeBelow(dir string, layer int, self bool) {
+	for p, e := range fs.entries {
+		if e.layer >= layer {
+			continue
+		}
+		if (self && p == dir) || isUnder(p, dir) {
+			delete(fs.entries, p)
+		}
+	}
+}
+
+// isUnder reports whether p is strictly inside dir ("." is the root).
+func isUnder(p, dir string) bool {
+	if dir == "." {
+		return p != "."
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// errUnknown marks a lookup whose answer depends on a layer without content.
+var errUnknown = errors.New("the content of a layer it may come from is not available (e.g. a shallow base layer)")
+
+// resolve follows symlinks in every component of p, as opening the path in a
+// running container would, and returns the canonical path and entry it names.
+// A file or symlink placed below a layer without content may have been
+// replaced by that layer, so it resolves to errUnknown, as does a missing path
+// when any layer lacks content. Directories are trusted: a layer replacing a
+// directory with something else is rare enough that refusing every path under
+// a shallow base image's /etc would be the worse trade.
+func (fs *layerFS) resolve(p string) (string, fsEntry, error) {
+	rest := strings.Split(canonicalPath(p), "/")
+	cur := "."
+	hops := 0
+	for len(rest) > 0 {
+		comp := rest[0]
+		rest = rest[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			// cur is already resolved, so its parent is a real directory;
+			// ".." never climbs above the root.
+			cur = path.Dir(cur)
+			continue
+		}
+		next := comp
+		if cur != "." {
+			next = cur + "/" + comp
+		}
+		e, ok := fs.entries[next]
+		if !ok || (e.typeflag != tar.TypeDir && e.layer < fs.topUnavailable) {
+			if fs.topUnavailable >= 0 {
+				return "", fsEntry{}, errUnknown
+			}
+			return "", fsEntry{}, fmt.Errorf("%q does not exist", "/"+next)
+		}
+		if e.typeflag == tar.TypeSymlink {
+			if hops++; hops > maxSymlinkHops {
+				return "", fsEntry{}, fmt.Errorf("too many levels of symbolic links resolving %q", p)
+			}
+			if strings.HasPrefix(e.linkname, "/") {
+				cur = "."
+			}
+			rest = append(strings.Split(e.linkname, "/"), rest...)
+			continue
+		}
+		if len(rest) > 0 && e.typeflag != tar.TypeDir {
+			return "", fsEntry{}, fmt.Errorf("%q is not a directory", "/"+next)
+		}
+		cur = next
+	}
+	if cur == "." {
+		return "", fsEntry{}, errors.New("the root directory has no content")
+	}
+	return cur, fs.entries[cur], nil
+}
+
+// readFiles returns the contents of the regular files at the given canonical
+// paths, keyed by layer then path, reading each layer at most once.
+func (fs *layerFS) readFiles(ctx context.Context, want map[int]map[string]bool) (map[int]map[string][]byte, error) {
+	out := map[int]map[string][]byte{}
+	for i, paths := range want {
+		contents, err := readLayerFiles(ctx, fs.layers[i], paths)
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+		out[i] = contents
+	}
+	return out, nil
+}
+
+// readLayerFiles reads the named regular files from one layer. The last entry
+// for a path wins, matching how the layer applies.
+func readLayerFiles(ctx context.Context, layer layerSource, paths map[string]bool) (map[string][]byte, error) {
+	r, c, err := layer.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	contents := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return contents, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar: %w", err)
+		}
+		p := canonicalPath(hdr.Name)
+		if !paths[p] || (hdr.Typeflag != tar.TypeReg) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", hdr.Name, err)
+		}
+		contents[p] = data
+	}
+}
+
+// checkFileContent validates fileContentTests against the merged filesystem.
+// When the layer contents are unavailable (fs is nil) every test fails with a
+// clear message.
+func checkFileContent(ctx context.Context, fs *layerFS, tests []FileContentTest) ([]result, error) {
+	type located struct {
+		layer int
+		path  string
+		err   error
+	}
+	locs := make([]located, len(tests))
+	want := map[int]map[string]bool{}
+	for i, t := range tests {
+		if fs == nil {
+			continue
+		}
+		p, entry, err := fs.resolve(t.Path)
+		if err == nil {
+			switch entry.typeflag {
+			case tar.TypeReg:
+			case tar.TypeLink:
+				// A hardlink shares the content of an earlier entry of its layer.
+				p = entry.linkname
+			case tar.TypeDir:
+				err = fmt.Errorf("%q is a directory", t.Path)
+			default:
+				err = fmt.Errorf("%q is not a regular file", t.Path)
+			}
+		}
+		locs[i] = located{layer: entry.layer, path: p, err: err}
+		if err == nil {
+			if want[entry.layer] == nil {
+				want[entry.layer] = map[string]bool{}
+			}
+			want[entry.layer][p] = true
+		}
+	}
+	var contents map[int]map[string][]byte
+	if fs != nil {
+		var err error
+		if contents, err = fs.readFiles(ctx, want); err != nil {
+			return nil, err
+		}
+	}
+
+	var results []result
+	for i, t := range tests {
+		name := t.Name
+		if name == "" {
+			name = t.Path
+		}
+		name = "file content " + name
+		if fs == nil {
+			results = append(results, result{name, false, "the layer contents are not available for this image; file contents cannot be checked"})
+			continue
+		}
+		if locs[i].err != nil {
+			results = append(results, result{name, false, fmt.Sprintf("cannot read %q: %v", t.Path, locs[i].err)})
+			continue
+		}
+		data, ok := contents[locs[i].layer][locs[i].path]
+		if !ok {
+			results = append(results, result{name, false, fmt.Sprintf("cannot read %q: its content was not found in layer %d", t.Path, locs[i].layer)})
+			continue
+		}
+		if msg := matchContents(data, t); msg != "" {
+			results = append(results, result{name, false, msg})
+		} else {
+			results = append(results, result{name, true, ""})
+		}
+	}
+	return results, nil
+}
+
+// matchContents checks that every expectedContents regex matches the file
+// content and no excludedContents regex does, returning a failure message or
+// "" on success.
+func matchContents(data []byte, t FileContentTest) string {
+	return matchRegexes("content", data, t.ExpectedContents, t.ExcludedContents)
+}
+
+// matchRegexes checks that every expected regex matches data and no excluded
+// regex does. what names the data in failure messages ("content", "output").
+func matchRegexes(what string, data []byte, expected, excluded []string) string {
+	var problems []string
+	for _, want := range expected {
+		re, err := regexp.Compile(want)
+		if err != nil {
+			return fmt.Sprintf("invalid regex %q: %v", want, err)
+		}
+		if !re.Match(data) {
+			problems = append(problems, fmt.Sprintf("expected %s %q not found", what, want))
+		}
+	}
+	for _, exclude := range excluded {
+		re, err := regexp.Compile(exclude)
+		if err != nil {
+			return fmt.Sprintf("invalid regex %q: %v", exclude, err)
+		}
+		if re.Match(data) {
+			problems = append(problems, fmt.Sprintf("excluded %s %q found", what, exclude))
+		}
+	}
+	return strings.Join(problems, "; ")
+}
+
+// dirStore is a compactstream.BlobStore backed by a content-addressed
+// directory, where each blob is stored at sha256/<hex of content>.
+type dirStore struct {
+	shaDir string
+}
+
+func (s *dirStore) ReaderForBlob(_ context.Context, digest []byte, size int64) (io.ReadCloser, error) {
+	path := filepath.Join(s.shaDir, hex.EncodeToString(digest))
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("blob sha256:%s (size %d) not found in content-addressed directory: %w", hex.EncodeToString(digest), size, err)
+	}
+	return f, nil
+}
+
+// closers closes each member in order, returning the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,179 @@
+package cst
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
+)
+
+// writeGzipLayer writes entries as a gzip-compressed layer blob.
+func writeGzipLayer(t *testing.T, entries ...testimage.Entry) layerSource {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(testimage.Tar(t, entries)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "layer.tar.gz")
+	if err := os.WriteFile(p, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return layerSource{blob: p}
+}
+
+// writeCompactLayer writes entries as a compact stream whose file contents are
+// all CAS references into a content-addressed directory.
+func writeCompactLayer(t *testing.T, entries ...testimage.Entry) layerSource {
+	t.Helper()
+	dir := t.TempDir()
+	casDir := filepath.Join(dir, "cas")
+	if err := os.MkdirAll(filepath.Join(casDir, "sha256"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := compactstream.NewWriter(&buf, compactstream.HashAlgoSHA256, 32, compactstream.StreamCompressionZstd,
+		compactstream.OriginalCompressionInfo{Compression: compactstream.OriginalCompressionNone, CompressionLevel: -1}, 0)
+	for _, e := range entries {
+		hdrBytes, err := compactstream.CaptureTarHeaderBytes(testimage.Header(e))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteStreamBytes(hdrBytes); err != nil {
+			t.Fatal(err)
+		}
+		if e.Content == "" {
+			continue
+		}
+		sum := sha256.Sum256([]byte(e.Content))
+		if err := os.WriteFile(filepath.Join(casDir, "sha256", hex.EncodeToString(sum[:])), []byte(e.Content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteCASRef(sum[:], uint64(len(e.Content))); err != nil {
+			t.Fatal(err)
+		}
+		if pad := (512 - len(e.Content)%512) % 512; pad > 0 {
+			if err := w.WriteStreamBytes(make([]byte, pad)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.WriteStreamBytes(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "layer.cstream")
+	if err := os.WriteFile(p, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return layerSource{compactStream: p, casDir: casDir}
+}
+
+func TestCheckFileContentMergedLayers(t *testing.T) {
+	base := writeGzipLayer(t,
+		testimage.Entry{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		testimage.Entry{Name: "etc/os-release", Content: "ID=debian\nVERSION_ID=12\n"},
+		testimage.Entry{Name: "etc/motd", Content: "welcome\n"},
+		testimage.Entry{Name: "etc/conf.d/a.conf", Content: "a=1\n"},
+		testimage.Entry{Name: "usr/lib/os-release", Content: "ID=lower\n"},
+		testimage.Entry{Name: "etc/hard", Typeflag: tar.TypeLink, Linkname: "etc/motd"},
+	)
+	top := writeCompactLayer(t,
+		testimage.Entry{Name: "etc/.wh.motd"},
+		testimage.Entry{Name: "etc/conf.d/.wh..wh..opq"},
+		testimage.Entry{Name: "etc/conf.d/b.conf", Content: "b=2\n"},
+		testimage.Entry{Name: "usr/lib/os-release", Content: "ID=distroless\n"},
+		testimage.Entry{Name: "etc/alt", Typeflag: tar.TypeSymlink, Linkname: "../usr/lib/os-release"},
+		testimage.Entry{Name: "etc/abs", Typeflag: tar.TypeSymlink, Linkname: "/etc/conf.d"},
+	)
+	ctx := context.Background()
+	fs, err := buildLayerFS(ctx, []layerSource{base, top})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []FileContentTest{
+		{Path: "/etc/os-release", ExpectedContents: []string{"(?m)^ID=debian$", "VERSION_ID=12"}, ExcludedContents: []string{"alpine"}},
+		{Path: "/etc/alt", ExpectedContents: []string{"ID=distroless"}, ExcludedContents: []string{"lower"}},
+		{Path: "/etc/abs/b.conf", ExpectedContents: []string{"b=2"}},
+		{Path: "/etc/hard", ExpectedContents: []string{"welcome"}},
+	}
+	if f := failures(mustCheckFileContent(t, fs, tests)); len(f) != 0 {
+		t.Errorf("unexpected failures: %+v", f)
+	}
+
+	bad := []FileContentTest{
+		{Path: "/etc/motd"},          // whited out
+		{Path: "/etc/conf.d/a.conf"}, // hidden by the opaque whiteout
+		{Path: "/etc/os-release", ExpectedContents: []string{"alpine"}},
+		{Path: "/etc/os-release", ExcludedContents: []string{"debian"}},
+		{Path: "/etc"}, // a directory
+		{Path: "/etc/os-release", ExpectedContents: []string{"("}},
+	}
+	if f := failures(mustCheckFileContent(t, fs, bad)); len(f) != len(bad) {
+		t.Errorf("expected %d failures, got %d: %+v", len(bad), len(f), f)
+	}
+}
+
+func TestCheckFileContentUnavailableLayer(t *testing.T) {
+	top := writeGzipLayer(t, testimage.Entry{Name: "app/config.json", Content: `{"debug": false}`})
+	// The base layer (e.g. a shallow base image) has no content.
+	fs, err := buildLayerFS(context.Background(), []layerSource{{}, top})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []FileContentTest{
+		{Path: "/app/config.json", ExpectedContents: []string{`"debug": false`}},
+		{Path: "/etc/os-release"},
+	}
+	results := mustCheckFileContent(t, fs, tests)
+	if !results[0].pass {
+		t.Errorf("file from an available layer: %s", results[0].msg)
+	}
+	if results[1].pass || !strings.Contains(results[1].msg, "not available") {
+		t.Errorf("file that may come from the unavailable layer: got %+v", results[1])
+	}
+}
+
+func TestCheckFileContentNoLayers(t *testing.T) {
+	results := mustCheckFileContent(t, nil, []FileContentTest{{Path: "/etc/os-release"}})
+	if len(results) != 1 || results[0].pass {
+		t.Fatalf("expected one failure without layer contents, got %+v", results)
+	}
+}
+
+func TestResolveSymlinkLoop(t *testing.T) {
+	layer := writeGzipLayer(t,
+		testimage.Entry{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+		testimage.Entry{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "/a"},
+	)
+	fs, err := buildLayerFS(context.Background(), []layerSource{layer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.resolve("/a"); err == nil || !strings.Contains(err.Error(), "symbolic links") {
+		t.Errorf("expected a symlink loop error, got %v", err)
+	}
+}
+
+func mustCheckFileContent(t *testing.T, fs *layerFS, tests []FileContentTest) []result {
+	t.Helper()
+	results, err := checkFileContent(context.Background(), fs, tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
@@ -1,10 +1,13 @@
 // Package cst implements the `img image-structure-test`
 // subcommand: a container-structure-test-compatible validator that checks an
-// image using ONLY its config JSON and its mtree filesystem listing (never the
-// layer blobs). It is invoked at `bazel test` time by the image_structure_test
-// rule via the hermetic launcher, with a single --request file that points (by
-// runfiles rlocation path) at the aspect-produced images spec and the CST config
-// files.
+// image using its config JSON and its mtree filesystem listing. The layer blobs
+// (or compact streams plus their CAS directories) are read only when the test
+// asks for them, to evaluate fileContentTests against the merged filesystem
+// view, or to extract that view and run commandTests in it inside an
+// unprivileged user-namespace sandbox (Linux only). It is invoked at `bazel
+// test` time by the image_structure_test rule via the hermetic launcher, with a
+// single --request file that points (by runfiles rlocation path) at the
+// aspect-produced images spec and the CST config files.
 package cst
 
 import (
@@ -21,11 +24,15 @@ import (
 )
 
 // Process is the entry point for `img image-structure-test`.
-func Process(_ context.Context, args []string) {
+func Process(ctx context.Context, args []string) {
+	if len(args) > 0 && args[0] == sandboxExecArg {
+		sandboxExec(args[1:])
+		return
+	}
 	var requestPath string
 	flagSet := flag.NewFlagSet("image-structure-test", flag.ExitOnError)
 	flagSet.Usage = func() {
-		fmt.Fprintf(flagSet.Output(), "Validates an image's structure using its config JSON and mtree.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Validates an image's structure using its config JSON, mtree, and (optionally) layer contents.\n\n")
 		fmt.Fprintf(flagSet.Output(), "Usage: img image-structure-test --request <request.json>\n")
 		flagSet.PrintDefaults()
 	}
@@ -42,7 +49,7 @@ func Process(_ context.Context, args []string) {
 		os.Exit(1)
 	}
 
-	ok, err := run(requestPath)
+	ok, err := run(ctx, requestPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "image-structure-test: %v\n", err)
 		os.Exit(1)
@@ -54,7 +61,7 @@ func Process(_ context.Context, args []string) {
 
 // run loads the request, validates every image against every config, prints a
 // report, and reports whether all assertions passed.
-func run(requestPath string) (bool, error) {
+func run(ctx context.Context, requestPath string) (bool, error) {
 	req, err := loadRequest(requestPath)
 	if err != nil {
 		return false, err
@@ -71,6 +78,13 @@ func run(requestPath string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	caps := capabilities{contents: true}
+	for _, img := range images {
+		if img.layers == nil {
+			caps.contents = false
+		}
+	}
+	caps.commands = req.RunCommands && caps.contents
 
 	// Load and pre-validate every config once. A config that uses an unsupported
 	// CST category fails the whole run with a clear message.
@@ -80,6 +94,7 @@ func run(requestPath string) (bool, error) {
 	}
 	var configs []loadedConfig
 	failed := false
+	needContents := false
 	for _, ref := range req.Configs {
 		p, err := runfiles.Rlocation(ref)
 		if err != nil {
@@ -89,7 +104,8 @@ func run(requestPath string) (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		if cats := unsupportedCategories(st); len(cats) > 0 {
+		needContents = needContents || len(st.FileContentTests) > 0 || (caps.commands && len(st.CommandTests) > 0)
+		if cats := unsupportedCategories(st, caps); len(cats) > 0 {
 			failed = true
 			fmt.Fprintf(os.Stderr, "FAIL config %s: unsupported test categories for the mtree+config driver:\n", ref)
 			for _, c := range cats {
@@ -117,10 +133,30 @@ func run(requestPath string) (bool, error) {
 			fmt.Fprintf(os.Stderr, "  warning: the image mtree is a partial view (some layers contributed no mtree); "+
 				"file-existence results -- especially shouldExist: false -- may be unreliable\n")
 		}
+		// The layers are only walked when some config reads file contents.
+		var fs *layerFS
+		if needContents {
+			fs, err = buildLayerFS(ctx, img.layers)
+			if err != nil {
+				return false, fmt.Errorf("image %s: reading layers: %w", img.platform, err)
+			}
+		}
 		for _, c := range configs {
 			var results []result
 			results = append(results, checkMetadata(cf, c.st.MetadataTest)...)
 			results = append(results, checkFileExistence(entries, c.st.FileExistenceTests)...)
+			contentResults, err := checkFileContent(ctx, fs, c.st.FileContentTests)
+			if err != nil {
+				return false, fmt.Errorf("image %s: %w", img.platform, err)
+			}
+			results = append(results, contentResults...)
+			if len(c.st.CommandTests) > 0 {
+				if reason := commandSkipReason(img.platform, cf); reason != "" {
+					fmt.Fprintf(os.Stderr, "  SKIP [%s] %d commandTests: %s\n", c.label, len(c.st.CommandTests), reason)
+				} else {
+					results = append(results, checkCommands(ctx, fs, cf, c.st.GlobalEnvVars, c.st.CommandTests)...)
+				}
+			}
 			for _, r := range results {
 				total++
 				if r.pass {
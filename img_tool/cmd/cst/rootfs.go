@@ -0,0 +1,231 @@
+package cst
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// extractRootfs materializes the merged filesystem of lfs under dir, writing
+// only the entries that survive in the merged view, each from the layer that
+// placed it. Device nodes and FIFOs are skipped (an unprivileged process
+// cannot create them), and ownership is not recorded: every file belongs to the
+// user running the test, which the sandbox maps to the image user.
+func extractRootfs(ctx context.Context, lfs *layerFS, dir string) error {
+	if lfs.topUnavailable >= 0 {
+		return fmt.Errorf("layer %d has no content (e.g. a shallow base layer), so the image filesystem cannot be extracted", lfs.topUnavailable)
+	}
+	// Directory modes are applied last, so a read-only directory does not stop
+	// its own contents from being written.
+	dirModes := map[string]fs.FileMode{}
+	for i, layer := range lfs.layers {
+		if err := extractLayer(ctx, lfs, i, layer, dir, dirModes); err != nil {
+			return fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+	for p, mode := range dirModes {
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractLayer(ctx context.Context, lfs *layerFS, i int, layer layerSource, dir string, dirModes map[string]fs.FileMode) error {
+	r, c, err := layer.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		p := canonicalPath(hdr.Name)
+		if e, ok := lfs.entries[p]; !ok || e.layer != i || e.typeflag != hdr.Typeflag {
+			continue // hidden by a whiteout or replaced by a later entry
+		}
+		target, err := rootfsPath(dir, p)
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+				os.Remove(target)
+				if err := os.Mkdir(target, 0o755); err != nil {
+					return err
+				}
+			}
+			dirModes[target] = mode
+		case tar.TypeReg:
+			if err := writeRootfsFile(target, tr, mode); err != nil {
+				return fmt.Errorf("extracting %s: %w", hdr.Name, err)
+			}
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := rootfsPath(dir, canonicalPath(hdr.Linkname))
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Link(source, target); err != nil {
+				return fmt.Errorf("extracting hardlink %s: %w", hdr.Name, err)
+			}
+		}
+	}
+}
+
+// rootfsPath returns the host path of the canonical image path p under dir,
+// creating its parent directories. A parent that exists as anything but a real
+// directory is replaced, so no entry is ever written through a symlink out of
+// the root.
+func rootfsPath(dir, p string) (string, error) {
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("path %q escapes the image root", p)
+	}
+	comps := strings.Split(p, "/")
+	cur := dir
+	for _, comp := range comps[:len(comps)-1] {
+		cur = filepath.Join(cur, comp)
+		fi, err := os.Lstat(cur)
+		if err == nil && fi.IsDir() {
+			continue
+		}
+		if err == nil {
+			if err := os.Remove(cur); err != nil {
+				return "", err
+			}
+		}
+		if err := os.Mkdir(cur, 0o755); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(cur, comps[len(comps)-1]), nil
+}
+
+// mkdirRootfs creates the canonical image directory p under dir, with its
+// parents, unless it already exists.
+func mkdirRootfs(dir, p string) error {
+	if p == "." {
+		return nil
+	}
+	target, err := rootfsPath(dir, p)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		return nil
+	}
+	return os.Mkdir(target, 0o755)
+}
+
+func writeRootfsFile(target string, r io.Reader, mode fs.FileMode) error {
+	os.Remove(target)
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(target, mode)
+}
+
+// removeRootfs deletes an extracted root, first making every directory
+// writable again.
+func removeRootfs(dir string) error {
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+// resolveUser maps an image config user ("name", "uid", "name:group",
+// "uid:gid", ...) to numeric ids, looking names up in the extracted root's
+// /etc/passwd and /etc/group, as a container runtime does. It also returns the
+// user's home directory ("" when unknown).
+func resolveUser(rootfs, user string) (uid, gid int, home string, err error) {
+	if user == "" {
+		return 0, 0, "/root", nil
+	}
+	name, group, hasGroup := strings.Cut(user, ":")
+	passwd, _ := readIDFile(filepath.Join(rootfs, "etc", "passwd"))
+	found := false
+	for _, fields := range passwd {
+		if len(fields) < 6 || (fields[0] != name && fields[2] != name) {
+			continue
+		}
+		uid, _ = strconv.Atoi(fields[2])
+		gid, _ = strconv.Atoi(fields[3])
+		home = fields[5]
+		found = true
+		break
+	}
+	if !found {
+		if uid, err = strconv.Atoi(name); err != nil {
+			return 0, 0, "", fmt.Errorf("user %q not found in /etc/passwd", name)
+		}
+		gid = 0
+	}
+	if hasGroup {
+		groups, _ := readIDFile(filepath.Join(rootfs, "etc", "group"))
+		found = false
+		for _, fields := range groups {
+			if len(fields) >= 3 && (fields[0] == group || fields[2] == group) {
+				gid, _ = strconv.Atoi(fields[2])
+				found = true
+				break
+			}
+		}
+		if !found {
+			if gid, err = strconv.Atoi(group); err != nil {
+				return 0, 0, "", fmt.Errorf("group %q not found in /etc/group", group)
+			}
+		}
+	}
+	return uid, gid, home, nil
+}
+
+// readIDFile reads a colon-separated database such as /etc/passwd.
+func readIDFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rows [][]string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rows = append(rows, strings.Split(line, ":"))
+	}
+	return rows, sc.Err()
+}
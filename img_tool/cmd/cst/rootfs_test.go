@@ -0,0 +1,96 @@
+package cst
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+)
+
+func TestExtractRootfs(t *testing.T) {
+	base := writeGzipLayer(t,
+		testimage.Entry{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		testimage.Entry{Name: "etc/passwd", Content: "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001:app:/home/app:/bin/sh\n"},
+		testimage.Entry{Name: "etc/group", Content: "root:x:0:\nstaff:x:50:\n"},
+		testimage.Entry{Name: "etc/motd", Content: "welcome\n"},
+		testimage.Entry{Name: "opt/old/file", Content: "old\n"},
+		testimage.Entry{Name: "usr/bin/tool", Content: "#!/bin/sh\n"},
+	)
+	top := writeCompactLayer(t,
+		testimage.Entry{Name: "etc/.wh.motd"},
+		testimage.Entry{Name: "opt/.wh..wh..opq"},
+		testimage.Entry{Name: "opt/new", Content: "new\n"},
+		testimage.Entry{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+		testimage.Entry{Name: "usr/bin/hard", Typeflag: tar.TypeLink, Linkname: "usr/bin/tool"},
+	)
+	ctx := context.Background()
+	lfs, err := buildLayerFS(ctx, []layerSource{base, top})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := extractRootfs(ctx, lfs, dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, gone := range []string{"etc/motd", "opt/old"} {
+		if _, err := os.Lstat(filepath.Join(dir, gone)); !os.IsNotExist(err) {
+			t.Errorf("%s should be hidden by a whiteout, got %v", gone, err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "opt/new")); err != nil || string(data) != "new\n" {
+		t.Errorf("opt/new = %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "bin")); err != nil || link != "usr/bin" {
+		t.Errorf("bin -> %q, %v", link, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "bin/hard")); err != nil || string(data) != "#!/bin/sh\n" {
+		t.Errorf("bin/hard = %q, %v", data, err)
+	}
+
+	uid, gid, home, err := resolveUser(dir, "app")
+	if err != nil || uid != 1000 || gid != 1001 || home != "/home/app" {
+		t.Errorf(`resolveUser("app") = %d, %d, %q, %v`, uid, gid, home, err)
+	}
+	uid, gid, _, err = resolveUser(dir, "app:staff")
+	if err != nil || uid != 1000 || gid != 50 {
+		t.Errorf(`resolveUser("app:staff") = %d, %d, %v`, uid, gid, err)
+	}
+	uid, gid, _, err = resolveUser(dir, "4242:7")
+	if err != nil || uid != 4242 || gid != 7 {
+		t.Errorf(`resolveUser("4242:7") = %d, %d, %v`, uid, gid, err)
+	}
+	if _, _, _, err := resolveUser(dir, "nobody"); err == nil {
+		t.Error(`resolveUser("nobody"): expected an error for an unknown user`)
+	}
+}
+
+func TestExtractRootfsUnavailableLayer(t *testing.T) {
+	top := writeGzipLayer(t, testimage.Entry{Name: "app/main", Content: "x"})
+	lfs, err := buildLayerFS(context.Background(), []layerSource{{}, top})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := extractRootfs(context.Background(), lfs, t.TempDir()); err == nil {
+		t.Error("expected an error for an image with a layer without content")
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	got := commandEnv(
+		[]string{"PATH=/usr/bin", "LANG=C"},
+		[]EnvVar{{Key: "GLOBAL", Value: "g"}},
+		[]EnvVar{{Key: "PATH", Value: "/opt/bin:$PATH"}, {Key: "BOTH", Value: "${GLOBAL}-${LANG}"}},
+		"/home/app",
+	)
+	want := []string{"PATH=/opt/bin:/usr/bin", "LANG=C", "GLOBAL=g", "BOTH=g-C", "HOME=/home/app"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("commandEnv = %q, want %q", got, want)
+	}
+	if got := commandEnv(nil, nil, nil, ""); !reflect.DeepEqual(got, []string{"PATH=" + defaultPath, "HOME=/"}) {
+		t.Errorf("commandEnv defaults = %q", got)
+	}
+}
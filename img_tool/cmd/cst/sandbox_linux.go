@@ -0,0 +1,261 @@
+//go:build linux
+
+package cst
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// devNodes are bind-mounted from the host into the image's /dev, the minimum
+// most programs expect from a container runtime.
+var devNodes = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// sandboxHostname is the hostname inside the sandbox, so that a command
+// printing it gets the same answer on every host.
+const sandboxHostname = "localhost"
+
+// runSandboxed runs c.argv inside c.rootfs without a daemon or privileges: the
+// img binary re-executes itself (see sandboxExec) in new user, mount, PID,
+// network, IPC and UTS namespaces, where the calling user is mapped to root,
+// which may mount and pivot_root there. The command sees none of the host's
+// processes, network interfaces, IPC objects or hostname.
+func runSandboxed(ctx context.Context, c sandboxCommand) (commandOutput, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return commandOutput{}, fmt.Errorf("locating the img binary: %w", err)
+	}
+	args := append([]string{"image-structure-test", sandboxExecArg, c.rootfs, c.workdir, strconv.Itoa(c.uid), strconv.Itoa(c.gid), "--"}, c.argv...)
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Env = c.env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	err = cmd.Run()
+	out := commandOutput{stdout: stdout.String(), stderr: stderr.String()}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		out.exitCode = exitStatus(exitErr.ProcessState)
+	default:
+		return out, fmt.Errorf("starting the sandbox: %w (unprivileged user namespaces may be disabled on this host, e.g. by kernel.unprivileged_userns_clone=0 or kernel.apparmor_restrict_unprivileged_userns=1)", err)
+	}
+	if out.exitCode == sandboxErrorExitCode {
+		if msg, ok := strings.CutPrefix(out.stderr, sandboxErrorPrefix); ok {
+			return out, fmt.Errorf("sandbox: %s", strings.TrimSpace(msg))
+		}
+	}
+	return out, nil
+}
+
+// sandboxExec is the sandbox's init, PID 1 of its PID namespace: it runs as
+// root of the user namespace runSandboxed created, with args <rootfs>
+// <workdir> <uid> <gid> -- <argv...>. It brings up the loopback interface,
+// sets the hostname, binds the host's basic /dev nodes and mounts a /proc of
+// the sandbox's processes into the root, makes it the root of the mount
+// namespace, and executes the command; for a non-root image user it first
+// moves the command into a nested user namespace where the calling user is
+// that uid and gid. It never returns.
+func sandboxExec(args []string) {
+	if len(args) < 6 || args[4] != "--" {
+		sandboxFail(errors.New("malformed arguments"))
+	}
+	rootfs, workdir, argv := args[0], args[1], args[5:]
+	uid, err := strconv.Atoi(args[2])
+	if err != nil {
+		sandboxFail(fmt.Errorf("invalid uid %q", args[2]))
+	}
+	gid, err := strconv.Atoi(args[3])
+	if err != nil {
+		sandboxFail(fmt.Errorf("invalid gid %q", args[3]))
+	}
+	if err := loopbackUp(); err != nil {
+		sandboxFail(err)
+	}
+	if err := syscall.Sethostname([]byte(sandboxHostname)); err != nil {
+		sandboxFail(fmt.Errorf("setting the hostname: %w", err))
+	}
+	if err := prepareRootfs(rootfs); err != nil {
+		sandboxFail(err)
+	}
+	if err := pivotRoot(rootfs); err != nil {
+		sandboxFail(err)
+	}
+	if err := os.Chdir(workdir); err != nil {
+		sandboxFail(fmt.Errorf("entering the working directory: %w", err))
+	}
+	path, err := exec.LookPath(argv[0])
+	if err != nil && !errors.Is(err, exec.ErrDot) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", argv[0], err)
+		if errors.Is(err, fs.ErrPermission) {
+			os.Exit(126)
+		}
+		os.Exit(127)
+	}
+	if uid == 0 && gid == 0 {
+		err := syscall.Exec(path, argv, os.Environ())
+		fmt.Fprintf(os.Stderr, "%s: %v\n", argv[0], err)
+		os.Exit(126)
+	}
+	cmd := exec.Command(path)
+	cmd.Args = argv
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: uid, HostID: 0, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: gid, HostID: 0, Size: 1}},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitStatus(exitErr.ProcessState))
+	}
+	if err != nil {
+		// Writing the nested id maps goes through the /proc mounted in the root.
+		sandboxFail(fmt.Errorf("running as %d:%d: %w", uid, gid, err))
+	}
+	os.Exit(0)
+}
+
+// prepareRootfs populates /dev and /proc in the image root. The mounts are
+// private to the sandbox's mount namespace and vanish with it. Binding a node
+// the host lacks is skipped: an empty file is a better stand-in than nothing.
+// Any other failed mount is an error, so that no command runs in a partial
+// root.
+func prepareRootfs(rootfs string) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	dev, err := realDir(rootfs, "dev")
+	if err != nil {
+		return err
+	}
+	for _, name := range devNodes {
+		target := filepath.Join(dev, name)
+		if fi, err := os.Lstat(target); err == nil && !fi.Mode().IsRegular() {
+			os.Remove(target)
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, 0o666)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if _, err := os.Stat("/dev/" + name); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := syscall.Mount("/dev/"+name, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("binding /dev/%s: %w", name, err)
+		}
+	}
+	for name, link := range map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"} {
+		if _, err := os.Lstat(filepath.Join(dev, name)); errors.Is(err, fs.ErrNotExist) {
+			if err := os.Symlink(link, filepath.Join(dev, name)); err != nil {
+				return err
+			}
+		}
+	}
+	proc, err := realDir(rootfs, "proc")
+	if err != nil {
+		return err
+	}
+	// A fresh proc shows the processes of the sandbox's PID namespace only.
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %w", err)
+	}
+	return nil
+}
+
+// loopbackUp brings up lo, the only interface of the sandbox's network
+// namespace, so that commands may still talk to themselves over localhost.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("bringing up the loopback interface: %w", err)
+	}
+	defer syscall.Close(fd)
+	// struct ifreq: the interface name, then a union whose first member is
+	// the flags.
+	var ifreq struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifreq.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return fmt.Errorf("bringing up the loopback interface: %w", errno)
+	}
+	ifreq.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return fmt.Errorf("bringing up the loopback interface: %w", errno)
+	}
+	return nil
+}
+
+// pivotRoot makes rootfs the root of the sandbox's mount namespace and
+// detaches the host's. A plain chroot is not enough: the kernel refuses to
+// create the nested user namespace for a non-root image user from inside one.
+func pivotRoot(rootfs string) error {
+	// pivot_root needs the new root to be a mount point.
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("binding the image root: %w", err)
+	}
+	if err := os.Chdir(rootfs); err != nil {
+		return err
+	}
+	// Stack the old root on top of the new one and detach it, as runc does,
+	// which needs no directory for it inside the image.
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching the host root: %w", err)
+	}
+	return os.Chdir("/")
+}
+
+// realDir returns rootfs/name, making sure it is a directory and not a
+// symlink that would carry a mount out of the root.
+func realDir(rootfs, name string) (string, error) {
+	p := filepath.Join(rootfs, name)
+	if fi, err := os.Lstat(p); err == nil {
+		if fi.IsDir() {
+			return p, nil
+		}
+		if err := os.Remove(p); err != nil {
+			return "", err
+		}
+	}
+	return p, os.Mkdir(p, 0o755)
+}
+
+// exitStatus maps a process state to a shell-style exit code (128+signal for
+// a killed process).
+func exitStatus(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ps.ExitCode()
+}
+
+func sandboxFail(err error) {
+	fmt.Fprintf(os.Stderr, "%s%v\n", sandboxErrorPrefix, err)
+	os.Exit(sandboxErrorExitCode)
+}
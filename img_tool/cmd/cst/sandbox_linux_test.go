@@ -0,0 +1,169 @@
+//go:build linux
+
+package cst
+
+import (
+	"context"
+	"debug/elf"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMain lets the test binary stand in for img: runSandboxed re-executes
+// os.Executable() as the sandbox init, and the tests copy the binary into
+// the image root as the command to run (the probe).
+func TestMain(m *testing.M) {
+	if len(os.Args) > 2 && os.Args[1] == "image-structure-test" && os.Args[2] == sandboxExecArg {
+		sandboxExec(os.Args[3:])
+	}
+	if os.Getenv("CST_SANDBOX_PROBE") == "1" {
+		probe()
+	}
+	os.Exit(m.Run())
+}
+
+// probe reports what the command sees inside the sandbox.
+func probe() {
+	cwd, _ := os.Getwd()
+	devNull := "ok"
+	if err := os.WriteFile("/dev/null", []byte("x"), 0); err != nil {
+		devNull = err.Error()
+	}
+	_, hostFile := os.Stat("/probe-host-marker")
+	hostname, _ := os.Hostname()
+	// The processes the mounted proc lists, which are those of the sandbox's
+	// PID namespace only.
+	var procs int
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err == nil {
+			procs++
+		}
+	}
+	var interfaces []string
+	if list, err := net.Interfaces(); err == nil {
+		for _, iface := range list {
+			interfaces = append(interfaces, fmt.Sprintf("%s:%t", iface.Name, iface.Flags&net.FlagUp != 0))
+		}
+	}
+	fmt.Printf("uid=%d gid=%d cwd=%s args=%s foo=%s devnull=%s isolated=%t hostname=%s procs=%d net=%s\n",
+		os.Getuid(), os.Getgid(), cwd, strings.Join(os.Args[1:], ","), os.Getenv("FOO"), devNull, hostFile != nil, hostname, procs, strings.Join(interfaces, ","))
+	fmt.Fprint(os.Stderr, "probe stderr")
+	os.Exit(3)
+}
+
+func TestRunSandboxed(t *testing.T) {
+	rootfs := t.TempDir()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyExecutable(t, rootfs, self, "/bin/probe")
+	if err := os.MkdirAll(filepath.Join(rootfs, "app"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// A marker outside the image root that the sandboxed probe must not see.
+	if err := os.WriteFile("/probe-host-marker", nil, 0o644); err == nil {
+		defer os.Remove("/probe-host-marker")
+	}
+
+	ctx := context.Background()
+	env := []string{"CST_SANDBOX_PROBE=1", "FOO=bar", "PATH=/bin"}
+	// The root probe replaces the sandbox init; a non-root one runs as its
+	// child.
+	for _, tc := range []struct {
+		uid, gid int
+		procs    int
+	}{{0, 0, 1}, {1000, 1001, 2}} {
+		out, err := runSandboxed(ctx, sandboxCommand{rootfs: rootfs, workdir: "/app", argv: []string{"probe", "a", "b"}, env: env, uid: tc.uid, gid: tc.gid})
+		if err != nil && strings.Contains(err.Error(), "starting the sandbox") {
+			t.Skipf("user namespaces are not available: %v", err)
+		}
+		if err != nil {
+			t.Fatalf("uid %d: %v (stderr %q)", tc.uid, err, out.stderr)
+		}
+		want := fmt.Sprintf("uid=%d gid=%d cwd=/app args=a,b foo=bar devnull=ok isolated=true hostname=localhost procs=%d net=lo:true\n", tc.uid, tc.gid, tc.procs)
+		if out.stdout != want || out.stderr != "probe stderr" || out.exitCode != 3 {
+			t.Errorf("uid %d: got stdout %q, stderr %q, exit %d; want stdout %q, stderr %q, exit 3", tc.uid, out.stdout, out.stderr, out.exitCode, want, "probe stderr")
+		}
+	}
+
+	out, err := runSandboxed(ctx, sandboxCommand{rootfs: rootfs, workdir: "/", argv: []string{"missing"}, env: env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.exitCode != 127 {
+		t.Errorf("missing command: exit %d, want 127 (stderr %q)", out.exitCode, out.stderr)
+	}
+}
+
+// copyExecutable copies the host executable src to dst inside rootfs, along
+// with its ELF interpreter and shared libraries at their host paths, so it
+// runs inside the image root.
+func copyExecutable(t *testing.T, rootfs, src, dst string) {
+	t.Helper()
+	copyFile(t, src, filepath.Join(rootfs, dst))
+	f, err := elf.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var interp string
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data, err := io.ReadAll(prog.Open())
+			if err != nil {
+				t.Fatal(err)
+			}
+			interp = strings.TrimRight(string(data), "\x00")
+		}
+	}
+	if interp == "" {
+		return // statically linked
+	}
+	copyFile(t, interp, filepath.Join(rootfs, interp))
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := []string{filepath.Dir(interp), "/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+	if lib, err := filepath.EvalSymlinks(interp); err == nil {
+		dirs = append(dirs, filepath.Dir(lib))
+	}
+	matches, _ := filepath.Glob("/lib/*-linux-gnu")
+	dirs = append(dirs, matches...)
+	for _, lib := range libs {
+		found := false
+		for _, dir := range dirs {
+			p := filepath.Join(dir, lib)
+			if _, err := os.Stat(p); err == nil {
+				copyFile(t, p, filepath.Join(rootfs, p))
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Skipf("cannot find shared library %s for the probe", lib)
+		}
+	}
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
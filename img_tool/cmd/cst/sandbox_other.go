@@ -0,0 +1,21 @@
+//go:build !linux
+
+package cst
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// runSandboxed needs Linux user namespaces; commandSkipReason keeps it from
+// being reached elsewhere.
+func runSandboxed(context.Context, sandboxCommand) (commandOutput, error) {
+	return commandOutput{}, errors.New("commandTests can only run on Linux")
+}
+
+func sandboxExec([]string) {
+	fmt.Fprintf(os.Stderr, "%scommandTests can only run on Linux\n", sandboxErrorPrefix)
+	os.Exit(sandboxErrorExitCode)
+}
@@ -18,15 +18,18 @@ type (
 	Spec      = structuretest.Spec
 	ImageSpec = structuretest.ImageSpec
 	Platform  = structuretest.Platform
+	LayerSpec = structuretest.LayerSpec
 )
 
-// resolvedImage is an image with its config + mtree resolved to absolute,
-// readable paths.
+// resolvedImage is an image with its config + mtree (and, when requested, its
+// layers) resolved to absolute, readable paths.
 type resolvedImage struct {
 	platform   Platform
 	configPath string
 	mtreePath  string // "" when no mtree is available
 	complete   bool
+	// layers is nil when the layer contents are not available to the test.
+	layers []layerSource
 }
 
 // loadRequest reads the request file (an absolute path provided by the launcher).
@@ -58,19 +61,41 @@ func loadImages(spec *Spec) ([]resolvedImage, error) {
 				return nil, fmt.Errorf("resolving mtree %q: %w", img.Mtree, err)
 			}
 		}
+		var layers []layerSource
+		if img.Layers != nil {
+			layers = []layerSource{}
+			for _, l := range img.Layers {
+				layer, err := resolveLayer(l, runfiles.Rlocation)
+				if err != nil {
+					return nil, err
+				}
+				layers = append(layers, layer)
+			}
+		}
 		images = append(images, resolvedImage{
 			platform:   img.Platform,
 			configPath: configPath,
 			mtreePath:  mtreePath,
 			complete:   img.Complete,
+			layers:     layers,
 		})
 	}
-	for _, treeRef := range spec.LayoutTrees {
+	if len(spec.LayoutDirs) > 0 && len(spec.LayoutDirs) != len(spec.LayoutTrees) {
+		return nil, fmt.Errorf("spec lists %d layout dirs for %d layout trees", len(spec.LayoutDirs), len(spec.LayoutTrees))
+	}
+	for i, treeRef := range spec.LayoutTrees {
 		treeDir, err := runfiles.Rlocation(treeRef)
 		if err != nil {
 			return nil, fmt.Errorf("resolving layout tree %q: %w", treeRef, err)
 		}
-		layoutImages, err := loadLayoutTree(treeDir)
+		layoutDir := ""
+		if len(spec.LayoutDirs) > 0 {
+			layoutDir, err = runfiles.Rlocation(spec.LayoutDirs[i])
+			if err != nil {
+				return nil, fmt.Errorf("resolving layout dir %q: %w", spec.LayoutDirs[i], err)
+			}
+		}
+		layoutImages, err := loadLayoutTree(treeDir, layoutDir)
 		if err != nil {
 			return nil, fmt.Errorf("reading layout metadata tree %q: %w", treeRef, err)
 		}
@@ -83,8 +108,10 @@ func loadImages(spec *Spec) ([]resolvedImage, error) {
 }
 
 // loadLayoutTree reads the images.json produced by `img oci-layout-metadata`
-// inside treeDir; its Config/Mtree paths are relative to treeDir.
-func loadLayoutTree(treeDir string) ([]resolvedImage, error) {
+// inside treeDir; its Config/Mtree paths are relative to treeDir and its layer
+// blob paths relative to layoutDir. The layers are left out when layoutDir is
+// "" (the layout is not in the runfiles).
+func loadLayoutTree(treeDir, layoutDir string) ([]resolvedImage, error) {
 	data, err := os.ReadFile(filepath.Join(treeDir, "images.json"))
 	if err != nil {
 		return nil, fmt.Errorf("reading images.json: %w", err)
@@ -99,12 +126,50 @@ func loadLayoutTree(treeDir string) ([]resolvedImage, error) {
 		if img.Mtree != "" {
 			mtreePath = filepath.Join(treeDir, img.Mtree)
 		}
+		var layers []layerSource
+		if layoutDir != "" {
+			layers = []layerSource{}
+			for _, l := range img.Layers {
+				layer, err := resolveLayer(l, func(p string) (string, error) {
+					return filepath.Join(layoutDir, p), nil
+				})
+				if err != nil {
+					return nil, err
+				}
+				layers = append(layers, layer)
+			}
+		}
 		images = append(images, resolvedImage{
 			platform:   img.Platform,
 			configPath: filepath.Join(treeDir, img.Config),
 			mtreePath:  mtreePath,
 			complete:   img.Complete,
+			layers:     layers,
 		})
 	}
 	return images, nil
 }
+
+// resolveLayer resolves the paths of one LayerSpec with resolve (runfiles
+// lookup, or a join onto the layout directory).
+func resolveLayer(l LayerSpec, resolve func(string) (string, error)) (layerSource, error) {
+	var layer layerSource
+	var err error
+	if l.Blob != "" {
+		if layer.blob, err = resolve(l.Blob); err != nil {
+			return layerSource{}, fmt.Errorf("resolving layer blob %q: %w", l.Blob, err)
+		}
+	}
+	if l.CompactStream != "" {
+		if l.CASDir == "" {
+			return layerSource{}, fmt.Errorf("compact stream %q has no CAS directory", l.CompactStream)
+		}
+		if layer.compactStream, err = resolve(l.CompactStream); err != nil {
+			return layerSource{}, fmt.Errorf("resolving compact stream %q: %w", l.CompactStream, err)
+		}
+		if layer.casDir, err = resolve(l.CASDir); err != nil {
+			return layerSource{}, fmt.Errorf("resolving CAS directory %q: %w", l.CASDir, err)
+		}
+	}
+	return layer, nil
+}
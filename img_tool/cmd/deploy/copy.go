@@ -0,0 +1,169 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/imagecopy"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// The copy operation.
+//
+// A copy promotes an image that already lives in a registry -- typically a
+// staging digest the pipeline tested -- to its destination, with its
+// referrers, through the deploy's own auth and gateways (see pkg/imagecopy).
+// It runs after the push operations, so a deploy can push to staging and copy
+// from there in one go, and before signing and retention. Under --transactional
+// it is staged by digest with the pushes and its tags move in the commit phase.
+
+// copyDestination resolves where a copy operation writes: its source, the
+// destination repository (with --registry and --repository applied) and its tags
+// (with the --tag extras).
+func copyDestination(op api.IndexedCopyDeployOperation, opts DeployOptions) (name.Digest, name.Repository, []string, error) {
+	source, err := op.SourceDigest(registryopts.NameOptions()...)
+	if err != nil {
+		return name.Digest{}, name.Repository{}, nil, fmt.Errorf("copy operation %d: %w", op.I, err)
+	}
+	repository, err := name.NewRepository(overrideOr(op.Registry, opts.OverrideRegistry)+"/"+overrideOr(op.Repository, opts.OverrideRepository), registryopts.NameOptions()...)
+	if err != nil {
+		return name.Digest{}, name.Repository{}, nil, fmt.Errorf("copy operation %d: parsing destination: %w", op.I, err)
+	}
+	tags := deduplicateStrings(append(append([]string(nil), op.Tags...), opts.AdditionalTags...))
+	return source, repository, tags, nil
+}
+
+// copyReferences returns the references a copy operation writes: its digest
+// reference followed by every tag. It performs no I/O.
+func copyReferences(op api.IndexedCopyDeployOperation, opts DeployOptions) ([]string, error) {
+	source, repository, tags, err := copyDestination(op, opts)
+	if err != nil {
+		return nil, err
+	}
+	refs := []string{repository.Digest(source.DigestStr()).String()}
+	for _, tag := range tags {
+		refs = append(refs, repository.Tag(tag).String())
+	}
+	return refs, nil
+}
+
+// newDeployCopier returns the copier of a deploy: reading through the pull
+// transport and writing through the push transport.
+func newDeployCopier(pullTransport, pushTransport http.RoundTripper, jobs int, referrers bool) *imagecopy.Copier {
+	return imagecopy.NewBuilder().
+		WithSourceRemoteOptions(registryopts.Default().WithTransport(pullTransport).WithJobs(jobs).Remote()...).
+		WithDestinationRemoteOptions(registryopts.Default().WithTransport(pushTransport).WithJobs(jobs).Remote()...).
+		WithJobs(jobs).
+		WithReferrers(referrers).
+		Build()
+}
+
+// applyCopyOperations copies every operation's source to its destination, with
+// jobs operations in flight, and returns the references written. staged copies
+// write the digest reference only; the commit phase of a transactional deploy
+// writes the tags.
+func applyCopyOperations(ctx context.Context, ops []api.IndexedCopyDeployOperation, pullTransport, pushTransport http.RoundTripper, opts DeployOptions, staged bool, report *deployRecorder) ([]string, error) {
+	jobs := max(opts.Jobs, 1)
+	withReferrers := newDeployCopier(pullTransport, pushTransport, jobs, true)
+	withoutReferrers := newDeployCopier(pullTransport, pushTransport, jobs, false)
+
+	var mu sync.Mutex
+	var written []string
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+	for _, op := range ops {
+		g.Go(func() error {
+			source, repository, tags, err := copyDestination(op, opts)
+			if err != nil {
+				return err
+			}
+			if staged {
+				tags = nil
+			}
+			copier := withReferrers
+			if op.SkipReferrers {
+				copier = withoutReferrers
+			}
+			result, err := copier.Copy(groupCtx, source, repository, tags)
+			if err != nil {
+				return fmt.Errorf("copy operation %d: %w", op.I, err)
+			}
+			how := "streamed"
+			if result.Mounted {
+				how = "cross-mounted"
+			}
+			fmt.Fprintf(os.Stderr, "copied %s to %s (%s blobs, %d referrers)\n", source, repository, how, len(result.Referrers))
+			var referrers []string
+			for _, referrer := range result.Referrers {
+				referrers = append(referrers, referrer.String())
+			}
+			report.copied(op.I, referrers)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, ref := range result.References {
+				if _, isTag := ref.(name.Tag); isTag {
+					written = append(written, ref.String())
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Strings(written)
+	return written, nil
+}
+
+// planCopyTagWrites lists the tags the copy operations write, for the commit
+// phase of a transactional deploy. It reads each source manifest, which the tags
+// point at once committed.
+func planCopyTagWrites(ctx context.Context, ops []api.IndexedCopyDeployOperation, pullTransport http.RoundTripper, opts DeployOptions) ([]tagWrite, error) {
+	copier := newDeployCopier(pullTransport, nil, max(opts.Jobs, 1), false)
+	var writes []tagWrite
+	for _, op := range ops {
+		source, repository, tags, err := copyDestination(op, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(tags) == 0 {
+			continue
+		}
+		descriptor, err := copier.Resolve(ctx, source)
+		if err != nil {
+			return nil, fmt.Errorf("copy operation %d: %w", op.I, err)
+		}
+		manifest := rawManifest{digest: descriptor.Digest, raw: descriptor.Manifest, mediaType: descriptor.MediaType}
+		for _, tag := range tags {
+			ref, err := name.NewTag(repository.Tag(tag).String(), registryopts.NameOptions()...)
+			if err != nil {
+				return nil, fmt.Errorf("copy operation %d: parsing tag %q: %w", op.I, tag, err)
+			}
+			writes = append(writes, tagWrite{ref: ref, index: op.I, manifest: manifest})
+		}
+	}
+	return writes, nil
+}
+
+// deduplicateStrings returns values without duplicates, in first-seen order.
+func deduplicateStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var unique []string
+	for _, value := range values {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		unique = append(unique, value)
+	}
+	return unique
+}
@@ -0,0 +1,138 @@
+package deploy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// TestCopyOperationPromotesWithinARegistry copies a staging digest to its
+// production repository: the layers are cross-mounted rather than uploaded, and
+// the tags -- with the --tag extras -- point at the source digest.
+func TestCopyOperationPromotesWithinARegistry(t *testing.T) {
+	reg := newNaiveRegistry()
+	transport := reg.transport()
+	image, err := random.Image(512, 2)
+	if err != nil {
+		t.Fatalf("random image: %v", err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	staging, err := name.NewDigest("reg.example.com/staging/app@"+digest.String(), registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatalf("parsing source: %v", err)
+	}
+	if err := remote.Write(staging, image, registryopts.Default().WithTransport(transport).Remote()...); err != nil {
+		t.Fatalf("pushing source: %v", err)
+	}
+	blobPutsBefore, _, _ := reg.snapshot()
+
+	op := api.IndexedCopyDeployOperation{I: 3, CopyDeployOperation: api.CopyDeployOperation{
+		Command:    "copy",
+		Source:     staging.String(),
+		Registry:   "reg.example.com",
+		Repository: "prod/app",
+		Tags:       []string{"v1.2.3"},
+	}}
+	if err := op.Validate(); err != nil {
+		t.Fatalf("invalid operation: %v", err)
+	}
+	opts := DeployOptions{Jobs: 2, AdditionalTags: []string{"latest", "v1.2.3"}}
+	want := []string{
+		"reg.example.com/prod/app@" + digest.String(),
+		"reg.example.com/prod/app:v1.2.3",
+		"reg.example.com/prod/app:latest",
+	}
+	refs, err := copyReferences(op, opts)
+	if err != nil {
+		t.Fatalf("copyReferences: %v", err)
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("copyReferences = %v, want %v", refs, want)
+	}
+
+	recorder := newDeployRecorder()
+	written, err := applyCopyOperations(context.Background(), []api.IndexedCopyDeployOperation{op}, transport, transport, opts, false, recorder)
+	if err != nil {
+		t.Fatalf("applyCopyOperations: %v", err)
+	}
+	if want := []string{"reg.example.com/prod/app:latest", "reg.example.com/prod/app:v1.2.3"}; !reflect.DeepEqual(written, want) {
+		t.Errorf("written tags = %v, want %v", written, want)
+	}
+	for _, tag := range []string{"v1.2.3", "latest"} {
+		stored, found := reg.storedManifestFor("prod/app", tag)
+		if !found || stored.digest != digest.String() {
+			t.Errorf("prod/app:%s = %+v (found %v), want %s", tag, stored, found, digest)
+		}
+	}
+	blobPuts, mounts, _ := reg.snapshot()
+	if len(blobPuts) != len(blobPutsBefore) {
+		t.Errorf("blob uploads %v after the copy, want every blob mounted from staging/app", blobPuts[len(blobPutsBefore):])
+	}
+	if len(mounts) == 0 {
+		t.Error("no blob was mounted from staging/app")
+	}
+}
+
+// TestCopyOperationStagedWritesNoTags checks the staging half of a transactional
+// copy: the digest is written, the tags are left to the commit phase, which
+// planCopyTagWrites prepares.
+func TestCopyOperationStagedWritesNoTags(t *testing.T) {
+	reg := newNaiveRegistry()
+	transport := reg.transport()
+	image, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("random image: %v", err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	source := "reg.example.com/staging/app@" + digest.String()
+	staging, err := name.NewDigest(source, registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatalf("parsing source: %v", err)
+	}
+	if err := remote.Write(staging, image, registryopts.Default().WithTransport(transport).Remote()...); err != nil {
+		t.Fatalf("pushing source: %v", err)
+	}
+
+	ops := []api.IndexedCopyDeployOperation{{I: 0, CopyDeployOperation: api.CopyDeployOperation{
+		Command:    "copy",
+		Source:     source,
+		Registry:   "reg.example.com",
+		Repository: "prod/app",
+		Tags:       []string{"stable"},
+	}}}
+	opts := DeployOptions{Jobs: 1}
+	writes, err := planCopyTagWrites(context.Background(), ops, transport, opts)
+	if err != nil {
+		t.Fatalf("planCopyTagWrites: %v", err)
+	}
+	if len(writes) != 1 || writes[0].ref.String() != "reg.example.com/prod/app:stable" || writes[0].manifest.digest != digest {
+		t.Fatalf("tag writes = %+v, want prod/app:stable at %s", writes, digest)
+	}
+
+	written, err := applyCopyOperations(context.Background(), ops, transport, transport, opts, true, nil)
+	if err != nil {
+		t.Fatalf("applyCopyOperations: %v", err)
+	}
+	if len(written) != 0 {
+		t.Errorf("a staged copy wrote tags %v", written)
+	}
+	if _, found := reg.storedManifestFor("prod/app", digest.String()); !found {
+		t.Error("the staged copy did not write the digest")
+	}
+	if _, found := reg.storedManifestFor("prod/app", "stable"); found {
+		t.Error("the staged copy wrote its tag before the commit phase")
+	}
+}
@@ -264,6 +264,9 @@ type dedupOptions struct {
 	// process plans (see dedup_locations.go). Nil plans this deploy on its own, which
 	// is what the deploys that upload nothing do.
 	locations *blobLocations
+	// report records the shared blobs left to the ordinary push for --report-json.
+	// Nil records nothing.
+	report *deployRecorder
 }
 
 // destination is one manifest this deploy intends the registry to hold. Several
@@ -1031,7 +1034,7 @@ func manifestAbsent(err error) bool {
 // the layer stops being mount-only, so the manifest push mounts it if the upload made
 // it after all and uploads the bytes into its own repository if it did not, which is
 // what would have happened without the strategy.
-func uploadDedupBlobs(ctx context.Context, vfs *deployvfs.VFS, plan *dedupPlan, jobs int, remoteOptions []remote.Option, locations *blobLocations, diffIDs *diffIDIndex) (retErr error) {
+func uploadDedupBlobs(ctx context.Context, vfs *deployvfs.VFS, plan *dedupPlan, jobs int, remoteOptions []remote.Option, locations *blobLocations, diffIDs *diffIDIndex, report *deployRecorder) (retErr error) {
 	type upload struct {
 		repo   name.Repository
 		digest registryv1.Hash
@@ -1132,6 +1135,7 @@ func uploadDedupBlobs(ctx context.Context, vfs *deployvfs.VFS, plan *dedupPlan,
 				abandoned = append(abandoned, up)
 				abandonedMu.Unlock()
 				fmt.Fprintf(os.Stderr, "warning: leaving blob %s to the ordinary push: %v\n", up.digest, err)
+				report.warn(fmt.Sprintf("leaving blob %s to the ordinary push: %v", up.digest, err))
 				return nil
 			}
 		})
@@ -1185,35 +1189,12 @@ func prepareDedupPush(ctx context.Context, vfs *deployvfs.VFS, pushOps []api.Ind
 		// errgroup.SetLimit(0) would let no goroutine run at all.
 		opts.jobs = 1
 	}
-	if err := validateDeduplicatedPushOperations(pushOps, tagOps, opts.selector); err != nil {
-		return nil, err
-	}
-
-	working := dedupWorkingSet(pushOps, tagOps, opts.selector, opts.overrideRegistry, opts.overrideRepository)
-	dests := make([]destination, len(working))
-	for i, manifest := range working {
-		dests[i] = manifest.dest
-	}
-	remoteOptions := registryopts.Default().WithTransport(opts.pushTransport).WithJobs(opts.jobs).Remote()
-
-	present, err := findPresentManifests(ctx, dests, opts.jobs, remoteOptions)
-	if err != nil {
-		return nil, err
-	}
-
-	// A deploy that uploads nothing learns nothing about where a blob is, and what it
-	// would publish is an assumption about the registry it never checked: the blobs
-	// are expected to be in place already. So it plans on its own signals and leaves
-	// the process-wide cache untouched.
-	locations := opts.locations
-	if opts.forbidUpload {
-		locations = nil
-	}
-
-	plan, err := planDedupPush(working, present, opts.blobRepository, locations)
+	plan, working, err := planDedupPushFor(ctx, pushOps, tagOps, opts)
 	if err != nil {
 		return nil, err
 	}
+	remoteOptions := registryopts.Default().WithTransport(opts.pushTransport).WithJobs(opts.jobs).Remote()
+	locations := dedupLocations(opts)
 
 	if !opts.forbidUpload {
 		// The diff ids of the blobs that get an artificial manifest, read from the
@@ -1224,7 +1205,7 @@ func prepareDedupPush(ctx context.Context, vfs *deployvfs.VFS, pushOps []api.Ind
 		if plan.artificial > 0 {
 			diffIDs = newDiffIDIndex(vfs, working, plan)
 		}
-		if err := uploadDedupBlobs(ctx, vfs, plan, opts.jobs, remoteOptions, locations, diffIDs); err != nil {
+		if err := uploadDedupBlobs(ctx, vfs, plan, opts.jobs, remoteOptions, locations, diffIDs, opts.report); err != nil {
 			return nil, fmt.Errorf("uploading shared blobs: %w", err)
 		}
 	} else if artificialManifestsRequested(working) {
@@ -1235,6 +1216,58 @@ func prepareDedupPush(ctx context.Context, vfs *deployvfs.VFS, pushOps []api.Ind
 	}
 
 	plan.report(os.Stderr, opts)
+	return newDedupViews(vfs, plan, opts), nil
+}
+
+// planDedupPushFor runs the phases of a deduplicated push that only read: it
+// validates the deduplicating operations, asks the registry which of their
+// manifests it already holds, and plans the uploads and mounts. prepareDedupPush
+// goes on to perform the plan; `img deploy --dry-run` only describes it.
+//
+// It returns the working set the plan was made from as well, because the upload
+// phase reads the configs of its images (see newDiffIDIndex).
+func planDedupPushFor(ctx context.Context, pushOps []api.IndexedPushDeployOperation, tagOps []api.IndexedRegistryTagDeployOperation, opts dedupOptions) (*dedupPlan, []manifestDestination, error) {
+	if opts.jobs < 1 {
+		opts.jobs = 1
+	}
+	if err := validateDeduplicatedPushOperations(pushOps, tagOps, opts.selector); err != nil {
+		return nil, nil, err
+	}
+
+	working := dedupWorkingSet(pushOps, tagOps, opts.selector, opts.overrideRegistry, opts.overrideRepository)
+	dests := make([]destination, len(working))
+	for i, manifest := range working {
+		dests[i] = manifest.dest
+	}
+	remoteOptions := registryopts.Default().WithTransport(opts.pushTransport).WithJobs(opts.jobs).Remote()
+
+	present, err := findPresentManifests(ctx, dests, opts.jobs, remoteOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan, err := planDedupPush(working, present, opts.blobRepository, dedupLocations(opts))
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, working, nil
+}
+
+// dedupLocations returns the location cache a deploy plans against.
+//
+// A deploy that uploads nothing learns nothing about where a blob is, and what it
+// would publish is an assumption about the registry it never checked: the blobs
+// are expected to be in place already. So it plans on its own signals and leaves
+// the process-wide cache untouched.
+func dedupLocations(opts dedupOptions) *blobLocations {
+	if opts.forbidUpload {
+		return nil
+	}
+	return opts.locations
+}
+
+// newDedupViews returns the per-registry views the manifest push is served from
+// once plan has been carried out.
+func newDedupViews(vfs *deployvfs.VFS, plan *dedupPlan, opts dedupOptions) *dedupViews {
 	views := &dedupViews{
 		plain:            vfs,
 		byRegistry:       make(map[string]*deployvfs.VFS),
@@ -1244,7 +1277,7 @@ func prepareDedupPush(ctx context.Context, vfs *deployvfs.VFS, pushOps []api.Ind
 	for registry, crossMountPlan := range plan.crossMountPlans() {
 		views.byRegistry[registry] = vfs.WithCrossMountPlan(crossMountPlan)
 	}
-	return views, nil
+	return views
 }
 
 // artificialManifestsRequested reports whether any destination asked for artificial
@@ -193,6 +193,8 @@ func (r *naiveRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		r.serveBlob(w, req, repository, target)
 	case kind == "manifests":
 		r.serveManifest(w, req, repository, target)
+	case kind == "tags" && target == "list":
+		r.listTags(w, repository)
 	default:
 		http.Error(w, "unexpected path", http.StatusBadRequest)
 	}
@@ -333,6 +335,27 @@ func (r *naiveRegistry) serveManifest(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
+	if req.Method == http.MethodDelete {
+		r.mu.Lock()
+		_, found := r.manifests[repository][reference]
+		delete(r.manifests[repository], reference)
+		// Deleting a manifest by digest deletes every tag pointing at it.
+		if strings.HasPrefix(reference, "sha256:") {
+			for identifier, stored := range r.manifests[repository] {
+				if stored.digest == reference {
+					delete(r.manifests[repository], identifier)
+				}
+			}
+		}
+		r.mu.Unlock()
+		if !found {
+			http.Error(w, "manifest unknown", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
 	r.mu.Lock()
 	stored, found := r.manifests[repository][reference]
 	r.mu.Unlock()
@@ -351,6 +374,26 @@ func (r *naiveRegistry) serveManifest(w http.ResponseWriter, req *http.Request,
 	w.Write(stored.body)
 }
 
+// listTags handles GET /v2/<repository>/tags/list, in one page.
+func (r *naiveRegistry) listTags(w http.ResponseWriter, repository string) {
+	r.mu.Lock()
+	stored, found := r.manifests[repository]
+	tags := []string{}
+	for identifier := range stored {
+		if !strings.HasPrefix(identifier, "sha256:") {
+			tags = append(tags, identifier)
+		}
+	}
+	r.mu.Unlock()
+	if !found {
+		http.Error(w, `{"errors":[{"code":"NAME_UNKNOWN"}]}`, http.StatusNotFound)
+		return
+	}
+	sort.Strings(tags)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"name": repository, "tags": tags})
+}
+
 func (r *naiveRegistry) putBlobLocked(repository, digest string, content []byte) {
 	if r.blobs[repository] == nil {
 		r.blobs[repository] = map[string][]byte{}
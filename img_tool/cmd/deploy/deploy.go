@@ -92,9 +92,16 @@ func DeployProcess(ctx context.Context, args []string) {
 	var defaultSignSetting string
 	var signForce bool
 	var signTargetsFlag string
+	var provenanceBuilderID string
+	var verifyFlag string
+	var verifySignSetting string
 	var deduplicatedPush string
 	var deduplicatedPushBlobRepository string
 	var deduplicatedPushContent string
+	var dryRun bool
+	var dryRunFormat string
+	var reportJSON string
+	var transactional bool
 
 	flagSet := flag.NewFlagSet("deploy", flag.ContinueOnError)
 	flagSet.Var(&requestFiles, "request-file", "Deploy manifest JSON request file (can be used multiple times)")
@@ -113,9 +120,16 @@ func DeployProcess(ctx context.Context, args []string) {
 	flagSet.StringVar(&defaultSignSetting, "default_sign_setting", "", "Default sign_setting for operations without one: a path to a config file, or sha256:<hex> referencing a discovered setting")
 	flagSet.BoolVar(&signForce, "sign_force", false, "Sign every push operation using the default sign_setting, even operations not configured to sign at build time")
 	flagSet.StringVar(&signTargetsFlag, "sign_targets", "", "Override which descriptors are signed: a comma-separated list of roots,child_manifests,referrers or 'all'")
+	flagSet.StringVar(&provenanceBuilderID, "provenance_builder_id", "", "Builder ID recorded in the SLSA provenance attestations of push operations configured to attest provenance, overriding the one in the deploy manifest (e.g. the URI of the CI workflow running the deploy)")
+	flagSet.StringVar(&verifyFlag, "verify", "", "Before writing anything, require a valid signature on these sources, and fail the deploy otherwise: a comma-separated list of base_images (the pulled base image of every push and load operation, which must be pinned by digest), copy_sources (the source of every copy operation) or 'all'. The signatures are checked by the verify-oci-artifact verb of a signer plugin.")
+	flagSet.StringVar(&verifySignSetting, "verify_sign_setting", "", "sign_setting whose plugin and verify_args check the --verify sources: a path to a config file, or sha256:<hex> referencing a discovered setting. Defaults to the default sign_setting.")
 	flagSet.StringVar(&deduplicatedPush, "deduplicated-push", "", "Override the deploy manifest's deduplicated_push setting: 'enabled' checks which manifests the registry already has, uploads each blob several repositories need to just one of them, and cross-mounts it into the others; 'best_effort' does the same but uploads a layer's bytes the ordinary way where the registry refuses to mount it; 'disabled' pushes each manifest independently. 'enabled' requires a registry that supports cross-repository blob mounting: where mounting is refused, an opted-in push fails rather than uploading the blob into every repository. Empty (default) uses the deploy manifest's setting. Ignored when --sink is set.")
 	flagSet.StringVar(&deduplicatedPushBlobRepository, "deduplicated-push-blob-repository", "", "Override the deploy manifest's deduplicated_push_blob_repository setting: the repository within each destination registry that every shared blob is uploaded to and cross-mounted from. Empty (default) uses the deploy manifest's setting, where empty in turn lets the deploy pick a home repository per blob.")
 	flagSet.StringVar(&deduplicatedPushContent, "deduplicated-push-content", "", "Override the deploy manifest's deduplicated_push_content setting: 'blobs' uploads a shared blob to its home repository and nothing else; 'blobs_and_artificial_manifests' also uploads a config blob and creates a manifest referencing the blob there, for registries that only expose a blob to other repositories once a manifest references it. Empty (default) uses the deploy manifest's setting.")
+	flagSet.BoolVar(&dryRun, "dry-run", false, "Print what the deploy would do instead of doing it: the references each operation writes, which manifests and blobs the destination registries already hold (asked with HEAD requests; registry_untag operations also list tags and fetch manifests and configs), which blobs would be uploaded and from where, which would be cross-mounted and from which repository, and which subjects would be signed, and which tags and manifests registry_untag operations would delete (listing the repositories as they stand before the deploy). Nothing is pushed, loaded, tagged, signed or deleted. Cannot be combined with --sink.")
+	flagSet.BoolVar(&transactional, "transactional", false, "Make the deploy all-or-nothing at the tag level: record what every tag the deploy writes points at, push every manifest by digest only, and move the tags only once every destination holds its manifests. If moving any tag fails, every tag already moved is restored to its recorded manifest, or deleted if it did not exist before. Loads are not part of the transaction. Cannot be combined with --sink or the bes push strategy.")
+	flagSet.StringVar(&reportJSON, "report-json", "", "Write what the deploy did to this path as JSON: every operation with the references it wrote (registry/repository@digest and tags), what happened to each blob (skipped, mounted, uploaded or reconstructed, with its source, bytes and duration), the signatures attached, and the best-effort failures that did not stop the deploy. Written whether or not the deploy succeeds. Cannot be combined with --sink or --dry-run.")
+	flagSet.StringVar(&dryRunFormat, "dry-run-format", dryRunFormatText, "Format of the --dry-run plan printed on stdout: 'text' for a human reviewer or 'json' for tooling")
 
 	if err := flagSet.Parse(args); err != nil {
 		flagSet.Usage()
@@ -133,6 +147,18 @@ func DeployProcess(ctx context.Context, args []string) {
 		os.Exit(1)
 	}
 
+	if dryRun {
+		if sink != "" {
+			fmt.Fprintln(os.Stderr, "Error: --dry-run cannot be combined with --sink")
+			os.Exit(1)
+		}
+		if err := validateDryRunFormat(dryRunFormat); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			flagSet.Usage()
+			os.Exit(1)
+		}
+	}
+
 	if err := applyProgressMode(progressMode, false); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		flagSet.Usage()
@@ -170,11 +196,18 @@ func DeployProcess(ctx context.Context, args []string) {
 		DefaultSignSetting:         defaultSignSetting,
 		SignForce:                  signForce,
 		SignTargets:                splitCommaList(signTargetsFlag),
+		ProvenanceBuilderID:        provenanceBuilderID,
+		Verify:                     splitCommaList(verifyFlag),
+		VerifySignSetting:          verifySignSetting,
 		DeduplicatedPush: dedupFlags{
 			mode:           deduplicatedPush,
 			blobRepository: deduplicatedPushBlobRepository,
 			content:        deduplicatedPushContent,
 		},
+		DryRun:        dryRun,
+		DryRunFormat:  dryRunFormat,
+		ReportJSON:    reportJSON,
+		Transactional: transactional,
 	}
 
 	if err := DeployWithExtras(ctx, rawRequest, opts); err != nil {
@@ -232,9 +265,31 @@ type DeployOptions struct {
 	DefaultSignSetting string   // path or "sha256:<hex>" default setting
 	SignForce          bool     // sign all push ops using the default setting
 	SignTargets        []string // override sign-target selection (roots/child_manifests/referrers/all)
+	// ProvenanceBuilderID overrides the builder ID of provenance attestations.
+	ProvenanceBuilderID string
+
+	// Verify lists the sources (base_images, copy_sources or all) that must
+	// carry a valid signature before anything is deployed, checked by the plugin
+	// of VerifySignSetting (a path or "sha256:<hex>"; empty means the default
+	// sign_setting). See verify.go.
+	Verify            []string
+	VerifySignSetting string
 
 	// DeduplicatedPush overrides the deploy manifest's deduplicated_push settings.
 	DeduplicatedPush dedupFlags
+
+	// DryRun prints the deploy plan on stdout, in DryRunFormat ("text" or "json"),
+	// instead of deploying. See dryrun.go.
+	DryRun       bool
+	DryRunFormat string
+
+	// ReportJSON is the path the deploy report is written to, or empty for none.
+	// See report.go.
+	ReportJSON string
+
+	// Transactional stages every push by digest and moves the tags last, rolling
+	// them back if any fails. See transaction.go.
+	Transactional bool
 }
 
 // dedupFlags are the run-time overrides of the deduplicated push settings recorded
@@ -269,9 +324,18 @@ func (f dedupFlags) or(fallback dedupFlags) dedupFlags {
 	return f
 }
 
-func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions) error {
+func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions) (retErr error) {
 	// --jobs is the ceiling on requests in flight to the destination registry.
 	registryopts.LimitConcurrencyToJobs(opts.Jobs)
+	if opts.DryRun && opts.Sink != "" {
+		return fmt.Errorf("--dry-run cannot be combined with --sink")
+	}
+	if opts.ReportJSON != "" && (opts.Sink != "" || opts.DryRun) {
+		return fmt.Errorf("--report-json cannot be combined with --sink or --dry-run")
+	}
+	if opts.Transactional && opts.Sink != "" {
+		return fmt.Errorf("--transactional cannot be combined with --sink")
+	}
 
 	var req api.DeployManifest
 	decoder := json.NewDecoder(bytes.NewReader(rawRequest))
@@ -349,6 +413,37 @@ func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions
 	if err != nil {
 		return err
 	}
+	registryUntagOperations, err := req.RegistryUntagOperations()
+	if err != nil {
+		return err
+	}
+	copyOperations, err := req.CopyOperations()
+	if err != nil {
+		return err
+	}
+
+	// The verification pre-flight runs before anything is written -- and before a
+	// dry run or a sink, which would otherwise report a plan the real deploy
+	// refuses.
+	verifySources, err := parseVerifySources(opts.Verify)
+	if err != nil {
+		return err
+	}
+	if len(verifySources) > 0 {
+		subjects, err := verifySubjects(baseOps, copyOperations, verifySources)
+		if err != nil {
+			return err
+		}
+		if len(subjects) > 0 {
+			verifier, err := newDeployVerifier(req.Settings, opts)
+			if err != nil {
+				return err
+			}
+			if err := preflightVerify(ctx, subjects, verifier, registryopts.Default().WithTransport(pullTransport).Remote()); err != nil {
+				return err
+			}
+		}
+	}
 
 	// Blob-staging repository: layer blobs are pushed to req.Settings.BlobRepository
 	// and cross-mounted from there when the manifests are pushed to their real
@@ -386,11 +481,69 @@ func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions
 	// performs no registry/daemon network I/O for the destination (source blobs
 	// are still resolved from the VFS as usual).
 	if opts.Sink != "" {
+		if len(copyOperations) > 0 {
+			fmt.Fprintf(os.Stderr, "note: --sink skips %d copy operations\n", len(copyOperations))
+		}
+		if len(registryUntagOperations) > 0 {
+			fmt.Fprintf(os.Stderr, "note: --sink skips %d registry_untag operations\n", len(registryUntagOperations))
+		}
 		return deployToSink(ctx, opts.Sink, vfs, casBlobs, pushOperations, loadOperations, registryTagOperations, req.Settings, opts)
 	}
 
-	if len(pushOperations) == 0 && len(loadOperations) == 0 && len(registryTagOperations) == 0 {
-		return fmt.Errorf("no push, load, or registry_tag operations found in deploy manifest")
+	// A dry run stops here: everything it reports is resolved from the VFS and the
+	// operations, plus HEAD requests against the destination registries.
+	if opts.DryRun {
+		plan, err := planDeploy(ctx, req.Settings, dryRunInputs{
+			vfs:           vfs,
+			pushOps:       pushOperations,
+			loadOps:       loadOperations,
+			tagOps:        registryTagOperations,
+			copyOps:       copyOperations,
+			untagOps:      registryUntagOperations,
+			selector:      dedupSelect,
+			pushTransport: pushTransport,
+			opts:          opts,
+		})
+		if err != nil {
+			return fmt.Errorf("planning dry run: %w", err)
+		}
+		return writeDeployPlan(os.Stdout, plan, opts.DryRunFormat)
+	}
+
+	if len(pushOperations) == 0 && len(loadOperations) == 0 && len(registryTagOperations) == 0 && len(copyOperations) == 0 && len(registryUntagOperations) == 0 {
+		return fmt.Errorf("no push, load, registry_tag, copy or registry_untag operations found in deploy manifest")
+	}
+
+	// With --report-json, everything from here on is recorded -- the blob requests
+	// through the push transport, the signatures, the best-effort failures -- and the
+	// report is written however the deploy ends. See report.go.
+	var recorder *deployRecorder
+	if opts.ReportJSON != "" {
+		recorder = newDeployRecorder()
+		pushTransport = recorder.wrap(pushTransport)
+		defer func() {
+			report, err := recorder.build(reportInputs{
+				vfs:      vfs,
+				pushOps:  pushOperations,
+				loadOps:  loadOperations,
+				tagOps:   registryTagOperations,
+				copyOps:  copyOperations,
+				untagOps: registryUntagOperations,
+				settings: req.Settings,
+				opts:     opts,
+			}, retErr)
+			if err == nil {
+				err = writeDeployReport(opts.ReportJSON, report)
+			}
+			if err == nil {
+				return
+			}
+			if retErr == nil {
+				retErr = err
+				return
+			}
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}()
 	}
 
 	// check if any operation requires a blob cache endpoint
@@ -453,6 +606,7 @@ func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions
 			jobs:               opts.Jobs,
 			forbidUpload:       req.Settings.ForbidLayerPush,
 			pushTransport:      pushTransport,
+			report:             recorder,
 			// One-shot: every destination this deploy will ever have is in the plan
 			// below, so the cache has no second deploy to agree with. It is passed all
 			// the same, so that both entry points resolve a blob's home through the one
@@ -479,6 +633,33 @@ func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions
 		return vfs
 	}
 
+	// A transactional deploy records what every tag it writes points at now, then
+	// pushes by digest only; the tags move after everything is staged (see
+	// transaction.go).
+	stagedPushOperations := pushOperations
+	var tagWrites []tagWrite
+	var tagStates map[string]tagState
+	if opts.Transactional {
+		if err := validateTransactional(req.Settings); err != nil {
+			return err
+		}
+		tagWrites, err = planTagWrites(pushOperations, registryTagOperations, vfsForOperation, opts)
+		if err != nil {
+			return fmt.Errorf("planning tags: %w", err)
+		}
+		copyTagWrites, err := planCopyTagWrites(ctx, copyOperations, pullTransport, opts)
+		if err != nil {
+			return fmt.Errorf("planning tags: %w", err)
+		}
+		tagWrites = append(tagWrites, copyTagWrites...)
+		tagStates, err = recordTagStates(ctx, tagWrites, opts.Jobs, registryopts.Default().WithTransport(pushTransport).WithJobs(opts.Jobs).Remote())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "transactional deploy: staging all manifests before moving %d tags\n%s", len(tagWrites), describeTagStates(tagWrites, tagStates))
+		stagedPushOperations = withoutTags(pushOperations)
+	}
+
 	if len(pushOperations) > 0 {
 		uploadBuilder := push.NewBuilder(vfs).
 			WithVFSForOperation(func(op api.IndexedPushDeployOperation) push.VFS {
@@ -495,13 +676,13 @@ func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions
 		if opts.OverrideRepository != "" {
 			uploadBuilder = uploadBuilder.WithOverrideRepository(opts.OverrideRepository)
 		}
-		if len(opts.AdditionalTags) > 0 {
+		if len(opts.AdditionalTags) > 0 && !opts.Transactional {
 			uploadBuilder = uploadBuilder.WithExtraTags(opts.AdditionalTags)
 		}
 		uploader := uploadBuilder.Build()
 
 		g.Go(func() error {
-			tags, err := uploader.PushAll(groupCtx, pushOperations, req.Settings.PushStrategy)
+			tags, err := uploader.PushAll(groupCtx, stagedPushOperations, req.Settings.PushStrategy)
 			if err != nil {
 				return err
 			}
@@ -544,26 +725,50 @@ func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions
 	}
 	// Note: loadedTags are already printed by the loader itself
 
+	// Copies run once the pushes are in, so a deploy may copy what it just pushed
+	// to a staging repository (see copy.go).
+	if len(copyOperations) > 0 {
+		copiedTags, err := applyCopyOperations(ctx, copyOperations, pullTransport, pushTransport, opts, opts.Transactional, recorder)
+		if err != nil {
+			return err
+		}
+		for _, tag := range copiedTags {
+			fmt.Println(tag)
+		}
+	}
+
 	// Sign pushed artifacts (referrers require the subjects to already exist in
 	// the registry, so this runs after the push errgroup completes). Signing
 	// creates its own pusher — the top-level pusher above is scoped to
 	// registry_tag ops, and PushAll uses its own internal pusher.
 	if len(pushOperations) > 0 {
 		if err := applySignOperations(ctx, pushOperations, req.Settings, signOptions{
-			settingFiles:       opts.SignSettingFiles,
-			defaultSetting:     opts.DefaultSignSetting,
-			force:              opts.SignForce,
-			targetOverride:     opts.SignTargets,
-			overrideRegistry:   opts.OverrideRegistry,
-			overrideRepository: opts.OverrideRepository,
-			pushTransport:      pushTransport,
-			jobs:               opts.Jobs,
+			settingFiles:        opts.SignSettingFiles,
+			defaultSetting:      opts.DefaultSignSetting,
+			force:               opts.SignForce,
+			targetOverride:      opts.SignTargets,
+			overrideRegistry:    opts.OverrideRegistry,
+			overrideRepository:  opts.OverrideRepository,
+			provenanceBuilderID: opts.ProvenanceBuilderID,
+			pushTransport:       pushTransport,
+			jobs:                opts.Jobs,
+			report:              recorder,
 		}); err != nil {
 			return err
 		}
 	}
 
-	if len(registryTagOperations) > 0 {
+	// The commit phase of a transactional deploy writes every tag at once: those of
+	// the push, copy and registry_tag operations.
+	if opts.Transactional {
+		committed, err := commitTags(ctx, tagWrites, tagStates, opts.Jobs, registryopts.Default().WithTransport(pushTransport).Remote())
+		if err != nil {
+			return fmt.Errorf("committing tags: %w", err)
+		}
+		for _, t := range committed {
+			fmt.Println(t)
+		}
+	} else if len(registryTagOperations) > 0 {
 		extraTagNames, err := applyRegistryTagOperations(ctx, vfsForOperation, pusher, registryTagOperations, req.Settings.PushStrategy, opts.OverrideRegistry, opts.OverrideRepository, opts.Jobs)
 		if err != nil {
 			return err
@@ -573,9 +778,37 @@ func DeployWithExtras(ctx context.Context, rawRequest []byte, opts DeployOptions
 		}
 	}
 
+	// Retention runs last, once the deploy's own tags are in place (see untag.go).
+	// It is not part of a transaction: a tag it deletes is not restored. Under the
+	// bes strategy nothing is in place yet, so it does not run at all.
+	if len(registryUntagOperations) > 0 && req.Settings.PushStrategy == "bes" {
+		fmt.Fprintf(os.Stderr, "note: the bes strategy skips %d registry_untag operations\n", len(registryUntagOperations))
+	} else if len(registryUntagOperations) > 0 {
+		return applyRegistryUntagOperations(ctx, pushOperations, copyOperations, registryTagOperations, registryUntagOperations, opts, registryopts.Default().WithTransport(pushTransport).WithJobs(opts.Jobs).Remote(), recorder)
+	}
 	return nil
 }
 
+// applyRegistryUntagOperations plans the registry_untag operations against the
+// repositories as they stand after the rest of the deploy, deletes what they
+// give up, and logs every deleted reference on stderr (stdout lists only the
+// references the deploy wrote).
+func applyRegistryUntagOperations(ctx context.Context, pushOps []api.IndexedPushDeployOperation, copyOps []api.IndexedCopyDeployOperation, tagOps []api.IndexedRegistryTagDeployOperation, ops []api.IndexedRegistryUntagDeployOperation, opts DeployOptions, remoteOptions []remote.Option, report *deployRecorder) error {
+	protected, err := untagProtected(ctx, pushOps, copyOps, tagOps, opts, remoteOptions)
+	if err != nil {
+		return err
+	}
+	plans, err := planUntagOperations(ctx, ops, protected, opts, remoteOptions)
+	if err != nil {
+		return err
+	}
+	deleted, err := applyUntagPlans(ctx, plans, opts.Jobs, remoteOptions, report)
+	for _, ref := range deleted {
+		fmt.Fprintf(os.Stderr, "deleted %s\n", ref)
+	}
+	return err
+}
+
 // applyRegistryTagOperations writes the pre-expanded tags from registry_tag
 // ops onto manifests already pushed by a preceding push op. Under the `bes`
 // strategy the BES syncer is responsible for this, so we no-op.
@@ -1091,12 +1324,13 @@ func deployToSink(ctx context.Context, spec string, vfs *deployvfs.VFS, casBlobs
 	// referrer manifests of their subjects, and the distribution sinks only
 	// generate their referrers/ listings from the on-disk manifests at Close.
 	if err := signIntoSink(ctx, s, pushOps, settings, signOptions{
-		settingFiles:       opts.SignSettingFiles,
-		defaultSetting:     opts.DefaultSignSetting,
-		force:              opts.SignForce,
-		targetOverride:     opts.SignTargets,
-		overrideRegistry:   opts.OverrideRegistry,
-		overrideRepository: opts.OverrideRepository,
+		settingFiles:        opts.SignSettingFiles,
+		defaultSetting:      opts.DefaultSignSetting,
+		force:               opts.SignForce,
+		targetOverride:      opts.SignTargets,
+		overrideRegistry:    opts.OverrideRegistry,
+		overrideRepository:  opts.OverrideRepository,
+		provenanceBuilderID: opts.ProvenanceBuilderID,
 	}); err != nil {
 		s.Close()
 		return err
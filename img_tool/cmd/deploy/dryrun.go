@@ -0,0 +1,738 @@
+package deploy
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/deployvfs"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/provenance"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// The dry run.
+//
+// `img deploy --dry-run` resolves everything a deploy would do and describes it
+// instead of doing it, so a release manager can review a multi_deploy before it
+// touches a production registry. It goes through the same machinery the deploy
+// itself uses -- the VFS decides where each blob would be read from, the push and
+// load builders decide which references would be written, the deduplicated push
+// plans its uploads and mounts -- and stops short of every write. It only reads
+// from the destination registries: HEAD requests for manifests and blobs, and,
+// for registry_untag operations, tag lists and GETs of the manifests and configs
+// their retention rules rank by. It never uploads, mounts, tags, signs or deletes.
+//
+// What the registry answers is a snapshot. A manifest or blob reported present
+// may be gone by the time the deploy runs, and one reported missing may have been
+// pushed by then; the deploy re-checks either way.
+
+// Values of --dry-run-format.
+const (
+	dryRunFormatText = "text"
+	dryRunFormatJSON = "json"
+)
+
+// Values of plannedBlob.Action: what the manifest push would do with a blob in
+// the destination repository.
+const (
+	// blobActionPresent: the destination repository already holds the blob, so the
+	// push skips it after its own HEAD.
+	blobActionPresent = "present"
+	// blobActionMount: the blob is cross-mounted from plannedBlob.MountFrom. Unless
+	// the blob is mount-only, a refused mount falls back to uploading its bytes.
+	blobActionMount = "mount"
+	// blobActionUpload: the blob's bytes are uploaded, read from plannedBlob.Source.
+	blobActionUpload = "upload"
+	// blobActionForbidden: the blob would have to be uploaded, but layer uploads are
+	// forbidden (forbid_layer_push), so the push would fail.
+	blobActionForbidden = "forbidden"
+)
+
+// deployPlan is what a deploy would do, in the shape `img deploy --dry-run`
+// prints it.
+type deployPlan struct {
+	PushStrategy string `json:"push_strategy,omitempty"`
+	LoadStrategy string `json:"load_strategy,omitempty"`
+	// SharedUploads are the blobs uploaded before any manifest is pushed: to the
+	// build-time staging repository (blob_repository), or to their home repository
+	// by the deduplicated push.
+	SharedUploads []plannedUpload    `json:"shared_uploads,omitempty"`
+	Operations    []plannedOperation `json:"operations"`
+}
+
+// plannedUpload is one blob uploaded ahead of the manifest push.
+type plannedUpload struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	Source     string `json:"source,omitempty"`
+	// Reason is "blob_repository" or "deduplicated_push".
+	Reason string `json:"reason"`
+}
+
+// plannedOperation is one operation of the deploy manifest.
+type plannedOperation struct {
+	Index   int    `json:"index"`
+	Command string `json:"command"`
+	// RootKind and Root are empty for a registry_untag, which has no root.
+	// A copy has a Root (its source digest) but no RootKind: the source is not
+	// read, since the deploy may push it first.
+	RootKind string `json:"root_kind,omitempty"`
+	Root     string `json:"root,omitempty"`
+	// Registry and Repository are the destination after --registry and
+	// --repository are applied. Both are empty for a load in the rules_oci
+	// compatible mode, whose tags are full references already.
+	Registry   string `json:"registry,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	// References are the references written: the digest reference and every tag
+	// of a push or a copy, the tags of a registry_tag, the image names of a load.
+	References []string `json:"references,omitempty"`
+	// Deletes are the references a registry_untag would delete, resolved against
+	// the repository as it stands before the deploy, and Spared the tags and
+	// digests it selects but leaves alone because the deploy writes them.
+	Deletes []string `json:"deletes,omitempty"`
+	Spared  []string `json:"spared,omitempty"`
+	// Daemon and Platforms describe a load.
+	Daemon           string             `json:"daemon,omitempty"`
+	Platforms        []string           `json:"platforms,omitempty"`
+	DeduplicatedPush string             `json:"deduplicated_push,omitempty"`
+	Manifests        []plannedManifest  `json:"manifests,omitempty"`
+	Signatures       []plannedSignature `json:"signatures,omitempty"`
+	// Note explains an operation the deploy does not perform itself.
+	Note string `json:"note,omitempty"`
+}
+
+// plannedManifest is one manifest of an operation and, when the destination does
+// not hold it yet, what happens to each blob it references.
+type plannedManifest struct {
+	Digest  string        `json:"digest"`
+	Present bool          `json:"present"`
+	Blobs   []plannedBlob `json:"blobs,omitempty"`
+}
+
+// plannedBlob is one blob of a missing manifest.
+type plannedBlob struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type,omitempty"`
+	Size      int64  `json:"size"`
+	// Role is "config" or "layer".
+	Role   string `json:"role"`
+	Action string `json:"action"`
+	// MountFrom is the repository a mounted blob comes from.
+	MountFrom string `json:"mount_from,omitempty"`
+	// MountOnly records that a refused mount fails the push instead of falling
+	// back to an upload.
+	MountOnly bool `json:"mount_only,omitempty"`
+	// Source is where the bytes of an uploaded blob are read from (see
+	// deployvfs.VFS.Location).
+	Source string `json:"source,omitempty"`
+}
+
+// plannedSignature is one subject the deploy would sign after the push.
+type plannedSignature struct {
+	Subject string `json:"subject"`
+	// PredicateType is set for an attestation, e.g. the SLSA provenance
+	// predicate type.
+	PredicateType string `json:"predicate_type,omitempty"`
+	// Setting is the digest of the sign_setting used, or "default".
+	Setting    string `json:"setting"`
+	BestEffort bool   `json:"best_effort,omitempty"`
+}
+
+// dryRunInputs is what planDeploy needs beyond the deploy manifest: the VFS the
+// deploy would read from, the transport it would push through and the options it
+// was started with.
+type dryRunInputs struct {
+	vfs           *deployvfs.VFS
+	pushOps       []api.IndexedPushDeployOperation
+	loadOps       []api.IndexedLoadDeployOperation
+	tagOps        []api.IndexedRegistryTagDeployOperation
+	copyOps       []api.IndexedCopyDeployOperation
+	untagOps      []api.IndexedRegistryUntagDeployOperation
+	selector      dedupSelector
+	pushTransport http.RoundTripper
+	opts          DeployOptions
+}
+
+// validateDryRunFormat checks a --dry-run-format value.
+func validateDryRunFormat(format string) error {
+	switch format {
+	case dryRunFormatText, dryRunFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid --dry-run-format value %q: want %q or %q", format, dryRunFormatText, dryRunFormatJSON)
+}
+
+// planDeploy resolves every operation of the deploy manifest into a deployPlan.
+// It only reads from the destination registries: HEADs for manifests and blobs,
+// and the tag lists, manifests and configs planUntagOperations asks for.
+func planDeploy(ctx context.Context, settings api.DeploySettings, in dryRunInputs) (*deployPlan, error) {
+	jobs := max(in.opts.Jobs, 1)
+	plan := &deployPlan{
+		PushStrategy: settings.PushStrategy,
+		LoadStrategy: settings.LoadStrategy,
+	}
+	remoteOptions := registryopts.Default().WithTransport(in.pushTransport).WithJobs(jobs).Remote()
+
+	// The deduplicated push decides its uploads and mounts up front, from the
+	// registry's own answers. Planning it with no location cache keeps the dry run
+	// from claiming homes a later deploy of this process would then trust.
+	var views *dedupViews
+	var dedup *dedupPlan
+	registryPush := settings.PushStrategy != "bes"
+	if registryPush && in.selector.any(in.pushOps, in.tagOps) {
+		if err := validateDeduplicatedPush(settings); err != nil {
+			return nil, err
+		}
+		options := dedupOptions{
+			selector:           in.selector,
+			blobRepository:     settings.BlobRepository,
+			overrideRegistry:   in.opts.OverrideRegistry,
+			overrideRepository: in.opts.OverrideRepository,
+			jobs:               jobs,
+			forbidUpload:       settings.ForbidLayerPush,
+			pushTransport:      in.pushTransport,
+		}
+		var err error
+		dedup, _, err = planDedupPushFor(ctx, in.pushOps, in.tagOps, options)
+		if err != nil {
+			return nil, fmt.Errorf("planning deduplicated push: %w", err)
+		}
+		views = newDedupViews(in.vfs, dedup, options)
+		if !settings.ForbidLayerPush {
+			for _, repository := range dedup.uploadRepositories() {
+				for _, digest := range dedup.uploads[repository] {
+					plan.SharedUploads = append(plan.SharedUploads, plannedUpload{
+						Repository: repository,
+						Digest:     digest.String(),
+						Source:     blobSource(in.vfs, digest),
+						Reason:     "deduplicated_push",
+					})
+				}
+			}
+		}
+	}
+	if stagingOps := stagingPushOperations(in.pushOps, in.selector); registryPush && settings.BlobRepository != "" && !settings.ForbidLayerPush {
+		plan.SharedUploads = append(plan.SharedUploads, plannedStagingUploads(in.vfs, stagingOps, settings.BlobRepository, in.opts.OverrideRegistry)...)
+	}
+	vfsForOperation := func(registry string, base api.BaseCommandOperation) *deployvfs.VFS {
+		if view := views.For(registry, base); view != nil {
+			return view
+		}
+		return in.vfs
+	}
+
+	uploader := newReferenceUploader(in.vfs, in.opts)
+
+	// Every manifest of every push operation is checked, and every blob of the ones
+	// the registry is missing, in two rounds of parallel HEADs.
+	var pushed []plannedOperation
+	var manifestChecks []destination
+	for _, op := range in.pushOps {
+		planned := plannedOperation{
+			Index:            op.I,
+			Command:          op.Command,
+			RootKind:         op.RootKind,
+			Root:             op.Root.Digest,
+			Registry:         overrideOr(op.Registry, in.opts.OverrideRegistry),
+			Repository:       overrideOr(op.Repository, in.opts.OverrideRepository),
+			DeduplicatedPush: in.selector.mode(op.BaseCommandOperation),
+		}
+		refs, err := uploader.References(op)
+		if err != nil {
+			return nil, fmt.Errorf("push operation %d: %w", op.I, err)
+		}
+		for _, ref := range refs {
+			planned.References = append(planned.References, ref.String())
+		}
+		if !registryPush {
+			planned.Note = "pushed by the build event stream syncer, not by this deploy"
+			pushed = append(pushed, planned)
+			continue
+		}
+		for _, manifest := range op.Manifests {
+			planned.Manifests = append(planned.Manifests, plannedManifest{Digest: manifest.Descriptor.Digest})
+			manifestChecks = append(manifestChecks, plannedDestination(planned, manifest.Descriptor.Digest))
+		}
+		pushed = append(pushed, planned)
+	}
+	presentManifests, err := findPresentManifests(ctx, manifestChecks, jobs, remoteOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobChecks []destination
+	for i, op := range in.pushOps {
+		if !registryPush {
+			break
+		}
+		for j, manifest := range op.Manifests {
+			planned := &pushed[i].Manifests[j]
+			planned.Present = presentManifests[plannedDestination(pushed[i], manifest.Descriptor.Digest)]
+			if planned.Present {
+				continue
+			}
+			blobChecks = append(blobChecks, plannedDestination(pushed[i], manifest.Config.Digest))
+			for _, layer := range manifest.LayerBlobs {
+				blobChecks = append(blobChecks, plannedDestination(pushed[i], layer.Digest))
+			}
+		}
+	}
+	presentBlobs, err := findPresentBlobs(ctx, blobChecks, jobs, remoteOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range in.pushOps {
+		if !registryPush {
+			break
+		}
+		view := vfsForOperation(op.Registry, op.BaseCommandOperation)
+		for j, manifest := range op.Manifests {
+			planned := &pushed[i].Manifests[j]
+			if planned.Present {
+				continue
+			}
+			config := plannedBlob{Digest: manifest.Config.Digest, MediaType: manifest.Config.MediaType, Size: manifest.Config.Size, Role: "config"}
+			if presentBlobs[plannedDestination(pushed[i], config.Digest)] {
+				config.Action = blobActionPresent
+			} else {
+				config.Action = blobActionUpload
+				config.Source = blobSourceOf(in.vfs, config.Digest)
+			}
+			planned.Blobs = append(planned.Blobs, config)
+			for _, layer := range manifest.LayerBlobs {
+				planned.Blobs = append(planned.Blobs, planLayer(view, pushed[i], layer, presentBlobs, dedup))
+			}
+		}
+	}
+
+	signed, err := plannedSignatures(in.pushOps, settings, in.opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pushed {
+		pushed[i].Signatures = signed[pushed[i].Index]
+	}
+	plan.Operations = append(plan.Operations, pushed...)
+
+	for _, op := range in.tagOps {
+		planned := plannedOperation{
+			Index:      op.I,
+			Command:    op.Command,
+			RootKind:   op.RootKind,
+			Root:       op.Root.Digest,
+			Registry:   overrideOr(op.Registry, in.opts.OverrideRegistry),
+			Repository: overrideOr(op.Repository, in.opts.OverrideRepository),
+		}
+		refs, err := registryTagReferences(op, in.opts.OverrideRegistry, in.opts.OverrideRepository)
+		if err != nil {
+			return nil, err
+		}
+		planned.References = refs
+		if !registryPush {
+			planned.Note = "tagged by the build event stream syncer, not by this deploy"
+		}
+		plan.Operations = append(plan.Operations, planned)
+	}
+
+	for _, op := range in.copyOps {
+		refs, err := copyReferences(op, in.opts)
+		if err != nil {
+			return nil, err
+		}
+		source, _ := op.SourceDigest(registryopts.NameOptions()...)
+		note := "copied with its referrers from " + source.String()
+		if op.SkipReferrers {
+			note = "copied without its referrers from " + source.String()
+		}
+		plan.Operations = append(plan.Operations, plannedOperation{
+			Index:      op.I,
+			Command:    op.Command,
+			Root:       source.DigestStr(),
+			Registry:   overrideOr(op.Registry, in.opts.OverrideRegistry),
+			Repository: overrideOr(op.Repository, in.opts.OverrideRepository),
+			References: refs,
+			Note:       note,
+		})
+	}
+
+	if len(in.untagOps) > 0 && !registryPush {
+		for _, op := range in.untagOps {
+			plan.Operations = append(plan.Operations, plannedOperation{
+				Index:      op.I,
+				Command:    op.Command,
+				Registry:   overrideOr(op.Registry, in.opts.OverrideRegistry),
+				Repository: overrideOr(op.Repository, in.opts.OverrideRepository),
+				Note:       "skipped: the build event stream syncer pushes after this deploy",
+			})
+		}
+	} else if len(in.untagOps) > 0 {
+		protected, err := untagProtected(ctx, in.pushOps, in.copyOps, in.tagOps, in.opts, remoteOptions)
+		if err != nil {
+			return nil, err
+		}
+		untagPlans, err := planUntagOperations(ctx, in.untagOps, protected, in.opts, remoteOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, untag := range untagPlans {
+			plan.Operations = append(plan.Operations, plannedOperation{
+				Index:      untag.op.I,
+				Command:    untag.op.Command,
+				Registry:   untag.repository.RegistryStr(),
+				Repository: untag.repository.RepositoryStr(),
+				Deletes:    untag.references(),
+				Spared:     untag.spared,
+			})
+		}
+	}
+
+	if len(in.loadOps) > 0 {
+		loader := newReferenceLoader(in.vfs, in.opts)
+		for _, op := range in.loadOps {
+			tags, err := loader.Tags(op)
+			if err != nil {
+				return nil, fmt.Errorf("load operation %d: %w", op.I, err)
+			}
+			daemon := op.Daemon
+			if daemon == "" {
+				daemon = "docker"
+			}
+			plan.Operations = append(plan.Operations, plannedOperation{
+				Index:      op.I,
+				Command:    op.Command,
+				RootKind:   op.RootKind,
+				Root:       op.Root.Digest,
+				Registry:   op.Registry,
+				Repository: op.Repository,
+				References: tags,
+				Daemon:     daemon,
+				Platforms:  in.opts.PlatformList,
+			})
+		}
+	}
+
+	// Operations are reported in the order of the deploy manifest, whatever their
+	// command.
+	slices.SortStableFunc(plan.Operations, func(a, b plannedOperation) int { return cmp.Compare(a.Index, b.Index) })
+	return plan, nil
+}
+
+// planLayer decides what the manifest push would do with one layer in the
+// destination of op, as served by view.
+func planLayer(view *deployvfs.VFS, op plannedOperation, layer api.LayerBlob, present map[destination]bool, dedup *dedupPlan) plannedBlob {
+	planned := plannedBlob{Digest: layer.Digest, MediaType: layer.MediaType, Size: layer.Size, Role: "layer"}
+	if present[plannedDestination(op, layer.Digest)] {
+		planned.Action = blobActionPresent
+		return planned
+	}
+	hash, err := registryv1.NewHash(layer.Digest)
+	if err != nil {
+		planned.Action = blobActionUpload
+		return planned
+	}
+	if dedup.uploadsTo(normalizeRegistry(op.Registry)+"/"+op.Repository, layer.Digest) {
+		// This repository is the blob's home: the deduplicated push uploads it here
+		// before the manifest push, which then finds it present.
+		planned.Action = blobActionUpload
+		planned.Source = blobSource(view, hash)
+		return planned
+	}
+	planned.MountOnly = view.MountOnly(hash)
+	if src, found := view.CrossMountSource(hash); found {
+		planned.Action = blobActionMount
+		planned.MountFrom = src.Repository
+		if src.Registry != "" {
+			planned.MountFrom = src.Registry + "/" + src.Repository
+		}
+		return planned
+	}
+	if planned.MountOnly {
+		planned.Action = blobActionForbidden
+		return planned
+	}
+	planned.Action = blobActionUpload
+	planned.Source = blobSource(view, hash)
+	return planned
+}
+
+// uploadsTo reports whether the plan uploads the blob to the repository
+// ("<registry>/<repository>"). It is false for a nil plan.
+func (p *dedupPlan) uploadsTo(repository, digest string) bool {
+	if p == nil {
+		return false
+	}
+	for _, hash := range p.uploads[repository] {
+		if hash.String() == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// plannedStagingUploads lists the blobs preUploadStagingBlobs would upload to the
+// build-time staging repository.
+func plannedStagingUploads(vfs *deployvfs.VFS, ops []api.IndexedPushDeployOperation, blobRepository, overrideRegistry string) []plannedUpload {
+	var uploads []plannedUpload
+	seen := make(map[string]bool)
+	for _, op := range ops {
+		repository := overrideOr(op.Registry, overrideRegistry) + "/" + blobRepository
+		for _, manifest := range op.Manifests {
+			for _, layer := range manifest.LayerBlobs {
+				if seen[repository+"@"+layer.Digest] {
+					continue
+				}
+				seen[repository+"@"+layer.Digest] = true
+				uploads = append(uploads, plannedUpload{
+					Repository: repository,
+					Digest:     layer.Digest,
+					Source:     blobSourceOf(vfs, layer.Digest),
+					Reason:     "blob_repository",
+				})
+			}
+		}
+	}
+	return uploads
+}
+
+// plannedSignatures lists, per operation index, the subjects the deploy would
+// sign. It resolves the sign settings the way the deploy does but never starts a
+// signer plugin.
+func plannedSignatures(pushOps []api.IndexedPushDeployOperation, settings api.DeploySettings, opts DeployOptions) (map[int][]plannedSignature, error) {
+	signOpts := signOptions{
+		settingFiles:   opts.SignSettingFiles,
+		defaultSetting: opts.DefaultSignSetting,
+		force:          opts.SignForce,
+		targetOverride: opts.SignTargets,
+	}
+	store, _, err := signStore(signOpts)
+	if err != nil {
+		return nil, err
+	}
+	override := normalizeTargets(signOpts.targetOverride)
+	signatures := make(map[int][]plannedSignature)
+	for _, op := range pushOps {
+		decision := decideSigning(op, store, signOpts.force, override)
+		if !decision.sign {
+			continue
+		}
+		setting := "default"
+		if decision.setting != nil && decision.setting.Digest != "" {
+			setting = decision.setting.Digest
+		}
+		if _, err := store.Resolve(decision.setting, settings.DefaultSignSetting); err != nil && !decision.bestEffort {
+			return nil, fmt.Errorf("push operation %d: %w", op.I, err)
+		}
+		for _, subject := range collectSubjects(op, decision.targets) {
+			signatures[op.I] = append(signatures[op.I], plannedSignature{
+				Subject:    subject.Digest,
+				Setting:    setting,
+				BestEffort: decision.bestEffort,
+			})
+		}
+		if decision.provenance != nil {
+			signatures[op.I] = append(signatures[op.I], plannedSignature{
+				Subject:       op.Root.Digest,
+				PredicateType: provenance.PredicateType,
+				Setting:       setting,
+				BestEffort:    decision.bestEffort,
+			})
+		}
+	}
+	return signatures, nil
+}
+
+// plannedDestination is the destination a blob or manifest of op is checked at.
+func plannedDestination(op plannedOperation, digest string) destination {
+	return destination{registry: normalizeRegistry(op.Registry), repository: op.Repository, digest: digest}
+}
+
+// blobSourceOf is blobSource for a digest string.
+func blobSourceOf(vfs *deployvfs.VFS, digest string) string {
+	hash, err := registryv1.NewHash(digest)
+	if err != nil {
+		return ""
+	}
+	return blobSource(vfs, hash)
+}
+
+// blobSource returns where the VFS would read the blob from, in the words
+// printBlobStats uses.
+func blobSource(vfs *deployvfs.VFS, digest registryv1.Hash) string {
+	location, found := vfs.Location(digest)
+	if !found {
+		return ""
+	}
+	switch location {
+	case "file":
+		return "disk"
+	case "registry":
+		return "container registry"
+	case "remote_cache":
+		return "remote cache"
+	case "compact_stream":
+		return "compact stream"
+	case "stub":
+		return "nowhere (expected in the registry)"
+	}
+	return location
+}
+
+// findPresentBlobs asks the registry which of the blobs it already holds in the
+// given repositories, with --jobs requests in flight. As for manifests (see
+// findPresentManifests), a 401 or 403 counts as absent.
+func findPresentBlobs(ctx context.Context, dests []destination, jobs int, remoteOptions []remote.Option) (map[destination]bool, error) {
+	if len(dests) == 0 {
+		return nil, nil
+	}
+	puller, err := remote.NewPuller(remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("creating puller: %w", err)
+	}
+
+	found := make([]bool, len(dests))
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+	for i, dest := range dests {
+		g.Go(func() error {
+			ref, err := dest.digestRef()
+			if err != nil {
+				return fmt.Errorf("parsing blob %s: %w", dest, err)
+			}
+			layer, err := puller.Layer(groupCtx, ref)
+			if err != nil {
+				return fmt.Errorf("checking whether blob %s is already present: %w", dest, err)
+			}
+			if mountable, ok := layer.(*remote.MountableLayer); ok {
+				layer = mountable.Layer
+			}
+			exists, err := partial.Exists(layer)
+			if err != nil {
+				if manifestAbsent(err) {
+					return nil
+				}
+				return fmt.Errorf("checking whether blob %s is already present: %w", dest, err)
+			}
+			found[i] = exists
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	present := make(map[destination]bool, len(dests))
+	for i, dest := range dests {
+		if found[i] {
+			present[dest] = true
+		}
+	}
+	return present, nil
+}
+
+// writeDeployPlan prints the plan as JSON or as text for a human reviewer.
+func writeDeployPlan(w io.Writer, plan *deployPlan, format string) error {
+	if format == dryRunFormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "dry run: nothing was pushed, loaded, tagged, signed or deleted\n")
+	if len(plan.SharedUploads) > 0 {
+		fmt.Fprintf(&sb, "blobs uploaded before the manifest push:\n")
+		for _, upload := range plan.SharedUploads {
+			fmt.Fprintf(&sb, "  %s@%s (%s", upload.Repository, upload.Digest, strings.ReplaceAll(upload.Reason, "_", " "))
+			if upload.Source != "" {
+				fmt.Fprintf(&sb, ", from %s", upload.Source)
+			}
+			fmt.Fprintf(&sb, ")\n")
+		}
+	}
+	for _, op := range plan.Operations {
+		fmt.Fprintf(&sb, "%s %d:", op.Command, op.Index)
+		if op.RootKind != "" {
+			fmt.Fprintf(&sb, " %s", op.RootKind)
+		}
+		if op.Root != "" {
+			fmt.Fprintf(&sb, " %s", op.Root)
+		}
+		switch {
+		case op.Daemon != "":
+			fmt.Fprintf(&sb, " into %s", op.Daemon)
+			if len(op.Platforms) > 0 {
+				fmt.Fprintf(&sb, " (platforms %s)", strings.Join(op.Platforms, ", "))
+			}
+		case op.Root == "":
+			fmt.Fprintf(&sb, " in %s/%s", op.Registry, op.Repository)
+		case op.Registry != "":
+			fmt.Fprintf(&sb, " to %s/%s", op.Registry, op.Repository)
+			if op.DeduplicatedPush != "" && op.DeduplicatedPush != deduplicatedPushDisabled {
+				fmt.Fprintf(&sb, " (deduplicated push %s)", op.DeduplicatedPush)
+			}
+		}
+		fmt.Fprintf(&sb, "\n")
+		if op.Note != "" {
+			fmt.Fprintf(&sb, "  note: %s\n", op.Note)
+		}
+		for _, ref := range op.References {
+			fmt.Fprintf(&sb, "  writes %s\n", ref)
+		}
+		for _, ref := range op.Deletes {
+			fmt.Fprintf(&sb, "  deletes %s\n", ref)
+		}
+		for _, spared := range op.Spared {
+			fmt.Fprintf(&sb, "  keeps %s (written by this deploy)\n", spared)
+		}
+		for _, manifest := range op.Manifests {
+			if manifest.Present {
+				fmt.Fprintf(&sb, "  manifest %s: already present\n", manifest.Digest)
+				continue
+			}
+			fmt.Fprintf(&sb, "  manifest %s: missing\n", manifest.Digest)
+			for _, blob := range manifest.Blobs {
+				fmt.Fprintf(&sb, "    %s %s (%s): %s", blob.Role, blob.Digest, humanizeBytes(blob.Size), blob.Action)
+				switch blob.Action {
+				case blobActionMount:
+					fmt.Fprintf(&sb, " from %s", blob.MountFrom)
+					if blob.MountOnly {
+						fmt.Fprintf(&sb, " (mount only)")
+					}
+				case blobActionUpload:
+					if blob.Source != "" {
+						fmt.Fprintf(&sb, " from %s", blob.Source)
+					}
+				case blobActionForbidden:
+					fmt.Fprintf(&sb, " (forbid_layer_push is set: the push would fail)")
+				}
+				fmt.Fprintf(&sb, "\n")
+			}
+		}
+		for _, signature := range op.Signatures {
+			if signature.PredicateType != "" {
+				fmt.Fprintf(&sb, "  attests %s for %s with sign_setting %s", signature.PredicateType, signature.Subject, signature.Setting)
+			} else {
+				fmt.Fprintf(&sb, "  signs %s with sign_setting %s", signature.Subject, signature.Setting)
+			}
+			if signature.BestEffort {
+				fmt.Fprintf(&sb, " (best effort)")
+			}
+			fmt.Fprintf(&sb, "\n")
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
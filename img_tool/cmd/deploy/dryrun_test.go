@@ -0,0 +1,209 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/deployvfs"
+)
+
+// runDryRun plans the deploy of dm against the registry behind transport, the way
+// `img deploy --dry-run` does.
+func runDryRun(t *testing.T, transport http.RoundTripper, layoutDirs []string, dm api.DeployManifest) *deployPlan {
+	t.Helper()
+	vfsBuilder := deployvfs.NewBuilder(dm)
+	for _, layoutDir := range layoutDirs {
+		vfsBuilder = vfsBuilder.WithOCILayout(layoutDir)
+	}
+	vfs, err := vfsBuilder.Build()
+	if err != nil {
+		t.Fatalf("building VFS: %v", err)
+	}
+	pushOps, err := dm.PushOperations()
+	if err != nil {
+		t.Fatalf("reading push operations: %v", err)
+	}
+	plan, err := planDeploy(context.Background(), dm.Settings, dryRunInputs{
+		vfs:           vfs,
+		pushOps:       pushOps,
+		pushTransport: transport,
+		opts:          DeployOptions{Jobs: 4},
+	})
+	if err != nil {
+		t.Fatalf("planning dry run: %v", err)
+	}
+	return plan
+}
+
+// plannedLayerActions returns, per repository, the action planned for each layer.
+func plannedLayerActions(plan *deployPlan) map[string]map[string]plannedBlob {
+	actions := make(map[string]map[string]plannedBlob)
+	for _, op := range plan.Operations {
+		for _, manifest := range op.Manifests {
+			for _, blob := range manifest.Blobs {
+				if blob.Role != "layer" {
+					continue
+				}
+				if actions[op.Repository] == nil {
+					actions[op.Repository] = make(map[string]plannedBlob)
+				}
+				actions[op.Repository][blob.Digest] = blob
+			}
+		}
+	}
+	return actions
+}
+
+// TestDryRunPlansDeduplicatedPushWithoutWriting holds the dry run to its promise:
+// it reports the uploads and mounts the deduplicated push would make -- each shared
+// layer uploaded to its home repository and mounted into the others -- and the
+// registry sees no write at all.
+func TestDryRunPlansDeduplicatedPushWithoutWriting(t *testing.T) {
+	reg := newNaiveRegistry()
+	layoutDirs, dm, images := buildSharedLayerLayouts(t, "reg.example.com", 3, 2)
+	home := images.repositories[0]
+
+	plan := runDryRun(t, reg.transport(), layoutDirs, dm)
+
+	blobPuts, mounts, manifestPuts := reg.snapshot()
+	if len(blobPuts) != 0 || len(mounts) != 0 || len(manifestPuts) != 0 {
+		t.Fatalf("dry run wrote to the registry: blobs %v, mounts %v, manifests %v", blobPuts, mounts, manifestPuts)
+	}
+
+	actions := plannedLayerActions(plan)
+	for _, digest := range images.shared {
+		if got := actions[home][digest]; got.Action != blobActionUpload {
+			t.Errorf("shared layer %s in home %s: action %q, want %q", digest, home, got.Action, blobActionUpload)
+		}
+		for _, repository := range images.repositories[1:] {
+			got := actions[repository][digest]
+			if got.Action != blobActionMount || got.MountFrom != "reg.example.com/"+home {
+				t.Errorf("shared layer %s in %s: action %q from %q, want %q from reg.example.com/%s", digest, repository, got.Action, got.MountFrom, blobActionMount, home)
+			}
+		}
+	}
+	for i, digest := range images.unique {
+		if got := actions[images.repositories[i]][digest]; got.Action != blobActionUpload || got.Source != "disk" {
+			t.Errorf("layer %s in %s: action %q from %q, want %q from disk", digest, images.repositories[i], got.Action, got.Source, blobActionUpload)
+		}
+	}
+
+	var shared []string
+	for _, upload := range plan.SharedUploads {
+		if upload.Reason != "deduplicated_push" || upload.Repository != "reg.example.com/"+home {
+			t.Errorf("unexpected shared upload %+v", upload)
+		}
+		shared = append(shared, upload.Digest)
+	}
+	if len(shared) != len(images.shared) {
+		t.Errorf("plan uploads %d shared blobs ahead of the manifests, want %d: %v", len(shared), len(images.shared), shared)
+	}
+
+	for i, op := range plan.Operations {
+		if len(op.Manifests) != 1 || op.Manifests[0].Present {
+			t.Errorf("operation %d: manifests %+v, want one missing manifest", i, op.Manifests)
+		}
+		wantRef := "reg.example.com/" + images.repositories[i] + ":latest"
+		if !slices.Contains(op.References, wantRef) {
+			t.Errorf("operation %d writes %v, want %s among them", i, op.References, wantRef)
+		}
+	}
+}
+
+// TestDryRunReportsWhatTheRegistryHolds plans the incremental deploy: two of three
+// services are already pushed, so their manifests are reported present, and the
+// third's shared layers are mounted out of a sibling instead of uploaded.
+func TestDryRunReportsWhatTheRegistryHolds(t *testing.T) {
+	reg := newNaiveRegistry()
+	layoutDirs, dm, images := buildSharedLayerLayouts(t, "reg.example.com", 3, 2)
+	siblings := dm
+	siblings.Operations = dm.Operations[1:]
+	if err := runDedupDeploy(t, reg, layoutDirs, siblings); err != nil {
+		t.Fatalf("deploying the siblings: %v", err)
+	}
+	beforeBlobs, beforeMounts, beforeManifests := reg.snapshot()
+
+	plan := runDryRun(t, reg.transport(), layoutDirs, dm)
+
+	blobPuts, mounts, manifestPuts := reg.snapshot()
+	if len(blobPuts) != len(beforeBlobs) || len(mounts) != len(beforeMounts) || len(manifestPuts) != len(beforeManifests) {
+		t.Fatalf("dry run wrote to the registry")
+	}
+
+	for i, op := range plan.Operations {
+		if want := i > 0; len(op.Manifests) != 1 || op.Manifests[0].Present != want {
+			t.Errorf("operation %d (%s): manifests %+v, want present=%v", i, op.Repository, op.Manifests, want)
+		}
+	}
+	actions := plannedLayerActions(plan)
+	for _, digest := range images.shared {
+		got := actions[images.repositories[0]][digest]
+		if got.Action != blobActionMount || !strings.HasPrefix(got.MountFrom, "reg.example.com/team/service-") || got.MountFrom == "reg.example.com/"+images.repositories[0] {
+			t.Errorf("shared layer %s: action %q from %q, want a mount from a sibling", digest, got.Action, got.MountFrom)
+		}
+	}
+	if len(plan.SharedUploads) != 0 {
+		t.Errorf("plan uploads %v ahead of the manifests, want nothing: every shared layer is already in the registry", plan.SharedUploads)
+	}
+}
+
+// TestWriteDeployPlan checks both output formats of a plan.
+func TestWriteDeployPlan(t *testing.T) {
+	plan := &deployPlan{
+		PushStrategy: "eager",
+		Operations: []plannedOperation{{
+			Index:      0,
+			Command:    "push",
+			RootKind:   "manifest",
+			Root:       "sha256:aaaa",
+			Registry:   "reg.example.com",
+			Repository: "team/app",
+			References: []string{"reg.example.com/team/app:latest"},
+			Manifests: []plannedManifest{{
+				Digest: "sha256:aaaa",
+				Blobs: []plannedBlob{
+					{Digest: "sha256:bbbb", Size: 2048, Role: "layer", Action: blobActionMount, MountFrom: "team/base"},
+					{Digest: "sha256:cccc", Size: 10, Role: "layer", Action: blobActionForbidden},
+				},
+			}},
+		}},
+	}
+
+	var text bytes.Buffer
+	if err := writeDeployPlan(&text, plan, dryRunFormatText); err != nil {
+		t.Fatalf("writing text plan: %v", err)
+	}
+	for _, want := range []string{
+		"push 0: manifest sha256:aaaa to reg.example.com/team/app",
+		"writes reg.example.com/team/app:latest",
+		"manifest sha256:aaaa: missing",
+		"layer sha256:bbbb (2.0 KiB): mount from team/base",
+		"layer sha256:cccc (10 B): forbidden",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text plan does not contain %q:\n%s", want, text.String())
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err := writeDeployPlan(&encoded, plan, dryRunFormatJSON); err != nil {
+		t.Fatalf("writing JSON plan: %v", err)
+	}
+	var decoded deployPlan
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil {
+		t.Fatalf("decoding JSON plan: %v", err)
+	}
+	if got := decoded.Operations[0].Manifests[0].Blobs[0]; got.Action != blobActionMount || got.MountFrom != "team/base" {
+		t.Errorf("decoded blob = %+v, want a mount from team/base", got)
+	}
+
+	if err := validateDryRunFormat("yaml"); err == nil {
+		t.Errorf("validateDryRunFormat(yaml) = nil, want an error")
+	}
+}
@@ -0,0 +1,603 @@
+package deploy
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/deployvfs"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/load"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/push"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// The deploy report.
+//
+// `img deploy --report-json <path>` writes what the deploy did as JSON, for a
+// release pipeline that feeds the deployed digests into change management and
+// would otherwise have to scrape stderr: every operation with the references it
+// wrote, what happened to each of its blobs, the signatures attached to it, and
+// the best-effort failures that did not stop the deploy.
+//
+// The blob outcomes are observed rather than predicted. go-containerregistry
+// decides per blob whether to skip, mount or upload it, and the deduplicated push
+// uploads and mounts ahead of it, so the report watches the requests they send
+// through the push transport (see reportTransport) and attributes each blob
+// request to the repository and digest it names. The report is written when the
+// deploy returns, whether or not it succeeded: a failed deploy's report records
+// the error and whatever had been done by then.
+
+// Values of reportedBlob.Outcome, from the weakest to the strongest. A blob can
+// be seen several times in one repository -- uploaded to its home by the
+// deduplicated push, then found present by the manifest push -- and the report
+// keeps the strongest outcome.
+const (
+	// blobOutcomeSkipped: the repository already held the blob, or held the
+	// manifest, so the blob was never asked about.
+	blobOutcomeSkipped = "skipped"
+	// blobOutcomeMounted: the blob was cross-mounted from reportedBlob.MountFrom.
+	blobOutcomeMounted = "mounted"
+	// blobOutcomeUploaded: the blob's bytes were uploaded.
+	blobOutcomeUploaded = "uploaded"
+	// blobOutcomeReconstructed: the blob's bytes were uploaded after rebuilding the
+	// compressed blob from a compact stream.
+	blobOutcomeReconstructed = "reconstructed"
+)
+
+// deployReport is the document `img deploy --report-json` writes.
+type deployReport struct {
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+	PushStrategy string `json:"push_strategy,omitempty"`
+	// Warnings are the best-effort failures that belong to no single operation,
+	// such as a shared blob the deduplicated push left to the ordinary push.
+	Warnings   []string            `json:"warnings,omitempty"`
+	Operations []reportedOperation `json:"operations"`
+}
+
+// reportedOperation is one operation of the deploy manifest.
+type reportedOperation struct {
+	Index    int    `json:"index"`
+	Command  string `json:"command"`
+	RootKind string `json:"root_kind,omitempty"`
+	// Digest is the digest of the operation's root manifest or index. A
+	// registry_untag has neither.
+	Digest     string `json:"digest,omitempty"`
+	Registry   string `json:"registry,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	// References are the references the operation wrote: for a push the digest
+	// reference (registry/repository@digest) followed by every tag, for a
+	// registry_tag its tags, for a load the image names.
+	References []string `json:"references,omitempty"`
+	// Referrers are the digests of the referrers a copy carried along.
+	Referrers []string `json:"referrers,omitempty"`
+	// Deleted are the references a registry_untag deleted (or found already
+	// gone).
+	Deleted []string `json:"deleted,omitempty"`
+	Daemon  string   `json:"daemon,omitempty"`
+	// Blobs are the configs and layers of every manifest of a push, each listed
+	// once.
+	Blobs      []reportedBlob      `json:"blobs,omitempty"`
+	Signatures []reportedSignature `json:"signatures,omitempty"`
+	// Errors are the best-effort failures of this operation: a signature that
+	// could not be made, for example.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// reportedBlob is what happened to one blob in the operation's repository.
+type reportedBlob struct {
+	Digest string `json:"digest"`
+	// Role is "config" or "layer".
+	Role    string `json:"role"`
+	Size    int64  `json:"size"`
+	Outcome string `json:"outcome,omitempty"`
+	// MountFrom is the repository a mounted blob came from.
+	MountFrom string `json:"mount_from,omitempty"`
+	// Source is where an uploaded blob's bytes were read from (see
+	// deployvfs.VFS.Location).
+	Source string `json:"source,omitempty"`
+	// Bytes is how many bytes were sent to the registry: the blob's size for an
+	// upload, zero otherwise.
+	Bytes int64 `json:"bytes"`
+	// DurationMillis spans from the first request about the blob in this
+	// repository to the one that settled it.
+	DurationMillis int64 `json:"duration_ms"`
+}
+
+// reportedSignature is one signature or attestation artifact attached to a
+// subject.
+type reportedSignature struct {
+	Subject string `json:"subject"`
+	// PredicateType is set for an attestation, e.g. the SLSA provenance
+	// predicate type.
+	PredicateType string `json:"predicate_type,omitempty"`
+	Referrer      string `json:"referrer"`
+}
+
+// reportKey names a blob in one repository. registry is normalized (see
+// normalizeRegistry), as it is everywhere else a registry is a key.
+type reportKey struct {
+	registry   string
+	repository string
+	digest     string
+}
+
+// blobRecord is what the push transport saw of one blob in one repository.
+type blobRecord struct {
+	outcome   string
+	mountFrom string
+	started   time.Time
+	settled   time.Time
+}
+
+// deployRecorder collects what a deploy does while it does it. Every method is
+// safe for concurrent use and is a no-op on a nil recorder, so the deploy can
+// call it unconditionally and only pay for it with --report-json.
+type deployRecorder struct {
+	mu sync.Mutex
+	// blobs is what the push transport saw, per repository and digest.
+	blobs map[reportKey]*blobRecord
+	// uploads maps the location of an upload session to the repository it uploads
+	// into, for registries that hand out upload locations outside /v2/<name>/.
+	uploads    map[string]string
+	signatures map[int][]reportedSignature
+	errors     map[int][]string
+	deleted    map[int][]string
+	referrers  map[int][]string
+	warnings   []string
+	// now is time.Now, replaceable in tests.
+	now func() time.Time
+}
+
+// newDeployRecorder returns an empty recorder.
+func newDeployRecorder() *deployRecorder {
+	return &deployRecorder{
+		blobs:      make(map[reportKey]*blobRecord),
+		uploads:    make(map[string]string),
+		signatures: make(map[int][]reportedSignature),
+		errors:     make(map[int][]string),
+		deleted:    make(map[int][]string),
+		referrers:  make(map[int][]string),
+		now:        time.Now,
+	}
+}
+
+// signed records a signature artifact pushed for a subject of operation index.
+// predicateType is empty for a signature and names the predicate of an
+// attestation.
+func (r *deployRecorder) signed(index int, subject, predicateType, referrer string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.signatures[index] = append(r.signatures[index], reportedSignature{Subject: subject, PredicateType: predicateType, Referrer: referrer})
+}
+
+// operationError records a best-effort failure of operation index.
+func (r *deployRecorder) operationError(index int, message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors[index] = append(r.errors[index], message)
+}
+
+// copied records the referrers copy operation index carried along.
+func (r *deployRecorder) copied(index int, referrers []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.referrers[index] = append(r.referrers[index], referrers...)
+}
+
+// untagged records a reference registry_untag operation index deleted.
+func (r *deployRecorder) untagged(index int, ref string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deleted[index] = append(r.deleted[index], ref)
+}
+
+// warn records a best-effort failure that belongs to no single operation.
+func (r *deployRecorder) warn(message string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.warnings = append(r.warnings, message)
+}
+
+// wrap returns base with the blob requests it carries recorded. A nil recorder
+// returns base unchanged.
+func (r *deployRecorder) wrap(base http.RoundTripper) http.RoundTripper {
+	if r == nil {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &reportTransport{base: base, recorder: r}
+}
+
+// reportTransport feeds deployRecorder from the distribution API requests of a
+// push. It only reads requests and responses; it never changes them.
+type reportTransport struct {
+	base     http.RoundTripper
+	recorder *deployRecorder
+}
+
+func (t *reportTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := t.recorder.now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	t.recorder.observe(req, resp, started)
+	return resp, nil
+}
+
+// observe records one blob request and the registry's answer to it:
+//
+//   - HEAD /v2/<name>/blobs/<digest> answered 200: the blob is present, skipped.
+//   - POST /v2/<name>/blobs/uploads/?mount=<digest>&from=<source> answered 201:
+//     mounted. Answered 202, the registry refused the mount and started an upload.
+//   - PUT <upload location>?digest=<digest> answered 201: uploaded.
+//
+// Every other request only marks when the work on a blob started.
+func (r *deployRecorder) observe(req *http.Request, resp *http.Response, started time.Time) {
+	repository, rest, ok := splitDistributionPath(req.URL.Path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !ok {
+		repository, ok = r.uploads[req.URL.Path]
+		if !ok {
+			return
+		}
+		rest = "blobs/uploads/"
+	}
+	registry := normalizeRegistry(req.URL.Host)
+	query := req.URL.Query()
+
+	// Upload sessions continue at whatever location the registry returns.
+	if location := resp.Header.Get("Location"); location != "" && resp.StatusCode == http.StatusAccepted && strings.HasPrefix(rest, "blobs/uploads/") {
+		if parsed, err := req.URL.Parse(location); err == nil {
+			r.uploads[parsed.Path] = repository
+		}
+	}
+
+	switch {
+	case req.Method == http.MethodHead && strings.HasPrefix(rest, "blobs/") && !strings.HasPrefix(rest, "blobs/uploads/"):
+		record := r.recordLocked(reportKey{registry, repository, strings.TrimPrefix(rest, "blobs/")}, started)
+		if resp.StatusCode == http.StatusOK {
+			record.settle(blobOutcomeSkipped, "", r.now())
+		}
+	case req.Method == http.MethodPost && rest == "blobs/uploads/" && query.Get("mount") != "":
+		record := r.recordLocked(reportKey{registry, repository, query.Get("mount")}, started)
+		if resp.StatusCode == http.StatusCreated {
+			record.settle(blobOutcomeMounted, query.Get("from"), r.now())
+		}
+	case req.Method == http.MethodPut && strings.HasPrefix(rest, "blobs/uploads/") && query.Get("digest") != "":
+		record := r.recordLocked(reportKey{registry, repository, query.Get("digest")}, started)
+		if resp.StatusCode == http.StatusCreated {
+			record.settle(blobOutcomeUploaded, "", r.now())
+		}
+	}
+}
+
+// recordLocked returns the record of a blob, creating it at started.
+func (r *deployRecorder) recordLocked(key reportKey, started time.Time) *blobRecord {
+	record, found := r.blobs[key]
+	if !found {
+		record = &blobRecord{started: started}
+		r.blobs[key] = record
+	}
+	return record
+}
+
+// settle records an outcome unless a stronger one was recorded already.
+func (b *blobRecord) settle(outcome, mountFrom string, at time.Time) {
+	if outcomeStrength(outcome) < outcomeStrength(b.outcome) {
+		return
+	}
+	b.outcome = outcome
+	b.mountFrom = mountFrom
+	b.settled = at
+}
+
+func outcomeStrength(outcome string) int {
+	switch outcome {
+	case blobOutcomeSkipped:
+		return 1
+	case blobOutcomeMounted:
+		return 2
+	case blobOutcomeUploaded:
+		return 3
+	}
+	return 0
+}
+
+// splitDistributionPath splits /v2/<name>/<rest> into the repository name and
+// what follows it, "blobs/..." or "manifests/...". <name> may itself contain
+// slashes, so the split is at the last element that can start <rest>.
+func splitDistributionPath(path string) (repository, rest string, ok bool) {
+	path, found := strings.CutPrefix(path, "/v2/")
+	if !found {
+		return "", "", false
+	}
+	i := strings.LastIndex(path, "/blobs/uploads/")
+	if i < 0 {
+		i = strings.LastIndex(path, "/blobs/")
+	}
+	if i < 0 {
+		i = strings.LastIndex(path, "/manifests/")
+	}
+	if i <= 0 {
+		return "", "", false
+	}
+	repository, err := url.PathUnescape(path[:i])
+	if err != nil {
+		return "", "", false
+	}
+	return repository, path[i+1:], true
+}
+
+// reportInputs is what the report describes: the operations of the deploy, the
+// VFS their blobs were served from and the options the deploy ran with.
+type reportInputs struct {
+	vfs      *deployvfs.VFS
+	pushOps  []api.IndexedPushDeployOperation
+	loadOps  []api.IndexedLoadDeployOperation
+	tagOps   []api.IndexedRegistryTagDeployOperation
+	copyOps  []api.IndexedCopyDeployOperation
+	untagOps []api.IndexedRegistryUntagDeployOperation
+	settings api.DeploySettings
+	opts     DeployOptions
+}
+
+// build assembles the report from the operations and what was recorded while
+// they ran. deployErr is the error the deploy returned, if any.
+func (r *deployRecorder) build(in reportInputs, deployErr error) (*deployReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &deployReport{
+		Success:      deployErr == nil,
+		PushStrategy: in.settings.PushStrategy,
+		Warnings:     append([]string(nil), r.warnings...),
+	}
+	if deployErr != nil {
+		report.Error = deployErr.Error()
+	}
+	registryPush := in.settings.PushStrategy != "bes"
+
+	uploader := newReferenceUploader(in.vfs, in.opts)
+	for _, op := range in.pushOps {
+		reported := reportedOperation{
+			Index:      op.I,
+			Command:    op.Command,
+			RootKind:   op.RootKind,
+			Digest:     op.Root.Digest,
+			Registry:   overrideOr(op.Registry, in.opts.OverrideRegistry),
+			Repository: overrideOr(op.Repository, in.opts.OverrideRepository),
+			Signatures: r.signatures[op.I],
+			Errors:     r.errors[op.I],
+		}
+		refs, err := uploader.References(op)
+		if err != nil {
+			return nil, fmt.Errorf("push operation %d: %w", op.I, err)
+		}
+		for _, ref := range refs {
+			reported.References = append(reported.References, ref.String())
+		}
+		if registryPush {
+			reported.Blobs = r.operationBlobsLocked(in.vfs, reported, op.Manifests, deployErr == nil)
+		}
+		report.Operations = append(report.Operations, reported)
+	}
+	for _, op := range in.tagOps {
+		reported := reportedOperation{
+			Index:      op.I,
+			Command:    op.Command,
+			RootKind:   op.RootKind,
+			Digest:     op.Root.Digest,
+			Registry:   overrideOr(op.Registry, in.opts.OverrideRegistry),
+			Repository: overrideOr(op.Repository, in.opts.OverrideRepository),
+			Errors:     r.errors[op.I],
+		}
+		refs, err := registryTagReferences(op, in.opts.OverrideRegistry, in.opts.OverrideRepository)
+		if err != nil {
+			return nil, err
+		}
+		reported.References = refs
+		report.Operations = append(report.Operations, reported)
+	}
+	for _, op := range in.copyOps {
+		refs, err := copyReferences(op, in.opts)
+		if err != nil {
+			return nil, err
+		}
+		source, _ := op.SourceDigest(registryopts.NameOptions()...)
+		report.Operations = append(report.Operations, reportedOperation{
+			Index:      op.I,
+			Command:    op.Command,
+			Digest:     source.DigestStr(),
+			Registry:   overrideOr(op.Registry, in.opts.OverrideRegistry),
+			Repository: overrideOr(op.Repository, in.opts.OverrideRepository),
+			References: refs,
+			Referrers:  r.referrers[op.I],
+			Errors:     r.errors[op.I],
+		})
+	}
+	for _, op := range in.untagOps {
+		deleted := append([]string(nil), r.deleted[op.I]...)
+		sort.Strings(deleted)
+		report.Operations = append(report.Operations, reportedOperation{
+			Index:      op.I,
+			Command:    op.Command,
+			Registry:   overrideOr(op.Registry, in.opts.OverrideRegistry),
+			Repository: overrideOr(op.Repository, in.opts.OverrideRepository),
+			Deleted:    deleted,
+			Errors:     r.errors[op.I],
+		})
+	}
+	if len(in.loadOps) > 0 {
+		loader := newReferenceLoader(in.vfs, in.opts)
+		for _, op := range in.loadOps {
+			tags, err := loader.Tags(op)
+			if err != nil {
+				return nil, fmt.Errorf("load operation %d: %w", op.I, err)
+			}
+			daemon := op.Daemon
+			if daemon == "" {
+				daemon = "docker"
+			}
+			report.Operations = append(report.Operations, reportedOperation{
+				Index:      op.I,
+				Command:    op.Command,
+				RootKind:   op.RootKind,
+				Digest:     op.Root.Digest,
+				Registry:   op.Registry,
+				Repository: op.Repository,
+				References: tags,
+				Daemon:     daemon,
+				Errors:     r.errors[op.I],
+			})
+		}
+	}
+	slices.SortStableFunc(report.Operations, func(a, b reportedOperation) int { return cmp.Compare(a.Index, b.Index) })
+	return report, nil
+}
+
+// operationBlobsLocked lists the config and layers of every manifest of a push,
+// each once, with what the push transport saw of it in the operation's
+// repository. A blob the transport never saw was skipped when the deploy
+// succeeded: the registry already held the manifest, so nothing asked about it.
+func (r *deployRecorder) operationBlobsLocked(vfs *deployvfs.VFS, op reportedOperation, manifests []api.ManifestDeployInfo, succeeded bool) []reportedBlob {
+	var blobs []reportedBlob
+	seen := make(map[string]bool)
+	add := func(descriptor api.Descriptor, role string) {
+		if seen[descriptor.Digest] {
+			return
+		}
+		seen[descriptor.Digest] = true
+		blob := reportedBlob{Digest: descriptor.Digest, Role: role, Size: descriptor.Size}
+		record, found := r.blobs[reportKey{normalizeRegistry(op.Registry), op.Repository, descriptor.Digest}]
+		switch {
+		case found && record.outcome != "":
+			blob.Outcome = record.outcome
+			blob.MountFrom = record.mountFrom
+			blob.DurationMillis = record.settled.Sub(record.started).Milliseconds()
+		case succeeded:
+			blob.Outcome = blobOutcomeSkipped
+		}
+		if blob.Outcome == blobOutcomeUploaded {
+			blob.Bytes = blob.Size
+			if hash, err := registryv1.NewHash(blob.Digest); err == nil {
+				if location, found := vfs.Location(hash); found && location == "compact_stream" {
+					blob.Outcome = blobOutcomeReconstructed
+				}
+				blob.Source = blobSource(vfs, hash)
+			}
+		}
+		blobs = append(blobs, blob)
+	}
+	for _, manifest := range manifests {
+		add(manifest.Config, "config")
+		for _, layer := range manifest.LayerBlobs {
+			add(layer.Descriptor, "layer")
+		}
+	}
+	return blobs
+}
+
+// newReferenceUploader returns an uploader configured with the deploy's
+// overrides and extra tags, for resolving the references a push writes.
+func newReferenceUploader(vfs *deployvfs.VFS, opts DeployOptions) interface {
+	References(api.IndexedPushDeployOperation) ([]name.Reference, error)
+} {
+	builder := push.NewBuilder(vfs).
+		WithOverrideRegistry(opts.OverrideRegistry).
+		WithOverrideRepository(opts.OverrideRepository)
+	if len(opts.AdditionalTags) > 0 {
+		builder = builder.WithExtraTags(opts.AdditionalTags)
+	}
+	return builder.Build()
+}
+
+// newReferenceLoader returns a loader configured with the deploy's overrides,
+// platforms and extra tags, for resolving the image names a load writes.
+func newReferenceLoader(vfs *deployvfs.VFS, opts DeployOptions) interface {
+	Tags(api.IndexedLoadDeployOperation) ([]string, error)
+} {
+	builder := load.NewBuilder(vfs).
+		WithOverrideRegistry(opts.OverrideRegistry).
+		WithOverrideRepository(opts.OverrideRepository)
+	if len(opts.PlatformList) > 0 {
+		builder = builder.WithPlatforms(opts.PlatformList)
+	}
+	if len(opts.AdditionalTags) > 0 {
+		builder = builder.WithExtraTags(opts.AdditionalTags)
+	}
+	return builder.Build()
+}
+
+// registryTagReferences returns the references a registry_tag operation writes,
+// with the --registry and --repository overrides applied.
+func registryTagReferences(op api.IndexedRegistryTagDeployOperation, overrideRegistry, overrideRepository string) ([]string, error) {
+	baseRef := overrideOr(op.Registry, overrideRegistry) + "/" + overrideOr(op.Repository, overrideRepository)
+	var refs []string
+	for _, tag := range op.Tags {
+		ref, err := name.NewTag(baseRef+":"+tag, registryopts.NameOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("creating registry_tag ref %q: %w", tag, err)
+		}
+		refs = append(refs, ref.String())
+	}
+	return refs, nil
+}
+
+// writeDeployReport writes the report to path, atomically, so a pipeline polling
+// for the file never reads half of it.
+func writeDeployReport(path string, report *deployReport) error {
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling deploy report: %w", err)
+	}
+	raw = append(raw, '\n')
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("writing deploy report: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing deploy report: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing deploy report: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing deploy report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/deployvfs"
+)
+
+// buildReport assembles the report of a deploy of dm from what recorder saw.
+func buildReport(t *testing.T, recorder *deployRecorder, layoutDirs []string, dm api.DeployManifest, deployErr error) *deployReport {
+	t.Helper()
+	vfsBuilder := deployvfs.NewBuilder(dm)
+	for _, layoutDir := range layoutDirs {
+		vfsBuilder = vfsBuilder.WithOCILayout(layoutDir)
+	}
+	vfs, err := vfsBuilder.Build()
+	if err != nil {
+		t.Fatalf("building VFS: %v", err)
+	}
+	pushOps, err := dm.PushOperations()
+	if err != nil {
+		t.Fatalf("reading push operations: %v", err)
+	}
+	report, err := recorder.build(reportInputs{vfs: vfs, pushOps: pushOps, settings: dm.Settings}, deployErr)
+	if err != nil {
+		t.Fatalf("building report: %v", err)
+	}
+	return report
+}
+
+// reportedBlobs returns, per repository, the reported outcome of each blob.
+func reportedBlobs(report *deployReport) map[string]map[string]reportedBlob {
+	blobs := make(map[string]map[string]reportedBlob)
+	for _, op := range report.Operations {
+		blobs[op.Repository] = make(map[string]reportedBlob)
+		for _, blob := range op.Blobs {
+			blobs[op.Repository][blob.Digest] = blob
+		}
+	}
+	return blobs
+}
+
+// TestReportRecordsBlobOutcomes runs the deduplicated push through the report
+// transport and holds the report to what the registry saw: each shared layer
+// uploaded to its home and mounted into the other repositories, every other blob
+// uploaded where it is needed -- and, on a second run, everything skipped.
+func TestReportRecordsBlobOutcomes(t *testing.T) {
+	reg := newNaiveRegistry()
+	layoutDirs, dm, images := buildSharedLayerLayouts(t, "reg.example.com", 3, 2)
+	home := images.repositories[0]
+
+	recorder := newDeployRecorder()
+	if err := runDedupDeployVia(t, recorder.wrap(reg.transport()), layoutDirs, dm); err != nil {
+		t.Fatalf("deduplicated push: %v", err)
+	}
+	report := buildReport(t, recorder, layoutDirs, dm, nil)
+	if !report.Success || report.Error != "" {
+		t.Errorf("report of a successful deploy: success %v, error %q", report.Success, report.Error)
+	}
+
+	blobs := reportedBlobs(report)
+	for _, digest := range images.shared {
+		if got := blobs[home][digest]; got.Outcome != blobOutcomeUploaded || got.Bytes != got.Size || got.Source != "disk" {
+			t.Errorf("shared layer %s in home %s: %+v, want uploaded from disk", digest, home, got)
+		}
+		for _, repository := range images.repositories[1:] {
+			if got := blobs[repository][digest]; got.Outcome != blobOutcomeMounted || got.MountFrom != home || got.Bytes != 0 {
+				t.Errorf("shared layer %s in %s: %+v, want mounted from %s", digest, repository, got, home)
+			}
+		}
+	}
+	for i, repository := range images.repositories {
+		for _, digest := range []string{images.unique[i], images.configs[i]} {
+			if got := blobs[repository][digest]; got.Outcome != blobOutcomeUploaded {
+				t.Errorf("blob %s in %s: outcome %q, want %q", digest, repository, got.Outcome, blobOutcomeUploaded)
+			}
+		}
+	}
+	for i, op := range report.Operations {
+		want := "reg.example.com/" + images.repositories[i] + "@" + images.manifests[i]
+		if len(op.References) == 0 || op.References[0] != want {
+			t.Errorf("operation %d references %v, want %s first", i, op.References, want)
+		}
+	}
+
+	again := newDeployRecorder()
+	if err := runDedupDeployVia(t, again.wrap(reg.transport()), layoutDirs, dm); err != nil {
+		t.Fatalf("second deduplicated push: %v", err)
+	}
+	for repository, digests := range reportedBlobs(buildReport(t, again, layoutDirs, dm, nil)) {
+		for digest, got := range digests {
+			if got.Outcome != blobOutcomeSkipped {
+				t.Errorf("second run: blob %s in %s: outcome %q, want %q", digest, repository, got.Outcome, blobOutcomeSkipped)
+			}
+		}
+	}
+}
+
+// TestReportRecordsFailuresAndSignatures checks the parts of the report the
+// transport does not see, and that a failed deploy leaves the outcomes it never
+// observed empty rather than claiming the blobs were skipped.
+func TestReportRecordsFailuresAndSignatures(t *testing.T) {
+	layoutDirs, dm, images := buildSharedLayerLayouts(t, "reg.example.com", 2, 1)
+	recorder := newDeployRecorder()
+	recorder.signed(0, images.manifests[0], "", "sha256:5166")
+	recorder.operationError(1, "signing skipped: plugin not found")
+	recorder.warn("leaving blob sha256:abcd to the ordinary push: mount refused")
+
+	report := buildReport(t, recorder, layoutDirs, dm, errors.New("deploying images: registry unavailable"))
+	if report.Success || report.Error != "deploying images: registry unavailable" {
+		t.Errorf("report of a failed deploy: success %v, error %q", report.Success, report.Error)
+	}
+	if len(report.Warnings) != 1 {
+		t.Errorf("warnings = %v, want one", report.Warnings)
+	}
+	if got := report.Operations[0].Signatures; len(got) != 1 || got[0].Referrer != "sha256:5166" {
+		t.Errorf("signatures of operation 0 = %+v", got)
+	}
+	if got := report.Operations[1].Errors; len(got) != 1 {
+		t.Errorf("errors of operation 1 = %v, want one", got)
+	}
+	for _, op := range report.Operations {
+		for _, blob := range op.Blobs {
+			if blob.Outcome != "" {
+				t.Errorf("blob %s in %s: outcome %q, want none: nothing was observed", blob.Digest, op.Repository, blob.Outcome)
+			}
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := writeDeployReport(path, report); err != nil {
+		t.Fatalf("writing report: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	var decoded deployReport
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("decoding report: %v", err)
+	}
+	if len(decoded.Operations) != 2 || decoded.Operations[1].Errors[0] != "signing skipped: plugin not found" {
+		t.Errorf("decoded report = %+v", decoded)
+	}
+}
+
+func TestSplitDistributionPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, repository, rest string
+		ok                     bool
+	}{
+		{"/v2/team/app/blobs/sha256:abcd", "team/app", "blobs/sha256:abcd", true},
+		{"/v2/team/app/blobs/uploads/", "team/app", "blobs/uploads/", true},
+		{"/v2/team/app/blobs/uploads/1234", "team/app", "blobs/uploads/1234", true},
+		{"/v2/blobs/blobs/uploads/1234", "blobs", "blobs/uploads/1234", true},
+		{"/v2/team/app/manifests/latest", "team/app", "manifests/latest", true},
+		{"/v2/", "", "", false},
+		{"/token", "", "", false},
+	} {
+		repository, rest, ok := splitDistributionPath(tc.path)
+		if repository != tc.repository || rest != tc.rest || ok != tc.ok {
+			t.Errorf("splitDistributionPath(%q) = %q, %q, %v; want %q, %q, %v", tc.path, repository, rest, ok, tc.repository, tc.rest, tc.ok)
+		}
+	}
+}
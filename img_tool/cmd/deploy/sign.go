@@ -15,6 +15,7 @@ import (
 
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/ocilayout"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/provenance"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/signer"
 )
@@ -27,12 +28,19 @@ type signOptions struct {
 	targetOverride     []string
 	overrideRegistry   string
 	overrideRepository string
+	// provenanceBuilderID overrides the builder ID recorded in the deploy
+	// manifest for provenance attestations.
+	provenanceBuilderID string
 
 	// pushTransport and jobs configure the pusher created for registry-path
 	// signing (applySignOperations). They are unused by the --sink path, which
 	// captures signatures locally instead of pushing.
 	pushTransport http.RoundTripper
 	jobs          int
+
+	// report records the signatures pushed and the best-effort failures for
+	// --report-json. Nil records nothing.
+	report *deployRecorder
 }
 
 // signDecision is the outcome of deciding whether and how a push operation is
@@ -42,13 +50,17 @@ type signDecision struct {
 	bestEffort bool
 	setting    *api.Descriptor // explicit op setting, or nil to use the default
 	targets    map[string]bool // effective subject targets (roots/child_manifests)
+	// provenance, when set, additionally attests the SLSA provenance of the
+	// root with the same sign_setting.
+	provenance *api.ProvenanceConfig
 }
 
 // signEmitter attaches the signature artifacts produced for one subject of a
 // push operation to their destination (a registry repository or a local sink).
 // It is the only part of the signing flow that differs between the registry
-// push and --sink paths.
-type signEmitter func(ctx context.Context, op api.IndexedPushDeployOperation, subject api.Descriptor, imgs []registryv1.Image) error
+// push and --sink paths. predicateType is empty for a signature and names the
+// predicate of an attestation.
+type signEmitter func(ctx context.Context, op api.IndexedPushDeployOperation, subject api.Descriptor, predicateType string, imgs []registryv1.Image) error
 
 // applySignOperations signs the eligible push operations after they have been
 // pushed to the registry. Referrers are attached to each signed subject.
@@ -86,7 +98,7 @@ func applySignOperations(ctx context.Context, pushOps []api.IndexedPushDeployOpe
 		reg, repo := opRegistry(op, opts), opRepository(op, opts)
 		return fmt.Errorf("cannot sign %s/%s@%s: deploy-time signing is unsupported for push strategy %q", reg, repo, op.Root.Digest, settings.PushStrategy)
 	}
-	emit := func(ctx context.Context, op api.IndexedPushDeployOperation, subject api.Descriptor, imgs []registryv1.Image) error {
+	emit := func(ctx context.Context, op api.IndexedPushDeployOperation, subject api.Descriptor, predicateType string, imgs []registryv1.Image) error {
 		reg, repo := opRegistry(op, opts), opRepository(op, opts)
 		repository, err := name.NewRepository(reg+"/"+repo, registryopts.NameOptions()...)
 		if err != nil {
@@ -97,7 +109,8 @@ func applySignOperations(ctx context.Context, pushOps []api.IndexedPushDeployOpe
 			return err
 		}
 		for _, p := range pushed {
-			fmt.Fprintf(os.Stderr, "    signed %s/%s@%s -> %s\n", reg, repo, subject.Digest, p)
+			fmt.Fprintf(os.Stderr, "    %s %s/%s@%s -> %s\n", signVerb(predicateType), reg, repo, subject.Digest, p)
+			opts.report.signed(op.I, subject.Digest, predicateType, p)
 		}
 		return nil
 	}
@@ -119,7 +132,7 @@ func signIntoSink(ctx context.Context, s sink, pushOps []api.IndexedPushDeployOp
 	if !anyOpSigns(pushOps, store, opts) {
 		return nil
 	}
-	emit := func(ctx context.Context, op api.IndexedPushDeployOperation, subject api.Descriptor, imgs []registryv1.Image) error {
+	emit := func(ctx context.Context, op api.IndexedPushDeployOperation, subject api.Descriptor, predicateType string, imgs []registryv1.Image) error {
 		reg, repo := opRegistry(op, opts), opRepository(op, opts)
 		for _, img := range imgs {
 			si, err := signatureSinkImage(img, reg, repo)
@@ -133,7 +146,7 @@ func signIntoSink(ctx context.Context, s sink, pushOps []api.IndexedPushDeployOp
 			if err != nil {
 				return fmt.Errorf("computing signature digest: %w", err)
 			}
-			fmt.Fprintf(os.Stderr, "    signed %s/%s@%s -> %s (sink)\n", reg, repo, subject.Digest, d)
+			fmt.Fprintf(os.Stderr, "    %s %s/%s@%s -> %s (sink)\n", signVerb(predicateType), reg, repo, subject.Digest, d)
 		}
 		return nil
 	}
@@ -189,14 +202,16 @@ func forEachSignature(ctx context.Context, pushOps []api.IndexedPushDeployOperat
 			if err := precheck(op); err != nil {
 				if decision.bestEffort {
 					fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+					opts.report.operationError(op.I, err.Error())
 					continue
 				}
 				return err
 			}
 		}
-		if err := signOneEmit(ctx, op, decision, store, settings.DefaultSignSetting, rfHandle, emit); err != nil {
+		if err := signOneEmit(ctx, op, decision, store, settings.DefaultSignSetting, rfHandle, opts, emit); err != nil {
 			if decision.bestEffort {
 				fmt.Fprintf(os.Stderr, "warning: signing %s/%s@%s skipped: %v\n", reg, repo, op.Root.Digest, err)
+				opts.report.operationError(op.I, fmt.Sprintf("signing %s/%s@%s skipped: %v", reg, repo, op.Root.Digest, err))
 				continue
 			}
 			return fmt.Errorf("signing %s/%s@%s: %w", reg, repo, op.Root.Digest, err)
@@ -206,8 +221,9 @@ func forEachSignature(ctx context.Context, pushOps []api.IndexedPushDeployOperat
 }
 
 // signOneEmit signs every selected subject of op and hands the resulting
-// artifacts to emit.
-func signOneEmit(ctx context.Context, op api.IndexedPushDeployOperation, decision signDecision, store *signer.SettingStore, manifestDefault *api.Descriptor, rf *runfiles.Runfiles, emit signEmitter) error {
+// artifacts to emit. When the decision asks for provenance, the root's SLSA
+// provenance statement is then signed by the same plugin and emitted as well.
+func signOneEmit(ctx context.Context, op api.IndexedPushDeployOperation, decision signDecision, store *signer.SettingStore, manifestDefault *api.Descriptor, rf *runfiles.Runfiles, opts signOptions, emit signEmitter) error {
 	cfg, err := store.Resolve(decision.setting, manifestDefault)
 	if err != nil {
 		return err
@@ -226,11 +242,46 @@ func signOneEmit(ctx context.Context, op api.IndexedPushDeployOperation, decisio
 		if err != nil {
 			return fmt.Errorf("signing subject %s: %w", subjectDesc.Digest, err)
 		}
-		if err := emit(ctx, op, subjectDesc, imgs); err != nil {
+		if err := emit(ctx, op, subjectDesc, "", imgs); err != nil {
 			return err
 		}
 	}
-	return nil
+
+	if decision.provenance == nil {
+		return nil
+	}
+	statement, err := provenance.NewStatement(provenance.Input{
+		Subject:    op.Root,
+		Registry:   opRegistry(op, opts),
+		Repository: opRepository(op, opts),
+		Config:     *decision.provenance,
+		BuilderID:  opts.provenanceBuilderID,
+		Base:       op.PullInfo,
+	})
+	if err != nil {
+		return err
+	}
+	payload, err := statement.Marshal()
+	if err != nil {
+		return fmt.Errorf("encoding provenance statement: %w", err)
+	}
+	vDesc, err := signer.SubjectDescriptor(op.Root)
+	if err != nil {
+		return err
+	}
+	imgs, err := sub.SignDSSEArtifacts(ctx, vDesc, provenance.PayloadType, payload)
+	if err != nil {
+		return fmt.Errorf("attesting provenance of %s: %w", op.Root.Digest, err)
+	}
+	return emit(ctx, op, op.Root, provenance.PredicateType, imgs)
+}
+
+// signVerb describes an emitted artifact in progress output.
+func signVerb(predicateType string) string {
+	if predicateType == "" {
+		return "signed"
+	}
+	return "attested " + predicateType + " for"
 }
 
 // signatureSinkImage converts a signature artifact image (produced by a signer
@@ -298,6 +349,8 @@ func signatureSinkImage(img registryv1.Image, registry, repository string) (sink
 // targets. Precedence: an operation with an explicit Sign config is always
 // signed; --sign_force signs any op using the default; and a --sign_targets
 // override that includes "referrers" signs referrer ops using the default.
+// Provenance is only attested for an operation with an explicit Sign config,
+// since that is where the deploy manifest records the build invocation.
 func decideSigning(op api.IndexedPushDeployOperation, store *signer.SettingStore, force bool, override map[string]bool) signDecision {
 	switch {
 	case op.Sign != nil:
@@ -306,6 +359,7 @@ func decideSigning(op api.IndexedPushDeployOperation, store *signer.SettingStore
 			bestEffort: op.Sign.BestEffort,
 			setting:    op.Sign.Setting,
 			targets:    chooseTargets(op.Sign.Targets, override),
+			provenance: op.Provenance,
 		}
 	case force && store.HasDefault():
 		return signDecision{sign: true, targets: chooseTargets(nil, override)}
@@ -0,0 +1,50 @@
+package deploy
+
+import (
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/signer"
+)
+
+// TestDecideSigningProvenance checks provenance is attested exactly for the
+// operations that request signing at build time and record a build invocation.
+func TestDecideSigningProvenance(t *testing.T) {
+	config := &api.ProvenanceConfig{Target: "//app:push"}
+	for _, tc := range []struct {
+		name           string
+		op             api.PushDeployOperation
+		wantSign       bool
+		wantProvenance bool
+	}{
+		{
+			name:           "signed with provenance",
+			op:             api.PushDeployOperation{Sign: &api.SignConfig{BestEffort: true}, Provenance: config},
+			wantSign:       true,
+			wantProvenance: true,
+		},
+		{
+			name:     "signed without provenance",
+			op:       api.PushDeployOperation{Sign: &api.SignConfig{}},
+			wantSign: true,
+		},
+		{
+			name: "provenance without signing",
+			op:   api.PushDeployOperation{Provenance: config},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store, err := signer.Discover(nil, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			decision := decideSigning(api.IndexedPushDeployOperation{PushDeployOperation: tc.op}, store, false, nil)
+			if decision.sign != tc.wantSign {
+				t.Errorf("sign = %v, want %v", decision.sign, tc.wantSign)
+			}
+			if (decision.provenance != nil) != tc.wantProvenance {
+				t.Errorf("provenance = %+v, want provenance %v", decision.provenance, tc.wantProvenance)
+			}
+		})
+	}
+}
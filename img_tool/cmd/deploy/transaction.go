@@ -0,0 +1,345 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/deployvfs"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// The transactional deploy.
+//
+// A multi_deploy that promotes one release to several registries moves a tag in
+// each of them. Pushed the ordinary way, every operation writes its blobs, its
+// manifests and its tags as it goes, so a failure in the third registry leaves
+// the tags of the first two already moved: half a promotion.
+//
+// `img deploy --transactional` splits the deploy in three phases, so that
+// promotions are all-or-nothing at the tag level:
+//
+//  1. Record. Before anything is written, every tag the deploy will write is
+//     resolved in its registry, and the manifest it points at (if any) is kept.
+//  2. Stage. Every push operation is pushed by digest only: blobs, child
+//     manifests and the root manifest reach every destination, but no tag moves.
+//     Signatures are attached here too, since referrers hang off digests. A
+//     failure in this phase leaves every tag where it was.
+//  3. Commit. Only now are the tags written -- those of the push operations, the
+//     --tag extras and those of the registry_tag operations. If any of them
+//     fails, every tag this phase attempted is restored to the manifest recorded
+//     in phase 1, or deleted if it did not exist before.
+//
+// Restoring is best effort by nature: a registry that does not allow deleting
+// tags keeps a tag the deploy created, and a tag another client moved in the
+// meantime is moved back. Both are reported: the first as a rollback error, the
+// second as a warning naming the manifest the other client wrote, found by
+// resolving every tag before it is restored. Loads into a local daemon are not
+// part of the transaction.
+
+// tagWrite is one tag the commit phase writes.
+type tagWrite struct {
+	ref name.Tag
+	// index is the operation the tag belongs to.
+	index int
+	// manifest is the root manifest the tag points at once committed. Pushed as a
+	// rawManifest, it is written without walking its blobs or children, which the
+	// stage phase already pushed.
+	manifest rawManifest
+}
+
+// tagState is what a tag pointed at before the deploy.
+type tagState struct {
+	// present is false for a tag that did not exist.
+	present  bool
+	manifest rawManifest
+}
+
+// withoutTags returns copies of the push operations that write their digest
+// reference only: the stage phase.
+func withoutTags(ops []api.IndexedPushDeployOperation) []api.IndexedPushDeployOperation {
+	staged := make([]api.IndexedPushDeployOperation, len(ops))
+	for i, op := range ops {
+		op.Tags = nil
+		staged[i] = op
+	}
+	return staged
+}
+
+// validateTransactional rejects the settings a transactional deploy cannot honor.
+func validateTransactional(settings api.DeploySettings) error {
+	if settings.PushStrategy == "bes" {
+		return errors.New("--transactional is not supported with the bes push strategy: the build event stream syncer performs the push")
+	}
+	return nil
+}
+
+// planTagWrites lists every tag the deploy writes -- the tags of the push
+// operations plus the --tag extras, and the tags of the registry_tag operations
+// -- with the root manifest each points at.
+func planTagWrites(pushOps []api.IndexedPushDeployOperation, tagOps []api.IndexedRegistryTagDeployOperation, vfsForOperation func(string, api.BaseCommandOperation) *deployvfs.VFS, opts DeployOptions) ([]tagWrite, error) {
+	var writes []tagWrite
+	add := func(index int, view *deployvfs.VFS, root string, refs []string) error {
+		if len(refs) == 0 {
+			return nil
+		}
+		manifest, err := rootManifest(view, root)
+		if err != nil {
+			return fmt.Errorf("operation %d: %w", index, err)
+		}
+		for _, ref := range refs {
+			tag, err := name.NewTag(ref, registryopts.NameOptions()...)
+			if err != nil {
+				return fmt.Errorf("operation %d: parsing tag %q: %w", index, ref, err)
+			}
+			writes = append(writes, tagWrite{ref: tag, index: index, manifest: manifest})
+		}
+		return nil
+	}
+
+	uploader := newReferenceUploader(nil, opts)
+	for _, op := range pushOps {
+		refs, err := uploader.References(op)
+		if err != nil {
+			return nil, fmt.Errorf("push operation %d: %w", op.I, err)
+		}
+		var tags []string
+		for _, ref := range refs {
+			if _, isTag := ref.(name.Tag); isTag {
+				tags = append(tags, ref.String())
+			}
+		}
+		if err := add(op.I, vfsForOperation(op.Registry, op.BaseCommandOperation), op.Root.Digest, tags); err != nil {
+			return nil, err
+		}
+	}
+	for _, op := range tagOps {
+		refs, err := registryTagReferences(op, opts.OverrideRegistry, opts.OverrideRepository)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(op.I, vfsForOperation(op.Registry, op.BaseCommandOperation), op.Root.Digest, refs); err != nil {
+			return nil, err
+		}
+	}
+	return writes, nil
+}
+
+// rootManifest reads the root manifest of an operation from the VFS.
+func rootManifest(vfs *deployvfs.VFS, digest string) (rawManifest, error) {
+	hash, err := registryv1.NewHash(digest)
+	if err != nil {
+		return rawManifest{}, fmt.Errorf("parsing root digest: %w", err)
+	}
+	taggable, err := vfs.Taggable(hash)
+	if err != nil {
+		return rawManifest{}, fmt.Errorf("locating manifest %s: %w", digest, err)
+	}
+	raw, err := taggable.RawManifest()
+	if err != nil {
+		return rawManifest{}, fmt.Errorf("reading manifest %s: %w", digest, err)
+	}
+	manifest := rawManifest{digest: hash, raw: raw, mediaType: types.OCIManifestSchema1}
+	if withMediaType, ok := taggable.(interface {
+		MediaType() (types.MediaType, error)
+	}); ok {
+		if mediaType, err := withMediaType.MediaType(); err == nil {
+			manifest.mediaType = mediaType
+		}
+	}
+	return manifest, nil
+}
+
+// recordTagStates resolves every tag the deploy writes to the manifest it points
+// at now, with --jobs requests in flight. A tag written by several operations is
+// resolved once. Any answer other than "not found" aborts the deploy before it
+// writes anything: a tag that cannot be read cannot be restored.
+func recordTagStates(ctx context.Context, writes []tagWrite, jobs int, remoteOptions []remote.Option) (map[string]tagState, error) {
+	puller, err := remote.NewPuller(remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("creating puller: %w", err)
+	}
+	states := make(map[string]tagState)
+	var mu sync.Mutex
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(max(jobs, 1))
+	seen := make(map[string]bool)
+	for _, write := range writes {
+		key := write.ref.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		g.Go(func() error {
+			descriptor, err := puller.Get(groupCtx, write.ref)
+			state := tagState{}
+			switch {
+			case err == nil:
+				state = tagState{present: true, manifest: rawManifest{
+					digest:    descriptor.Digest,
+					raw:       descriptor.Manifest,
+					mediaType: descriptor.MediaType,
+				}}
+			case isNotFound(err):
+			default:
+				return fmt.Errorf("recording the current value of %s: %w", key, err)
+			}
+			mu.Lock()
+			states[key] = state
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// isNotFound reports whether a registry error means the manifest does not exist.
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	if terr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, diagnostic := range terr.Errors {
+		if diagnostic.Code == transport.ManifestUnknownErrorCode || diagnostic.Code == transport.NameUnknownErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// commitTags writes every tag, with --jobs requests in flight, and returns the
+// tags written. If any write fails, every tag it attempted is restored to its
+// recorded state (see rollbackTags) and the error says what the rollback did.
+func commitTags(ctx context.Context, writes []tagWrite, states map[string]tagState, jobs int, remoteOptions []remote.Option) ([]string, error) {
+	pusher, err := remote.NewPusher(append(remoteOptions, remote.WithJobs(max(jobs, 1)))...)
+	if err != nil {
+		return nil, fmt.Errorf("creating pusher: %w", err)
+	}
+
+	puller, err := remote.NewPuller(remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("creating puller: %w", err)
+	}
+
+	var mu sync.Mutex
+	// attempted maps every tag the commit tried to write to the manifest it wrote.
+	attempted := make(map[string]registryv1.Hash)
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(max(jobs, 1))
+	for _, write := range writes {
+		g.Go(func() error {
+			if groupCtx.Err() != nil {
+				return nil
+			}
+			mu.Lock()
+			attempted[write.ref.String()] = write.manifest.digest
+			mu.Unlock()
+			if err := pusher.Push(groupCtx, write.ref, write.manifest); err != nil {
+				return fmt.Errorf("tagging %s: %w", write.ref, err)
+			}
+			return nil
+		})
+	}
+	commitErr := g.Wait()
+	if commitErr == nil {
+		var tags []string
+		for _, write := range writes {
+			tags = append(tags, write.ref.String())
+		}
+		slices.Sort(tags)
+		return tags, nil
+	}
+
+	// The commit context may already be cancelled; the rollback must run anyway.
+	restored, rollbackErr := rollbackTags(context.WithoutCancel(ctx), pusher, puller, attempted, states)
+	if rollbackErr != nil {
+		return nil, fmt.Errorf("%w; rolled back %d of %d tags, the rest failed and the destinations are inconsistent: %w", commitErr, restored, len(attempted), rollbackErr)
+	}
+	return nil, fmt.Errorf("%w; rolled back %d tags to their previous values", commitErr, restored)
+}
+
+// rollbackTags restores every attempted tag to its recorded state: a tag that
+// pointed at a manifest points at it again, and a tag that did not exist is
+// deleted. Each tag is resolved first: one pointing at neither the manifest the
+// commit wrote nor the recorded one was moved by another client, which is
+// reported before the tag is restored all the same. Every tag is attempted; the
+// count of tags restored is returned, and the errors are joined.
+func rollbackTags(ctx context.Context, pusher *remote.Pusher, puller *remote.Puller, attempted map[string]registryv1.Hash, states map[string]tagState) (int, error) {
+	tags := make([]string, 0, len(attempted))
+	for tag := range attempted {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	restored := 0
+	var errs []error
+	for _, tag := range tags {
+		ref, err := name.NewTag(tag, registryopts.NameOptions()...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		state := states[tag]
+		// A tag that cannot be resolved is restored without the comparison.
+		if current, err := puller.Head(ctx, ref); err == nil && current.Digest != attempted[tag] && (!state.present || current.Digest != state.manifest.digest) {
+			fmt.Fprintf(os.Stderr, "warning: %s was moved to %s by another client during the deploy; restoring it anyway\n", tag, current.Digest)
+		}
+		if state.present {
+			if err := pusher.Push(ctx, ref, state.manifest); err != nil {
+				errs = append(errs, fmt.Errorf("restoring %s to %s: %w", tag, state.manifest.digest, err))
+				continue
+			}
+			restored++
+			fmt.Fprintf(os.Stderr, "    rolled back %s to %s\n", tag, state.manifest.digest)
+			continue
+		}
+		if err := pusher.Delete(ctx, ref); err != nil && !isNotFound(err) {
+			errs = append(errs, fmt.Errorf("deleting %s, which did not exist before the deploy: %w", tag, err))
+			continue
+		}
+		restored++
+		fmt.Fprintf(os.Stderr, "    rolled back %s (deleted)\n", tag)
+	}
+	return restored, errors.Join(errs...)
+}
+
+// describeTagStates summarizes the recorded states on stderr, so the log of a
+// failed promotion says what the tags were restored to.
+func describeTagStates(writes []tagWrite, states map[string]tagState) string {
+	var b strings.Builder
+	seen := make(map[string]bool)
+	for _, write := range writes {
+		key := write.ref.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		state := states[key]
+		if state.present {
+			fmt.Fprintf(&b, "    %s: %s -> %s\n", key, state.manifest.digest, write.manifest.digest)
+		} else {
+			fmt.Fprintf(&b, "    %s: (new) -> %s\n", key, write.manifest.digest)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,228 @@
+package deploy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/deployvfs"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/push"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// runTransactionalDeploy pushes dm the way `img deploy --transactional` does:
+// record the tags, stage every manifest by digest, then commit the tags.
+func runTransactionalDeploy(t *testing.T, transport http.RoundTripper, layoutDirs []string, dm api.DeployManifest) error {
+	t.Helper()
+	vfsBuilder := deployvfs.NewBuilder(dm)
+	for _, layoutDir := range layoutDirs {
+		vfsBuilder = vfsBuilder.WithOCILayout(layoutDir)
+	}
+	vfs, err := vfsBuilder.Build()
+	if err != nil {
+		t.Fatalf("building VFS: %v", err)
+	}
+	pushOps, err := dm.PushOperations()
+	if err != nil {
+		t.Fatalf("reading push operations: %v", err)
+	}
+
+	ctx := context.Background()
+	remoteOptions := registryopts.Default().WithTransport(transport).Remote()
+	writes, err := planTagWrites(pushOps, nil, func(string, api.BaseCommandOperation) *deployvfs.VFS { return vfs }, DeployOptions{})
+	if err != nil {
+		t.Fatalf("planning tags: %v", err)
+	}
+	states, err := recordTagStates(ctx, writes, 4, remoteOptions)
+	if err != nil {
+		t.Fatalf("recording tags: %v", err)
+	}
+	if _, err := push.NewBuilder(vfs).WithJobs(4).WithRemoteOptions(remoteOptions...).Build().PushAll(ctx, withoutTags(pushOps), "eager"); err != nil {
+		return err
+	}
+	_, err = commitTags(ctx, writes, states, 4, remoteOptions)
+	return err
+}
+
+// failingTagWrites wraps a transport so that writing the given tag fails, the way
+// a registry refuses a write the credentials do not cover.
+func failingTagWrites(base http.RoundTripper, repository, tag string) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPut && req.URL.Path == "/v2/"+repository+"/manifests/"+tag {
+			return &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       io.NopCloser(strings.NewReader(`{"errors":[{"code":"DENIED","message":"tag is protected"}]}`)),
+				Request:    req,
+			}, nil
+		}
+		return base.RoundTrip(req)
+	})
+}
+
+// TestTransactionalDeployMovesEveryTag is the success path: every manifest is
+// staged and every tag ends up on the new manifest, including a tag that already
+// pointed elsewhere.
+func TestTransactionalDeployMovesEveryTag(t *testing.T) {
+	reg := newNaiveRegistry()
+	oldDirs, oldDM, _ := buildSharedLayerLayouts(t, "reg.example.com", 1, 1)
+	if err := runDedupDeploy(t, reg, oldDirs, oldDM); err != nil {
+		t.Fatalf("deploying the previous release: %v", err)
+	}
+
+	layoutDirs, dm, images := buildSharedLayerLayouts(t, "reg.example.com", 2, 2)
+	if err := runTransactionalDeploy(t, reg.transport(), layoutDirs, dm); err != nil {
+		t.Fatalf("transactional deploy: %v", err)
+	}
+	for i, repository := range images.repositories {
+		if stored, found := reg.storedManifestFor(repository, "latest"); !found || stored.digest != images.manifests[i] {
+			t.Errorf("tag latest in %s = %q, want %s", repository, stored.digest, images.manifests[i])
+		}
+	}
+}
+
+// TestTransactionalDeployRollsBackTags is the reason for the mode: the second
+// destination refuses its tag, so the first destination's tag -- already moved
+// -- is restored to the previous release, and the tag the deploy would have
+// created is not left behind. The manifests stay staged by digest.
+func TestTransactionalDeployRollsBackTags(t *testing.T) {
+	reg := newNaiveRegistry()
+	oldDirs, oldDM, oldImages := buildSharedLayerLayouts(t, "reg.example.com", 1, 1)
+	if err := runDedupDeploy(t, reg, oldDirs, oldDM); err != nil {
+		t.Fatalf("deploying the previous release: %v", err)
+	}
+
+	layoutDirs, dm, images := buildSharedLayerLayouts(t, "reg.example.com", 2, 2)
+	err := runTransactionalDeploy(t, failingTagWrites(reg.transport(), images.repositories[1], "latest"), layoutDirs, dm)
+	if err == nil {
+		t.Fatal("transactional deploy succeeded, want the refused tag to fail it")
+	}
+	if !strings.Contains(err.Error(), "rolled back") {
+		t.Errorf("error %q does not say the tags were rolled back", err)
+	}
+
+	if stored, found := reg.storedManifestFor(images.repositories[0], "latest"); !found || stored.digest != oldImages.manifests[0] {
+		t.Errorf("tag latest in %s = %q, want it restored to %s", images.repositories[0], stored.digest, oldImages.manifests[0])
+	}
+	if stored, found := reg.storedManifestFor(images.repositories[1], "latest"); found {
+		t.Errorf("tag latest in %s = %q, want it absent as before the deploy", images.repositories[1], stored.digest)
+	}
+	for i, repository := range images.repositories {
+		if _, found := reg.storedManifestFor(repository, images.manifests[i]); !found {
+			t.Errorf("manifest %s was not staged in %s", images.manifests[i], repository)
+		}
+	}
+}
+
+// TestTransactionalDeployStagesWithoutTags checks that a failure while staging
+// leaves every tag alone.
+func TestTransactionalDeployStagesWithoutTags(t *testing.T) {
+	reg := newNaiveRegistry()
+	layoutDirs, dm, images := buildSharedLayerLayouts(t, "reg.example.com", 2, 1)
+	// The second manifest cannot be staged, so no tag may move -- not even the
+	// first destination's, whose manifest was staged fine.
+	err := runTransactionalDeploy(t, failingTagWrites(reg.transport(), images.repositories[1], images.manifests[1]), layoutDirs, dm)
+	if err == nil {
+		t.Fatal("transactional deploy succeeded, want the refused manifest to fail it")
+	}
+	for _, repository := range images.repositories {
+		if stored, found := reg.storedManifestFor(repository, "latest"); found {
+			t.Errorf("tag latest in %s = %q, want no tag written while staging failed", repository, stored.digest)
+		}
+	}
+}
+
+// TestTransactionalDeployCountsOnlyRestoredTags checks the rollback count when a
+// restore fails: the registry refuses to delete the tag the deploy would have
+// created, so that tag is not counted. Whether the first destination's tag was
+// attempted before the failure cancelled the commit depends on scheduling, so
+// the count is checked against the number attempted.
+func TestTransactionalDeployCountsOnlyRestoredTags(t *testing.T) {
+	reg := newNaiveRegistry()
+	oldDirs, oldDM, _ := buildSharedLayerLayouts(t, "reg.example.com", 1, 1)
+	if err := runDedupDeploy(t, reg, oldDirs, oldDM); err != nil {
+		t.Fatalf("deploying the previous release: %v", err)
+	}
+
+	layoutDirs, dm, images := buildSharedLayerLayouts(t, "reg.example.com", 2, 2)
+	failing := failingTagWrites(reg.transport(), images.repositories[1], "latest")
+	refusingDeletes := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodDelete {
+			return &http.Response{
+				StatusCode: http.StatusMethodNotAllowed,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       io.NopCloser(strings.NewReader(`{"errors":[{"code":"UNSUPPORTED","message":"tag deletion is not supported"}]}`)),
+				Request:    req,
+			}, nil
+		}
+		return failing.RoundTrip(req)
+	})
+	err := runTransactionalDeploy(t, refusingDeletes, layoutDirs, dm)
+	if err == nil {
+		t.Fatal("transactional deploy succeeded, want the refused tag to fail it")
+	}
+	counts := regexp.MustCompile(`rolled back (\d+) of (\d+) tags`).FindStringSubmatch(err.Error())
+	if counts == nil || !strings.Contains(err.Error(), "UNSUPPORTED") {
+		t.Fatalf("error %q does not say how many tags were rolled back and why the rest were not", err)
+	}
+	restored, _ := strconv.Atoi(counts[1])
+	attempted, _ := strconv.Atoi(counts[2])
+	if restored != attempted-1 {
+		t.Errorf("rolled back %d of %d tags, want every tag but the undeletable one", restored, attempted)
+	}
+}
+
+// TestRollbackRestoresATagMovedByAnotherClient checks that a tag another client
+// moved after the commit wrote it is still restored to its recorded manifest.
+func TestRollbackRestoresATagMovedByAnotherClient(t *testing.T) {
+	reg := newNaiveRegistry()
+	transport := reg.transport()
+	remoteOptions := registryopts.Default().WithTransport(transport).Remote()
+	ctx := context.Background()
+	recorded := pushPreview(t, transport, "app", "latest", untagDay(1))
+	written := pushPreview(t, transport, "app", "deploy", untagDay(2))
+	moved := pushPreview(t, transport, "app", "latest", untagDay(3))
+
+	ref, err := name.NewTag("reg.example.com/app:latest", registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatalf("parsing tag: %v", err)
+	}
+	descriptor, err := remote.Get(ref.Context().Digest(recorded), remoteOptions...)
+	if err != nil {
+		t.Fatalf("reading %s: %v", recorded, err)
+	}
+	states := map[string]tagState{ref.String(): {present: true, manifest: rawManifest{
+		digest:    descriptor.Digest,
+		raw:       descriptor.Manifest,
+		mediaType: descriptor.MediaType,
+	}}}
+	writtenHash, err := remote.Head(ref.Context().Digest(written), remoteOptions...)
+	if err != nil {
+		t.Fatalf("resolving %s: %v", written, err)
+	}
+	pusher, err := remote.NewPusher(remoteOptions...)
+	if err != nil {
+		t.Fatalf("creating pusher: %v", err)
+	}
+	puller, err := remote.NewPuller(remoteOptions...)
+	if err != nil {
+		t.Fatalf("creating puller: %v", err)
+	}
+
+	restored, err := rollbackTags(ctx, pusher, puller, map[string]registryv1.Hash{ref.String(): writtenHash.Digest}, states)
+	if err != nil || restored != 1 {
+		t.Fatalf("rollback restored %d tags, error %v; want 1 and no error", restored, err)
+	}
+	if stored, found := reg.storedManifestFor("app", "latest"); !found || stored.digest != recorded {
+		t.Errorf("tag latest = %q, want it moved back from %s to %s", stored.digest, moved, recorded)
+	}
+}
@@ -0,0 +1,473 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// Retention: the registry_untag operation.
+//
+// A deploy that publishes a preview image per pull request leaves a tag behind
+// for every one of them. registry_untag lets the same deploy manifest clean them
+// up: it deletes explicit tags, the tags matching a pattern that a keep-last-N or
+// older-than rule gives up, and manifests by digest.
+//
+// The operation runs last, after every push, tag and signature, and it is
+// planned then too: the tags are listed once the deploy has written its own, so a
+// keep_last window counts the image just published. A tag the same deploy writes
+// is never deleted, whatever the rules say -- neither is a manifest it pushes,
+// whether named by digest or by a tag pointing at it: the protected set holds the
+// digest of every manifest the deploy writes, the children of its indexes
+// included, and every tag the rules give up is resolved to its digest before it
+// is deleted.
+//
+// Under the bes strategy the deploy pushes nothing itself -- the build event
+// stream syncer does, later -- so there is nothing to plan against yet, and the
+// registry_untag operations are skipped.
+//
+// Deleting a tag is DELETE /v2/<name>/manifests/<tag>, which the distribution
+// spec allows but not every registry implements; some only delete manifests by
+// digest, which removes every tag pointing at the manifest. registry_untag never
+// falls back from one to the other: the registry's refusal is the error.
+
+// untagCreatedAnnotation is the OCI annotation recording when an image was
+// created. It wins over the config's created field, which reproducible builds
+// pin to a constant.
+const untagCreatedAnnotation = "org.opencontainers.image.created"
+
+// untagPlan is what one registry_untag operation deletes.
+type untagPlan struct {
+	op         api.IndexedRegistryUntagDeployOperation
+	repository name.Repository
+	// tags are deleted by tag and digests by digest, each sorted.
+	tags    []string
+	digests []string
+	// spared are the tags and digests the rules selected but the deploy writes
+	// itself.
+	spared []string
+}
+
+// references returns every reference the plan deletes, tags first.
+func (p untagPlan) references() []string {
+	refs := make([]string, 0, len(p.tags)+len(p.digests))
+	for _, tag := range p.tags {
+		refs = append(refs, p.repository.Tag(tag).String())
+	}
+	for _, digest := range p.digests {
+		refs = append(refs, p.repository.Digest(digest).String())
+	}
+	return refs
+}
+
+// untagProtected returns every reference the push, copy and registry_tag
+// operations of the deploy write: the digest reference and tags of each push and
+// copy (with the --tag extras and the overrides applied), the tags of each
+// registry_tag, and the digest reference of every manifest a push or
+// registry_tag writes -- the root and, for an index, each of its children.
+//
+// The children of a copied index are not in the deploy manifest; they are read
+// from the destination, where the copy has put them. A destination that does not
+// hold the index yet (a dry run) protects the root alone.
+func untagProtected(ctx context.Context, pushOps []api.IndexedPushDeployOperation, copyOps []api.IndexedCopyDeployOperation, tagOps []api.IndexedRegistryTagDeployOperation, opts DeployOptions, remoteOptions []remote.Option) (map[string]bool, error) {
+	protected := make(map[string]bool)
+	protectManifests := func(repository name.Repository, base api.BaseCommandOperation) {
+		protected[repository.Digest(base.Root.Digest).String()] = true
+		for _, manifest := range base.Manifests {
+			protected[repository.Digest(manifest.Descriptor.Digest).String()] = true
+		}
+	}
+	uploader := newReferenceUploader(nil, opts)
+	for _, op := range pushOps {
+		refs, err := uploader.References(op)
+		if err != nil {
+			return nil, fmt.Errorf("push operation %d: %w", op.I, err)
+		}
+		for _, ref := range refs {
+			protected[ref.String()] = true
+			protectManifests(ref.Context(), op.BaseCommandOperation)
+		}
+	}
+	for _, op := range copyOps {
+		refs, err := copyReferences(op, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			protected[ref] = true
+		}
+		source, repository, _, err := copyDestination(op, opts)
+		if err != nil {
+			return nil, err
+		}
+		children, err := untagIndexChildren(ctx, repository.Digest(source.DigestStr()), remoteOptions)
+		if err != nil {
+			return nil, fmt.Errorf("copy operation %d: %w", op.I, err)
+		}
+		for _, child := range children {
+			protected[repository.Digest(child).String()] = true
+		}
+	}
+	for _, op := range tagOps {
+		refs, err := registryTagReferences(op, opts.OverrideRegistry, opts.OverrideRepository)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			protected[ref] = true
+		}
+		repository, err := name.NewRepository(overrideOr(op.Registry, opts.OverrideRegistry)+"/"+overrideOr(op.Repository, opts.OverrideRepository), registryopts.NameOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("registry_tag operation %d: parsing repository: %w", op.I, err)
+		}
+		protectManifests(repository, op.BaseCommandOperation)
+	}
+	return protected, nil
+}
+
+// untagIndexChildren returns the digests of the manifests an index in the
+// registry holds, or none when ref is an image or is not there.
+func untagIndexChildren(ctx context.Context, ref name.Digest, remoteOptions []remote.Option) ([]string, error) {
+	descriptor, err := remote.Get(ref, append(remoteOptions, remote.WithContext(ctx))...)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ref, err)
+	}
+	if !descriptor.MediaType.IsIndex() {
+		return nil, nil
+	}
+	index, err := descriptor.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ref, err)
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ref, err)
+	}
+	children := make([]string, 0, len(indexManifest.Manifests))
+	for _, child := range indexManifest.Manifests {
+		children = append(children, child.Digest.String())
+	}
+	return children, nil
+}
+
+// planUntagOperations resolves every registry_untag operation against its
+// repository as it stands now. It only reads: it lists tags and, when the
+// retention rules rank by creation time, fetches manifests and configs.
+func planUntagOperations(ctx context.Context, ops []api.IndexedRegistryUntagDeployOperation, protected map[string]bool, opts DeployOptions, remoteOptions []remote.Option) ([]untagPlan, error) {
+	plans := make([]untagPlan, 0, len(ops))
+	for _, op := range ops {
+		plan, err := planUntag(ctx, op, protected, opts, remoteOptions)
+		if err != nil {
+			return nil, fmt.Errorf("registry_untag operation %d: %w", op.I, err)
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// planUntag resolves one registry_untag operation.
+func planUntag(ctx context.Context, op api.IndexedRegistryUntagDeployOperation, protected map[string]bool, opts DeployOptions, remoteOptions []remote.Option) (untagPlan, error) {
+	repository, err := name.NewRepository(overrideOr(op.Registry, opts.OverrideRegistry)+"/"+overrideOr(op.Repository, opts.OverrideRepository), registryopts.NameOptions()...)
+	if err != nil {
+		return untagPlan{}, fmt.Errorf("parsing repository: %w", err)
+	}
+	plan := untagPlan{op: op, repository: repository}
+
+	deleted := make(map[string]bool)
+	for _, tag := range op.Tags {
+		deleted[tag] = true
+	}
+	if op.Match != "" {
+		matched, err := untagRetention(ctx, op, repository, max(opts.Jobs, 1), remoteOptions)
+		if err != nil {
+			return untagPlan{}, err
+		}
+		for _, tag := range matched {
+			deleted[tag] = true
+		}
+	}
+	var candidates []string
+	for tag := range deleted {
+		if _, err := name.NewTag(repository.Tag(tag).String(), registryopts.NameOptions()...); err != nil {
+			return untagPlan{}, fmt.Errorf("invalid tag %q: %w", tag, err)
+		}
+		if protected[repository.Tag(tag).String()] {
+			plan.spared = append(plan.spared, tag)
+			continue
+		}
+		candidates = append(candidates, tag)
+	}
+	// A tag pointing at a manifest the deploy writes stays too: a registry that
+	// deletes tags by deleting their manifest would take the manifest with it.
+	digests, err := untagTagDigests(ctx, repository, candidates, max(opts.Jobs, 1), remoteOptions)
+	if err != nil {
+		return untagPlan{}, err
+	}
+	for _, tag := range candidates {
+		if digest, found := digests[tag]; found && protected[repository.Digest(digest).String()] {
+			plan.spared = append(plan.spared, tag)
+			continue
+		}
+		plan.tags = append(plan.tags, tag)
+	}
+	for _, digest := range op.Digests {
+		if _, err := registryv1.NewHash(digest); err != nil {
+			return untagPlan{}, fmt.Errorf("invalid digest %q: %w", digest, err)
+		}
+		if protected[repository.Digest(digest).String()] {
+			plan.spared = append(plan.spared, digest)
+			continue
+		}
+		plan.digests = append(plan.digests, digest)
+	}
+	slices.Sort(plan.tags)
+	slices.Sort(plan.digests)
+	slices.Sort(plan.spared)
+	return plan, nil
+}
+
+// untagTagDigests resolves tags to the digests of the manifests they point at,
+// with jobs HEAD requests in flight. A tag that is already gone is left out.
+func untagTagDigests(ctx context.Context, repository name.Repository, tags []string, jobs int, remoteOptions []remote.Option) (map[string]string, error) {
+	puller, err := remote.NewPuller(remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("creating puller: %w", err)
+	}
+	digests := make(map[string]string, len(tags))
+	var mu sync.Mutex
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+	for _, tag := range tags {
+		g.Go(func() error {
+			descriptor, err := puller.Head(groupCtx, repository.Tag(tag))
+			if isNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("resolving %s: %w", repository.Tag(tag), err)
+			}
+			mu.Lock()
+			digests[tag] = descriptor.Digest.String()
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// untagRetention lists the tags of the repository matching op.Match and returns
+// the ones the retention rules give up. A repository that does not exist has no
+// tags.
+func untagRetention(ctx context.Context, op api.IndexedRegistryUntagDeployOperation, repository name.Repository, jobs int, remoteOptions []remote.Option) ([]string, error) {
+	pattern, err := regexp.Compile("^(?:" + op.Match + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("parsing match: %w", err)
+	}
+	var cutoff time.Time
+	if op.OlderThan != "" {
+		cutoff, err = time.Parse(time.RFC3339, op.OlderThan)
+		if err != nil {
+			return nil, fmt.Errorf("parsing older_than: %w", err)
+		}
+	}
+
+	all, err := remote.List(repository, append(remoteOptions, remote.WithContext(ctx))...)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("listing tags of %s: %w", repository, err)
+	}
+	var matched []string
+	for _, tag := range all {
+		if pattern.MatchString(tag) {
+			matched = append(matched, tag)
+		}
+	}
+	// Without a rule, every matching tag goes.
+	if op.KeepLast == nil && op.OlderThan == "" {
+		return matched, nil
+	}
+
+	var created map[string]time.Time
+	if op.Order != api.UntagOrderTag {
+		created, err = untagCreationTimes(ctx, repository, matched, jobs, remoteOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Newest first; equal creation times fall back to the tags themselves.
+	slices.SortStableFunc(matched, func(a, b string) int {
+		if c := created[b].Compare(created[a]); c != 0 {
+			return c
+		}
+		return strings.Compare(b, a)
+	})
+
+	var expired []string
+	for rank, tag := range matched {
+		keptByCount := op.KeepLast != nil && rank < *op.KeepLast
+		keptByAge := op.OlderThan != "" && !created[tag].Before(cutoff)
+		// A rule that is not set keeps nothing, so the other decides alone.
+		if keptByCount || keptByAge {
+			continue
+		}
+		expired = append(expired, tag)
+	}
+	return expired, nil
+}
+
+// untagCreationTimes fetches the creation time of the image behind every tag,
+// with jobs requests in flight.
+func untagCreationTimes(ctx context.Context, repository name.Repository, tags []string, jobs int, remoteOptions []remote.Option) (map[string]time.Time, error) {
+	puller, err := remote.NewPuller(remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("creating puller: %w", err)
+	}
+	created := make(map[string]time.Time, len(tags))
+	var mu sync.Mutex
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+	for _, tag := range tags {
+		g.Go(func() error {
+			descriptor, err := puller.Get(groupCtx, repository.Tag(tag))
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", repository.Tag(tag), err)
+			}
+			at, err := imageCreated(descriptor)
+			if err != nil {
+				return fmt.Errorf("reading the creation time of %s: %w", repository.Tag(tag), err)
+			}
+			mu.Lock()
+			created[tag] = at
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// imageCreated returns when the image or index behind a descriptor was created:
+// the org.opencontainers.image.created annotation of its manifest when set, else
+// the created field of its config -- for an index, the config of its first
+// image.
+func imageCreated(descriptor *remote.Descriptor) (time.Time, error) {
+	var annotated struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(descriptor.Manifest, &annotated); err != nil {
+		return time.Time{}, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if value, found := annotated.Annotations[untagCreatedAnnotation]; found {
+		at, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("parsing annotation %s: %w", untagCreatedAnnotation, err)
+		}
+		return at, nil
+	}
+
+	if !descriptor.MediaType.IsIndex() {
+		image, err := descriptor.Image()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return configCreated(image)
+	}
+	index, err := descriptor.ImageIndex()
+	if err != nil {
+		return time.Time{}, err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, child := range indexManifest.Manifests {
+		if !child.MediaType.IsImage() {
+			continue
+		}
+		image, err := index.Image(child.Digest)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return configCreated(image)
+	}
+	return time.Time{}, errors.New("index holds no image")
+}
+
+func configCreated(image registryv1.Image) (time.Time, error) {
+	config, err := image.ConfigFile()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading config: %w", err)
+	}
+	return config.Created.Time, nil
+}
+
+// applyUntagPlans deletes everything the plans name, with jobs requests in
+// flight, and returns the references deleted. A reference that is already gone
+// counts as deleted. A failure fails the deploy unless the operation is
+// best_effort, in which case it is a warning (and an error of the operation in
+// the report). Every deletion is attempted either way.
+func applyUntagPlans(ctx context.Context, plans []untagPlan, jobs int, remoteOptions []remote.Option, report *deployRecorder) ([]string, error) {
+	pusher, err := remote.NewPusher(remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("creating pusher: %w", err)
+	}
+
+	var mu sync.Mutex
+	var deleted []string
+	var errs []error
+	var g errgroup.Group
+	g.SetLimit(max(jobs, 1))
+	for _, plan := range plans {
+		for _, spared := range plan.spared {
+			fmt.Fprintf(os.Stderr, "registry_untag %d: keeping %s, which this deploy writes\n", plan.op.I, spared)
+		}
+		for _, ref := range plan.references() {
+			g.Go(func() error {
+				parsed, err := name.ParseReference(ref, registryopts.NameOptions()...)
+				if err == nil {
+					err = pusher.Delete(ctx, parsed)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil || isNotFound(err):
+					deleted = append(deleted, ref)
+					report.untagged(plan.op.I, ref)
+				case plan.op.BestEffort:
+					message := fmt.Sprintf("deleting %s: %v", ref, err)
+					fmt.Fprintf(os.Stderr, "warning: registry_untag %d: %s\n", plan.op.I, message)
+					report.operationError(plan.op.I, message)
+				default:
+					errs = append(errs, fmt.Errorf("registry_untag %d: deleting %s: %w", plan.op.I, ref, err))
+				}
+				return nil
+			})
+		}
+	}
+	g.Wait()
+	slices.Sort(deleted)
+	return deleted, errors.Join(errs...)
+}
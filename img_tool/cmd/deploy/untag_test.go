@@ -0,0 +1,254 @@
+package deploy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// untagDay returns noon on day n of a month, the creation times of the preview
+// images of these tests.
+func untagDay(n int) time.Time {
+	return time.Date(2026, time.March, n, 12, 0, 0, 0, time.UTC)
+}
+
+// pushPreview pushes an image created at created under tag, and returns its
+// digest.
+func pushPreview(t *testing.T, transport http.RoundTripper, repository, tag string, created time.Time) string {
+	t.Helper()
+	image, err := mutate.CreatedAt(empty.Image, registryv1.Time{Time: created})
+	if err != nil {
+		t.Fatalf("creating image: %v", err)
+	}
+	ref, err := name.NewTag("reg.example.com/"+repository+":"+tag, registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatalf("parsing tag: %v", err)
+	}
+	if err := remote.Write(ref, image, registryopts.Default().WithTransport(transport).Remote()...); err != nil {
+		t.Fatalf("pushing %s: %v", ref, err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	return digest.String()
+}
+
+// runUntag plans and applies one registry_untag operation the way img deploy
+// does, sparing the references in protected.
+func runUntag(t *testing.T, transport http.RoundTripper, op api.RegistryUntagDeployOperation, protected ...string) (untagPlan, []string, error) {
+	t.Helper()
+	op.Command = "registry_untag"
+	if err := op.Validate(); err != nil {
+		t.Fatalf("invalid operation: %v", err)
+	}
+	spared := make(map[string]bool)
+	for _, ref := range protected {
+		spared[ref] = true
+	}
+	remoteOptions := registryopts.Default().WithTransport(transport).Remote()
+	ops := []api.IndexedRegistryUntagDeployOperation{{I: 0, RegistryUntagDeployOperation: op}}
+	plans, err := planUntagOperations(context.Background(), ops, spared, DeployOptions{Jobs: 4}, remoteOptions)
+	if err != nil {
+		t.Fatalf("planning: %v", err)
+	}
+	deleted, err := applyUntagPlans(context.Background(), plans, 4, remoteOptions, nil)
+	return plans[0], deleted, err
+}
+
+// remainingTags lists the tags left in a repository of the test registry.
+func remainingTags(t *testing.T, reg *naiveRegistry, repository string) []string {
+	t.Helper()
+	repo, err := name.NewRepository("reg.example.com/"+repository, registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatalf("parsing repository: %v", err)
+	}
+	tags, err := remote.List(repo, registryopts.Default().WithTransport(reg.transport()).Remote()...)
+	if err != nil {
+		t.Fatalf("listing tags: %v", err)
+	}
+	return tags
+}
+
+// TestUntagKeepsNewestMatchingTags is the per-pull-request preview case: of the
+// tags matching the pattern only the newest two survive -- ranked by creation
+// time, not by name, since pr-10 sorts before pr-9 -- tags outside the pattern
+// are left alone, and an explicit tag goes too.
+func TestUntagKeepsNewestMatchingTags(t *testing.T) {
+	reg := newNaiveRegistry()
+	transport := reg.transport()
+	for i, tag := range []string{"pr-7", "pr-8", "pr-9", "pr-10"} {
+		pushPreview(t, transport, "previews", tag, untagDay(i+1))
+	}
+	pushPreview(t, transport, "previews", "main", untagDay(1))
+	pushPreview(t, transport, "previews", "scratch", untagDay(1))
+
+	keep := 2
+	_, deleted, err := runUntag(t, transport, api.RegistryUntagDeployOperation{
+		Registry:   "reg.example.com",
+		Repository: "previews",
+		Match:      "pr-[0-9]+",
+		KeepLast:   &keep,
+		Tags:       []string{"scratch"},
+	})
+	if err != nil {
+		t.Fatalf("untag: %v", err)
+	}
+	want := []string{"reg.example.com/previews:pr-7", "reg.example.com/previews:pr-8", "reg.example.com/previews:scratch"}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+	if got, want := remainingTags(t, reg, "previews"), []string{"main", "pr-10", "pr-9"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remaining tags %v, want %v", got, want)
+	}
+}
+
+// TestUntagOlderThanSparesTheDeploysOwnTags checks the age rule, a tag the
+// deploy writes itself surviving it, and deletion by digest.
+func TestUntagOlderThanSparesTheDeploysOwnTags(t *testing.T) {
+	reg := newNaiveRegistry()
+	transport := reg.transport()
+	digests := make(map[string]string)
+	for i, tag := range []string{"pr-1", "pr-2", "pr-3", "pr-4"} {
+		digests[tag] = pushPreview(t, transport, "previews", tag, untagDay(i+1))
+	}
+
+	plan, deleted, err := runUntag(t, transport, api.RegistryUntagDeployOperation{
+		Registry:   "reg.example.com",
+		Repository: "previews",
+		Match:      "pr-.*",
+		OlderThan:  untagDay(3).Format(time.RFC3339),
+		Digests:    []string{digests["pr-4"]},
+	}, "reg.example.com/previews:pr-1")
+	if err != nil {
+		t.Fatalf("untag: %v", err)
+	}
+	if !reflect.DeepEqual(plan.spared, []string{"pr-1"}) {
+		t.Errorf("spared %v, want [pr-1]", plan.spared)
+	}
+	want := []string{"reg.example.com/previews:pr-2", "reg.example.com/previews@" + digests["pr-4"]}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+	// Deleting pr-4's manifest by digest took its tag with it.
+	if got, want := remainingTags(t, reg, "previews"), []string{"pr-1", "pr-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remaining tags %v, want %v", got, want)
+	}
+}
+
+// TestUntagTagOrderAndMissingRepository ranks by tag for a repository that
+// does not exist yet -- which has nothing to delete rather than failing -- and
+// for one that does.
+func TestUntagTagOrderAndMissingRepository(t *testing.T) {
+	reg := newNaiveRegistry()
+	transport := reg.transport()
+	keep := 1
+	op := api.RegistryUntagDeployOperation{
+		Registry:   "reg.example.com",
+		Repository: "nightly",
+		Match:      "build-[0-9]{8}",
+		KeepLast:   &keep,
+		Order:      api.UntagOrderTag,
+	}
+	if _, deleted, err := runUntag(t, transport, op); err != nil || len(deleted) != 0 {
+		t.Fatalf("untag in a missing repository: deleted %v, error %v", deleted, err)
+	}
+
+	// Reproducible builds: every image carries the same creation time.
+	for _, tag := range []string{"build-20260301", "build-20260302", "build-20260303"} {
+		pushPreview(t, transport, "nightly", tag, time.Unix(0, 0))
+	}
+	if _, _, err := runUntag(t, transport, op); err != nil {
+		t.Fatalf("untag: %v", err)
+	}
+	if got, want := remainingTags(t, reg, "nightly"), []string{"build-20260303"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remaining tags %v, want %v", got, want)
+	}
+}
+
+// TestUntagBestEffort checks that a registry refusing tag deletion fails the
+// operation, unless it is best effort.
+func TestUntagBestEffort(t *testing.T) {
+	reg := newNaiveRegistry()
+	pushPreview(t, reg.transport(), "previews", "pr-1", untagDay(1))
+	refusing := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodDelete {
+			return &http.Response{
+				StatusCode: http.StatusMethodNotAllowed,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       io.NopCloser(strings.NewReader(`{"errors":[{"code":"UNSUPPORTED","message":"tag deletion is not supported"}]}`)),
+				Request:    req,
+			}, nil
+		}
+		return reg.transport().RoundTrip(req)
+	})
+
+	op := api.RegistryUntagDeployOperation{Registry: "reg.example.com", Repository: "previews", Tags: []string{"pr-1"}}
+	if _, _, err := runUntag(t, refusing, op); err == nil || !strings.Contains(err.Error(), "UNSUPPORTED") {
+		t.Errorf("untag against a refusing registry: error %v, want the registry's refusal", err)
+	}
+	op.BestEffort = true
+	if _, deleted, err := runUntag(t, refusing, op); err != nil || len(deleted) != 0 {
+		t.Errorf("best-effort untag: deleted %v, error %v; want nothing deleted and no error", deleted, err)
+	}
+}
+
+// TestUntagSparesTheManifestsOfAPushedIndex checks that the protected set holds
+// the children of an index the deploy pushes, by digest: a registry_untag naming
+// a child's digest, or a tag pointing at it, leaves both in place.
+func TestUntagSparesTheManifestsOfAPushedIndex(t *testing.T) {
+	reg := newNaiveRegistry()
+	transport := reg.transport()
+	child := pushPreview(t, transport, "previews", "pr-1", untagDay(1))
+	pushPreview(t, transport, "previews", "pr-2", untagDay(2))
+
+	push := api.IndexedPushDeployOperation{PushDeployOperation: api.PushDeployOperation{
+		BaseCommandOperation: api.BaseCommandOperation{
+			Command:   "push",
+			RootKind:  "index",
+			Root:      api.Descriptor{Digest: "sha256:" + strings.Repeat("a", 64)},
+			Manifests: []api.ManifestDeployInfo{{Descriptor: api.Descriptor{Digest: child}}},
+		},
+		PushTarget: api.PushTarget{Registry: "reg.example.com", Repository: "previews", Tags: []string{"latest"}},
+	}}
+	opts := DeployOptions{Jobs: 4}
+	remoteOptions := registryopts.Default().WithTransport(transport).Remote()
+	protected, err := untagProtected(context.Background(), []api.IndexedPushDeployOperation{push}, nil, nil, opts, remoteOptions)
+	if err != nil {
+		t.Fatalf("untagProtected: %v", err)
+	}
+	if !protected["reg.example.com/previews@"+child] {
+		t.Fatalf("protected %v does not hold the index's child %s", protected, child)
+	}
+
+	op := api.IndexedRegistryUntagDeployOperation{RegistryUntagDeployOperation: api.RegistryUntagDeployOperation{
+		Command:    "registry_untag",
+		Registry:   "reg.example.com",
+		Repository: "previews",
+		Match:      "pr-.*",
+		Digests:    []string{child},
+	}}
+	plans, err := planUntagOperations(context.Background(), []api.IndexedRegistryUntagDeployOperation{op}, protected, opts, remoteOptions)
+	if err != nil {
+		t.Fatalf("planning: %v", err)
+	}
+	if got, want := plans[0].spared, []string{"pr-1", child}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spared %v, want %v", got, want)
+	}
+	if got, want := plans[0].references(), []string{"reg.example.com/previews:pr-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deletes %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/signer"
+)
+
+// The sources `img deploy --verify` checks for a valid signature before it
+// writes anything.
+const (
+	// verifyBaseImages checks the pulled base image of every push and load
+	// operation, by the digest recorded in its PullInfo.
+	verifyBaseImages = "base_images"
+	// verifyCopySources checks the source of every copy operation: a promotion
+	// only goes ahead for a digest that was signed where it was staged.
+	verifyCopySources = "copy_sources"
+)
+
+// parseVerifySources turns the --verify list into a set, expanding "all".
+func parseVerifySources(list []string) (map[string]bool, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	sources := map[string]bool{}
+	for _, s := range list {
+		switch s {
+		case "all":
+			sources[verifyBaseImages] = true
+			sources[verifyCopySources] = true
+		case verifyBaseImages, verifyCopySources:
+			sources[s] = true
+		default:
+			return nil, fmt.Errorf("invalid --verify source %q: want %s, %s or all", s, verifyBaseImages, verifyCopySources)
+		}
+	}
+	return sources, nil
+}
+
+// verifySubjects lists the digests the pre-flight checks, in operation order
+// and without repeats. A base image pulled by tag alone cannot be verified: a
+// tag says nothing about which image the build used, so it is an error rather
+// than a skip.
+func verifySubjects(baseOps []api.BaseCommandOperation, copyOps []api.IndexedCopyDeployOperation, sources map[string]bool) ([]name.Digest, error) {
+	var subjects []name.Digest
+	seen := map[string]bool{}
+	add := func(d name.Digest) {
+		if !seen[d.String()] {
+			seen[d.String()] = true
+			subjects = append(subjects, d)
+		}
+	}
+	if sources[verifyBaseImages] {
+		for _, op := range baseOps {
+			pull := op.PullInfo
+			if pull.OriginalBaseImageRepository == "" {
+				continue
+			}
+			if pull.OriginalBaseImageDigest == "" {
+				return nil, fmt.Errorf("cannot verify base image %s of %s: it was pulled by tag %q, not by digest", pull.OriginalBaseImageRepository, op.Root.Digest, pull.OriginalBaseImageTag)
+			}
+			// The first registry is the one the image was pulled from; the
+			// rest are mirrors serving the same digest.
+			registry := "docker.io"
+			if len(pull.OriginalBaseImageRegistries) > 0 {
+				registry = pull.OriginalBaseImageRegistries[0]
+			}
+			ref := registry + "/" + pull.OriginalBaseImageRepository + "@" + pull.OriginalBaseImageDigest
+			d, err := name.NewDigest(ref, registryopts.NameOptions()...)
+			if err != nil {
+				return nil, fmt.Errorf("parsing base image %q: %w", ref, err)
+			}
+			add(d)
+		}
+	}
+	if sources[verifyCopySources] {
+		for _, op := range copyOps {
+			d, err := op.SourceDigest(registryopts.NameOptions()...)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", op.I, err)
+			}
+			add(d)
+		}
+	}
+	return subjects, nil
+}
+
+// newDeployVerifier resolves the sign_setting whose plugin verifies the
+// pre-flight subjects: --verify_sign_setting, or else the default sign_setting
+// the deploy would sign with.
+func newDeployVerifier(settings api.DeploySettings, opts DeployOptions) (*signer.Subprocess, error) {
+	setting := opts.VerifySignSetting
+	if setting == "" {
+		setting = opts.DefaultSignSetting
+	}
+	store, rfHandle, err := signStore(signOptions{settingFiles: opts.SignSettingFiles, defaultSetting: setting})
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := store.Resolve(nil, settings.DefaultSignSetting)
+	if err != nil {
+		return nil, fmt.Errorf("resolving the sign_setting to verify with (set --verify_sign_setting): %w", err)
+	}
+	return signer.NewSubprocess(cfg, rfHandle)
+}
+
+// preflightVerify checks every subject for a valid signature before the deploy
+// writes anything. It checks them all, logging each outcome on stderr, and
+// fails naming every subject that did not verify.
+func preflightVerify(ctx context.Context, subjects []name.Digest, verifier api.OCIArtifactVerifier, remoteOptions []remote.Option) error {
+	var failed []string
+	for _, subject := range subjects {
+		_, result, err := signer.VerifyReference(ctx, verifier, subject, remoteOptions...)
+		if err != nil {
+			return fmt.Errorf("verifying %s: %w", subject, err)
+		}
+		if !result.Verified {
+			fmt.Fprintf(os.Stderr, "not verified: %s: %s\n", subject, result.Reason)
+			failed = append(failed, subject.String())
+			continue
+		}
+		identity := ""
+		if result.Identity != "" {
+			identity = " signed by " + result.Identity
+		}
+		fmt.Fprintf(os.Stderr, "verified %s: signature %s%s\n", subject, result.Artifact, identity)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("pre-flight verification failed, nothing was deployed: no valid signature on %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
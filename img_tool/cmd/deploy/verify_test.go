@@ -0,0 +1,147 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testregistry"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+func TestParseVerifySources(t *testing.T) {
+	sources, err := parseVerifySources([]string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sources[verifyBaseImages] || !sources[verifyCopySources] {
+		t.Errorf("all = %v, want both sources", sources)
+	}
+	if _, err := parseVerifySources([]string{"roots"}); err == nil {
+		t.Error("accepted an unknown source")
+	}
+}
+
+func TestVerifySubjects(t *testing.T) {
+	const baseDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	const copyDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	base := api.PullInfo{
+		OriginalBaseImageRegistries: []string{"mirror.example.com", "docker.io"},
+		OriginalBaseImageRepository: "library/debian",
+		OriginalBaseImageTag:        "bookworm",
+		OriginalBaseImageDigest:     baseDigest,
+	}
+	baseOps := []api.BaseCommandOperation{
+		{Command: "push", PullInfo: base},
+		{Command: "load", PullInfo: base},
+		{Command: "push"}, // built from scratch
+	}
+	copyOps := []api.IndexedCopyDeployOperation{{I: 3, CopyDeployOperation: api.CopyDeployOperation{
+		Command:    "copy",
+		Source:     "staging.example.com/team/app@" + copyDigest,
+		Registry:   "prod.example.com",
+		Repository: "team/app",
+	}}}
+
+	subjects, err := verifySubjects(baseOps, copyOps, map[string]bool{verifyBaseImages: true, verifyCopySources: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range subjects {
+		got = append(got, s.String())
+	}
+	want := []string{
+		"mirror.example.com/library/debian@" + baseDigest,
+		"staging.example.com/team/app@" + copyDigest,
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("subjects = %v, want %v", got, want)
+	}
+
+	subjects, err = verifySubjects(baseOps, copyOps, map[string]bool{verifyCopySources: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subjects) != 1 || subjects[0].DigestStr() != copyDigest {
+		t.Errorf("copy_sources subjects = %v, want the copy source alone", subjects)
+	}
+
+	unpinned := []api.BaseCommandOperation{{Command: "push", PullInfo: api.PullInfo{OriginalBaseImageRepository: "library/debian", OriginalBaseImageTag: "bookworm"}}}
+	if _, err := verifySubjects(unpinned, nil, map[string]bool{verifyBaseImages: true}); err == nil {
+		t.Error("accepted a base image pulled by tag alone")
+	}
+}
+
+// referrerVerifier trusts any referrer at all.
+type referrerVerifier struct{}
+
+func (referrerVerifier) Verify(_ context.Context, subject registryv1.Descriptor, artifacts []registryv1.Image) (api.VerifyResult, error) {
+	if len(artifacts) == 0 {
+		return api.VerifyResult{Reason: "no referrers"}, nil
+	}
+	d, err := artifacts[0].Digest()
+	if err != nil {
+		return api.VerifyResult{}, err
+	}
+	return api.VerifyResult{Verified: true, Artifact: d.String()}, nil
+}
+
+func TestPreflightVerify(t *testing.T) {
+	regs := testregistry.New("reg.example.com")
+	push := func(repo string, withReferrer bool) name.Digest {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.NewDigest("reg.example.com/"+repo+"@"+d.String(), registryopts.NameOptions()...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img, regs.Options()...); err != nil {
+			t.Fatal(err)
+		}
+		if withReferrer {
+			mt, err := img.MediaType()
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := img.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig := mutate.Subject(empty.Image, registryv1.Descriptor{MediaType: mt, Digest: d, Size: size}).(registryv1.Image)
+			sd, err := sig.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.Write(ref.Context().Digest(sd.String()), sig, regs.Options()...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ref
+	}
+	signed := push("team/signed", true)
+	unsigned := push("team/unsigned", false)
+	ctx := context.Background()
+
+	if err := preflightVerify(ctx, []name.Digest{signed}, referrerVerifier{}, regs.Options()); err != nil {
+		t.Errorf("preflightVerify(signed): %v", err)
+	}
+	err := preflightVerify(ctx, []name.Digest{unsigned, signed}, referrerVerifier{}, regs.Options())
+	if err == nil || !strings.Contains(err.Error(), unsigned.String()) || strings.Contains(err.Error(), signed.String()) {
+		t.Errorf("preflightVerify(unsigned, signed) = %v, want an error naming only the unsigned image", err)
+	}
+}
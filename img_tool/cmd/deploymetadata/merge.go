@@ -113,15 +113,16 @@ func DeployMergeProcess(ctx context.Context, args []string) {
 }
 
 // keepOperation reports whether an operation with the given command should be
-// retained given the requested operation kinds. Push, registry_tag, and referrer
-// (also command "push") operations count as the "push" kind; load operations
+// retained given the requested operation kinds. Push, registry_tag, copy,
+// registry_untag and referrer (also command "push") operations count as the
+// "push" kind; load operations
 // count as "load". Unrecognized commands are always kept so unknown operation
 // types are never silently dropped.
 func keepOperation(command string, kinds map[string]bool) bool {
 	switch command {
 	case "load":
 		return kinds["load"]
-	case "push", "registry_tag":
+	case "push", "registry_tag", "copy", "registry_untag":
 		return kinds["push"]
 	default:
 		return true
@@ -70,19 +70,20 @@ func TestDeployMergeProcessExpandsArgfile(t *testing.T) {
 
 func TestMergeDeployManifestsFiltersByOperation(t *testing.T) {
 	tmp := t.TempDir()
-	// A manifest carrying every operation kind we filter on. registry_tag rides
-	// along with push; referrer operations also use the "push" command.
-	input := writeDeployManifest(t, filepath.Join(tmp, "in.json"), "push", "registry_tag", "load")
+	// A manifest carrying every operation kind we filter on. registry_tag, copy
+	// and registry_untag ride along with push; referrer operations also use the "push"
+	// command.
+	input := writeDeployManifest(t, filepath.Join(tmp, "in.json"), "push", "registry_tag", "copy", "registry_untag", "load")
 
 	cases := []struct {
 		name       string
 		operations []string
 		want       []string
 	}{
-		{"push only", []string{"push"}, []string{"push", "registry_tag"}},
+		{"push only", []string{"push"}, []string{"push", "registry_tag", "copy", "registry_untag"}},
 		{"load only", []string{"load"}, []string{"load"}},
-		{"both", []string{"push", "load"}, []string{"push", "registry_tag", "load"}},
-		{"no filter keeps all", nil, []string{"push", "registry_tag", "load"}},
+		{"both", []string{"push", "load"}, []string{"push", "registry_tag", "copy", "registry_untag", "load"}},
+		{"no filter keeps all", nil, []string{"push", "registry_tag", "copy", "registry_untag", "load"}},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
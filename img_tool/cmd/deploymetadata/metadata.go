@@ -67,6 +67,14 @@ var (
 	signBestEffort         bool
 	signTargets            []string
 	defaultSignSettingFile string
+
+	// Provenance: whether the push operation attests SLSA provenance, and the
+	// build invocation recorded for it (builder ID, Bazel target label and the
+	// workspace status files of a stamped build).
+	provenanceEnabled    bool
+	provenanceBuilderID  string
+	provenanceTarget     string
+	provenanceStampFiles []string
 )
 
 func DeployMetadataProcess(ctx context.Context, args []string) {
@@ -77,6 +85,7 @@ func DeployMetadataProcess(ctx context.Context, args []string) {
 	manifestTagFiles = nil
 	layerSourcesForManifest = nil
 	signTargets = nil
+	provenanceStampFiles = nil
 
 	flagSet := flag.NewFlagSet("deploy-metadata", flag.ExitOnError)
 	flagSet.Usage = func() {
@@ -163,6 +172,13 @@ func DeployMetadataProcess(ctx context.Context, args []string) {
 			return fmt.Errorf("invalid --sign-target %q", value)
 		}
 	})
+	flagSet.BoolVar(&provenanceEnabled, "provenance", false, `(Optional) attest the SLSA provenance of the pushed root when it is signed. The provenance statement is signed with this operation's sign_setting and attached as a referrer.`)
+	flagSet.StringVar(&provenanceBuilderID, "provenance-builder-id", "", `(Optional) builder ID recorded in the provenance attestation (overridable at deploy time).`)
+	flagSet.StringVar(&provenanceTarget, "provenance-target", "", `(Optional) label of the Bazel target recorded in the provenance attestation.`)
+	flagSet.Func("provenance-stamp-file", `(Optional) Bazel workspace status file (stable-status.txt or volatile-status.txt) whose values are recorded in the provenance attestation. Can be specified multiple times; later files win.`, func(value string) error {
+		provenanceStampFiles = append(provenanceStampFiles, value)
+		return nil
+	})
 	flagSet.StringVar(&defaultSignSettingFile, "default-sign-setting-file", "", `(Optional) path to a sign_setting config file used as the manifest-level default for operations that request signing but carry no setting of their own.`)
 
 	if err := flagSet.Parse(args); err != nil {
@@ -430,6 +446,17 @@ func WriteMetadata(ctx context.Context, outputPath string) error {
 				BestEffort: signBestEffort,
 				Targets:    append([]string(nil), signTargets...),
 			}
+			if provenanceEnabled {
+				stamp, err := readStampValues(provenanceStampFiles)
+				if err != nil {
+					return err
+				}
+				operation.Provenance = &api.ProvenanceConfig{
+					BuilderID: provenanceBuilderID,
+					Target:    provenanceTarget,
+					Stamp:     stamp,
+				}
+			}
 		}
 		defaultSignSetting, err := signConfigDescriptor(defaultSignSettingFile)
 		if err != nil {
@@ -727,6 +754,29 @@ func signConfigDescriptor(path string) (*api.Descriptor, error) {
 	}, nil
 }
 
+// readStampValues reads Bazel workspace status files ("KEY value" lines) into a
+// map, or returns nil when no file is given or none holds a value.
+func readStampValues(paths []string) (map[string]string, error) {
+	var values map[string]string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading stamp file %s: %w", path, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, ok := strings.Cut(strings.TrimSuffix(line, "\r"), " ")
+			if !ok || key == "" || strings.HasPrefix(key, "#") {
+				continue
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
 // targetsIncludeReferrers reports whether the sign-target selection covers
 // referrer artifacts (either explicitly or via "all").
 func targetsIncludeReferrers(targets []string) bool {
@@ -12,7 +12,9 @@ import (
 
 // writePushMetadata runs the deploy-metadata writer over one push operation and
 // returns it, so a test can check what the build recorded for `img deploy` to read.
-func writePushMetadata(t *testing.T, configJSON string) api.PushDeployOperation {
+// Each setup function runs once the flags are reset, with the test's temporary
+// directory, to set further flags.
+func writePushMetadata(t *testing.T, configJSON string, setup ...func(dir string)) api.PushDeployOperation {
 	t.Helper()
 	tmp := t.TempDir()
 
@@ -33,6 +35,9 @@ func writePushMetadata(t *testing.T, configJSON string) api.PushDeployOperation
 	deduplicatedPush = api.DeduplicatedPushBestEffort
 	deduplicatedPushBlobRepository = "team/_blobs"
 	deduplicatedPushContent = api.DeduplicatedPushContentBlobsAndArtificialManifests
+	for _, f := range setup {
+		f(tmp)
+	}
 	if err := WriteMetadata(context.Background(), outputPath); err != nil {
 		t.Fatalf("WriteMetadata: %v", err)
 	}
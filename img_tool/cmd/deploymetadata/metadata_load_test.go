@@ -44,6 +44,14 @@ func resetMetadataFlags(manifestPath, configPath string) {
 	deduplicatedPush = ""
 	deduplicatedPushBlobRepository = ""
 	deduplicatedPushContent = ""
+	signSettingFile = ""
+	signBestEffort = false
+	signTargets = nil
+	defaultSignSettingFile = ""
+	provenanceEnabled = false
+	provenanceBuilderID = ""
+	provenanceTarget = ""
+	provenanceStampFiles = nil
 }
 
 func writeLoadMetadata(t *testing.T, configJSON string) api.LoadDeployOperation {
@@ -0,0 +1,54 @@
+package deploymetadata
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestPushOperationRecordsProvenance checks a signed push records the build
+// invocation its provenance attestation is made from, with later workspace
+// status files overriding earlier ones.
+func TestPushOperationRecordsProvenance(t *testing.T) {
+	op := writePushMetadata(t, `{"registry":"reg.example.com","repository":"team/app","tags":["latest"]}`, func(dir string) {
+		files := map[string]string{
+			"sign_setting.json":   `{"schema_version":1,"mode":"command","tool":"cosign-plugin"}`,
+			"stable-status.txt":   "BUILD_SCM_REVISION 4f2a9c1\nSTABLE_CHANNEL beta\n",
+			"volatile-status.txt": "BUILD_TIMESTAMP 1700000000\nSTABLE_CHANNEL stable\n",
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		signSettingFile = filepath.Join(dir, "sign_setting.json")
+		provenanceEnabled = true
+		provenanceBuilderID = "https://ci.example.com/builders/main"
+		provenanceTarget = "//app:push"
+		provenanceStampFiles = []string{filepath.Join(dir, "stable-status.txt"), filepath.Join(dir, "volatile-status.txt")}
+	})
+
+	if op.Sign == nil || op.Provenance == nil {
+		t.Fatalf("sign = %+v, provenance = %+v, want both recorded", op.Sign, op.Provenance)
+	}
+	if op.Provenance.BuilderID != "https://ci.example.com/builders/main" || op.Provenance.Target != "//app:push" {
+		t.Errorf("provenance = %+v", op.Provenance)
+	}
+	wantStamp := map[string]string{"BUILD_SCM_REVISION": "4f2a9c1", "BUILD_TIMESTAMP": "1700000000", "STABLE_CHANNEL": "stable"}
+	if !reflect.DeepEqual(op.Provenance.Stamp, wantStamp) {
+		t.Errorf("stamp = %v, want %v", op.Provenance.Stamp, wantStamp)
+	}
+}
+
+// TestProvenanceNeedsSigning checks provenance is not recorded for a push that
+// is not signed: there would be no sign_setting to attest it with.
+func TestProvenanceNeedsSigning(t *testing.T) {
+	op := writePushMetadata(t, `{"registry":"reg.example.com","repository":"team/app","tags":["latest"]}`, func(string) {
+		provenanceEnabled = true
+		provenanceTarget = "//app:push"
+	})
+	if op.Provenance != nil {
+		t.Errorf("provenance = %+v, want none without signing", op.Provenance)
+	}
+}
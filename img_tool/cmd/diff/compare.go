@@ -0,0 +1,485 @@
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Statuses of a LayerDiff.
+const (
+	layerUnchanged = "unchanged"
+	// layerRecompressed is a layer with the same content in a different
+	// blob, e.g. compressed with another algorithm or level.
+	layerRecompressed = "recompressed"
+	layerModified     = "modified"
+	layerAdded        = "added"
+	layerRemoved      = "removed"
+)
+
+// Kinds of a FileChange and a ConfigChange.
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeModified = "modified"
+)
+
+// fieldOrder is the order the fields of a modified file are reported in.
+// Extended attributes follow, sorted by name.
+var fieldOrder = []string{"type", "size", "mode", "uid", "gid", "uname", "gname", "link", "sha256digest", "time"}
+
+// Report is everything `img diff` found out about two images. It is also the
+// JSON output, so its field names are part of the interface.
+type Report struct {
+	Old Side `json:"old"`
+	New Side `json:"new"`
+	// Identical is true when nothing differs: the manifests are the same, or
+	// for mtree specs, every layer is.
+	Identical bool `json:"identical"`
+	// Manifest lists the changed manifest annotations.
+	Manifest []ConfigChange `json:"manifest,omitempty"`
+	// Config lists the changed config fields. Configs are only compared when
+	// both sides are images.
+	Config []ConfigChange `json:"config,omitempty"`
+	Layers []LayerDiff    `json:"layers"`
+}
+
+// Side describes one of the two things compared.
+type Side struct {
+	Source string `json:"source"`
+	// Digest is the digest of the image manifest; empty for mtree specs.
+	Digest       string `json:"digest,omitempty"`
+	Platform     string `json:"platform,omitempty"`
+	ConfigDigest string `json:"config_digest,omitempty"`
+	Layers       int    `json:"layers"`
+}
+
+// ConfigChange is a changed field of the config or the manifest. Fields that
+// are maps or lists of settings (env, labels, annotations) are compared per
+// Key; the others are compared as a whole. A list is rendered as JSON.
+type ConfigChange struct {
+	Field  string `json:"field"`
+	Key    string `json:"key,omitempty"`
+	Change string `json:"change"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// LayerDiff pairs a layer of the old side with a layer of the new side. An
+// added layer has no old index, a removed layer no new index.
+type LayerDiff struct {
+	OldIndex     *int   `json:"old_index,omitempty"`
+	NewIndex     *int   `json:"new_index,omitempty"`
+	Status       string `json:"status"`
+	OldDigest    string `json:"old_digest,omitempty"`
+	NewDigest    string `json:"new_digest,omitempty"`
+	OldMediaType string `json:"old_media_type,omitempty"`
+	NewMediaType string `json:"new_media_type,omitempty"`
+	Added        int    `json:"added"`
+	Removed      int    `json:"removed"`
+	Modified     int    `json:"modified"`
+	// Files lists the changed entries, sorted by path.
+	Files []FileChange `json:"files,omitempty"`
+	// FilesUnavailable says why the files of a changed layer were not
+	// compared, e.g. because it is not a tar layer.
+	FilesUnavailable string `json:"files_unavailable,omitempty"`
+}
+
+// FileChange is an entry added to, removed from or modified in a layer.
+type FileChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	// Type is the mtree type of the entry (file, dir, link, ...): the new
+	// one, or the old one of a removed entry.
+	Type string `json:"type,omitempty"`
+	// Size is the size of an added or removed file.
+	Size int64 `json:"size,omitempty"`
+	// Fields lists what changed about a modified entry.
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange is a changed field of an entry: one of type, size, mode, uid,
+// gid, uname, gname, link, sha256digest, time, or xattr.<name> (base64).
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// compare compares two sides, reading the layers that differ.
+func compare(old, new *side) (*Report, error) {
+	report := &Report{
+		Old:    describeSide(old),
+		New:    describeSide(new),
+		Layers: []LayerDiff{},
+	}
+	if old.manifest != nil && new.manifest != nil {
+		report.Manifest = compareMaps("annotations", old.manifest.Annotations, new.manifest.Annotations)
+	}
+	if old.config != nil && new.config != nil {
+		report.Config = compareConfig(old.config, new.config)
+		if len(report.Config) == 0 && report.Old.ConfigDigest != report.New.ConfigDigest {
+			// Something none of the compared fields covers, such as
+			// the formatting of the JSON.
+			report.Config = append(report.Config, ConfigChange{Field: "config", Change: changeModified, Old: report.Old.ConfigDigest, New: report.New.ConfigDigest})
+		}
+	}
+
+	for _, pair := range pairLayers(old.layers, new.layers) {
+		layer, err := compareLayers(old.layers, new.layers, pair)
+		if err != nil {
+			return nil, err
+		}
+		report.Layers = append(report.Layers, layer)
+	}
+
+	if old.digest != "" && new.digest != "" {
+		report.Identical = old.digest == new.digest
+	} else {
+		report.Identical = len(report.Manifest) == 0 && len(report.Config) == 0
+		for _, layer := range report.Layers {
+			report.Identical = report.Identical && layer.Status == layerUnchanged
+		}
+	}
+	return report, nil
+}
+
+func describeSide(s *side) Side {
+	result := Side{Source: s.description, Digest: s.digest, Platform: s.platform, Layers: len(s.layers)}
+	if s.manifest != nil {
+		result.ConfigDigest = s.manifest.Config.Digest.String()
+	}
+	return result
+}
+
+// layerPair holds the indexes of a pair of layers; -1 for a missing layer.
+type layerPair struct {
+	old, new int
+}
+
+// pairLayers pairs the layers of the two sides. A new layer is paired with an
+// old layer of the same content first, so a layer that only moved or was
+// recompressed is not compared file by file; the rest are paired in order.
+// The pairs come in the order of the new layers, followed by the removed
+// layers.
+func pairLayers(old, new []layerSource) []layerPair {
+	pairs := make([]layerPair, len(new))
+	usedOld := make([]bool, len(old))
+	for j := range new {
+		pairs[j] = layerPair{old: -1, new: j}
+		for i := range old {
+			if !usedOld[i] && old[i].key == new[j].key {
+				pairs[j].old = i
+				usedOld[i] = true
+				break
+			}
+		}
+	}
+	var unpairedOld []int
+	for i := range old {
+		if !usedOld[i] {
+			unpairedOld = append(unpairedOld, i)
+		}
+	}
+	for j := range pairs {
+		if pairs[j].old == -1 && len(unpairedOld) > 0 {
+			pairs[j].old = unpairedOld[0]
+			unpairedOld = unpairedOld[1:]
+		}
+	}
+	for _, i := range unpairedOld {
+		pairs = append(pairs, layerPair{old: i, new: -1})
+	}
+	return pairs
+}
+
+// compareLayers compares a pair of layers, reading their entries when their
+// contents differ.
+func compareLayers(oldLayers, newLayers []layerSource, pair layerPair) (LayerDiff, error) {
+	var result LayerDiff
+	var old, new *layerSource
+	if pair.old >= 0 {
+		old = &oldLayers[pair.old]
+		result.OldIndex = &pair.old
+		result.OldDigest = old.digest
+		result.OldMediaType = old.mediaType
+	}
+	if pair.new >= 0 {
+		new = &newLayers[pair.new]
+		result.NewIndex = &pair.new
+		result.NewDigest = new.digest
+		result.NewMediaType = new.mediaType
+	}
+
+	switch {
+	case old == nil:
+		result.Status = layerAdded
+	case new == nil:
+		result.Status = layerRemoved
+	case old.key == new.key && old.digest == new.digest:
+		result.Status = layerUnchanged
+		return result, nil
+	case old.key == new.key:
+		result.Status = layerRecompressed
+		return result, nil
+	default:
+		result.Status = layerModified
+	}
+
+	for _, layer := range []*layerSource{old, new} {
+		if layer != nil && layer.open == nil {
+			result.FilesUnavailable = fmt.Sprintf("%s is not a tar layer", layer.digest)
+			return result, nil
+		}
+	}
+	oldEntries, err := readEntries(old)
+	if err != nil {
+		return LayerDiff{}, err
+	}
+	newEntries, err := readEntries(new)
+	if err != nil {
+		return LayerDiff{}, err
+	}
+
+	result.Files = compareEntries(oldEntries, newEntries)
+	for _, file := range result.Files {
+		switch file.Change {
+		case changeAdded:
+			result.Added++
+		case changeRemoved:
+			result.Removed++
+		case changeModified:
+			result.Modified++
+		}
+	}
+	return result, nil
+}
+
+// readEntries reads the entries of a layer; a missing layer has none.
+func readEntries(layer *layerSource) (*layerEntries, error) {
+	if layer == nil {
+		return &layerEntries{}, nil
+	}
+	entries, err := layer.open()
+	if err != nil {
+		return nil, fmt.Errorf("reading layer %s: %w", layer.key, err)
+	}
+	return entries, nil
+}
+
+// compareEntries lists the entries added, removed and modified between two
+// layers, sorted by path. A field is compared only when both layers were
+// recorded with it.
+func compareEntries(old, new *layerEntries) []FileChange {
+	paths := make(map[string]bool, len(old.files)+len(new.files))
+	for path := range old.files {
+		paths[path] = true
+	}
+	for path := range new.files {
+		paths[path] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var changes []FileChange
+	for _, path := range sorted {
+		oldKeywords, inOld := old.files[path]
+		newKeywords, inNew := new.files[path]
+		switch {
+		case !inOld:
+			changes = append(changes, entryChange(path, changeAdded, newKeywords))
+		case !inNew:
+			changes = append(changes, entryChange(path, changeRemoved, oldKeywords))
+		default:
+			fields := compareFields(oldKeywords, newKeywords, old.keywords, new.keywords)
+			if len(fields) > 0 {
+				changes = append(changes, FileChange{Path: path, Change: changeModified, Type: newKeywords["type"], Fields: fields})
+			}
+		}
+	}
+	return changes
+}
+
+func entryChange(path, change string, keywords map[string]string) FileChange {
+	size, _ := strconv.ParseInt(keywords["size"], 10, 64)
+	if keywords["type"] != "file" {
+		size = 0
+	}
+	return FileChange{Path: path, Change: change, Type: keywords["type"], Size: size}
+}
+
+// compareFields lists the fields that differ between two entries.
+func compareFields(old, new map[string]string, oldRecorded, newRecorded map[string]bool) []FieldChange {
+	var fields []FieldChange
+	for _, field := range fieldOrder {
+		if !oldRecorded[field] || !newRecorded[field] {
+			continue
+		}
+		if old[field] != new[field] {
+			fields = append(fields, FieldChange{Field: field, Old: old[field], New: new[field]})
+		}
+	}
+	if !oldRecorded["xattr"] || !newRecorded["xattr"] {
+		return fields
+	}
+	var xattrs []string
+	for _, keywords := range []map[string]string{old, new} {
+		for keyword := range keywords {
+			if fieldGroup(keyword) == "xattr" {
+				xattrs = append(xattrs, keyword)
+			}
+		}
+	}
+	sort.Strings(xattrs)
+	for i, xattr := range xattrs {
+		if i > 0 && xattrs[i-1] == xattr {
+			continue
+		}
+		if old[xattr] != new[xattr] {
+			fields = append(fields, FieldChange{Field: xattr, Old: old[xattr], New: new[xattr]})
+		}
+	}
+	return fields
+}
+
+// compareConfig lists the changed fields of two image configs.
+func compareConfig(old, new *v1.ConfigFile) []ConfigChange {
+	var changes []ConfigChange
+	scalar := func(field, oldValue, newValue string) {
+		if oldValue != newValue {
+			changes = append(changes, ConfigChange{Field: field, Change: changeKind(oldValue != "", newValue != ""), Old: oldValue, New: newValue})
+		}
+	}
+	platform := func(c *v1.ConfigFile) string {
+		return (&v1.Platform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant}).String()
+	}
+
+	scalar("platform", platform(old), platform(new))
+	scalar("created", formatTime(old.Created.Time), formatTime(new.Created.Time))
+	scalar("author", old.Author, new.Author)
+	scalar("entrypoint", jsonList(old.Config.Entrypoint), jsonList(new.Config.Entrypoint))
+	scalar("cmd", jsonList(old.Config.Cmd), jsonList(new.Config.Cmd))
+	changes = append(changes, compareMaps("env", envMap(old.Config.Env), envMap(new.Config.Env))...)
+	scalar("user", old.Config.User, new.Config.User)
+	scalar("working_dir", old.Config.WorkingDir, new.Config.WorkingDir)
+	scalar("exposed_ports", jsonList(sortedSet(old.Config.ExposedPorts)), jsonList(sortedSet(new.Config.ExposedPorts)))
+	scalar("volumes", jsonList(sortedSet(old.Config.Volumes)), jsonList(sortedSet(new.Config.Volumes)))
+	scalar("stop_signal", old.Config.StopSignal, new.Config.StopSignal)
+	changes = append(changes, compareMaps("labels", old.Config.Labels, new.Config.Labels)...)
+
+	// History entries are compared by position, the key being the index.
+	for i := 0; i < max(len(old.History), len(new.History)); i++ {
+		var oldEntry, newEntry string
+		if i < len(old.History) {
+			oldEntry = historyEntry(old.History[i])
+		}
+		if i < len(new.History) {
+			newEntry = historyEntry(new.History[i])
+		}
+		if oldEntry != newEntry {
+			changes = append(changes, ConfigChange{Field: "history", Key: strconv.Itoa(i), Change: changeKind(oldEntry != "", newEntry != ""), Old: oldEntry, New: newEntry})
+		}
+	}
+	return changes
+}
+
+// compareMaps lists the keys added to, removed from and changed in a map,
+// sorted by key.
+func compareMaps(field string, old, new map[string]string) []ConfigChange {
+	keys := make(map[string]bool)
+	for key := range old {
+		keys[key] = true
+	}
+	for key := range new {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var changes []ConfigChange
+	for _, key := range sorted {
+		oldValue, inOld := old[key]
+		newValue, inNew := new[key]
+		if inOld && inNew && oldValue == newValue {
+			continue
+		}
+		changes = append(changes, ConfigChange{Field: field, Key: key, Change: changeKind(inOld, inNew), Old: oldValue, New: newValue})
+	}
+	return changes
+}
+
+func changeKind(inOld, inNew bool) string {
+	switch {
+	case !inOld:
+		return changeAdded
+	case !inNew:
+		return changeRemoved
+	default:
+		return changeModified
+	}
+}
+
+// envMap maps the variables of an env list to their values. A variable set
+// twice keeps its last value, as in a container.
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		m[key] = value
+	}
+	return m
+}
+
+func sortedSet(set map[string]struct{}) []string {
+	values := make([]string, 0, len(set))
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// historyEntry renders a history entry as JSON.
+func historyEntry(h v1.History) string {
+	data, err := json.Marshal(struct {
+		Created    string `json:"created,omitempty"`
+		CreatedBy  string `json:"created_by,omitempty"`
+		Comment    string `json:"comment,omitempty"`
+		EmptyLayer bool   `json:"empty_layer,omitempty"`
+	}{formatTime(h.Created.Time), h.CreatedBy, h.Comment, h.EmptyLayer})
+	if err != nil {
+		return h.CreatedBy
+	}
+	return string(data)
+}
+
+// jsonList renders a list the way a Dockerfile's exec form spells it, so
+// items with spaces stay recognizable. An empty list renders as "".
+func jsonList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return strings.Join(values, " ")
+	}
+	return string(data)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
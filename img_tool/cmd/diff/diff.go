@@ -0,0 +1,111 @@
+// Package diff implements `img diff`: a file-level comparison of two images
+// or layers, for finding out why an image digest changed.
+//
+// Each side is a registry reference, an OCI layout directory or a list of
+// mtree specs as written by `img mtree`. The layers of the two sides are
+// paired up: layers with the same content (diff ID) are unchanged, even when
+// they moved or were compressed differently, and the remaining layers are
+// paired in order. For every pair whose content differs, the files of the two
+// layers are compared: which were added or removed, and for the others which
+// of type, size, mode, owner, link target, modification time, extended
+// attributes and content digest changed. Only those layers are read, so
+// comparing two builds that share their base layers downloads little.
+//
+// For images the config is compared as well (entrypoint, cmd, env, user,
+// labels, ports, history, ...) along with the manifest annotations. The
+// report is printed for people or, with --format=json, as JSON for scripts.
+package diff
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+func DiffProcess(ctx context.Context, args []string) {
+	var platform, format string
+	var limit int
+
+	flagSet := flag.NewFlagSet("diff", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Compares two images or layers file by file, and their configs.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img diff [OPTIONS] OLD NEW\n\n")
+		fmt.Fprintf(flagSet.Output(), "OLD and NEW are each one of:\n")
+		fmt.Fprintf(flagSet.Output(), "  - an OCI layout directory holding a single image or index\n")
+		fmt.Fprintf(flagSet.Output(), "  - an mtree spec written by `img mtree`, or a comma-separated list of them (one per layer)\n")
+		fmt.Fprintf(flagSet.Output(), "  - a tag or digest reference of an image in a registry, read through the pull gateway\n")
+		fmt.Fprintf(flagSet.Output(), "    when configured\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img diff registry.example.com/team/app:v1 registry.example.com/team/app:v2",
+			"img diff --platform linux/arm64 registry.example.com/team/app:v1 bazel-bin/app/image_oci_layout",
+			"img diff --format=json old/image_oci_layout new/image_oci_layout",
+			"img diff old/base.mtree,old/app.mtree new/base.mtree,new/app.mtree",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+
+	flagSet.StringVar(&platform, "platform", "", "Platform to compare when a side is an index of several, e.g. linux/arm64")
+	flagSet.StringVar(&format, "format", "human", `Output format: "human" or "json"`)
+	flagSet.IntVar(&limit, "limit", 50, "Maximum number of changed files listed per layer in the human output (0 for all)")
+
+	if err := flagSet.Parse(args); err != nil {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if format != "human" && format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: --format must be \"human\" or \"json\", not %q\n", format)
+		os.Exit(1)
+	}
+	if flagSet.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Error: expected OLD and NEW\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	pull, err := registryopts.Pull()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: configuring pull transport: %v\n", err)
+		os.Exit(1)
+	}
+	oldSide, err := openSide(ctx, flagSet.Arg(0), platform, pull.Remote())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	newSide, err := openSide(ctx, flagSet.Arg(1), platform, pull.Remote())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	report, err := compare(oldSide, newSide)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := write(os.Stdout, report, format, limit); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// write prints the report in the given format. limit only applies to the
+// human output; the JSON output lists every change.
+func write(w io.Writer, report *Report, format string, limit int) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	writeHuman(w, report, limit)
+	return nil
+}
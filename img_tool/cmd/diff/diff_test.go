@@ -0,0 +1,204 @@
+package diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+)
+
+func TestDiffLayouts(t *testing.T) {
+	baseEntries := []testimage.Entry{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "etc/hosts", Content: "127.0.0.1 localhost\n", Mode: 0o644},
+	}
+	oldDir := testimage.WriteLayout(t, []v1.Layer{
+		testimage.Layer(t, baseEntries, gzip.BestCompression),
+		testimage.Layer(t, []testimage.Entry{
+			{Name: "app/main", Content: "v1", Mode: 0o755},
+			{Name: "app/config", Content: "debug = false\n", Mode: 0o644},
+			{Name: "app/old", Content: "gone soon", Mode: 0o644},
+		}, gzip.DefaultCompression),
+	}, func(c *v1.Config) {
+		c.Env = []string{"PATH=/usr/bin", "DEBUG=0"}
+		c.Entrypoint = []string{"/app/main"}
+	})
+	newDir := testimage.WriteLayout(t, []v1.Layer{
+		// The same base layer, compressed differently.
+		testimage.Layer(t, baseEntries, gzip.BestSpeed),
+		testimage.Layer(t, []testimage.Entry{
+			{Name: "app/main", Content: "v2", Mode: 0o755},
+			{Name: "app/config", Content: "debug = false\n", Mode: 0o600, PAXRecords: map[string]string{"SCHILY.xattr.user.origin": "build"}},
+			{Name: "app/new", Content: "hello", Mode: 0o644},
+		}, gzip.DefaultCompression),
+	}, func(c *v1.Config) {
+		c.Env = []string{"PATH=/usr/local/bin:/usr/bin"}
+		c.Entrypoint = []string{"/app/main"}
+		c.Labels = map[string]string{"version": "2"}
+	})
+
+	ctx := context.Background()
+	oldSide, err := openSide(ctx, oldDir, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSide, err := openSide(ctx, newDir, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := compare(oldSide, newSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Identical {
+		t.Fatal("images reported identical")
+	}
+
+	wantConfig := []ConfigChange{
+		{Field: "env", Key: "DEBUG", Change: changeRemoved, Old: "0"},
+		{Field: "env", Key: "PATH", Change: changeModified, Old: "/usr/bin", New: "/usr/local/bin:/usr/bin"},
+		{Field: "labels", Key: "version", Change: changeAdded, New: "2"},
+	}
+	if len(report.Config) != len(wantConfig) {
+		t.Fatalf("config changes = %+v, want %+v", report.Config, wantConfig)
+	}
+	for i, want := range wantConfig {
+		if report.Config[i] != want {
+			t.Errorf("config change %d = %+v, want %+v", i, report.Config[i], want)
+		}
+	}
+
+	if len(report.Layers) != 2 {
+		t.Fatalf("got %d layer diffs, want 2", len(report.Layers))
+	}
+	if base := report.Layers[0]; base.Status != layerRecompressed || len(base.Files) != 0 {
+		t.Errorf("base layer = %+v, want recompressed without files", base)
+	}
+	app := report.Layers[1]
+	if app.Status != layerModified || app.Added != 1 || app.Removed != 1 || app.Modified != 2 {
+		t.Fatalf("app layer = %+v, want 1 added, 1 removed and 2 modified", app)
+	}
+	changes := make(map[string]FileChange)
+	for _, file := range app.Files {
+		changes[file.Path] = file
+	}
+	if got := changes["/app/new"]; got.Change != changeAdded || got.Type != "file" || got.Size != 5 {
+		t.Errorf("/app/new = %+v", got)
+	}
+	if got := changes["/app/old"]; got.Change != changeRemoved || got.Size != 9 {
+		t.Errorf("/app/old = %+v", got)
+	}
+	if got := fieldNames(changes["/app/main"].Fields); got != "sha256digest" {
+		t.Errorf("/app/main changed %s, want its content digest", got)
+	}
+	if got := fieldNames(changes["/app/config"].Fields); got != "mode xattr.user.origin" {
+		t.Errorf("/app/config changed %s, want its mode and xattr", got)
+	}
+
+	var human bytes.Buffer
+	if err := write(&human, report, "human", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"#0 recompressed",
+		"same content",
+		"#1 modified",
+		"1 added, 1 removed, 2 modified",
+		"+ /app/new (file, 5 B)",
+		"- /app/old (file, 9 B)",
+		"~ /app/config: mode 0644 -> 0600, xattr.user.origin (none) -> YnVpbGQ=",
+		"~ env PATH: /usr/bin -> /usr/local/bin:/usr/bin",
+		"+ labels version: 2",
+	} {
+		if !strings.Contains(human.String(), want) {
+			t.Errorf("human output lacks %q:\n%s", want, human.String())
+		}
+	}
+
+	// An image compared with itself has no differences.
+	report, err = compare(oldSide, oldSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Identical || len(report.Config) != 0 || report.Layers[1].Status != layerUnchanged {
+		t.Errorf("image differs from itself: %+v", report)
+	}
+}
+
+func TestDiffMtrees(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := writeFile("base.mtree", "#mtree v2.0\n./etc type=dir mode=0755\n./etc/hosts type=file size=4 mode=0644\n")
+	oldApp := writeFile("old.mtree", "#mtree v2.0\n./app/main type=file size=2 mode=0755 uid=0\n./app/link type=link link=main\n")
+	// Written without uids: the owner of app/main is not compared.
+	newApp := writeFile("new.mtree", "#mtree v2.0\n./app/main type=file size=3 mode=0755\n./app/link type=link link=other\n")
+
+	oldSide, err := openSide(context.Background(), base+","+oldApp, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSide, err := openSide(context.Background(), base+","+newApp, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := compare(oldSide, newSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Identical || report.Layers[0].Status != layerUnchanged {
+		t.Fatalf("report = %+v, want a difference in the second layer only", report)
+	}
+	app := report.Layers[1]
+	if app.Modified != 2 || app.Added != 0 || app.Removed != 0 {
+		t.Fatalf("app layer = %+v, want 2 modified", app)
+	}
+	if got := fieldNames(app.Files[0].Fields); app.Files[0].Path != "/app/link" || got != "link" {
+		t.Errorf("first change = %+v", app.Files[0])
+	}
+	if got := fieldNames(app.Files[1].Fields); app.Files[1].Path != "/app/main" || got != "size" {
+		t.Errorf("second change = %+v", app.Files[1])
+	}
+}
+
+func TestPairLayers(t *testing.T) {
+	layers := func(keys ...string) []layerSource {
+		var result []layerSource
+		for _, key := range keys {
+			result = append(result, layerSource{key: key})
+		}
+		return result
+	}
+	// b moved to the front, c changed into d, and e was removed.
+	got := pairLayers(layers("a", "b", "c", "e"), layers("b", "a", "d"))
+	want := []layerPair{{old: 1, new: 0}, {old: 0, new: 1}, {old: 2, new: 2}, {old: 3, new: -1}}
+	if len(got) != len(want) {
+		t.Fatalf("pairs = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("pairs = %v, want %v", got, want)
+		}
+	}
+}
+
+func fieldNames(fields []FieldChange) string {
+	var names []string
+	for _, field := range fields {
+		names = append(names, field.Field)
+	}
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,173 @@
+package diff
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeHuman renders the report for reading in a terminal, listing at most
+// limit changed files per layer (0 for all). Everything in it is also in the
+// JSON output, which is what scripts should use.
+func writeHuman(w io.Writer, report *Report, limit int) {
+	writeSide(w, "old:", report.Old)
+	writeSide(w, "new:", report.New)
+	fmt.Fprintln(w)
+	if report.Identical {
+		fmt.Fprintln(w, "No differences.")
+		return
+	}
+
+	if len(report.Manifest) > 0 {
+		fmt.Fprintln(w, "Manifest:")
+		writeConfigChanges(w, report.Manifest)
+		fmt.Fprintln(w)
+	}
+	if len(report.Config) > 0 {
+		fmt.Fprintln(w, "Config:")
+		writeConfigChanges(w, report.Config)
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w, "Layers:")
+	for _, layer := range report.Layers {
+		writeLayer(w, layer, limit)
+	}
+}
+
+func writeSide(w io.Writer, label string, side Side) {
+	fmt.Fprintf(w, "%s %s", label, side.Source)
+	var details []string
+	if side.Digest != "" {
+		details = append(details, side.Digest)
+	}
+	if side.Platform != "" {
+		details = append(details, side.Platform)
+	}
+	details = append(details, fmt.Sprintf("%d layers", side.Layers))
+	fmt.Fprintf(w, " (%s)\n", strings.Join(details, ", "))
+}
+
+func writeConfigChanges(w io.Writer, changes []ConfigChange) {
+	for _, change := range changes {
+		name := change.Field
+		if change.Key != "" {
+			name += " " + change.Key
+		}
+		switch change.Change {
+		case changeAdded:
+			fmt.Fprintf(w, "  + %s: %s\n", name, change.New)
+		case changeRemoved:
+			fmt.Fprintf(w, "  - %s: %s\n", name, change.Old)
+		default:
+			fmt.Fprintf(w, "  ~ %s: %s -> %s\n", name, change.Old, change.New)
+		}
+	}
+}
+
+func writeLayer(w io.Writer, layer LayerDiff, limit int) {
+	var position string
+	switch {
+	case layer.NewIndex == nil:
+		position = fmt.Sprintf("old #%d", *layer.OldIndex)
+	case layer.OldIndex == nil || *layer.OldIndex == *layer.NewIndex:
+		position = fmt.Sprintf("#%d", *layer.NewIndex)
+	default:
+		position = fmt.Sprintf("#%d (old #%d)", *layer.NewIndex, *layer.OldIndex)
+	}
+
+	digests := layer.NewDigest
+	switch {
+	case layer.NewIndex == nil:
+		digests = layer.OldDigest
+	case layer.OldIndex != nil && layer.OldDigest != layer.NewDigest:
+		digests = layer.OldDigest + " -> " + layer.NewDigest
+	}
+	line := fmt.Sprintf("  %s %s", position, layer.Status)
+	if digests != "" {
+		line += "  " + digests
+	}
+	switch layer.Status {
+	case layerUnchanged:
+		fmt.Fprintln(w, line)
+		return
+	case layerRecompressed:
+		if layer.OldMediaType != layer.NewMediaType {
+			line += fmt.Sprintf(" (%s -> %s)", layer.OldMediaType, layer.NewMediaType)
+		}
+		fmt.Fprintf(w, "%s, same content\n", line)
+		return
+	}
+	if layer.FilesUnavailable != "" {
+		fmt.Fprintf(w, "%s\n       files: unavailable: %s\n", line, layer.FilesUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "%s: %d added, %d removed, %d modified\n", line, layer.Added, layer.Removed, layer.Modified)
+
+	for i, file := range layer.Files {
+		if limit > 0 && i == limit {
+			fmt.Fprintf(w, "       ... and %d more\n", len(layer.Files)-limit)
+			break
+		}
+		switch file.Change {
+		case changeAdded:
+			fmt.Fprintf(w, "       + %s (%s)\n", file.Path, describeEntry(file))
+		case changeRemoved:
+			fmt.Fprintf(w, "       - %s (%s)\n", file.Path, describeEntry(file))
+		default:
+			var fields []string
+			for _, field := range file.Fields {
+				fields = append(fields, fmt.Sprintf("%s %s -> %s", fieldName(field.Field), shortValue(field.Field, field.Old), shortValue(field.Field, field.New)))
+			}
+			fmt.Fprintf(w, "       ~ %s: %s\n", file.Path, strings.Join(fields, ", "))
+		}
+	}
+}
+
+// describeEntry describes an added or removed entry by its type, and a file
+// by its size.
+func describeEntry(file FileChange) string {
+	if file.Type == "file" {
+		return "file, " + humanizeBytes(file.Size)
+	}
+	return file.Type
+}
+
+// fieldName names a field the way people know it.
+func fieldName(field string) string {
+	switch field {
+	case "sha256digest":
+		return "sha256"
+	case "time":
+		return "mtime"
+	}
+	return field
+}
+
+// shortValue abbreviates content digests to 12 hex digits and renders a
+// missing value as "(none)".
+func shortValue(field, value string) string {
+	switch {
+	case value == "":
+		return "(none)"
+	case field == "sha256digest" && len(value) > 12:
+		return value[:12]
+	}
+	return value
+}
+
+// humanizeBytes renders a byte count with a binary unit.
+func humanizeBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return fmt.Sprintf("%.1f PiB", value/unit)
+}
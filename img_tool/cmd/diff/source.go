@@ -0,0 +1,260 @@
+package diff
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/ocilayout"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// entryKeywords are the mtree fields a layer blob is rendered with for the
+// comparison. The link count is left out: it says nothing about a layer that
+// its entries do not already say.
+var entryKeywords = []string{"type", "size", "mode", "uid", "uname", "gid", "gname", "sha256", "time", "link", "xattr"}
+
+// side is one of the two things being compared: the single image of a
+// registry reference or an OCI layout, or a list of mtree specs.
+type side struct {
+	// description names the side in the report.
+	description string
+	// digest is the digest of the image manifest; empty for mtree specs.
+	digest   string
+	platform string
+	// manifest and config are nil for mtree specs.
+	manifest *v1.Manifest
+	config   *v1.ConfigFile
+	layers   []layerSource
+}
+
+// layerSource is a layer of a side, read only when it has to be compared file
+// by file.
+type layerSource struct {
+	// key identifies the layer's content: the diff ID of a layer blob, the
+	// digest of an mtree spec. Layers with equal keys are not compared.
+	key       string
+	digest    string
+	mediaType string
+	// open reads the layer's entries.
+	open func() (*layerEntries, error)
+}
+
+// layerEntries are the entries of a layer, each with its mtree keywords.
+type layerEntries struct {
+	// files maps the absolute path of an entry to its keywords, e.g.
+	// "type"->"file", "mode"->"0644", "sha256digest"->"<hex>".
+	files map[string]map[string]string
+	// keywords is the set of fields the entries were recorded with ("xattr"
+	// standing for all extended attributes). A field is only compared when
+	// both layers were recorded with it, so an mtree spec written without
+	// content digests does not make every file look modified.
+	keywords map[string]bool
+}
+
+// openSide opens a side by the form of its argument: an existing directory is
+// an OCI layout, an existing file or a comma-separated list is a list of mtree
+// specs, and anything else is a registry reference.
+func openSide(ctx context.Context, arg, platform string, opts []remote.Option) (*side, error) {
+	first, _, isList := strings.Cut(arg, ",")
+	info, err := os.Stat(first)
+	switch {
+	case err == nil && info.IsDir() && !isList:
+		return openLayout(arg, platform)
+	case err == nil || isList:
+		return openMtrees(strings.Split(arg, ","))
+	default:
+		return openRegistry(ctx, arg, platform, opts)
+	}
+}
+
+// openRegistry reads the image a tag or digest reference points at.
+func openRegistry(ctx context.Context, raw, platform string, opts []remote.Option) (*side, error) {
+	ref, err := name.ParseReference(raw, registryopts.NameOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", raw, err)
+	}
+	image, p, err := ocilayout.FetchImage(ctx, ref, platform, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if p != "" {
+		platform = p
+	}
+	return imageSide(ref.Name(), image, platform)
+}
+
+// openLayout reads the single image of an OCI layout, chosen by platform
+// when the layout holds an index.
+func openLayout(dir, platform string) (*side, error) {
+	l, err := ocilayout.Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	image, p, err := l.Image(platform)
+	if err != nil {
+		return nil, err
+	}
+	if p != "" {
+		platform = p
+	}
+	return imageSide(dir, image, platform)
+}
+
+// imageSide describes an image for the comparison. Its layers are read
+// lazily.
+func imageSide(description string, image v1.Image, platform string) (*side, error) {
+	manifest, err := image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return nil, err
+	}
+	config, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	if platform == "" {
+		platform = (&v1.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}).String()
+	}
+	s := &side{
+		description: description,
+		digest:      digest.String(),
+		platform:    platform,
+		manifest:    manifest,
+		config:      config,
+	}
+	for i, desc := range manifest.Layers {
+		layer := layerSource{
+			key:       desc.Digest.String(),
+			digest:    desc.Digest.String(),
+			mediaType: string(desc.MediaType),
+		}
+		if i < len(config.RootFS.DiffIDs) {
+			layer.key = config.RootFS.DiffIDs[i].String()
+		}
+		if isTarLayer(string(desc.MediaType)) {
+			digest := desc.Digest
+			layer.open = func() (*layerEntries, error) {
+				blob, err := image.LayerByDigest(digest)
+				if err != nil {
+					return nil, err
+				}
+				return blobEntries(blob)
+			}
+		}
+		s.layers = append(s.layers, layer)
+	}
+	return s, nil
+}
+
+// openMtrees describes a list of mtree specs, one per layer. An mtree of a
+// whole image filesystem (--layout oci_layer_filesystem_applied_changeset)
+// works as a single layer.
+func openMtrees(paths []string) (*side, error) {
+	s := &side{description: strings.Join(paths, ",")}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.layers = append(s.layers, layerSource{
+			key: fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+			open: func() (*layerEntries, error) {
+				entries, err := mtreeEntries(bytes.NewReader(data), nil)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+				return entries, nil
+			},
+		})
+	}
+	return s, nil
+}
+
+// isTarLayer reports whether a layer media type is a (possibly compressed)
+// tar, as opposed to an artifact blob.
+func isTarLayer(mediaType string) bool {
+	return strings.Contains(mediaType, "tar")
+}
+
+// blobEntries reads the entries of a layer blob by rendering it as an mtree
+// spec, so that blobs and mtree specs are compared in the same terms. The
+// blob is decompressed by its magic rather than trusted to match its media
+// type.
+func blobEntries(layer v1.Layer) (*layerEntries, error) {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	r, err := mtree.Decompress(rc)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+	var spec bytes.Buffer
+	opts := mtree.Options{PathPrefix: "./", Keywords: entryKeywords, Layout: mtree.LayoutTar}
+	if err := mtree.Write(r, &spec, opts, mtree.HashContent); err != nil {
+		return nil, err
+	}
+	keywords := make(map[string]bool)
+	for _, keyword := range entryKeywords {
+		keywords[keywordName(keyword)] = true
+	}
+	return mtreeEntries(&spec, keywords)
+}
+
+// mtreeEntries reads the entries of an mtree spec. keywords is the set of
+// fields the spec was written with; when nil, it is the set of fields found in
+// the spec. Later entries for a path replace earlier ones, as in a tar.
+func mtreeEntries(r io.Reader, keywords map[string]bool) (*layerEntries, error) {
+	parsed, err := mtree.ParseEntries(r)
+	if err != nil {
+		return nil, err
+	}
+	entries := &layerEntries{files: make(map[string]map[string]string, len(parsed)), keywords: keywords}
+	if entries.keywords == nil {
+		entries.keywords = make(map[string]bool)
+	}
+	for _, entry := range parsed {
+		delete(entry.Keywords, "nlink")
+		if keywords == nil {
+			for keyword := range entry.Keywords {
+				entries.keywords[fieldGroup(keyword)] = true
+			}
+		}
+		entries.files["/"+entry.Path] = entry.Keywords
+	}
+	return entries, nil
+}
+
+// keywordName maps an mtree option name to the keyword it writes.
+func keywordName(option string) string {
+	if option == "sha256" {
+		return "sha256digest"
+	}
+	return option
+}
+
+// fieldGroup maps a keyword to the field it belongs to: every extended
+// attribute belongs to "xattr".
+func fieldGroup(keyword string) string {
+	if strings.HasPrefix(keyword, "xattr.") {
+		return "xattr"
+	}
+	return keyword
+}
@@ -0,0 +1,301 @@
+// Package flatten implements `img flatten`: it squashes the layers of an image
+// into a single layer.
+//
+// The layers are given in order, as layer tars (gzip, zstd or uncompressed) or
+// compact streams, whose CAS-referenced content is read from --cas-dir. They
+// are applied in order with the whiteout semantics of OCI layers: a whiteout
+// deletes a path of the lower layers, an opaque whiteout the lower layers'
+// contents of its directory, and a later entry of a path replaces an earlier
+// one (a file replacing a directory takes the directory's contents along).
+// What remains is written as one layer, either a tar or an EROFS image, in any
+// supported compression. Hardlinks whose original path did not survive become
+// regular files.
+//
+// With --source-manifest and --source-config, the manifest and config of the
+// image are rewritten for the merged layer, with the rewrite of `img optimize`.
+// The history of the config is collapsed: all its entries are kept, marked as
+// creating no layer, and one entry for the merged layer is appended.
+package flatten
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compress"
+	erofs "github.com/bazel-contrib/rules_img/img_tool/pkg/go-erofs"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/imagerewrite"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerinput"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/metadata"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
+)
+
+func FlattenProcess(ctx context.Context, args []string) {
+	var inputs layerinput.List
+	var casDir, layerFormat, formatFlag, compressorJobsFlag, history string
+	var compressionLevel int
+	var metadataOutput, sourceManifest, sourceConfig, manifestOutput, configOutput string
+
+	flagSet := flag.NewFlagSet("flatten", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Squashes the layers of an image into a single layer, applying whiteouts.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img flatten [OPTIONS] (--tar <tar> | --cstream <cstream>)... <output>\n\n")
+		fmt.Fprintf(flagSet.Output(), "Every --tar and --cstream flag is a layer, from the lowest to the topmost.\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img flatten --tar base.tgz --tar app.tgz --metadata flat.json flat.tgz",
+			"img flatten --layer-format erofs --format zstd --tar base.tgz --tar app.tgz flat.erofs.zst",
+			"img flatten --cas-dir cas --cstream base.tgz.cstream --cstream app.tgz.cstream --source-manifest manifest.json --source-config config.json --manifest flat_manifest.json --config flat_config.json flat.tgz",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+	flagSet.Var(inputs.Flag(layerinput.Tar), "tar", "Add a layer tar blob (may be gzip- or zstd-compressed). Repeatable.")
+	flagSet.Var(inputs.Flag(layerinput.CStream), "cstream", "Add a layer compact stream (.cstream). Repeatable; requires --cas-dir.")
+	flagSet.StringVar(&casDir, "cas-dir", "", "Content-addressed directory (sha256/<hex>) holding the content the compact streams reference.")
+	flagSet.StringVar(&layerFormat, "layer-format", "tar", `The format of the merged layer: "tar" or "erofs". EROFS layers can only be run by runtimes that mount them directly.`)
+	flagSet.StringVar(&formatFlag, "format", "gzip", `The compression of the merged layer: "gzip", "zstd" or "none".`)
+	flagSet.StringVar(&compressorJobsFlag, "compressor-jobs", "1", `Number of compressor jobs. 1 uses single-threaded stdlib gzip. n>1 uses pgzip. "nproc" uses NumCPU.`)
+	flagSet.IntVar(&compressionLevel, "compression-level", -1, `Compression level. For gzip: 0-9. If unset, use library default.`)
+	flagSet.StringVar(&history, "history", "", `created_by recorded for the merged layer, in its metadata and the config's history. Defaults to "img flatten (<n> layers)".`)
+	flagSet.StringVar(&metadataOutput, "metadata", "", `Write the metadata of the merged layer to the specified file, as "img layer --metadata" does.`)
+	flagSet.StringVar(&sourceManifest, "source-manifest", "", "Image manifest to rewrite for the merged layer.")
+	flagSet.StringVar(&sourceConfig, "source-config", "", "Image config to rewrite for the merged layer.")
+	flagSet.StringVar(&manifestOutput, "manifest", "", "Output image manifest. Requires --source-manifest and --source-config.")
+	flagSet.StringVar(&configOutput, "config", "", "Output image config. Requires --source-manifest and --source-config.")
+
+	if err := flagSet.Parse(args); err != nil {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if len(inputs) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: at least one of --tar or --cstream is required\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if flagSet.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Error: exactly one output file is required\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	outputPath := flagSet.Arg(0)
+	rewrite := sourceManifest != "" || sourceConfig != "" || manifestOutput != "" || configOutput != ""
+	if rewrite && (sourceManifest == "" || sourceConfig == "") {
+		fmt.Fprintf(os.Stderr, "Error: rewriting the image requires both --source-manifest and --source-config\n")
+		os.Exit(1)
+	}
+
+	var compression api.CompressionAlgorithm
+	switch formatFlag {
+	case "gzip":
+		compression = api.Gzip
+	case "zstd":
+		compression = api.Zstd
+	case "none", "uncompressed":
+		compression = api.Uncompressed
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format %s. Supported formats are gzip, zstd and none.\n", formatFlag)
+		os.Exit(1)
+	}
+	mediaType, err := layerMediaType(layerFormat, compression)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	var store compactstream.BlobStore = compactstream.NullBlobStore{}
+	for _, input := range inputs {
+		if input.Kind == layerinput.CStream && casDir == "" {
+			fmt.Fprintf(os.Stderr, "Error: --cstream %s requires --cas-dir for the content it references\n", input.Path)
+			os.Exit(1)
+		}
+	}
+	if casDir != "" {
+		store = &dirStore{shaDir: filepath.Join(casDir, "sha256")}
+	}
+	if history == "" {
+		history = fmt.Sprintf("img flatten (%d layers)", len(inputs))
+	}
+
+	layers := make([]layerOpener, len(inputs))
+	for i, input := range inputs {
+		layers[i] = func() (io.ReadCloser, error) { return openLayer(ctx, input, store) }
+	}
+
+	var opts []compress.Option
+	if compressionLevel >= 0 {
+		opts = append(opts, compress.CompressionLevel(compressionLevel))
+	}
+	if compressorJobsFlag == "nproc" {
+		opts = append(opts, compress.CompressorJobs(runtime.NumCPU()))
+	} else if n, err := strconv.Atoi(compressorJobsFlag); err == nil {
+		opts = append(opts, compress.CompressorJobs(n))
+	}
+	state, err := writeLayer(layers, layerFormat, compression, outputPath, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	layer := api.Descriptor{
+		DiffID:    fmt.Sprintf("sha256:%x", state.ContentHash),
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", state.OuterHash),
+		Size:      state.CompressedSize,
+	}
+	if metadataOutput != "" {
+		if err := writeMetadata(layer, state, history, metadataOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing metadata: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if rewrite {
+		if err := rewriteImage(sourceManifest, sourceConfig, layer, history, manifestOutput, configOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rewriting image: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// writeLayer flattens the layers into the output file and returns the state
+// of its compressor, which holds the digests and size of the merged layer.
+func writeLayer(layers []layerOpener, layerFormat string, compression api.CompressionAlgorithm, outputPath string, opts []compress.Option) (state api.AppenderState, err error) {
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return state, err
+	}
+	defer func() { err = errors.Join(err, out.Close()) }()
+	appender, err := compress.AppenderFactory(string(api.SHA256), string(compression), out, append(opts, compress.ContentType(layerFormat))...)
+	if err != nil {
+		return state, fmt.Errorf("creating compressor: %w", err)
+	}
+	tempDir := filepath.Dir(outputPath)
+
+	switch layerFormat {
+	case "tar":
+		tw := tar.NewWriter(appender)
+		if err := flattenLayers(layers, &tarEntryWriter{tw: tw}, tempDir); err != nil {
+			return state, err
+		}
+		if err := tw.Close(); err != nil {
+			return state, err
+		}
+	case "erofs":
+		// A fixed build time keeps the image reproducible.
+		fsys := erofs.NewWriter(erofs.WithBuildTime(0, 0), erofs.WithTempDir(tempDir))
+		if err := flattenLayers(layers, &erofsEntryWriter{fsys: fsys}, tempDir); err != nil {
+			return state, err
+		}
+		if _, err := fsys.WriteTo(appender); err != nil {
+			return state, fmt.Errorf("writing EROFS image: %w", err)
+		}
+	}
+	return appender.Finalize()
+}
+
+// writeMetadata writes the metadata of the merged layer, in the format of
+// `img layer --metadata`.
+func writeMetadata(layer api.Descriptor, state api.AppenderState, history, path string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, f.Close()) }()
+	return metadata.WriteLayerMetadata(layer.DiffID, layer.MediaType, layer.Digest, layer.Size, state.LayerAnnotations, api.LayerHistory(history), f)
+}
+
+// rewriteImage points the manifest and config at the merged layer and
+// collapses the config's history.
+func rewriteImage(sourceManifest, sourceConfig string, layer api.Descriptor, history, manifestOutput, configOutput string) error {
+	manifest, err := imagerewrite.ReadManifest(sourceManifest)
+	if err != nil {
+		return err
+	}
+	config, err := imagerewrite.ReadConfig(sourceConfig)
+	if err != nil {
+		return err
+	}
+	collapseHistory(&config, history)
+	manifestRaw, configRaw, err := imagerewrite.ReplaceLayers(&manifest, &config, []api.Descriptor{layer})
+	if err != nil {
+		return err
+	}
+	if configOutput != "" {
+		if err := os.WriteFile(configOutput, configRaw, 0o644); err != nil {
+			return fmt.Errorf("writing config: %w", err)
+		}
+	}
+	if manifestOutput != "" {
+		if err := os.WriteFile(manifestOutput, manifestRaw, 0o644); err != nil {
+			return fmt.Errorf("writing manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// openLayer returns the uncompressed tar stream of a layer.
+func openLayer(ctx context.Context, ref layerinput.Input, store compactstream.BlobStore) (io.ReadCloser, error) {
+	f, err := os.Open(ref.Path)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Kind == layerinput.CStream {
+		reader, err := compactstream.NewReconstructingReader(ctx, f, store)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading %s: %w", ref.Path, err)
+		}
+		return &layerReader{Reader: reader, closers: []io.Closer{reader, f}}, nil
+	}
+	r, err := mtree.Decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %w", ref.Path, err)
+	}
+	closers := []io.Closer{f}
+	if closer, ok := r.(io.Closer); ok {
+		closers = []io.Closer{closer, f}
+	}
+	return &layerReader{Reader: r, closers: closers}, nil
+}
+
+// layerReader is the tar stream of a layer, closing the readers it is
+// decoded from.
+type layerReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (l *layerReader) Close() error {
+	var err error
+	for _, closer := range l.closers {
+		err = errors.Join(err, closer.Close())
+	}
+	return err
+}
+
+// dirStore is a compactstream.BlobStore backed by a content-addressed directory, where
+// each blob is stored at sha256/<hex of content>.
+type dirStore struct {
+	shaDir string
+}
+
+func (s *dirStore) ReaderForBlob(_ context.Context, digest []byte, size int64) (io.ReadCloser, error) {
+	path := filepath.Join(s.shaDir, hex.EncodeToString(digest))
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("blob sha256:%s (size %d) not found in content-addressed directory: %w", hex.EncodeToString(digest), size, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,274 @@
+package flatten
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	erofs "github.com/bazel-contrib/rules_img/img_tool/pkg/go-erofs"
+)
+
+func TestFlattenLayers(t *testing.T) {
+	layers := []layerOpener{
+		tarLayer(t, []testimage.Entry{
+			{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "./etc/hosts", Content: "old hosts"},
+			{Name: "./usr/share/doc/readme", Content: "readme"},
+			{Name: "./var/cache/a", Content: "a"},
+			{Name: "./opt/data", Content: "shared"},
+			{Name: "./opt/link", Typeflag: tar.TypeLink, Linkname: "./opt/data"},
+			{Name: "./srv/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "./srv/www/index.html", Content: "index"},
+		}),
+		tarLayer(t, []testimage.Entry{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o700},
+			{Name: "etc/hosts", Content: "new hosts"},
+			{Name: "usr/share/.wh.doc"},
+			{Name: "var/cache/.wh..wh..opq"},
+			{Name: "var/cache/b", Content: "b"},
+			// The hardlinks outlive the file they were linked to.
+			{Name: "opt/.wh.data"},
+			{Name: "opt/link2", Typeflag: tar.TypeLink, Linkname: "opt/link"},
+			// A file replacing a directory takes its contents along.
+			{Name: "srv", Content: "not a directory"},
+		}),
+	}
+	var got recorder
+	if err := flattenLayers(layers, &got, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"./ dir 0755",
+		"etc/ dir 0700",
+		"opt/link file shared",
+		"etc/hosts file new hosts",
+		"var/cache/b file b",
+		"opt/link2 link opt/link",
+		"srv file not a directory",
+	}
+	if strings.Join(got.entries, "\n") != strings.Join(want, "\n") {
+		t.Errorf("flattened entries:\n%s\nwant:\n%s", strings.Join(got.entries, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestFlattenWhiteoutThroughImplicitDirectories checks that a whiteout
+// removes everything beneath its path, also when the directories in between
+// have no entry of their own, and nothing beside it.
+func TestFlattenWhiteoutThroughImplicitDirectories(t *testing.T) {
+	layers := []layerOpener{
+		tarLayer(t, []testimage.Entry{
+			{Name: "a/b/c/d", Content: "d"},
+			{Name: "a/b/e", Content: "e"},
+			{Name: "a/bc", Content: "bc"},
+			{Name: "a/x/y", Content: "y"},
+		}),
+		tarLayer(t, []testimage.Entry{
+			{Name: "a/.wh.b"},
+			{Name: "a/x/.wh..wh..opq"},
+			{Name: "a/x/z", Content: "z"},
+		}),
+		tarLayer(t, []testimage.Entry{
+			{Name: "a/b/c/new", Content: "new"},
+		}),
+	}
+	var got recorder
+	if err := flattenLayers(layers, &got, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"a/bc file bc",
+		"a/x/z file z",
+		"a/b/c/new file new",
+	}
+	if strings.Join(got.entries, "\n") != strings.Join(want, "\n") {
+		t.Errorf("flattened entries:\n%s\nwant:\n%s", strings.Join(got.entries, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFlattenHardlinkToMissingFile(t *testing.T) {
+	layers := []layerOpener{
+		tarLayer(t, []testimage.Entry{{Name: "link", Typeflag: tar.TypeLink, Linkname: "missing"}}),
+	}
+	err := flattenLayers(layers, &recorder{}, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("flattenLayers() error = %v, want an error about the missing hardlink target", err)
+	}
+}
+
+func TestWriteLayerErofs(t *testing.T) {
+	layers := []layerOpener{
+		tarLayer(t, []testimage.Entry{
+			{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+			{Name: "bin/tool", Content: "#!/bin/sh\n", Mode: 0o755},
+			{Name: "bin/alias", Typeflag: tar.TypeSymlink, Linkname: "tool"},
+		}),
+		tarLayer(t, []testimage.Entry{
+			{Name: "bin/.wh.alias"},
+			{Name: "bin/tool2", Typeflag: tar.TypeLink, Linkname: "bin/tool"},
+		}),
+	}
+	output := filepath.Join(t.TempDir(), "flat.erofs")
+	state, err := writeLayer(layers, "erofs", api.Uncompressed, output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CompressedSize != int64(len(image)) {
+		t.Errorf("compressed size = %d, want %d", state.CompressedSize, len(image))
+	}
+	img, err := erofs.Open(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := fs.ReadFile(img, "bin/tool2")
+	if err != nil || string(content) != "#!/bin/sh\n" {
+		t.Errorf("bin/tool2 = %q, %v, want the content of bin/tool", content, err)
+	}
+	info, err := fs.Stat(img, "bin/tool")
+	if err != nil || info.Mode().Perm() != 0o755 {
+		t.Errorf("bin/tool mode = %v, %v, want 0755", info, err)
+	}
+	if _, err := fs.Stat(img, "bin/alias"); err == nil {
+		t.Errorf("bin/alias survived its whiteout")
+	}
+}
+
+func TestRewriteImage(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := writeJSON(t, dir, "manifest.json", map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]any{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:old", "size": 1},
+		"layers":        []any{map[string]any{"digest": "sha256:a"}, map[string]any{"digest": "sha256:b"}},
+		"annotations":   map[string]any{"org.opencontainers.image.title": "app"},
+	})
+	configPath := writeJSON(t, dir, "config.json", map[string]any{
+		"config": map[string]any{"Entrypoint": []any{"/app"}},
+		"rootfs": map[string]any{"type": "layers", "diff_ids": []any{"sha256:da", "sha256:db"}},
+		"history": []any{
+			map[string]any{"created": "2024-01-01T00:00:00Z", "created_by": "base"},
+			map[string]any{"created_by": "ENV A=B", "empty_layer": true},
+			map[string]any{"created": "2024-02-01T00:00:00Z", "created_by": "app"},
+		},
+	})
+	layer := api.Descriptor{DiffID: "sha256:flatdiff", MediaType: api.TarGzipLayer, Digest: "sha256:flat", Size: 42}
+	manifestOutput := filepath.Join(dir, "out_manifest.json")
+	configOutput := filepath.Join(dir, "out_config.json")
+	if err := rewriteImage(manifestPath, configPath, layer, "img flatten (2 layers)", manifestOutput, configOutput); err != nil {
+		t.Fatal(err)
+	}
+
+	var config struct {
+		Config map[string]any `json:"config"`
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []api.History `json:"history"`
+	}
+	readJSON(t, configOutput, &config)
+	if len(config.RootFS.DiffIDs) != 1 || config.RootFS.DiffIDs[0] != "sha256:flatdiff" {
+		t.Errorf("diff_ids = %v, want [sha256:flatdiff]", config.RootFS.DiffIDs)
+	}
+	if config.Config["Entrypoint"] == nil {
+		t.Errorf("config lost its Entrypoint: %v", config.Config)
+	}
+	if len(config.History) != 4 {
+		t.Fatalf("history = %+v, want 4 entries", config.History)
+	}
+	for i, entry := range config.History[:3] {
+		if !entry.EmptyLayer {
+			t.Errorf("history entry %d = %+v, want empty_layer", i, entry)
+		}
+	}
+	merged := config.History[3]
+	if merged.EmptyLayer || merged.CreatedBy != "img flatten (2 layers)" || merged.Created == nil || merged.Created.Month() != 2 {
+		t.Errorf("merged history entry = %+v, want the flatten entry created with the last layer", merged)
+	}
+
+	var manifest struct {
+		Layers      []api.Descriptor  `json:"layers"`
+		Config      api.Descriptor    `json:"config"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	readJSON(t, manifestOutput, &manifest)
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != "sha256:flat" || manifest.Layers[0].Size != 42 {
+		t.Errorf("layers = %+v, want the merged layer", manifest.Layers)
+	}
+	configRaw, err := os.ReadFile(configOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Config.Size != int64(len(configRaw)) || manifest.Annotations["org.opencontainers.image.title"] != "app" {
+		t.Errorf("manifest = %+v, want the rewritten config and the source annotations", manifest)
+	}
+}
+
+// recorder is an entryWriter that records the entries it receives.
+type recorder struct {
+	entries []string
+}
+
+func (r *recorder) WriteEntry(hdr *tar.Header, content io.Reader) error {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		r.entries = append(r.entries, fmt.Sprintf("%s dir %04o", hdr.Name, hdr.Mode))
+	case tar.TypeLink:
+		r.entries = append(r.entries, hdr.Name+" link "+hdr.Linkname)
+	default:
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != hdr.Size {
+			return io.ErrUnexpectedEOF
+		}
+		r.entries = append(r.entries, hdr.Name+" file "+string(data))
+	}
+	return nil
+}
+
+// tarLayer returns an opener of an uncompressed layer tar with the entries.
+func tarLayer(t *testing.T, entries []testimage.Entry) layerOpener {
+	t.Helper()
+	data := testimage.Tar(t, entries)
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func writeJSON(t *testing.T, dir, name string, value any) string {
+	t.Helper()
+	raw, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func readJSON(t *testing.T, path string, value any) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		t.Fatal(err)
+	}
+}
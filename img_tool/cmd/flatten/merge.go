@@ -0,0 +1,353 @@
+package flatten
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// OCI layer whiteout markers (see the OCI image-spec layer changeset rules).
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// layerOpener opens the uncompressed tar stream of a layer. Every layer is
+// read twice, so it must return a fresh stream on every call.
+type layerOpener func() (io.ReadCloser, error)
+
+// entryWriter receives the entries of the merged layer, in tar order: every
+// directory before the entries beneath it, and the target of a hardlink
+// before the link. content holds hdr.Size bytes for a regular file.
+type entryWriter interface {
+	WriteEntry(hdr *tar.Header, content io.Reader) error
+}
+
+// position is where an entry occurs in the input: the index of its layer and
+// its index among the tar entries of that layer.
+type position struct {
+	layer, index int
+}
+
+func (p position) less(o position) bool {
+	if p.layer != o.layer {
+		return p.layer < o.layer
+	}
+	return p.index < o.index
+}
+
+// node is a path of the filesystem built by applying the layers in order.
+type node struct {
+	name string
+	// pos is where the node is written. A directory declared again by a
+	// later layer keeps the position of its first declaration, so that it
+	// still precedes its children, but takes the header of the last one.
+	pos position
+	hdr *tar.Header
+	// source is the node whose content a hardlink shares, resolved when the
+	// link was added. A link to a link shares the content of the first.
+	source *node
+	// materialize is set on a hardlink whose source does not survive: it is
+	// written as a regular file with the source's header and content.
+	materialize bool
+}
+
+// mergePlan is the outcome of the first pass over the layers: which entries
+// make it into the merged layer, and which content must be kept aside for
+// hardlinks that outlive their source.
+type mergePlan struct {
+	keep map[position]*node
+	// spool marks the entries whose content is needed later by a
+	// materialized hardlink.
+	spool map[position]bool
+}
+
+// flattenLayers applies the layers in order, as a container runtime would,
+// and writes the entries of the resulting filesystem to w. Whiteouts are
+// applied and dropped, and only the last version of every path is written.
+//
+// The layers are read twice: once to find the surviving entries, once to copy
+// them. Only headers are held in memory, and only the content of hardlinked
+// files whose original path does not survive is copied to a temporary file in
+// tempDir.
+func flattenLayers(layers []layerOpener, w entryWriter, tempDir string) error {
+	plan, err := planMerge(layers)
+	if err != nil {
+		return err
+	}
+	return writeMerged(layers, plan, w, tempDir)
+}
+
+// tree is the filesystem built by applying the layers: its nodes by path,
+// and the paths beneath every directory. The index also holds directories
+// that have no entry of their own (a layer may add "a/b/c" without "a/b"), so
+// that removing a subtree visits only that subtree.
+type tree struct {
+	nodes    map[string]*node
+	children map[string]map[string]bool
+}
+
+func newTree() *tree {
+	return &tree{nodes: make(map[string]*node), children: make(map[string]map[string]bool)}
+}
+
+// add puts n into the tree, replacing the node of its path.
+func (t *tree) add(n *node) {
+	t.nodes[n.name] = n
+	for p := n.name; p != "."; p = path.Dir(p) {
+		parent := path.Dir(p)
+		siblings := t.children[parent]
+		if siblings == nil {
+			siblings = make(map[string]bool)
+			t.children[parent] = siblings
+		}
+		if siblings[p] {
+			break
+		}
+		siblings[p] = true
+	}
+}
+
+// remove deletes the node of a path, and drops the path and its now empty
+// parents from the index.
+func (t *tree) remove(name string) {
+	delete(t.nodes, name)
+	t.prune(name)
+}
+
+func (t *tree) prune(name string) {
+	for p := name; p != "." && t.nodes[p] == nil && len(t.children[p]) == 0; p = path.Dir(p) {
+		delete(t.children, p)
+		delete(t.children[path.Dir(p)], p)
+	}
+}
+
+// removeBelow deletes the nodes beneath dir that come from a layer below
+// belowLayer.
+func (t *tree) removeBelow(dir string, belowLayer int) {
+	for child := range t.children[dir] {
+		t.removeBelow(child, belowLayer)
+		if n := t.nodes[child]; n != nil && n.pos.layer < belowLayer {
+			t.remove(child)
+		} else {
+			t.prune(child)
+		}
+	}
+}
+
+// planMerge is the first pass: it applies the layers' entries, whiteouts
+// included, to a tree of the filesystem.
+func planMerge(layers []layerOpener) (*mergePlan, error) {
+	fs := newTree()
+	for i, open := range layers {
+		err := forEachEntry(open, func(index int, hdr *tar.Header, _ io.Reader) error {
+			name := cleanName(hdr.Name)
+			dir, base := path.Split(name)
+			dir = strings.TrimSuffix(dir, "/")
+			if dir == "" {
+				dir = "."
+			}
+			switch {
+			case base == whiteoutOpaque:
+				// An opaque whiteout hides the lower layers' entries of
+				// its directory, not those of its own layer.
+				fs.removeBelow(dir, i)
+				return nil
+			case strings.HasPrefix(base, whiteoutPrefix):
+				target := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				fs.removeBelow(target, i)
+				if n, ok := fs.nodes[target]; ok && n.pos.layer < i {
+					fs.remove(target)
+				}
+				return nil
+			}
+
+			h := outputHeader(hdr, name)
+			if existing, ok := fs.nodes[name]; ok && existing.hdr.Typeflag == tar.TypeDir {
+				if h.Typeflag == tar.TypeDir {
+					existing.hdr = h
+					return nil
+				}
+				// A non-directory replacing a directory takes its
+				// contents along.
+				fs.removeBelow(name, len(layers))
+			}
+			n := &node{name: name, pos: position{i, index}, hdr: h}
+			if h.Typeflag == tar.TypeLink {
+				target, ok := fs.nodes[cleanName(hdr.Linkname)]
+				if !ok || target.hdr.Typeflag == tar.TypeDir {
+					return fmt.Errorf("hardlink %s points to %s, which is not a file of this or a lower layer", name, hdr.Linkname)
+				}
+				if target.source != nil {
+					target = target.source
+				}
+				n.source = target
+			}
+			fs.add(n)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+
+	survivors := make([]*node, 0, len(fs.nodes))
+	for _, n := range fs.nodes {
+		survivors = append(survivors, n)
+	}
+	sort.Slice(survivors, func(a, b int) bool { return survivors[a].pos.less(survivors[b].pos) })
+
+	plan := &mergePlan{keep: make(map[position]*node, len(fs.nodes)), spool: make(map[position]bool)}
+	// The first surviving link of a lost source becomes a regular file, and
+	// the other links point at it.
+	materialized := make(map[*node]string)
+	for _, n := range survivors {
+		plan.keep[n.pos] = n
+		if n.source == nil {
+			continue
+		}
+		if fs.nodes[n.source.name] == n.source {
+			n.hdr.Linkname = n.source.name
+			continue
+		}
+		if first, ok := materialized[n.source]; ok {
+			n.hdr.Linkname = first
+			continue
+		}
+		materialized[n.source] = n.name
+		n.materialize = true
+		if n.source.hdr.Typeflag == tar.TypeReg && n.source.hdr.Size > 0 {
+			plan.spool[n.source.pos] = true
+		}
+	}
+	return plan, nil
+}
+
+// writeMerged is the second pass: it copies the surviving entries of the
+// layers to w, in order.
+func writeMerged(layers []layerOpener, plan *mergePlan, w entryWriter, tempDir string) (err error) {
+	spooled := make(map[position]string)
+	defer func() {
+		for _, p := range spooled {
+			err = errors.Join(err, os.Remove(p))
+		}
+	}()
+
+	for i, open := range layers {
+		err := forEachEntry(open, func(index int, _ *tar.Header, content io.Reader) error {
+			pos := position{i, index}
+			if plan.spool[pos] {
+				// Spooled entries never survive themselves: their path
+				// was overwritten or deleted.
+				p, err := spool(content, tempDir)
+				if err != nil {
+					return err
+				}
+				spooled[pos] = p
+				return nil
+			}
+			n, ok := plan.keep[pos]
+			if !ok {
+				return nil
+			}
+			if !n.materialize {
+				return w.WriteEntry(n.hdr, content)
+			}
+			hdr := outputHeader(n.source.hdr, n.name)
+			p, ok := spooled[n.source.pos]
+			if !ok {
+				return w.WriteEntry(hdr, strings.NewReader(""))
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return w.WriteEntry(hdr, f)
+		})
+		if err != nil {
+			return fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// forEachEntry calls fn for every entry of the layer, with its index. Global
+// pax headers apply to the entries after them and are not entries of their
+// own.
+func forEachEntry(open layerOpener, fn func(index int, hdr *tar.Header, content io.Reader) error) (err error) {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, r.Close()) }()
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			index--
+			continue
+		}
+		if err := fn(index, hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// spool copies content to a new file in tempDir and returns its path.
+func spool(content io.Reader, tempDir string) (string, error) {
+	f, err := os.CreateTemp(tempDir, "flatten-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// outputHeader returns a copy of hdr under the given name, as written to the
+// merged layer.
+func outputHeader(hdr *tar.Header, name string) *tar.Header {
+	h := *hdr
+	h.Name = name
+	if h.Typeflag == tar.TypeDir {
+		h.Name += "/"
+	}
+	if h.Typeflag != tar.TypeLink && h.Typeflag != tar.TypeSymlink {
+		h.Linkname = ""
+	}
+	if len(hdr.PAXRecords) > 0 {
+		h.PAXRecords = make(map[string]string, len(hdr.PAXRecords))
+		for k, v := range hdr.PAXRecords {
+			h.PAXRecords[k] = v
+		}
+	}
+	return &h
+}
+
+// cleanName normalizes a tar entry name to a relative path without a trailing
+// slash; the root directory is ".".
+func cleanName(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
@@ -0,0 +1,143 @@
+package flatten
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	erofs "github.com/bazel-contrib/rules_img/img_tool/pkg/go-erofs"
+)
+
+// xattrPrefix is the pax record prefix of extended attributes.
+const xattrPrefix = "SCHILY.xattr."
+
+// tarEntryWriter writes the merged layer as a tar stream.
+type tarEntryWriter struct {
+	tw *tar.Writer
+}
+
+func (t *tarEntryWriter) WriteEntry(hdr *tar.Header, content io.Reader) error {
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	_, err := io.Copy(t.tw, content)
+	return err
+}
+
+// erofsEntryWriter builds the merged layer as an EROFS image. The image is
+// written once all entries are added, since its metadata comes first.
+type erofsEntryWriter struct {
+	fsys *erofs.Writer
+}
+
+func (e *erofsEntryWriter) WriteEntry(hdr *tar.Header, content io.Reader) error {
+	name := "/" + cleanName(hdr.Name)
+	if name == "/." {
+		name = "/"
+	}
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := e.fsys.Mkdir(name, mode); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := e.fsys.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, content); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := e.fsys.Chmod(name, mode); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := e.fsys.Symlink(hdr.Linkname, name); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// A hardlink shares the inode, and so the metadata, of its target.
+		return e.fsys.Link("/"+hdr.Linkname, name)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		typ := map[byte]uint16{tar.TypeChar: erofs.ModeChardev, tar.TypeBlock: erofs.ModeBlockdev, tar.TypeFifo: erofs.ModeFifo}[hdr.Typeflag]
+		if err := e.fsys.Mknod(name, typ|uint16(hdr.Mode&0o7777), encodeDev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+	if err := e.fsys.Chown(name, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := e.fsys.Chtimes(name, hdr.AccessTime, hdr.ModTime); err != nil {
+		return err
+	}
+	for key, value := range hdr.PAXRecords {
+		if attr, ok := strings.CutPrefix(key, xattrPrefix); ok {
+			if err := e.fsys.Setxattr(name, attr, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeDev encodes a device number the way Linux stores it in a stat
+// structure (and EROFS in an inode).
+func encodeDev(major, minor int64) uint32 {
+	return uint32(minor&0xff) | uint32(major&0xfff)<<8 | uint32(minor&^0xff)<<12
+}
+
+// layerMediaType returns the media type of the merged layer.
+func layerMediaType(layerFormat string, compression api.CompressionAlgorithm) (string, error) {
+	mediaTypes := map[string]map[api.CompressionAlgorithm]string{
+		"tar": {
+			api.Uncompressed: api.TarLayer,
+			api.Gzip:         api.TarGzipLayer,
+			api.Zstd:         api.TarZstdLayer,
+		},
+		"erofs": {
+			api.Uncompressed: api.ErofsLayer,
+			api.Gzip:         api.ErofsGzipLayer,
+			api.Zstd:         api.ErofsZstdLayer,
+		},
+	}
+	byCompression, ok := mediaTypes[layerFormat]
+	if !ok {
+		return "", fmt.Errorf("unsupported layer format %q, want \"tar\" or \"erofs\"", layerFormat)
+	}
+	mediaType, ok := byCompression[compression]
+	if !ok {
+		return "", fmt.Errorf("unsupported compression %q, want \"gzip\", \"zstd\" or \"none\"", compression)
+	}
+	return mediaType, nil
+}
+
+// collapseHistory rewrites the history of an image config for an image whose
+// layers were merged into one: every entry is kept, for the record, but marked
+// as creating no layer, and one entry for the merged layer is appended.
+func collapseHistory(config *specv1.Image, createdBy string) {
+	collapsed := make([]specv1.History, 0, len(config.History)+1)
+	var created *time.Time
+	for _, entry := range config.History {
+		entry.EmptyLayer = true
+		if entry.Created != nil {
+			created = entry.Created
+		}
+		collapsed = append(collapsed, entry)
+	}
+	config.History = append(collapsed, specv1.History{Created: created, CreatedBy: createdBy})
+}
@@ -7,33 +7,42 @@ import (
 
 	"github.com/google/go-containerregistry/pkg/logs"
 
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/analyze"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/base"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/casdir"
 	compactstreamcmd "github.com/bazel-contrib/rules_img/img_tool/cmd/compactstream"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/compress"
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/copycmd"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/cst"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/deploy"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/deploymetadata"
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/diff"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/dockersave"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/downloadblob"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/downloadmanifest"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/expandtemplate"
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/flatten"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/hash"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/index"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/indexfromocilayout"
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/inspect"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/layer"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/manifest"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/manifestfromocilayout"
 	mtreecmd "github.com/bazel-contrib/rules_img/img_tool/cmd/mtree"
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/mutate"
 	ocilayoutcmd "github.com/bazel-contrib/rules_img/img_tool/cmd/ocilayoutcmd"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/ocilayoutmetadata"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/optimize"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/pull"
 	pushcmd "github.com/bazel-contrib/rules_img/img_tool/cmd/push"
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/rebase"
+	sbomcmd "github.com/bazel-contrib/rules_img/img_tool/cmd/sbom"
 	socicmd "github.com/bazel-contrib/rules_img/img_tool/cmd/soci"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/sparseocilayout"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/syncocirefgraph"
 	"github.com/bazel-contrib/rules_img/img_tool/cmd/validate"
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/verify"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
 )
 
@@ -46,30 +55,39 @@ Global flags (accepted by any command):
                            --insecure). Also settable via IMG_INSECURE=1.
 
 Commands:
-  base                     describes base image contents (subcommands: etc, trust-store, system-libraries, skeleton)
+  analyze                  reports the space an image wastes in its layers and checks it against thresholds
+  base                     describes base image contents (subcommands: etc, trust-store, system-libraries, packages, tzdata, locales, skeleton)
   compress                 (re-)compresses a layer
+  copy                     copies an image or index with its referrers between registry references
+  diff                     compares two images or layers file by file, and their configs
   docker-save              assembles a Docker save compatible directory or tarball
   download-blob            downloads a single blob from a registry
   download-manifest        downloads a manifest by digest or tag from a registry
   expand-template          expands Go templates in push request JSON
+  flatten                  squashes the layers of an image into one tar or EROFS layer, applying whiteouts
   hash                     computes file hashes and layer metadata (supports persistent worker mode)
   index                    creates a multi-platform image index
   index-from-oci-layout    converts an OCI layout to an image index
+  inspect                  prints what is in an image (platforms, config, layers and their files, referrers)
   layer                    creates a layer from files
   manifest                 creates an image manifest and config from layers
   manifest-from-oci-layout converts an OCI layout to an image manifest
   mtree                    writes an mtree spec of a layer's metadata and merges mtree files
+  mutate                   appends layers to an image in a registry or OCI layout, edits its config and pushes it
   oci-layout               assembles an OCI layout directory from manifest and layers
   oci-layout-metadata      extracts per-platform config and mtree from an OCI image layout
   optimize                 rewrites image metadata after layer optimization
   pull                     pulls an image from a registry
+  rebase                   moves an image onto a new base image without rebuilding the layers on top
+  sbom                     writes an SPDX or CycloneDX SBOM of an image from its build inputs
   sparse-oci-layout        assembles a sparse OCI layout (without layer blobs) from manifest and layers
   soci-index               creates a SOCI Index Manifest v2 from per-layer ztoc blobs
   ztoc                     generates a ztoc (SOCI table of contents) for a gzip-compressed layer
-  compact-stream           inspects or reconstructs a compact stream (subcommands: reconstruct, list)
+  compact-stream           inspects or reconstructs a compact stream (subcommands: reconstruct, list, index)
   cas-dir                  builds a content-addressed directory (sha256/<hex>) from input files
   sync-oci-ref-graph       syncs OCI reference graph by downloading manifests in parallel
   validate                 validates layers and images
+  verify                   checks that images carry a valid signature, using a signer plugin
   image-structure-test     validates an image's structure (config + mtree) against container-structure-test configs
   deploy                   pushes an image to a registry or loads it into a local container runtime
   deploy-metadata          calculates metadata for deploying an image (push/load)
@@ -107,14 +125,24 @@ func Run(ctx context.Context, args []string) {
 		index.IndexProcess(ctx, args[2:])
 	case "index-from-oci-layout":
 		indexfromocilayout.IndexFromOCILayoutProcess(ctx, args[2:])
+	case "analyze":
+		analyze.AnalyzeProcess(ctx, args[2:])
+	case "diff":
+		diff.DiffProcess(ctx, args[2:])
+	case "inspect":
+		inspect.InspectProcess(ctx, args[2:])
 	case "soci-index":
 		socicmd.SociIndexProcess(ctx, args[2:])
 	case "ztoc":
 		socicmd.ZtocProcess(ctx, args[2:])
 	case "validate":
 		validate.ValidationProcess(ctx, args[2:])
+	case "verify":
+		verify.VerifyProcess(ctx, args[2:])
 	case "deploy":
 		deploy.DeployProcess(ctx, args[2:])
+	case "copy":
+		copycmd.CopyProcess(ctx, args[2:])
 	case "push":
 		pushcmd.PushProcess(ctx, args[2:])
 	case "deploy-metadata":
@@ -131,6 +159,8 @@ func Run(ctx context.Context, args []string) {
 		downloadmanifest.DownloadManifestProcess(ctx, args[2:])
 	case "pull":
 		pull.PullProcess(ctx, args[2:])
+	case "sbom":
+		sbomcmd.SBOMProcess(ctx, args[2:])
 	case "sync-oci-ref-graph":
 		syncocirefgraph.SyncOCIRefGraphProcess(ctx, args[2:])
 	case "hash":
@@ -139,6 +169,12 @@ func Run(ctx context.Context, args []string) {
 		ocilayoutcmd.OCILayoutProcess(ctx, args[2:])
 	case "optimize":
 		optimize.OptimizeProcess(ctx, args[2:])
+	case "flatten":
+		flatten.FlattenProcess(ctx, args[2:])
+	case "rebase":
+		rebase.RebaseProcess(ctx, args[2:])
+	case "mutate":
+		mutate.MutateProcess(ctx, args[2:])
 	case "sparse-oci-layout":
 		sparseocilayout.SparseOCILayoutProcess(ctx, args[2:])
 	case "compact-stream":
@@ -0,0 +1,150 @@
+package inspect
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
+)
+
+// whiteoutPrefix marks the entries of a layer that delete a path of the layers
+// below, including the opaque directory marker ".wh..wh..opq".
+const whiteoutPrefix = ".wh."
+
+// isTarLayer reports whether a layer media type is a (possibly compressed)
+// tar, as opposed to an artifact blob.
+func isTarLayer(mediaType types.MediaType) bool {
+	return strings.Contains(string(mediaType), "tar")
+}
+
+// blobContents counts the entries of a layer by reading its blob. The blob is
+// decompressed by its magic rather than trusted to match its media type.
+func blobContents(layer v1.Layer, largest int) (*Contents, error) {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	r, err := mtree.Decompress(rc)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	counter := newContentsCounter("layer", largest)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			counter.add(hdr.Name, entryDirectory, 0)
+		case tar.TypeSymlink:
+			counter.add(hdr.Name, entrySymlink, 0)
+		case tar.TypeReg, tar.TypeLink:
+			// A hard link shares the data of its target, so it adds a
+			// file but no bytes.
+			size := hdr.Size
+			if hdr.Typeflag == tar.TypeLink {
+				size = 0
+			}
+			counter.add(hdr.Name, entryFile, size)
+		}
+	}
+	return counter.contents(), nil
+}
+
+// mtreeContents counts the entries of a layer from its mtree spec, as written
+// by `img mtree` and the layer rules.
+func mtreeContents(r io.Reader, largest int) (*Contents, error) {
+	entries, err := mtree.ParseEntries(r)
+	if err != nil {
+		return nil, err
+	}
+	counter := newContentsCounter("mtree", largest)
+	for _, entry := range entries {
+		if entry.Path == "." {
+			continue
+		}
+		switch entry.Keywords["type"] {
+		case "dir":
+			counter.add(entry.Path, entryDirectory, 0)
+		case "link":
+			counter.add(entry.Path, entrySymlink, 0)
+		case "file":
+			size, _ := strconv.ParseInt(entry.Keywords["size"], 10, 64)
+			counter.add(entry.Path, entryFile, size)
+		}
+	}
+	return counter.contents(), nil
+}
+
+type entryKind int
+
+const (
+	entryFile entryKind = iota
+	entryDirectory
+	entrySymlink
+)
+
+// contentsCounter accumulates the Contents of a layer.
+type contentsCounter struct {
+	result  Contents
+	files   []File
+	largest int
+}
+
+func newContentsCounter(source string, largest int) *contentsCounter {
+	return &contentsCounter{result: Contents{Source: source}, largest: largest}
+}
+
+func (c *contentsCounter) add(name string, kind entryKind, size int64) {
+	name = "/" + strings.TrimPrefix(path.Clean("/"+name), "/")
+	if strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+		c.result.Whiteouts++
+		return
+	}
+	switch kind {
+	case entryDirectory:
+		c.result.Directories++
+	case entrySymlink:
+		c.result.Symlinks++
+	case entryFile:
+		c.result.Files++
+		c.result.FileBytes += size
+		if c.largest > 0 {
+			c.files = append(c.files, File{Path: name, Size: size})
+		}
+	}
+}
+
+// contents returns the counts with the largest files, biggest first and ties
+// broken by path.
+func (c *contentsCounter) contents() *Contents {
+	sort.Slice(c.files, func(i, j int) bool {
+		if c.files[i].Size != c.files[j].Size {
+			return c.files[i].Size > c.files[j].Size
+		}
+		return c.files[i].Path < c.files[j].Path
+	})
+	if len(c.files) > c.largest {
+		c.files = c.files[:c.largest]
+	}
+	result := c.result
+	result.Largest = c.files
+	return &result
+}
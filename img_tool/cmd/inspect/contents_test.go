@@ -0,0 +1,33 @@
+package inspect
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+)
+
+func TestBlobContents(t *testing.T) {
+	layer := testimage.Layer(t, []testimage.Entry{
+		{Name: "./usr/", Typeflag: tar.TypeDir},
+		{Name: "./usr/lib/libc.so", Size: 64},
+		{Name: "./usr/lib/libc.so.6", Typeflag: tar.TypeLink},
+		{Name: "./usr/lib/.wh.libold.so"},
+		{Name: "./usr/lib/.wh..wh..opq"},
+		{Name: "./usr/bin/a", Size: 8},
+		{Name: "./usr/bin/b", Size: 8},
+	}, gzip.BestSpeed)
+	got, err := blobContents(layer, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The hard link is a file, but its data is counted with its target.
+	if got.Source != "layer" || got.Files != 4 || got.Directories != 1 || got.Whiteouts != 2 || got.FileBytes != 80 {
+		t.Errorf("contents = %+v", got)
+	}
+	// Equal sizes are ordered by path.
+	if want := []File{{Path: "/usr/lib/libc.so", Size: 64}, {Path: "/usr/bin/a", Size: 8}}; !equalFiles(got.Largest, want) {
+		t.Errorf("largest = %+v, want %+v", got.Largest, want)
+	}
+}
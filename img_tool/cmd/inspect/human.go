@@ -0,0 +1,212 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// writeHuman renders the report for reading in a terminal. Everything in it
+// is also in the JSON output, which is what scripts should use.
+func writeHuman(w io.Writer, report *Report) {
+	fmt.Fprintf(w, "source: %s\n", report.Source)
+	for _, image := range report.Images {
+		fmt.Fprintln(w)
+		writeImage(w, image)
+	}
+}
+
+func writeImage(w io.Writer, image Image) {
+	kind := "Image"
+	if len(image.Manifests) != 1 || image.Manifests[0].Digest != image.Digest {
+		kind = "Index"
+	}
+	fmt.Fprintf(w, "%s %s\n", kind, image.Digest)
+	for _, name := range image.Names {
+		row(w, "Name:", name)
+	}
+	row(w, "Media type:", image.MediaType)
+	row(w, "Size:", humanizeBytes(image.Size))
+	row(w, "Platforms:", strings.Join(image.Platforms, ", "))
+	writeAnnotations(w, "  ", image.Annotations)
+	writeReferrers(w, "  ", image.Referrers)
+
+	for _, manifest := range image.Manifests {
+		fmt.Fprintln(w)
+		writeManifest(w, manifest, kind == "Index")
+	}
+}
+
+func writeManifest(w io.Writer, manifest Manifest, inIndex bool) {
+	if inIndex {
+		fmt.Fprintf(w, "Manifest %s (%s)\n", manifest.Digest, manifest.Platform)
+		row(w, "Media type:", manifest.MediaType)
+		row(w, "Size:", humanizeBytes(manifest.Size))
+		writeAnnotations(w, "  ", manifest.Annotations)
+		writeReferrers(w, "  ", manifest.Referrers)
+	} else {
+		fmt.Fprintf(w, "Manifest (%s)\n", manifest.Platform)
+	}
+
+	config := manifest.Config
+	row(w, "Config:", config.Digest)
+	if config.Created != "" {
+		row(w, "Created:", config.Created)
+	}
+	if config.Author != "" {
+		row(w, "Author:", config.Author)
+	}
+	row(w, "Entrypoint:", jsonList(config.Entrypoint))
+	row(w, "Cmd:", jsonList(config.Cmd))
+	row(w, "User:", orNone(config.User))
+	row(w, "Working dir:", orNone(config.WorkingDir))
+	row(w, "Exposed ports:", orNone(strings.Join(config.ExposedPorts, ", ")))
+	if len(config.Volumes) > 0 {
+		row(w, "Volumes:", strings.Join(config.Volumes, ", "))
+	}
+	if config.StopSignal != "" {
+		row(w, "Stop signal:", config.StopSignal)
+	}
+	if len(config.Env) > 0 {
+		fmt.Fprintln(w, "  Env:")
+		for _, env := range config.Env {
+			fmt.Fprintf(w, "    %s\n", env)
+		}
+	}
+	if len(config.Labels) > 0 {
+		fmt.Fprintln(w, "  Labels:")
+		for _, key := range sortedKeys(config.Labels) {
+			fmt.Fprintf(w, "    %s: %s\n", key, config.Labels[key])
+		}
+	}
+	row(w, "Lazy pulling:", lazyPulling(manifest))
+
+	var total int64
+	for _, layer := range manifest.Layers {
+		total += layer.Size
+	}
+	row(w, "Layers:", fmt.Sprintf("%d (%s)", len(manifest.Layers), humanizeBytes(total)))
+	for i, layer := range manifest.Layers {
+		writeLayer(w, i, layer)
+	}
+}
+
+func writeLayer(w io.Writer, i int, layer Layer) {
+	estargz := ""
+	if layer.Estargz {
+		estargz = ", eStargz"
+	}
+	fmt.Fprintf(w, "    #%d %s  %s  %s%s\n", i, layer.Digest, humanizeBytes(layer.Size), layer.MediaType, estargz)
+	if layer.CreatedBy != "" {
+		fmt.Fprintf(w, "       created by: %s\n", layer.CreatedBy)
+	}
+	if layer.Comment != "" {
+		fmt.Fprintf(w, "       comment:    %s\n", layer.Comment)
+	}
+	writeAnnotations(w, "       ", layer.Annotations)
+	switch {
+	case layer.Contents != nil:
+		c := layer.Contents
+		fmt.Fprintf(w, "       contents:   %d files (%s), %d directories, %d symlinks", c.Files, humanizeBytes(c.FileBytes), c.Directories, c.Symlinks)
+		if c.Whiteouts > 0 {
+			fmt.Fprintf(w, ", %d whiteouts", c.Whiteouts)
+		}
+		fmt.Fprintf(w, " (from %s)\n", c.Source)
+		for _, file := range c.Largest {
+			fmt.Fprintf(w, "         %10s  %s\n", humanizeBytes(file.Size), file.Path)
+		}
+	case layer.ContentsUnavailable != "":
+		fmt.Fprintf(w, "       contents:   unavailable: %s\n", layer.ContentsUnavailable)
+	}
+}
+
+func writeAnnotations(w io.Writer, indent string, annotations map[string]string) {
+	if len(annotations) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%sAnnotations:\n", indent)
+	for _, key := range sortedKeys(annotations) {
+		fmt.Fprintf(w, "%s  %s: %s\n", indent, key, annotations[key])
+	}
+}
+
+func writeReferrers(w io.Writer, indent string, referrers []Referrer) {
+	if len(referrers) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%sReferrers:\n", indent)
+	for _, referrer := range referrers {
+		artifactType := referrer.ArtifactType
+		if artifactType == "" {
+			artifactType = referrer.MediaType
+		}
+		fmt.Fprintf(w, "%s  %s  %s  %s\n", indent, referrer.Digest, artifactType, humanizeBytes(referrer.Size))
+	}
+}
+
+// lazyPulling summarizes the lazy pulling support of a manifest.
+func lazyPulling(manifest Manifest) string {
+	var parts []string
+	if n := manifest.LazyPulling.EstargzLayers; n > 0 {
+		parts = append(parts, fmt.Sprintf("eStargz (%d of %d layers)", n, len(manifest.Layers)))
+	}
+	if manifest.LazyPulling.SOCIIndex != "" {
+		parts = append(parts, "SOCI index "+manifest.LazyPulling.SOCIIndex)
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// row prints a label/value pair with the label left-padded to a fixed width.
+func row(w io.Writer, label, value string) {
+	fmt.Fprintf(w, "  %-15s %s\n", label, value)
+}
+
+// jsonList renders a command line the way a Dockerfile's exec form spells it,
+// so arguments with spaces stay recognizable.
+func jsonList(values []string) string {
+	if len(values) == 0 {
+		return "(none)"
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return strings.Join(values, " ")
+	}
+	return string(data)
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// humanizeBytes renders a byte count with a binary unit.
+func humanizeBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return fmt.Sprintf("%.1f PiB", value/unit)
+}
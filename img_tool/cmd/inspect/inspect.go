@@ -0,0 +1,174 @@
+// Package inspect implements `img inspect`: a summary of what is in an image,
+// read from an OCI layout, a deploy manifest or a registry.
+//
+// For every image it reports the platforms, the parts of the config that
+// decide how a container runs (entrypoint, env, user, ports), the layers with
+// their sizes, media types and the history entries that created them, and
+// what each layer holds: how many files, directories and symlinks, and the
+// largest files. The file listing comes from the layer's mtree when one is
+// given, and from reading the layer blob otherwise. Annotations, lazy pulling
+// support (eStargz layers, a SOCI index) and the referrers attached to the
+// image (signatures, SBOMs, attestations) round it off.
+//
+// The report is printed for people or, with --format=json, as JSON for
+// scripts, replacing the usual mix of crane, dive and jq.
+package inspect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// options controls how much of an image is looked at.
+type options struct {
+	// contents reads layer blobs that have no mtree for their file listing.
+	contents bool
+	// largest is the number of largest files listed per layer.
+	largest int
+	// mtrees maps a layer digest or diff ID to the mtree spec of the layer.
+	mtrees map[string]string
+	// platforms, when not empty, restricts the manifests of an index to
+	// these platforms.
+	platforms []string
+}
+
+func InspectProcess(ctx context.Context, args []string) {
+	var layoutPath, deployManifestPath, format string
+	var platforms stringSliceFlag
+	mtrees := make(mtreeFlag)
+	opts := options{}
+
+	flagSet := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Prints what is in an image: platforms, config, layers and their files, annotations,\n")
+		fmt.Fprintf(flagSet.Output(), "lazy pulling support and referrers.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img inspect [OPTIONS] (REFERENCE | --oci-layout DIR | --deploy-manifest FILE)\n\n")
+		fmt.Fprintf(flagSet.Output(), "REFERENCE is a tag or digest reference of an image in a registry, read through the\n")
+		fmt.Fprintf(flagSet.Output(), "pull gateway when configured. The blobs of a deploy manifest are found the way\n")
+		fmt.Fprintf(flagSet.Output(), "`img deploy` finds them: in the runfiles (RUNFILES_DIR) of the push or load target,\n")
+		fmt.Fprintf(flagSet.Output(), "and for layers of a pulled base image, in the registry they came from.\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img inspect registry.example.com/team/app:v1.2.3",
+			"img inspect --format=json --platform linux/arm64 registry.example.com/team/app@sha256:abc123...",
+			"img inspect --oci-layout bazel-bin/app/image_oci_layout",
+			"img inspect --contents=false --oci-layout bazel-bin/app/image_oci_layout",
+			"RUNFILES_DIR=bazel-bin/app/push.exe.runfiles img inspect --deploy-manifest bazel-bin/app/push.json",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+
+	flagSet.StringVar(&layoutPath, "oci-layout", "", "Inspect the images of this OCI layout directory")
+	flagSet.StringVar(&deployManifestPath, "deploy-manifest", "", "Inspect the images pushed or loaded by this deploy manifest")
+	flagSet.StringVar(&format, "format", "human", `Output format: "human" or "json"`)
+	flagSet.BoolVar(&opts.contents, "contents", true, "Read layer blobs without an --mtree to count their files. Downloads the layers of a registry image.")
+	flagSet.IntVar(&opts.largest, "largest", 5, "Number of largest files to list per layer")
+	flagSet.Var(mtrees, "mtree", "mtree spec of a layer as DIGEST=PATH, DIGEST being the layer digest or diff ID (can be used multiple times)")
+	flagSet.Var(&platforms, "platform", "Only inspect the manifests of this platform in an index, e.g. linux/arm64 (can be used multiple times)")
+
+	if err := flagSet.Parse(args); err != nil {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if format != "human" && format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: --format must be \"human\" or \"json\", not %q\n", format)
+		os.Exit(1)
+	}
+	opts.mtrees = mtrees
+	opts.platforms = platforms
+
+	sources := 0
+	for _, given := range []bool{layoutPath != "", deployManifestPath != "", flagSet.NArg() > 0} {
+		if given {
+			sources++
+		}
+	}
+	if sources != 1 || flagSet.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "Error: expected exactly one of REFERENCE, --oci-layout or --deploy-manifest\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	pull, err := registryopts.Pull()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: configuring pull transport: %v\n", err)
+		os.Exit(1)
+	}
+
+	var src *source
+	switch {
+	case layoutPath != "":
+		src, err = openLayout(layoutPath)
+	case deployManifestPath != "":
+		src, err = openDeployManifest(ctx, deployManifestPath, pull.Remote())
+	default:
+		src, err = openRegistry(ctx, flagSet.Arg(0), pull.Remote())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	report, err := inspect(ctx, src, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := write(os.Stdout, report, format); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// write prints the report in the given format.
+func write(w io.Writer, report *Report, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	writeHuman(w, report)
+	return nil
+}
+
+// mtreeFlag collects DIGEST=PATH pairs.
+type mtreeFlag map[string]string
+
+func (m mtreeFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for digest, path := range m {
+		pairs = append(pairs, digest+"="+path)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (m mtreeFlag) Set(value string) error {
+	digest, path, ok := strings.Cut(value, "=")
+	if !ok || digest == "" || path == "" {
+		return errors.New("expected DIGEST=PATH")
+	}
+	m[digest] = path
+	return nil
+}
+
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
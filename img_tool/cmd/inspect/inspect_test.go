@@ -0,0 +1,373 @@
+package inspect
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testregistry"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+const sbomArtifactType = "application/spdx+json"
+
+func TestInspectLayout(t *testing.T) {
+	index := testIndex(t)
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendIndex(index, layout.WithAnnotations(map[string]string{api.AnnotationOCIImageRefName: "app:latest"})); err != nil {
+		t.Fatal(err)
+	}
+	image := platformImage(t, index)
+	if err := p.AppendImage(sbomFor(t, image)); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := openLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := inspect(context.Background(), src, options{contents: true, largest: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Images) != 1 {
+		t.Fatalf("got %d images, want only the index (the SBOM is a referrer)", len(report.Images))
+	}
+	got := report.Images[0]
+	if want := []string{"app:latest"}; !equalStrings(got.Names, want) {
+		t.Errorf("names = %q, want %q", got.Names, want)
+	}
+	if want := []string{"linux/amd64"}; !equalStrings(got.Platforms, want) {
+		t.Errorf("platforms = %q, want %q", got.Platforms, want)
+	}
+	if len(got.Manifests) != 1 {
+		t.Fatalf("got %d manifests, want 1", len(got.Manifests))
+	}
+	manifest := got.Manifests[0]
+
+	config := manifest.Config
+	if want := []string{"/app", "--serve"}; !equalStrings(config.Entrypoint, want) {
+		t.Errorf("entrypoint = %q, want %q", config.Entrypoint, want)
+	}
+	if want := []string{"8080/tcp", "9090/tcp"}; !equalStrings(config.ExposedPorts, want) {
+		t.Errorf("exposed ports = %q, want %q", config.ExposedPorts, want)
+	}
+	if config.User != "65532" || config.Created != "2024-01-02T03:04:05Z" {
+		t.Errorf("user, created = %q, %q", config.User, config.Created)
+	}
+
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("got %d layers, want 2", len(manifest.Layers))
+	}
+	base, app := manifest.Layers[0], manifest.Layers[1]
+	// The empty history entry between the two layers belongs to neither.
+	if base.CreatedBy != "base files" || app.CreatedBy != "app binary" {
+		t.Errorf("created by = %q, %q", base.CreatedBy, app.CreatedBy)
+	}
+	if base.Estargz || !app.Estargz || manifest.LazyPulling.EstargzLayers != 1 {
+		t.Errorf("estargz = %v, %v (%d layers)", base.Estargz, app.Estargz, manifest.LazyPulling.EstargzLayers)
+	}
+	if base.Contents == nil || base.Contents.Files != 3 || base.Contents.Directories != 1 || base.Contents.Symlinks != 1 {
+		t.Fatalf("base contents = %+v", base.Contents)
+	}
+	if want := []File{{Path: "/etc/big", Size: 300}, {Path: "/etc/medium", Size: 200}}; !equalFiles(base.Contents.Largest, want) {
+		t.Errorf("largest = %+v, want %+v", base.Contents.Largest, want)
+	}
+
+	if len(manifest.Referrers) != 1 || manifest.Referrers[0].ArtifactType != sbomArtifactType {
+		t.Errorf("referrers = %+v, want the SBOM", manifest.Referrers)
+	}
+
+	var human bytes.Buffer
+	if err := write(&human, report, "human"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Index " + got.Digest,
+		"Name:           app:latest",
+		`Entrypoint:     ["/app","--serve"]`,
+		"created by: app binary",
+		"3 files (600 B), 1 directories, 1 symlinks (from layer)",
+		"300 B  /etc/big",
+		"Lazy pulling:   eStargz (1 of 2 layers)",
+		sbomArtifactType,
+	} {
+		if !strings.Contains(human.String(), want) {
+			t.Errorf("human output lacks %q:\n%s", want, human.String())
+		}
+	}
+
+	var encoded bytes.Buffer
+	if err := write(&encoded, report, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil {
+		t.Fatalf("JSON output does not parse: %v", err)
+	}
+	if decoded.Images[0].Manifests[0].Layers[1].DiffID != app.DiffID {
+		t.Errorf("JSON output lost the diff ID")
+	}
+}
+
+func TestInspectSparseLayoutAndMtree(t *testing.T) {
+	image := platformImage(t, testIndex(t))
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendImage(image); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseDigest, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appDigest, err := layers[1].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A sparse layout lacks the layer blobs.
+	for _, digest := range []v1.Hash{baseDigest, appDigest} {
+		if err := os.Remove(filepath.Join(dir, "blobs", digest.Algorithm, digest.Hex)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtreePath := filepath.Join(t.TempDir(), "app.mtree")
+	spec := "#mtree\n./app type=file size=4096\n./app.d type=dir\n./app.d/.wh.old type=file size=0\n"
+	if err := os.WriteFile(mtreePath, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := openLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := inspect(context.Background(), src, options{
+		contents: true,
+		largest:  5,
+		mtrees:   map[string]string{appDigest.String(): mtreePath},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := report.Images[0].Manifests[0]
+	if base := manifest.Layers[0]; base.Contents != nil || base.ContentsUnavailable == "" {
+		t.Errorf("missing blob: contents = %+v, unavailable = %q", base.Contents, base.ContentsUnavailable)
+	}
+	want := &Contents{Source: "mtree", Files: 1, Directories: 1, Whiteouts: 1, FileBytes: 4096, Largest: []File{{Path: "/app", Size: 4096}}}
+	if got := manifest.Layers[1].Contents; got == nil || got.Source != want.Source || got.Files != want.Files || got.Directories != want.Directories || got.Whiteouts != want.Whiteouts || got.FileBytes != want.FileBytes || !equalFiles(got.Largest, want.Largest) {
+		t.Errorf("mtree contents = %+v, want %+v", got, want)
+	}
+}
+
+func TestInspectRegistry(t *testing.T) {
+	regs := testregistry.New("reg.example.com")
+	tag, err := name.NewTag("reg.example.com/team/app:v1", registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := testIndex(t)
+	if err := remote.WriteIndex(tag, index, regs.Options()...); err != nil {
+		t.Fatal(err)
+	}
+	sbom := sbomFor(t, platformImage(t, index))
+	sbomDigest, err := sbom.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag.Context().Digest(sbomDigest.String()), sbom, regs.Options()...); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	src, err := openRegistry(ctx, tag.String(), regs.Options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := inspect(ctx, src, options{contents: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := report.Images[0]
+	if want := []string{tag.Name()}; !equalStrings(image.Names, want) {
+		t.Errorf("names = %q, want %q", image.Names, want)
+	}
+	manifest := image.Manifests[0]
+	if len(manifest.Referrers) != 1 || manifest.Referrers[0].Digest != sbomDigest.String() {
+		t.Errorf("referrers = %+v, want %s", manifest.Referrers, sbomDigest)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.Contents != nil || layer.ContentsUnavailable != "" {
+			t.Errorf("layer %s: contents read although --contents=false", layer.Digest)
+		}
+	}
+}
+
+func TestPlatformSelected(t *testing.T) {
+	for _, tc := range []struct {
+		platform string
+		selected []string
+		want     bool
+	}{
+		{"linux/amd64", nil, true},
+		{"linux/amd64", []string{"linux/amd64"}, true},
+		{"linux/arm64/v8", []string{"linux/arm64"}, true},
+		{"linux/arm64", []string{"linux/arm64/v8"}, false},
+		{"linux/amd64", []string{"linux/arm64"}, false},
+	} {
+		if got := platformSelected(tc.platform, tc.selected); got != tc.want {
+			t.Errorf("platformSelected(%q, %q) = %v, want %v", tc.platform, tc.selected, got, tc.want)
+		}
+	}
+}
+
+// testIndex returns an index holding a single linux/amd64 image of two
+// layers, the second of them annotated as eStargz.
+func testIndex(t *testing.T) v1.ImageIndex {
+	t.Helper()
+	base := testimage.Layer(t, []testimage.Entry{
+		{Name: "etc/", Typeflag: tar.TypeDir},
+		{Name: "etc/big", Size: 300},
+		{Name: "etc/medium", Size: 200},
+		{Name: "etc/small", Size: 100},
+		{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "big"},
+	}, gzip.BestSpeed)
+	app := testimage.Layer(t, []testimage.Entry{{Name: "app", Size: 10}}, gzip.BestSpeed)
+
+	image, err := mutate.Append(empty.Image,
+		mutate.Addendum{Layer: base, History: v1.History{CreatedBy: "base files"}, MediaType: types.OCILayer},
+		mutate.Addendum{Layer: app, History: v1.History{CreatedBy: "app binary"}, MediaType: types.OCILayer, Annotations: map[string]string{
+			api.TocDigestAnnotation: "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = configFile.DeepCopy()
+	configFile.OS = "linux"
+	configFile.Architecture = "amd64"
+	configFile.Created = v1.Time{Time: mustParseTime(t, "2024-01-02T03:04:05Z")}
+	configFile.Config.Entrypoint = []string{"/app", "--serve"}
+	configFile.Config.Env = []string{"PATH=/usr/bin"}
+	configFile.Config.User = "65532"
+	configFile.Config.ExposedPorts = map[string]struct{}{"9090/tcp": {}, "8080/tcp": {}}
+	// An entry that changed only the config sits between the two layers.
+	configFile.History = []v1.History{configFile.History[0], {CreatedBy: "ENV PATH", EmptyLayer: true}, configFile.History[1]}
+	image, err = mutate.ConfigFile(image, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image = mutate.MediaType(image, types.OCIManifestSchema1)
+	return mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex), mutate.IndexAddendum{
+		Add: image,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+		},
+	})
+}
+
+// platformImage returns the single image of an index made by testIndex.
+func platformImage(t *testing.T, index v1.ImageIndex) v1.Image {
+	t.Helper()
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := index.Image(indexManifest.Manifests[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+// sbomFor returns an SBOM artifact whose subject is image.
+func sbomFor(t *testing.T, image v1.Image) v1.Image {
+	t.Helper()
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := image.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbom, err := mutate.Append(empty.Image, mutate.Addendum{Layer: static.NewLayer([]byte(`{"spdxVersion":"SPDX-2.3"}`), sbomArtifactType)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbom = mutate.MediaType(sbom, types.OCIManifestSchema1)
+	sbom = mutate.ConfigMediaType(sbom, sbomArtifactType)
+	return mutate.Subject(sbom, v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: digest, Size: size}).(v1.Image)
+}
+
+func equalStrings(a, b []string) bool {
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00") && len(a) == len(b)
+}
+
+func equalFiles(a, b []File) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestPushNames(t *testing.T) {
+	const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	for _, tc := range []struct {
+		target api.PushTarget
+		want   []string
+	}{
+		{api.PushTarget{Registry: "ghcr.io", Repository: "team/app", Tags: []string{"v1", "latest"}}, []string{"ghcr.io/team/app:v1", "ghcr.io/team/app:latest"}},
+		{api.PushTarget{Registry: "ghcr.io", Repository: "team/app"}, []string{"ghcr.io/team/app@" + digest}},
+	} {
+		if got := pushNames(tc.target, digest); !equalStrings(got, tc.want) {
+			t.Errorf("pushNames(%+v) = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package inspect
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+// SOCI v1 indexes are attached as referrers with this artifact type; v2
+// indexes (api.SociIndexArtifactTypeV2) are linked through annotations.
+const sociIndexArtifactTypeV1 = "application/vnd.amazon.soci.index.v1+json"
+
+// Report is everything `img inspect` found out about the images of a source.
+// It is also the JSON output, so its field names are part of the interface.
+type Report struct {
+	Source string  `json:"source"`
+	Images []Image `json:"images"`
+}
+
+// Image is a single image manifest or an index, with one Manifest per
+// platform. A single manifest is its own only Manifest.
+type Image struct {
+	Names       []string          `json:"names,omitempty"`
+	Digest      string            `json:"digest"`
+	MediaType   string            `json:"media_type"`
+	Size        int64             `json:"size"`
+	Platforms   []string          `json:"platforms"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Referrers   []Referrer        `json:"referrers,omitempty"`
+	Manifests   []Manifest        `json:"manifests"`
+}
+
+// Manifest is the image of one platform.
+type Manifest struct {
+	Digest      string            `json:"digest"`
+	MediaType   string            `json:"media_type"`
+	Size        int64             `json:"size"`
+	Platform    string            `json:"platform"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Config      Config            `json:"config"`
+	Layers      []Layer           `json:"layers"`
+	History     []History         `json:"history,omitempty"`
+	LazyPulling LazyPulling       `json:"lazy_pulling"`
+	// Referrers are those of this manifest; those of a single-manifest image
+	// are listed on the Image.
+	Referrers []Referrer `json:"referrers,omitempty"`
+}
+
+// Config holds the parts of the image config that decide how a container of
+// the image runs.
+type Config struct {
+	Digest       string            `json:"digest"`
+	Created      string            `json:"created,omitempty"`
+	Author       string            `json:"author,omitempty"`
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	User         string            `json:"user,omitempty"`
+	WorkingDir   string            `json:"working_dir,omitempty"`
+	ExposedPorts []string          `json:"exposed_ports,omitempty"`
+	Volumes      []string          `json:"volumes,omitempty"`
+	StopSignal   string            `json:"stop_signal,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// Layer is one layer of a manifest, with the history entry that created it.
+type Layer struct {
+	Digest      string            `json:"digest"`
+	DiffID      string            `json:"diff_id,omitempty"`
+	MediaType   string            `json:"media_type"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	CreatedBy   string            `json:"created_by,omitempty"`
+	Comment     string            `json:"comment,omitempty"`
+	Estargz     bool              `json:"estargz,omitempty"`
+	Contents    *Contents         `json:"contents,omitempty"`
+	// ContentsUnavailable says why Contents is missing although it was asked
+	// for, e.g. because the blob is not in a sparse layout.
+	ContentsUnavailable string `json:"contents_unavailable,omitempty"`
+}
+
+// Contents counts the entries of a layer. A whiteout (a file deleted from a
+// lower layer) is counted as such, not as a file.
+type Contents struct {
+	// Source is where the listing came from: "mtree" or "layer".
+	Source      string `json:"source"`
+	Files       int    `json:"files"`
+	Directories int    `json:"directories"`
+	Symlinks    int    `json:"symlinks"`
+	Whiteouts   int    `json:"whiteouts"`
+	// FileBytes is the sum of the sizes of the regular files.
+	FileBytes int64  `json:"file_bytes"`
+	Largest   []File `json:"largest_files,omitempty"`
+}
+
+// File is a regular file of a layer.
+type File struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// History is an entry of the config history.
+type History struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// LazyPulling reports what lets a snapshotter start a container before its
+// layers are downloaded.
+type LazyPulling struct {
+	// EstargzLayers is the number of layers carrying an eStargz TOC.
+	EstargzLayers int `json:"estargz_layers"`
+	// SOCIIndex is the digest of the SOCI index of the manifest, found
+	// through its annotation, the enclosing index, or its referrers.
+	SOCIIndex string `json:"soci_index,omitempty"`
+}
+
+// Referrer is an artifact whose subject is an image: a signature, an SBOM,
+// an attestation.
+type Referrer struct {
+	Digest       string            `json:"digest"`
+	MediaType    string            `json:"media_type"`
+	ArtifactType string            `json:"artifact_type,omitempty"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// inspect describes every image of a source.
+func inspect(ctx context.Context, src *source, opts options) (*Report, error) {
+	report := &Report{Source: src.description, Images: []Image{}}
+	for _, t := range src.targets {
+		image, err := describeTarget(ctx, src, t, opts)
+		if err != nil {
+			return nil, fmt.Errorf("inspecting %s: %w", t.desc.Digest, err)
+		}
+		report.Images = append(report.Images, image)
+	}
+	return report, nil
+}
+
+func describeTarget(ctx context.Context, src *source, t target, opts options) (Image, error) {
+	image := Image{
+		Names:     t.names,
+		Digest:    t.desc.Digest.String(),
+		MediaType: string(t.desc.MediaType),
+		Size:      t.desc.Size,
+		Platforms: []string{},
+		Manifests: []Manifest{},
+	}
+	referrers := listReferrers(ctx, src, t.desc.Digest)
+	image.Referrers = referrers
+
+	if t.image != nil {
+		manifest, err := describeManifest(t.image, t.desc, opts)
+		if err != nil {
+			return Image{}, err
+		}
+		if image.MediaType == "" {
+			image.MediaType = manifest.MediaType
+		}
+		image.Annotations = manifest.Annotations
+		manifest.LazyPulling.SOCIIndex = sociIndexFromReferrers(manifest.LazyPulling.SOCIIndex, referrers)
+		image.Platforms = append(image.Platforms, manifest.Platform)
+		image.Manifests = append(image.Manifests, manifest)
+		return image, nil
+	}
+
+	manifests, annotations, err := describeIndex(ctx, src, t.index, opts, 0)
+	if err != nil {
+		return Image{}, err
+	}
+	image.Annotations = annotations
+	for _, manifest := range manifests {
+		image.Platforms = append(image.Platforms, manifest.Platform)
+	}
+	image.Manifests = manifests
+	return image, nil
+}
+
+// describeIndex describes the manifests of an index, descending into nested
+// indexes. A SOCI v2 index listed in the index is not a platform of its own:
+// it is recorded on the manifest it belongs to.
+func describeIndex(ctx context.Context, src *source, index v1.ImageIndex, opts options, depth int) ([]Manifest, map[string]string, error) {
+	if depth > 8 {
+		return nil, nil, fmt.Errorf("index nesting too deep")
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	sociIndexes := make(map[string]string)
+	for _, desc := range indexManifest.Manifests {
+		if manifest := desc.Annotations[api.SociImageManifestDigestAnnotation]; manifest != "" {
+			sociIndexes[manifest] = desc.Digest.String()
+		}
+	}
+
+	var manifests []Manifest
+	for _, desc := range indexManifest.Manifests {
+		if desc.Annotations[api.SociImageManifestDigestAnnotation] != "" || desc.ArtifactType == api.SociIndexArtifactTypeV2 {
+			continue
+		}
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, nil, err
+			}
+			nested, _, err := describeIndex(ctx, src, child, opts, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			manifests = append(manifests, nested...)
+		case desc.MediaType.IsImage():
+			if desc.Platform != nil && !platformSelected(desc.Platform.String(), opts.platforms) {
+				continue
+			}
+			image, err := index.Image(desc.Digest)
+			if err != nil {
+				return nil, nil, err
+			}
+			manifest, err := describeManifest(image, desc, opts)
+			if err != nil {
+				return nil, nil, fmt.Errorf("manifest %s: %w", desc.Digest, err)
+			}
+			if desc.Platform == nil && !platformSelected(manifest.Platform, opts.platforms) {
+				continue
+			}
+			if manifest.LazyPulling.SOCIIndex == "" {
+				manifest.LazyPulling.SOCIIndex = sociIndexes[manifest.Digest]
+			}
+			referrers := listReferrers(ctx, src, desc.Digest)
+			manifest.Referrers = referrers
+			manifest.LazyPulling.SOCIIndex = sociIndexFromReferrers(manifest.LazyPulling.SOCIIndex, referrers)
+			manifests = append(manifests, manifest)
+		}
+	}
+	return manifests, indexManifest.Annotations, nil
+}
+
+// platformSelected reports whether a platform passes the --platform filter.
+// A filter without a variant matches every variant.
+func platformSelected(platform string, selected []string) bool {
+	if len(selected) == 0 {
+		return true
+	}
+	for _, want := range selected {
+		if platform == want || strings.HasPrefix(platform, want+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// describeManifest describes the image of one platform. desc is the
+// descriptor the image was found by; its platform, when set, wins over the
+// one in the config.
+func describeManifest(image v1.Image, desc v1.Descriptor, opts options) (Manifest, error) {
+	manifest, err := image.Manifest()
+	if err != nil {
+		return Manifest{}, err
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return Manifest{}, err
+	}
+	size, err := image.Size()
+	if err != nil {
+		return Manifest{}, err
+	}
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		return Manifest{}, fmt.Errorf("reading config: %w", err)
+	}
+
+	result := Manifest{
+		Digest:      digest.String(),
+		MediaType:   string(manifest.MediaType),
+		Size:        size,
+		Annotations: manifest.Annotations,
+		Config:      describeConfig(manifest.Config.Digest, configFile),
+		Layers:      []Layer{},
+		LazyPulling: LazyPulling{SOCIIndex: manifest.Annotations[api.SociIndexDigestAnnotation]},
+	}
+	if desc.Platform != nil {
+		result.Platform = desc.Platform.String()
+	} else {
+		result.Platform = (&v1.Platform{OS: configFile.OS, Architecture: configFile.Architecture, Variant: configFile.Variant}).String()
+	}
+
+	// Every history entry that is not marked empty created the next layer.
+	var layerHistory []v1.History
+	for _, h := range configFile.History {
+		result.History = append(result.History, History{
+			Created:    formatTime(h.Created.Time),
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		})
+		if !h.EmptyLayer {
+			layerHistory = append(layerHistory, h)
+		}
+	}
+
+	for i, desc := range manifest.Layers {
+		layer := Layer{
+			Digest:      desc.Digest.String(),
+			MediaType:   string(desc.MediaType),
+			Size:        desc.Size,
+			Annotations: desc.Annotations,
+			Estargz:     desc.Annotations[api.TocDigestAnnotation] != "",
+		}
+		if i < len(configFile.RootFS.DiffIDs) {
+			layer.DiffID = configFile.RootFS.DiffIDs[i].String()
+		}
+		if i < len(layerHistory) {
+			layer.CreatedBy = layerHistory[i].CreatedBy
+			layer.Comment = layerHistory[i].Comment
+		}
+		if layer.Estargz {
+			result.LazyPulling.EstargzLayers++
+		}
+		describeContents(image, desc, &layer, opts)
+		result.Layers = append(result.Layers, layer)
+	}
+	return result, nil
+}
+
+func describeConfig(digest v1.Hash, configFile *v1.ConfigFile) Config {
+	config := Config{
+		Digest:     digest.String(),
+		Created:    formatTime(configFile.Created.Time),
+		Author:     configFile.Author,
+		Entrypoint: configFile.Config.Entrypoint,
+		Cmd:        configFile.Config.Cmd,
+		Env:        configFile.Config.Env,
+		User:       configFile.Config.User,
+		WorkingDir: configFile.Config.WorkingDir,
+		StopSignal: configFile.Config.StopSignal,
+		Labels:     configFile.Config.Labels,
+	}
+	for port := range configFile.Config.ExposedPorts {
+		config.ExposedPorts = append(config.ExposedPorts, port)
+	}
+	sort.Strings(config.ExposedPorts)
+	for volume := range configFile.Config.Volumes {
+		config.Volumes = append(config.Volumes, volume)
+	}
+	sort.Strings(config.Volumes)
+	return config
+}
+
+// describeContents fills in what a layer holds, from its mtree when one was
+// given, and else from the blob when contents were asked for.
+func describeContents(image v1.Image, desc v1.Descriptor, layer *Layer, opts options) {
+	mtreePath, ok := opts.mtrees[layer.Digest]
+	if !ok && layer.DiffID != "" {
+		mtreePath, ok = opts.mtrees[layer.DiffID]
+	}
+	if ok {
+		f, err := os.Open(mtreePath)
+		if err != nil {
+			layer.ContentsUnavailable = err.Error()
+			return
+		}
+		defer f.Close()
+		contents, err := mtreeContents(f, opts.largest)
+		if err != nil {
+			layer.ContentsUnavailable = fmt.Sprintf("%s: %v", mtreePath, err)
+			return
+		}
+		layer.Contents = contents
+		return
+	}
+	if !opts.contents {
+		return
+	}
+	if !isTarLayer(desc.MediaType) {
+		layer.ContentsUnavailable = "not a tar layer"
+		return
+	}
+	blob, err := image.LayerByDigest(desc.Digest)
+	if err == nil {
+		layer.Contents, err = blobContents(blob, opts.largest)
+	}
+	if err != nil {
+		layer.ContentsUnavailable = err.Error()
+	}
+}
+
+// listReferrers returns the referrers of a digest, sorted by artifact type and
+// digest so the report does not depend on the order a registry lists them in.
+// Not being able to list them, say for lack of permission, is worth a warning
+// but leaves the rest of the report intact.
+func listReferrers(ctx context.Context, src *source, digest v1.Hash) []Referrer {
+	descs, err := src.referrers(ctx, digest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: listing referrers of %s: %v\n", digest, err)
+		return nil
+	}
+	var referrers []Referrer
+	for _, desc := range descs {
+		referrers = append(referrers, Referrer{
+			Digest:       desc.Digest.String(),
+			MediaType:    string(desc.MediaType),
+			ArtifactType: desc.ArtifactType,
+			Size:         desc.Size,
+			Annotations:  desc.Annotations,
+		})
+	}
+	sort.Slice(referrers, func(i, j int) bool {
+		if referrers[i].ArtifactType != referrers[j].ArtifactType {
+			return referrers[i].ArtifactType < referrers[j].ArtifactType
+		}
+		return referrers[i].Digest < referrers[j].Digest
+	})
+	return referrers
+}
+
+// sociIndexFromReferrers returns the SOCI index already known, or else the
+// first referrer that is one.
+func sociIndexFromReferrers(known string, referrers []Referrer) string {
+	if known != "" {
+		return known
+	}
+	for _, referrer := range referrers {
+		if referrer.ArtifactType == sociIndexArtifactTypeV1 || referrer.ArtifactType == api.SociIndexArtifactTypeV2 {
+			return referrer.Digest
+		}
+	}
+	return ""
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,265 @@
+package inspect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/deployvfs"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/ocilayout"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// source is where the images come from: the images themselves, and a way to
+// find the artifacts referring to a manifest.
+type source struct {
+	// description names the source in the report.
+	description string
+	targets     []target
+	// referrers lists the descriptors of the manifests whose subject is the
+	// given digest.
+	referrers func(ctx context.Context, digest v1.Hash) ([]v1.Descriptor, error)
+}
+
+// target is one image of a source: an image manifest or an index.
+type target struct {
+	// names are the references the image goes by: its tag in a registry or
+	// an OCI layout, or where a deploy manifest pushes or loads it.
+	names []string
+	desc  v1.Descriptor
+	// Exactly one of image and index is set.
+	image v1.Image
+	index v1.ImageIndex
+}
+
+// openRegistry reads the image a tag or digest reference points at. Referrers
+// come from the registry's referrers API, or the tag schema fallback for
+// registries without one.
+func openRegistry(ctx context.Context, raw string, opts []remote.Option) (*source, error) {
+	ref, err := name.ParseReference(raw, registryopts.NameOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", raw, err)
+	}
+	opts = append(opts, remote.WithContext(ctx))
+	desc, err := ocilayout.FetchRoot(ctx, ref, opts...)
+	if err != nil {
+		return nil, err
+	}
+	t := target{names: []string{ref.Name()}, desc: desc.Descriptor}
+	if desc.MediaType.IsIndex() {
+		t.index, err = desc.ImageIndex()
+	} else {
+		t.image, err = desc.Image()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &source{
+		description: ref.Name(),
+		targets:     []target{t},
+		referrers: func(ctx context.Context, digest v1.Hash) ([]v1.Descriptor, error) {
+			index, err := remote.Referrers(ref.Context().Digest(digest.String()), append(opts, remote.WithContext(ctx))...)
+			if err != nil {
+				return nil, err
+			}
+			manifest, err := index.IndexManifest()
+			if err != nil {
+				return nil, err
+			}
+			return manifest.Manifests, nil
+		},
+	}, nil
+}
+
+// openLayout reads the images listed in the index.json of an OCI layout. An
+// entry with a subject is not an image of its own but a referrer of the
+// manifest it names, the way `oras` and rules_img store signatures and SBOMs
+// next to an image. Layer blobs missing from a sparse layout are reported as
+// unavailable rather than failing.
+func openLayout(dir string) (*source, error) {
+	l, err := ocilayout.Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	src := &source{description: dir}
+	for _, desc := range l.Roots {
+		t := target{desc: desc}
+		if refName := desc.Annotations[api.AnnotationOCIImageRefName]; refName != "" {
+			t.names = []string{refName}
+		}
+		if desc.MediaType.IsIndex() {
+			t.index, err = l.Index.ImageIndex(desc.Digest)
+		} else {
+			t.image, err = l.Index.Image(desc.Digest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", desc.Digest, err)
+		}
+		src.targets = append(src.targets, t)
+	}
+	if len(src.targets) == 0 {
+		return nil, fmt.Errorf("no images found in OCI layout %s", dir)
+	}
+	src.referrers = func(_ context.Context, digest v1.Hash) ([]v1.Descriptor, error) {
+		return l.Referrers[digest], nil
+	}
+	return src, nil
+}
+
+// openDeployManifest reads the images a deploy manifest pushes or loads, from
+// the same places `img deploy` would. A push operation marked as a referrer
+// (an SBOM, say) is listed as a referrer of its subject instead.
+func openDeployManifest(ctx context.Context, manifestPath string, opts []remote.Option) (*source, error) {
+	raw, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var dm api.DeployManifest
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&dm); err != nil {
+		return nil, fmt.Errorf("unmarshalling deploy manifest file: %w", err)
+	}
+	// Inspecting only reads. With these strategies a layer that is found in
+	// no source becomes a stub, described without its contents, instead of
+	// failing the whole VFS the way a deploy has to.
+	dm.Settings.PushStrategy = "cas_registry"
+	dm.Settings.LoadStrategy = "cas_registry"
+	vfs, err := deployvfs.NewBuilder(dm).
+		WithContainerRegistryOptions(opts...).
+		WithContext(ctx).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	pushOps, err := dm.PushOperations()
+	if err != nil {
+		return nil, err
+	}
+	loadOps, err := dm.LoadOperations()
+	if err != nil {
+		return nil, err
+	}
+
+	src := &source{description: manifestPath}
+	byDigest := make(map[string]int)
+	addTarget := func(op api.BaseCommandOperation, names []string) error {
+		if i, ok := byDigest[op.Root.Digest]; ok {
+			src.targets[i].names = append(src.targets[i].names, names...)
+			return nil
+		}
+		digest, err := v1.NewHash(op.Root.Digest)
+		if err != nil {
+			return fmt.Errorf("root of operation: %w", err)
+		}
+		t := target{
+			names: names,
+			desc: v1.Descriptor{
+				MediaType:   types.MediaType(op.Root.MediaType),
+				Size:        op.Root.Size,
+				Digest:      digest,
+				Annotations: op.Root.Annotations,
+			},
+		}
+		if op.RootKind == "index" {
+			t.index, err = vfs.ImageIndex(digest)
+		} else {
+			t.image, err = vfs.Image(digest)
+		}
+		if err != nil {
+			return err
+		}
+		byDigest[op.Root.Digest] = len(src.targets)
+		src.targets = append(src.targets, t)
+		return nil
+	}
+
+	referrers := make(map[v1.Hash][]v1.Descriptor)
+	for _, op := range pushOps {
+		if op.Referrer {
+			desc, subject, err := deployReferrer(vfs, op.Root)
+			if err != nil {
+				return nil, err
+			}
+			if subject != nil {
+				referrers[*subject] = append(referrers[*subject], desc)
+			}
+			continue
+		}
+		if err := addTarget(op.BaseCommandOperation, pushNames(op.PushTarget, op.Root.Digest)); err != nil {
+			return nil, fmt.Errorf("push operation %d: %w", op.I, err)
+		}
+	}
+	for _, op := range loadOps {
+		if err := addTarget(op.BaseCommandOperation, op.ImageNames()); err != nil {
+			return nil, fmt.Errorf("load operation %d: %w", op.I, err)
+		}
+	}
+	if len(src.targets) == 0 {
+		return nil, fmt.Errorf("deploy manifest %s pushes or loads no images", manifestPath)
+	}
+	src.referrers = func(_ context.Context, digest v1.Hash) ([]v1.Descriptor, error) {
+		return referrers[digest], nil
+	}
+	return src, nil
+}
+
+// pushNames returns the references a push operation writes: one per tag, or
+// the digest reference when it pushes no tags.
+func pushNames(target api.PushTarget, digest string) []string {
+	repository := target.Repository
+	if target.Registry != "" {
+		repository = target.Registry + "/" + target.Repository
+	}
+	if len(target.Tags) == 0 {
+		return []string{repository + "@" + digest}
+	}
+	names := make([]string, 0, len(target.Tags))
+	for _, tag := range target.Tags {
+		names = append(names, repository+":"+tag)
+	}
+	return names
+}
+
+// deployReferrer reads the manifest pushed by a referrer operation and returns
+// its descriptor and the digest of its subject.
+func deployReferrer(vfs *deployvfs.VFS, root api.Descriptor) (v1.Descriptor, *v1.Hash, error) {
+	digest, err := v1.NewHash(root.Digest)
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	blob, err := vfs.ManifestBlob(digest)
+	if err != nil {
+		return v1.Descriptor{}, nil, err
+	}
+	rc, err := blob.Compressed()
+	if err != nil {
+		return v1.Descriptor{}, nil, fmt.Errorf("reading referrer manifest %s: %w", digest, err)
+	}
+	defer rc.Close()
+	var raw bytes.Buffer
+	if _, err := raw.ReadFrom(rc); err != nil {
+		return v1.Descriptor{}, nil, fmt.Errorf("reading referrer manifest %s: %w", digest, err)
+	}
+	desc := v1.Descriptor{
+		MediaType:   types.MediaType(root.MediaType),
+		Size:        root.Size,
+		Digest:      digest,
+		Annotations: root.Annotations,
+	}
+	subject, artifactType := ocilayout.SubjectOf(raw.Bytes())
+	desc.ArtifactType = artifactType
+	if subject == nil {
+		return desc, nil, nil
+	}
+	return desc, &subject.Digest, nil
+}
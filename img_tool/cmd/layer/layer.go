@@ -16,12 +16,9 @@ import (
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/compress"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/contentmanifest"
-	"github.com/bazel-contrib/rules_img/img_tool/pkg/digestfs"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/kvfile"
-	"github.com/bazel-contrib/rules_img/img_tool/pkg/metadata"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerbuild"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/tarcas"
-	"github.com/bazel-contrib/rules_img/img_tool/pkg/tree"
-	"github.com/bazel-contrib/rules_img/img_tool/pkg/tree/runfiles"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/ztoc"
 )
 
@@ -45,6 +42,13 @@ func LayerProcess(ctx context.Context, args []string) {
 	var baseMetadataFromFiles baseMetadataFromFileArgs
 	var formatFlag string
 	var estargzFlag bool
+	var estargzPrioritizedFilesFlag string
+	var zstdChunkedFlag bool
+	var splitStrategyFlag string
+	var splitMaxSizeFlag int64
+	var splitPrefixFlags splitPrefixArgs
+	var splitBucketsFlag int
+	var splitOutputDirFlag string
 	var mediaTypeFlag string
 	var metadataOutputFlag string
 	var contentManifestOutputFlag string
@@ -96,6 +100,13 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 	flagSet.StringVar(&contentManifestCollection, "deduplicate-collection", "", `Path of a content manifest collection file that can be used for deduplication.`)
 	flagSet.StringVar(&formatFlag, "format", "", `The compression format of the output layer. Can be "gzip", "zstd", or "none". Default is to guess the algorithm based on the filename, but fall back to "gzip".`)
 	flagSet.BoolVar(&estargzFlag, "estargz", false, `Use estargz format for compression. This creates seekable gzip streams optimized for lazy pulling.`)
+	flagSet.StringVar(&estargzPrioritizedFilesFlag, "estargz-prioritized-files", "", `File listing paths in the image, one per line, that the estargz layer writes first, followed by the prefetch landmark, so stargz-snapshotter can prefetch them when a container starts (e.g. the files a previous container run opened, in that order). Paths that are not in this layer are ignored. Requires --estargz.`)
+	flagSet.BoolVar(&zstdChunkedFlag, "zstd-chunked", false, `Use the zstd:chunked format of containers/storage (podman, CRI-O) for compression. Every file is compressed into a zstd frame of its own, and a TOC and tar-split data are appended, so that clients can pull only the files they do not have yet. The layer stays a valid zstd layer. Requires --format zstd; cannot be combined with --estargz.`)
+	flagSet.StringVar(&splitStrategyFlag, "split-strategy", "", `Split the inputs into several layers instead of one. "size" fills layers in input order up to --split-max-size uncompressed bytes each. "prefix" puts the inputs under each --split-prefix into a layer of their own, followed by a layer for everything else. "hash" assigns inputs to --split-buckets layers by the SHA-256 of their content (of their path in the image for inputs without content), so unchanged files stay in the same layer. Base metadata streams and imported tars always go into the first layer. Requires --split-output-dir.`)
+	flagSet.Int64Var(&splitMaxSizeFlag, "split-max-size", 0, `Maximum uncompressed content bytes per layer for --split-strategy size. A single input larger than this gets a layer of its own.`)
+	flagSet.Var(&splitPrefixFlags, "split-prefix", `A path prefix in the image that gets a layer of its own with --split-strategy prefix. Can be specified multiple times; layers follow the order of the flags, and an input under several prefixes goes to the longest one.`)
+	flagSet.IntVar(&splitBucketsFlag, "split-buckets", 0, `Number of layers for --split-strategy hash.`)
+	flagSet.StringVar(&splitOutputDirFlag, "split-output-dir", "", `Directory to write split layers to: layer-NNN.<ext> with layer-NNN_metadata.json and layer-NNN.content_manifest for every layer, and manifest_fragment.json listing the layer metadata in order (see "img manifest --layers-from-manifest-fragment"). Replaces the positional output, --metadata and --content-manifest.`)
 	flagSet.StringVar(&mediaTypeFlag, "media-type", "", `Override the layer media type in the metadata output. If empty, auto-detected from the compression format.`)
 	flagSet.StringVar(&compressorJobsFlag, "compressor-jobs", "1", `Number of compressor jobs. 1 uses single-threaded stdlib gzip. n>1 uses pgzip. "nproc" uses NumCPU.`)
 	flagSet.IntVar(&compressionLevelFlag, "compression-level", -1, `Compression level. For gzip: 0-9. If unset, use library default.`)
@@ -129,7 +140,47 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 		os.Exit(1)
 	}
 
-	if !compactStreamOnlyFlag && flagSet.NArg() != 1 {
+	if estargzPrioritizedFilesFlag != "" && !estargzFlag {
+		fmt.Fprintf(os.Stderr, "Error: --estargz-prioritized-files requires --estargz\n")
+		os.Exit(1)
+	}
+
+	if zstdChunkedFlag && estargzFlag {
+		fmt.Fprintf(os.Stderr, "Error: --zstd-chunked cannot be combined with --estargz\n")
+		os.Exit(1)
+	}
+
+	var splitOpts splitOptions
+	if splitStrategyFlag != "" || splitOutputDirFlag != "" {
+		splitOpts = splitOptions{
+			strategy: splitStrategyFlag,
+			maxSize:  splitMaxSizeFlag,
+			prefixes: splitPrefixFlags,
+			buckets:  splitBucketsFlag,
+		}
+		if splitStrategyFlag == "" {
+			fmt.Fprintf(os.Stderr, "Error: --split-output-dir requires --split-strategy\n")
+			os.Exit(1)
+		}
+		if splitOutputDirFlag == "" {
+			fmt.Fprintf(os.Stderr, "Error: --split-strategy requires --split-output-dir\n")
+			os.Exit(1)
+		}
+		if err := splitOpts.validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if flagSet.NArg() > 0 || metadataOutputFlag != "" || contentManifestOutputFlag != "" {
+			fmt.Fprintf(os.Stderr, "Error: --split-strategy writes its outputs to --split-output-dir and does not accept a positional output, --metadata or --content-manifest\n")
+			os.Exit(1)
+		}
+		if compactStreamOutputFlag != "" || compactStreamOnlyFlag || ztocOutputFlag != "" || estargzPrioritizedFilesFlag != "" {
+			fmt.Fprintf(os.Stderr, "Error: --split-strategy cannot be combined with --compact-stream, --compact-stream-only, --ztoc or --estargz-prioritized-files\n")
+			os.Exit(1)
+		}
+	}
+
+	if !compactStreamOnlyFlag && splitOpts.strategy == "" && flagSet.NArg() != 1 {
 		flagSet.Usage()
 		os.Exit(1)
 	}
@@ -139,7 +190,7 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 	}
 
 	var outputFilePath string
-	if !compactStreamOnlyFlag {
+	if !compactStreamOnlyFlag && splitOpts.strategy == "" {
 		outputFilePath = flagSet.Arg(0)
 	}
 
@@ -162,7 +213,7 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 	var compressionAlgorithm api.CompressionAlgorithm
 	switch formatFlag {
 	case "":
-		if compactStreamOnlyFlag {
+		if compactStreamOnlyFlag || splitOpts.strategy != "" {
 			compressionAlgorithm = api.Gzip
 		} else if filepath.Ext(outputFilePath) == ".tar" {
 			compressionAlgorithm = api.Uncompressed
@@ -189,10 +240,15 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 		os.Exit(1)
 	}
 
+	if zstdChunkedFlag && compressionAlgorithm != api.Zstd {
+		fmt.Fprintf(os.Stderr, "Error: --zstd-chunked requires zstd compression, got %s\n", compressionAlgorithm)
+		os.Exit(1)
+	}
+
 	var outputFile io.Writer
 	if compactStreamOnlyFlag {
 		outputFile = io.Discard
-	} else {
+	} else if splitOpts.strategy == "" {
 		f, err := os.OpenFile(outputFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error opening output file: %v\n", err)
@@ -208,7 +264,7 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 	}
 
 	// Parse layer metadata
-	layerMetadata, err := ParseLayerMetadata(defaultMetadataFlag, fileMetadataFlags)
+	layerMetadata, err := layerbuild.ParseMetadata(defaultMetadataFlag, fileMetadataFlags)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error parsing metadata: %v\n", err)
 		os.Exit(1)
@@ -216,7 +272,7 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 
 	// read the addFromFile parameter file and create a list of operations
 	for _, paramFile := range addFromFile {
-		addFileOpsFromParamFile, err := readParamFile(paramFile)
+		addFileOpsFromParamFile, err := layerbuild.ReadParamFile(paramFile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error reading parameter file: %v\n", err)
 			os.Exit(1)
@@ -237,7 +293,7 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 
 	// read the symlinksFromFile parameter file and create a list of operations
 	for _, paramFile := range symlinksFromFiles {
-		symlinkOpsFromParamFile, err := readSymlinkParamFile(paramFile)
+		symlinkOpsFromParamFile, err := layerbuild.ReadSymlinkParamFile(paramFile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error reading symlink parameter file: %v\n", err)
 			os.Exit(1)
@@ -258,7 +314,7 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 	// read the emptyFilesFromFile parameter files and collect paths
 	var emptyFilePaths []string
 	for _, paramFile := range emptyFilesFromFiles {
-		paths, err := readEmptyFilesParamFile(paramFile)
+		paths, err := layerbuild.ReadEmptyFilesParamFile(paramFile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error reading empty files parameter file: %v\n", err)
 			os.Exit(1)
@@ -266,6 +322,16 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 		emptyFilePaths = append(emptyFilePaths, paths...)
 	}
 
+	var prioritizedFiles []string
+	if estargzPrioritizedFilesFlag != "" {
+		paths, err := readPrioritizedFilesFile(estargzPrioritizedFilesFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		prioritizedFiles = paths
+	}
+
 	// read the baseMetadataFromFile parameter files and collect stream paths.
 	// Streams named directly on the command line come first, then those listed
 	// in parameter files, in the order given.
@@ -315,6 +381,39 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 		casImporter.AddCollection(contentManifestCollection)
 	}
 
+	if splitOpts.strategy != "" {
+		layers, err := splitLayerInputs(splitOpts, layerInputs{
+			addFiles:          addFiles,
+			importTars:        importTarFlags,
+			executables:       executableFlags,
+			symlinks:          symlinkFlags,
+			emptyFiles:        emptyFilePaths,
+			baseMetadataPaths: baseMetadataPaths,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Splitting layer: %v\n", err)
+			os.Exit(1)
+		}
+		if err := writeSplitLayers(layers, splitOutputDirFlag, splitLayerSettings{
+			compressionAlgorithm:    compressionAlgorithm,
+			useEstargz:              estargzFlag,
+			zstdChunked:             zstdChunkedFlag,
+			casImporter:             casImporter,
+			layerMetadata:           layerMetadata,
+			compressorJobs:          compressorJobsFlag,
+			compressionLevel:        compressionLevelFlag,
+			createParentDirectories: createParentDirectoriesFlag,
+			treeArtifactHandling:    treeArtifactHandlingFlag,
+			history:                 layerHistory,
+			mediaType:               mediaTypeFlag,
+			annotations:             annotations,
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "Writing split layers: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var casExporter api.CASStateExporter
 	if len(contentManifestOutputFlag) > 0 {
 		casExporter = contentmanifest.New(contentManifestOutputFlag, api.SHA256)
@@ -323,7 +422,7 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 	}
 
 	compressorState, err := handleLayerState(
-		compressionAlgorithm, estargzFlag, addFiles, importTarFlags, executableFlags, symlinkFlags, emptyFilePaths,
+		compressionAlgorithm, estargzFlag, zstdChunkedFlag, prioritizedFiles, addFiles, importTarFlags, executableFlags, symlinkFlags, emptyFilePaths,
 		baseMetadataPaths,
 		casImporter, casExporter, outputFile, layerMetadata,
 		compressorJobsFlag, compressionLevelFlag, createParentDirectoriesFlag,
@@ -358,7 +457,7 @@ The type is either 'f' for regular files, 'd' for directories. The parameter fil
 			}
 		}()
 
-		if err := writeMetadata(layerHistory, compressionAlgorithm, estargzFlag, mediaTypeFlag, annotations, compressorState, metadataOutputFile); err != nil {
+		if err := layerbuild.WriteMetadata(layerHistory, compressionAlgorithm, estargzFlag, mediaTypeFlag, annotations, compressorState, metadataOutputFile); err != nil {
 			fmt.Fprintf(os.Stderr, "Writing metadata: %v\n", err)
 			os.Exit(1)
 		}
@@ -416,20 +515,13 @@ func compactStreamCompressionLevel(level int) (int8, error) {
 }
 
 func handleLayerState(
-	compressionAlgorithm api.CompressionAlgorithm, useEstargz bool, addFiles addFiles, importTars importTars, addExecutables executables, addSymlinks symlinks, emptyFiles []string,
+	compressionAlgorithm api.CompressionAlgorithm, useEstargz, zstdChunked bool, prioritizedFiles []string, addFiles addFiles, importTars importTars, addExecutables executables, addSymlinks symlinks, emptyFiles []string,
 	baseMetadataPaths []string,
-	casImporter api.CASStateSupplier, casExporter api.CASStateExporter, outputFile io.Writer, layerMetadata *LayerMetadata,
+	casImporter api.CASStateSupplier, casExporter api.CASStateExporter, outputFile io.Writer, layerMetadata *layerbuild.Metadata,
 	compressorJobsFlag string, compressionLevelFlag int, createParentDirectories bool,
 	treeArtifactHandling string,
 	compactStreamPath string, compactStreamInlineThreshold uint64,
 ) (compressorState api.AppenderState, err error) {
-	// Create shared digestfs with precaching
-	digestFS := digestfs.New(&tarcas.SHA256Helper{})
-	precacher := digestfs.NewPrecacher(digestFS, 4) // 4 workers as requested
-	defer precacher.Close()
-
-	// Start precaching files in the background
-	startPrecaching(precacher, addFiles, addExecutables)
 	var opts []compress.Option
 	// compression level
 	if compressionLevelFlag >= 0 {
@@ -444,18 +536,14 @@ func handleLayerState(
 			opts = append(opts, compress.CompressorJobs(n))
 		}
 	}
-
-	compressor, err := compress.TarAppenderFactory("sha256", string(compressionAlgorithm), useEstargz, outputFile, opts...)
-	if err != nil {
-		return compressorState, fmt.Errorf("creating compressor: %w", err)
+	if len(prioritizedFiles) > 0 {
+		opts = append(opts, compress.PrioritizedFiles(prioritizedFiles))
+	}
+	if zstdChunked {
+		opts = append(opts, compress.ZstdChunked(true))
 	}
 
 	var tarcasOpts []tarcas.Option
-	tarcasOpts = append(tarcasOpts,
-		tarcas.CreateParentDirectories(createParentDirectories),
-		tarcas.DeduplicateTreeArtifacts(treeArtifactHandling == "deduplicate_symlink"),
-	)
-
 	var csFile *os.File
 	var csWriter *compactstream.Writer
 	if compactStreamPath != "" {
@@ -470,6 +558,7 @@ func handleLayerState(
 		if err != nil {
 			return compressorState, fmt.Errorf("opening compact stream output file: %w", err)
 		}
+		defer csFile.Close()
 
 		var origComp uint8
 		switch compressionAlgorithm {
@@ -493,185 +582,53 @@ func handleLayerState(
 			compactstream.StreamCompressionZstd,
 			compactstream.OriginalCompressionInfo{
 				Compression:      origComp,
-				Seekable:         useEstargz,
+				Seekable:         useEstargz || zstdChunked,
 				CompressionLevel: csLevel,
 				CompressorJobs:   recordedCompressorJobs(compressorJobsFlag),
+				ZstdChunked:      zstdChunked,
+				PrioritizedFiles: prioritizedFiles,
 			},
 			inlineThreshold,
 		)
 		tarcasOpts = append(tarcasOpts, tarcas.WithCompactStreamWriter{Writer: csWriter})
 	}
 
-	tw, err := tarcas.CASFactoryWithDigestFS("sha256", compressor, digestFS, tarcasOpts...)
+	compressorState, err = layerbuild.Write(outputFile, layerbuild.Contents{
+		BaseMetadataPaths: baseMetadataPaths,
+		ImportTars:        importTars,
+		Files:             addFiles,
+		Executables:       addExecutables,
+		Symlinks:          addSymlinks,
+		EmptyFiles:        emptyFiles,
+	}, layerbuild.Options{
+		Compression:              compressionAlgorithm,
+		Seekable:                 useEstargz || zstdChunked,
+		CompressOptions:          opts,
+		TarCASOptions:            tarcasOpts,
+		CreateParentDirectories:  createParentDirectories,
+		DeduplicateTreeArtifacts: treeArtifactHandling == "deduplicate_symlink",
+		Metadata:                 layerMetadata,
+		CASImporter:              casImporter,
+		CASExporter:              casExporter,
+	})
 	if err != nil {
-		return compressorState, fmt.Errorf("creating Content-addressable storage inside tar file: %w", err)
-	}
-	// Finalization runs in this deferred closure so it executes on every exit
-	// path, and in a specific order: close the tar writer (flushing all tar data
-	// into the compressor and feeding the index observer), then finalize the
-	// compressor to obtain the compressed-stream digest and size, then record
-	// that information on the index and emit it. The index is written last
-	// because its compressed-stream digest is only known once the compressor has
-	// been finalized.
-	defer func() {
-		if err := tw.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error closing tar writer: %v\n", err)
-			os.Exit(1)
-		}
-
-		var compressorCloseErr error
-		compressorState, compressorCloseErr = compressor.Finalize()
-		if compressorCloseErr != nil {
-			fmt.Fprintf(os.Stderr, "Error closing compressor: %v\n", compressorCloseErr)
-			os.Exit(1)
-		}
-
-		if csWriter != nil {
-			if err := csWriter.SetCompressedStreamInfo(compressorState.OuterHash, uint64(compressorState.CompressedSize)); err != nil {
-				fmt.Fprintf(os.Stderr, "Error recording compressed stream info on compact stream: %v\n", err)
-				os.Exit(1)
-			}
-			if err := csWriter.Close(); err != nil {
-				fmt.Fprintf(os.Stderr, "Error writing compact stream: %v\n", err)
-				os.Exit(1)
-			}
-			if err := csFile.Close(); err != nil {
-				fmt.Fprintf(os.Stderr, "Error closing index file: %v\n", err)
-				os.Exit(1)
-			}
-		}
-	}()
-	if err := tw.Import(casImporter); err != nil {
-		return compressorState, fmt.Errorf("importing content manifests for deduplication: %w", err)
-	}
-
-	recorder := tree.NewRecorder(tw)
-	if layerMetadata != nil {
-		recorder = recorder.WithMetadata(layerMetadata)
-	}
-	if err := writeLayer(recorder, addFiles, importTars, addExecutables, addSymlinks, emptyFiles, baseMetadataPaths, createParentDirectories, layerMetadata); err != nil {
 		return compressorState, err
 	}
 
-	return compressorState, tw.Export(casExporter)
-}
-
-func writeLayer(recorder tree.Recorder, addFiles addFiles, importTars importTars, addExecutables executables, addSymlinks symlinks, emptyFiles []string, baseMetadataPaths []string, createParentDirectories bool, layerMetadata *LayerMetadata) error {
-	// Base metadata comes first: it describes the scaffolding of the image (the
-	// directory skeleton, /etc, the trust store), and writing it ahead of
-	// everything else keeps parent directories in front of the files placed
-	// into them.
-	if len(baseMetadataPaths) > 0 {
-		if err := writeBaseEntries(recorder, baseMetadataPaths, createParentDirectories, layerMetadata); err != nil {
-			return err
+	// The compact stream is finished last: its compressed-stream digest is
+	// only known once Write has finalized the compressor.
+	if csWriter != nil {
+		if err := csWriter.SetCompressedStreamInfo(compressorState.OuterHash, uint64(compressorState.CompressedSize)); err != nil {
+			return compressorState, fmt.Errorf("recording compressed stream info on compact stream: %w", err)
 		}
-	}
-
-	for _, tarFile := range importTars {
-		if err := recorder.ImportTar(tarFile); err != nil {
-			return fmt.Errorf("importing tar file: %w", err)
+		if err := csWriter.Close(); err != nil {
+			return compressorState, fmt.Errorf("writing compact stream: %w", err)
 		}
-	}
-
-	for _, op := range addFiles {
-		switch op.FileType {
-		case api.RegularFile:
-			if err := recorder.RegularFileFromPath(op.File, op.PathInImage); err != nil {
-				return fmt.Errorf("writing regular file: %w", err)
-			}
-		case api.Directory:
-			if err := recorder.TreeFromPath(op.File, op.PathInImage); err != nil {
-				return fmt.Errorf("writing directory: %w", err)
-			}
-		case api.Symlink:
-			link, err := op.Readlink()
-			if err != nil {
-				return fmt.Errorf("reading symlink: %w", err)
-			}
-			if err := recorder.Symlink(link, op.PathInImage); err != nil {
-				return fmt.Errorf("writing symlink: %w", err)
-			}
-		default:
-			return fmt.Errorf("unknown type %s for file %s", op.FileType.String(), op.File)
+		if err := csFile.Close(); err != nil {
+			return compressorState, fmt.Errorf("closing compact stream output file: %w", err)
 		}
 	}
-
-	for _, op := range addExecutables {
-		runfilesList, err := readParamFile(op.RunfilesParameterFile)
-		if err != nil {
-			return fmt.Errorf("reading runfiles parameter file: %w", err)
-		}
-		accessor := runfiles.NewRunfilesFS()
-		for _, f := range runfilesList {
-			accessor.Add(f.PathInImage, f)
-		}
-		if err := recorder.Executable(op.Executable, op.PathInImage, accessor); err != nil {
-			return fmt.Errorf("writing executable: %w", err)
-		}
-	}
-
-	for _, op := range addSymlinks {
-		if err := recorder.Symlink(op.Target, op.LinkName); err != nil {
-			return fmt.Errorf("writing symlink: %w", err)
-		}
-	}
-
-	for _, path := range emptyFiles {
-		if err := recorder.EmptyFile(path); err != nil {
-			return fmt.Errorf("writing empty file: %w", err)
-		}
-	}
-
-	// Verify that all file metadata entries were used
-	if layerMetadata != nil {
-		if err := layerMetadata.VerifyAllFileMetadataUsed(); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func writeMetadata(history string, compressionAlgorithm api.CompressionAlgorithm, useEstargz bool, mediaTypeOverride string, annotations map[string]string, compressorState api.AppenderState, outputFile io.Writer) error {
-	// Record the created_by history from the user-provided --history; a missing
-	// value becomes "history missing" (LayerHistory).
-	layerHistory := api.LayerHistory(history)
-	var mediaType string
-	if mediaTypeOverride != "" {
-		mediaType = mediaTypeOverride
-	} else {
-		switch compressionAlgorithm {
-		case api.Uncompressed:
-			mediaType = "application/vnd.oci.image.layer.v1.tar"
-		case api.Gzip:
-			mediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
-		case api.Zstd:
-			mediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
-		default:
-			return fmt.Errorf("unsupported compression algorithm: %s", compressionAlgorithm)
-		}
-	}
-
-	// Merge user annotations with layer annotations from the appender state
-	mergedAnnotations := metadata.MergeAnnotations(annotations, compressorState.LayerAnnotations)
-
-	// Replace sentinel annotation values with computed diff ID
-	diffID := fmt.Sprintf("sha256:%x", compressorState.ContentHash)
-	for _, key := range annotationKeysWithDerivableDiffID {
-		if v, ok := mergedAnnotations[key]; ok && v == "DERIVE_FROM_DIFF_ID" {
-			mergedAnnotations[key] = diffID
-		}
-	}
-
-	return metadata.WriteLayerMetadata(
-		fmt.Sprintf("sha256:%x", compressorState.ContentHash),
-		mediaType,
-		fmt.Sprintf("sha256:%x", compressorState.OuterHash),
-		compressorState.CompressedSize,
-		mergedAnnotations,
-		layerHistory,
-		outputFile,
-	)
+	return compressorState, nil
 }
 
 // generateLayerZtoc builds a ztoc (SOCI table of contents) for the finalized
@@ -693,39 +650,6 @@ func generateLayerZtoc(blobPath, ztocPath string, spanSize int64, buildToolIdent
 	return nil
 }
 
-// startPrecaching begins background digest calculation for files that will be processed
-func startPrecaching(precacher *digestfs.Precacher, addFiles addFiles, addExecutables executables) {
-	// Collect all files that will need digest calculation
-	var filesToPrecache []string
-
-	// Add files from addFiles operations
-	for _, op := range addFiles {
-		if op.FileType == api.RegularFile {
-			filesToPrecache = append(filesToPrecache, op.File)
-		}
-	}
-
-	// Add executable files and their runfiles
-	for _, op := range addExecutables {
-		filesToPrecache = append(filesToPrecache, op.Executable)
-
-		// Add runfiles if available
-		if op.RunfilesParameterFile != "" {
-			runfilesList, err := readParamFile(op.RunfilesParameterFile)
-			if err == nil {
-				for _, f := range runfilesList {
-					if f.FileType == api.RegularFile {
-						filesToPrecache = append(filesToPrecache, f.File)
-					}
-				}
-			}
-		}
-	}
-
-	// Start precaching in the background
-	precacher.PrecacheFiles(filesToPrecache)
-}
-
 // readAnnotationsFile reads a file containing annotations in JSON or
 // newline-delimited KEY=VALUE form (see the kvfile package) and flattens it to
 // a map, keeping the last value for each key.
@@ -736,9 +660,3 @@ func readAnnotationsFile(path string) (map[string]string, error) {
 	}
 	return kvfile.Flatten(pairs), nil
 }
-
-// any annotation keys in this list can be set to the magic sentinel
-// "DERIVE_FROM_DIFF_ID" to inject the diff_id as a layer annotation.
-var annotationKeysWithDerivableDiffID = []string{
-	"io.deis.oras.content.digest",
-}
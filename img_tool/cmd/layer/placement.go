@@ -6,6 +6,8 @@ import (
 	"os"
 	"path"
 	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerbuild"
 )
 
 // placeFilesSpec describes how to place a target's default outputs into the
@@ -90,7 +92,7 @@ func readPlaceFilesParamFile(paramFile string) (addFiles, error) {
 		if line == "" {
 			continue
 		}
-		shortPath, typeOfFile, source, err := splitParamFileLine(line)
+		shortPath, typeOfFile, source, err := layerbuild.SplitParamFileLine(line)
 		if err != nil {
 			return nil, fmt.Errorf("parsing placement parameter file: %w", err)
 		}
@@ -109,7 +111,7 @@ func readPlaceFilesParamFile(paramFile string) (addFiles, error) {
 		if err != nil {
 			return nil, err
 		}
-		typ, err := parseFileType(entry.Type, entry.Source)
+		typ, err := layerbuild.ParseFileType(entry.Type, entry.Source)
 		if err != nil {
 			return nil, fmt.Errorf("parsing placement parameter file: %w", err)
 		}
@@ -0,0 +1,398 @@
+package layer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/contentmanifest"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerbuild"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/metadata"
+)
+
+// Split strategies for --split-strategy.
+const (
+	// splitBySize fills layers in input order until the next input would
+	// take a layer beyond --split-max-size uncompressed bytes.
+	splitBySize = "size"
+	// splitByPrefix puts inputs under each --split-prefix into a layer of
+	// their own, and everything else into a final layer.
+	splitByPrefix = "prefix"
+	// splitByHash assigns inputs to --split-buckets layers by a hash of
+	// their content, so a file lands in the same layer on every build.
+	splitByHash = "hash"
+)
+
+// manifestFragmentName is the file in the split output directory listing the
+// layers in order.
+const manifestFragmentName = "manifest_fragment.json"
+
+type splitOptions struct {
+	strategy string
+	maxSize  int64
+	prefixes []string
+	buckets  int
+}
+
+func (o splitOptions) validate() error {
+	switch o.strategy {
+	case splitBySize:
+		if o.maxSize <= 0 {
+			return fmt.Errorf("--split-strategy size requires a positive --split-max-size")
+		}
+	case splitByPrefix:
+		if len(o.prefixes) == 0 {
+			return fmt.Errorf("--split-strategy prefix requires at least one --split-prefix")
+		}
+		for _, prefix := range o.prefixes {
+			if strings.Trim(prefix, "/") == "" {
+				return fmt.Errorf("--split-prefix %q does not name a directory", prefix)
+			}
+		}
+	case splitByHash:
+		if o.buckets < 2 {
+			return fmt.Errorf("--split-strategy hash requires --split-buckets of at least 2")
+		}
+	default:
+		return fmt.Errorf("unknown --split-strategy %q (supported: size, prefix, hash)", o.strategy)
+	}
+	return nil
+}
+
+// layerInputs are the inputs of a single layer.
+type layerInputs struct {
+	addFiles          addFiles
+	importTars        importTars
+	executables       executables
+	symlinks          symlinks
+	emptyFiles        []string
+	baseMetadataPaths []string
+}
+
+// splitItem is an input that can be placed in any layer of a split.
+type splitItem struct {
+	pathInImage string
+	// contentPath is the file whose content places the item under
+	// splitByHash. Items without one are placed by their path in the image.
+	contentPath string
+	// size is the number of uncompressed content bytes the item adds.
+	size int64
+	add  func(*layerInputs)
+}
+
+// splitLayerInputs distributes inputs over layers according to opts.
+//
+// Base metadata streams and imported tars describe many entries at once and
+// cannot be split; they always go into the first layer, where they would also
+// be written without splitting. All other inputs (files, directories,
+// executables with their runfiles, symlinks and empty files) are placed one by
+// one.
+//
+// The size strategy yields as many layers as it needs. The prefix strategy
+// yields one layer per prefix, in the order given, followed by one for
+// everything else, and the hash strategy one layer per bucket. The layers of
+// these two are written even when they are empty, so the number of layers only
+// depends on the flags.
+func splitLayerInputs(opts splitOptions, in layerInputs) ([]layerInputs, error) {
+	first := layerInputs{
+		importTars:        in.importTars,
+		baseMetadataPaths: in.baseMetadataPaths,
+	}
+	items, err := collectSplitItems(in)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.strategy {
+	case splitBySize:
+		var firstSize int64
+		for _, path := range append(append([]string(nil), in.baseMetadataPaths...), in.importTars...) {
+			size, err := contentSize(path)
+			if err != nil {
+				return nil, err
+			}
+			firstSize += size
+		}
+		layers := []layerInputs{first}
+		currentSize := firstSize
+		for _, item := range items {
+			if currentSize > 0 && currentSize+item.size > opts.maxSize {
+				layers = append(layers, layerInputs{})
+				currentSize = 0
+			}
+			item.add(&layers[len(layers)-1])
+			currentSize += item.size
+		}
+		return layers, nil
+	case splitByPrefix:
+		layers := make([]layerInputs, len(opts.prefixes)+1)
+		layers[0] = first
+		for _, item := range items {
+			item.add(&layers[prefixLayer(opts.prefixes, item.pathInImage)])
+		}
+		return layers, nil
+	case splitByHash:
+		layers := make([]layerInputs, opts.buckets)
+		layers[0] = first
+		for _, item := range items {
+			bucket, err := hashBucket(item, opts.buckets)
+			if err != nil {
+				return nil, err
+			}
+			item.add(&layers[bucket])
+		}
+		return layers, nil
+	}
+	return nil, fmt.Errorf("unknown --split-strategy %q", opts.strategy)
+}
+
+// collectSplitItems lists the placeable inputs in the order writeLayer writes
+// them.
+func collectSplitItems(in layerInputs) ([]splitItem, error) {
+	var items []splitItem
+	for _, op := range in.addFiles {
+		var size int64
+		var contentPath string
+		switch op.FileType {
+		case api.RegularFile:
+			var err error
+			if size, err = contentSize(op.File); err != nil {
+				return nil, err
+			}
+			contentPath = op.File
+		case api.Directory:
+			var err error
+			if size, err = contentSize(op.File); err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, splitItem{
+			pathInImage: op.PathInImage,
+			contentPath: contentPath,
+			size:        size,
+			add:         func(l *layerInputs) { l.addFiles = append(l.addFiles, op) },
+		})
+	}
+	for _, op := range in.executables {
+		size, err := contentSize(op.Executable)
+		if err != nil {
+			return nil, err
+		}
+		if op.RunfilesParameterFile != "" {
+			runfilesList, err := layerbuild.ReadParamFile(op.RunfilesParameterFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading runfiles parameter file: %w", err)
+			}
+			for _, f := range runfilesList {
+				if f.FileType == api.Symlink {
+					continue
+				}
+				runfileSize, err := contentSize(f.File)
+				if err != nil {
+					return nil, err
+				}
+				size += runfileSize
+			}
+		}
+		items = append(items, splitItem{
+			pathInImage: op.PathInImage,
+			contentPath: op.Executable,
+			size:        size,
+			add:         func(l *layerInputs) { l.executables = append(l.executables, op) },
+		})
+	}
+	for _, op := range in.symlinks {
+		items = append(items, splitItem{
+			pathInImage: op.LinkName,
+			add:         func(l *layerInputs) { l.symlinks = append(l.symlinks, op) },
+		})
+	}
+	for _, path := range in.emptyFiles {
+		items = append(items, splitItem{
+			pathInImage: path,
+			add:         func(l *layerInputs) { l.emptyFiles = append(l.emptyFiles, path) },
+		})
+	}
+	return items, nil
+}
+
+// contentSize returns the size of a file, or the total size of the regular
+// files in a directory.
+func contentSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	var total int64
+	err = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// prefixLayer returns the layer for a path in the image under the prefix
+// strategy: that of the longest prefix containing the path, or the final
+// layer.
+func prefixLayer(prefixes []string, pathInImage string) int {
+	pathInImage = strings.Trim(pathInImage, "/")
+	layer, longest := len(prefixes), -1
+	for i, prefix := range prefixes {
+		prefix = strings.Trim(prefix, "/")
+		if (pathInImage == prefix || strings.HasPrefix(pathInImage, prefix+"/")) && len(prefix) > longest {
+			layer, longest = i, len(prefix)
+		}
+	}
+	return layer
+}
+
+// hashBucket returns the layer for an item under the hash strategy. Regular
+// files and executables are placed by the SHA-256 of their content, so
+// unchanged files keep their layer no matter what else changes; other inputs
+// are placed by the SHA-256 of their path in the image.
+func hashBucket(item splitItem, buckets int) (int, error) {
+	h := sha256.New()
+	if item.contentPath != "" {
+		f, err := os.Open(item.contentPath)
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("hashing %s: %w", item.contentPath, err)
+		}
+	} else {
+		h.Write([]byte(strings.Trim(item.pathInImage, "/")))
+	}
+	return int(binary.BigEndian.Uint64(h.Sum(nil)) % uint64(buckets)), nil
+}
+
+// splitLayerFileName names the files of layer i in the split output
+// directory: "layer-000" followed by suffix.
+func splitLayerFileName(i int, suffix string) string {
+	return fmt.Sprintf("layer-%03d%s", i, suffix)
+}
+
+// blobExtension is the file extension of a layer blob.
+func blobExtension(compressionAlgorithm api.CompressionAlgorithm) string {
+	switch compressionAlgorithm {
+	case api.Gzip:
+		return ".tgz"
+	case api.Zstd:
+		return ".tar.zst"
+	}
+	return ".tar"
+}
+
+// splitLayerSettings are the settings every layer of a split shares.
+type splitLayerSettings struct {
+	compressionAlgorithm    api.CompressionAlgorithm
+	useEstargz              bool
+	zstdChunked             bool
+	casImporter             api.CASStateSupplier
+	layerMetadata           *layerbuild.Metadata
+	compressorJobs          string
+	compressionLevel        int
+	createParentDirectories bool
+	treeArtifactHandling    string
+	history                 string
+	mediaType               string
+	annotations             map[string]string
+}
+
+// writeSplitLayers writes each layer of a split into outputDir as
+// layer-NNN.<ext> with its metadata (layer-NNN_metadata.json) and content
+// manifest (layer-NNN.content_manifest), and then the manifest fragment
+// listing the layer metadata in order.
+func writeSplitLayers(layers []layerInputs, outputDir string, settings splitLayerSettings) error {
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("creating split output directory: %w", err)
+	}
+	descriptors := make([]api.Descriptor, len(layers))
+	for i, in := range layers {
+		descriptor, err := writeSplitLayer(i, in, outputDir, settings)
+		if err != nil {
+			return fmt.Errorf("writing layer %d of %d: %w", i+1, len(layers), err)
+		}
+		descriptors[i] = descriptor
+	}
+
+	fragment, err := os.OpenFile(filepath.Join(outputDir, manifestFragmentName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening manifest fragment: %w", err)
+	}
+	if err := metadata.WriteManifestFragment(descriptors, fragment); err != nil {
+		fragment.Close()
+		return err
+	}
+	return fragment.Close()
+}
+
+func writeSplitLayer(i int, in layerInputs, outputDir string, settings splitLayerSettings) (api.Descriptor, error) {
+	blob, err := os.OpenFile(filepath.Join(outputDir, splitLayerFileName(i, blobExtension(settings.compressionAlgorithm))), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return api.Descriptor{}, fmt.Errorf("opening output file: %w", err)
+	}
+	defer blob.Close()
+	casExporter := contentmanifest.New(filepath.Join(outputDir, splitLayerFileName(i, ".content_manifest")), api.SHA256)
+
+	compressorState, err := handleLayerState(
+		settings.compressionAlgorithm, settings.useEstargz, settings.zstdChunked, nil, in.addFiles, in.importTars, in.executables, in.symlinks, in.emptyFiles,
+		in.baseMetadataPaths,
+		settings.casImporter, casExporter, blob, settings.layerMetadata,
+		settings.compressorJobs, settings.compressionLevel, settings.createParentDirectories,
+		settings.treeArtifactHandling,
+		"", 0,
+	)
+	if err != nil {
+		return api.Descriptor{}, err
+	}
+	if err := blob.Close(); err != nil {
+		return api.Descriptor{}, fmt.Errorf("closing output file: %w", err)
+	}
+
+	metadataPath := filepath.Join(outputDir, splitLayerFileName(i, "_metadata.json"))
+	metadataFile, err := os.OpenFile(metadataPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return api.Descriptor{}, fmt.Errorf("opening metadata output file: %w", err)
+	}
+	if err := layerbuild.WriteMetadata(settings.history, settings.compressionAlgorithm, settings.useEstargz, settings.mediaType, settings.annotations, compressorState, metadataFile); err != nil {
+		metadataFile.Close()
+		return api.Descriptor{}, err
+	}
+	if err := metadataFile.Close(); err != nil {
+		return api.Descriptor{}, err
+	}
+
+	// The fragment repeats the metadata exactly as written.
+	data, err := os.ReadFile(metadataPath)
+	if err != nil {
+		return api.Descriptor{}, err
+	}
+	var descriptor api.Descriptor
+	if err := json.Unmarshal(data, &descriptor); err != nil {
+		return api.Descriptor{}, fmt.Errorf("reading back layer metadata: %w", err)
+	}
+	return descriptor, nil
+}
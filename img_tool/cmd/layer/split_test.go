@@ -0,0 +1,152 @@
+package layer
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+// splitTestInputs writes files of the given sizes and returns them as --add
+// inputs, in order.
+func splitTestInputs(t *testing.T, files map[string]int, order []string) layerInputs {
+	t.Helper()
+	dir := t.TempDir()
+	var in layerInputs
+	for _, pathInImage := range order {
+		file := filepath.Join(dir, strings.ReplaceAll(pathInImage, "/", "_"))
+		// Distinct content per file, so the hash strategy sees distinct digests.
+		content := append([]byte(pathInImage), make([]byte, files[pathInImage])...)[:files[pathInImage]]
+		if err := os.WriteFile(file, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		in.addFiles = append(in.addFiles, addFile{PathInImage: pathInImage, File: file, FileType: api.RegularFile})
+	}
+	return in
+}
+
+// layerPaths lists the paths in the image of each layer's added files.
+func layerPaths(layers []layerInputs) [][]string {
+	var paths [][]string
+	for _, l := range layers {
+		var p []string
+		for _, op := range l.addFiles {
+			p = append(p, op.PathInImage)
+		}
+		for _, s := range l.symlinks {
+			p = append(p, s.LinkName)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func TestSplitBySize(t *testing.T) {
+	order := []string{"a", "b", "c", "d", "e"}
+	in := splitTestInputs(t, map[string]int{"a": 400, "b": 500, "c": 2000, "d": 100, "e": 100}, order)
+	in.importTars = importTars{in.addFiles[0].File}
+
+	layers, err := splitLayerInputs(splitOptions{strategy: splitBySize, maxSize: 1000}, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The imported tar (400 bytes) and a fill the first layer, as b would
+	// take it beyond 1000 bytes; c exceeds the limit alone and gets a layer
+	// of its own.
+	want := [][]string{{"a"}, {"b"}, {"c"}, {"d", "e"}}
+	if got := layerPaths(layers); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("layers = %v, want %v", got, want)
+	}
+	if len(layers[0].importTars) != 1 || len(layers[1].importTars) != 0 {
+		t.Fatalf("imported tars are not all in the first layer")
+	}
+}
+
+func TestSplitByPrefix(t *testing.T) {
+	order := []string{"usr/lib/python3/site.py", "app/main", "usr/lib/libc.so", "usr/libexec/x", "etc/hosts"}
+	in := splitTestInputs(t, map[string]int{}, order)
+	in.symlinks = symlinks{{LinkName: "/usr/lib/python3/current", Target: "site.py"}}
+
+	layers, err := splitLayerInputs(splitOptions{strategy: splitByPrefix, prefixes: []string{"/usr/lib/", "usr/lib/python3", "app"}}, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The longest prefix wins, "usr/lib" does not contain "usr/libexec", and
+	// the last layer takes everything else.
+	want := [][]string{
+		{"usr/lib/libc.so"},
+		{"usr/lib/python3/site.py", "/usr/lib/python3/current"},
+		{"app/main"},
+		{"usr/libexec/x", "etc/hosts"},
+	}
+	if got := layerPaths(layers); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("layers = %v, want %v", got, want)
+	}
+}
+
+func TestSplitByHashIsStable(t *testing.T) {
+	sizes := map[string]int{}
+	var order []string
+	for _, name := range strings.Fields("a b c d e f g h i j k l m n o p") {
+		order = append(order, "files/"+name)
+		sizes["files/"+name] = 64
+	}
+	in := splitTestInputs(t, sizes, order)
+	opts := splitOptions{strategy: splitByHash, buckets: 4}
+
+	layers, err := splitLayerInputs(opts, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 4 {
+		t.Fatalf("got %d layers, want 4", len(layers))
+	}
+	used := 0
+	for _, l := range layers {
+		if len(l.addFiles) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("all files landed in %d layer(s)", used)
+	}
+
+	// Dropping a file leaves every other file in its layer.
+	bucketOf := func(layers []layerInputs) map[string]int {
+		m := map[string]int{}
+		for i, l := range layers {
+			for _, op := range l.addFiles {
+				m[op.PathInImage] = i
+			}
+		}
+		return m
+	}
+	before := bucketOf(layers)
+	in.addFiles = in.addFiles[1:]
+	layers, err = splitLayerInputs(opts, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, bucket := range bucketOf(layers) {
+		if before[path] != bucket {
+			t.Fatalf("%s moved from layer %d to %d", path, before[path], bucket)
+		}
+	}
+}
+
+func TestSplitOptionsValidate(t *testing.T) {
+	for _, opts := range []splitOptions{
+		{strategy: "random"},
+		{strategy: splitBySize},
+		{strategy: splitByPrefix},
+		{strategy: splitByPrefix, prefixes: []string{"/"}},
+		{strategy: splitByHash, buckets: 1},
+	} {
+		if err := opts.validate(); err == nil {
+			t.Errorf("%+v: validate succeeded", opts)
+		}
+	}
+}
@@ -6,17 +6,41 @@ import (
 	"strings"
 )
 
-type fileList []string
+// layerSource is a layer metadata file (--layer-from-metadata) or a manifest
+// fragment listing several layers (--layers-from-manifest-fragment).
+type layerSource struct {
+	path     string
+	fragment bool
+}
 
-func (l *fileList) String() string {
-	return strings.Join(*l, ", ")
+// layerSources holds the layer sources of both flags in the order they were
+// given, which is the order of the layers in the image.
+type layerSources []layerSource
+
+// layerSourceFlag adds the sources of one flag to a shared layerSources.
+type layerSourceFlag struct {
+	sources  *layerSources
+	fragment bool
+}
+
+func (f layerSourceFlag) String() string {
+	if f.sources == nil {
+		return ""
+	}
+	var paths []string
+	for _, source := range *f.sources {
+		if source.fragment == f.fragment {
+			paths = append(paths, source.path)
+		}
+	}
+	return strings.Join(paths, ", ")
 }
 
-func (l *fileList) Set(value string) error {
+func (f layerSourceFlag) Set(value string) error {
 	if _, err := os.Stat(value); err != nil {
 		return fmt.Errorf("file %s does not exist: %w", value, err)
 	}
-	*l = append(*l, value)
+	*f.sources = append(*f.sources, layerSource{path: value, fragment: f.fragment})
 	return nil
 }
 
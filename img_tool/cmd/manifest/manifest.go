@@ -19,13 +19,15 @@ import (
 
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/kvfile"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/metadata"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/runconfig"
 )
 
 var (
 	operatingSystem           string
 	architecture              string
 	variant                   string
-	layerFromMetadataArgs     fileList
+	layerSourceArgs           layerSources
 	configFragment            string
 	configMediaType           string
 	configTemplates           string
@@ -55,9 +57,8 @@ var (
 
 // inheritFromBase is the sentinel value used by the image_manifest rule to
 // distinguish a config field that was left untouched (inherit the base image's
-// value) from one explicitly set to an empty value (unset the field). It matches
-// INHERIT_FROM_BASE in img/private/common/inherit.bzl.
-const inheritFromBase = "<inherit from base>"
+// value) from one explicitly set to an empty value (unset the field).
+const inheritFromBase = runconfig.InheritFromBase
 
 func ManifestProcess(_ context.Context, args []string) {
 	flagSet := flag.NewFlagSet("manifest", flag.ExitOnError)
@@ -77,7 +78,8 @@ func ManifestProcess(_ context.Context, args []string) {
 	flagSet.StringVar(&operatingSystem, "os", "linux", `The operating system of the image. Defaults to linux.`)
 	flagSet.StringVar(&architecture, "architecture", "amd64", `The architecture of the image. Defaults to amd64.`)
 	flagSet.StringVar(&variant, "variant", "", `The platform variant (e.g., v3 for amd64/v3, v8 for arm64/v8).`)
-	flagSet.Var(&layerFromMetadataArgs, "layer-from-metadata", `Ordered list of layer metadata files that will make up the image, as produced by "img layer --metadata".`)
+	flagSet.Var(layerSourceFlag{sources: &layerSourceArgs}, "layer-from-metadata", `Ordered list of layer metadata files that will make up the image, as produced by "img layer --metadata".`)
+	flagSet.Var(layerSourceFlag{sources: &layerSourceArgs, fragment: true}, "layers-from-manifest-fragment", `A manifest fragment listing several layers, as produced by "img layer --split-strategy". Its layers take the place of the flag among the --layer-from-metadata layers.`)
 	flagSet.StringVar(&configFragment, "config-fragment", "", `A JSON file containing a config fragment to be merged into the final config. This is useful for adding custom labels or other metadata to the image. When --config-media-type is set to a non-OCI type (e.g. application/vnd.cncf.helm.config.v1+json for Helm), this file is used as the entire config blob as-is.`)
 	flagSet.StringVar(&configMediaType, "config-media-type", "", `Override the config blob media type. When set to application/vnd.oci.empty.v1+json, --config-fragment is optional; if omitted, an empty JSON config descriptor is produced with inlined data. For other non-OCI types (e.g. application/vnd.cncf.helm.config.v1+json for Helm charts), --config-fragment is required and used verbatim as the config blob with no OCI image structure.`)
 	flagSet.StringVar(&configTemplates, "config-templates", "", `A JSON file containing template-expanded env, labels, and annotations values.`)
@@ -125,14 +127,23 @@ func ManifestProcess(_ context.Context, args []string) {
 		variant = "v8"
 	}
 
-	layers := make([]api.Descriptor, len(layerFromMetadataArgs))
-	for i, layerFile := range layerFromMetadataArgs {
-		layer, err := readLayerMetadata(layerFile)
+	var layers []api.Descriptor
+	for _, source := range layerSourceArgs {
+		if source.fragment {
+			fragmentLayers, err := readManifestFragment(source.path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to read manifest fragment %s: %v\n", source.path, err)
+				os.Exit(1)
+			}
+			layers = append(layers, fragmentLayers...)
+			continue
+		}
+		layer, err := readLayerMetadata(source.path)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to read layer metadata file %s: %v\n", layerFile, err)
+			fmt.Fprintf(os.Stderr, "Failed to read layer metadata file %s: %v\n", source.path, err)
 			os.Exit(1)
 		}
-		layers[i] = layer
+		layers = append(layers, layer)
 	}
 
 	// Read config templates once if provided
@@ -407,6 +418,20 @@ func readLayerMetadata(filePath string) (api.Descriptor, error) {
 	return layer, nil
 }
 
+func readManifestFragment(filePath string) ([]api.Descriptor, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening manifest fragment: %w", err)
+	}
+	defer file.Close()
+
+	fragment, err := metadata.ReadManifestFragment(file)
+	if err != nil {
+		return nil, err
+	}
+	return fragment.Layers, nil
+}
+
 func overlayConfigFromFile(config *specv1.Image, filePath string, isBase bool) error {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -548,11 +573,6 @@ func overlayNewConfigValues(config *specv1.Image, layers []api.Descriptor, templ
 		config.RootFS.DiffIDs[i] = digest.Digest(layer.DiffID)
 	}
 
-	// Apply the image config value from the --user flag with three-way semantics:
-	// the INHERIT_FROM_BASE sentinel inherits the base value, an empty string
-	// unsets it, and any other value overrides it.
-	applyStringConfig(&config.Config.User, user)
-
 	// Apply environment variables from config templates or command line
 	envToApply := env
 	if templatesData != nil && templatesData.Env != nil {
@@ -572,68 +592,6 @@ func overlayNewConfigValues(config *specv1.Image, layers []api.Descriptor, templ
 		envToApply = merged
 	}
 
-	if len(envToApply) > 0 {
-		// First, build a map of existing env vars
-		existingEnv := make(map[string]bool)
-		for i, envVar := range config.Config.Env {
-			key := strings.SplitN(envVar, "=", 2)[0]
-			if _, exists := envToApply[key]; exists {
-				// Update existing env var
-				config.Config.Env[i] = fmt.Sprintf("%s=%s", key, envToApply[key])
-				existingEnv[key] = true
-			}
-		}
-		// Add new env vars in sorted order to ensure determinism
-		keys := make([]string, 0, len(envToApply))
-		for key := range envToApply {
-			keys = append(keys, key)
-		}
-		slices.Sort(keys)
-		for _, key := range keys {
-			if !existingEnv[key] {
-				config.Config.Env = append(config.Config.Env, fmt.Sprintf("%s=%s", key, envToApply[key]))
-			}
-		}
-	}
-
-	// NOTE: Setting entrypoint clears Cmd, which is consistent with Docker/Dockerfile behavior.
-	// This matches the behavior of rules_oci and crane.
-	// See: https://github.com/bazel-contrib/rules_img/issues/368
-	// See: https://github.com/bazel-contrib/rules_oci/issues/649
-	// See: https://github.com/google/go-containerregistry/blob/c3d1dcc932076c15b65b8b9acfff1d47ded2ebf9/cmd/crane/cmd/mutate.go#L107
-	//
-	// Capture the inherited (base + fragment) entrypoint and cmd before either is
-	// modified, so a sentinel item can be expanded to the original base value even
-	// when setting the entrypoint has already cleared the inherited cmd.
-	baseEntrypoint := slices.Clone(config.Config.Entrypoint)
-	baseCmd := slices.Clone(config.Config.Cmd)
-
-	// entrypoint and cmd use three-way semantics driven by the flag values:
-	// a lone sentinel is a no-op (inherit), so inheriting the entrypoint does not
-	// clear an inherited cmd; an empty list unsets the field; any other list is
-	// set after expanding sentinel items against the captured base value. Setting
-	// the entrypoint clears cmd (Docker semantics), matching the historical rule.
-	switch {
-	case isPureInherit(entrypoint):
-		// inherit: leave the base entrypoint (and cmd) untouched
-	case len(entrypoint) == 0:
-		config.Config.Entrypoint = nil // unset; leave cmd to its own resolution
-	default:
-		config.Config.Entrypoint = expandInherit(entrypoint, baseEntrypoint)
-		config.Config.Cmd = nil
-	}
-
-	switch {
-	case isPureInherit(cmd):
-		// inherit: leave cmd as-is (base value, or cleared by setting entrypoint)
-	case len(cmd) == 0:
-		config.Config.Cmd = nil // unset
-	default:
-		config.Config.Cmd = expandInherit(cmd, baseCmd)
-	}
-
-	applyStringConfig(&config.Config.WorkingDir, workingDir)
-
 	// Apply labels from config templates or command line
 	labelsToApply := labels
 	if templatesData != nil && templatesData.Labels != nil {
@@ -654,22 +612,15 @@ func overlayNewConfigValues(config *specv1.Image, layers []api.Descriptor, templ
 		labelsToApply = merged
 	}
 
-	if len(labelsToApply) > 0 {
-		if config.Config.Labels == nil {
-			config.Config.Labels = make(map[string]string)
-		}
-		// Add labels in sorted order to ensure determinism
-		keys := make([]string, 0, len(labelsToApply))
-		for key := range labelsToApply {
-			keys = append(keys, key)
-		}
-		slices.Sort(keys)
-		for _, key := range keys {
-			config.Config.Labels[key] = labelsToApply[key]
-		}
-	}
-
-	applyStringConfig(&config.Config.StopSignal, stopSignal)
+	runconfig.Settings{
+		User:       user,
+		WorkingDir: workingDir,
+		StopSignal: stopSignal,
+		Env:        envToApply,
+		Entrypoint: entrypoint,
+		Cmd:        cmd,
+		Labels:     labelsToApply,
+	}.Apply(&config.Config)
 
 	return nil
 }
@@ -682,42 +633,6 @@ type ConfigTemplates struct {
 	Created     string            `json:"created"`
 }
 
-// applyStringConfig resolves a scalar config string field from its flag value
-// with three-way semantics: the inheritFromBase sentinel leaves the inherited
-// (base) value in place, an empty string unsets the field, and any other value
-// overrides it.
-func applyStringConfig(field *string, value string) {
-	switch value {
-	case inheritFromBase:
-		// inherit: leave the base value in place
-	case "":
-		*field = "" // unset
-	default:
-		*field = value
-	}
-}
-
-// isPureInherit reports whether a list is exactly the inheritFromBase sentinel,
-// i.e. a plain "inherit from base" with no additional items. Such a list is a
-// no-op so that inheriting the base entrypoint does not clear an inherited cmd.
-func isPureInherit(list []string) bool {
-	return len(list) == 1 && list[0] == inheritFromBase
-}
-
-// expandInherit returns list with every inheritFromBase sentinel item replaced,
-// in place, by the items of base. A sentinel with no base expands to nothing.
-func expandInherit(list, base []string) []string {
-	out := make([]string, 0, len(list))
-	for _, item := range list {
-		if item == inheritFromBase {
-			out = append(out, base...)
-		} else {
-			out = append(out, item)
-		}
-	}
-	return out
-}
-
 // readConfigTemplates reads and parses the config templates JSON file
 func readConfigTemplates(filePath string) (*ConfigTemplates, error) {
 	file, err := os.Open(filePath)
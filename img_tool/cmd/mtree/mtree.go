@@ -22,40 +22,12 @@ import (
 	"strings"
 
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerinput"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
 )
 
-// inputRef is one --tar/--cstream/--mtree input, in command-line order.
-type inputRef struct {
-	kind inputKind
-	path string
-}
-
-type inputKind int
-
-const (
-	tarKind inputKind = iota
-	cstreamKind
-	mtreeKind
-)
-
-// orderedInput is a flag.Value that appends each occurrence of an input flag to
-// a shared slice, so the relative order of --tar/--cstream/--mtree across the
-// command line is preserved (flag.Parse calls Set in argument order).
-type orderedInput struct {
-	kind   inputKind
-	inputs *[]inputRef
-}
-
-func (o orderedInput) String() string { return "" }
-
-func (o orderedInput) Set(v string) error {
-	*o.inputs = append(*o.inputs, inputRef{kind: o.kind, path: v})
-	return nil
-}
-
 func MtreeProcess(ctx context.Context, args []string) {
-	var inputs []inputRef
+	var inputs layerinput.List
 	var outputPath string
 	defaults := mtree.DefaultOptions()
 	var pathPrefix string
@@ -69,9 +41,9 @@ func MtreeProcess(ctx context.Context, args []string) {
 		flagSet.PrintDefaults()
 		fmt.Fprintf(flagSet.Output(), "\nInputs are processed in command-line order and may be interleaved.\n")
 	}
-	flagSet.Var(orderedInput{tarKind, &inputs}, "tar", "Add a layer tar blob input (may be gzip- or zstd-compressed). Repeatable.")
-	flagSet.Var(orderedInput{cstreamKind, &inputs}, "cstream", "Add a compact stream (.cstream) input. Repeatable.")
-	flagSet.Var(orderedInput{mtreeKind, &inputs}, "mtree", "Add an existing mtree spec input. Repeatable.")
+	flagSet.Var(inputs.Flag(layerinput.Tar), "tar", "Add a layer tar blob input (may be gzip- or zstd-compressed). Repeatable.")
+	flagSet.Var(inputs.Flag(layerinput.CStream), "cstream", "Add a compact stream (.cstream) input. Repeatable.")
+	flagSet.Var(inputs.Flag(layerinput.Mtree), "mtree", "Add an existing mtree spec input. Repeatable.")
 	flagSet.StringVar(&outputPath, "output", "", `Path to write the mtree to, or "-" for stdout (required).`)
 	flagSet.StringVar(&pathPrefix, "path-prefix", defaults.PathPrefix, `Prefix for entry paths: "./" (full-path entries) or "" (bare tar paths).`)
 	flagSet.StringVar(&options, "options", strings.Join(defaults.Keywords, ","), "Comma-separated, ordered list of fields to emit (type,size,mode,uid,uname,gid,gname,sha256,time,link,nlink,xattr).")
@@ -108,7 +80,7 @@ func MtreeProcess(ctx context.Context, args []string) {
 // run opens every input, assembles the ordered mtree.Input list, and renders it.
 // All inputs are opened up front and closed at the end because WriteMulti streams
 // through them in order.
-func run(ctx context.Context, refs []inputRef, opts mtree.Options, outputPath string) (err error) {
+func run(ctx context.Context, refs layerinput.List, opts mtree.Options, outputPath string) (err error) {
 	var closers []io.Closer
 	defer func() {
 		for i := len(closers) - 1; i >= 0; i-- {
@@ -120,27 +92,27 @@ func run(ctx context.Context, refs []inputRef, opts mtree.Options, outputPath st
 
 	var inputs []mtree.Input
 	for _, ref := range refs {
-		f, oerr := os.Open(ref.path)
+		f, oerr := os.Open(ref.Path)
 		if oerr != nil {
-			return fmt.Errorf("opening %s: %w", ref.path, oerr)
+			return fmt.Errorf("opening %s: %w", ref.Path, oerr)
 		}
 		closers = append(closers, f)
 
-		switch ref.kind {
-		case tarKind:
+		switch ref.Kind {
+		case layerinput.Tar:
 			uncompressed, derr := mtree.Decompress(f)
 			if derr != nil {
 				return derr
 			}
 			inputs = append(inputs, mtree.Input{Kind: mtree.TarInput, Reader: uncompressed, Digester: mtree.HashContent})
-		case cstreamKind:
+		case layerinput.CStream:
 			reader, rerr := compactstream.NewReconstructingReader(ctx, f, compactstream.NullBlobStore{})
 			if rerr != nil {
 				return rerr
 			}
 			closers = append(closers, reader)
 			inputs = append(inputs, mtree.Input{Kind: mtree.TarInput, Reader: reader, Digester: cstreamDigester(reader)})
-		case mtreeKind:
+		case layerinput.Mtree:
 			inputs = append(inputs, mtree.Input{Kind: mtree.MtreeInput, Reader: f})
 		}
 	}
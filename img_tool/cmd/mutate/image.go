@@ -0,0 +1,238 @@
+package mutate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/runconfig"
+)
+
+// runSettingsKeys are the fields of the image config's "config" object that
+// runconfig.Settings edits. Only these are written back, so fields the OCI
+// image spec does not know (Healthcheck, Shell, ...) survive the edit.
+var runSettingsKeys = []string{"User", "WorkingDir", "StopSignal", "Env", "Entrypoint", "Cmd", "Labels"}
+
+// mutateImage appends layers to the manifest and config of an image and
+// applies settings to its config. Everything else is kept as it is, including
+// the descriptors of the image's own layers, so that they can be mounted from
+// where the image came from. It returns the serialized manifest and config.
+func mutateImage(rawManifest, rawConfig []byte, layers []api.Descriptor, settings runconfig.Settings) (manifestRaw, configRaw []byte, err error) {
+	var imageManifest, config map[string]any
+	if err := json.Unmarshal(rawManifest, &imageManifest); err != nil {
+		return nil, nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return nil, nil, fmt.Errorf("decoding config: %w", err)
+	}
+
+	if err := editRunConfig(config, settings); err != nil {
+		return nil, nil, err
+	}
+
+	rootFS, _ := config["rootfs"].(map[string]any)
+	if rootFS == nil {
+		return nil, nil, fmt.Errorf("config has no rootfs")
+	}
+	diffIDs, _ := rootFS["diff_ids"].([]any)
+	manifestLayers, _ := imageManifest["layers"].([]any)
+	if len(diffIDs) != len(manifestLayers) {
+		return nil, nil, fmt.Errorf("manifest lists %d layers, but config lists %d diff IDs", len(manifestLayers), len(diffIDs))
+	}
+	// The history only describes the layers when the image has one: an
+	// image without history does not get one for the added layers alone.
+	history, hasHistory := config["history"].([]any)
+	for _, layer := range layers {
+		descriptor := map[string]any{
+			"mediaType": layer.MediaType,
+			"digest":    layer.Digest,
+			"size":      layer.Size,
+		}
+		if len(layer.Annotations) > 0 {
+			descriptor["annotations"] = layer.Annotations
+		}
+		manifestLayers = append(manifestLayers, descriptor)
+		diffIDs = append(diffIDs, layer.DiffID)
+		if !hasHistory {
+			continue
+		}
+		entries := layer.History
+		if len(entries) == 0 {
+			entries = api.LayerHistory("")
+		}
+		for _, entry := range entries {
+			var value any
+			if err := remarshal(entry, &value); err != nil {
+				return nil, nil, err
+			}
+			history = append(history, value)
+		}
+	}
+	rootFS["diff_ids"] = diffIDs
+	imageManifest["layers"] = manifestLayers
+	if hasHistory {
+		config["history"] = history
+	}
+
+	configRaw, err = json.Marshal(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling config: %w", err)
+	}
+	configDescriptor, _ := imageManifest["config"].(map[string]any)
+	if configDescriptor == nil {
+		return nil, nil, fmt.Errorf("manifest has no config descriptor")
+	}
+	configDescriptor["digest"] = fmt.Sprintf("sha256:%x", sha256.Sum256(configRaw))
+	configDescriptor["size"] = len(configRaw)
+	delete(configDescriptor, "data")
+
+	manifestRaw, err = json.Marshal(imageManifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling manifest: %w", err)
+	}
+	return manifestRaw, configRaw, nil
+}
+
+// editRunConfig applies settings to the "config" object of an image config.
+// The settings are applied to a decoded copy and only the fields they changed
+// are written back.
+func editRunConfig(config map[string]any, settings runconfig.Settings) error {
+	runConfig, _ := config["config"].(map[string]any)
+	var before, after specv1.ImageConfig
+	if err := remarshal(runConfig, &before); err != nil {
+		return fmt.Errorf("decoding run config: %w", err)
+	}
+	if err := remarshal(runConfig, &after); err != nil {
+		return fmt.Errorf("decoding run config: %w", err)
+	}
+	settings.Apply(&after)
+
+	var beforeFields, afterFields map[string]any
+	if err := remarshal(before, &beforeFields); err != nil {
+		return err
+	}
+	if err := remarshal(after, &afterFields); err != nil {
+		return err
+	}
+	for _, key := range runSettingsKeys {
+		if reflect.DeepEqual(beforeFields[key], afterFields[key]) {
+			continue
+		}
+		if runConfig == nil {
+			runConfig = make(map[string]any)
+			config["config"] = runConfig
+		}
+		if value, ok := afterFields[key]; ok {
+			runConfig[key] = value
+		} else {
+			delete(runConfig, key)
+		}
+	}
+	return nil
+}
+
+// remarshal converts from into to through JSON.
+func remarshal(from, to any) error {
+	raw, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, to)
+}
+
+// image is the mutated image as pushed: the rewritten manifest and config,
+// and its layers in manifest order.
+type image struct {
+	rawManifest []byte
+	rawConfig   []byte
+	manifest    *v1.Manifest
+	configFile  *v1.ConfigFile
+	layers      []v1.Layer
+}
+
+func newImage(rawManifest, rawConfig []byte, layers []v1.Layer) (*image, error) {
+	parsedManifest, err := v1.ParseManifest(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, fmt.Errorf("parsing image manifest: %w", err)
+	}
+	configFile, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, fmt.Errorf("parsing image config: %w", err)
+	}
+	if len(layers) != len(parsedManifest.Layers) {
+		return nil, fmt.Errorf("manifest lists %d layers, got %d", len(parsedManifest.Layers), len(layers))
+	}
+	return &image{
+		rawManifest: rawManifest,
+		rawConfig:   rawConfig,
+		manifest:    parsedManifest,
+		configFile:  configFile,
+		layers:      layers,
+	}, nil
+}
+
+func (img *image) Layers() ([]v1.Layer, error) {
+	return img.layers, nil
+}
+
+func (img *image) MediaType() (types.MediaType, error) {
+	if img.manifest.MediaType == "" {
+		return types.OCIManifestSchema1, nil
+	}
+	return img.manifest.MediaType, nil
+}
+
+func (img *image) Size() (int64, error) {
+	return int64(len(img.rawManifest)), nil
+}
+
+func (img *image) ConfigName() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(img.rawConfig))
+	return h, err
+}
+
+func (img *image) ConfigFile() (*v1.ConfigFile, error) {
+	return img.configFile, nil
+}
+
+func (img *image) RawConfigFile() ([]byte, error) {
+	return img.rawConfig, nil
+}
+
+func (img *image) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(img.rawManifest))
+	return h, err
+}
+
+func (img *image) Manifest() (*v1.Manifest, error) {
+	return img.manifest, nil
+}
+
+func (img *image) RawManifest() ([]byte, error) {
+	return img.rawManifest, nil
+}
+
+func (img *image) LayerByDigest(digest v1.Hash) (v1.Layer, error) {
+	for i, desc := range img.manifest.Layers {
+		if desc.Digest == digest {
+			return img.layers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("layer %s not found", digest)
+}
+
+func (img *image) LayerByDiffID(diffID v1.Hash) (v1.Layer, error) {
+	for i, id := range img.configFile.RootFS.DiffIDs {
+		if id == diffID && i < len(img.layers) {
+			return img.layers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("layer with diffID %s not found", diffID)
+}
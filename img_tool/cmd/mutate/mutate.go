@@ -0,0 +1,411 @@
+// Package mutate implements `img mutate`: it appends layers to an image that
+// is already in a registry or an OCI layout, edits the settings of its config
+// and pushes the result, without Bazel.
+//
+// The appended layers are layer blobs written by `img layer` (given with their
+// metadata), and files given with the same flags as to `img layer`, which are
+// written into one more layer on top. The config is edited with the merge
+// rules of `img manifest` (runconfig.Settings). The image's own layers keep
+// their descriptors and are never downloaded: they are mounted from the
+// source repository when the destination is on the same registry, and
+// streamed through otherwise. Reads go through the pull gateway and writes
+// through the push gateway, when configured, with the auth of every other
+// registry command.
+package mutate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/deployvfs"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerbuild"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/runconfig"
+)
+
+// addedLayer is a layer appended to the image: its metadata, as written by
+// `img layer --metadata`, and the file holding its blob.
+type addedLayer struct {
+	desc api.Descriptor
+	path string
+}
+
+// options are the settings of a mutation.
+type options struct {
+	platform  string
+	mountFrom string
+	layers    []addedLayer
+	files     *layerbuild.FileFlags
+	format    api.CompressionAlgorithm
+	history   string
+	settings  runconfig.Settings
+	tags      []string
+	jobs      int
+}
+
+func MutateProcess(ctx context.Context, args []string) {
+	var layerFlags layerList
+	var files layerbuild.FileFlags
+	var env, labels stringMap
+	var entrypoint, cmd, tags stringList
+	var user, workingDir string
+	var formatFlag string
+	opts := options{files: &files}
+
+	flagSet := flag.NewFlagSet("mutate", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Appends layers to an image in a registry or an OCI layout, edits its config and pushes the result.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img mutate [OPTIONS] SOURCE DESTINATION\n\n")
+		fmt.Fprintf(flagSet.Output(), "SOURCE is a tag or digest reference, or the directory of an OCI layout.\n")
+		fmt.Fprintf(flagSet.Output(), "DESTINATION is a repository, or a tag reference in it. The layers of the\n")
+		fmt.Fprintf(flagSet.Output(), "source image are mounted from the source repository when DESTINATION is on\n")
+		fmt.Fprintf(flagSet.Output(), "the same registry, and streamed otherwise; they are never downloaded.\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img mutate --layer hotfix_metadata.json=hotfix.tgz registry.example.com/team/app:v1.2.3 registry.example.com/team/app:v1.2.3-hotfix1",
+			"img mutate --add /etc/app/config.yaml=./config.yaml --env LOG_LEVEL=debug registry.example.com/team/app:v1 registry.example.com/team/app:debug",
+			"img mutate --platform linux/arm64 --entrypoint /app/bin --entrypoint=--safe-mode registry.example.com/team/app:v1 registry.example.com/team/app:safe",
+			"img mutate --mount-from registry.example.com/team/app --label incident=INC-1234 bazel-bin/app/image_oci_layout registry.example.com/team/app:patched",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+	flagSet.Var(&layerFlags, "layer", `Layer to append, as <metadata>=<blob>: the metadata file and blob written by "img layer". Can be specified multiple times; layers are appended in order.`)
+	files.Register(flagSet)
+	flagSet.StringVar(&formatFlag, "format", "gzip", `The compression of the layer built from --add and the other file flags: "gzip", "zstd" or "none".`)
+	flagSet.StringVar(&opts.history, "history", "img mutate", `created_by recorded in the history for the layer built from --add and the other file flags.`)
+	flagSet.Var(&env, "env", `Environment variable to set, as key=value (can be specified multiple times). Variables the image already sets are replaced in place.`)
+	flagSet.Var(&entrypoint, "entrypoint", `Entrypoint of the container, one argument per flag. Replaces the image's entrypoint and clears its cmd; --entrypoint "" unsets it.`)
+	flagSet.Var(&cmd, "cmd", `Default arguments to the entrypoint, one argument per flag. --cmd "" unsets them.`)
+	flagSet.StringVar(&user, "user", "", `The username or UID the container runs as. --user "" unsets it.`)
+	flagSet.StringVar(&workingDir, "working-dir", "", `Working directory of the container. --working-dir "" unsets it.`)
+	flagSet.Var(&labels, "label", `Label to set in the config, as key=value (can be specified multiple times).`)
+	flagSet.StringVar(&opts.platform, "platform", "", `Platform of the image to mutate when SOURCE is an index, e.g. linux/arm64. Only that image is pushed.`)
+	flagSet.StringVar(&opts.mountFrom, "mount-from", "", `Repository (registry/repository) to mount the layers of an OCI layout SOURCE from, instead of uploading them. Useful for a sparse layout whose base layers were never downloaded.`)
+	flagSet.Var(&tags, "tag", "Additional tag to write at the destination (can be specified multiple times)")
+	flagSet.IntVar(&opts.jobs, "jobs", registryopts.DefaultJobs, "Number of blobs uploaded or mounted at once")
+
+	if err := flagSet.Parse(args); err != nil {
+		// flag has already printed the error and the usage.
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+	if flagSet.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Error: expected SOURCE and DESTINATION\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	switch formatFlag {
+	case "gzip":
+		opts.format = api.Gzip
+	case "zstd":
+		opts.format = api.Zstd
+	case "none", "uncompressed":
+		opts.format = api.Uncompressed
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q, want gzip, zstd or none\n", formatFlag)
+		os.Exit(1)
+	}
+
+	// Settings without a flag are inherited from the image, as the
+	// image_manifest rule does for attributes it leaves unset.
+	opts.settings = runconfig.Settings{
+		User:       runconfig.InheritFromBase,
+		WorkingDir: runconfig.InheritFromBase,
+		StopSignal: runconfig.InheritFromBase,
+		Env:        env,
+		Entrypoint: []string{runconfig.InheritFromBase},
+		Cmd:        []string{runconfig.InheritFromBase},
+		Labels:     labels,
+	}
+	flagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "user":
+			opts.settings.User = user
+		case "working-dir":
+			opts.settings.WorkingDir = workingDir
+		case "entrypoint":
+			opts.settings.Entrypoint = argumentList(entrypoint)
+		case "cmd":
+			opts.settings.Cmd = argumentList(cmd)
+		}
+	})
+	opts.layers = layerFlags
+	opts.tags = tags
+
+	if err := run(ctx, flagSet.Arg(0), flagSet.Arg(1), opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, sourceArg, destination string, opts options) error {
+	dst, dstTag, err := parseDestination(destination)
+	if err != nil {
+		return err
+	}
+	tags := opts.tags
+	if dstTag != "" {
+		tags = append([]string{dstTag}, tags...)
+	}
+
+	pull, err := registryopts.Pull()
+	if err != nil {
+		return fmt.Errorf("configuring pull transport: %w", err)
+	}
+	push, err := registryopts.Push()
+	if err != nil {
+		return fmt.Errorf("configuring push transport: %w", err)
+	}
+	registryopts.LimitConcurrencyToJobs(opts.jobs)
+	defer registryopts.LogConcurrencySummary(os.Stderr)
+
+	src, err := openSource(ctx, sourceArg, opts.platform, pull.WithJobs(opts.jobs).Remote())
+	if err != nil {
+		return err
+	}
+	if opts.mountFrom != "" {
+		if src.repository != nil {
+			return fmt.Errorf("--mount-from only applies to an OCI layout; the layers of %s are mounted from its repository", src.description)
+		}
+		repository, err := name.NewRepository(opts.mountFrom, registryopts.NameOptions()...)
+		if err != nil {
+			return fmt.Errorf("parsing --mount-from: %w", err)
+		}
+		src.repository = &repository
+	}
+
+	added := opts.layers
+	if !opts.files.Empty() {
+		blob, err := os.CreateTemp("", "img-mutate-*.layer")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(blob.Name())
+		desc, err := opts.files.WriteLayer(opts.format, opts.history, blob)
+		if closeErr := blob.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("writing layer: %w", err)
+		}
+		added = append(added, addedLayer{desc: desc, path: blob.Name()})
+	}
+
+	img, err := buildImage(src, added, opts.settings)
+	if err != nil {
+		return err
+	}
+	refs, err := pushImage(img, dst, tags, append(push.WithJobs(opts.jobs).Remote(), remote.WithContext(ctx)))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "mutated %s: appended %d layers\n", src.description, len(added))
+	for _, ref := range refs {
+		fmt.Println(ref.String())
+	}
+	return nil
+}
+
+// pushImage pushes the image to the repository, by digest and under every
+// tag, and returns the references it wrote.
+func pushImage(img *image, dst name.Repository, tags []string, opts []remote.Option) ([]name.Reference, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	refs := []name.Reference{dst.Digest(digest.String())}
+	for _, tag := range tags {
+		refs = append(refs, dst.Tag(tag))
+	}
+	// The first write uploads the blobs, the others only point a tag at
+	// the manifest.
+	target := refs[0]
+	if len(tags) > 0 {
+		target = refs[1]
+	}
+	if err := remote.Write(target, img, opts...); err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", target, err)
+	}
+	for _, ref := range refs[1:] {
+		if ref == target {
+			continue
+		}
+		if err := remote.Tag(ref.(name.Tag), img, opts...); err != nil {
+			return nil, fmt.Errorf("tagging %s: %w", ref, err)
+		}
+	}
+	return refs, nil
+}
+
+// buildImage appends the layers to the source image and applies the settings
+// to its config. The source's layers are mounted from its repository, when it
+// has one.
+func buildImage(src *source, added []addedLayer, settings runconfig.Settings) (*image, error) {
+	rawManifest, err := src.image.RawManifest()
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest of %s: %w", src.description, err)
+	}
+	rawConfig, err := src.image.RawConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("reading config of %s: %w", src.description, err)
+	}
+	descs := make([]api.Descriptor, len(added))
+	for i, a := range added {
+		descs[i] = a.desc
+	}
+	manifestRaw, configRaw, err := mutateImage(rawManifest, rawConfig, descs, settings)
+	if err != nil {
+		return nil, fmt.Errorf("mutating %s: %w", src.description, err)
+	}
+
+	srcManifest, err := src.image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	var layers []v1.Layer
+	for _, desc := range srcManifest.Layers {
+		l, err := src.image.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s of %s: %w", desc.Digest, src.description, err)
+		}
+		if src.repository != nil {
+			l = &remote.MountableLayer{Layer: l, Reference: src.repository.Digest(desc.Digest.String())}
+		}
+		layers = append(layers, l)
+	}
+	for _, a := range added {
+		path := a.path
+		layers = append(layers, deployvfs.NewLayer(a.desc, func() (io.ReadCloser, error) {
+			return os.Open(path)
+		}))
+	}
+	return newImage(manifestRaw, configRaw, layers)
+}
+
+// parseDestination splits a destination into its repository and the tag it
+// names, if any. A digest cannot be a destination: the digest of the mutated
+// image is only known once it is built.
+func parseDestination(destination string) (repository name.Repository, tag string, err error) {
+	if repository, err := name.NewRepository(destination, registryopts.NameOptions()...); err == nil {
+		return repository, "", nil
+	}
+	ref, err := name.ParseReference(destination, registryopts.NameOptions()...)
+	if err != nil {
+		return name.Repository{}, "", fmt.Errorf("parsing destination: %w", err)
+	}
+	t, ok := ref.(name.Tag)
+	if !ok {
+		return name.Repository{}, "", fmt.Errorf("destination %s names a digest; give a repository or a tag", destination)
+	}
+	return t.Context(), t.TagStr(), nil
+}
+
+// argumentList turns the values of a list flag into RunSettings semantics: a
+// single empty value unsets the list.
+func argumentList(values []string) []string {
+	if len(values) == 1 && values[0] == "" {
+		return []string{}
+	}
+	return values
+}
+
+// layerList is the repeatable --layer <metadata>=<blob> flag.
+type layerList []addedLayer
+
+func (l *layerList) String() string {
+	parts := make([]string, len(*l))
+	for i, a := range *l {
+		parts[i] = a.desc.Digest + "=" + a.path
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (l *layerList) Set(value string) error {
+	metadataPath, blobPath, ok := strings.Cut(value, "=")
+	if !ok || metadataPath == "" || blobPath == "" {
+		return fmt.Errorf("want <metadata>=<blob>, got %q", value)
+	}
+	desc, err := readLayerMetadata(metadataPath)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != desc.Size {
+		return fmt.Errorf("blob %s has %d bytes, but its metadata %s says %d", blobPath, info.Size(), metadataPath, desc.Size)
+	}
+	*l = append(*l, addedLayer{desc: desc, path: blobPath})
+	return nil
+}
+
+// readLayerMetadata reads a layer metadata file written by `img layer
+// --metadata`.
+func readLayerMetadata(path string) (api.Descriptor, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return api.Descriptor{}, err
+	}
+	defer file.Close()
+	var desc api.Descriptor
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&desc); err != nil {
+		return api.Descriptor{}, fmt.Errorf("decoding layer metadata %s: %w", path, err)
+	}
+	if desc.Digest == "" || desc.DiffID == "" || desc.MediaType == "" {
+		return api.Descriptor{}, fmt.Errorf("layer metadata %s lacks a digest, diff ID or media type", path)
+	}
+	return desc, nil
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type stringMap map[string]string
+
+func (m *stringMap) String() string {
+	var parts []string
+	for k, v := range *m {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (m *stringMap) Set(value string) error {
+	if *m == nil {
+		*m = make(map[string]string)
+	}
+	key, val, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("invalid key=value format: %s", value)
+	}
+	(*m)[key] = val
+	return nil
+}
@@ -0,0 +1,358 @@
+package mutate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testregistry"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/layerbuild"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/runconfig"
+)
+
+const (
+	testManifest = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.manifest.v1+json",
+  "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:0000000000000000000000000000000000000000000000000000000000000000", "size": 1},
+  "layers": [
+    {"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111", "size": 10, "urls": ["https://mirror.example.com/base"]}
+  ],
+  "annotations": {"org.opencontainers.image.source": "https://example.com/app"}
+}`
+	testConfig = `{
+  "architecture": "amd64",
+  "os": "linux",
+  "config": {
+    "User": "app",
+    "Env": ["PATH=/usr/bin", "LOG_LEVEL=info"],
+    "Entrypoint": ["/app/bin"],
+    "Cmd": ["--serve"],
+    "Labels": {"team": "platform"},
+    "Healthcheck": {"Test": ["CMD", "/app/bin", "--health"]}
+  },
+  "rootfs": {"type": "layers", "diff_ids": ["sha256:2222222222222222222222222222222222222222222222222222222222222222"]},
+  "history": [{"created_by": "base"}]
+}`
+)
+
+func TestMutateImage(t *testing.T) {
+	added := []api.Descriptor{{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+		Digest:    "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+		DiffID:    "sha256:4444444444444444444444444444444444444444444444444444444444444444",
+		Size:      20,
+		History:   api.LayerHistory("hotfix"),
+	}}
+	settings := runconfig.Settings{
+		User:       runconfig.InheritFromBase,
+		WorkingDir: "/srv",
+		StopSignal: runconfig.InheritFromBase,
+		Env:        map[string]string{"LOG_LEVEL": "debug", "TRACE": "1"},
+		Entrypoint: []string{"/app/bin", "--safe-mode"},
+		Cmd:        []string{runconfig.InheritFromBase},
+		Labels:     map[string]string{"incident": "INC-1234"},
+	}
+
+	manifestRaw, configRaw, err := mutateImage([]byte(testManifest), []byte(testConfig), added, settings)
+	if err != nil {
+		t.Fatalf("mutateImage: %v", err)
+	}
+
+	var gotManifest struct {
+		Config      map[string]any    `json:"config"`
+		Layers      []map[string]any  `json:"layers"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(manifestRaw, &gotManifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotManifest.Layers) != 2 {
+		t.Fatalf("manifest has %d layers, want 2", len(gotManifest.Layers))
+	}
+	if urls, _ := gotManifest.Layers[0]["urls"].([]any); len(urls) != 1 {
+		t.Errorf("base layer descriptor lost its urls: %v", gotManifest.Layers[0])
+	}
+	if gotManifest.Layers[1]["digest"] != added[0].Digest {
+		t.Errorf("appended layer digest = %v, want %s", gotManifest.Layers[1]["digest"], added[0].Digest)
+	}
+	if gotManifest.Annotations["org.opencontainers.image.source"] == "" {
+		t.Errorf("manifest annotations were dropped")
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256(configRaw)); gotManifest.Config["digest"] != want {
+		t.Errorf("config digest = %v, want %s", gotManifest.Config["digest"], want)
+	}
+	if gotManifest.Config["size"] != float64(len(configRaw)) {
+		t.Errorf("config size = %v, want %d", gotManifest.Config["size"], len(configRaw))
+	}
+
+	var gotConfig struct {
+		Config  map[string]any `json:"config"`
+		RootFS  v1.RootFS      `json:"rootfs"`
+		History []v1.History   `json:"history"`
+	}
+	if err := json.Unmarshal(configRaw, &gotConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotConfig.RootFS.DiffIDs) != 2 || gotConfig.RootFS.DiffIDs[1].String() != added[0].DiffID {
+		t.Errorf("diff_ids = %v, want the appended layer's diff ID last", gotConfig.RootFS.DiffIDs)
+	}
+	if len(gotConfig.History) != 2 || gotConfig.History[1].CreatedBy != "hotfix" {
+		t.Errorf("history = %+v, want the appended layer's entry last", gotConfig.History)
+	}
+	if _, ok := gotConfig.Config["Healthcheck"]; !ok {
+		t.Errorf("Healthcheck was dropped from the config: %v", gotConfig.Config)
+	}
+	for key, want := range map[string]any{
+		"User":       "app",
+		"WorkingDir": "/srv",
+		"Env":        []any{"PATH=/usr/bin", "LOG_LEVEL=debug", "TRACE=1"},
+		"Entrypoint": []any{"/app/bin", "--safe-mode"},
+		"Labels":     map[string]any{"team": "platform", "incident": "INC-1234"},
+	} {
+		if got := gotConfig.Config[key]; !reflect.DeepEqual(got, want) {
+			t.Errorf("config %s = %v, want %v", key, got, want)
+		}
+	}
+	// A new entrypoint clears the cmd of the image, as in the image_manifest rule.
+	if _, ok := gotConfig.Config["Cmd"]; ok {
+		t.Errorf("Cmd = %v, want it cleared by the new entrypoint", gotConfig.Config["Cmd"])
+	}
+}
+
+func TestMutateImageUnsets(t *testing.T) {
+	settings := runconfig.Settings{
+		User:       "",
+		WorkingDir: runconfig.InheritFromBase,
+		StopSignal: runconfig.InheritFromBase,
+		Entrypoint: []string{runconfig.InheritFromBase},
+		Cmd:        []string{},
+	}
+	_, configRaw, err := mutateImage([]byte(testManifest), []byte(testConfig), nil, settings)
+	if err != nil {
+		t.Fatalf("mutateImage: %v", err)
+	}
+	var gotConfig struct {
+		Config map[string]any `json:"config"`
+	}
+	if err := json.Unmarshal(configRaw, &gotConfig); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"User", "Cmd"} {
+		if value, ok := gotConfig.Config[key]; ok {
+			t.Errorf("config %s = %v, want it unset", key, value)
+		}
+	}
+	if !reflect.DeepEqual(gotConfig.Config["Entrypoint"], []any{"/app/bin"}) {
+		t.Errorf("Entrypoint = %v, want it inherited", gotConfig.Config["Entrypoint"])
+	}
+}
+
+func TestMutateImageLayerCountMismatch(t *testing.T) {
+	config := strings.Replace(testConfig, `"diff_ids": [`, `"diff_ids": ["sha256:5555555555555555555555555555555555555555555555555555555555555555", `, 1)
+	if _, _, err := mutateImage([]byte(testManifest), []byte(config), nil, runconfig.Settings{}); err == nil {
+		t.Fatalf("mutateImage accepted a config with more diff IDs than manifest layers")
+	}
+}
+
+func TestParseDestination(t *testing.T) {
+	for _, tc := range []struct {
+		destination string
+		repository  string
+		tag         string
+		wantErr     string
+	}{
+		{destination: "registry.example.com/team/app", repository: "registry.example.com/team/app"},
+		{destination: "registry.example.com/team/app:patched", repository: "registry.example.com/team/app", tag: "patched"},
+		{destination: "registry.example.com/team/app@sha256:1111111111111111111111111111111111111111111111111111111111111111", wantErr: "names a digest"},
+	} {
+		t.Run(tc.destination, func(t *testing.T) {
+			repository, tag, err := parseDestination(tc.destination)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("parseDestination(%s) error = %v, want %q", tc.destination, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDestination: %v", err)
+			}
+			if repository.Name() != tc.repository || tag != tc.tag {
+				t.Errorf("parseDestination = %s, %q; want %s, %q", repository.Name(), tag, tc.repository, tc.tag)
+			}
+		})
+	}
+}
+
+// writeFilesLayer builds a layer holding one file with the flags of `img
+// layer`, as `img mutate --add` does.
+func writeFilesLayer(t *testing.T) addedLayer {
+	t.Helper()
+	dir := t.TempDir()
+	content := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(content, []byte("log_level: debug\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var files layerbuild.FileFlags
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	files.Register(flagSet)
+	if err := flagSet.Parse([]string{"--add", "/etc/app/config.yaml=" + content}); err != nil {
+		t.Fatal(err)
+	}
+	if files.Empty() {
+		t.Fatalf("FileFlags.Empty() = true after --add")
+	}
+
+	blob, err := os.Create(filepath.Join(dir, "layer.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := files.WriteLayer(api.Gzip, "hotfix", blob)
+	if closeErr := blob.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("WriteLayer: %v", err)
+	}
+	raw, err := os.ReadFile(blob.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256(raw)); desc.Digest != want || desc.Size != int64(len(raw)) {
+		t.Fatalf("WriteLayer metadata = %s (%d bytes), blob is %s (%d bytes)", desc.Digest, desc.Size, want, len(raw))
+	}
+	return addedLayer{desc: desc, path: blob.Name()}
+}
+
+func TestPushMountsSourceLayers(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name        string
+		destination string
+		// mounted is whether the layers of the source are mounted rather
+		// than uploaded: only within the same registry.
+		mounted bool
+	}{
+		{name: "same registry", destination: "src.example.com/team/app", mounted: true},
+		{name: "other registry", destination: "dst.example.com/team/app", mounted: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			regs := testregistry.New("src.example.com", "dst.example.com")
+			base, err := random.Image(256, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sourceRef, err := name.ParseReference("src.example.com/base/app:v1", registryopts.NameOptions()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := remote.Write(sourceRef, base, regs.Options()...); err != nil {
+				t.Fatalf("writing source image: %v", err)
+			}
+			regs.ResetUploads()
+
+			src, err := openSource(ctx, sourceRef.String(), "", regs.Options())
+			if err != nil {
+				t.Fatalf("openSource: %v", err)
+			}
+			added := writeFilesLayer(t)
+			img, err := buildImage(src, []addedLayer{added}, runconfig.Settings{
+				User:       runconfig.InheritFromBase,
+				WorkingDir: runconfig.InheritFromBase,
+				StopSignal: runconfig.InheritFromBase,
+				Env:        map[string]string{"LOG_LEVEL": "debug"},
+				Entrypoint: []string{runconfig.InheritFromBase},
+				Cmd:        []string{runconfig.InheritFromBase},
+			})
+			if err != nil {
+				t.Fatalf("buildImage: %v", err)
+			}
+			dst, tag, err := parseDestination(tc.destination + ":patched")
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs, err := pushImage(img, dst, []string{tag, "latest"}, regs.Options())
+			if err != nil {
+				t.Fatalf("pushImage: %v", err)
+			}
+			if len(refs) != 3 {
+				t.Fatalf("pushImage wrote %v, want the digest and two tags", refs)
+			}
+
+			host := dst.RegistryStr()
+			uploaded := make(map[string]bool)
+			for _, digest := range regs.Uploads(host) {
+				uploaded[digest] = true
+			}
+			baseLayers, err := base.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range baseLayers {
+				digest, err := l.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if uploaded[digest.String()] == tc.mounted {
+					t.Errorf("source layer %s uploaded = %v, want %v", digest, uploaded[digest.String()], !tc.mounted)
+				}
+			}
+			if !uploaded[added.desc.Digest] {
+				t.Errorf("appended layer %s was not uploaded", added.desc.Digest)
+			}
+
+			for _, ref := range refs {
+				pushed, err := remote.Image(ref, regs.Options()...)
+				if err != nil {
+					t.Fatalf("fetching %s: %v", ref, err)
+				}
+				digest, err := pushed.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, err := img.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if digest != want {
+					t.Errorf("%s = %s, want %s", ref, digest, want)
+				}
+			}
+			pushed, err := remote.Image(refs[1], regs.Options()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers, err := pushed.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layers) != 3 {
+				t.Errorf("pushed image has %d layers, want 3", len(layers))
+			}
+			config, err := pushed.ConfigFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.Config.Env, []string{"LOG_LEVEL=debug"}) {
+				t.Errorf("Env = %v, want [LOG_LEVEL=debug]", config.Config.Env)
+			}
+			if last := config.History[len(config.History)-1]; last.CreatedBy != "hotfix" {
+				t.Errorf("last history entry = %+v, want created_by hotfix", last)
+			}
+		})
+	}
+}
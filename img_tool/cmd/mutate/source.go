@@ -0,0 +1,52 @@
+package mutate
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/ocilayout"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// source is the image being mutated.
+type source struct {
+	description string
+	image       v1.Image
+	// repository is where the layers of the image can be mounted from: the
+	// repository of a registry reference, or --mount-from for an OCI layout.
+	// Nil when they can only be uploaded.
+	repository *name.Repository
+}
+
+// openSource opens the image of a registry reference, or of an OCI layout
+// when the argument is an existing directory. An index is narrowed down to
+// the image of the platform.
+func openSource(ctx context.Context, arg, platform string, opts []remote.Option) (*source, error) {
+	if info, err := os.Stat(arg); err == nil && info.IsDir() {
+		l, err := ocilayout.Read(arg)
+		if err != nil {
+			return nil, err
+		}
+		image, _, err := l.Image(platform)
+		if err != nil {
+			return nil, err
+		}
+		return &source{description: arg, image: image}, nil
+	}
+
+	ref, err := name.ParseReference(arg, registryopts.NameOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", arg, err)
+	}
+	image, _, err := ocilayout.FetchImage(ctx, ref, platform, opts...)
+	if err != nil {
+		return nil, err
+	}
+	repository := ref.Context()
+	return &source{description: ref.Name(), image: image, repository: &repository}, nil
+}
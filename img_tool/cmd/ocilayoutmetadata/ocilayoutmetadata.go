@@ -6,9 +6,10 @@
 // filesystem, writing them plus an images.json index into an output directory.
 //
 // It reads the layer blobs (at build time) to compute the mtree, but the layers
-// themselves are never emitted: only the small config + mtree metadata is. The
-// image_structure_test aspect uses this so a rules_oci image can be validated
-// without shipping any layer to the test runfiles.
+// themselves are never emitted: only the small config + mtree metadata is, plus
+// each layer's blob path within the layout. The image_structure_test aspect uses
+// this so a rules_oci image can be validated without shipping any layer to the
+// test runfiles; only a test that reads file contents ships the layout itself.
 package ocilayoutmetadata
 
 import (
@@ -164,9 +165,27 @@ func processManifest(srcDir, outputDir string, i int, desc specv1.Descriptor, op
 		Config:   configRel,
 		Mtree:    mtreeRel,
 		Complete: complete,
+		Layers:   layerSpecs(manifest.Layers),
 	}, nil
 }
 
+// layerSpecs records where each tar layer's blob lives, relative to the OCI
+// layout directory, so a test that ships the layout can read file contents. A
+// non-tar layer gets an empty LayerSpec: its effect on the filesystem is
+// unknown, as in the mtree.
+func layerSpecs(layers []specv1.Descriptor) []structuretest.LayerSpec {
+	specs := make([]structuretest.LayerSpec, 0, len(layers))
+	for _, layer := range layers {
+		if !strings.Contains(layer.MediaType, "tar") {
+			specs = append(specs, structuretest.LayerSpec{})
+			continue
+		}
+		blob := "blobs/" + layer.Digest.Algorithm().String() + "/" + layer.Digest.Hex()
+		specs = append(specs, structuretest.LayerSpec{Blob: blob})
+	}
+	return specs
+}
+
 // writeLayersMtree renders the merged mtree of the tar layers to outPath and
 // reports whether every layer was a tar (a skipped non-tar layer makes the mtree
 // an incomplete filesystem view).
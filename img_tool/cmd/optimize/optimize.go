@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/imagerewrite"
 	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -89,55 +90,22 @@ func rewriteManifest() error {
 		return fmt.Errorf("at least one --layer-from-metadata is required")
 	}
 
-	manifest, err := readJSONObject(sourceManifest)
+	manifest, err := imagerewrite.ReadManifest(sourceManifest)
 	if err != nil {
-		return fmt.Errorf("reading source manifest: %w", err)
+		return err
 	}
-	config, err := readJSONObject(sourceConfig)
-	if err != nil {
-		return fmt.Errorf("reading source config: %w", err)
-	}
-
-	layers, diffIDs, err := readLayerDescriptors(layerMetadataArgs)
+	config, err := imagerewrite.ReadConfig(sourceConfig)
 	if err != nil {
 		return err
 	}
 
-	rootFS, _ := config["rootfs"].(map[string]any)
-	if rootFS == nil {
-		rootFS = make(map[string]any)
-	}
-	rootFS["type"] = "layers"
-	rootFS["diff_ids"] = diffIDs
-	config["rootfs"] = rootFS
-
-	configRaw, err := json.Marshal(config)
+	layers, err := readLayerDescriptors(layerMetadataArgs)
 	if err != nil {
-		return fmt.Errorf("marshaling rewritten config: %w", err)
-	}
-
-	configDescriptor := sourceConfigDescriptor(manifest)
-	configMediaType := stringField(configDescriptor, "mediaType")
-	if configMediaType == "" {
-		configMediaType = specv1.MediaTypeImageConfig
-	}
-	configDescriptor["mediaType"] = configMediaType
-	configDescriptor["digest"] = digestString(configRaw)
-	configDescriptor["size"] = len(configRaw)
-	delete(configDescriptor, "data")
-
-	if _, ok := manifest["schemaVersion"]; !ok {
-		manifest["schemaVersion"] = 2
-	}
-	if stringField(manifest, "mediaType") == "" {
-		manifest["mediaType"] = specv1.MediaTypeImageManifest
+		return err
 	}
-	manifest["config"] = configDescriptor
-	manifest["layers"] = layers
-
-	manifestRaw, err := json.Marshal(manifest)
+	manifestRaw, configRaw, err := imagerewrite.ReplaceLayers(&manifest, &config, layers)
 	if err != nil {
-		return fmt.Errorf("marshaling rewritten manifest: %w", err)
+		return err
 	}
 
 	if err := writeIfRequested(configOutput, configRaw); err != nil {
@@ -146,7 +114,7 @@ func rewriteManifest() error {
 	if err := writeIfRequested(manifestOutput, manifestRaw); err != nil {
 		return fmt.Errorf("writing manifest: %w", err)
 	}
-	return writeDescriptorAndDigest(sourceDescriptor, stringField(manifest, "mediaType"), manifestRaw)
+	return writeDescriptorAndDigest(sourceDescriptor, manifest.MediaType, manifestRaw)
 }
 
 func rewriteIndex() error {
@@ -190,51 +158,29 @@ func rewriteIndex() error {
 	return writeDescriptorAndDigest(sourceDescriptor, stringField(index, "mediaType"), indexRaw)
 }
 
-func readLayerDescriptors(paths []string) ([]any, []string, error) {
-	layers := make([]any, 0, len(paths))
-	diffIDs := make([]string, 0, len(paths))
+func readLayerDescriptors(paths []string) ([]api.Descriptor, error) {
+	layers := make([]api.Descriptor, 0, len(paths))
 	for _, path := range paths {
 		raw, err := os.ReadFile(path)
 		if err != nil {
-			return nil, nil, fmt.Errorf("reading layer metadata %s: %w", path, err)
+			return nil, fmt.Errorf("reading layer metadata %s: %w", path, err)
 		}
 		var layer api.Descriptor
 		if err := json.Unmarshal(raw, &layer); err != nil {
-			return nil, nil, fmt.Errorf("decoding layer metadata %s: %w", path, err)
+			return nil, fmt.Errorf("decoding layer metadata %s: %w", path, err)
 		}
 		if layer.MediaType == "" {
-			return nil, nil, fmt.Errorf("layer metadata %s is missing mediaType", path)
+			return nil, fmt.Errorf("layer metadata %s is missing mediaType", path)
 		}
 		if layer.Digest == "" {
-			return nil, nil, fmt.Errorf("layer metadata %s is missing digest", path)
+			return nil, fmt.Errorf("layer metadata %s is missing digest", path)
 		}
 		if layer.DiffID == "" {
-			return nil, nil, fmt.Errorf("layer metadata %s is missing diff_id", path)
-		}
-		descriptor := map[string]any{
-			"mediaType": layer.MediaType,
-			"digest":    layer.Digest,
-			"size":      layer.Size,
-		}
-		if len(layer.Annotations) > 0 {
-			descriptor["annotations"] = layer.Annotations
+			return nil, fmt.Errorf("layer metadata %s is missing diff_id", path)
 		}
-		layers = append(layers, descriptor)
-		diffIDs = append(diffIDs, layer.DiffID)
-	}
-	return layers, diffIDs, nil
-}
-
-func sourceConfigDescriptor(manifest map[string]any) map[string]any {
-	configDescriptor, _ := manifest["config"].(map[string]any)
-	if configDescriptor == nil {
-		return make(map[string]any)
-	}
-	clone := make(map[string]any, len(configDescriptor))
-	for key, value := range configDescriptor {
-		clone[key] = value
+		layers = append(layers, layer)
 	}
-	return clone
+	return layers, nil
 }
 
 func writeDescriptorAndDigest(sourceDescriptorPath string, mediaType string, content []byte) error {
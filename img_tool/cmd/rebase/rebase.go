@@ -0,0 +1,319 @@
+// Package rebase implements `img rebase`: it moves an image from the base
+// image it was built on to another one, without rebuilding the layers on top.
+//
+// The image, its old base and its new base are each given as a manifest and a
+// config. The lowest layers of the image must be the layers of the old base,
+// which is checked by their diff IDs (the digests of the uncompressed layers,
+// so a base that was recompressed still matches), and the new base must be
+// for the platform of the image. The old base's layers are replaced by the
+// layers of the new base, and the layers above them are kept unchanged.
+//
+// The history of the config follows: the entries that belong to the old base
+// are replaced by the history of the new base. Everything else in the config
+// (entrypoint, environment, labels, ...) is the image's own and is kept,
+// including what the image inherited from the old base; a new base that
+// changes such settings needs a rebuild instead. The manifest and config are
+// rewritten with pkg/imagerewrite, like those of `img optimize`.
+//
+// The blobs of the new base's layers are usually not on disk. --layer-sources
+// writes, for every layer of the rebased image, the repositories it can be
+// mounted from, in the format of `img deploy-metadata --layer-sources-file`, so
+// that the rebased image is pushed through the usual deploy manifest path.
+package rebase
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/imagerewrite"
+)
+
+// sourceList is a repeatable "registry/repository" flag.
+type sourceList []api.LayerSource
+
+func (s *sourceList) String() string {
+	parts := make([]string, len(*s))
+	for i, source := range *s {
+		parts[i] = source.Registry + "/" + source.Repository
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s *sourceList) Set(value string) error {
+	registry, repository, ok := strings.Cut(value, "/")
+	if !ok || registry == "" || repository == "" {
+		return fmt.Errorf("want registry/repository, got %q", value)
+	}
+	*s = append(*s, api.LayerSource{Registry: registry, Repository: repository})
+	return nil
+}
+
+func RebaseProcess(_ context.Context, args []string) {
+	var sourceManifest, sourceConfig string
+	var oldBaseManifest, oldBaseConfig, newBaseManifest, newBaseConfig string
+	var manifestOutput, configOutput, digestOutput, layerSourcesOutput string
+	var newBaseSources, imageSources sourceList
+
+	flagSet := flag.NewFlagSet("rebase", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Replaces the base image layers of an image, keeping the layers built on top of it.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img rebase --source-manifest <manifest> --source-config <config> --old-base-manifest <manifest> --old-base-config <config> --new-base-manifest <manifest> --new-base-config <config> [OPTIONS]\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img rebase --source-manifest app_manifest.json --source-config app_config.json --old-base-manifest old_manifest.json --old-base-config old_config.json --new-base-manifest new_manifest.json --new-base-config new_config.json --manifest rebased_manifest.json --config rebased_config.json",
+			"img rebase ... --new-base-source index.docker.io/library/debian --image-source ghcr.io/example/app --layer-sources layer_sources.json",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+	flagSet.StringVar(&sourceManifest, "source-manifest", "", "Manifest of the image to rebase.")
+	flagSet.StringVar(&sourceConfig, "source-config", "", "Config of the image to rebase.")
+	flagSet.StringVar(&oldBaseManifest, "old-base-manifest", "", "Manifest of the base image the image was built on.")
+	flagSet.StringVar(&oldBaseConfig, "old-base-config", "", "Config of the base image the image was built on.")
+	flagSet.StringVar(&newBaseManifest, "new-base-manifest", "", "Manifest of the base image to move the image to.")
+	flagSet.StringVar(&newBaseConfig, "new-base-config", "", "Config of the base image to move the image to.")
+	flagSet.StringVar(&manifestOutput, "manifest", "", "Output image manifest.")
+	flagSet.StringVar(&configOutput, "config", "", "Output image config.")
+	flagSet.StringVar(&digestOutput, "digest", "", "Output digest of the rebased manifest.")
+	flagSet.StringVar(&layerSourcesOutput, "layer-sources", "", `Write the repositories each layer can be mounted from, for "img deploy-metadata --layer-sources-file".`)
+	flagSet.Var(&newBaseSources, "new-base-source", `Repository (registry/repository) the layers of the new base can be mounted from. Can be specified multiple times.`)
+	flagSet.Var(&imageSources, "image-source", `Repository (registry/repository) the layers of the image above its base can be mounted from. Can be specified multiple times.`)
+
+	if err := flagSet.Parse(args); err != nil {
+		// flag has already printed the error and the usage.
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+	if flagSet.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments %q\n", flagSet.Args())
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	for _, required := range []struct{ flag, value string }{
+		{"--source-manifest", sourceManifest},
+		{"--source-config", sourceConfig},
+		{"--old-base-manifest", oldBaseManifest},
+		{"--old-base-config", oldBaseConfig},
+		{"--new-base-manifest", newBaseManifest},
+		{"--new-base-config", newBaseConfig},
+	} {
+		if required.value == "" {
+			fmt.Fprintf(os.Stderr, "Error: %s is required\n", required.flag)
+			flagSet.Usage()
+			os.Exit(1)
+		}
+	}
+
+	img, err := readImage(sourceManifest, sourceConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	oldBase, err := readImage(oldBaseManifest, oldBaseConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	newBase, err := readImage(newBaseManifest, newBaseConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	err = writeRebased(img, oldBase, newBase, outputs{
+		manifest:       manifestOutput,
+		config:         configOutput,
+		digest:         digestOutput,
+		layerSources:   layerSourcesOutput,
+		newBaseSources: newBaseSources,
+		imageSources:   imageSources,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error rebasing %s: %v\n", sourceManifest, err)
+		os.Exit(1)
+	}
+}
+
+// image is a manifest and config, with the layers of the manifest and their
+// diff IDs from the config side by side.
+type image struct {
+	manifest specv1.Manifest
+	config   specv1.Image
+	layers   []api.Descriptor
+}
+
+// readImage reads a manifest and its config.
+func readImage(manifestPath, configPath string) (*image, error) {
+	manifest, err := imagerewrite.ReadManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := imagerewrite.ReadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("manifest %s has %d layers, but its config %s has %d diff IDs", manifestPath, len(manifest.Layers), configPath, len(config.RootFS.DiffIDs))
+	}
+	layers := make([]api.Descriptor, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		layers[i] = api.Descriptor{
+			MediaType:   desc.MediaType,
+			Digest:      desc.Digest.String(),
+			Size:        desc.Size,
+			Annotations: desc.Annotations,
+			DiffID:      config.RootFS.DiffIDs[i].String(),
+		}
+	}
+	return &image{manifest: manifest, config: config, layers: layers}, nil
+}
+
+// rebase returns the layers and history of img moved from oldBase to
+// newBase. The history is nil for an image without history.
+func rebase(img, oldBase, newBase *image) ([]api.Descriptor, []specv1.History, error) {
+	if !samePlatform(img.config.Platform, newBase.config.Platform) {
+		return nil, nil, fmt.Errorf("the image is for %s, but the new base is for %s", platformString(img.config.Platform), platformString(newBase.config.Platform))
+	}
+	if len(img.layers) < len(oldBase.layers) {
+		return nil, nil, fmt.Errorf("the image has %d layers, fewer than the %d layers of the old base", len(img.layers), len(oldBase.layers))
+	}
+	for i, layer := range oldBase.layers {
+		if img.layers[i].DiffID != layer.DiffID {
+			return nil, nil, fmt.Errorf("layer %d of the image has diff ID %s, but the old base has %s: the image is not built on the old base", i, img.layers[i].DiffID, layer.DiffID)
+		}
+	}
+	appLayers := img.layers[len(oldBase.layers):]
+	layers := append(append([]api.Descriptor{}, newBase.layers...), appLayers...)
+
+	if len(img.config.History) == 0 {
+		return layers, nil, nil
+	}
+	baseEntries, err := baseHistoryLength(img.config.History, oldBase)
+	if err != nil {
+		return nil, nil, err
+	}
+	history := append(append([]specv1.History{}, newBase.config.History...), img.config.History[baseEntries:]...)
+	return layers, history, nil
+}
+
+// samePlatform reports whether layers built for one platform run on the
+// other. A missing ARM variant is the default one, as in containerd's
+// platform matching.
+func samePlatform(a, b specv1.Platform) bool {
+	return a.OS == b.OS && a.Architecture == b.Architecture && armVariant(a) == armVariant(b)
+}
+
+func armVariant(p specv1.Platform) string {
+	switch {
+	case p.Variant != "":
+		return p.Variant
+	case p.Architecture == "arm64":
+		return "v8"
+	case p.Architecture == "arm":
+		return "v7"
+	}
+	return ""
+}
+
+func platformString(p specv1.Platform) string {
+	parts := []string{p.OS, p.Architecture}
+	if p.Variant != "" {
+		parts = append(parts, p.Variant)
+	}
+	return strings.Join(parts, "/")
+}
+
+// baseHistoryLength returns how many of the image's history entries belong
+// to the old base. An image built on a base usually starts with the base's
+// history as is. Failing that, the base's part ends with the history entry of
+// its last layer: the n-th entry that is not an empty layer, for a base of n
+// layers.
+func baseHistoryLength(history []specv1.History, oldBase *image) (int, error) {
+	baseHistory := oldBase.config.History
+	if len(baseHistory) <= len(history) && reflect.DeepEqual(history[:len(baseHistory)], baseHistory) {
+		return len(baseHistory), nil
+	}
+	if len(oldBase.layers) == 0 {
+		return 0, nil
+	}
+	layers := 0
+	for i, entry := range history {
+		if entry.EmptyLayer {
+			continue
+		}
+		layers++
+		if layers == len(oldBase.layers) {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("the history of the image describes %d layers, fewer than the %d layers of the old base", layers, len(oldBase.layers))
+}
+
+// outputs are the files `img rebase` writes.
+type outputs struct {
+	manifest, config, digest, layerSources string
+	newBaseSources, imageSources           []api.LayerSource
+}
+
+// writeRebased rebases img and writes the requested outputs.
+func writeRebased(img, oldBase, newBase *image, out outputs) error {
+	layers, history, err := rebase(img, oldBase, newBase)
+	if err != nil {
+		return err
+	}
+	if history != nil {
+		img.config.History = history
+	}
+	manifestRaw, configRaw, err := imagerewrite.ReplaceLayers(&img.manifest, &img.config, layers)
+	if err != nil {
+		return err
+	}
+	if err := writeIfRequested(out.config, configRaw); err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	if err := writeIfRequested(out.manifest, manifestRaw); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	if err := writeIfRequested(out.digest, []byte(fmt.Sprintf("sha256:%x", sha256.Sum256(manifestRaw)))); err != nil {
+		return fmt.Errorf("writing digest: %w", err)
+	}
+	if out.layerSources == "" {
+		return nil
+	}
+	perLayer := make([][]api.LayerSource, len(layers))
+	for i := range layers {
+		sources := out.imageSources
+		if i < len(newBase.layers) {
+			sources = out.newBaseSources
+		}
+		perLayer[i] = append([]api.LayerSource{}, sources...)
+	}
+	raw, err := json.Marshal(map[string][][]api.LayerSource{"0": perLayer})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(out.layerSources, raw, 0o644); err != nil {
+		return fmt.Errorf("writing layer sources: %w", err)
+	}
+	return nil
+}
+
+func writeIfRequested(path string, content []byte) error {
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, content, 0o644)
+}
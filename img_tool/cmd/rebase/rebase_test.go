@@ -0,0 +1,207 @@
+package rebase
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+func TestWriteRebased(t *testing.T) {
+	dir := t.TempDir()
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	baseHistory := []specv1.History{
+		{CreatedBy: "debian base", Created: &created},
+		{CreatedBy: "ENV PATH=/usr/bin", EmptyLayer: true},
+	}
+	oldBase := testImage(t, dir, "old", []string{"base1"}, baseHistory, nil)
+	newBase := testImage(t, dir, "new", []string{"patched1", "patched2"}, []specv1.History{
+		{CreatedBy: "patched base 1"},
+		{CreatedBy: "patched base 2"},
+	}, nil)
+	img := testImage(t, dir, "app", []string{"base1", "app1", "app2"}, append(append([]specv1.History{}, baseHistory...),
+		specv1.History{CreatedBy: "bazel build //app:deps"},
+		specv1.History{CreatedBy: "bazel build //app:bin"},
+	), map[string]any{"Entrypoint": []any{"/app/bin"}})
+
+	out := outputs{
+		manifest:       filepath.Join(dir, "rebased_manifest.json"),
+		config:         filepath.Join(dir, "rebased_config.json"),
+		digest:         filepath.Join(dir, "rebased_digest"),
+		layerSources:   filepath.Join(dir, "layer_sources.json"),
+		newBaseSources: []api.LayerSource{{Registry: "index.docker.io", Repository: "library/debian"}},
+		imageSources:   []api.LayerSource{{Registry: "ghcr.io", Repository: "example/app"}},
+	}
+	if err := writeRebased(img, oldBase, newBase, out); err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest struct {
+		Layers []api.Descriptor `json:"layers"`
+		Config api.Descriptor   `json:"config"`
+	}
+	readTestJSON(t, out.manifest, &manifest)
+	var digests []string
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	if got := strings.Join(digests, " "); got != "sha256:patched1 sha256:patched2 sha256:app1 sha256:app2" {
+		t.Errorf("layers = %s, want the new base's layers and the app layers", got)
+	}
+
+	var config struct {
+		Config map[string]any `json:"config"`
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []api.History `json:"history"`
+	}
+	readTestJSON(t, out.config, &config)
+	if got := strings.Join(config.RootFS.DiffIDs, " "); got != "sha256:diff-patched1 sha256:diff-patched2 sha256:diff-app1 sha256:diff-app2" {
+		t.Errorf("diff_ids = %s", got)
+	}
+	var createdBy []string
+	for _, entry := range config.History {
+		createdBy = append(createdBy, entry.CreatedBy)
+	}
+	if got := strings.Join(createdBy, ", "); got != "patched base 1, patched base 2, bazel build //app:deps, bazel build //app:bin" {
+		t.Errorf("history = %s", got)
+	}
+	if config.Config["Entrypoint"] == nil {
+		t.Errorf("config lost the image's Entrypoint: %v", config.Config)
+	}
+
+	digest, err := os.ReadFile(out.digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(digest), "sha256:") {
+		t.Errorf("digest = %q", digest)
+	}
+
+	var sources map[string][][]api.LayerSource
+	readTestJSON(t, out.layerSources, &sources)
+	perLayer := sources["0"]
+	if len(perLayer) != 4 || perLayer[1][0].Repository != "library/debian" || perLayer[2][0].Repository != "example/app" {
+		t.Errorf("layer sources = %+v, want the new base's repository for its layers and the image's for the rest", sources)
+	}
+}
+
+func TestRebaseRejectsOtherBase(t *testing.T) {
+	dir := t.TempDir()
+	oldBase := testImage(t, dir, "old", []string{"base1", "base2"}, nil, nil)
+	newBase := testImage(t, dir, "new", []string{"patched1"}, nil, nil)
+	img := testImage(t, dir, "app", []string{"base1", "other", "app1"}, nil, nil)
+	_, _, err := rebase(img, oldBase, newBase)
+	if err == nil || !strings.Contains(err.Error(), "not built on the old base") {
+		t.Errorf("rebase() error = %v, want an error about the base", err)
+	}
+}
+
+func TestRebaseRejectsOtherPlatform(t *testing.T) {
+	dir := t.TempDir()
+	oldBase := testImage(t, dir, "old", []string{"base1"}, nil, nil)
+	newBase := testImage(t, dir, "new", []string{"patched1"}, nil, nil)
+	newBase.config.Architecture = "arm64"
+	img := testImage(t, dir, "app", []string{"base1", "app1"}, nil, nil)
+	_, _, err := rebase(img, oldBase, newBase)
+	if err == nil || !strings.Contains(err.Error(), "linux/amd64") || !strings.Contains(err.Error(), "linux/arm64") {
+		t.Errorf("rebase() error = %v, want an error naming both platforms", err)
+	}
+
+	// A missing arm64 variant is v8.
+	img.config.Architecture, img.config.Variant = "arm64", "v8"
+	if _, _, err := rebase(img, oldBase, newBase); err != nil {
+		t.Errorf("rebase() of linux/arm64/v8 onto linux/arm64 = %v, want success", err)
+	}
+}
+
+func TestBaseHistoryLength(t *testing.T) {
+	oldBase := &image{
+		config: specv1.Image{History: []specv1.History{{CreatedBy: "squashed away"}}},
+		layers: []api.Descriptor{{DiffID: "sha256:a"}, {DiffID: "sha256:b"}},
+	}
+	history := []specv1.History{
+		{CreatedBy: "base layer 1"},
+		{CreatedBy: "ENV A=B", EmptyLayer: true},
+		{CreatedBy: "base layer 2"},
+		{CreatedBy: "app layer"},
+	}
+	// The image does not start with the old base's history, so the base's
+	// part ends with the history entry of its second layer.
+	got, err := baseHistoryLength(history, oldBase)
+	if err != nil || got != 3 {
+		t.Errorf("baseHistoryLength() = %d, %v, want 3", got, err)
+	}
+	oldBase.layers = append(oldBase.layers, api.Descriptor{}, api.Descriptor{})
+	if _, err := baseHistoryLength(history, oldBase); err == nil {
+		t.Errorf("baseHistoryLength() succeeded for a base with more layers than the history describes")
+	}
+}
+
+// testImage writes a manifest and config with the given layers, whose digests
+// are "sha256:<name>" and diff IDs "sha256:diff-<name>", and returns them read
+// back.
+func testImage(t *testing.T, dir, name string, layerNames []string, history []specv1.History, runConfig map[string]any) *image {
+	t.Helper()
+	layers := []any{}
+	diffIDs := []any{}
+	for _, layer := range layerNames {
+		layers = append(layers, map[string]any{"mediaType": api.TarGzipLayer, "digest": "sha256:" + layer, "size": 10})
+		diffIDs = append(diffIDs, "sha256:diff-"+layer)
+	}
+	manifest := map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]any{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:config", "size": 1},
+		"layers":        layers,
+	}
+	config := map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": diffIDs},
+	}
+	if history != nil {
+		config["history"] = history
+	}
+	if runConfig != nil {
+		config["config"] = runConfig
+	}
+	manifestPath := writeTestJSON(t, dir, name+"_manifest.json", manifest)
+	configPath := writeTestJSON(t, dir, name+"_config.json", config)
+	img, err := readImage(manifestPath, configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func writeTestJSON(t *testing.T, dir, name string, value any) string {
+	t.Helper()
+	raw, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func readTestJSON(t *testing.T, path string, value any) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		t.Fatal(err)
+	}
+}
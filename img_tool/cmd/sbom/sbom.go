@@ -0,0 +1,225 @@
+package sbom
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta/pkgfile"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/sbom"
+)
+
+// options are the inputs of one `img sbom` run.
+type options struct {
+	format       string
+	output       string
+	name         string
+	manifest     string
+	mtrees       []string
+	layers       []string
+	baseMetadata []string
+	debs         []string
+	rpms         []string
+	apks         []string
+	dpkgStatus   []string
+	baseImage    string
+	distro       string
+	created      string
+}
+
+func SBOMProcess(ctx context.Context, args []string) {
+	var opts options
+	var mtrees, layers, baseMetadata, debs, rpms, apks, dpkgStatus stringSliceFlag
+
+	flagSet := flag.NewFlagSet("sbom", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Writes a software bill of materials (SPDX 2.3 or CycloneDX 1.5 JSON) for an image from its build inputs.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img sbom [OPTIONS]\n\n")
+		fmt.Fprintf(flagSet.Output(), "Files are listed with their digests from the image's mtree, from layer blobs or\n")
+		fmt.Fprintf(flagSet.Output(), "from base metadata streams, applied in the order given (--mtree, then --layer,\n")
+		fmt.Fprintf(flagSet.Output(), "then --base-metadata). Packages come from .deb, .rpm and .apk files and from the\n")
+		fmt.Fprintf(flagSet.Output(), "dpkg status database, whether passed with --dpkg-status or found in a layer or\n")
+		fmt.Fprintf(flagSet.Output(), "base metadata stream, as does apk's installed database. The output is\n")
+		fmt.Fprintf(flagSet.Output(), "deterministic for a given --created time.\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img sbom --name registry.example.com/team/app --manifest manifest.json --mtree image.mtree --output app.spdx.json",
+			"img sbom --format cyclonedx --layer base.tgz --layer app.tgz --deb ca-certificates.deb --output app.cdx.json",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+
+	flagSet.StringVar(&opts.format, "format", sbom.FormatSPDX, `Format of the SBOM: "spdx" (SPDX 2.3 JSON) or "cyclonedx" (CycloneDX 1.5 JSON)`)
+	flagSet.StringVar(&opts.output, "output", "", "Path of the SBOM to write (default: stdout)")
+	flagSet.StringVar(&opts.name, "name", "", "Name of the image, e.g. registry.example.com/team/app")
+	flagSet.StringVar(&opts.manifest, "manifest", "", "(Optional) image manifest file; its digest identifies the image in the SBOM")
+	flagSet.Var(&mtrees, "mtree", "mtree spec listing files of the image, such as the image's merged mtree (can be specified multiple times)")
+	flagSet.Var(&layers, "layer", "Layer blob (tar, tar+gzip or tar+zstd) whose files and packages are listed (can be specified multiple times)")
+	flagSet.Var(&baseMetadata, "base-metadata", "Base metadata stream (from img base) whose files and packages are listed (can be specified multiple times)")
+	flagSet.Var(&debs, "deb", "Debian package installed in the image (can be specified multiple times)")
+	flagSet.Var(&rpms, "rpm", "RPM package installed in the image (can be specified multiple times)")
+	flagSet.Var(&apks, "apk", "Alpine package installed in the image (can be specified multiple times)")
+	flagSet.Var(&dpkgStatus, "dpkg-status", "dpkg status database (var/lib/dpkg/status or a status.d file) listing installed packages (can be specified multiple times)")
+	flagSet.StringVar(&opts.baseImage, "base-image", "", "(Optional) reference of the pulled base image, e.g. index.docker.io/library/debian@sha256:...")
+	flagSet.StringVar(&opts.distro, "distro", "", "(Optional) distribution used in package URLs, e.g. debian (default: the ID of the image's os-release)")
+	flagSet.StringVar(&opts.created, "created", "", "Creation time of the SBOM, as RFC 3339 or Unix seconds (default: $SOURCE_DATE_EPOCH, else the Unix epoch)")
+
+	if err := flagSet.Parse(args); err != nil {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if flagSet.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments %v\n", flagSet.Args())
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	opts.mtrees, opts.layers, opts.baseMetadata = mtrees, layers, baseMetadata
+	opts.debs, opts.rpms, opts.apks, opts.dpkgStatus = debs, rpms, apks, dpkgStatus
+
+	if err := run(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(opts options) error {
+	if _, err := sbom.MediaType(opts.format); err != nil {
+		return err
+	}
+	created, err := parseCreated(opts.created, os.Getenv("SOURCE_DATE_EPOCH"))
+	if err != nil {
+		return err
+	}
+	doc := sbom.Document{
+		Name:      opts.name,
+		BaseImage: opts.baseImage,
+		Distro:    opts.distro,
+		Created:   created,
+	}
+	if opts.manifest != "" {
+		raw, err := os.ReadFile(opts.manifest)
+		if err != nil {
+			return fmt.Errorf("reading manifest: %w", err)
+		}
+		sum := sha256.Sum256(raw)
+		doc.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	if doc.Name == "" {
+		doc.Name = "image"
+	}
+
+	collector := sbom.NewCollector()
+	for _, p := range opts.mtrees {
+		if err := addFile(p, collector.AddMtree); err != nil {
+			return fmt.Errorf("reading mtree %s: %w", p, err)
+		}
+	}
+	for _, p := range opts.layers {
+		if err := addFile(p, collector.AddLayer); err != nil {
+			return fmt.Errorf("reading layer %s: %w", p, err)
+		}
+	}
+	for _, p := range opts.baseMetadata {
+		entries, err := basemeta.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("reading base metadata %s: %w", p, err)
+		}
+		if err := collector.AddBaseMetadata(entries, os.ReadFile); err != nil {
+			return fmt.Errorf("reading base metadata %s: %w", p, err)
+		}
+	}
+	for _, p := range opts.dpkgStatus {
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("reading dpkg status: %w", err)
+		}
+		for _, info := range pkgfile.ParseDpkgStatus(content) {
+			collector.AddPackage(info)
+		}
+	}
+	for _, p := range opts.debs {
+		info, err := pkgfile.ReadDebInfo(p)
+		if err != nil {
+			return err
+		}
+		collector.AddPackage(*info)
+	}
+	for _, p := range opts.rpms {
+		info, err := pkgfile.ReadRPMInfo(p)
+		if err != nil {
+			return err
+		}
+		collector.AddPackage(*info)
+	}
+	for _, p := range opts.apks {
+		record, err := pkgfile.ReadAPKRecord(p)
+		if err != nil {
+			return err
+		}
+		collector.AddPackage(record.Info)
+	}
+
+	var buf bytes.Buffer
+	if err := sbom.Write(&buf, collector.Document(doc), opts.format); err != nil {
+		return fmt.Errorf("writing SBOM: %w", err)
+	}
+	if opts.output == "" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(opts.output, buf.Bytes(), 0o644)
+}
+
+// addFile opens p and hands it to add.
+func addFile(p string, add func(io.Reader) error) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return add(f)
+}
+
+// parseCreated returns the creation time of the SBOM: --created as RFC 3339 or
+// Unix seconds, else SOURCE_DATE_EPOCH, else the Unix epoch -- never the wall
+// clock, which would make every build of the SBOM differ.
+func parseCreated(created, sourceDateEpoch string) (time.Time, error) {
+	value, what := created, "--created"
+	if value == "" {
+		value, what = sourceDateEpoch, "SOURCE_DATE_EPOCH"
+	}
+	if value == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing %s %q: want RFC 3339 or Unix seconds", what, value)
+	}
+	return t.UTC(), nil
+}
+
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,95 @@
+package sbom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCreated(t *testing.T) {
+	for _, tc := range []struct {
+		created, sourceDateEpoch string
+		want                     time.Time
+		wantErr                  bool
+	}{
+		{want: time.Unix(0, 0).UTC()},
+		{sourceDateEpoch: "1700000000", want: time.Unix(1700000000, 0).UTC()},
+		{created: "2024-05-01T12:00:00+02:00", sourceDateEpoch: "1700000000", want: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{created: "yesterday", wantErr: true},
+	} {
+		got, err := parseCreated(tc.created, tc.sourceDateEpoch)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseCreated(%q, %q) error = %v, wantErr %v", tc.created, tc.sourceDateEpoch, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && !got.Equal(tc.want) {
+			t.Errorf("parseCreated(%q, %q) = %v, want %v", tc.created, tc.sourceDateEpoch, got, tc.want)
+		}
+	}
+}
+
+// TestRunIsReproducible writes the same SBOM twice and checks the bytes match
+// and the manifest digest names the image.
+func TestRunIsReproducible(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.json")
+	mtree := filepath.Join(dir, "image.mtree")
+	status := filepath.Join(dir, "status")
+	for path, content := range map[string]string{
+		manifest: `{"schemaVersion":2}`,
+		mtree:    "#mtree v2.0\n./bin/app type=file size=5 sha256digest=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n",
+		status:   "Package: tzdata\nStatus: install ok installed\nVersion: 2024a-0+deb12u1\nArchitecture: all\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var outputs [][]byte
+	for i := range 2 {
+		output := filepath.Join(dir, "sbom"+string(rune('0'+i))+".json")
+		opts := options{
+			format:     "cyclonedx",
+			output:     output,
+			name:       "registry.example.com/team/app",
+			manifest:   manifest,
+			mtrees:     []string{mtree},
+			dpkgStatus: []string{status},
+			distro:     "debian",
+		}
+		if err := run(opts); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, data)
+	}
+	if string(outputs[0]) != string(outputs[1]) {
+		t.Error("two runs wrote different SBOMs")
+	}
+	var doc struct {
+		Metadata struct {
+			Component struct {
+				Version string `json:"version"`
+			} `json:"component"`
+		} `json:"metadata"`
+		Components []struct {
+			PURL string `json:"purl"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(outputs[0], &doc); err != nil {
+		t.Fatalf("parsing SBOM: %v", err)
+	}
+	sum := sha256.Sum256([]byte(`{"schemaVersion":2}`))
+	if want := "sha256:" + hex.EncodeToString(sum[:]); doc.Metadata.Component.Version != want {
+		t.Errorf("image version = %q, want the manifest digest %s", doc.Metadata.Component.Version, want)
+	}
+	if len(doc.Components) != 2 || doc.Components[0].PURL != "pkg:deb/debian/tzdata@2024a-0+deb12u1?arch=all" {
+		t.Errorf("components = %+v", doc.Components)
+	}
+}
@@ -0,0 +1,289 @@
+package reproducible
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/ocilayout"
+)
+
+// build is one of the two builds compared: the images of an OCI layout, or a
+// list of layers given by their metadata.
+type build struct {
+	description string
+	// index is the raw index manifest when the OCI layout holds an index.
+	index  []byte
+	images []buildImage
+}
+
+// buildImage is an image of a build. Images built from layer metadata have
+// no manifest or config.
+type buildImage struct {
+	platform string
+	digest   string
+	manifest []byte
+	config   []byte
+	layers   []buildLayer
+}
+
+// buildLayer is a layer of a build.
+type buildLayer struct {
+	desc api.Descriptor
+	// source names the file the layer is read from.
+	source string
+	// openTar opens the uncompressed tar of the layer; nil when only the
+	// metadata of the layer is known.
+	openTar func(ctx context.Context) (*tarStream, error)
+	// openBlob opens the compressed layer blob; nil for compact streams.
+	openBlob func() (io.ReadCloser, error)
+	// compression reads the parameters the blob was compressed with.
+	compression func() (map[string]string, error)
+}
+
+// tarStream is the uncompressed tar of a layer. For a compact stream, the
+// content of CAS-referenced files is zero-filled and only known by digest.
+type tarStream struct {
+	reader io.Reader
+	// refDigest returns the recorded content digest of the range at offset,
+	// for compact streams.
+	refDigest func(offset, size int64) ([]byte, bool)
+	closers   []io.Closer
+}
+
+func (t *tarStream) Close() error {
+	var err error
+	for i := len(t.closers) - 1; i >= 0; i-- {
+		if cerr := t.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// openLayout reads the single image or index of an OCI layout, with every
+// image of the index.
+func openLayout(dir string) (*build, error) {
+	l, err := ocilayout.Read(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err := l.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &build{description: dir}
+	if root.MediaType.IsImage() {
+		image, err := l.Index.Image(root.Digest)
+		if err != nil {
+			return nil, err
+		}
+		bi, err := layoutImage(image, "")
+		if err != nil {
+			return nil, err
+		}
+		b.images = append(b.images, bi)
+		return b, nil
+	}
+
+	child, err := l.Index.ImageIndex(root.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if b.index, err = child.RawManifest(); err != nil {
+		return nil, err
+	}
+	childManifest, err := child.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range childManifest.Manifests {
+		if !desc.MediaType.IsImage() || ocilayout.IsSoci(desc) {
+			continue
+		}
+		image, err := child.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		bi, err := layoutImage(image, ocilayout.PlatformOf(desc))
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: %w", desc.Digest, err)
+		}
+		b.images = append(b.images, bi)
+	}
+	return b, nil
+}
+
+// layoutImage describes an image of an OCI layout. Its platform is the one
+// of its index entry, or else the one of its config.
+func layoutImage(image v1.Image, platform string) (buildImage, error) {
+	digest, err := image.Digest()
+	if err != nil {
+		return buildImage{}, err
+	}
+	manifest, err := image.Manifest()
+	if err != nil {
+		return buildImage{}, err
+	}
+	rawManifest, err := image.RawManifest()
+	if err != nil {
+		return buildImage{}, err
+	}
+	rawConfig, err := image.RawConfigFile()
+	if err != nil {
+		return buildImage{}, fmt.Errorf("reading config: %w", err)
+	}
+	config, err := image.ConfigFile()
+	if err != nil {
+		return buildImage{}, fmt.Errorf("reading config: %w", err)
+	}
+	if platform == "" {
+		platform = (&v1.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}).String()
+	}
+
+	bi := buildImage{platform: platform, digest: digest.String(), manifest: rawManifest, config: rawConfig}
+	for i, desc := range manifest.Layers {
+		layer := buildLayer{
+			desc: api.Descriptor{
+				MediaType:   string(desc.MediaType),
+				Digest:      desc.Digest.String(),
+				Size:        desc.Size,
+				Annotations: desc.Annotations,
+			},
+			source: desc.Digest.String(),
+		}
+		if i < len(config.RootFS.DiffIDs) {
+			layer.desc.DiffID = config.RootFS.DiffIDs[i].String()
+		}
+		blobDigest := desc.Digest
+		open := func() (io.ReadCloser, error) {
+			blob, err := image.LayerByDigest(blobDigest)
+			if err != nil {
+				return nil, err
+			}
+			return blob.Compressed()
+		}
+		setBlobSource(&layer, open)
+		bi.layers = append(bi.layers, layer)
+	}
+	return bi, nil
+}
+
+// openLayers reads a build given as layers: each a layer metadata file (as
+// written by `img layer --metadata`), optionally with the compact stream or
+// the blob of the layer.
+func openLayers(specs []string) (*build, error) {
+	b := &build{description: strings.Join(specs, ",")}
+	image := buildImage{}
+	for _, spec := range specs {
+		metadataPath, contentPath, _ := strings.Cut(spec, "=")
+		raw, err := os.ReadFile(metadataPath)
+		if err != nil {
+			return nil, err
+		}
+		var layer buildLayer
+		if err := json.Unmarshal(raw, &layer.desc); err != nil {
+			return nil, fmt.Errorf("parsing layer metadata %s: %w", metadataPath, err)
+		}
+		layer.source = metadataPath
+		if contentPath != "" {
+			layer.source = contentPath
+			isCompactStream, err := isCompactStreamFile(contentPath)
+			if err != nil {
+				return nil, err
+			}
+			if isCompactStream {
+				setCompactStreamSource(&layer, contentPath)
+			} else {
+				setBlobSource(&layer, func() (io.ReadCloser, error) { return os.Open(contentPath) })
+			}
+		}
+		image.layers = append(image.layers, layer)
+	}
+	b.images = append(b.images, image)
+	return b, nil
+}
+
+// setBlobSource reads a layer from its compressed blob.
+func setBlobSource(layer *buildLayer, open func() (io.ReadCloser, error)) {
+	layer.openBlob = open
+	layer.openTar = func(context.Context) (*tarStream, error) {
+		rc, err := open()
+		if err != nil {
+			return nil, err
+		}
+		r, err := mtree.Decompress(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		stream := &tarStream{reader: r, closers: []io.Closer{rc}}
+		if closer, ok := r.(io.Closer); ok {
+			stream.closers = append(stream.closers, closer)
+		}
+		return stream, nil
+	}
+	layer.compression = func() (map[string]string, error) {
+		rc, err := open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return blobCompression(rc)
+	}
+}
+
+// setCompactStreamSource reads a layer from its compact stream, with the
+// content of CAS-referenced files known by digest only.
+func setCompactStreamSource(layer *buildLayer, path string) {
+	layer.openTar = func(ctx context.Context) (*tarStream, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := compactstream.NewReconstructingReader(ctx, bufio.NewReader(f), compactstream.NullBlobStore{})
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &tarStream{reader: reader, refDigest: reader.RefDigestAt, closers: []io.Closer{f, reader}}, nil
+	}
+	layer.compression = func() (map[string]string, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		header, err := compactstream.ReadHeader(bufio.NewReader(f))
+		if err != nil {
+			return nil, err
+		}
+		return compactStreamCompression(header.OriginalCompression), nil
+	}
+}
+
+// isCompactStreamFile reports whether a file starts with the compact stream
+// magic.
+func isCompactStreamFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	prefix := make([]byte, compactstream.MagicSize)
+	n, err := io.ReadFull(f, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return compactstream.HasMagic(prefix[:n]), nil
+}
@@ -0,0 +1,149 @@
+package reproducible
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
+)
+
+// gzipExtraFlags names the values of the XFL byte of a gzip header, which
+// DEFLATE encoders set from their compression level.
+var gzipExtraFlags = map[byte]string{
+	0: "0",
+	2: "2 (maximum compression)",
+	4: "4 (fastest)",
+}
+
+// blobCompression reads the parameters a layer blob was compressed with from
+// the header of its first gzip member or zstd frame. Encoders differ in these
+// headers where the compressed data alone says nothing about the cause.
+func blobCompression(r io.Reader) (map[string]string, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(18)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("reading compression header: %w", err)
+	}
+	switch {
+	case len(header) >= 10 && header[0] == 0x1f && header[1] == 0x8b:
+		return gzipParameters(header), nil
+	case len(header) >= 4 && binary.LittleEndian.Uint32(header) == 0xfd2fb528:
+		return zstdParameters(header), nil
+	case len(header) >= 4 && binary.LittleEndian.Uint32(header)&0xfffffff0 == 0x184d2a50:
+		// A skippable frame, as zstd:chunked layers may start with.
+		return map[string]string{"compression": "zstd", "zstd.first_frame": "skippable"}, nil
+	}
+	return map[string]string{"compression": "none"}, nil
+}
+
+// gzipParameters reads the fixed fields of a gzip member header (RFC 1952).
+func gzipParameters(header []byte) map[string]string {
+	flags := header[3]
+	xfl, ok := gzipExtraFlags[header[8]]
+	if !ok {
+		xfl = strconv.Itoa(int(header[8]))
+	}
+	var names []string
+	for bit, name := range []string{"text", "header_crc", "extra", "name", "comment"} {
+		if flags&(1<<bit) != 0 {
+			names = append(names, name)
+		}
+	}
+	return map[string]string{
+		"compression": "gzip",
+		"gzip.flags":  strings.Join(names, ","),
+		"gzip.mtime":  strconv.FormatUint(uint64(binary.LittleEndian.Uint32(header[4:8])), 10),
+		"gzip.xfl":    xfl,
+		"gzip.os":     strconv.Itoa(int(header[9])),
+	}
+}
+
+// zstdParameters reads the frame header descriptor and window size of a zstd
+// frame (RFC 8878).
+func zstdParameters(header []byte) map[string]string {
+	params := map[string]string{"compression": "zstd"}
+	if len(header) < 6 {
+		return params
+	}
+	descriptor := header[4]
+	singleSegment := descriptor&0x20 != 0
+	params["zstd.checksum"] = strconv.FormatBool(descriptor&0x04 != 0)
+	params["zstd.single_segment"] = strconv.FormatBool(singleSegment)
+	params["zstd.content_size_field"] = strconv.Itoa([]int{0, 2, 4, 8}[descriptor>>6])
+	params["zstd.dictionary_id_field"] = strconv.Itoa([]int{0, 1, 2, 4}[descriptor&0x03])
+	if !singleSegment {
+		window := header[5]
+		exponent := uint(window >> 3)
+		base := uint64(1) << (10 + exponent)
+		params["zstd.window_size"] = strconv.FormatUint(base+base/8*uint64(window&0x07), 10)
+	}
+	return params
+}
+
+// compactStreamCompression lists the compression parameters a compact stream
+// recorded for the layer it describes.
+func compactStreamCompression(info compactstream.OriginalCompressionInfo) map[string]string {
+	compression := strconv.Itoa(int(info.Compression))
+	switch info.Compression {
+	case compactstream.OriginalCompressionNone:
+		compression = "none"
+	case compactstream.OriginalCompressionGzip:
+		compression = "gzip"
+	case compactstream.OriginalCompressionZstd:
+		compression = "zstd"
+	}
+	return map[string]string{
+		"compression":       compression,
+		"seekable":          strconv.FormatBool(info.Seekable),
+		"zstd_chunked":      strconv.FormatBool(info.ZstdChunked),
+		"level":             strconv.Itoa(int(info.CompressionLevel)),
+		"jobs":              strconv.Itoa(int(info.CompressorJobs)),
+		"end_padding":       strconv.FormatUint(uint64(info.EndPadding), 10),
+		"prioritized_files": strings.Join(info.PrioritizedFiles, ","),
+	}
+}
+
+// firstDifferentByte returns the offset of the first byte in which two
+// streams differ, or -1 if they are equal.
+func firstDifferentByte(a, b io.Reader) (int64, error) {
+	const chunkSize = 64 << 10
+	bufA, bufB := make([]byte, chunkSize), make([]byte, chunkSize)
+	var offset int64
+	for {
+		nA, errA := io.ReadFull(a, bufA)
+		nB, errB := io.ReadFull(b, bufB)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return 0, errA
+		}
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return 0, errB
+		}
+		if i := mismatch(bufA[:nA], bufB[:nB]); i >= 0 {
+			return offset + int64(i), nil
+		}
+		if nA < chunkSize {
+			return -1, nil
+		}
+		offset += chunkSize
+	}
+}
+
+// mismatch returns the index of the first byte in which a and b differ,
+// counting the end of the shorter one as a difference, or -1 if they are
+// equal.
+func mismatch(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		return n
+	}
+	return -1
+}
@@ -0,0 +1,161 @@
+package reproducible
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// writeHuman renders the report for reading in a terminal. Everything in it
+// is also in the JSON output, which is what scripts should use.
+func writeHuman(w io.Writer, report *Report) {
+	fmt.Fprintf(w, "a: %s\n", report.A)
+	fmt.Fprintf(w, "b: %s\n", report.B)
+	fmt.Fprintln(w)
+	if report.Reproducible {
+		fmt.Fprintln(w, "Reproducible: the builds are identical.")
+		return
+	}
+	fmt.Fprintln(w, "Not reproducible.")
+	if len(report.Index) > 0 {
+		fmt.Fprintln(w, "\nIndex:")
+		writeJSONDifferences(w, "  ", report.Index)
+	}
+	for _, image := range report.Images {
+		fmt.Fprintln(w)
+		writeImage(w, image)
+	}
+}
+
+func writeImage(w io.Writer, image ImageReport) {
+	name := "Image"
+	if image.Platform != "" {
+		name += " " + image.Platform
+	}
+	switch {
+	case image.Missing != "":
+		fmt.Fprintf(w, "%s: only in build %s\n", name, otherBuild(image.Missing))
+		return
+	case image.Reproducible:
+		fmt.Fprintf(w, "%s: identical (%s)\n", name, image.DigestA)
+		return
+	case image.DigestA != "" || image.DigestB != "":
+		fmt.Fprintf(w, "%s: %s vs %s\n", name, orNone(image.DigestA), orNone(image.DigestB))
+	default:
+		fmt.Fprintf(w, "%s:\n", name)
+	}
+	if len(image.Manifest) > 0 {
+		fmt.Fprintln(w, "  Manifest:")
+		writeJSONDifferences(w, "    ", image.Manifest)
+	}
+	if len(image.Config) > 0 {
+		fmt.Fprintln(w, "  Config:")
+		writeJSONDifferences(w, "    ", image.Config)
+	}
+	for _, layer := range image.Layers {
+		writeLayer(w, layer)
+	}
+}
+
+func writeLayer(w io.Writer, layer LayerReport) {
+	switch layer.Status {
+	case layerIdentical:
+		fmt.Fprintf(w, "  Layer #%d: identical\n", layer.Index)
+		return
+	case layerMissing:
+		missing := "b"
+		if layer.DigestA == "" {
+			missing = "a"
+		}
+		fmt.Fprintf(w, "  Layer #%d: only in build %s\n", layer.Index, otherBuild(missing))
+		return
+	case layerCompression:
+		fmt.Fprintf(w, "  Layer #%d: compression differs (same diff ID %s)\n", layer.Index, layer.DiffIDA)
+	default:
+		fmt.Fprintf(w, "  Layer #%d: content differs (diff ID %s vs %s)\n", layer.Index, orNone(layer.DiffIDA), orNone(layer.DiffIDB))
+	}
+	fmt.Fprintf(w, "    digest: %s vs %s\n", layer.DigestA, layer.DigestB)
+	if len(layer.Compression) > 0 {
+		fmt.Fprintln(w, "    Compression:")
+		for _, field := range layer.Compression {
+			fmt.Fprintf(w, "      %s: %s vs %s\n", field.Field, orNone(field.A), orNone(field.B))
+		}
+	} else if layer.Status == layerCompression {
+		fmt.Fprintln(w, "    Compression: same parameters; the compressor produced different output (another version or concurrency?)")
+	}
+	if layer.CompressedOffset != nil {
+		fmt.Fprintf(w, "    First differing compressed byte: %d\n", *layer.CompressedOffset)
+	}
+	if d := layer.FirstDifference; d != nil {
+		writeDifference(w, d)
+	}
+	if layer.DifferingEntries > 0 {
+		fields := make([]string, 0, len(layer.DifferingFields))
+		for field := range layer.DifferingFields {
+			fields = append(fields, field)
+		}
+		sort.Slice(fields, func(i, j int) bool {
+			if layer.DifferingFields[fields[i]] != layer.DifferingFields[fields[j]] {
+				return layer.DifferingFields[fields[i]] > layer.DifferingFields[fields[j]]
+			}
+			return fields[i] < fields[j]
+		})
+		for i, field := range fields {
+			fields[i] = fmt.Sprintf("%s (%d)", field, layer.DifferingFields[field])
+		}
+		fmt.Fprintf(w, "    %d entries differ: %s\n", layer.DifferingEntries, strings.Join(fields, ", "))
+	}
+	if layer.Note != "" {
+		fmt.Fprintf(w, "    Note: %s\n", layer.Note)
+	}
+}
+
+func writeDifference(w io.Writer, d *Difference) {
+	switch d.Kind {
+	case differenceHeader:
+		fmt.Fprintf(w, "    First difference: header of entry #%d %s (tar offset %d)\n", d.Entry, d.Path, d.Offset)
+		for _, field := range d.Fields {
+			fmt.Fprintf(w, "      %s: %s vs %s\n", field.Field, orNone(field.A), orNone(field.B))
+		}
+	case differenceHeaderEncoding:
+		fmt.Fprintf(w, "    First difference: encoding of the header of entry #%d %s (tar offset %d): same fields, %s\n", d.Entry, d.Path, d.Offset, d.Detail)
+	case differenceContent:
+		fmt.Fprintf(w, "    First difference: content of entry #%d %s (tar offset %d): %s\n", d.Entry, d.Path, d.Offset, d.Detail)
+	case differenceOrder, differenceEntries:
+		fmt.Fprintf(w, "    First difference: entry #%d is %s in build A and %s in build B (tar offset %d): %s\n", d.Entry, orNone(d.Path), orNone(d.OtherPath), d.Offset, d.Detail)
+		for _, path := range d.OnlyInA {
+			fmt.Fprintf(w, "      only in A: %s\n", path)
+		}
+		for _, path := range d.OnlyInB {
+			fmt.Fprintf(w, "      only in B: %s\n", path)
+		}
+	case differenceTrailer:
+		fmt.Fprintf(w, "    First difference: after the last entry (tar offset %d): %s\n", d.Offset, d.Detail)
+	}
+}
+
+func writeJSONDifferences(w io.Writer, indent string, differences []JSONDifference) {
+	for _, d := range differences {
+		path := d.Path
+		if path == "" {
+			path = "(document)"
+		}
+		fmt.Fprintf(w, "%s%s: %s vs %s\n", indent, path, orNone(d.A), orNone(d.B))
+	}
+}
+
+// otherBuild names the build that has what the other one is missing.
+func otherBuild(missing string) string {
+	if missing == "a" {
+		return "B"
+	}
+	return "A"
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
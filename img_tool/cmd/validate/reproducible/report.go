@@ -0,0 +1,406 @@
+package reproducible
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Statuses of a LayerReport.
+const (
+	layerIdentical = "identical"
+	// layerCompression is a layer with the same tar in differently
+	// compressed blobs.
+	layerCompression = "compression"
+	layerContent     = "content"
+	// layerMissing is a layer only one of the builds has.
+	layerMissing = "missing"
+)
+
+// maxJSONDifferences caps the differences listed per manifest or config.
+const maxJSONDifferences = 50
+
+// Report is everything `img validate reproducible` found out about two
+// builds. It is also the JSON output, so its field names are part of the
+// interface.
+type Report struct {
+	A            string `json:"a"`
+	B            string `json:"b"`
+	Reproducible bool   `json:"reproducible"`
+	// Index lists the differences between the index manifests.
+	Index  []JSONDifference `json:"index,omitempty"`
+	Images []ImageReport    `json:"images"`
+}
+
+// ImageReport compares the images of the two builds for one platform.
+type ImageReport struct {
+	Platform     string `json:"platform,omitempty"`
+	DigestA      string `json:"digest_a,omitempty"`
+	DigestB      string `json:"digest_b,omitempty"`
+	Reproducible bool   `json:"reproducible"`
+	// Missing is "a" or "b" for an image only the other build has.
+	Missing  string           `json:"missing,omitempty"`
+	Manifest []JSONDifference `json:"manifest,omitempty"`
+	Config   []JSONDifference `json:"config,omitempty"`
+	Layers   []LayerReport    `json:"layers,omitempty"`
+}
+
+// JSONDifference is a value that differs between two JSON documents, at a
+// path like "history[2].created". A and B are the JSON encoded values; a
+// missing value is empty.
+type JSONDifference struct {
+	Path string `json:"path"`
+	A    string `json:"a,omitempty"`
+	B    string `json:"b,omitempty"`
+}
+
+// LayerReport compares the layers of the two builds at one index.
+type LayerReport struct {
+	Index   int    `json:"index"`
+	Status  string `json:"status"`
+	DigestA string `json:"digest_a,omitempty"`
+	DigestB string `json:"digest_b,omitempty"`
+	DiffIDA string `json:"diff_id_a,omitempty"`
+	DiffIDB string `json:"diff_id_b,omitempty"`
+	// Compression lists the compression parameters that differ.
+	Compression []FieldDifference `json:"compression,omitempty"`
+	// CompressedOffset is the first byte in which two blobs of the same
+	// tar differ.
+	CompressedOffset *int64 `json:"compressed_offset,omitempty"`
+	// FirstDifference is the first difference in the uncompressed tars.
+	FirstDifference *Difference `json:"first_difference,omitempty"`
+	// DifferingEntries counts the entries that differ while the entries of
+	// the tars line up, and DifferingFields counts them per field.
+	DifferingEntries int            `json:"differing_entries,omitempty"`
+	DifferingFields  map[string]int `json:"differing_fields,omitempty"`
+	// Note explains what could not be compared.
+	Note string `json:"note,omitempty"`
+}
+
+// Difference is the first difference between two tars, in terms of the
+// entries of the tar.
+type Difference struct {
+	// Kind is one of header, header_encoding, content, order, entries and
+	// trailer.
+	Kind string `json:"kind"`
+	// Entry is the index of the entry in the tar.
+	Entry int `json:"entry"`
+	// Path is the path in the image of the entry in build A, and OtherPath
+	// that of the entry in build B where the entries no longer line up.
+	Path      string `json:"path,omitempty"`
+	OtherPath string `json:"other_path,omitempty"`
+	// Offset is the offset in the uncompressed tar of build A where the
+	// difference starts.
+	Offset int64             `json:"offset"`
+	Fields []FieldDifference `json:"fields,omitempty"`
+	// ContentOffset is the first differing byte of a file's content, when
+	// both contents were available.
+	ContentOffset *int64   `json:"content_offset,omitempty"`
+	OnlyInA       []string `json:"only_in_a,omitempty"`
+	OnlyInB       []string `json:"only_in_b,omitempty"`
+	Detail        string   `json:"detail,omitempty"`
+}
+
+// FieldDifference is a field that differs between the two builds.
+type FieldDifference struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// compareBuilds compares two builds. Images are paired by platform, layers by
+// index.
+func compareBuilds(ctx context.Context, a, b *build) (*Report, error) {
+	report := &Report{A: a.description, B: b.description, Images: []ImageReport{}}
+	if !bytes.Equal(a.index, b.index) {
+		report.Index = jsonDifferences(a.index, b.index)
+	}
+
+	imagesB := make(map[string]*buildImage)
+	for i := range b.images {
+		imagesB[b.images[i].platform] = &b.images[i]
+	}
+	for i := range a.images {
+		imageA := &a.images[i]
+		imageB, ok := imagesB[imageA.platform]
+		if !ok {
+			report.Images = append(report.Images, ImageReport{Platform: imageA.platform, DigestA: imageA.digest, Missing: "b"})
+			continue
+		}
+		delete(imagesB, imageA.platform)
+		image, err := compareImages(ctx, imageA, imageB)
+		if err != nil {
+			return nil, err
+		}
+		report.Images = append(report.Images, image)
+	}
+	for i := range b.images {
+		if _, ok := imagesB[b.images[i].platform]; ok {
+			report.Images = append(report.Images, ImageReport{Platform: b.images[i].platform, DigestB: b.images[i].digest, Missing: "a"})
+		}
+	}
+
+	report.Reproducible = len(report.Index) == 0
+	for _, image := range report.Images {
+		report.Reproducible = report.Reproducible && image.Reproducible
+	}
+	return report, nil
+}
+
+func compareImages(ctx context.Context, a, b *buildImage) (ImageReport, error) {
+	report := ImageReport{Platform: a.platform, DigestA: a.digest, DigestB: b.digest}
+	if a.digest != "" && a.digest == b.digest {
+		report.Reproducible = true
+		return report, nil
+	}
+	if !bytes.Equal(a.manifest, b.manifest) {
+		report.Manifest = jsonDifferences(a.manifest, b.manifest)
+	}
+	if !bytes.Equal(a.config, b.config) {
+		report.Config = jsonDifferences(a.config, b.config)
+	}
+
+	report.Reproducible = len(report.Manifest) == 0 && len(report.Config) == 0
+	for i := 0; i < max(len(a.layers), len(b.layers)); i++ {
+		var layerA, layerB *buildLayer
+		if i < len(a.layers) {
+			layerA = &a.layers[i]
+		}
+		if i < len(b.layers) {
+			layerB = &b.layers[i]
+		}
+		layer, err := compareLayers(ctx, i, layerA, layerB)
+		if err != nil {
+			return ImageReport{}, fmt.Errorf("layer %d: %w", i, err)
+		}
+		report.Reproducible = report.Reproducible && layer.Status == layerIdentical
+		report.Layers = append(report.Layers, layer)
+	}
+	return report, nil
+}
+
+// compareLayers compares two layers. Layers with the same digest are
+// identical; with the same diff ID, only their compression differs;
+// otherwise their tars are walked to find the first difference.
+func compareLayers(ctx context.Context, index int, a, b *buildLayer) (LayerReport, error) {
+	report := LayerReport{Index: index}
+	if a == nil || b == nil {
+		report.Status = layerMissing
+		if a != nil {
+			report.DigestA, report.DiffIDA = a.desc.Digest, a.desc.DiffID
+		} else {
+			report.DigestB, report.DiffIDB = b.desc.Digest, b.desc.DiffID
+		}
+		return report, nil
+	}
+	report.DigestA, report.DigestB = a.desc.Digest, b.desc.Digest
+	report.DiffIDA, report.DiffIDB = a.desc.DiffID, b.desc.DiffID
+	if a.desc.Digest == b.desc.Digest {
+		report.Status = layerIdentical
+		return report, nil
+	}
+
+	var err error
+	if report.Compression, err = compareCompression(a, b); err != nil {
+		return LayerReport{}, err
+	}
+	if a.desc.DiffID != "" && a.desc.DiffID == b.desc.DiffID {
+		report.Status = layerCompression
+		if a.openBlob == nil || b.openBlob == nil {
+			return report, nil
+		}
+		offset, err := compareBlobs(a, b)
+		if err != nil {
+			return LayerReport{}, err
+		}
+		report.CompressedOffset = &offset
+		return report, nil
+	}
+
+	report.Status = layerContent
+	for _, layer := range []struct {
+		name  string
+		layer *buildLayer
+	}{{"A", a}, {"B", b}} {
+		if layer.layer.openTar == nil {
+			report.Note = fmt.Sprintf("build %s gives no compact stream or blob of the layer (%s), so only the digests were compared", layer.name, layer.layer.source)
+			return report, nil
+		}
+	}
+	tarA, err := a.openTar(ctx)
+	if err != nil {
+		return LayerReport{}, fmt.Errorf("opening %s: %w", a.source, err)
+	}
+	defer tarA.Close()
+	tarB, err := b.openTar(ctx)
+	if err != nil {
+		return LayerReport{}, fmt.Errorf("opening %s: %w", b.source, err)
+	}
+	defer tarB.Close()
+	comparison, err := compareTars(tarA, tarB)
+	if err != nil {
+		return LayerReport{}, err
+	}
+	report.FirstDifference = comparison.first
+	report.DifferingEntries = comparison.differingEntries
+	if len(comparison.fieldCounts) > 0 {
+		report.DifferingFields = comparison.fieldCounts
+	}
+	if comparison.first == nil {
+		report.Note = "the tars are the same; the layer metadata of the two builds disagrees with their content"
+	}
+	return report, nil
+}
+
+// compareCompression lists the compression parameters and layer descriptor
+// fields that differ. Parameters only one side records (a compact stream
+// records the level, a blob header the gzip OS byte) are listed when set.
+func compareCompression(a, b *buildLayer) ([]FieldDifference, error) {
+	parameters := func(layer *buildLayer) (map[string]string, error) {
+		params := map[string]string{"media_type": layer.desc.MediaType}
+		for key, value := range layer.desc.Annotations {
+			params["annotation:"+key] = value
+		}
+		if layer.compression == nil {
+			return params, nil
+		}
+		compression, err := layer.compression()
+		if err != nil {
+			return nil, fmt.Errorf("reading compression of %s: %w", layer.source, err)
+		}
+		for key, value := range compression {
+			params[key] = value
+		}
+		return params, nil
+	}
+	paramsA, err := parameters(a)
+	if err != nil {
+		return nil, err
+	}
+	paramsB, err := parameters(b)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for key := range paramsA {
+		keys[key] = true
+	}
+	for key := range paramsB {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	var differences []FieldDifference
+	for _, key := range sorted {
+		if paramsA[key] != paramsB[key] {
+			differences = append(differences, FieldDifference{Field: key, A: paramsA[key], B: paramsB[key]})
+		}
+	}
+	return differences, nil
+}
+
+// compareBlobs returns the first byte in which two layer blobs differ.
+func compareBlobs(a, b *buildLayer) (int64, error) {
+	blobA, err := a.openBlob()
+	if err != nil {
+		return 0, err
+	}
+	defer blobA.Close()
+	blobB, err := b.openBlob()
+	if err != nil {
+		return 0, err
+	}
+	defer blobB.Close()
+	return firstDifferentByte(blobA, blobB)
+}
+
+// jsonDifferences lists the values that differ between two JSON documents,
+// with their paths. Documents that do not parse are compared as a whole.
+func jsonDifferences(a, b []byte) []JSONDifference {
+	var valueA, valueB any
+	if json.Unmarshal(a, &valueA) != nil || json.Unmarshal(b, &valueB) != nil {
+		return []JSONDifference{{Path: "", A: string(a), B: string(b)}}
+	}
+	var differences []JSONDifference
+	collectJSONDifferences("", valueA, valueB, &differences)
+	if len(differences) == 0 {
+		// Equal values, encoded differently (whitespace, key order).
+		differences = append(differences, JSONDifference{Path: "", A: fmt.Sprintf("%d bytes", len(a)), B: fmt.Sprintf("%d bytes", len(b))})
+	}
+	return differences
+}
+
+func collectJSONDifferences(path string, a, b any, differences *[]JSONDifference) {
+	if len(*differences) >= maxJSONDifferences {
+		return
+	}
+	switch valueA := a.(type) {
+	case map[string]any:
+		if valueB, ok := b.(map[string]any); ok {
+			keys := make(map[string]bool)
+			for key := range valueA {
+				keys[key] = true
+			}
+			for key := range valueB {
+				keys[key] = true
+			}
+			sorted := make([]string, 0, len(keys))
+			for key := range keys {
+				sorted = append(sorted, key)
+			}
+			sort.Strings(sorted)
+			for _, key := range sorted {
+				child := key
+				if path != "" {
+					child = path + "." + key
+				}
+				collectJSONDifferences(child, valueA[key], valueB[key], differences)
+			}
+			return
+		}
+	case []any:
+		if valueB, ok := b.([]any); ok {
+			for i := 0; i < max(len(valueA), len(valueB)); i++ {
+				var itemA, itemB any
+				if i < len(valueA) {
+					itemA = valueA[i]
+				}
+				if i < len(valueB) {
+					itemB = valueB[i]
+				}
+				collectJSONDifferences(path+"["+strconv.Itoa(i)+"]", itemA, itemB, differences)
+			}
+			return
+		}
+	}
+	encodedA, encodedB := encodeJSON(a), encodeJSON(b)
+	if encodedA != encodedB {
+		*differences = append(*differences, JSONDifference{Path: path, A: encodedA, B: encodedB})
+	}
+}
+
+// encodeJSON encodes a JSON value; a missing value encodes as "".
+func encodeJSON(value any) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// writeJSON prints the report as JSON.
+func writeJSON(w io.Writer, report *Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,122 @@
+// Package reproducible implements `img validate reproducible`, which checks
+// that two builds of the same target are bit for bit identical and, where
+// they are not, pinpoints why.
+//
+// A build is given as an OCI layout, or as its layers: layer metadata files
+// (as written by `img layer --metadata`), each with the compact stream or the
+// blob of the layer. Images are paired by platform and layers by index.
+// Layers with the same digest are identical. Layers with the same diff ID but
+// another digest hold the same tar, compressed differently: the compression
+// parameters that differ are reported, from the compact stream header
+// (OriginalCompressionInfo) or the gzip and zstd frame headers of a blob,
+// along with the first differing compressed byte. Layers whose tars differ
+// are walked entry by entry, and the first difference is reported in terms of
+// the path in the image: a header field (mtime, uid/gid, mode, PAX records,
+// ...), the same fields encoded differently, the first differing byte of the
+// content, entries in another order, or entries only one build has. The
+// number of differing entries per field is reported for the whole layer, to
+// tell a one-off difference from a systematic one.
+package reproducible
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func ReproducibleProcess(ctx context.Context, args []string) {
+	var layoutA, layoutB, format string
+	var layersA, layersB stringSliceFlag
+
+	flagSet := flag.NewFlagSet("reproducible", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Checks that two builds of the same target are identical and pinpoints the first\n")
+		fmt.Fprintf(flagSet.Output(), "difference of every layer that is not.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img validate reproducible (--oci-layout-a DIR | --layer-a METADATA[=FILE]...) (--oci-layout-b DIR | --layer-b METADATA[=FILE]...)\n\n")
+		fmt.Fprintf(flagSet.Output(), "FILE is the compact stream or the blob of the layer. Without it, only the digests\n")
+		fmt.Fprintf(flagSet.Output(), "of the layer are compared. Exits with status 1 when the builds differ.\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img validate reproducible --oci-layout-a /tmp/first/image_oci_layout --oci-layout-b bazel-bin/app/image_oci_layout",
+			"img validate reproducible --layer-a a/layer_metadata.json=a/layer.cstream --layer-b b/layer_metadata.json=b/layer.cstream",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+	flagSet.StringVar(&layoutA, "oci-layout-a", "", "OCI layout of the first build")
+	flagSet.StringVar(&layoutB, "oci-layout-b", "", "OCI layout of the second build")
+	flagSet.Var(&layersA, "layer-a", "Layer of the first build as METADATA[=FILE], in order (can be used multiple times)")
+	flagSet.Var(&layersB, "layer-b", "Layer of the second build as METADATA[=FILE], in order (can be used multiple times)")
+	flagSet.StringVar(&format, "format", "human", `Output format: "human" or "json"`)
+
+	if err := flagSet.Parse(args); err != nil {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if format != "human" && format != "json" {
+		fmt.Fprintf(os.Stderr, "Error: --format must be \"human\" or \"json\", not %q\n", format)
+		os.Exit(1)
+	}
+	if flagSet.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments %q\n", flagSet.Args())
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	a, err := openBuild("a", layoutA, layersA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	b, err := openBuild("b", layoutB, layersB)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	report, err := compareBuilds(ctx, a, b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if format == "json" {
+		err = writeJSON(os.Stdout, report)
+	} else {
+		writeHuman(os.Stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !report.Reproducible {
+		os.Exit(1)
+	}
+}
+
+// openBuild opens a build from its OCI layout or its layers, whichever of the
+// flags for the side was given.
+func openBuild(side, layoutPath string, layers []string) (*build, error) {
+	switch {
+	case layoutPath != "" && len(layers) > 0:
+		return nil, fmt.Errorf("--oci-layout-%s and --layer-%s cannot be combined", side, side)
+	case layoutPath != "":
+		return openLayout(layoutPath)
+	case len(layers) > 0:
+		return openLayers(layers)
+	}
+	return nil, fmt.Errorf("one of --oci-layout-%s and --layer-%s is required", side, side)
+}
@@ -0,0 +1,279 @@
+package reproducible
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+)
+
+func TestCompareTars(t *testing.T) {
+	base := []testimage.Entry{
+		{Name: "etc/", Typeflag: tar.TypeDir},
+		{Name: "etc/hosts", Content: "127.0.0.1 localhost\n"},
+		{Name: "usr/bin/app", Content: "binary"},
+	}
+	modify := func(change func(entries []testimage.Entry) []testimage.Entry) []testimage.Entry {
+		entries := append([]testimage.Entry(nil), base...)
+		return change(entries)
+	}
+
+	tests := []struct {
+		name        string
+		a, b        []testimage.Entry
+		want        *Difference
+		wantEntries int
+		wantFields  map[string]int
+	}{
+		{
+			name: "identical",
+			a:    base,
+			b:    base,
+		},
+		{
+			name: "mtime",
+			a:    base,
+			b: modify(func(entries []testimage.Entry) []testimage.Entry {
+				for i := range entries {
+					entries[i].ModTime = time.Unix(1700000000, 0)
+				}
+				return entries
+			}),
+			want: &Difference{
+				Kind:   differenceHeader,
+				Entry:  0,
+				Path:   "/etc",
+				Offset: 136,
+				Fields: []FieldDifference{{Field: "mtime", A: "1970-01-01T00:00:00Z", B: "2023-11-14T22:13:20Z"}},
+			},
+			wantEntries: 3,
+			wantFields:  map[string]int{"mtime": 3},
+		},
+		{
+			name: "uid and xattr",
+			a:    base,
+			b: modify(func(entries []testimage.Entry) []testimage.Entry {
+				entries[1].Uid = 1000
+				entries[1].PAXRecords = map[string]string{"SCHILY.xattr.user.origin": "build"}
+				return entries
+			}),
+			want: &Difference{
+				Kind:  differenceHeader,
+				Entry: 1,
+				Path:  "/etc/hosts",
+				Fields: []FieldDifference{
+					{Field: "uid", A: "0", B: "1000"},
+					{Field: "pax:SCHILY.xattr.user.origin", A: "", B: "build"},
+					{Field: "format", A: "USTAR", B: "PAX"},
+				},
+			},
+			wantEntries: 1,
+			wantFields:  map[string]int{"uid": 1, "pax:SCHILY.xattr.user.origin": 1, "format": 1},
+		},
+		{
+			name: "content",
+			a:    base,
+			b: modify(func(entries []testimage.Entry) []testimage.Entry {
+				entries[2].Content = "binarY"
+				return entries
+			}),
+			want: &Difference{
+				Kind:   differenceContent,
+				Entry:  2,
+				Path:   "/usr/bin/app",
+				Offset: 4*512 + 5,
+				Detail: "first differing byte at offset 5 of the file",
+			},
+			wantEntries: 1,
+			wantFields:  map[string]int{"content": 1},
+		},
+		{
+			name: "order",
+			a:    base,
+			b:    []testimage.Entry{base[0], base[2], base[1]},
+			want: &Difference{
+				Kind:      differenceOrder,
+				Entry:     1,
+				Path:      "/etc/hosts",
+				OtherPath: "/usr/bin/app",
+				Detail:    "the remaining 2 entries are the same, in another order",
+			},
+		},
+		{
+			name: "extra entry",
+			a:    base,
+			b:    append(modify(func(entries []testimage.Entry) []testimage.Entry { return entries }), testimage.Entry{Name: "tmp/build.log", Content: "log"}),
+			want: &Difference{
+				Kind:      differenceEntries,
+				Entry:     3,
+				OtherPath: "/tmp/build.log",
+				OnlyInB:   []string{"/tmp/build.log"},
+				Detail:    "0 entries only in build A, 1 only in build B",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comparison, err := compareTars(tarStreamOf(t, tt.a), tarStreamOf(t, tt.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if comparison.first != nil {
+					t.Fatalf("first difference = %+v, want none", comparison.first)
+				}
+				return
+			}
+			got := comparison.first
+			if got == nil {
+				t.Fatal("no difference found")
+			}
+			if got.Kind != tt.want.Kind || got.Entry != tt.want.Entry || got.Path != tt.want.Path || got.OtherPath != tt.want.OtherPath || got.Detail != tt.want.Detail {
+				t.Errorf("first difference = %+v, want %+v", got, tt.want)
+			}
+			if tt.want.Offset != 0 && got.Offset != tt.want.Offset {
+				t.Errorf("offset = %d, want %d", got.Offset, tt.want.Offset)
+			}
+			if len(got.Fields) != len(tt.want.Fields) {
+				t.Fatalf("fields = %+v, want %+v", got.Fields, tt.want.Fields)
+			}
+			for i := range got.Fields {
+				if got.Fields[i] != tt.want.Fields[i] {
+					t.Errorf("field %d = %+v, want %+v", i, got.Fields[i], tt.want.Fields[i])
+				}
+			}
+			if len(got.OnlyInA) != len(tt.want.OnlyInA) || len(got.OnlyInB) != len(tt.want.OnlyInB) {
+				t.Errorf("only in A/B = %q/%q, want %q/%q", got.OnlyInA, got.OnlyInB, tt.want.OnlyInA, tt.want.OnlyInB)
+			}
+			if comparison.differingEntries != tt.wantEntries {
+				t.Errorf("differing entries = %d, want %d", comparison.differingEntries, tt.wantEntries)
+			}
+			for field, count := range tt.wantFields {
+				if comparison.fieldCounts[field] != count {
+					t.Errorf("entries differing in %s = %d, want %d", field, comparison.fieldCounts[field], count)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareTarsHeaderEncoding(t *testing.T) {
+	// The same entry, written in the USTAR and GNU formats.
+	entries := []testimage.Entry{{Name: "etc/hosts", Content: "127.0.0.1 localhost\n"}}
+	gnu := []testimage.Entry{{Name: "etc/hosts", Content: "127.0.0.1 localhost\n", Format: tar.FormatGNU}}
+	comparison, err := compareTars(tarStreamOf(t, entries), tarStreamOf(t, gnu))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comparison.first == nil || comparison.first.Kind != differenceHeaderEncoding {
+		t.Fatalf("first difference = %+v, want a header encoding difference", comparison.first)
+	}
+	if comparison.first.Path != "/etc/hosts" {
+		t.Errorf("path = %q, want /etc/hosts", comparison.first.Path)
+	}
+}
+
+func TestCompareLayouts(t *testing.T) {
+	base := []testimage.Entry{
+		{Name: "etc/", Typeflag: tar.TypeDir},
+		{Name: "etc/hosts", Content: "127.0.0.1 localhost\n"},
+	}
+	app := []testimage.Entry{
+		{Name: "app/main", Content: "main"},
+		{Name: "app/config", Content: "debug = false\n"},
+	}
+	dirA := testimage.WriteLayout(t, []v1.Layer{testimage.Layer(t, base, gzip.BestCompression), testimage.Layer(t, app, gzip.DefaultCompression)}, nil)
+	dirSame := testimage.WriteLayout(t, []v1.Layer{testimage.Layer(t, base, gzip.BestCompression), testimage.Layer(t, app, gzip.DefaultCompression)}, nil)
+	rebuiltApp := append([]testimage.Entry(nil), app...)
+	rebuiltApp[1].ModTime = time.Unix(1700000000, 0)
+	dirB := testimage.WriteLayout(t, []v1.Layer{testimage.Layer(t, base, gzip.BestSpeed), testimage.Layer(t, rebuiltApp, gzip.DefaultCompression)}, nil)
+
+	ctx := context.Background()
+	open := func(dir string) *build {
+		b, err := openLayout(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	report, err := compareBuilds(ctx, open(dirA), open(dirSame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Reproducible {
+		t.Fatalf("identical builds reported as not reproducible: %+v", report)
+	}
+
+	report, err = compareBuilds(ctx, open(dirA), open(dirB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Reproducible {
+		t.Fatal("different builds reported as reproducible")
+	}
+	if len(report.Images) != 1 || len(report.Images[0].Layers) != 2 {
+		t.Fatalf("report = %+v, want one image with two layers", report)
+	}
+	if len(report.Images[0].Manifest) == 0 || len(report.Images[0].Config) == 0 {
+		t.Errorf("manifest and config differences = %+v, %+v, want both", report.Images[0].Manifest, report.Images[0].Config)
+	}
+
+	baseLayer := report.Images[0].Layers[0]
+	if baseLayer.Status != layerCompression {
+		t.Errorf("base layer status = %q, want %q", baseLayer.Status, layerCompression)
+	}
+	if baseLayer.CompressedOffset == nil {
+		t.Error("base layer has no compressed offset")
+	}
+	var xfl *FieldDifference
+	for i := range baseLayer.Compression {
+		if baseLayer.Compression[i].Field == "gzip.xfl" {
+			xfl = &baseLayer.Compression[i]
+		}
+	}
+	if xfl == nil || xfl.A != "2 (maximum compression)" || xfl.B != "4 (fastest)" {
+		t.Errorf("gzip.xfl difference = %+v, want maximum compression vs fastest", xfl)
+	}
+
+	appLayer := report.Images[0].Layers[1]
+	if appLayer.Status != layerContent {
+		t.Fatalf("app layer status = %q, want %q", appLayer.Status, layerContent)
+	}
+	d := appLayer.FirstDifference
+	if d == nil || d.Kind != differenceHeader || d.Entry != 1 || d.Path != "/app/config" {
+		t.Fatalf("first difference = %+v, want the header of /app/config", d)
+	}
+	if len(d.Fields) != 1 || d.Fields[0].Field != "mtime" {
+		t.Errorf("fields = %+v, want mtime", d.Fields)
+	}
+	if appLayer.DifferingEntries != 1 || appLayer.DifferingFields["mtime"] != 1 {
+		t.Errorf("differing entries = %d %v, want 1 in mtime", appLayer.DifferingEntries, appLayer.DifferingFields)
+	}
+
+	var out bytes.Buffer
+	writeHuman(&out, report)
+	for _, want := range []string{
+		"Not reproducible.",
+		"Layer #0: compression differs",
+		"gzip.xfl: 2 (maximum compression) vs 4 (fastest)",
+		"Layer #1: content differs",
+		"First difference: header of entry #1 /app/config",
+		"mtime: 1970-01-01T00:00:00Z vs 2023-11-14T22:13:20Z",
+		"1 entries differ: mtime (1)",
+	} {
+		if !bytes.Contains(out.Bytes(), []byte(want)) {
+			t.Errorf("human output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func tarStreamOf(t *testing.T, entries []testimage.Entry) *tarStream {
+	return &tarStream{reader: bytes.NewReader(testimage.Tar(t, entries))}
+}
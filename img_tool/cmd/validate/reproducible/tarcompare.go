@@ -0,0 +1,404 @@
+package reproducible
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of a Difference.
+const (
+	// differenceHeader is an entry whose header fields differ.
+	differenceHeader = "header"
+	// differenceHeaderEncoding is an entry whose header fields are the same
+	// but encoded differently, e.g. in another tar format.
+	differenceHeaderEncoding = "header_encoding"
+	differenceContent        = "content"
+	// differenceOrder is a tar with the same entries in another order.
+	differenceOrder = "order"
+	// differenceEntries is a tar with other entries.
+	differenceEntries = "entries"
+	// differenceTrailer is a tar whose end-of-archive blocks differ.
+	differenceTrailer = "trailer"
+)
+
+// paxFields are the PAX records archive/tar folds into header fields, which
+// are compared as such.
+var paxFields = map[string]bool{
+	"path": true, "linkpath": true, "size": true, "uid": true, "gid": true,
+	"uname": true, "gname": true, "mtime": true, "atime": true, "ctime": true,
+}
+
+// maxListedEntries caps the entries listed as only in one of the builds.
+const maxListedEntries = 20
+
+// tarComparison is what comparing two tar streams found.
+type tarComparison struct {
+	first *Difference
+	// differingEntries counts the aligned entries that differ.
+	differingEntries int
+	// fieldCounts counts the differing entries per field.
+	fieldCounts map[string]int
+}
+
+// recordingReader counts the bytes read through it and, while recording,
+// keeps them, so the raw bytes of tar headers can be compared.
+type recordingReader struct {
+	r         io.Reader
+	offset    int64
+	recording bool
+	recorded  bytes.Buffer
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	if r.recording {
+		r.recorded.Write(p[:n])
+	}
+	return n, err
+}
+
+// tarWalker reads the entries of a tar stream with their raw header bytes.
+type tarWalker struct {
+	stream *tarStream
+	rec    *recordingReader
+	tr     *tar.Reader
+}
+
+func newTarWalker(stream *tarStream) *tarWalker {
+	rec := &recordingReader{r: stream.reader}
+	return &tarWalker{stream: stream, rec: rec, tr: tar.NewReader(rec)}
+}
+
+// next reads the next header. raw holds the bytes read for it: the padding of
+// the previous entry's content and the header blocks, including PAX and GNU
+// long name headers. start is the offset raw begins at in the tar.
+func (w *tarWalker) next() (hdr *tar.Header, raw []byte, start int64, err error) {
+	if _, err := io.Copy(io.Discard, w.tr); err != nil {
+		return nil, nil, 0, err
+	}
+	w.rec.recorded.Reset()
+	start = w.rec.offset
+	w.rec.recording = true
+	hdr, err = w.tr.Next()
+	w.rec.recording = false
+	return hdr, bytes.Clone(w.rec.recorded.Bytes()), start, err
+}
+
+// trailer returns the bytes after the last entry: the raw bytes read by the
+// final next and the rest of the stream.
+func (w *tarWalker) trailer(raw []byte) ([]byte, error) {
+	rest, err := io.ReadAll(w.rec)
+	if err != nil {
+		return nil, err
+	}
+	return append(raw, rest...), nil
+}
+
+// contentDigest returns the digest a compact stream recorded for the content
+// of the current entry.
+func (w *tarWalker) contentDigest(size int64) ([]byte, bool) {
+	if w.stream.refDigest == nil || size == 0 {
+		return nil, false
+	}
+	return w.stream.refDigest(w.rec.offset, size)
+}
+
+// compareTars walks two tar streams in lockstep and finds the first
+// difference. Aligned entries are all compared, to count which fields differ
+// across the layer; once the entries no longer line up, the remaining names
+// tell whether only their order differs.
+func compareTars(a, b *tarStream) (*tarComparison, error) {
+	result := &tarComparison{fieldCounts: make(map[string]int)}
+	wa, wb := newTarWalker(a), newTarWalker(b)
+	for entry := 0; ; entry++ {
+		hdrA, rawA, startA, errA := wa.next()
+		hdrB, rawB, _, errB := wb.next()
+		if errA != nil && errA != io.EOF {
+			return nil, fmt.Errorf("reading tar of build A: %w", errA)
+		}
+		if errB != nil && errB != io.EOF {
+			return nil, fmt.Errorf("reading tar of build B: %w", errB)
+		}
+
+		if errA == io.EOF && errB == io.EOF {
+			trailerA, err := wa.trailer(rawA)
+			if err != nil {
+				return nil, err
+			}
+			trailerB, err := wb.trailer(rawB)
+			if err != nil {
+				return nil, err
+			}
+			if i := mismatch(trailerA, trailerB); i >= 0 && result.first == nil {
+				result.first = &Difference{
+					Kind:   differenceTrailer,
+					Entry:  entry,
+					Offset: startA + int64(i),
+					Detail: fmt.Sprintf("end of archive of %d vs %d bytes", len(trailerA), len(trailerB)),
+				}
+			}
+			return result, nil
+		}
+
+		if errA == io.EOF || errB == io.EOF || hdrA.Name != hdrB.Name {
+			namesA, namesB := []string{}, []string{}
+			if errA != io.EOF {
+				namesA = append(namesA, hdrA.Name)
+			}
+			if errB != io.EOF {
+				namesB = append(namesB, hdrB.Name)
+			}
+			if err := remainingNames(wa, &namesA); err != nil {
+				return nil, err
+			}
+			if err := remainingNames(wb, &namesB); err != nil {
+				return nil, err
+			}
+			if result.first == nil {
+				result.first = entriesDifference(entry, namesA, namesB)
+				result.first.Offset = startA + int64(max(mismatch(rawA, rawB), 0))
+			}
+			return result, nil
+		}
+
+		fields := compareHeaders(hdrA, hdrB)
+		content, err := compareContent(wa, wb, hdrA, hdrB)
+		if err != nil {
+			return nil, fmt.Errorf("comparing %s: %w", hdrA.Name, err)
+		}
+		encodingDiffers := len(fields) == 0 && !bytes.Equal(rawA, rawB)
+		if len(fields) == 0 && content == nil && !encodingDiffers {
+			continue
+		}
+
+		result.differingEntries++
+		for _, field := range fields {
+			result.fieldCounts[field.Field]++
+		}
+		if content != nil {
+			result.fieldCounts["content"]++
+		}
+		if encodingDiffers {
+			result.fieldCounts["header_encoding"]++
+		}
+		if result.first != nil {
+			continue
+		}
+
+		difference := &Difference{Entry: entry, Path: imagePath(hdrA.Name), Fields: fields}
+		switch {
+		case len(fields) > 0:
+			difference.Kind = differenceHeader
+			difference.Offset = startA + int64(max(mismatch(rawA, rawB), 0))
+		case content != nil:
+			difference.Kind = differenceContent
+			difference.Offset = startA + int64(len(rawA))
+			if content.offset >= 0 {
+				difference.Offset += content.offset
+				difference.ContentOffset = &content.offset
+			}
+			difference.Detail = content.detail
+		default:
+			difference.Kind = differenceHeaderEncoding
+			difference.Offset = startA + int64(mismatch(rawA, rawB))
+			difference.Detail = fmt.Sprintf("%d vs %d header bytes", len(rawA), len(rawB))
+		}
+		result.first = difference
+	}
+}
+
+// remainingNames appends the names of the entries left in a tar.
+func remainingNames(w *tarWalker, names *[]string) error {
+	for {
+		if _, err := io.Copy(io.Discard, w.tr); err != nil {
+			return err
+		}
+		hdr, err := w.tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		*names = append(*names, hdr.Name)
+	}
+}
+
+// entriesDifference describes two tars whose entries stop lining up at entry:
+// the same entries in another order, or entries only one of them has.
+func entriesDifference(entry int, namesA, namesB []string) *Difference {
+	difference := &Difference{Entry: entry}
+	if len(namesA) > 0 {
+		difference.Path = imagePath(namesA[0])
+	}
+	if len(namesB) > 0 {
+		difference.OtherPath = imagePath(namesB[0])
+	}
+
+	counts := make(map[string]int)
+	for _, name := range namesA {
+		counts[name]++
+	}
+	for _, name := range namesB {
+		counts[name]--
+	}
+	for name, count := range counts {
+		for ; count > 0; count-- {
+			difference.OnlyInA = append(difference.OnlyInA, imagePath(name))
+		}
+		for ; count < 0; count++ {
+			difference.OnlyInB = append(difference.OnlyInB, imagePath(name))
+		}
+	}
+	if len(difference.OnlyInA) == 0 && len(difference.OnlyInB) == 0 {
+		difference.Kind = differenceOrder
+		difference.Detail = fmt.Sprintf("the remaining %d entries are the same, in another order", len(namesA))
+		return difference
+	}
+	difference.Kind = differenceEntries
+	difference.Detail = fmt.Sprintf("%d entries only in build A, %d only in build B", len(difference.OnlyInA), len(difference.OnlyInB))
+	sort.Strings(difference.OnlyInA)
+	sort.Strings(difference.OnlyInB)
+	if len(difference.OnlyInA) > maxListedEntries {
+		difference.OnlyInA = difference.OnlyInA[:maxListedEntries]
+	}
+	if len(difference.OnlyInB) > maxListedEntries {
+		difference.OnlyInB = difference.OnlyInB[:maxListedEntries]
+	}
+	return difference
+}
+
+// compareHeaders lists the fields in which two headers of the same name
+// differ. PAX records that archive/tar does not fold into fields (extended
+// attributes, say) are compared one by one as "pax:<key>".
+func compareHeaders(a, b *tar.Header) []FieldDifference {
+	var fields []FieldDifference
+	field := func(name, valueA, valueB string) {
+		if valueA != valueB {
+			fields = append(fields, FieldDifference{Field: name, A: valueA, B: valueB})
+		}
+	}
+	field("type", typeName(a.Typeflag), typeName(b.Typeflag))
+	field("linkname", a.Linkname, b.Linkname)
+	field("size", strconv.FormatInt(a.Size, 10), strconv.FormatInt(b.Size, 10))
+	field("mode", fmt.Sprintf("%#o", a.Mode), fmt.Sprintf("%#o", b.Mode))
+	field("uid", strconv.Itoa(a.Uid), strconv.Itoa(b.Uid))
+	field("gid", strconv.Itoa(a.Gid), strconv.Itoa(b.Gid))
+	field("uname", a.Uname, b.Uname)
+	field("gname", a.Gname, b.Gname)
+	field("mtime", formatTime(a.ModTime), formatTime(b.ModTime))
+	field("atime", formatTime(a.AccessTime), formatTime(b.AccessTime))
+	field("ctime", formatTime(a.ChangeTime), formatTime(b.ChangeTime))
+	field("devmajor", strconv.FormatInt(a.Devmajor, 10), strconv.FormatInt(b.Devmajor, 10))
+	field("devminor", strconv.FormatInt(a.Devminor, 10), strconv.FormatInt(b.Devminor, 10))
+
+	keys := make(map[string]bool)
+	for key := range a.PAXRecords {
+		keys[key] = true
+	}
+	for key := range b.PAXRecords {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		if !paxFields[key] {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		field("pax:"+key, a.PAXRecords[key], b.PAXRecords[key])
+	}
+	if len(fields) > 0 {
+		// The format only explains a difference of other fields, such
+		// as an mtime with nanoseconds needing PAX.
+		field("format", a.Format.String(), b.Format.String())
+	}
+	return fields
+}
+
+// contentDifference is a difference in the content of a file. offset is the
+// first differing byte of the content, or -1 when only digests are known.
+type contentDifference struct {
+	offset int64
+	detail string
+}
+
+// compareContent compares the content of two regular files of the same size.
+// A compact stream records the content of a CAS-referenced file only by its
+// digest; it is compared with the digest of the other side.
+func compareContent(wa, wb *tarWalker, a, b *tar.Header) (*contentDifference, error) {
+	if a.Typeflag != tar.TypeReg || b.Typeflag != tar.TypeReg || a.Size != b.Size || a.Size == 0 {
+		return nil, nil
+	}
+	digestA, knownA := wa.contentDigest(a.Size)
+	digestB, knownB := wb.contentDigest(b.Size)
+	if !knownA && !knownB {
+		offset, err := firstDifferentByte(wa.tr, wb.tr)
+		if err != nil || offset < 0 {
+			return nil, err
+		}
+		return &contentDifference{offset: offset, detail: fmt.Sprintf("first differing byte at offset %d of the file", offset)}, nil
+	}
+	var err error
+	if !knownA {
+		digestA, err = hashContent(wa.tr)
+	} else if !knownB {
+		digestB, err = hashContent(wb.tr)
+	}
+	if err != nil || bytes.Equal(digestA, digestB) {
+		return nil, err
+	}
+	return &contentDifference{offset: -1, detail: fmt.Sprintf("content sha256:%x vs sha256:%x", digestA, digestB)}, nil
+}
+
+func hashContent(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// imagePath renders a tar entry name as a path in the image.
+func imagePath(name string) string {
+	return "/" + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func typeName(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return strconv.Quote(string(typeflag))
+}
+
+// formatTime renders a header time with its full precision; a time the
+// header does not carry renders as "".
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -6,12 +6,14 @@ import (
 	"os"
 
 	layerpresence "github.com/bazel-contrib/rules_img/img_tool/cmd/validate/layer-presence"
+	"github.com/bazel-contrib/rules_img/img_tool/cmd/validate/reproducible"
 )
 
 const usage = `Usage img validate [COMMAND] [ARGS...]
 
 Commands:
-  layer-presence  Checks that layers used for deduplication are present in a final image.`
+  layer-presence  Checks that layers used for deduplication are present in a final image.
+  reproducible    Checks that two builds of the same target are identical and pinpoints where they differ.`
 
 func ValidationProcess(ctx context.Context, args []string) {
 	if len(args) < 1 {
@@ -23,6 +25,8 @@ func ValidationProcess(ctx context.Context, args []string) {
 	switch command {
 	case "layer-presence":
 		layerpresence.LayerPresenceProcess(ctx, args[1:])
+	case "reproducible":
+		reproducible.ReproducibleProcess(ctx, args[1:])
 	default:
 		fmt.Fprintln(os.Stderr, usage)
 		os.Exit(1)
@@ -0,0 +1,155 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/runfiles"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/signer"
+)
+
+func VerifyProcess(ctx context.Context, args []string) {
+	var settingFile string
+	var plugin string
+	var pluginArgs stringSliceFlag
+
+	flagSet := flag.NewFlagSet("verify", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Checks that images carry a valid signature, using the signer plugin they were signed with.\n\n")
+		fmt.Fprintf(flagSet.Output(), "Usage: img verify [OPTIONS] IMAGE...\n\n")
+		fmt.Fprintf(flagSet.Output(), "Each IMAGE is a tag or digest reference. Its referrers are fetched through the\n")
+		fmt.Fprintf(flagSet.Output(), "pull gateway, when configured, and handed to the plugin as\n")
+		fmt.Fprintf(flagSet.Output(), "`<plugin> verify-oci-artifact [args...]`, which decides whether one of them is a\n")
+		fmt.Fprintf(flagSet.Output(), "valid signature. The verified digest references are printed on stdout; the\n")
+		fmt.Fprintf(flagSet.Output(), "command fails if any IMAGE has no valid signature.\n\n")
+		flagSet.PrintDefaults()
+		examples := []string{
+			"img verify --plugin rules-img-cosign --plugin_arg=--key --plugin_arg=cosign.pub registry.example.com/team/app:v1.2.3",
+			"img verify --sign_setting_file bazel-bin/release_signer.sign_config.json registry.example.com/team/app@sha256:abc123...",
+		}
+		fmt.Fprintf(flagSet.Output(), "\nExamples:\n")
+		for _, example := range examples {
+			fmt.Fprintf(flagSet.Output(), "  $ %s\n", example)
+		}
+	}
+
+	flagSet.StringVar(&settingFile, "sign_setting_file", "", "sign_setting config file (the output of a signing_config target) naming the plugin; its verify_args are passed to the plugin")
+	flagSet.StringVar(&plugin, "plugin", "", "Name or path of the signer plugin, resolved on $PATH (instead of --sign_setting_file)")
+	flagSet.Var(&pluginArgs, "plugin_arg", "Argument passed to --plugin after the verify-oci-artifact verb (can be used multiple times)")
+
+	if err := flagSet.Parse(args); err != nil {
+		flagSet.Usage()
+		os.Exit(1)
+	}
+	if flagSet.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Error: expected at least one IMAGE\n")
+		flagSet.Usage()
+		os.Exit(1)
+	}
+
+	verifier, err := newVerifier(settingFile, plugin, pluginArgs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	pull, err := registryopts.Pull()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: configuring pull transport: %v\n", err)
+		os.Exit(1)
+	}
+	if err := run(ctx, flagSet.Args(), verifier, pull.Remote(), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newVerifier builds the plugin subprocess from a sign_setting config file, or
+// from a plugin command and its verify arguments. Exactly one must be given.
+func newVerifier(settingFile, plugin string, pluginArgs []string) (*signer.Subprocess, error) {
+	switch {
+	case settingFile != "" && plugin != "":
+		return nil, errors.New("--sign_setting_file and --plugin are mutually exclusive")
+	case settingFile == "" && plugin == "":
+		return nil, errors.New("one of --sign_setting_file or --plugin is required")
+	case settingFile != "" && len(pluginArgs) > 0:
+		return nil, errors.New("--plugin_arg requires --plugin; a sign_setting carries its own verify_args")
+	}
+
+	var rf *runfiles.Runfiles
+	if r, err := runfiles.New(); err == nil {
+		rf = r
+	}
+	if plugin != "" {
+		return signer.NewSubprocess(signer.SignSettingConfig{
+			SchemaVersion: 1,
+			Mode:          "command",
+			Tool:          plugin,
+			VerifyArgs:    pluginArgs,
+		}, rf)
+	}
+	store, err := signer.Discover(nil, nil, settingFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := store.Resolve(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return signer.NewSubprocess(cfg, rf)
+}
+
+// run verifies every reference in refs and prints the verified digest
+// references on stdout. It checks them all before reporting the ones that did
+// not verify.
+func run(ctx context.Context, refs []string, verifier api.OCIArtifactVerifier, opts []remote.Option, stdout io.Writer) error {
+	var failed []string
+	for _, raw := range refs {
+		ref, err := name.ParseReference(raw, registryopts.NameOptions()...)
+		if err != nil {
+			return fmt.Errorf("parsing %q: %w", raw, err)
+		}
+		digest, result, err := signer.VerifyReference(ctx, verifier, ref, opts...)
+		if err != nil {
+			return err
+		}
+		if !result.Verified {
+			fmt.Fprintf(os.Stderr, "not verified: %s: %s\n", digest, result.Reason)
+			failed = append(failed, digest.String())
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "verified %s: signature %s%s\n", digest, result.Artifact, signedBy(result.Identity))
+		fmt.Fprintln(stdout, digest.String())
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("no valid signature on %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func signedBy(identity string) string {
+	if identity == "" {
+		return ""
+	}
+	return " signed by " + identity
+}
+
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,153 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testregistry"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// TestHelperProcess is not a real test: with GO_WANT_HELPER_PROCESS=verify it
+// acts as the verify-oci-artifact verb of a signer plugin whose signature of a
+// subject is the layer "sig-of-<hex>".
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "verify" {
+		return
+	}
+	var req api.VerifyRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		os.Exit(2)
+	}
+	result := api.VerifyResult{Reason: "no signature by the test key"}
+	for _, artifact := range req.Artifacts {
+		for _, blob := range artifact.Blobs {
+			if string(blob) == "sig-of-"+req.Subject.Digest.Hex {
+				result = api.VerifyResult{Verified: true, Artifact: artifact.Descriptor.Digest.String(), Identity: "test key"}
+			}
+		}
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		os.Exit(4)
+	}
+	os.Exit(0)
+}
+
+func TestRun(t *testing.T) {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "verify")
+	regs := testregistry.New("reg.example.com")
+	signed := pushImage(t, regs, "reg.example.com/team/app:signed")
+	pushSignature(t, regs, signed, "sig-of-"+strings.TrimPrefix(digestOf(t, regs, signed).DigestStr(), "sha256:"))
+	forged := pushImage(t, regs, "reg.example.com/team/app:forged")
+	pushSignature(t, regs, forged, "sig-of-something-else")
+	unsigned := pushImage(t, regs, "reg.example.com/team/app:unsigned")
+
+	verifier, err := newVerifier("", os.Args[0], []string{"-test.run=TestHelperProcess"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	var stdout bytes.Buffer
+	if err := run(ctx, []string{signed.String()}, verifier, regs.Options(), &stdout); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got, want := strings.TrimSpace(stdout.String()), digestOf(t, regs, signed).String(); got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+
+	stdout.Reset()
+	err = run(ctx, []string{signed.String(), forged.String(), unsigned.String()}, verifier, regs.Options(), &stdout)
+	if err == nil {
+		t.Fatal("run verified a forged and an unsigned image")
+	}
+	for _, tag := range []name.Tag{forged, unsigned} {
+		if !strings.Contains(err.Error(), digestOf(t, regs, tag).DigestStr()) {
+			t.Errorf("error %q does not name %s", err, tag)
+		}
+	}
+	if strings.Count(stdout.String(), "\n") != 1 {
+		t.Errorf("stdout = %q, want only the signed image", stdout.String())
+	}
+}
+
+func TestNewVerifierFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		settingFile string
+		plugin      string
+		pluginArgs  []string
+	}{
+		{name: "neither"},
+		{name: "both", settingFile: "setting.json", plugin: "plugin"},
+		{name: "args without plugin", settingFile: "setting.json", pluginArgs: []string{"--key"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newVerifier(tc.settingFile, tc.plugin, tc.pluginArgs); err == nil {
+				t.Error("newVerifier accepted the flags")
+			}
+		})
+	}
+}
+
+func pushImage(t *testing.T, regs *testregistry.Registries, ref string) name.Tag {
+	t.Helper()
+	tag, err := name.NewTag(ref, registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag, img, regs.Options()...); err != nil {
+		t.Fatal(err)
+	}
+	return tag
+}
+
+// pushSignature attaches a referrer of tag whose single layer is data.
+func pushSignature(t *testing.T, regs *testregistry.Registries, tag name.Tag, data string) {
+	t.Helper()
+	subject, err := remote.Head(tag, regs.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := mutate.Append(empty.Image, mutate.Addendum{Layer: static.NewLayer([]byte(data), "application/vnd.test.signature")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig = mutate.MediaType(sig, types.OCIManifestSchema1)
+	sig = mutate.ConfigMediaType(sig, "application/vnd.oci.empty.v1+json")
+	sig = mutate.Subject(sig, v1.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size}).(v1.Image)
+	digest, err := sig.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag.Context().Digest(digest.String()), sig, regs.Options()...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func digestOf(t *testing.T, regs *testregistry.Registries, tag name.Tag) name.Digest {
+	t.Helper()
+	desc, err := remote.Head(tag, regs.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tag.Context().Digest(desc.Digest.String())
+}
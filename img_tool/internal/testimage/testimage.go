@@ -0,0 +1,158 @@
+// Package testimage builds the tar layers and OCI layouts that tests of the
+// commands reading images (img analyze, img diff, img flatten, img inspect,
+// img validate reproducible and the container structure test) and of the SBOM
+// collector take as input.
+package testimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// Epoch is the modification time of entries that set none, and the creation
+// time of the images written by WriteLayout.
+var Epoch = time.Unix(0, 0)
+
+// Entry is an entry of a tar layer. The zero values of its fields stand for
+// a regular file with mode 0644, modified at Epoch, in USTAR format, or PAX
+// format when it has PAX records.
+type Entry struct {
+	Name     string
+	Typeflag byte
+	// Content is the content of a file. Size gives the size of a file of
+	// zero bytes instead, when the content does not matter.
+	Content    string
+	Size       int64
+	Linkname   string
+	Mode       int64
+	Uid        int
+	ModTime    time.Time
+	PAXRecords map[string]string
+	Format     tar.Format
+}
+
+// Tar returns a tar archive of the entries, in order.
+func Tar(t testing.TB, entries []Entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := Header(entry)
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		content := []byte(entry.Content)
+		if entry.Content == "" {
+			content = make([]byte, hdr.Size)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Header returns the tar header Tar writes for entry, for tests that write
+// layers in formats other than tar from the same entries.
+func Header(entry Entry) *tar.Header {
+	hdr := &tar.Header{
+		Name:       entry.Name,
+		Typeflag:   entry.Typeflag,
+		Size:       entry.Size,
+		Linkname:   entry.Linkname,
+		Mode:       entry.Mode,
+		Uid:        entry.Uid,
+		ModTime:    entry.ModTime,
+		PAXRecords: entry.PAXRecords,
+		Format:     entry.Format,
+	}
+	if entry.Content != "" {
+		hdr.Size = int64(len(entry.Content))
+	}
+	if hdr.Typeflag == 0 {
+		hdr.Typeflag = tar.TypeReg
+	}
+	if hdr.Mode == 0 {
+		hdr.Mode = 0o644
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = Epoch
+	}
+	if hdr.Format == tar.FormatUnknown {
+		hdr.Format = tar.FormatUSTAR
+		if len(hdr.PAXRecords) > 0 {
+			hdr.Format = tar.FormatPAX
+		}
+	}
+	return hdr
+}
+
+// Layer returns a layer of the entries, gzip-compressed at level, so the
+// same entries at two levels give layers with the same diff ID and different
+// digests.
+func Layer(t testing.TB, entries []Entry, level int) v1.Layer {
+	t.Helper()
+	data := Tar(t, entries)
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}, tarball.WithCompressionLevel(level))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// WriteLayout writes a linux/amd64 OCI image of the layers, created at Epoch
+// and without history, to a new OCI layout and returns its directory.
+// configure, when not nil, edits the run config of the image first.
+func WriteLayout(t testing.TB, layers []v1.Layer, configure func(*v1.Config)) string {
+	t.Helper()
+	var addenda []mutate.Addendum
+	for _, layer := range layers {
+		addenda = append(addenda, mutate.Addendum{Layer: layer, MediaType: types.OCILayer})
+	}
+	image, err := mutate.Append(empty.Image, addenda...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile = configFile.DeepCopy()
+	configFile.OS = "linux"
+	configFile.Architecture = "amd64"
+	configFile.Created = v1.Time{Time: Epoch}
+	configFile.History = nil
+	if configure != nil {
+		configure(&configFile.Config)
+	}
+	image, err = mutate.ConfigFile(image, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image = mutate.MediaType(image, types.OCIManifestSchema1)
+
+	dir := t.TempDir()
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := path.AppendImage(image); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,89 @@
+// Package testregistry serves in-memory OCI registries to tests from an
+// http.RoundTripper, since the sandboxes the tests run in do not allow binding
+// a loopback port. Tests of commands and packages that talk to registries
+// share it.
+package testregistry
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// Registries serves one in-memory registry, with referrers support, per host
+// and records the digests of the blobs uploaded to each. Requests to other
+// hosts fail with 404.
+type Registries struct {
+	mu       sync.Mutex
+	handlers map[string]http.Handler
+	uploads  map[string][]string
+}
+
+// New returns a registry for each of hosts.
+func New(hosts ...string) *Registries {
+	r := &Registries{handlers: make(map[string]http.Handler), uploads: make(map[string][]string)}
+	for _, host := range hosts {
+		r.handlers[host] = registry.New(registry.Logger(log.New(io.Discard, "", 0)), registry.WithReferrersSupport(true))
+	}
+	return r
+}
+
+// RoundTrip serves the request from the registry of its host.
+func (r *Registries) RoundTrip(request *http.Request) (*http.Response, error) {
+	// Handlers may assume the server-side invariants that net/http would
+	// establish when reading the request off a connection.
+	served := request.Clone(request.Context())
+	if served.Body == nil {
+		served.Body = http.NoBody
+	}
+	if served.Host == "" {
+		served.Host = served.URL.Host
+	}
+	served.RequestURI = served.URL.RequestURI()
+	// Every upload ends with a PUT naming the digest of the blob, whether
+	// its content came in chunks before or with the PUT itself.
+	if strings.Contains(served.URL.Path, "/blobs/uploads/") && served.Method == http.MethodPut {
+		r.mu.Lock()
+		r.uploads[served.URL.Host] = append(r.uploads[served.URL.Host], served.URL.Query().Get("digest"))
+		r.mu.Unlock()
+	}
+
+	recorder := httptest.NewRecorder()
+	if handler, ok := r.handlers[served.URL.Host]; ok {
+		handler.ServeHTTP(recorder, served)
+	} else {
+		http.NotFound(recorder, served)
+	}
+	response := recorder.Result()
+	response.Request = request
+	return response, nil
+}
+
+// Uploads returns the digests of the blobs uploaded to host, in upload order.
+// Blobs mounted from another repository are not uploads.
+func (r *Registries) Uploads(host string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.uploads[host]...)
+}
+
+// ResetUploads forgets the uploads recorded so far, so a test can look at the
+// uploads of one step only.
+func (r *Registries) ResetUploads() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploads = make(map[string][]string)
+}
+
+// Options returns the default remote options, with requests served by r.
+func (r *Registries) Options() []remote.Option {
+	return registryopts.Default().WithTransport(r).Remote()
+}
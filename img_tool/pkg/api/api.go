@@ -28,6 +28,13 @@ const (
 	TarGzipLayer = "application/vnd.oci.image.layer.v1.tar+gzip"
 	TarZstdLayer = "application/vnd.oci.image.layer.v1.tar+zstd"
 
+	// EROFS layer formats, as written by `img flatten --layer-format erofs`.
+	// They are not part of the OCI image spec: only runtimes that mount EROFS
+	// layers directly can use images with these layers.
+	ErofsLayer     = "application/vnd.erofs.layer.v1"
+	ErofsGzipLayer = "application/vnd.erofs.layer.v1+gzip"
+	ErofsZstdLayer = "application/vnd.erofs.layer.v1+zstd"
+
 	// Config media types
 	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
 
@@ -65,11 +72,11 @@ func (h HashAlgorithm) Len() int {
 
 func (c LayerFormat) CompressionAlgorithm() CompressionAlgorithm {
 	switch c {
-	case TarLayer:
+	case TarLayer, ErofsLayer:
 		return Uncompressed
-	case TarGzipLayer:
+	case TarGzipLayer, ErofsGzipLayer:
 		return Gzip
-	case TarZstdLayer:
+	case TarZstdLayer, ErofsZstdLayer:
 		return Zstd
 	default:
 		return ""
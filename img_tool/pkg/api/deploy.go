@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 )
@@ -77,6 +79,62 @@ func (dm *DeployManifest) RegistryTagOperations() ([]IndexedRegistryTagDeployOpe
 	return ops, nil
 }
 
+func (dm *DeployManifest) RegistryUntagOperations() ([]IndexedRegistryUntagDeployOperation, error) {
+	var ops []IndexedRegistryUntagDeployOperation
+	for i, rawOp := range dm.Operations {
+		var baseOp BaseCommandOperation
+		if err := json.Unmarshal(rawOp, &baseOp); err != nil {
+			return nil, err
+		}
+		if baseOp.Command != "registry_untag" {
+			continue
+		}
+		var untagOp RegistryUntagDeployOperation
+		decoder := json.NewDecoder(bytes.NewReader(rawOp))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&untagOp); err != nil {
+			return nil, err
+		}
+		if err := untagOp.Validate(); err != nil {
+			return nil, fmt.Errorf("registry_untag operation %d: %w", i, err)
+		}
+		ops = append(ops, IndexedRegistryUntagDeployOperation{
+			I:                            i,
+			Strategy:                     dm.Settings.PushStrategy,
+			RegistryUntagDeployOperation: untagOp,
+		})
+	}
+	return ops, nil
+}
+
+func (dm *DeployManifest) CopyOperations() ([]IndexedCopyDeployOperation, error) {
+	var ops []IndexedCopyDeployOperation
+	for i, rawOp := range dm.Operations {
+		var baseOp BaseCommandOperation
+		if err := json.Unmarshal(rawOp, &baseOp); err != nil {
+			return nil, err
+		}
+		if baseOp.Command != "copy" {
+			continue
+		}
+		var copyOp CopyDeployOperation
+		decoder := json.NewDecoder(bytes.NewReader(rawOp))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&copyOp); err != nil {
+			return nil, err
+		}
+		if err := copyOp.Validate(); err != nil {
+			return nil, fmt.Errorf("copy operation %d: %w", i, err)
+		}
+		ops = append(ops, IndexedCopyDeployOperation{
+			I:                   i,
+			Strategy:            dm.Settings.PushStrategy,
+			CopyDeployOperation: copyOp,
+		})
+	}
+	return ops, nil
+}
+
 func (dm *DeployManifest) LoadOperations() ([]IndexedLoadDeployOperation, error) {
 	var ops []IndexedLoadDeployOperation
 	// for each raw operation, check if the command is "load" and unmarshal accordingly
@@ -160,6 +218,22 @@ type SignConfig struct {
 	Targets []string `json:"targets,omitempty"`
 }
 
+// ProvenanceConfig is the build invocation recorded in a push operation for its
+// SLSA provenance attestation. The deploy tool adds what only it knows -- the
+// pushed digest and destination -- and takes the resolved base image from the
+// operation's PullInfo.
+type ProvenanceConfig struct {
+	// BuilderID identifies the build platform that produced the image (the SLSA
+	// builder.id). The runtime --provenance_builder_id flag overrides it; when
+	// both are empty the deploy tool uses a generic rules_img builder ID.
+	BuilderID string `json:"builder_id,omitempty"`
+	// Target is the label of the Bazel target the deploy manifest was built for.
+	Target string `json:"target,omitempty"`
+	// Stamp holds the workspace status values (BUILD_SCM_REVISION, BUILD_USER,
+	// ...) of the build, when it was stamped.
+	Stamp map[string]string `json:"stamp,omitempty"`
+}
+
 // Values of BaseCommandOperation.DeduplicatedPush: whether `img deploy` may serve
 // an operation's layers by cross-mounting them, and what a refused mount means.
 const (
@@ -246,6 +320,10 @@ type PushDeployOperation struct {
 	// push (e.g. an SBOM). It lets the deploy tool decide whether the
 	// "referrers" sign target applies to this operation.
 	Referrer bool `json:"referrer,omitempty"`
+	// Provenance, when set, requests a SLSA provenance attestation of the pushed
+	// root, signed with the operation's sign_setting and attached as a referrer
+	// next to its signature. It is only honored together with Sign.
+	Provenance *ProvenanceConfig `json:"provenance,omitempty"`
 }
 
 type IndexedPushDeployOperation struct {
@@ -267,6 +345,144 @@ type IndexedRegistryTagDeployOperation struct {
 	RegistryTagDeployOperation
 }
 
+// Values of RegistryUntagDeployOperation.Order.
+const (
+	// UntagOrderCreated ranks tags by the creation time of the image they point
+	// at: the org.opencontainers.image.created annotation when set, else the
+	// image config's created field (for an index, that of its first image).
+	UntagOrderCreated = "created"
+	// UntagOrderTag ranks tags by the tag itself, compared lexically: the tag that
+	// sorts last is the newest. Meant for tags that embed a sortable build
+	// number or timestamp, and for images built reproducibly, which all carry the
+	// same creation time.
+	UntagOrderTag = "tag"
+)
+
+// RegistryUntagDeployOperation removes content from one repository: the
+// retention counterpart of push and registry_tag, so images published by a
+// deploy (per-pull-request previews, say) are cleaned up by the same tool.
+//
+// It deletes the union of
+//   - every tag in Tags,
+//   - the tags matching Match that the retention rules do not keep: with
+//     KeepLast, all but the KeepLast newest (ranked by Order); with OlderThan,
+//     those created before it; with both, the ones both rules give up; with
+//     neither, every matching tag,
+//   - every manifest in Digests, deleted by digest (which removes every tag
+//     pointing at it, where the registry supports deleting manifests).
+//
+// A tag written by a push or registry_tag operation of the same deploy is never
+// deleted, whatever the rules say.
+type RegistryUntagDeployOperation struct {
+	Command    string `json:"command"` // "registry_untag"
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	// Tags are tags deleted outright.
+	Tags []string `json:"tags,omitempty"`
+	// Match is a regular expression (RE2 syntax, matched against the whole tag)
+	// selecting the tags the retention rules apply to. Empty selects no tags.
+	Match string `json:"match,omitempty"`
+	// KeepLast keeps the KeepLast newest matching tags. Zero keeps none; nil
+	// leaves the decision to OlderThan.
+	KeepLast *int `json:"keep_last,omitempty"`
+	// OlderThan is an RFC 3339 timestamp: matching tags whose image was created
+	// before it are deleted. It is only meaningful with Order "created".
+	OlderThan string `json:"older_than,omitempty"`
+	// Order ranks the matching tags for KeepLast: UntagOrderCreated (the default)
+	// or UntagOrderTag.
+	Order string `json:"order,omitempty"`
+	// Digests are manifests deleted by digest.
+	Digests []string `json:"digests,omitempty"`
+	// BestEffort turns a failed deletion into a warning instead of failing the
+	// deploy.
+	BestEffort bool `json:"best_effort,omitempty"`
+}
+
+// Validate reports a misconfigured registry_untag operation.
+func (o RegistryUntagDeployOperation) Validate() error {
+	if o.Registry == "" || o.Repository == "" {
+		return fmt.Errorf("registry and repository are required")
+	}
+	if len(o.Tags) == 0 && o.Match == "" && len(o.Digests) == 0 {
+		return fmt.Errorf("nothing to delete: set tags, match or digests")
+	}
+	if o.Match == "" && (o.KeepLast != nil || o.OlderThan != "") {
+		return fmt.Errorf("keep_last and older_than apply to the tags selected by match, which is empty")
+	}
+	if o.Match != "" {
+		if _, err := regexp.Compile(o.Match); err != nil {
+			return fmt.Errorf("invalid match: %w", err)
+		}
+	}
+	if o.OlderThan != "" {
+		if _, err := time.Parse(time.RFC3339, o.OlderThan); err != nil {
+			return fmt.Errorf("invalid older_than: %w", err)
+		}
+	}
+	if o.KeepLast != nil && *o.KeepLast < 0 {
+		return fmt.Errorf("keep_last must not be negative, got %d", *o.KeepLast)
+	}
+	switch o.Order {
+	case "", UntagOrderCreated:
+	case UntagOrderTag:
+		if o.OlderThan != "" {
+			return fmt.Errorf("older_than needs order %q", UntagOrderCreated)
+		}
+	default:
+		return fmt.Errorf("invalid order %q: want %q or %q", o.Order, UntagOrderCreated, UntagOrderTag)
+	}
+	return nil
+}
+
+// CopyDeployOperation copies an image or index that already lives in a registry
+// -- a tested staging digest, say -- to the destination, with the referrers
+// hanging off it (signatures, SBOMs, SOCI indexes), instead of rebuilding it.
+// The manifest is copied byte for byte, so it keeps its digest.
+type CopyDeployOperation struct {
+	Command string `json:"command"` // "copy"
+	// Source is the image to copy, pinned by digest:
+	// registry/repository@sha256:...
+	Source     string   `json:"source"`
+	Registry   string   `json:"registry"`
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags,omitempty"`
+	// SkipReferrers copies the image or index alone.
+	SkipReferrers bool `json:"skip_referrers,omitempty"`
+}
+
+// Validate reports a misconfigured copy operation.
+func (o CopyDeployOperation) Validate() error {
+	if o.Registry == "" || o.Repository == "" {
+		return fmt.Errorf("registry and repository are required")
+	}
+	if _, err := o.SourceDigest(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SourceDigest parses Source, which must name a digest: a deploy copies exactly
+// what was tested, never whatever a tag points at by the time it runs.
+func (o CopyDeployOperation) SourceDigest(opts ...name.Option) (name.Digest, error) {
+	source, err := name.NewDigest(o.Source, opts...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("source %q must be a reference pinned by digest (registry/repository@sha256:...): %w", o.Source, err)
+	}
+	return source, nil
+}
+
+type IndexedCopyDeployOperation struct {
+	I        int
+	Strategy string
+	CopyDeployOperation
+}
+
+type IndexedRegistryUntagDeployOperation struct {
+	I        int
+	Strategy string
+	RegistryUntagDeployOperation
+}
+
 // LoadDeployOperation describes loading an image into a local daemon. It mirrors
 // PushTarget's Registry/Repository/Tags shape, but keeps every destination field
 // optional: when only Tags are set (the rules_oci-compatible mode) the tags are
@@ -257,3 +257,77 @@ func TestLoadDeployOperationOmitsEmptyDestination(t *testing.T) {
 		t.Fatalf("ImageNames() = %v", got)
 	}
 }
+
+func TestRegistryUntagOperations(t *testing.T) {
+	dm := DeployManifest{Operations: []json.RawMessage{
+		json.RawMessage(`{"command":"push","registry":"gcr.io","repository":"app","root":{"digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000"},"root_kind":"manifest"}`),
+		json.RawMessage(`{"command":"registry_untag","registry":"gcr.io","repository":"app","match":"pr-[0-9]+","keep_last":3}`),
+	}}
+	ops, err := dm.RegistryUntagOperations()
+	if err != nil {
+		t.Fatalf("RegistryUntagOperations: %v", err)
+	}
+	if len(ops) != 1 || ops[0].I != 1 || ops[0].Match != "pr-[0-9]+" || ops[0].KeepLast == nil || *ops[0].KeepLast != 3 {
+		t.Fatalf("RegistryUntagOperations = %+v", ops)
+	}
+
+	dm.Operations[1] = json.RawMessage(`{"command":"registry_untag","registry":"gcr.io","repository":"app","keep":3}`)
+	if _, err := dm.RegistryUntagOperations(); err == nil {
+		t.Fatal("RegistryUntagOperations accepted an unknown field")
+	}
+}
+
+func TestValidateRegistryUntagOperation(t *testing.T) {
+	keep := func(n int) *int { return &n }
+	for _, tc := range []struct {
+		name    string
+		op      RegistryUntagDeployOperation
+		wantErr bool
+	}{
+		{name: "explicit tags", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Tags: []string{"old"}}},
+		{name: "digests", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Digests: []string{"sha256:abcd"}}},
+		{name: "keep last", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Match: "pr-.*", KeepLast: keep(5)}},
+		{name: "older than", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Match: "pr-.*", OlderThan: "2026-01-01T00:00:00Z"}},
+		{name: "tag order", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Match: "build-.*", KeepLast: keep(1), Order: UntagOrderTag}},
+		{name: "no destination", op: RegistryUntagDeployOperation{Tags: []string{"old"}}, wantErr: true},
+		{name: "nothing to delete", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app"}, wantErr: true},
+		{name: "rule without match", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Tags: []string{"old"}, KeepLast: keep(1)}, wantErr: true},
+		{name: "negative keep last", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Match: "pr-.*", KeepLast: keep(-1)}, wantErr: true},
+		{name: "invalid match", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Match: "pr-("}, wantErr: true},
+		{name: "invalid older than", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Match: "pr-.*", OlderThan: "last week"}, wantErr: true},
+		{name: "older than by tag", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Match: "pr-.*", OlderThan: "2026-01-01T00:00:00Z", Order: UntagOrderTag}, wantErr: true},
+		{name: "unknown order", op: RegistryUntagDeployOperation{Registry: "gcr.io", Repository: "app", Match: "pr-.*", KeepLast: keep(1), Order: "size"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.op.Validate(); (err != nil) != tc.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopyOperations(t *testing.T) {
+	const source = "staging.example.com/app@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	dm := DeployManifest{Operations: []json.RawMessage{
+		json.RawMessage(`{"command":"registry_tag","registry":"gcr.io","repository":"app","tags":["v1"],"root":{"digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000"},"root_kind":"manifest"}`),
+		json.RawMessage(`{"command":"copy","source":"` + source + `","registry":"gcr.io","repository":"app","tags":["v1"],"skip_referrers":true}`),
+	}}
+	ops, err := dm.CopyOperations()
+	if err != nil {
+		t.Fatalf("CopyOperations: %v", err)
+	}
+	if len(ops) != 1 || ops[0].I != 1 || ops[0].Source != source || !ops[0].SkipReferrers {
+		t.Fatalf("CopyOperations = %+v", ops)
+	}
+
+	for _, raw := range []string{
+		`{"command":"copy","source":"staging.example.com/app:candidate","registry":"gcr.io","repository":"app"}`,
+		`{"command":"copy","source":"` + source + `","registry":"gcr.io"}`,
+		`{"command":"copy","source":"` + source + `","registry":"gcr.io","repository":"app","referrers":false}`,
+	} {
+		dm.Operations[1] = json.RawMessage(raw)
+		if _, err := dm.CopyOperations(); err == nil {
+			t.Errorf("CopyOperations accepted %s", raw)
+		}
+	}
+}
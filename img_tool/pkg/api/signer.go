@@ -21,3 +21,66 @@ type OCIArtifactSigner interface {
 	// to a registry.
 	Sign(ctx context.Context, subject v1.Descriptor) (v1.Image, error)
 }
+
+// DSSESigner is implemented by signers that can also sign an arbitrary DSSE
+// payload about a subject, such as an in-toto Statement carrying SLSA
+// provenance. The payload is signed as given: the signer wraps it in a DSSE
+// envelope of payloadType and returns an OCI artifact whose subject field links
+// it to subject. Signers that only sign bare digests do not implement it.
+type DSSESigner interface {
+	SignDSSE(ctx context.Context, subject v1.Descriptor, payloadType string, payload []byte) (v1.Image, error)
+}
+
+// DSSEPayloadRequest is what `img deploy` writes to a signer plugin's stdin for
+// the sign-dsse-payload verb: the subject the attestation is about and the
+// payload to wrap in a DSSE envelope. Payload is base64-encoded in JSON.
+type DSSEPayloadRequest struct {
+	Subject     v1.Descriptor `json:"subject"`
+	PayloadType string        `json:"payloadType"`
+	Payload     []byte        `json:"payload"`
+}
+
+// OCIArtifactVerifier is the verifying counterpart of OCIArtifactSigner: it
+// decides whether one of the referrer artifacts of a subject is a valid
+// signature of it. `img verify` and the verification pre-flight of
+// `img deploy` carry one implementation, which delegates to the same external
+// signer plugin that signs (see img_tool/pkg/signer).
+type OCIArtifactVerifier interface {
+	// Verify checks artifacts, the referrers of subject, for a signature the
+	// verifier trusts. A subject without such a signature is not an error: the
+	// result says so, with a reason. Errors are reserved for a verifier that
+	// could not do its job (a missing key, a plugin that crashed).
+	Verify(ctx context.Context, subject v1.Descriptor, artifacts []v1.Image) (VerifyResult, error)
+}
+
+// VerifyRequest is what `img` writes to a signer plugin's stdin for the
+// verify-oci-artifact verb: the subject and the candidate signature artifacts
+// found among its referrers.
+type VerifyRequest struct {
+	Subject   v1.Descriptor    `json:"subject"`
+	Artifacts []VerifyArtifact `json:"artifacts"`
+}
+
+// VerifyArtifact is one referrer handed to a plugin for verification: its
+// manifest verbatim and the blobs (config and layers) it references, keyed by
+// digest. Manifest and blobs are base64-encoded in JSON.
+type VerifyArtifact struct {
+	Descriptor v1.Descriptor     `json:"descriptor"`
+	Manifest   []byte            `json:"manifest"`
+	Blobs      map[string][]byte `json:"blobs,omitempty"`
+}
+
+// VerifyResult is what a signer plugin writes to stdout for the
+// verify-oci-artifact verb.
+type VerifyResult struct {
+	// Verified is true when at least one artifact is a valid signature of the
+	// subject by a trusted signer.
+	Verified bool `json:"verified"`
+	// Artifact is the digest of the referrer whose signature verified.
+	Artifact string `json:"artifact,omitempty"`
+	// Identity names the signer as the plugin knows it: a certificate subject,
+	// a key fingerprint.
+	Identity string `json:"identity,omitempty"`
+	// Reason says why nothing verified.
+	Reason string `json:"reason,omitempty"`
+}
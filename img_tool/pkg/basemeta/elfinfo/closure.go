@@ -0,0 +1,408 @@
+package elfinfo
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxSymlinkHops bounds symlink resolution inside a sysroot, like the kernel's
+// limit of 40 bounds it on a live system.
+const maxSymlinkHops = 40
+
+// Sysroot is the root filesystem the libraries of a closure are taken from: a
+// directory laid out like the image, loose files keyed by their path in the
+// image (as extracted from packages), or both.
+type Sysroot struct {
+	// Dirs are directories holding a root filesystem, searched in order.
+	// Symlinks inside them resolve relative to the directory, the way they
+	// would inside the image.
+	Dirs []string
+	// Files maps absolute image paths to the host files holding them. Files
+	// are looked up before Dirs.
+	Files map[string]string
+}
+
+// resolve finds the file at an absolute image path, following symlinks inside
+// the sysroot. It returns the host path of the file and its image path with
+// symlinks resolved.
+func (s Sysroot) resolve(imagePath string) (hostPath, resolvedPath string, ok bool) {
+	imagePath = path.Clean("/" + imagePath)
+	if host, found := s.Files[imagePath]; found {
+		return host, imagePath, true
+	}
+	for _, dir := range s.Dirs {
+		if resolved, found := resolveInDir(dir, imagePath); found {
+			return filepath.Join(dir, filepath.FromSlash(resolved)), resolved, true
+		}
+	}
+	return "", "", false
+}
+
+// resolveInDir resolves imagePath component by component inside root, so that
+// an absolute symlink target (say /lib -> /usr/lib) stays inside root instead
+// of escaping to the host's filesystem. It reports whether a regular file is
+// at the end.
+func resolveInDir(root, imagePath string) (string, bool) {
+	pending := strings.Split(strings.TrimPrefix(imagePath, "/"), "/")
+	resolved := "/"
+	for hops := 0; len(pending) > 0; {
+		component := pending[0]
+		pending = pending[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil {
+			return "", false
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", false
+		}
+		target, err := os.Readlink(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil {
+			return "", false
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	info, err := os.Stat(filepath.Join(root, filepath.FromSlash(resolved)))
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return resolved, true
+}
+
+// Object is an ELF file whose dependencies a closure covers.
+type Object struct {
+	// HostPath is the file to read.
+	HostPath string
+	// Path is where the object lives in the image. It expands $ORIGIN in the
+	// object's search paths; leave it empty when unknown, and $ORIGIN entries
+	// are skipped.
+	Path string
+}
+
+// Library is one shared object of a closure.
+type Library struct {
+	// Path is where the library lives in the sysroot, symlinks resolved, e.g.
+	// "/usr/lib/x86_64-linux-gnu/libc.so.6".
+	Path string
+	// HostPath is the file holding it.
+	HostPath string
+	// Info is its ELF metadata.
+	Info Info
+}
+
+// Closure is the set of shared objects a dynamic linker loads for a group of
+// executables.
+type Closure struct {
+	// Interpreters are the dynamic linkers the executables name, keyed by
+	// their PT_INTERP path. Static executables contribute none.
+	Interpreters map[string]Library
+	// Libraries are the shared libraries loaded, sorted by Path. Neither the
+	// roots nor the interpreters are among them.
+	Libraries []Library
+}
+
+// Unresolved is a dependency no directory of the search path holds.
+type Unresolved struct {
+	// Name is the DT_NEEDED entry.
+	Name string
+	// NeededBy lists the objects asking for it.
+	NeededBy []string
+	// Searched lists the image directories looked in, in order.
+	Searched []string
+}
+
+// UnresolvedError reports the dependencies of a closure that could not be
+// found, all of them at once so that a missing package is fixed in one go.
+type UnresolvedError struct {
+	Missing []Unresolved
+}
+
+func (e *UnresolvedError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d shared libraries could not be resolved in the sysroot:", len(e.Missing))
+	for _, missing := range e.Missing {
+		fmt.Fprintf(&sb, "\n  %s, needed by %s", missing.Name, strings.Join(missing.NeededBy, ", "))
+		if len(missing.Searched) > 0 {
+			fmt.Fprintf(&sb, "\n    searched %s", strings.Join(missing.Searched, ":"))
+		}
+	}
+	return sb.String()
+}
+
+// multiarchTuples are the Debian multiarch directories glibc searches per
+// machine, before the plain library directories.
+var multiarchTuples = map[elf.Machine]string{
+	elf.EM_386:     "i386-linux-gnu",
+	elf.EM_X86_64:  "x86_64-linux-gnu",
+	elf.EM_ARM:     "arm-linux-gnueabihf",
+	elf.EM_AARCH64: "aarch64-linux-gnu",
+	elf.EM_MIPS:    "mips64el-linux-gnuabi64",
+	elf.EM_PPC64:   "powerpc64le-linux-gnu",
+	elf.EM_RISCV:   "riscv64-linux-gnu",
+	elf.EM_S390:    "s390x-linux-gnu",
+}
+
+// DefaultSearchPath is where the dynamic linker of a typical distribution
+// looks for an object's dependencies after its RPATH and RUNPATH: the
+// multiarch directories Debian and Ubuntu use, the lib64 directories of
+// Fedora and SUSE on 64-bit machines, and the plain ones.
+func DefaultSearchPath(info Info) []string {
+	var dirs []string
+	if tuple, ok := multiarchTuples[info.Machine]; ok {
+		dirs = append(dirs, "/lib/"+tuple, "/usr/lib/"+tuple)
+	}
+	if info.Class == 64 {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+	return append(dirs, "/lib", "/usr/lib")
+}
+
+// Resolve computes the shared library closure of the roots: every library the
+// dynamic linker loads, transitively, when running them, and the dynamic
+// linker itself.
+//
+// Dependencies are looked up the way glibc's ld.so does, minus the loader
+// cache: a name some loaded object already carries (as its SONAME or file
+// name) is satisfied by it; otherwise the requesting object's DT_RPATH (when
+// it has no DT_RUNPATH), its DT_RUNPATH, and then searchPath are tried in
+// order, skipping candidates of another ELF class or machine. searchPath
+// defaults to DefaultSearchPath of each requesting object.
+//
+// Roots are typically executables, but may include libraries the image gets
+// anyway (a plugin loaded with dlopen, say): their names satisfy dependencies
+// and their own dependencies are followed.
+//
+// Every dependency that cannot be found is collected into an
+// *UnresolvedError rather than failing on the first.
+func Resolve(roots []Object, sysroot Sysroot, searchPath []string) (*Closure, error) {
+	r := &resolver{
+		sysroot:    sysroot,
+		searchPath: searchPath,
+		provided:   make(map[string]bool),
+		libraries:  make(map[string]*Library),
+		missing:    make(map[string]*Unresolved),
+		closure:    &Closure{Interpreters: make(map[string]Library)},
+	}
+
+	type pending struct {
+		info     Info
+		path     string // image path, "" when unknown
+		describe string // how the object is named in error messages
+	}
+	var queue []pending
+	for _, root := range roots {
+		info, err := Read(root.HostPath)
+		if err != nil {
+			return nil, err
+		}
+		r.provide(info, root.Path)
+		describe := root.Path
+		if describe == "" {
+			describe = root.HostPath
+		}
+		queue = append(queue, pending{info, root.Path, describe})
+	}
+	// The interpreter is loaded before anything else, and libc names it as a
+	// dependency by its SONAME, which it must satisfy.
+	for _, root := range queue {
+		interp := root.info.Interpreter
+		if interp == "" {
+			continue
+		}
+		if _, done := r.closure.Interpreters[interp]; done {
+			continue
+		}
+		hostPath, resolved, ok := sysroot.resolve(interp)
+		if !ok {
+			r.addMissing(interp, root.describe, nil)
+			continue
+		}
+		info, err := Read(hostPath)
+		if err != nil {
+			return nil, err
+		}
+		r.closure.Interpreters[interp] = Library{Path: resolved, HostPath: hostPath, Info: info}
+		r.provide(info, interp)
+		r.provide(info, resolved)
+	}
+
+	for len(queue) > 0 {
+		object := queue[0]
+		queue = queue[1:]
+		for _, name := range object.info.Needed {
+			if r.provided[name] {
+				continue
+			}
+			library, searched, err := r.find(name, object.info, object.path)
+			if err != nil {
+				return nil, err
+			}
+			if library == nil {
+				r.addMissing(name, object.describe, searched)
+				continue
+			}
+			r.provided[name] = true
+			if _, seen := r.libraries[library.Path]; seen {
+				continue
+			}
+			r.libraries[library.Path] = library
+			r.provide(library.Info, library.Path)
+			queue = append(queue, pending{library.Info, library.Path, library.Path})
+		}
+	}
+
+	for _, library := range r.libraries {
+		r.closure.Libraries = append(r.closure.Libraries, *library)
+	}
+	sort.Slice(r.closure.Libraries, func(i, j int) bool { return r.closure.Libraries[i].Path < r.closure.Libraries[j].Path })
+
+	if len(r.missingOrder) > 0 {
+		err := &UnresolvedError{}
+		for _, name := range r.missingOrder {
+			err.Missing = append(err.Missing, *r.missing[name])
+		}
+		return r.closure, err
+	}
+	return r.closure, nil
+}
+
+// resolver holds the state of one Resolve call.
+type resolver struct {
+	sysroot    Sysroot
+	searchPath []string
+	// provided holds the names loaded objects answer to.
+	provided map[string]bool
+	// libraries are the resolved libraries by resolved image path.
+	libraries map[string]*Library
+	// missing collects unresolved dependencies by name, in the order first
+	// seen.
+	missing      map[string]*Unresolved
+	missingOrder []string
+	closure      *Closure
+}
+
+// provide records the names a loaded object satisfies dependencies by.
+func (r *resolver) provide(info Info, imagePath string) {
+	if info.SONAME != "" {
+		r.provided[info.SONAME] = true
+	}
+	if imagePath != "" {
+		r.provided[path.Base(imagePath)] = true
+	}
+}
+
+func (r *resolver) addMissing(name, neededBy string, searched []string) {
+	missing, ok := r.missing[name]
+	if !ok {
+		missing = &Unresolved{Name: name, Searched: searched}
+		r.missing[name] = missing
+		r.missingOrder = append(r.missingOrder, name)
+	}
+	missing.NeededBy = append(missing.NeededBy, neededBy)
+}
+
+// find looks up a dependency of an object, returning the library found or
+// nil and the directories searched.
+func (r *resolver) find(name string, requester Info, requesterPath string) (*Library, []string, error) {
+	if strings.Contains(name, "/") {
+		// A dependency with a slash is a path and is not searched for. Only
+		// absolute ones mean anything inside an image.
+		if !path.IsAbs(name) {
+			return nil, nil, nil
+		}
+		library, err := r.candidate(name, requester)
+		return library, nil, err
+	}
+
+	var dirs []string
+	if len(requester.RunPath) == 0 {
+		dirs = append(dirs, r.expand(requester.RPath, requester, requesterPath)...)
+	}
+	dirs = append(dirs, r.expand(requester.RunPath, requester, requesterPath)...)
+	if len(r.searchPath) > 0 {
+		dirs = append(dirs, r.searchPath...)
+	} else {
+		dirs = append(dirs, DefaultSearchPath(requester)...)
+	}
+
+	for _, dir := range dirs {
+		library, err := r.candidate(path.Join(dir, name), requester)
+		if err != nil {
+			return nil, nil, err
+		}
+		if library != nil {
+			return library, dirs, nil
+		}
+	}
+	return nil, dirs, nil
+}
+
+// candidate returns the library at an image path if it exists in the sysroot
+// and suits the requester's class and machine.
+func (r *resolver) candidate(imagePath string, requester Info) (*Library, error) {
+	hostPath, resolved, ok := r.sysroot.resolve(imagePath)
+	if !ok {
+		return nil, nil
+	}
+	if library, seen := r.libraries[resolved]; seen {
+		return library, nil
+	}
+	info, err := Read(hostPath)
+	if err != nil {
+		// The dynamic linker skips files that are not ELF objects too (a
+		// linker script named libc.so, say).
+		return nil, nil
+	}
+	if info.Class != requester.Class || info.Machine != requester.Machine {
+		return nil, nil
+	}
+	return &Library{Path: resolved, HostPath: hostPath, Info: info}, nil
+}
+
+// expand substitutes the dynamic string tokens in search directories.
+// $ORIGIN is the directory of the requesting object and $LIB its library
+// directory name; entries using $ORIGIN of an object whose image path is
+// unknown, or $PLATFORM, are skipped.
+func (r *resolver) expand(dirs []string, requester Info, requesterPath string) []string {
+	lib := "lib"
+	if requester.Class == 64 {
+		lib = "lib64"
+	}
+	var expanded []string
+	for _, dir := range dirs {
+		if strings.Contains(dir, "PLATFORM") {
+			continue
+		}
+		if strings.Contains(dir, "ORIGIN") {
+			if requesterPath == "" {
+				continue
+			}
+			origin := path.Dir(requesterPath)
+			dir = strings.NewReplacer("${ORIGIN}", origin, "$ORIGIN", origin).Replace(dir)
+		}
+		dir = strings.NewReplacer("${LIB}", lib, "$LIB", lib).Replace(dir)
+		if path.IsAbs(dir) {
+			expanded = append(expanded, path.Clean(dir))
+		}
+	}
+	return expanded
+}
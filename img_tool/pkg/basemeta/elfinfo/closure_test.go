@@ -0,0 +1,142 @@
+package elfinfo
+
+import (
+	"debug/elf"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSysroot lays out files, and symlinks to the given targets, under a
+// temporary root.
+func writeSysroot(t *testing.T, files map[string][]byte, links map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, data := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// TestResolve checks a usr-merged glibc sysroot: the interpreter is found
+// through the absolute /lib64 symlink without escaping the sysroot, libc's
+// dependency on the interpreter is satisfied by it, a SONAME symlink resolves
+// to the real file, transitive dependencies are followed, and a library of the
+// wrong machine is skipped in favour of a later directory.
+func TestResolve(t *testing.T) {
+	const multiarch = "usr/lib/x86_64-linux-gnu/"
+	root := writeSysroot(t, map[string][]byte{
+		"usr/lib64/ld-linux-x86-64.so.2":  buildObject(t, object{soname: "ld-linux-x86-64.so.2"}),
+		multiarch + "libc.so.6":           buildObject(t, object{soname: "libc.so.6", needed: []string{"ld-linux-x86-64.so.2"}, interpreter: "/lib64/ld-linux-x86-64.so.2"}),
+		multiarch + "libssl.so.3":         buildObject(t, object{soname: "libssl.so.3", needed: []string{"libcrypto.so.3", "libc.so.6"}}),
+		multiarch + "libcrypto.so.3.0.14": buildObject(t, object{soname: "libcrypto.so.3", needed: []string{"libc.so.6"}}),
+		multiarch + "libz.so.1":           buildObject(t, object{soname: "libz.so.1", machine: elf.EM_AARCH64}),
+		"usr/lib/libz.so.1":               buildObject(t, object{soname: "libz.so.1", needed: []string{"libc.so.6"}}),
+	}, map[string]string{
+		"lib":                        "usr/lib",
+		"lib64":                      "/usr/lib64",
+		multiarch + "libcrypto.so.3": "libcrypto.so.3.0.14",
+	})
+	app := writeTemp(t, "app", buildObject(t, object{
+		needed:      []string{"libssl.so.3", "libz.so.1", "libc.so.6"},
+		interpreter: "/lib64/ld-linux-x86-64.so.2",
+	}))
+
+	closure, err := Resolve([]Object{{HostPath: app}}, Sysroot{Dirs: []string{root}}, nil)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	interp, ok := closure.Interpreters["/lib64/ld-linux-x86-64.so.2"]
+	if !ok || interp.Path != "/usr/lib64/ld-linux-x86-64.so.2" || interp.HostPath != filepath.Join(root, "usr/lib64/ld-linux-x86-64.so.2") {
+		t.Errorf("Interpreters = %+v", closure.Interpreters)
+	}
+	var paths []string
+	for _, library := range closure.Libraries {
+		paths = append(paths, library.Path)
+	}
+	want := []string{
+		"/usr/lib/libz.so.1",
+		"/usr/lib/x86_64-linux-gnu/libc.so.6",
+		"/usr/lib/x86_64-linux-gnu/libcrypto.so.3.0.14",
+		"/usr/lib/x86_64-linux-gnu/libssl.so.3",
+	}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Errorf("Libraries = %v, want %v", paths, want)
+	}
+}
+
+// TestResolveUnresolved checks that every missing dependency is reported at
+// once, with who needs it and where it was looked for, and that $ORIGIN
+// expands against the image path of the requesting object, including one
+// taken from the loose files of a sysroot.
+func TestResolveUnresolved(t *testing.T) {
+	plugin := writeTemp(t, "libplugin.so", buildObject(t, object{soname: "libplugin.so", needed: []string{"libgone.so.2"}, runpath: "$ORIGIN"}))
+	app := writeTemp(t, "app", buildObject(t, object{
+		needed:  []string{"libplugin.so", "libmissing.so.1"},
+		runpath: "$ORIGIN/../lib:$PLATFORM/x",
+	}))
+	sysroot := Sysroot{Files: map[string]string{"/opt/app/lib/libplugin.so": plugin}}
+
+	closure, err := Resolve([]Object{{HostPath: app, Path: "/opt/app/bin/app"}}, sysroot, []string{"/usr/lib"})
+	var unresolved *UnresolvedError
+	if !errors.As(err, &unresolved) {
+		t.Fatalf("Resolve error = %v, want an UnresolvedError", err)
+	}
+	if len(closure.Libraries) != 1 || closure.Libraries[0].Path != "/opt/app/lib/libplugin.so" {
+		t.Errorf("Libraries = %+v, want the plugin", closure.Libraries)
+	}
+	if len(unresolved.Missing) != 2 {
+		t.Fatalf("Missing = %+v, want two", unresolved.Missing)
+	}
+	missing, gone := unresolved.Missing[0], unresolved.Missing[1]
+	if missing.Name != "libmissing.so.1" || strings.Join(missing.NeededBy, ",") != "/opt/app/bin/app" || strings.Join(missing.Searched, ":") != "/opt/app/lib:/usr/lib" {
+		t.Errorf("Missing[0] = %+v", missing)
+	}
+	if gone.Name != "libgone.so.2" || strings.Join(gone.NeededBy, ",") != "/opt/app/lib/libplugin.so" {
+		t.Errorf("Missing[1] = %+v", gone)
+	}
+	for _, want := range []string{"libmissing.so.1, needed by /opt/app/bin/app", "searched /opt/app/lib:/usr/lib", "libgone.so.2"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+// TestResolveRootsProvide checks that a root library satisfies dependencies
+// by its SONAME without being searched for, and that its own dependencies are
+// followed.
+func TestResolveRootsProvide(t *testing.T) {
+	root := writeSysroot(t, map[string][]byte{
+		"usr/lib/libc.so.6": buildObject(t, object{soname: "libc.so.6"}),
+	}, nil)
+	custom := writeTemp(t, "libcustom.so.1.0", buildObject(t, object{soname: "libcustom.so.1", needed: []string{"libc.so.6"}}))
+	app := writeTemp(t, "app", buildObject(t, object{needed: []string{"libcustom.so.1"}}))
+
+	closure, err := Resolve([]Object{{HostPath: app}, {HostPath: custom, Path: "/usr/lib/libcustom.so.1.0"}}, Sysroot{Dirs: []string{root}}, nil)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(closure.Libraries) != 1 || closure.Libraries[0].Path != "/usr/lib/libc.so.6" {
+		t.Errorf("Libraries = %+v, want only libc", closure.Libraries)
+	}
+	if len(closure.Interpreters) != 0 {
+		t.Errorf("Interpreters = %+v, want none", closure.Interpreters)
+	}
+}
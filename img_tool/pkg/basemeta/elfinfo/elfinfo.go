@@ -1,10 +1,12 @@
 // Package elfinfo reads the few pieces of ELF metadata a base image needs from
-// a shared library: its SONAME and its machine type.
+// a shared library or executable: its SONAME, its machine type, and what the
+// dynamic linker will look for when loading it.
 package elfinfo
 
 import (
 	"debug/elf"
 	"fmt"
+	"strings"
 )
 
 // Info describes a shared object.
@@ -16,8 +18,25 @@ type Info struct {
 	Class int
 	// Machine is the ELF machine type, used to tag entries in an ld.so cache.
 	Machine elf.Machine
+	// Needed lists the DT_NEEDED entries, the libraries the object asks the
+	// dynamic linker to load, in the order the linker loads them.
+	Needed []string
+	// RPath and RunPath are the DT_RPATH and DT_RUNPATH search directories,
+	// unexpanded: they may hold $ORIGIN and the other dynamic string tokens.
+	RPath   []string
+	RunPath []string
+	// Interpreter is the PT_INTERP path of the dynamic linker, e.g.
+	// "/lib64/ld-linux-x86-64.so.2". Empty for static executables and for most
+	// libraries.
+	Interpreter string
 }
 
+// maxInterpreterLen bounds the PT_INTERP segment, whose size comes from the
+// file itself. It is PATH_MAX: the kernel refuses to exec a binary whose
+// interpreter path is longer, and a larger size only means a malformed file
+// trying to make Read allocate gigabytes.
+const maxInterpreterLen = 4096
+
 // Read returns the ELF metadata of the shared object at path.
 func Read(path string) (Info, error) {
 	f, err := elf.Open(path)
@@ -34,11 +53,54 @@ func Read(path string) (Info, error) {
 	if err == nil && len(sonames) > 0 {
 		soname = sonames[0]
 	}
+	// The same goes for the other dynamic entries: a static executable has no
+	// .dynamic section at all.
+	needed, _ := f.DynString(elf.DT_NEEDED)
+	rpath, _ := f.DynString(elf.DT_RPATH)
+	runpath, _ := f.DynString(elf.DT_RUNPATH)
+
+	var interpreter string
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		if prog.Filesz > maxInterpreterLen {
+			return Info{}, fmt.Errorf("%s: PT_INTERP is %d bytes, longer than the %d bytes of a path", path, prog.Filesz, maxInterpreterLen)
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return Info{}, fmt.Errorf("%s: reading PT_INTERP: %w", path, err)
+		}
+		interpreter = strings.TrimRight(string(data), "\x00")
+	}
 
 	class := 64
 	if f.Class == elf.ELFCLASS32 {
 		class = 32
 	}
 
-	return Info{SONAME: soname, Class: class, Machine: f.Machine}, nil
+	return Info{
+		SONAME:      soname,
+		Class:       class,
+		Machine:     f.Machine,
+		Needed:      needed,
+		RPath:       splitSearchPath(rpath),
+		RunPath:     splitSearchPath(runpath),
+		Interpreter: interpreter,
+	}, nil
+}
+
+// splitSearchPath splits colon-separated DT_RPATH or DT_RUNPATH values into
+// their directories. An empty element means the current directory to the
+// dynamic linker, which never makes sense in an image, so it is dropped.
+func splitSearchPath(values []string) []string {
+	var dirs []string
+	for _, value := range values {
+		for _, dir := range strings.Split(value, ":") {
+			if dir != "" {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
 }
@@ -6,16 +6,39 @@ import (
 	"encoding/binary"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// object describes the ELF file buildObject assembles.
+type object struct {
+	soname      string
+	needed      []string
+	rpath       string
+	runpath     string
+	interpreter string
+	// interpreterSize overrides the size the PT_INTERP header claims, to
+	// build a malformed object.
+	interpreterSize uint64
+	machine         elf.Machine
+}
+
 // buildSharedObject assembles a minimal but well-formed 64-bit little-endian
 // ELF shared object whose .dynamic section carries a DT_SONAME.
+func buildSharedObject(t *testing.T, soname string) []byte {
+	t.Helper()
+	return buildObject(t, object{soname: soname})
+}
+
+// buildObject assembles a minimal but well-formed 64-bit little-endian ELF
+// object: a .dynamic section with the object's SONAME, DT_NEEDED, DT_RPATH and
+// DT_RUNPATH entries, and a PT_INTERP segment when it names an interpreter.
 //
 // Writing the bytes by hand keeps the test hermetic: it needs no cross
-// toolchain and no checked-in binary fixture, and it exercises exactly the two
-// structures Read cares about (the ELF header and the dynamic section).
-func buildSharedObject(t *testing.T, soname string) []byte {
+// toolchain and no checked-in binary fixture, and it exercises exactly the
+// structures Read cares about (the ELF header, the program headers and the
+// dynamic section).
+func buildObject(t *testing.T, o object) []byte {
 	t.Helper()
 
 	const (
@@ -23,25 +46,52 @@ func buildSharedObject(t *testing.T, soname string) []byte {
 		phdrSize = 56
 		shdrSize = 64
 	)
+	machine := o.machine
+	if machine == 0 {
+		machine = elf.EM_X86_64
+	}
 
-	// Layout: ELF header, one program header, the .dynstr and .dynamic section
-	// contents, then the section headers.
-	dynstrOff := uint64(ehdrSize + phdrSize)
-	// .dynstr starts with the mandatory empty string, then the SONAME.
-	dynstr := append([]byte{0}, append([]byte(soname), 0)...)
-	sonameIndex := uint64(1)
-
-	dynamicOff := dynstrOff + uint64(len(dynstr))
+	// .dynstr starts with the mandatory empty string.
+	dynstr := []byte{0}
+	addString := func(s string) uint64 {
+		index := uint64(len(dynstr))
+		dynstr = append(dynstr, append([]byte(s), 0)...)
+		return index
+	}
 	var dynamic bytes.Buffer
 	writeDyn := func(tag elf.DynTag, val uint64) {
 		binary.Write(&dynamic, binary.LittleEndian, uint64(tag))
 		binary.Write(&dynamic, binary.LittleEndian, val)
 	}
-	writeDyn(elf.DT_SONAME, sonameIndex)
+	if o.soname != "" {
+		writeDyn(elf.DT_SONAME, addString(o.soname))
+	}
+	for _, needed := range o.needed {
+		writeDyn(elf.DT_NEEDED, addString(needed))
+	}
+	if o.rpath != "" {
+		writeDyn(elf.DT_RPATH, addString(o.rpath))
+	}
+	if o.runpath != "" {
+		writeDyn(elf.DT_RUNPATH, addString(o.runpath))
+	}
 	writeDyn(elf.DT_NULL, 0)
+	var interp []byte
+	if o.interpreter != "" {
+		interp = append([]byte(o.interpreter), 0)
+	}
 
-	shoff := dynamicOff + uint64(dynamic.Len())
-	shstrOff := shoff
+	// Layout: ELF header, the program headers, the interpreter path, the
+	// .dynstr and .dynamic section contents, the section name table, then the
+	// section headers.
+	phnum := 1
+	if interp != nil {
+		phnum = 2
+	}
+	interpOff := uint64(ehdrSize + phdrSize*phnum)
+	dynstrOff := interpOff + uint64(len(interp))
+	dynamicOff := dynstrOff + uint64(len(dynstr))
+	shstrOff := dynamicOff + uint64(dynamic.Len())
 	// Section name string table: "", ".dynstr", ".dynamic", ".shstrtab".
 	var shstr bytes.Buffer
 	shstr.WriteByte(0)
@@ -51,7 +101,7 @@ func buildSharedObject(t *testing.T, soname string) []byte {
 	shstr.WriteString(".dynamic\x00")
 	shstrNameIdx := uint32(shstr.Len())
 	shstr.WriteString(".shstrtab\x00")
-	shoff = shstrOff + uint64(shstr.Len())
+	shoff := shstrOff + uint64(shstr.Len())
 
 	var out bytes.Buffer
 
@@ -63,7 +113,7 @@ func buildSharedObject(t *testing.T, soname string) []byte {
 	out.WriteByte(byte(elf.ELFOSABI_NONE))
 	out.Write(make([]byte, 8)) // ABI version + padding
 	binary.Write(&out, binary.LittleEndian, uint16(elf.ET_DYN))
-	binary.Write(&out, binary.LittleEndian, uint16(elf.EM_X86_64))
+	binary.Write(&out, binary.LittleEndian, uint16(machine))
 	binary.Write(&out, binary.LittleEndian, uint32(elf.EV_CURRENT))
 	binary.Write(&out, binary.LittleEndian, uint64(0))        // entry
 	binary.Write(&out, binary.LittleEndian, uint64(ehdrSize)) // phoff
@@ -71,21 +121,32 @@ func buildSharedObject(t *testing.T, soname string) []byte {
 	binary.Write(&out, binary.LittleEndian, uint32(0))        // flags
 	binary.Write(&out, binary.LittleEndian, uint16(ehdrSize)) // ehsize
 	binary.Write(&out, binary.LittleEndian, uint16(phdrSize)) // phentsize
-	binary.Write(&out, binary.LittleEndian, uint16(1))        // phnum
+	binary.Write(&out, binary.LittleEndian, uint16(phnum))    // phnum
 	binary.Write(&out, binary.LittleEndian, uint16(shdrSize)) // shentsize
 	binary.Write(&out, binary.LittleEndian, uint16(4))        // shnum
 	binary.Write(&out, binary.LittleEndian, uint16(3))        // shstrndx
 
-	// One PT_DYNAMIC program header pointing at the dynamic section.
-	binary.Write(&out, binary.LittleEndian, uint32(elf.PT_DYNAMIC))
-	binary.Write(&out, binary.LittleEndian, uint32(elf.PF_R))
-	binary.Write(&out, binary.LittleEndian, dynamicOff)            // offset
-	binary.Write(&out, binary.LittleEndian, dynamicOff)            // vaddr
-	binary.Write(&out, binary.LittleEndian, dynamicOff)            // paddr
-	binary.Write(&out, binary.LittleEndian, uint64(dynamic.Len())) // filesz
-	binary.Write(&out, binary.LittleEndian, uint64(dynamic.Len())) // memsz
-	binary.Write(&out, binary.LittleEndian, uint64(8))             // align
+	writeProg := func(typ elf.ProgType, off, size uint64) {
+		binary.Write(&out, binary.LittleEndian, uint32(typ))
+		binary.Write(&out, binary.LittleEndian, uint32(elf.PF_R))
+		binary.Write(&out, binary.LittleEndian, off)       // offset
+		binary.Write(&out, binary.LittleEndian, off)       // vaddr
+		binary.Write(&out, binary.LittleEndian, off)       // paddr
+		binary.Write(&out, binary.LittleEndian, size)      // filesz
+		binary.Write(&out, binary.LittleEndian, size)      // memsz
+		binary.Write(&out, binary.LittleEndian, uint64(8)) // align
+	}
+	if interp != nil {
+		size := uint64(len(interp))
+		if o.interpreterSize != 0 {
+			size = o.interpreterSize
+		}
+		writeProg(elf.PT_INTERP, interpOff, size)
+	}
+	// A PT_DYNAMIC program header pointing at the dynamic section.
+	writeProg(elf.PT_DYNAMIC, dynamicOff, uint64(dynamic.Len()))
 
+	out.Write(interp)
 	out.Write(dynstr)
 	out.Write(dynamic.Bytes())
 	out.Write(shstr.Bytes())
@@ -105,8 +166,8 @@ func buildSharedObject(t *testing.T, soname string) []byte {
 	// Section 0 is the mandatory null section.
 	writeSection(0, elf.SHT_NULL, 0, 0, 0, 0)
 	writeSection(dynstrNameIdx, elf.SHT_STRTAB, dynstrOff, uint64(len(dynstr)), 0, 0)
-	// .dynamic's link points at .dynstr (section 1), which is where the SONAME
-	// index is resolved.
+	// .dynamic's link points at .dynstr (section 1), which is where the
+	// string indexes are resolved.
 	writeSection(dynamicNameIdx, elf.SHT_DYNAMIC, dynamicOff, uint64(dynamic.Len()), 1, 16)
 	writeSection(shstrNameIdx, elf.SHT_STRTAB, shstrOff, uint64(shstr.Len()), 0, 0)
 
@@ -143,6 +204,33 @@ func TestReadSONAME(t *testing.T) {
 	}
 }
 
+// TestReadDependencies checks the entries the closure walks: DT_NEEDED in
+// order, the search paths split at colons, and the interpreter.
+func TestReadDependencies(t *testing.T) {
+	path := writeTemp(t, "app", buildObject(t, object{
+		needed:      []string{"libssl.so.3", "libc.so.6"},
+		rpath:       "/opt/old",
+		runpath:     "$ORIGIN/../lib::/opt/lib",
+		interpreter: "/lib64/ld-linux-x86-64.so.2",
+	}))
+	info, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if strings.Join(info.Needed, ",") != "libssl.so.3,libc.so.6" {
+		t.Errorf("Needed = %q", info.Needed)
+	}
+	if strings.Join(info.RPath, ",") != "/opt/old" || strings.Join(info.RunPath, ",") != "$ORIGIN/../lib,/opt/lib" {
+		t.Errorf("RPath = %q, RunPath = %q", info.RPath, info.RunPath)
+	}
+	if info.Interpreter != "/lib64/ld-linux-x86-64.so.2" {
+		t.Errorf("Interpreter = %q", info.Interpreter)
+	}
+	if info.SONAME != "" {
+		t.Errorf("SONAME = %q, want none", info.SONAME)
+	}
+}
+
 // TestReadRejectsNonELF checks that a file that is not an ELF object fails
 // loudly, so a stray text file in `libs` is caught at build time.
 func TestReadRejectsNonELF(t *testing.T) {
@@ -151,3 +239,17 @@ func TestReadRejectsNonELF(t *testing.T) {
 		t.Fatal("Read accepted a file that is not an ELF object")
 	}
 }
+
+// TestReadRejectsOversizedInterpreter checks that a PT_INTERP segment claiming
+// more than a path's worth of bytes is rejected before anything is allocated
+// for it, so a malformed binary in an image cannot exhaust memory.
+func TestReadRejectsOversizedInterpreter(t *testing.T) {
+	path := writeTemp(t, "app", buildObject(t, object{
+		interpreter:     "/lib64/ld-linux-x86-64.so.2",
+		interpreterSize: 8 << 30,
+	}))
+	_, err := Read(path)
+	if err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Fatalf("Read = %v, want an error about the oversized PT_INTERP", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package locale reads what a base image needs to know about glibc locales:
+// which locales a prebuilt locale-archive holds, and the normalized names glibc
+// looks a locale up by.
+package locale
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// archiveMagic opens every locale-archive (AR_MAGIC in glibc's locarchive.h).
+// The archive is written in the byte order of the machine that built it, so
+// the magic also tells which order to read the rest in.
+const archiveMagic = 0xde020109
+
+// The archive header is a sequence of 32-bit fields; these are the indexes of
+// the ones that locate the name hash table.
+const (
+	headerNamehashOffset = 2
+	headerNamehashSize   = 4
+	headerFields         = 14
+	namehashEntrySize    = 12
+)
+
+// ArchiveNames returns the names of the locales in a locale-archive, sorted.
+//
+// The names are read from the archive's name hash table, which is what
+// setlocale consults; every slot with a name offset holds a locale, under the
+// name it was added with (e.g. "en_US.utf8").
+func ArchiveNames(data []byte) ([]string, error) {
+	if len(data) < headerFields*4 {
+		return nil, fmt.Errorf("not a locale archive: %d bytes is shorter than the header", len(data))
+	}
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(data) == archiveMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(data) == archiveMagic:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a locale archive: bad magic %#x", binary.LittleEndian.Uint32(data))
+	}
+	field := func(i int) uint64 { return uint64(order.Uint32(data[i*4:])) }
+
+	offset, size := field(headerNamehashOffset), field(headerNamehashSize)
+	if offset+size*namehashEntrySize > uint64(len(data)) {
+		return nil, fmt.Errorf("corrupt locale archive: name hash table at %d with %d slots runs past the end", offset, size)
+	}
+	var names []string
+	for slot := uint64(0); slot < size; slot++ {
+		entry := data[offset+slot*namehashEntrySize:]
+		nameOffset := uint64(order.Uint32(entry[4:]))
+		if nameOffset == 0 {
+			continue
+		}
+		if nameOffset >= uint64(len(data)) {
+			return nil, fmt.Errorf("corrupt locale archive: locale name at %d is past the end", nameOffset)
+		}
+		name := data[nameOffset:]
+		end := strings.IndexByte(string(name), 0)
+		if end < 0 {
+			return nil, fmt.Errorf("corrupt locale archive: locale name at %d is not terminated", nameOffset)
+		}
+		names = append(names, string(name[:end]))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// NormalizeName returns the name glibc falls back to when looking up a locale:
+// the codeset, between "." and "@", is lowercased with everything but letters
+// and digits dropped, and an all-digit codeset gains an "iso" prefix. So
+// "en_US.UTF-8" is found as "en_US.utf8", which is how localedef names what it
+// builds.
+func NormalizeName(name string) string {
+	dot := strings.IndexByte(name, '.')
+	if dot < 0 {
+		return name
+	}
+	codeset, modifier := name[dot+1:], ""
+	if at := strings.IndexByte(codeset, '@'); at >= 0 {
+		codeset, modifier = codeset[:at], codeset[at:]
+	}
+	var normalized strings.Builder
+	digitsOnly := true
+	for _, c := range strings.ToLower(codeset) {
+		switch {
+		case c >= 'a' && c <= 'z':
+			digitsOnly = false
+			normalized.WriteRune(c)
+		case c >= '0' && c <= '9':
+			normalized.WriteRune(c)
+		}
+	}
+	prefix := ""
+	if digitsOnly {
+		prefix = "iso"
+	}
+	return name[:dot+1] + prefix + normalized.String() + modifier
+}
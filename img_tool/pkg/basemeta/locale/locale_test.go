@@ -0,0 +1,69 @@
+package locale
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// buildArchive lays out the parts of a locale-archive ArchiveNames reads: the
+// header, a name hash table with an empty slot between the used ones, and the
+// string table the names live in.
+func buildArchive(order binary.ByteOrder, names []string) []byte {
+	const namehashOffset = headerFields * 4
+	slots := len(names) + 1
+	stringOffset := namehashOffset + slots*namehashEntrySize
+
+	data := make([]byte, stringOffset)
+	order.PutUint32(data[0:], archiveMagic)
+	order.PutUint32(data[headerNamehashOffset*4:], namehashOffset)
+	order.PutUint32(data[3*4:], uint32(len(names)))
+	order.PutUint32(data[headerNamehashSize*4:], uint32(slots))
+	for i, name := range names {
+		slot := i
+		if i > 0 {
+			slot++
+		}
+		entry := data[namehashOffset+slot*namehashEntrySize:]
+		order.PutUint32(entry[0:], uint32(0x1234+i))
+		order.PutUint32(entry[4:], uint32(len(data)))
+		data = append(data, name...)
+		data = append(data, 0)
+	}
+	return data
+}
+
+func TestArchiveNames(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		names, err := ArchiveNames(buildArchive(order, []string{"en_US.utf8", "de_DE.utf8", "C.utf8"}))
+		if err != nil {
+			t.Fatalf("%v: ArchiveNames: %v", order, err)
+		}
+		if got := strings.Join(names, ","); got != "C.utf8,de_DE.utf8,en_US.utf8" {
+			t.Errorf("%v: names = %s", order, got)
+		}
+	}
+
+	if _, err := ArchiveNames([]byte("not an archive at all, just some text that is long enough")); err == nil || !strings.Contains(err.Error(), "bad magic") {
+		t.Errorf("ArchiveNames(text) = %v, want a bad magic error", err)
+	}
+	truncated := buildArchive(binary.LittleEndian, []string{"en_US.utf8"})
+	if _, err := ArchiveNames(truncated[:headerFields*4+4]); err == nil {
+		t.Errorf("ArchiveNames of a truncated archive succeeded")
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"en_US.UTF-8":            "en_US.utf8",
+		"de_DE.ISO-8859-15@euro": "de_DE.iso885915@euro",
+		"ja_JP.eucJP":            "ja_JP.eucjp",
+		"ru_RU.1251":             "ru_RU.iso1251",
+		"C":                      "C",
+		"en_US":                  "en_US",
+	} {
+		if got := NormalizeName(name); got != want {
+			t.Errorf("NormalizeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package pkgfile
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// apkChecksumRecord is the PAX record abuild attaches to every data entry,
+// holding the hex SHA-1 of a file's content or a symlink's target.
+const apkChecksumRecord = "APK-TOOLS.checksum.SHA1"
+
+// apkV3Magic starts a package in the ADB format of apk-tools 3, which is not a
+// tar at all.
+var apkV3Magic = []byte("ADB.")
+
+// apkPackage is an .apk split into its segments.
+//
+// An apk (v2) is a concatenation of gzip streams, each holding a tar archive:
+// an optional signature segment (.SIGN.* files), the control segment
+// (.PKGINFO and any install scripts), and the data segment. The first two
+// tars are cut before their end-of-archive blocks so that the whole file
+// reads as one tar, and every data entry carries an APK-TOOLS.checksum.SHA1
+// PAX record.
+type apkPackage struct {
+	// control is the compressed control segment exactly as stored: its SHA-1
+	// is the package's identity in apk's database.
+	control []byte
+	// data is the compressed data segment, or nil for a package without one.
+	data []byte
+	// size is the size of the whole package file.
+	size int64
+}
+
+// readAPK splits an .apk into its segments.
+func readAPK(apkPath string) (*apkPackage, error) {
+	data, err := os.ReadFile(apkPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading apk: %w", err)
+	}
+	if bytes.HasPrefix(data, apkV3Magic) {
+		return nil, fmt.Errorf("%s: package is in the apk-tools 3 (ADB) format, which img cannot read; use the v2 package from the Alpine repositories", apkPath)
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return nil, fmt.Errorf("%s: not an Alpine package (not a gzip stream)", apkPath)
+	}
+	members, err := splitGzipMembers(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", apkPath, err)
+	}
+
+	pkg := &apkPackage{size: int64(len(data))}
+	for i, member := range members {
+		names, err := tarNames(member, 1)
+		if err != nil {
+			return nil, fmt.Errorf("%s: reading segment %d: %w", apkPath, i, err)
+		}
+		switch {
+		case pkg.control == nil && len(names) > 0 && strings.HasPrefix(names[0], ".SIGN."):
+			// The signature segment signs the control segment; img does not
+			// verify it, any more than it verifies a .deb or .rpm signature.
+		case pkg.control == nil:
+			pkg.control = member
+		case pkg.data == nil:
+			pkg.data = member
+		default:
+			return nil, fmt.Errorf("%s: unexpected gzip stream %d after the data segment", apkPath, i)
+		}
+	}
+	if pkg.control == nil {
+		return nil, fmt.Errorf("%s: no control segment found (is this an Alpine package?)", apkPath)
+	}
+	return pkg, nil
+}
+
+// splitGzipMembers returns the compressed bytes of each gzip stream in a
+// concatenation of them.
+func splitGzipMembers(data []byte) ([][]byte, error) {
+	var members [][]byte
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		start := len(data) - r.Len()
+		// A bytes.Reader is an io.ByteReader, so neither gzip nor flate read
+		// past the end of the stream and the reader stops right at the next
+		// one.
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip stream %d: %w", len(members), err)
+		}
+		zr.Multistream(false)
+		if _, err := io.Copy(io.Discard, zr); err != nil {
+			return nil, fmt.Errorf("reading gzip stream %d: %w", len(members), err)
+		}
+		members = append(members, data[start:len(data)-r.Len()])
+	}
+	return members, nil
+}
+
+// tarNames lists the names of the first limit entries of a compressed tar
+// segment.
+func tarNames(member []byte, limit int) ([]string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(member))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for len(names) < limit {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, normalizeMemberPath(header.Name))
+	}
+	return names, nil
+}
+
+// ExtractAPK returns the files of an Alpine .apk package's data segment that
+// match.
+func ExtractAPK(apkPath string, match Matcher) ([]Entry, error) {
+	pkg, err := readAPK(apkPath)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.data == nil {
+		return nil, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(pkg.data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: decompressing data segment: %w", apkPath, err)
+	}
+	entries, err := extractTar(zr, match)
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading data segment: %w", apkPath, err)
+	}
+	return entries, nil
+}
+
+// APKRecord is what apk's database keeps about an installed Alpine package.
+type APKRecord struct {
+	// Info names the package. Its Source is the package's origin, the aport
+	// it was built from.
+	Info Info
+	// Installed is the package's entry in apk's database of installed
+	// packages, /lib/apk/db/installed: the package's metadata followed by
+	// every directory and file it installs, each file with its checksum. The
+	// entry ends with the blank line separating it from the next.
+	Installed []byte
+}
+
+// apkInstalledFields maps the .PKGINFO keys to the one-letter fields of the
+// installed database, in the order apk writes them. Keys that may repeat
+// (depend, provides, ...) are joined with spaces.
+var apkInstalledFields = []struct {
+	letter string
+	key    string
+}{
+	{"P", "pkgname"},
+	{"V", "pkgver"},
+	{"A", "arch"},
+	{"S", ""}, // the package file's size, filled in separately
+	{"I", "size"},
+	{"T", "pkgdesc"},
+	{"U", "url"},
+	{"L", "license"},
+	{"o", "origin"},
+	{"m", "maintainer"},
+	{"t", "builddate"},
+	{"c", "commit"},
+	{"k", "provider_priority"},
+	{"D", "depend"},
+	{"p", "provides"},
+	{"r", "replaces"},
+	{"i", "install_if"},
+}
+
+// ReadAPKRecord reads the metadata and file list of an Alpine .apk package and
+// renders its installed database entry.
+func ReadAPKRecord(apkPath string) (*APKRecord, error) {
+	pkg, err := readAPK(apkPath)
+	if err != nil {
+		return nil, err
+	}
+	pkginfo, err := readPKGINFO(pkg.control)
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading control segment: %w", apkPath, err)
+	}
+	fields := parsePKGINFO(pkginfo)
+	info := Info{
+		Format:       FormatAPK,
+		Name:         fields["pkgname"],
+		Version:      fields["pkgver"],
+		Architecture: fields["arch"],
+		Source:       fields["origin"],
+	}
+	if info.Name == "" || info.Version == "" {
+		return nil, fmt.Errorf("%s: .PKGINFO lacks a pkgname or pkgver", apkPath)
+	}
+
+	var entry bytes.Buffer
+	// The identity checksum is the SHA-1 of the compressed control segment,
+	// in apk's "Q1" + base64 notation.
+	identity := sha1.Sum(pkg.control)
+	fmt.Fprintf(&entry, "C:Q1%s\n", base64.StdEncoding.EncodeToString(identity[:]))
+	for _, field := range apkInstalledFields {
+		value := fields[field.key]
+		if field.letter == "S" {
+			value = strconv.FormatInt(pkg.size, 10)
+		}
+		if value != "" {
+			fmt.Fprintf(&entry, "%s:%s\n", field.letter, value)
+		}
+	}
+	if pkg.data != nil {
+		if err := writeAPKFiles(&entry, pkg.data); err != nil {
+			return nil, fmt.Errorf("%s: reading data segment: %w", apkPath, err)
+		}
+	}
+	entry.WriteString("\n")
+	return &APKRecord{Info: info, Installed: entry.Bytes()}, nil
+}
+
+// readPKGINFO returns the .PKGINFO file of a compressed control segment.
+func readPKGINFO(control []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(control))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := extractTar(zr, func(p string) bool { return p == ".PKGINFO" })
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no .PKGINFO file")
+	}
+	return entries[0].Content, nil
+}
+
+// parsePKGINFO reads the "key = value" lines of a .PKGINFO file. Repeated
+// keys are joined with spaces.
+func parsePKGINFO(content []byte) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, " = ")
+		if !found {
+			continue
+		}
+		if previous, ok := fields[key]; ok && previous != "" {
+			value = previous + " " + value
+		}
+		fields[key] = value
+	}
+	return fields
+}
+
+// writeAPKFiles appends the file list of a compressed data segment in the
+// installed database's notation: an F line per directory, followed by an R
+// line per file in it. M and a lines give a directory's or file's owner and
+// mode when they differ from apk's defaults (root, 0755 and 0644), and Z lines
+// a file's checksum.
+func writeAPKFiles(w *bytes.Buffer, data []byte) error {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	currentDir := ""
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(normalizeMemberPath(header.Name), "/")
+		if name == "" || name == "." {
+			continue
+		}
+		owner := fmt.Sprintf("%d:%d:%o", header.Uid, header.Gid, header.Mode&0o7777)
+		if header.Typeflag == tar.TypeDir {
+			fmt.Fprintf(w, "F:%s\n", name)
+			if owner != "0:0:755" {
+				fmt.Fprintf(w, "M:%s\n", owner)
+			}
+			currentDir = name
+			continue
+		}
+		if dir := path.Dir(name); dir != currentDir && dir != "." {
+			// A file whose directory has no entry of its own.
+			fmt.Fprintf(w, "F:%s\n", dir)
+			currentDir = dir
+		}
+		fmt.Fprintf(w, "R:%s\n", path.Base(name))
+		if owner != "0:0:644" {
+			fmt.Fprintf(w, "a:%s\n", owner)
+		}
+		checksum, err := apkChecksum(header, tr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if checksum != nil {
+			fmt.Fprintf(w, "Z:Q1%s\n", base64.StdEncoding.EncodeToString(checksum))
+		}
+	}
+}
+
+// apkChecksum returns the SHA-1 apk records for an entry: the one in its PAX
+// record when abuild wrote one, else the digest of a regular file's content or
+// a symlink's target.
+func apkChecksum(header *tar.Header, content io.Reader) ([]byte, error) {
+	if record, ok := header.PAXRecords[apkChecksumRecord]; ok {
+		checksum, err := hex.DecodeString(record)
+		if err != nil || len(checksum) != sha1.Size {
+			return nil, fmt.Errorf("malformed %s record %q", apkChecksumRecord, record)
+		}
+		return checksum, nil
+	}
+	h := sha1.New()
+	switch header.Typeflag {
+	case tar.TypeReg:
+		if _, err := io.Copy(h, content); err != nil {
+			return nil, err
+		}
+	case tar.TypeSymlink:
+		h.Write([]byte(header.Linkname))
+	default:
+		return nil, nil
+	}
+	return h.Sum(nil), nil
+}
+
+// ParseAPKInstalled lists the packages of apk's installed database,
+// /lib/apk/db/installed.
+func ParseAPKInstalled(content []byte) []Info {
+	var infos []Info
+	var current Info
+	flush := func() {
+		if current.Name != "" && current.Version != "" {
+			current.Format = FormatAPK
+			infos = append(infos, current)
+		}
+		current = Info{}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		letter, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		switch letter {
+		case "P":
+			current.Name = value
+		case "V":
+			current.Version = value
+		case "A":
+			current.Architecture = value
+		case "o":
+			current.Source = value
+		}
+	}
+	flush()
+	return infos
+}
@@ -1,10 +1,12 @@
-// Package pkgfile extracts files from Debian and RPM packages.
+// Package pkgfile extracts files from Debian, RPM and Alpine packages.
 //
-// This is deliberately not a package manager: it reads the payload archive and
-// nothing else. No control metadata is parsed, no dependencies are resolved,
-// no scripts are considered. The only use case is harvesting files that live at
-// a well-known path inside a package, such as the CA certificates in
-// ca-certificates.deb.
+// This is deliberately not a package manager: it reads the payload archive and,
+// for ReadDebRecord, ReadRPMRecord and ReadAPKRecord, the package metadata a
+// package database keeps. No dependencies are resolved, no scripts are
+// considered. The use cases are harvesting files that live at a well-known path
+// inside a package, such as the CA certificates in ca-certificates.deb, listing
+// the packages an image was assembled from in its SBOM, and recording them in
+// the image's own package database.
 //
 // Payloads compressed with xz are rejected rather than decompressed: a pure-Go
 // xz decoder is not in the standard library, and the core img tool deliberately
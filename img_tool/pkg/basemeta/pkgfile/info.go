@@ -0,0 +1,235 @@
+package pkgfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Package formats, as reported in Info.Format. They are also the package URL
+// types of the formats.
+const (
+	FormatDeb = "deb"
+	FormatRPM = "rpm"
+	FormatAPK = "apk"
+)
+
+// Info names a package: what an SBOM lists for it.
+type Info struct {
+	// Format is FormatDeb, FormatRPM or FormatAPK.
+	Format string
+	// Name is the package name.
+	Name string
+	// Version is the full version as the package manager compares it: for a
+	// Debian package the Version field ([epoch:]upstream[-revision]), for an RPM
+	// [epoch:]version-release, for an Alpine package pkgver (version-rN).
+	Version string
+	// Architecture is the architecture the package was built for, e.g. "amd64"
+	// or "x86_64"; "all" and "noarch" mark architecture-independent packages.
+	Architecture string
+	// Source is the source package a Debian binary package was built from, when
+	// its control file names one, or the origin of an Alpine package. It is
+	// empty for RPMs.
+	Source string
+}
+
+// ReadDebInfo reads the name, version and architecture of a .deb package from
+// the control file in its control archive.
+func ReadDebInfo(debPath string) (*Info, error) {
+	record, err := ReadDebRecord(debPath)
+	if err != nil {
+		return nil, err
+	}
+	return &record.Info, nil
+}
+
+// DebRecord is what dpkg's database keeps about an installed .deb package.
+type DebRecord struct {
+	// Info names the package.
+	Info Info
+	// Control is the package's control file, verbatim: the paragraph dpkg
+	// copies into its status database, continuation lines included.
+	Control []byte
+	// MD5Sums is the package's md5sums control file, listing the digest of
+	// every file it installs, or nil when the package ships none.
+	MD5Sums []byte
+}
+
+// ReadDebRecord reads the control and md5sums files of a .deb package's
+// control archive.
+func ReadDebRecord(debPath string) (*DebRecord, error) {
+	data, err := os.ReadFile(debPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading deb: %w", err)
+	}
+	members, err := readAr(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", debPath, err)
+	}
+
+	for _, member := range members {
+		if !strings.HasPrefix(member.name, "control.tar") {
+			continue
+		}
+		// ErrUnsupportedCompression's advice is about certificates; a control
+		// archive gets its own.
+		if compression := unsupportedSuffix(member.name); compression != "" {
+			return nil, fmt.Errorf("%s: %s is %s-compressed, which img cannot decompress; recompress the package with gzip or zstd", debPath, member.name, compression)
+		}
+		reader, err := decompress(bytes.NewReader(member.data), member.data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: decompressing %s: %w", debPath, member.name, err)
+		}
+		entries, err := extractTar(reader, func(p string) bool { return p == "control" || p == "md5sums" })
+		if err != nil {
+			return nil, fmt.Errorf("%s: reading %s: %w", debPath, member.name, err)
+		}
+		var record DebRecord
+		for _, entry := range entries {
+			if entry.Path == "control" {
+				record.Control = entry.Content
+			} else {
+				record.MD5Sums = entry.Content
+			}
+		}
+		if record.Control == nil {
+			return nil, fmt.Errorf("%s: %s holds no control file", debPath, member.name)
+		}
+		record.Info = debInfo(parseControl(record.Control))
+		if record.Info.Name == "" || record.Info.Version == "" {
+			return nil, fmt.Errorf("%s: control file lacks a Package or Version field", debPath)
+		}
+		return &record, nil
+	}
+
+	return nil, fmt.Errorf("%s: no control.tar member found (is this a Debian package?)", debPath)
+}
+
+// parseControl reads the fields of the first paragraph of a Debian control
+// file.
+func parseControl(content []byte) map[string]string {
+	paragraphs := parseParagraphs(content)
+	if len(paragraphs) == 0 {
+		return map[string]string{}
+	}
+	return paragraphs[0]
+}
+
+// parseParagraphs reads every paragraph of a Debian control-format file -- a
+// control file, or the dpkg status database. Continuation lines are dropped:
+// none of the fields read here has one.
+func parseParagraphs(content []byte) []map[string]string {
+	var paragraphs []map[string]string
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(fields) > 0 {
+				paragraphs = append(paragraphs, fields)
+				fields = make(map[string]string)
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields[key] = strings.TrimSpace(value)
+	}
+	if len(fields) > 0 {
+		paragraphs = append(paragraphs, fields)
+	}
+	return paragraphs
+}
+
+// ParseDpkgStatus lists the installed packages of a dpkg status database:
+// var/lib/dpkg/status, or one of the per-package files distroless images keep
+// in var/lib/dpkg/status.d. Packages whose Status is not "install ok
+// installed" are skipped; a status.d file carries no Status field and is read
+// as installed.
+func ParseDpkgStatus(content []byte) []Info {
+	var infos []Info
+	for _, fields := range parseParagraphs(content) {
+		if status, found := fields["Status"]; found && status != "install ok installed" {
+			continue
+		}
+		if fields["Package"] == "" || fields["Version"] == "" {
+			continue
+		}
+		infos = append(infos, debInfo(fields))
+	}
+	return infos
+}
+
+// debInfo picks the fields of a Debian package paragraph Info reports.
+func debInfo(fields map[string]string) Info {
+	return Info{
+		Format:       FormatDeb,
+		Name:         fields["Package"],
+		Version:      fields["Version"],
+		Architecture: fields["Architecture"],
+		// The Source field carries the source version in parentheses when it
+		// differs from the binary's: "glibc (2.36-9)".
+		Source: strings.TrimSpace(strings.SplitN(fields["Source"], "(", 2)[0]),
+	}
+}
+
+// ReadRPMInfo reads the name, version and architecture of an .rpm package from
+// its main header.
+func ReadRPMInfo(rpmPath string) (*Info, error) {
+	record, err := ReadRPMRecord(rpmPath)
+	if err != nil {
+		return nil, err
+	}
+	return &record.Info, nil
+}
+
+// RPMRecord is what rpm's database keeps about an installed .rpm package.
+type RPMRecord struct {
+	// Info names the package.
+	Info Info
+	// Header is the package's main header as rpm stores it in the Packages
+	// table of its database: the index entry count and data size, the index
+	// entries and the data store, without the header's magic and reserved
+	// bytes.
+	Header []byte
+}
+
+// ReadRPMRecord reads the main header of an .rpm package.
+func ReadRPMRecord(rpmPath string) (*RPMRecord, error) {
+	data, err := os.ReadFile(rpmPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading rpm: %w", err)
+	}
+	tags, headerStart, headerEnd, err := readRPMMainHeader(rpmPath, data)
+	if err != nil {
+		return nil, err
+	}
+	if tags[rpmTagName] == "" || tags[rpmTagVersion] == "" {
+		return nil, fmt.Errorf("%s: header lacks a name or version", rpmPath)
+	}
+	version := tags[rpmTagVersion]
+	if release := tags[rpmTagRelease]; release != "" {
+		version += "-" + release
+	}
+	if epoch := tags[rpmTagEpoch]; epoch != "" && epoch != "0" {
+		version = epoch + ":" + version
+	}
+	return &RPMRecord{
+		Info: Info{
+			Format:       FormatRPM,
+			Name:         tags[rpmTagName],
+			Version:      version,
+			Architecture: tags[rpmTagArch],
+		},
+		// The 8 bytes skipped are the magic, the version and 4 reserved bytes.
+		Header: bytes.Clone(data[headerStart+8 : headerEnd]),
+	}, nil
+}
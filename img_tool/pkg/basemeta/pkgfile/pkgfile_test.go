@@ -4,7 +4,10 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -72,6 +75,13 @@ func zstdBytes(t *testing.T, data []byte) []byte {
 	return buf.Bytes()
 }
 
+// testControl and testMD5Sums are the control files of the package writeDeb
+// assembles.
+const (
+	testControl = "Package: test\nSource: test-src (1:1.0-1)\nVersion: 1:1.0-1+b1\nArchitecture: amd64\nDescription: a test\n multi-line description\n"
+	testMD5Sums = "d41d8cd98f00b204e9800998ecf8427e  usr/share/doc/test/README\n"
+)
+
 // writeDeb assembles a .deb: an ar archive of debian-binary, control and data.
 func writeDeb(t *testing.T, dataName string, data []byte) string {
 	t.Helper()
@@ -87,7 +97,10 @@ func writeDeb(t *testing.T, dataName string, data []byte) string {
 		}
 	}
 	member("debian-binary", []byte("2.0\n"))
-	member("control.tar.gz", gzipBytes(t, tarPayload(t, map[string]string{"control": "Package: test\n"})))
+	member("control.tar.gz", gzipBytes(t, tarPayload(t, map[string]string{
+		"control": testControl,
+		"md5sums": testMD5Sums,
+	})))
 	member(dataName, data)
 
 	path := filepath.Join(t.TempDir(), "test.deb")
@@ -178,7 +191,7 @@ func cpioEntry(buf *bytes.Buffer, name string, mode uint64, content []byte) {
 }
 
 // writeRPM assembles a minimal .rpm: a lead, two headers and a cpio payload.
-func writeRPM(t *testing.T, compressor string, payload []byte) string {
+func writeRPM(t *testing.T, compressor string, payload []byte, extraTags map[int32]string) string {
 	t.Helper()
 	var buf bytes.Buffer
 
@@ -217,10 +230,14 @@ func writeRPM(t *testing.T, compressor string, payload []byte) string {
 	for buf.Len()%8 != 0 {
 		buf.WriteByte(0)
 	}
-	writeHeader(map[int32]string{
+	tags := map[int32]string{
 		rpmTagPayloadCompressor: compressor,
 		rpmTagPayloadFormat:     "cpio",
-	})
+	}
+	for tag, value := range extraTags {
+		tags[tag] = value
+	}
+	writeHeader(tags)
 	buf.Write(payload)
 
 	path := filepath.Join(t.TempDir(), "test.rpm")
@@ -239,7 +256,7 @@ func TestExtractRPM(t *testing.T) {
 	cpioEntry(&cpio, cpioTrailer, 0, nil)
 
 	entries, err := ExtractRPM(
-		writeRPM(t, "gzip", gzipBytes(t, cpio.Bytes())),
+		writeRPM(t, "gzip", gzipBytes(t, cpio.Bytes()), nil),
 		PrefixMatcher("etc/pki/ca-trust/source"),
 	)
 	if err != nil {
@@ -259,7 +276,7 @@ func TestExtractRPM(t *testing.T) {
 // TestExtractRPMRejectsXZ checks that the compressor tag is honoured before any
 // attempt to read the payload.
 func TestExtractRPMRejectsXZ(t *testing.T) {
-	_, err := ExtractRPM(writeRPM(t, "xz", []byte("whatever")), PrefixMatcher("etc"))
+	_, err := ExtractRPM(writeRPM(t, "xz", []byte("whatever"), nil), PrefixMatcher("etc"))
 	if err == nil {
 		t.Fatal("ExtractRPM accepted an xz payload")
 	}
@@ -269,6 +286,99 @@ func TestExtractRPMRejectsXZ(t *testing.T) {
 	}
 }
 
+// TestReadDebInfo checks that the package is named from its control file,
+// with the source version stripped from the Source field.
+func TestReadDebInfo(t *testing.T) {
+	info, err := ReadDebInfo(writeDeb(t, "data.tar", tarPayload(t, nil)))
+	if err != nil {
+		t.Fatalf("ReadDebInfo: %v", err)
+	}
+	want := Info{Format: FormatDeb, Name: "test", Version: "1:1.0-1+b1", Architecture: "amd64", Source: "test-src"}
+	if *info != want {
+		t.Errorf("ReadDebInfo = %+v, want %+v", *info, want)
+	}
+}
+
+// TestReadDebRecord checks that the control file comes back verbatim,
+// continuation lines included, along with the md5sums.
+func TestReadDebRecord(t *testing.T) {
+	record, err := ReadDebRecord(writeDeb(t, "data.tar", tarPayload(t, nil)))
+	if err != nil {
+		t.Fatalf("ReadDebRecord: %v", err)
+	}
+	if string(record.Control) != testControl {
+		t.Errorf("Control = %q, want %q", record.Control, testControl)
+	}
+	if string(record.MD5Sums) != testMD5Sums {
+		t.Errorf("MD5Sums = %q, want %q", record.MD5Sums, testMD5Sums)
+	}
+	if record.Info.Name != "test" {
+		t.Errorf("Info.Name = %q, want test", record.Info.Name)
+	}
+}
+
+// TestReadRPMInfo checks that the version joins version and release, and that
+// the payload is not read.
+func TestReadRPMInfo(t *testing.T) {
+	info, err := ReadRPMInfo(writeRPM(t, "xz", []byte("never read"), map[int32]string{
+		rpmTagName:    "openssl-libs",
+		rpmTagVersion: "3.0.7",
+		rpmTagRelease: "27.el9",
+		rpmTagArch:    "x86_64",
+	}))
+	if err != nil {
+		t.Fatalf("ReadRPMInfo: %v", err)
+	}
+	want := Info{Format: FormatRPM, Name: "openssl-libs", Version: "3.0.7-27.el9", Architecture: "x86_64"}
+	if *info != want {
+		t.Errorf("ReadRPMInfo = %+v, want %+v", *info, want)
+	}
+}
+
+// TestReadRPMRecord checks that the header blob starts at the index entry
+// count, as rpm's database stores it, and ends with the data store.
+func TestReadRPMRecord(t *testing.T) {
+	record, err := ReadRPMRecord(writeRPM(t, "gzip", []byte("payload"), map[int32]string{
+		rpmTagName:    "bash",
+		rpmTagVersion: "5.1.8",
+	}))
+	if err != nil {
+		t.Fatalf("ReadRPMRecord: %v", err)
+	}
+	if record.Info.Name != "bash" || record.Info.Version != "5.1.8" {
+		t.Errorf("Info = %+v", record.Info)
+	}
+	header := record.Header
+	if len(header) < 8 {
+		t.Fatalf("header blob is %d bytes", len(header))
+	}
+	indexCount := binary.BigEndian.Uint32(header[0:4])
+	storeSize := binary.BigEndian.Uint32(header[4:8])
+	if want := 8 + int(indexCount)*16 + int(storeSize); len(header) != want {
+		t.Errorf("header blob is %d bytes, want %d for %d entries and a %d-byte store", len(header), want, indexCount, storeSize)
+	}
+	if indexCount != 4 {
+		t.Errorf("header has %d entries, want 4", indexCount)
+	}
+}
+
+// TestParseDpkgStatus checks that only installed packages are listed, and that
+// a status.d file without Status fields counts as installed.
+func TestParseDpkgStatus(t *testing.T) {
+	status := "Package: libc6\nStatus: install ok installed\nVersion: 2.36-9\nArchitecture: amd64\nSource: glibc\n\n" +
+		"Package: removed\nStatus: deinstall ok config-files\nVersion: 1.0\n\n" +
+		"Package: tzdata\nStatus: install ok installed\nVersion: 2024a-0+deb12u1\nArchitecture: all\n"
+	infos := ParseDpkgStatus([]byte(status))
+	if len(infos) != 2 || infos[0].Name != "libc6" || infos[0].Source != "glibc" || infos[1].Name != "tzdata" {
+		t.Errorf("ParseDpkgStatus = %+v, want libc6 and tzdata", infos)
+	}
+
+	statusD := ParseDpkgStatus([]byte("Package: base-files\nVersion: 12.4+deb12u5\nArchitecture: amd64\n"))
+	if len(statusD) != 1 || statusD[0].Version != "12.4+deb12u5" {
+		t.Errorf("ParseDpkgStatus(status.d) = %+v", statusD)
+	}
+}
+
 // TestPrefixMatcher checks that a prefix matches a directory and its contents
 // but not a sibling whose name merely starts the same way.
 func TestPrefixMatcher(t *testing.T) {
@@ -303,3 +413,182 @@ func errorsAs(err error, target **ErrUnsupportedCompression) bool {
 	}
 	return false
 }
+
+// testPKGINFO is the .PKGINFO of the package writeAPK assembles.
+const testPKGINFO = `# Generated by abuild 3.12.0-r0
+# using fakeroot version 1.31
+# Fri Jan  1 00:00:00 UTC 2021
+pkgname = hello
+pkgver = 2.12-r1
+pkgdesc = A friendly greeter
+url = https://www.gnu.org/software/hello/
+builddate = 1609459200
+packager = Buildozer <alpine-devel@lists.alpinelinux.org>
+size = 4242
+arch = x86_64
+origin = hello-src
+commit = 0123456789abcdef0123456789abcdef01234567
+maintainer = Someone <someone@example.com>
+license = GPL-3.0-or-later
+depend = so:libc.musl-x86_64.so.1
+depend = /bin/sh
+provides = cmd:hello=2.12-r1
+datahash = 0000000000000000000000000000000000000000000000000000000000000000
+`
+
+// apkSegment writes a gzip-compressed tar segment of an .apk. Like abuild,
+// it leaves out the end-of-archive blocks unless the segment is the last one.
+func apkSegment(t *testing.T, last bool, write func(tw *tar.Writer)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write(tw)
+	if last {
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	} else if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return gzipBytes(t, buf.Bytes())
+}
+
+// writeAPKEntry writes one data entry with the checksum record abuild adds.
+func writeAPKEntry(t *testing.T, tw *tar.Writer, header *tar.Header, content string) {
+	t.Helper()
+	if header.Typeflag != tar.TypeDir {
+		checksummed := content
+		if header.Typeflag == tar.TypeSymlink {
+			checksummed = header.Linkname
+		}
+		sum := sha1.Sum([]byte(checksummed))
+		header.PAXRecords = map[string]string{apkChecksumRecord: hex.EncodeToString(sum[:])}
+		header.Format = tar.FormatPAX
+	}
+	header.Size = int64(len(content))
+	if err := tw.WriteHeader(header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeAPK assembles an .apk: optionally a signature segment, then the
+// control and data segments. It returns the package's path and its control
+// segment, whose checksum identifies it.
+func writeAPK(t *testing.T, signed bool) (string, []byte) {
+	t.Helper()
+	var apk []byte
+	if signed {
+		apk = append(apk, apkSegment(t, false, func(tw *tar.Writer) {
+			signature := "not really a signature"
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: ".SIGN.RSA.alpine-devel.rsa.pub", Mode: 0o644, Size: int64(len(signature))}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(signature)); err != nil {
+				t.Fatal(err)
+			}
+		})...)
+	}
+	control := apkSegment(t, false, func(tw *tar.Writer) {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: ".PKGINFO", Mode: 0o644, Size: int64(len(testPKGINFO))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(testPKGINFO)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	apk = append(apk, control...)
+	apk = append(apk, apkSegment(t, true, func(tw *tar.Writer) {
+		writeAPKEntry(t, tw, &tar.Header{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755}, "")
+		writeAPKEntry(t, tw, &tar.Header{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0o755}, "")
+		writeAPKEntry(t, tw, &tar.Header{Typeflag: tar.TypeReg, Name: "usr/bin/hello", Mode: 0o755}, "#!/bin/sh\necho hello\n")
+		writeAPKEntry(t, tw, &tar.Header{Typeflag: tar.TypeSymlink, Name: "usr/bin/hi", Linkname: "hello", Mode: 0o777}, "")
+		writeAPKEntry(t, tw, &tar.Header{Typeflag: tar.TypeReg, Name: "etc/hello.conf", Mode: 0o644}, "greeting=hello\n")
+		writeAPKEntry(t, tw, &tar.Header{Typeflag: tar.TypeDir, Name: "var/lib/hello/", Mode: 0o700, Uid: 100, Gid: 101}, "")
+		writeAPKEntry(t, tw, &tar.Header{Typeflag: tar.TypeReg, Name: "var/lib/hello/state", Mode: 0o600, Uid: 100, Gid: 101}, "")
+	})...)
+
+	path := filepath.Join(t.TempDir(), "hello-2.12-r1.apk")
+	if err := os.WriteFile(path, apk, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, control
+}
+
+// TestExtractAPK checks that files come from the data segment, past the
+// signature and control segments, with or without a signature.
+func TestExtractAPK(t *testing.T) {
+	for _, signed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("signed=%v", signed), func(t *testing.T) {
+			apkPath, _ := writeAPK(t, signed)
+			entries, err := ExtractAPK(apkPath, PrefixMatcher("etc"))
+			if err != nil {
+				t.Fatalf("ExtractAPK: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Path != "etc/hello.conf" || string(entries[0].Content) != "greeting=hello\n" {
+				t.Errorf("ExtractAPK = %+v, want etc/hello.conf", entries)
+			}
+		})
+	}
+}
+
+// TestExtractAPKRejectsV3 checks that an apk-tools 3 package gets a clear
+// error rather than a gzip one.
+func TestExtractAPKRejectsV3(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v3.apk")
+	if err := os.WriteFile(path, []byte("ADB.pckg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ExtractAPK(path, PrefixMatcher("etc"))
+	if err == nil || !strings.Contains(err.Error(), "apk-tools 3") {
+		t.Errorf("ExtractAPK(v3) error = %v, want an apk-tools 3 error", err)
+	}
+}
+
+// TestReadAPKRecord checks the installed database entry: the metadata in
+// apk's field order, then the directories with their files, owners and modes
+// where they differ from the defaults, and checksums taken from the PAX
+// records.
+func TestReadAPKRecord(t *testing.T) {
+	apkPath, control := writeAPK(t, true)
+	record, err := ReadAPKRecord(apkPath)
+	if err != nil {
+		t.Fatalf("ReadAPKRecord: %v", err)
+	}
+	wantInfo := Info{Format: FormatAPK, Name: "hello", Version: "2.12-r1", Architecture: "x86_64", Source: "hello-src"}
+	if record.Info != wantInfo {
+		t.Errorf("Info = %+v, want %+v", record.Info, wantInfo)
+	}
+
+	stat, err := os.Stat(apkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q1 := func(data string) string {
+		sum := sha1.Sum([]byte(data))
+		return "Q1" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	want := "C:" + q1(string(control)) + "\n" +
+		"P:hello\nV:2.12-r1\nA:x86_64\n" +
+		fmt.Sprintf("S:%d\n", stat.Size()) +
+		"I:4242\nT:A friendly greeter\nU:https://www.gnu.org/software/hello/\nL:GPL-3.0-or-later\n" +
+		"o:hello-src\nm:Someone <someone@example.com>\nt:1609459200\nc:0123456789abcdef0123456789abcdef01234567\n" +
+		"D:so:libc.musl-x86_64.so.1 /bin/sh\np:cmd:hello=2.12-r1\n" +
+		"F:usr\nF:usr/bin\n" +
+		"R:hello\na:0:0:755\nZ:" + q1("#!/bin/sh\necho hello\n") + "\n" +
+		"R:hi\na:0:0:777\nZ:" + q1("hello") + "\n" +
+		"F:etc\nR:hello.conf\nZ:" + q1("greeting=hello\n") + "\n" +
+		"F:var/lib/hello\nM:100:101:700\n" +
+		"R:state\na:100:101:600\nZ:" + q1("") + "\n" +
+		"\n"
+	if string(record.Installed) != want {
+		t.Errorf("Installed =\n%s\nwant\n%s", record.Installed, want)
+	}
+
+	// The entry reads back as the package it describes.
+	if infos := ParseAPKInstalled(append(record.Installed, record.Installed...)); len(infos) != 2 || infos[0] != wantInfo {
+		t.Errorf("ParseAPKInstalled = %+v, want two of %+v", infos, wantInfo)
+	}
+}
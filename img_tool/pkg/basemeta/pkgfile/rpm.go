@@ -21,10 +21,32 @@ const (
 	// rpmTagPayloadFormat (1124) names the archive format; only "cpio" exists
 	// in practice.
 	rpmTagPayloadFormat = 1124
-	// rpmTypeString is the header entry type for a NUL-terminated string.
+	// rpmTagName (1000), rpmTagVersion (1001), rpmTagRelease (1002),
+	// rpmTagEpoch (1003) and rpmTagArch (1022) identify the package; see
+	// ReadRPMInfo.
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+	rpmTagArch    = 1022
+	// rpmTypeInt32 is the header entry type for big-endian 32-bit integers, and
+	// rpmTypeString the one for a NUL-terminated string.
+	rpmTypeInt32  = 4
 	rpmTypeString = 6
 )
 
+// rpmDecodedTags are the header tags readRPMHeader decodes; every other tag is
+// skipped.
+var rpmDecodedTags = map[int32]bool{
+	rpmTagPayloadCompressor: true,
+	rpmTagPayloadFormat:     true,
+	rpmTagName:              true,
+	rpmTagVersion:           true,
+	rpmTagRelease:           true,
+	rpmTagEpoch:             true,
+	rpmTagArch:              true,
+}
+
 var (
 	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
 	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8}
@@ -41,23 +63,9 @@ func ExtractRPM(rpmPath string, match Matcher) ([]Entry, error) {
 	if err != nil {
 		return nil, fmt.Errorf("reading rpm: %w", err)
 	}
-	if len(data) < rpmLeadSize || !bytes.HasPrefix(data, rpmLeadMagic) {
-		return nil, fmt.Errorf("%s: not an RPM package (bad lead magic)", rpmPath)
-	}
-
-	offset := rpmLeadSize
-	// The signature header is padded so the header that follows starts on an
-	// 8-byte boundary; the main header is not padded.
-	signatureTags, signatureEnd, err := readRPMHeader(data, offset)
-	if err != nil {
-		return nil, fmt.Errorf("%s: reading signature header: %w", rpmPath, err)
-	}
-	_ = signatureTags
-	offset = (signatureEnd + 7) &^ 7
-
-	headerTags, headerEnd, err := readRPMHeader(data, offset)
+	headerTags, _, headerEnd, err := readRPMMainHeader(rpmPath, data)
 	if err != nil {
-		return nil, fmt.Errorf("%s: reading header: %w", rpmPath, err)
+		return nil, err
 	}
 
 	if format, ok := headerTags[rpmTagPayloadFormat]; ok && format != "cpio" && format != "" {
@@ -86,8 +94,33 @@ func ExtractRPM(rpmPath string, match Matcher) ([]Entry, error) {
 	return entries, nil
 }
 
-// readRPMHeader parses one header structure, returning its string-valued tags
-// and the offset just past the header.
+// readRPMMainHeader skips the lead and the signature header of the package
+// held in data, and parses the main header. It also returns the offsets at
+// which the main header starts and ends.
+func readRPMMainHeader(rpmPath string, data []byte) (map[int32]string, int, int, error) {
+	if len(data) < rpmLeadSize || !bytes.HasPrefix(data, rpmLeadMagic) {
+		return nil, 0, 0, fmt.Errorf("%s: not an RPM package (bad lead magic)", rpmPath)
+	}
+
+	offset := rpmLeadSize
+	// The signature header is padded so the header that follows starts on an
+	// 8-byte boundary; the main header is not padded.
+	_, signatureEnd, err := readRPMHeader(data, offset)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("%s: reading signature header: %w", rpmPath, err)
+	}
+	offset = (signatureEnd + 7) &^ 7
+
+	headerTags, headerEnd, err := readRPMHeader(data, offset)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("%s: reading header: %w", rpmPath, err)
+	}
+	return headerTags, offset, headerEnd, nil
+}
+
+// readRPMHeader parses one header structure, returning the tags of
+// rpmDecodedTags it holds (an integer tag formatted in decimal) and the offset
+// just past the header.
 func readRPMHeader(data []byte, offset int) (map[int32]string, int, error) {
 	if offset+rpmHeaderSize > len(data) {
 		return nil, 0, fmt.Errorf("truncated header at offset %d", offset)
@@ -114,12 +147,18 @@ func readRPMHeader(data []byte, offset int) (map[int32]string, int, error) {
 		entryType := binary.BigEndian.Uint32(entry[4:8])
 		entryOffset := int(binary.BigEndian.Uint32(entry[8:12]))
 
-		// Only the handful of string tags this package cares about are decoded;
-		// every other type is skipped rather than parsed.
-		if entryType != rpmTypeString || entryOffset >= len(store) {
+		// Only the handful of tags this package cares about are decoded; every
+		// other tag is skipped rather than parsed.
+		if !rpmDecodedTags[tag] || entryOffset >= len(store) {
+			continue
+		}
+		if entryType == rpmTypeInt32 {
+			if entryOffset+4 <= len(store) {
+				tags[tag] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(store[entryOffset:])), 10)
+			}
 			continue
 		}
-		if tag != rpmTagPayloadCompressor && tag != rpmTagPayloadFormat {
+		if entryType != rpmTypeString {
 			continue
 		}
 		value := store[entryOffset:]
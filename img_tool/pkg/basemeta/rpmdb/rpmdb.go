@@ -0,0 +1,379 @@
+// Package rpmdb writes rpm's SQLite package database (rpmdb.sqlite).
+//
+// rpm 4.16 and later keep their database in a single SQLite file. Its Packages
+// table maps a package number to the package's header blob; everything else in
+// the file (Name, Basenames, Providename, ... ) is an index rpm derives from
+// those headers. Vulnerability scanners read the Packages table alone, so that
+// is all this package writes, together with the sqlite_sequence bookkeeping
+// table that its AUTOINCREMENT column requires. `rpm --rebuilddb` run inside
+// the image regenerates the indexes, should rpm itself ever need them.
+//
+// The file is written directly in SQLite's documented on-disk format
+// (https://www.sqlite.org/fileformat2.html) rather than through an SQLite
+// library: the core img tool takes no cgo dependency, and a database holding
+// one append-only table of blobs needs only a small part of the format.
+package rpmdb
+
+import (
+	"encoding/binary"
+)
+
+// PackagesSchema is the statement rpm creates its Packages table with, as
+// SQLite records it in the schema table.
+const PackagesSchema = "CREATE TABLE 'Packages' (hnum INTEGER PRIMARY KEY AUTOINCREMENT,blob BLOB NOT NULL)"
+
+// sequenceSchema is the statement SQLite creates sqlite_sequence with the first
+// time a table with an AUTOINCREMENT column is created.
+const sequenceSchema = "CREATE TABLE sqlite_sequence(name,seq)"
+
+// Write renders a database holding one Packages row per header, numbered from
+// 1 in the order given. Each header is a package's main header without its
+// magic and reserved bytes (see pkgfile.RPMRecord). The output is a
+// deterministic function of the headers.
+func Write(headers [][]byte) []byte {
+	db := newDatabase()
+	// Page 1 holds the schema table; the two tables' roots follow it.
+	packagesRoot := db.allocate()
+	sequenceRoot := db.allocate()
+
+	schema := []record{
+		{"table", "Packages", "Packages", int64(packagesRoot), PackagesSchema},
+		{"table", "sqlite_sequence", "sqlite_sequence", int64(sequenceRoot), sequenceSchema},
+	}
+	db.writeTable(1, schema)
+
+	rows := make([]record, len(headers))
+	for i, header := range headers {
+		// hnum is an alias for the rowid, so SQLite stores NULL in its place.
+		rows[i] = record{nil, header}
+	}
+	db.writeTable(packagesRoot, rows)
+
+	var sequence []record
+	if len(headers) > 0 {
+		sequence = append(sequence, record{"Packages", int64(len(headers))})
+	}
+	db.writeTable(sequenceRoot, sequence)
+
+	return db.bytes()
+}
+
+// SQLite layout constants. A 4 KiB page is SQLite's default.
+const (
+	pageSize       = 4096
+	fileHeaderSize = 100
+	leafHeaderSize = 8
+	// interiorHeaderSize is the leaf header plus the right-most child pointer.
+	interiorHeaderSize = 12
+	// sqliteVersion is the library version recorded as the last writer,
+	// 3.45.0 in SQLITE_VERSION_NUMBER form.
+	sqliteVersion = 3045000
+
+	pageTypeTableInterior = 0x05
+	pageTypeTableLeaf     = 0x0d
+)
+
+// record is one row: each value is nil, an int64, a string or a []byte.
+type record []any
+
+// encode renders a record in SQLite's record format: a header of serial types
+// followed by the values.
+func (r record) encode() []byte {
+	var types, body []byte
+	for _, value := range r {
+		switch v := value.(type) {
+		case nil:
+			types = appendVarint(types, 0)
+		case int64:
+			serialType, n := integerSerialType(v)
+			types = appendVarint(types, serialType)
+			for i := n - 1; i >= 0; i-- {
+				body = append(body, byte(v>>(8*i)))
+			}
+		case string:
+			types = appendVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		case []byte:
+			types = appendVarint(types, uint64(len(v))*2+12)
+			body = append(body, v...)
+		default:
+			panic("rpmdb: unsupported record value")
+		}
+	}
+	// The header size counts itself, so its own varint length is part of it.
+	headerSize := len(types) + 1
+	for varintLen(uint64(headerSize)) != headerSize-len(types) {
+		headerSize = len(types) + varintLen(uint64(headerSize))
+	}
+	out := appendVarint(nil, uint64(headerSize))
+	out = append(out, types...)
+	return append(out, body...)
+}
+
+// integerSerialType picks the smallest serial type holding v and the number of
+// big-endian bytes it is stored in.
+func integerSerialType(v int64) (uint64, int) {
+	switch {
+	case v == 0:
+		return 8, 0
+	case v == 1:
+		return 9, 0
+	case v >= -1<<7 && v < 1<<7:
+		return 1, 1
+	case v >= -1<<15 && v < 1<<15:
+		return 2, 2
+	case v >= -1<<23 && v < 1<<23:
+		return 3, 3
+	case v >= -1<<31 && v < 1<<31:
+		return 4, 4
+	case v >= -1<<47 && v < 1<<47:
+		return 5, 6
+	default:
+		return 6, 8
+	}
+}
+
+// database is a file under construction, one page at a time.
+type database struct {
+	pages [][]byte
+}
+
+func newDatabase() *database {
+	db := &database{}
+	db.allocate() // page 1: file header and schema table
+	return db
+}
+
+// allocate appends a zeroed page and returns its (1-based) number.
+func (db *database) allocate() uint32 {
+	db.pages = append(db.pages, make([]byte, pageSize))
+	return uint32(len(db.pages))
+}
+
+func (db *database) page(number uint32) []byte { return db.pages[number-1] }
+
+// child is a b-tree page together with the largest rowid stored beneath it,
+// which is the key its parent separates it by.
+type child struct {
+	page     uint32
+	maxRowID int64
+}
+
+// writeTable stores rows (with rowids 1..len(rows)) as a table b-tree rooted
+// at root. Rows are packed into leaves in order; when they need more than one
+// leaf, interior levels are built above them until a single page remains,
+// which is written at root.
+func (db *database) writeTable(root uint32, rows []record) {
+	capacity := func(number uint32, header int) int {
+		if number == 1 {
+			return pageSize - fileHeaderSize - header
+		}
+		return pageSize - header
+	}
+
+	var leaves [][][]byte
+	var cells [][]byte
+	used := 0
+	for i, row := range rows {
+		cell := db.leafCell(int64(i+1), row.encode())
+		if len(cells) > 0 && used+len(cell)+2 > capacity(root, leafHeaderSize) {
+			leaves = append(leaves, cells)
+			cells, used = nil, 0
+		}
+		cells = append(cells, cell)
+		used += len(cell) + 2
+	}
+	leaves = append(leaves, cells)
+
+	if len(leaves) == 1 {
+		db.writePage(root, pageTypeTableLeaf, leaves[0], 0)
+		return
+	}
+	var level []child
+	rowID := int64(0)
+	for _, leaf := range leaves {
+		number := db.allocate()
+		db.writePage(number, pageTypeTableLeaf, leaf, 0)
+		rowID += int64(len(leaf))
+		level = append(level, child{number, rowID})
+	}
+
+	for {
+		// Group the children into interior pages. Every child but a page's
+		// last gets a cell; the last becomes the right-most pointer.
+		var groups [][]child
+		var group []child
+		used := 0
+		for _, c := range level {
+			if len(group) > 0 {
+				size := interiorCellSize(group[len(group)-1]) + 2
+				if used+size > capacity(root, interiorHeaderSize) {
+					groups = append(groups, group)
+					group, used = nil, 0
+				} else {
+					used += size
+				}
+			}
+			group = append(group, c)
+		}
+		// An interior page needs at least one cell, so a lone last child
+		// takes a sibling from the page before it.
+		if len(group) == 1 && len(groups) > 0 {
+			prev := groups[len(groups)-1]
+			group = []child{prev[len(prev)-1], group[0]}
+			groups[len(groups)-1] = prev[:len(prev)-1]
+		}
+		groups = append(groups, group)
+
+		if len(groups) == 1 {
+			db.writeInterior(root, groups[0])
+			return
+		}
+		var next []child
+		for _, group := range groups {
+			number := db.allocate()
+			db.writeInterior(number, group)
+			next = append(next, child{number, group[len(group)-1].maxRowID})
+		}
+		level = next
+	}
+}
+
+// leafCell builds a table leaf cell, spilling the end of a large payload into
+// a chain of overflow pages as the file format prescribes.
+func (db *database) leafCell(rowID int64, payload []byte) []byte {
+	cell := appendVarint(nil, uint64(len(payload)))
+	cell = appendVarint(cell, uint64(rowID))
+	local := localPayload(len(payload))
+	cell = append(cell, payload[:local]...)
+	if local == len(payload) {
+		return cell
+	}
+	rest := payload[local:]
+	first := db.allocate()
+	cell = binary.BigEndian.AppendUint32(cell, first)
+	for number := first; ; {
+		n := min(len(rest), pageSize-4)
+		page := db.page(number)
+		copy(page[4:], rest[:n])
+		rest = rest[n:]
+		if len(rest) == 0 {
+			return cell
+		}
+		next := db.allocate()
+		binary.BigEndian.PutUint32(page, next)
+		number = next
+	}
+}
+
+// localPayload is how many bytes of a table leaf payload of the given size
+// stay on the b-tree page.
+func localPayload(size int) int {
+	const (
+		usable     = pageSize
+		maxLocal   = usable - 35
+		minLocal   = (usable-12)*32/255 - 23
+		overflowed = usable - 4
+	)
+	if size <= maxLocal {
+		return size
+	}
+	k := minLocal + (size-minLocal)%overflowed
+	if k <= maxLocal {
+		return k
+	}
+	return minLocal
+}
+
+func interiorCellSize(c child) int { return 4 + varintLen(uint64(c.maxRowID)) }
+
+// writeInterior writes an interior table page over the children.
+func (db *database) writeInterior(number uint32, children []child) {
+	var cells [][]byte
+	for _, c := range children[:len(children)-1] {
+		cell := binary.BigEndian.AppendUint32(nil, c.page)
+		cells = append(cells, appendVarint(cell, uint64(c.maxRowID)))
+	}
+	db.writePage(number, pageTypeTableInterior, cells, children[len(children)-1].page)
+}
+
+// writePage lays out a b-tree page: the header and cell pointer array grow
+// from the front, the cells are packed against the end of the page.
+func (db *database) writePage(number uint32, pageType byte, cells [][]byte, rightMost uint32) {
+	page := db.page(number)
+	offset := 0
+	if number == 1 {
+		offset = fileHeaderSize
+	}
+	header := page[offset:]
+	header[0] = pageType
+	binary.BigEndian.PutUint16(header[3:], uint16(len(cells)))
+	pointers := offset + leafHeaderSize
+	if pageType == pageTypeTableInterior {
+		binary.BigEndian.PutUint32(header[8:], rightMost)
+		pointers = offset + interiorHeaderSize
+	}
+	end := pageSize
+	for i, cell := range cells {
+		end -= len(cell)
+		copy(page[end:], cell)
+		binary.BigEndian.PutUint16(page[pointers+2*i:], uint16(end))
+	}
+	// A content area starting at 65536 would be written as 0; with 4 KiB pages
+	// it never does.
+	binary.BigEndian.PutUint16(header[5:], uint16(end))
+}
+
+// bytes fills in the file header and returns the file.
+func (db *database) bytes() []byte {
+	header := db.pages[0][:fileHeaderSize]
+	copy(header, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(header[16:], pageSize)
+	header[18] = 1 // file format write version: legacy (rollback journal)
+	header[19] = 1 // file format read version
+	header[20] = 0 // reserved bytes per page
+	header[21] = 64
+	header[22] = 32
+	header[23] = 32
+	binary.BigEndian.PutUint32(header[24:], 1) // file change counter
+	binary.BigEndian.PutUint32(header[28:], uint32(len(db.pages)))
+	binary.BigEndian.PutUint32(header[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(header[44:], 4) // schema format number
+	binary.BigEndian.PutUint32(header[56:], 1) // text encoding: UTF-8
+	// The page count above is trusted only while this matches the change
+	// counter.
+	binary.BigEndian.PutUint32(header[92:], 1)
+	binary.BigEndian.PutUint32(header[96:], sqliteVersion)
+
+	out := make([]byte, 0, len(db.pages)*pageSize)
+	for _, page := range db.pages {
+		out = append(out, page...)
+	}
+	return out
+}
+
+// appendVarint appends v in SQLite's big-endian variable-length integer
+// encoding: seven bits per byte with the high bit set on all but the last, and
+// a ninth byte carrying a full eight bits.
+func appendVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, buf[i:]...)
+}
+
+func varintLen(v uint64) int { return len(appendVarint(nil, v)) }
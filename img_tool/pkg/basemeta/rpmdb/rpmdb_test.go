@@ -0,0 +1,161 @@
+package rpmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// readTable walks the table b-tree rooted at page root and returns its rows'
+// payloads by rowid, following overflow chains. It is an independent reading
+// of the file format, so the writer's page arithmetic is checked against it.
+func readTable(t *testing.T, file []byte, root uint32) map[int64][]byte {
+	t.Helper()
+	page := func(number uint32) []byte {
+		if number == 0 || int(number)*pageSize > len(file) {
+			t.Fatalf("page %d out of range", number)
+		}
+		return file[(number-1)*pageSize : number*pageSize]
+	}
+	rows := map[int64][]byte{}
+	var walk func(number uint32, maxKey int64)
+	walk = func(number uint32, maxKey int64) {
+		p := page(number)
+		header := p
+		if number == 1 {
+			header = p[fileHeaderSize:]
+		}
+		cells := int(binary.BigEndian.Uint16(header[3:]))
+		switch header[0] {
+		case pageTypeTableInterior:
+			for i := 0; i < cells; i++ {
+				off := binary.BigEndian.Uint16(header[interiorHeaderSize+2*i:])
+				childPage := binary.BigEndian.Uint32(p[off:])
+				key, _ := readVarint(p[off+4:])
+				if maxKey >= 0 && int64(key) > maxKey {
+					t.Errorf("page %d: key %d exceeds the parent's %d", number, key, maxKey)
+				}
+				walk(childPage, int64(key))
+			}
+			walk(binary.BigEndian.Uint32(header[8:]), maxKey)
+		case pageTypeTableLeaf:
+			for i := 0; i < cells; i++ {
+				off := int(binary.BigEndian.Uint16(header[leafHeaderSize+2*i:]))
+				size, n := readVarint(p[off:])
+				off += n
+				rowID, n := readVarint(p[off:])
+				off += n
+				if maxKey >= 0 && int64(rowID) > maxKey {
+					t.Errorf("page %d: rowid %d exceeds the parent's key %d", number, rowID, maxKey)
+				}
+				local := localPayload(int(size))
+				payload := append([]byte{}, p[off:off+local]...)
+				if local < int(size) {
+					next := binary.BigEndian.Uint32(p[off+local:])
+					for len(payload) < int(size) {
+						overflow := page(next)
+						payload = append(payload, overflow[4:min(pageSize, 4+int(size)-len(payload))]...)
+						next = binary.BigEndian.Uint32(overflow)
+					}
+					if next != 0 {
+						t.Errorf("row %d: overflow chain does not end", rowID)
+					}
+				}
+				rows[int64(rowID)] = payload
+			}
+		default:
+			t.Fatalf("page %d: unexpected page type %#x", number, header[0])
+		}
+	}
+	walk(root, -1)
+	return rows
+}
+
+// readVarint decodes one SQLite varint.
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}
+
+func TestWrite(t *testing.T) {
+	// Small headers fill several leaves, large ones overflow (one of them
+	// across several pages), so the tree gets an interior root.
+	var headers [][]byte
+	for i := 0; i < 400; i++ {
+		size := 40 + i%200
+		if i%50 == 7 {
+			size = 3*pageSize + i
+		}
+		headers = append(headers, bytes.Repeat([]byte{byte(i)}, size))
+	}
+	file := Write(headers)
+
+	if !bytes.HasPrefix(file, []byte("SQLite format 3\x00")) {
+		t.Fatal("missing SQLite magic")
+	}
+	if len(file)%pageSize != 0 || int(binary.BigEndian.Uint32(file[28:]))*pageSize != len(file) {
+		t.Errorf("header page count %d does not match the file size %d", binary.BigEndian.Uint32(file[28:]), len(file))
+	}
+
+	schema := readTable(t, file, 1)
+	want := record{"table", "Packages", "Packages", int64(2), PackagesSchema}.encode()
+	if !bytes.Equal(schema[1], want) {
+		t.Errorf("schema row 1 = %q, want %q", schema[1], want)
+	}
+
+	packages := readTable(t, file, 2)
+	if len(packages) != len(headers) {
+		t.Fatalf("read %d rows, want %d", len(packages), len(headers))
+	}
+	for i, header := range headers {
+		if got, want := packages[int64(i+1)], (record{nil, header}).encode(); !bytes.Equal(got, want) {
+			t.Fatalf("row %d differs (%d bytes, want %d)", i+1, len(got), len(want))
+		}
+	}
+
+	sequence := readTable(t, file, 3)
+	if got, want := sequence[1], (record{"Packages", int64(len(headers))}).encode(); !bytes.Equal(got, want) {
+		t.Errorf("sqlite_sequence row = %q, want %q", got, want)
+	}
+
+	if !bytes.Equal(file, Write(headers)) {
+		t.Error("Write is not deterministic")
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	file := Write(nil)
+	if len(file) != 3*pageSize {
+		t.Errorf("empty database has %d bytes, want 3 pages", len(file))
+	}
+	if rows := readTable(t, file, 2); len(rows) != 0 {
+		t.Errorf("empty database has %d package rows", len(rows))
+	}
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 1<<56 - 1, 1 << 56, 1<<64 - 1} {
+		encoded := appendVarint(nil, v)
+		got, n := readVarint(append(encoded, make([]byte, 9)...))
+		if got != v || n != len(encoded) {
+			t.Errorf("varint %d: decoded %d from %d bytes (encoded %d)", v, got, n, len(encoded))
+		}
+	}
+}
+
+func TestRecordHeaderSize(t *testing.T) {
+	// 130 one-byte serial types make the header size itself need two bytes.
+	r := make(record, 130)
+	encoded := r.encode()
+	size, n := readVarint(encoded)
+	if n != 2 || size != 132 {
+		t.Errorf("header size %d in %d bytes, want 132 in 2: %s", size, n, fmt.Sprint(encoded[:4]))
+	}
+}
@@ -0,0 +1,449 @@
+package tzdata
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lastTransitionYear is the last year whose transitions are written out. Like
+// zic's default, everything after it is left to the footer's TZ string; 2037
+// keeps the table within what a 32-bit time_t reader could still use.
+const lastTransitionYear = 2037
+
+// firstRuleYear bounds rules whose FROM is "minimum", so expanding them does
+// not iterate over billions of years.
+const firstRuleYear = 1800
+
+// localTimeType is one TZif local time type: a UT offset, whether it is
+// daylight saving time, and its abbreviation.
+type localTimeType struct {
+	utoff int64
+	dst   bool
+	abbr  string
+}
+
+// transition switches to a local time type at a UT time.
+type transition struct {
+	at  int64
+	typ localTimeType
+}
+
+// compiled is a zone reduced to what a TZif file holds.
+type compiled struct {
+	// initial is the type in effect before the first transition.
+	initial     localTimeType
+	transitions []transition
+	// footer is the POSIX TZ string for times after the last transition, or
+	// empty when the rules in effect cannot be expressed as one.
+	footer string
+	// extended is set when the footer uses the RFC 8536 version 3 extension:
+	// a transition time below zero or beyond 24 hours.
+	extended bool
+}
+
+// Compile returns the TZif file of a zone. A link name compiles to the file of
+// the zone it resolves to.
+func (db *Database) Compile(name string) ([]byte, error) {
+	zone, err := db.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := db.compileZone(zone)
+	if err != nil {
+		return nil, fmt.Errorf("zone %s: %w", zone, err)
+	}
+	return encodeTZif(c), nil
+}
+
+// ruleInstance is a rule applied to one year.
+type ruleInstance struct {
+	rule *rule
+	// local is the AT of the rule on its date, in seconds since the epoch as
+	// if that local clock were UT.
+	local int64
+}
+
+// ut converts the instance to UT, given the standard offset of the zone line
+// and the daylight saving amount in effect just before it.
+func (in ruleInstance) ut(stdoff, save int64) int64 {
+	return toUT(in.local, in.rule.atKind, stdoff, save)
+}
+
+func toUT(local int64, kind timeKind, stdoff, save int64) int64 {
+	switch kind {
+	case universalTime:
+		return local
+	case standardTime:
+		return local - stdoff
+	}
+	return local - stdoff - save
+}
+
+// compileZone walks the lines of a zone in order, emitting a transition at the
+// start of each line and at every rule transition within it.
+func (db *Database) compileZone(name string) (*compiled, error) {
+	lines := db.zones[name]
+	c := &compiled{}
+	emit := func(at int64, typ localTimeType) {
+		// A line starting at the same instant as a rule transition, or two
+		// rules of one set coinciding, leave only the last word.
+		for len(c.transitions) > 0 && c.transitions[len(c.transitions)-1].at >= at {
+			c.transitions = c.transitions[:len(c.transitions)-1]
+		}
+		c.transitions = append(c.transitions, transition{at: at, typ: typ})
+	}
+
+	// start is the UT time the current line takes over, unbounded for the
+	// first line.
+	start := int64(math.MinInt64)
+	var last localTimeType
+	for i, line := range lines {
+		first := i == 0
+		begin := func(typ localTimeType) {
+			if first {
+				c.initial = typ
+			} else {
+				emit(start, typ)
+			}
+		}
+
+		if line.rules == "" {
+			last = localTimeType{
+				utoff: line.stdoff + line.save,
+				dst:   line.dst,
+				abbr:  abbreviation(line.format, "", line.stdoff+line.save, line.dst),
+			}
+			begin(last)
+			if line.until != nil {
+				start = line.until.ut(line.stdoff, line.save)
+			}
+			continue
+		}
+
+		rules, ok := db.rules[line.rules]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown rule %q", line.pos, line.rules)
+		}
+		// Rules are expanded from their very first year, because the one in
+		// effect when the line starts may have taken effect long before.
+		toYear := lastTransitionYear
+		if line.until != nil && line.until.year < toYear {
+			toYear = line.until.year
+		}
+		instances := expandRules(rules, earliestYear(rules), toYear, line.stdoff)
+
+		// Until a rule says otherwise the line is on standard time, named with
+		// the letters of the first rule that sets standard time.
+		var save int64
+		var dst bool
+		letters := standardLetters(rules)
+		typ := func() localTimeType {
+			return localTimeType{
+				utoff: line.stdoff + save,
+				dst:   dst,
+				abbr:  abbreviation(line.format, letters, line.stdoff+save, dst),
+			}
+		}
+		begun := false
+		for _, in := range instances {
+			at := in.ut(line.stdoff, save)
+			if start != math.MinInt64 && at <= start {
+				// Already in effect when the line starts.
+				save, dst, letters = in.rule.save, in.rule.dst, in.rule.letters
+				continue
+			}
+			if !begun {
+				begin(typ())
+				begun = true
+			}
+			if line.until != nil && at >= line.until.ut(line.stdoff, save) {
+				break
+			}
+			save, dst, letters = in.rule.save, in.rule.dst, in.rule.letters
+			emit(at, typ())
+		}
+		if !begun {
+			begin(typ())
+		}
+		last = typ()
+		if line.until != nil {
+			start = line.until.ut(line.stdoff, save)
+		}
+	}
+
+	// Drop transitions that change nothing, which zone lines continuing the
+	// same time under a new rule set produce routinely.
+	previous := c.initial
+	kept := c.transitions[:0]
+	for _, tr := range c.transitions {
+		if tr.typ != previous {
+			kept = append(kept, tr)
+			previous = tr.typ
+		}
+	}
+	c.transitions = kept
+
+	c.footer, c.extended = db.footer(lines[len(lines)-1], last)
+	return c, nil
+}
+
+// ut converts an UNTIL to UT, given the standard offset of its line and the
+// daylight saving amount in effect at that moment.
+func (u *until) ut(stdoff, save int64) int64 {
+	return toUT(dayOf(u.year, u.month, u.on)*86400+u.at, u.atKind, stdoff, save)
+}
+
+// earliestYear returns the first year any rule of a set applies, but no
+// earlier than firstRuleYear.
+func earliestYear(rules []*rule) int {
+	earliest := lastTransitionYear
+	for _, r := range rules {
+		if r.from < earliest {
+			earliest = r.from
+		}
+	}
+	if earliest < firstRuleYear {
+		return firstRuleYear
+	}
+	return earliest
+}
+
+// standardLetters returns the LETTER/S of the earliest rule that sets standard
+// time, which names the time a zone line keeps before any of its rules apply.
+func standardLetters(rules []*rule) string {
+	var best *rule
+	for _, r := range rules {
+		if r.save == 0 && (best == nil || r.from < best.from || r.from == best.from && r.month < best.month) {
+			best = r
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.letters
+}
+
+// expandRules applies every rule of a set to each year it covers within
+// [fromYear, toYear], ordered by when the transitions happen.
+func expandRules(rules []*rule, fromYear, toYear int, stdoff int64) []ruleInstance {
+	var instances []ruleInstance
+	for _, r := range rules {
+		first, last := r.from, r.to
+		if first < fromYear {
+			first = fromYear
+		}
+		if last > toYear {
+			last = toYear
+		}
+		for year := first; year <= last; year++ {
+			instances = append(instances, ruleInstance{rule: r, local: dayOf(year, r.month, r.on)*86400 + r.at})
+		}
+	}
+	// Rules of one set are months apart, so ordering them on standard time is
+	// exact enough regardless of the daylight saving in effect.
+	key := func(in ruleInstance) int64 {
+		if in.rule.atKind == universalTime {
+			return in.local + stdoff
+		}
+		return in.local
+	}
+	sort.SliceStable(instances, func(i, j int) bool { return key(instances[i]) < key(instances[j]) })
+	return instances
+}
+
+// dayOf returns the day, counted from the Unix epoch, that an ON field selects
+// in a month. Weekday forms may step into the neighbouring month.
+func dayOf(year int, month time.Month, on daySpec) int64 {
+	date := func(day int) int64 {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / 86400
+	}
+	weekday := func(day int64) time.Weekday {
+		// 1970-01-01 was a Thursday.
+		return time.Weekday(((day+4)%7 + 7) % 7)
+	}
+	switch on.kind {
+	case dayLast:
+		day := date(1) + int64(time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()) - 1
+		return day - int64((weekday(day)-on.weekday+7)%7)
+	case dayOnOrAfter:
+		day := date(on.day)
+		return day + int64((on.weekday-weekday(day)+7)%7)
+	case dayOnOrBefore:
+		day := date(on.day)
+		return day - int64((weekday(day)-on.weekday+7)%7)
+	}
+	return date(on.day)
+}
+
+// abbreviation expands a zone line's FORMAT: "A/B" picks A for standard and B
+// for daylight saving time, "%s" is replaced by the rule's letters and "%z" by
+// the numeric UT offset.
+func abbreviation(format, letters string, utoff int64, dst bool) string {
+	if standard, daylight, ok := strings.Cut(format, "/"); ok {
+		if dst {
+			return daylight
+		}
+		return standard
+	}
+	format = strings.Replace(format, "%s", letters, 1)
+	return strings.Replace(format, "%z", numericOffset(utoff), 1)
+}
+
+// numericOffset formats a UT offset the way %z does: "+05", "+0530", "-03".
+func numericOffset(utoff int64) string {
+	sign := "+"
+	if utoff < 0 {
+		sign, utoff = "-", -utoff
+	}
+	hours, minutes, seconds := utoff/3600, utoff/60%60, utoff%60
+	switch {
+	case seconds != 0:
+		return fmt.Sprintf("%s%02d%02d%02d", sign, hours, minutes, seconds)
+	case minutes != 0:
+		return fmt.Sprintf("%s%02d%02d", sign, hours, minutes)
+	}
+	return fmt.Sprintf("%s%02d", sign, hours)
+}
+
+// footer returns the POSIX TZ string describing a zone after its last written
+// transition, from the zone's last line. A line on fixed time gives a string
+// without daylight saving; a rule set that switches indefinitely between a
+// standard and a daylight saving rule gives the full form. Anything else --
+// several rules continuing indefinitely, say -- has no TZ string, and readers
+// keep the last transition's type.
+func (db *Database) footer(line *zoneLine, last localTimeType) (string, bool) {
+	if line.until != nil {
+		return "", false
+	}
+	var ongoing []*rule
+	if line.rules != "" {
+		for _, r := range db.rules[line.rules] {
+			if r.to == yearMax {
+				ongoing = append(ongoing, r)
+			}
+		}
+	}
+	if len(ongoing) == 0 {
+		return posixAbbreviation(last.abbr) + posixTime(-last.utoff), false
+	}
+	if len(ongoing) != 2 {
+		return "", false
+	}
+	standard, daylight := ongoing[0], ongoing[1]
+	if standard.save != 0 {
+		standard, daylight = daylight, standard
+	}
+	if standard.save != 0 || daylight.save == 0 {
+		return "", false
+	}
+
+	// DST starts on the daylight rule, measured on the standard clock in
+	// effect before it, and ends on the standard rule, measured on the
+	// daylight clock.
+	startRule, startExtended, ok := posixRule(daylight, line.stdoff, 0)
+	if !ok {
+		return "", false
+	}
+	endRule, endExtended, ok := posixRule(standard, line.stdoff, daylight.save)
+	if !ok {
+		return "", false
+	}
+
+	var tz strings.Builder
+	tz.WriteString(posixAbbreviation(abbreviation(line.format, standard.letters, line.stdoff, false)))
+	tz.WriteString(posixTime(-line.stdoff))
+	tz.WriteString(posixAbbreviation(abbreviation(line.format, daylight.letters, line.stdoff+daylight.save, true)))
+	if daylight.save != 3600 {
+		tz.WriteString(posixTime(-(line.stdoff + daylight.save)))
+	}
+	tz.WriteString("," + startRule + "," + endRule)
+	return tz.String(), startExtended || endExtended
+}
+
+// posixRule renders the date and time of a rule as a TZ string rule: Mm.w.d
+// for the weekday forms, Jn for a fixed date. saveBefore is the daylight
+// saving in effect before the transition, which the wall clock time the TZ
+// string wants includes. It reports whether the time needs the version 3
+// extension, and fails for a date no TZ string form expresses.
+func posixRule(r *rule, stdoff, saveBefore int64) (string, bool, bool) {
+	wall := r.at
+	switch r.atKind {
+	case standardTime:
+		wall += saveBefore
+	case universalTime:
+		wall += stdoff + saveBefore
+	}
+
+	var date string
+	on := r.on
+	if on.kind == dayOnOrBefore {
+		// "Sun<=25" is the last Sunday of the seven days ending on the 25th,
+		// which is the first one on or after the 19th.
+		on = daySpec{kind: dayOnOrAfter, weekday: on.weekday, day: on.day - 6}
+		if on.day < 1 {
+			return "", false, false
+		}
+	}
+	switch on.kind {
+	case dayLast:
+		date = fmt.Sprintf("M%d.5.%d", r.month, on.weekday)
+	case dayOnOrAfter:
+		// Mm.w.d only expresses the weeks starting on the 1st, 8th, 15th and
+		// 22nd. "Fri>=23" is one day after "Thu>=22", so shift the weekday and
+		// the bound back into line and move the time forward instead.
+		shift := (on.day - 1) % 7
+		day := on.day - shift
+		if day > 22 {
+			return "", false, false
+		}
+		weekday := (int(on.weekday) - shift + 7) % 7
+		wall += int64(shift) * 86400
+		date = fmt.Sprintf("M%d.%d.%d", r.month, (day-1)/7+1, weekday)
+	default:
+		if r.month == time.February && on.day == 29 {
+			return "", false, false
+		}
+		// Jn counts the days of a non-leap year, which has the same day of
+		// year as any year for a date other than February 29.
+		date = fmt.Sprintf("J%d", time.Date(2001, r.month, on.day, 0, 0, 0, 0, time.UTC).YearDay())
+	}
+
+	extended := wall < 0 || wall > 24*3600
+	if wall != 2*3600 {
+		date += "/" + posixTime(wall)
+	}
+	return date, extended, true
+}
+
+// posixAbbreviation quotes an abbreviation in angle brackets unless it is
+// alphabetic, as a TZ string requires for names like "+03".
+func posixAbbreviation(abbr string) string {
+	for _, c := range abbr {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z') {
+			return "<" + abbr + ">"
+		}
+	}
+	if len(abbr) < 3 {
+		return "<" + abbr + ">"
+	}
+	return abbr
+}
+
+// posixTime formats seconds as [-]h[:mm[:ss]].
+func posixTime(seconds int64) string {
+	sign := ""
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	hours, minutes, secs := seconds/3600, seconds/60%60, seconds%60
+	switch {
+	case secs != 0:
+		return fmt.Sprintf("%s%d:%02d:%02d", sign, hours, minutes, secs)
+	case minutes != 0:
+		return fmt.Sprintf("%s%d:%02d", sign, hours, minutes)
+	}
+	return fmt.Sprintf("%s%d", sign, hours)
+}
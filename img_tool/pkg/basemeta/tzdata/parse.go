@@ -0,0 +1,592 @@
+// Package tzdata compiles the text sources of the IANA time zone database into
+// the TZif files (RFC 8536) that C libraries and most language runtimes read
+// zone rules from -- the job zic(8) does when a distribution builds its tzdata
+// package.
+//
+// The compiler accepts the source format zic documents: Rule, Zone and Link
+// lines, with keywords, months and weekdays abbreviated to any unambiguous
+// prefix, which covers both the per-continent files (africa, europe, ...) and
+// the condensed tzdata.zi. Leap second files are not supported: the "right/"
+// zones they produce are not what an image wants as its local time.
+//
+// Output follows zic's defaults where they matter to a reader: transitions are
+// written out through 2037, and the POSIX TZ string footer covers every time
+// after that.
+package tzdata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// yearMin and yearMax stand for the "minimum" and "maximum" years of a
+	// rule: the rule applies from the beginning of time, or indefinitely.
+	yearMin = math.MinInt32
+	yearMax = math.MaxInt32
+)
+
+// timeKind says which clock a time of day is measured on.
+type timeKind int
+
+const (
+	// wallClock is local time including any daylight saving in effect (no
+	// suffix, or "w").
+	wallClock timeKind = iota
+	// standardTime is local standard time, ignoring daylight saving ("s").
+	standardTime
+	// universalTime is UT ("u", "g" or "z").
+	universalTime
+)
+
+// dayKind is the form of a day-of-month specification.
+type dayKind int
+
+const (
+	dayFixed      dayKind = iota // "5"
+	dayLast                      // "lastSun"
+	dayOnOrAfter                 // "Sun>=8"
+	dayOnOrBefore                // "Sun<=25"
+)
+
+// daySpec is the ON field of a rule, or the day of an UNTIL.
+type daySpec struct {
+	kind    dayKind
+	weekday time.Weekday
+	day     int
+}
+
+// rule is one Rule line.
+type rule struct {
+	from, to int
+	month    time.Month
+	on       daySpec
+	at       int64
+	atKind   timeKind
+	save     int64
+	dst      bool
+	letters  string
+	pos      string
+}
+
+// until is the UNTIL of a zone line: the local time at which the next line
+// takes over.
+type until struct {
+	year   int
+	month  time.Month
+	on     daySpec
+	at     int64
+	atKind timeKind
+}
+
+// zoneLine is one line of a Zone: the first line or a continuation.
+type zoneLine struct {
+	stdoff int64
+	// rules names the Rule set in effect, or is empty when daylight saving is
+	// given by save and dst directly ("-" or a fixed amount).
+	rules  string
+	save   int64
+	dst    bool
+	format string
+	until  *until
+	pos    string
+}
+
+// Database holds parsed Rule, Zone and Link definitions. Rules may be used by
+// zones of another source file, so all files are parsed into one Database
+// before anything is compiled.
+type Database struct {
+	rules map[string][]*rule
+	zones map[string][]*zoneLine
+	links map[string]string
+	// defined records where each zone or link name was defined, so a
+	// redefinition can name both places.
+	defined map[string]string
+}
+
+// NewDatabase returns an empty Database.
+func NewDatabase() *Database {
+	return &Database{
+		rules:   make(map[string][]*rule),
+		zones:   make(map[string][]*zoneLine),
+		links:   make(map[string]string),
+		defined: make(map[string]string),
+	}
+}
+
+var (
+	lineKeywords = []string{"Rule", "Zone", "Link"}
+	monthNames   = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+	weekdayNames = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+)
+
+// lookupWord finds word in table the way zic does: an exact match, ignoring
+// case, or else a prefix of exactly one entry.
+func lookupWord(word string, table []string) (int, bool) {
+	if word == "" {
+		return -1, false
+	}
+	for i, entry := range table {
+		if strings.EqualFold(entry, word) {
+			return i, true
+		}
+	}
+	match := -1
+	for i, entry := range table {
+		if len(word) <= len(entry) && strings.EqualFold(entry[:len(word)], word) {
+			if match >= 0 {
+				return -1, false
+			}
+			match = i
+		}
+	}
+	return match, match >= 0
+}
+
+// Parse reads one source file into the database. fileName is only used in
+// error messages.
+func (db *Database) Parse(r io.Reader, fileName string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	// continuing is the zone whose last line had an UNTIL, so the next line
+	// must continue it.
+	var continuing string
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		pos := fmt.Sprintf("%s:%d", fileName, lineNumber)
+		fields := splitFields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		if continuing != "" {
+			var line *zoneLine
+			line, err = parseZoneLine(fields, pos)
+			if err == nil {
+				db.zones[continuing] = append(db.zones[continuing], line)
+				if line.until == nil {
+					continuing = ""
+				}
+			}
+		} else {
+			keyword, ok := lookupWord(fields[0], lineKeywords)
+			switch {
+			case !ok:
+				err = fmt.Errorf("unknown line type %q", fields[0])
+			case lineKeywords[keyword] == "Rule":
+				err = db.parseRule(fields[1:], pos)
+			case lineKeywords[keyword] == "Zone":
+				continuing, err = db.parseZone(fields[1:], pos)
+			default:
+				err = db.parseLink(fields[1:], pos)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", pos, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
+	}
+	if continuing != "" {
+		return fmt.Errorf("%s: zone %s ends with an UNTIL but has no continuation line", fileName, continuing)
+	}
+	return nil
+}
+
+// splitFields splits a source line into whitespace-separated fields, dropping
+// any comment. Double quotes group a field that contains spaces or "#".
+func splitFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inField, quoted := false, false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case quoted:
+			field.WriteRune(c)
+		case c == '#':
+			if inField {
+				fields = append(fields, field.String())
+			}
+			return fields
+		case c == ' ' || c == '\t' || c == '\f' || c == '\v' || c == '\r':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// parseRule parses the fields of a Rule line after the keyword:
+// NAME FROM TO - IN ON AT SAVE LETTER/S.
+func (db *Database) parseRule(fields []string, pos string) error {
+	if len(fields) != 9 {
+		return fmt.Errorf("a Rule line has 9 fields after the keyword, got %d", len(fields))
+	}
+	r := &rule{pos: pos}
+	var err error
+	if r.from, err = parseYear(fields[1]); err != nil {
+		return err
+	}
+	if i, ok := lookupWord(fields[2], []string{"minimum", "maximum", "only"}); ok && i == 2 {
+		r.to = r.from
+	} else if r.to, err = parseYear(fields[2]); err != nil {
+		return err
+	}
+	if r.to < r.from {
+		return fmt.Errorf("rule ends (%s) before it starts (%s)", fields[2], fields[1])
+	}
+	if fields[3] != "-" && fields[3] != "" {
+		return fmt.Errorf("rule types are obsolete and not supported, got %q", fields[3])
+	}
+	if r.month, err = parseMonth(fields[4]); err != nil {
+		return err
+	}
+	if r.on, err = parseDay(fields[5]); err != nil {
+		return err
+	}
+	if r.at, r.atKind, err = parseTimeOfDay(fields[6]); err != nil {
+		return err
+	}
+	if r.save, r.dst, err = parseSave(fields[7]); err != nil {
+		return err
+	}
+	if fields[8] != "-" {
+		r.letters = fields[8]
+	}
+	db.rules[fields[0]] = append(db.rules[fields[0]], r)
+	return nil
+}
+
+// parseZone parses the fields of a Zone line after the keyword: NAME and then
+// the fields of its first line. It returns the zone name when the line has an
+// UNTIL, and so must be continued.
+func (db *Database) parseZone(fields []string, pos string) (string, error) {
+	if len(fields) < 1 {
+		return "", fmt.Errorf("a Zone line needs a name")
+	}
+	name := fields[0]
+	if err := db.define(name, pos); err != nil {
+		return "", err
+	}
+	line, err := parseZoneLine(fields[1:], pos)
+	if err != nil {
+		return "", err
+	}
+	db.zones[name] = []*zoneLine{line}
+	if line.until != nil {
+		return name, nil
+	}
+	return "", nil
+}
+
+// parseLink parses the fields of a Link line after the keyword: TARGET
+// LINK-NAME.
+func (db *Database) parseLink(fields []string, pos string) error {
+	if len(fields) != 2 {
+		return fmt.Errorf("a Link line has 2 fields after the keyword, got %d", len(fields))
+	}
+	if err := db.define(fields[1], pos); err != nil {
+		return err
+	}
+	db.links[fields[1]] = fields[0]
+	return nil
+}
+
+// define claims a zone or link name.
+func (db *Database) define(name, pos string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if previous, ok := db.defined[name]; ok {
+		return fmt.Errorf("%s is already defined at %s", name, previous)
+	}
+	db.defined[name] = pos
+	return nil
+}
+
+// checkName rejects names that would not stay inside the zoneinfo directory
+// once used as a file path.
+func checkName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return fmt.Errorf("invalid zone name %q", name)
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || component == "." || component == ".." {
+			return fmt.Errorf("invalid zone name %q", name)
+		}
+	}
+	return nil
+}
+
+// parseZoneLine parses STDOFF RULES FORMAT [UNTIL].
+func parseZoneLine(fields []string, pos string) (*zoneLine, error) {
+	if len(fields) < 3 || len(fields) > 7 {
+		return nil, fmt.Errorf("a zone line has between 3 and 7 fields (STDOFF RULES FORMAT [UNTIL]), got %d", len(fields))
+	}
+	line := &zoneLine{format: fields[2], pos: pos}
+	var err error
+	if line.stdoff, err = parseDuration(fields[0]); err != nil {
+		return nil, fmt.Errorf("STDOFF: %w", err)
+	}
+	switch rules := fields[1]; {
+	case rules == "-" || rules == "":
+	case rules[0] == '-' || rules[0] >= '0' && rules[0] <= '9':
+		if line.save, line.dst, err = parseSave(rules); err != nil {
+			return nil, err
+		}
+	default:
+		line.rules = rules
+	}
+	if strings.Contains(line.format, "/") && strings.Contains(line.format, "%") {
+		return nil, fmt.Errorf("FORMAT %q mixes a slash with a %% directive", line.format)
+	}
+	if len(fields) > 3 {
+		if line.until, err = parseUntil(fields[3:]); err != nil {
+			return nil, fmt.Errorf("UNTIL: %w", err)
+		}
+	}
+	return line, nil
+}
+
+// parseUntil parses YEAR [MONTH [DAY [TIME]]].
+func parseUntil(fields []string) (*until, error) {
+	u := &until{month: time.January, on: daySpec{kind: dayFixed, day: 1}}
+	var err error
+	if u.year, err = parseYear(fields[0]); err != nil {
+		return nil, err
+	}
+	if u.year == yearMin {
+		return nil, fmt.Errorf("a zone line cannot end at the minimum year")
+	}
+	if len(fields) > 1 {
+		if u.month, err = parseMonth(fields[1]); err != nil {
+			return nil, err
+		}
+	}
+	if len(fields) > 2 {
+		if u.on, err = parseDay(fields[2]); err != nil {
+			return nil, err
+		}
+	}
+	if len(fields) > 3 {
+		if u.at, u.atKind, err = parseTimeOfDay(fields[3]); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// parseYear parses a year, or "minimum" or "maximum", which map to yearMin and
+// yearMax.
+func parseYear(s string) (int, error) {
+	if year, err := strconv.Atoi(s); err == nil {
+		return year, nil
+	}
+	i, ok := lookupWord(s, []string{"minimum", "maximum"})
+	if !ok {
+		return 0, fmt.Errorf("invalid year %q", s)
+	}
+	if i == 0 {
+		return yearMin, nil
+	}
+	return yearMax, nil
+}
+
+// parseMonth parses a month name or abbreviation.
+func parseMonth(s string) (time.Month, error) {
+	i, ok := lookupWord(s, monthNames)
+	if !ok {
+		return 0, fmt.Errorf("invalid month %q", s)
+	}
+	return time.Month(i + 1), nil
+}
+
+// parseWeekday parses a weekday name or abbreviation.
+func parseWeekday(s string) (time.Weekday, error) {
+	i, ok := lookupWord(s, weekdayNames)
+	if !ok {
+		return 0, fmt.Errorf("invalid weekday %q", s)
+	}
+	return time.Weekday(i), nil
+}
+
+// parseDay parses an ON field: "5", "lastSun", "Sun>=8" or "Sun<=25".
+func parseDay(s string) (daySpec, error) {
+	var spec daySpec
+	var dayField string
+	switch {
+	case len(s) > 4 && strings.EqualFold(s[:4], "last"):
+		weekday, err := parseWeekday(s[4:])
+		if err != nil {
+			return spec, err
+		}
+		return daySpec{kind: dayLast, weekday: weekday}, nil
+	case strings.Contains(s, ">="):
+		i := strings.Index(s, ">=")
+		weekday, err := parseWeekday(s[:i])
+		if err != nil {
+			return spec, err
+		}
+		spec = daySpec{kind: dayOnOrAfter, weekday: weekday}
+		dayField = s[i+2:]
+	case strings.Contains(s, "<="):
+		i := strings.Index(s, "<=")
+		weekday, err := parseWeekday(s[:i])
+		if err != nil {
+			return spec, err
+		}
+		spec = daySpec{kind: dayOnOrBefore, weekday: weekday}
+		dayField = s[i+2:]
+	default:
+		spec = daySpec{kind: dayFixed}
+		dayField = s
+	}
+	day, err := strconv.Atoi(dayField)
+	if err != nil || day < 1 || day > 31 {
+		return spec, fmt.Errorf("invalid day %q", s)
+	}
+	spec.day = day
+	return spec, nil
+}
+
+// parseTimeOfDay parses an AT field: a duration with an optional suffix naming
+// its clock.
+func parseTimeOfDay(s string) (int64, timeKind, error) {
+	kind := wallClock
+	if n := len(s); n > 1 {
+		switch s[n-1] {
+		case 'w':
+			s = s[:n-1]
+		case 's':
+			kind, s = standardTime, s[:n-1]
+		case 'u', 'g', 'z':
+			kind, s = universalTime, s[:n-1]
+		}
+	}
+	seconds, err := parseDuration(s)
+	return seconds, kind, err
+}
+
+// parseSave parses a SAVE field. The optional "s" or "d" suffix says whether
+// the amount counts as standard or daylight saving time; without one, any
+// non-zero amount is daylight saving time.
+func parseSave(s string) (int64, bool, error) {
+	indicator := byte(0)
+	if n := len(s); n > 1 && (s[n-1] == 's' || s[n-1] == 'd') {
+		indicator, s = s[n-1], s[:n-1]
+	}
+	seconds, err := parseDuration(s)
+	if err != nil {
+		return 0, false, fmt.Errorf("SAVE: %w", err)
+	}
+	switch indicator {
+	case 's':
+		return seconds, false, nil
+	case 'd':
+		return seconds, true, nil
+	}
+	return seconds, seconds != 0, nil
+}
+
+// parseDuration parses [-]hh[:mm[:ss[.fraction]]] into seconds, rounding any
+// fraction to the nearest second. "-" alone is zero.
+func parseDuration(s string) (int64, error) {
+	if s == "-" {
+		return 0, nil
+	}
+	sign := int64(1)
+	rest := s
+	if strings.HasPrefix(rest, "-") {
+		sign, rest = -1, rest[1:]
+	}
+	parts := strings.Split(rest, ":")
+	if rest == "" || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var seconds int64
+	for i, part := range parts {
+		if i == 2 {
+			if whole, fraction, ok := strings.Cut(part, "."); ok {
+				part = whole
+				if f, err := strconv.ParseFloat("0."+fraction, 64); err != nil {
+					return 0, fmt.Errorf("invalid time %q", s)
+				} else if f >= 0.5 {
+					seconds++
+				}
+			}
+		}
+		value, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || value < 0 || i > 0 && (len(part) != 2 || value > 59) {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		switch i {
+		case 0:
+			seconds += value * 3600
+		case 1:
+			seconds += value * 60
+		default:
+			seconds += value
+		}
+	}
+	return sign * seconds, nil
+}
+
+// Zones returns the names of the zones defined so far, sorted.
+func (db *Database) Zones() []string {
+	names := make([]string, 0, len(db.zones))
+	for name := range db.zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Links returns the links defined so far, as link name to target name. The
+// target may itself be a link; see Resolve.
+func (db *Database) Links() map[string]string {
+	links := make(map[string]string, len(db.links))
+	for name, target := range db.links {
+		links[name] = target
+	}
+	return links
+}
+
+// Resolve follows links from name to the zone they end at. A zone name
+// resolves to itself.
+func (db *Database) Resolve(name string) (string, error) {
+	seen := make(map[string]bool)
+	for {
+		if _, ok := db.zones[name]; ok {
+			return name, nil
+		}
+		target, ok := db.links[name]
+		if !ok {
+			return "", fmt.Errorf("unknown time zone %q", name)
+		}
+		if seen[name] {
+			return "", fmt.Errorf("link loop through %q", name)
+		}
+		seen[name] = true
+		name = target
+	}
+}
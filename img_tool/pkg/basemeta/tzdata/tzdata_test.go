@@ -0,0 +1,219 @@
+package tzdata
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// usRules are the United States rules since 1967, as the northamerica file of
+// the IANA database has them.
+const usRules = `
+# Rule	NAME	FROM	TO	-	IN	ON	AT	SAVE	LETTER/S
+Rule	US	1967	2006	-	Oct	lastSun	2:00	0	S
+Rule	US	1967	1973	-	Apr	lastSun	2:00	1:00	D
+Rule	US	1974	only	-	Jan	6	2:00	1:00	D
+Rule	US	1975	only	-	Feb	lastSun	2:00	1:00	D
+Rule	US	1976	1986	-	Apr	lastSun	2:00	1:00	D
+Rule	US	1987	2006	-	Apr	Sun>=1	2:00	1:00	D
+Rule	US	2007	max	-	Mar	Sun>=8	2:00	1:00	D
+Rule	US	2007	max	-	Nov	Sun>=1	2:00	0	S
+`
+
+// compile parses sources into a fresh database and compiles one zone.
+func compile(t *testing.T, name string, sources ...string) []byte {
+	t.Helper()
+	db := NewDatabase()
+	for i, source := range sources {
+		if err := db.Parse(strings.NewReader(source), "source"+string(rune('0'+i))); err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+	}
+	data, err := db.Compile(name)
+	if err != nil {
+		t.Fatalf("Compile(%s): %v", name, err)
+	}
+	return data
+}
+
+// footerOf returns the TZ string at the end of a TZif file.
+func footerOf(data []byte) string {
+	trimmed := bytes.TrimSuffix(data, []byte("\n"))
+	return string(trimmed[bytes.LastIndexByte(trimmed, '\n')+1:])
+}
+
+// compareWithReference checks that a compiled zone agrees with Go's embedded
+// copy of the IANA database on the offset and abbreviation at, and just
+// before, every transition of the reference zone between from and to.
+func compareWithReference(t *testing.T, data []byte, reference string, from, to time.Time) {
+	t.Helper()
+	got, err := time.LoadLocationFromTZData(reference, data)
+	if err != nil {
+		t.Fatalf("LoadLocationFromTZData: %v", err)
+	}
+	want, err := time.LoadLocation(reference)
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	checked := 0
+	for at := from; at.Before(to); {
+		for _, instant := range []time.Time{at, at.Add(-time.Second)} {
+			gotName, gotOffset := instant.In(got).Zone()
+			wantName, wantOffset := instant.In(want).Zone()
+			if gotName != wantName || gotOffset != wantOffset {
+				t.Fatalf("at %s: got %s %d, want %s %d", instant.UTC(), gotName, gotOffset, wantName, wantOffset)
+			}
+			checked++
+		}
+		_, end := at.In(want).ZoneBounds()
+		if end.IsZero() {
+			break
+		}
+		if !end.After(at) {
+			// ZoneBounds can report a year boundary of the TZ string range
+			// as the end of the zone that starts there; step past it.
+			end = at.Add(24 * time.Hour)
+		}
+		at = end
+	}
+	if checked < 100 {
+		t.Fatalf("only %d instants compared", checked)
+	}
+}
+
+// TestCompileRules checks a zone on a rule set against the real
+// America/New_York across the US rule changes of 1974, 1987 and 2007 and
+// well past 2037, where only the TZ string footer describes it.
+func TestCompileRules(t *testing.T) {
+	data := compile(t, "Test/New_York", usRules, "Zone Test/New_York -5:00 US E%sT\n")
+
+	compareWithReference(t, data, "America/New_York",
+		time.Date(1968, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC))
+	if footer := footerOf(data); footer != "EST5EDT,M3.2.0,M11.1.0" {
+		t.Errorf("footer = %q", footer)
+	}
+	if !bytes.HasPrefix(data, []byte("TZif2")) {
+		t.Errorf("data starts with %q, want a version 2 TZif file", data[:5])
+	}
+}
+
+// TestCompileNegativeSave checks Europe/Dublin's rules, where summer time is
+// standard time and winter time a negative daylight saving, with transitions
+// given in UT. The footer must measure each transition on the clock before it.
+func TestCompileNegativeSave(t *testing.T) {
+	data := compile(t, "Test/Dublin", `
+Rule	Eire	1981	max	-	Mar	lastSun	 1:00u	0	-
+Rule	Eire	1996	max	-	Oct	lastSun	 1:00u	-1:00	-
+Zone	Test/Dublin	1:00	Eire	IST/GMT
+`)
+
+	compareWithReference(t, data, "Europe/Dublin",
+		time.Date(1997, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC))
+	if footer := footerOf(data); footer != "IST-1GMT0,M10.5.0,M3.5.0/1" {
+		t.Errorf("footer = %q", footer)
+	}
+}
+
+// TestCompileLines checks a zone of several lines in the condensed tzdata.zi
+// syntax: local mean time before the first transition, UNTIL in UT and in
+// local time, fixed daylight saving with a numeric %z abbreviation, and a
+// link compiling to the same file as its zone.
+func TestCompileLines(t *testing.T) {
+	source := `
+Z Test/Kolkata 5:53:28 - LMT 1854 Jun 28
+5:53:20 - HMT 1870
+5:21:10 - MMT 1906
+5:30 - IST 1941 O
+5:30 1 %z 1942 May 15
+5:30 - IST 1942 S
+5:30 1 %z 1945 O 15
+5:30 - IST
+L Test/Kolkata Test/Calcutta
+`
+	data := compile(t, "Test/Kolkata", source)
+	loc, err := time.LoadLocationFromTZData("Test/Kolkata", data)
+	if err != nil {
+		t.Fatalf("LoadLocationFromTZData: %v", err)
+	}
+	for _, tc := range []struct {
+		at     time.Time
+		name   string
+		offset int
+	}{
+		{time.Date(1800, 1, 1, 0, 0, 0, 0, time.UTC), "LMT", 5*3600 + 53*60 + 28},
+		{time.Date(1860, 1, 1, 0, 0, 0, 0, time.UTC), "HMT", 5*3600 + 53*60 + 20},
+		{time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC), "MMT", 5*3600 + 21*60 + 10},
+		// 1906 Jan 1 00:00 MMT is 1905-12-31 18:38:50 UT.
+		{time.Date(1905, 12, 31, 18, 38, 49, 0, time.UTC), "MMT", 5*3600 + 21*60 + 10},
+		{time.Date(1905, 12, 31, 18, 38, 50, 0, time.UTC), "IST", 5*3600 + 30*60},
+		{time.Date(1942, 1, 1, 0, 0, 0, 0, time.UTC), "+0630", 6*3600 + 30*60},
+		{time.Date(1942, 6, 1, 0, 0, 0, 0, time.UTC), "IST", 5*3600 + 30*60},
+		{time.Date(1944, 1, 1, 0, 0, 0, 0, time.UTC), "+0630", 6*3600 + 30*60},
+		{time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), "IST", 5*3600 + 30*60},
+	} {
+		if name, offset := tc.at.In(loc).Zone(); name != tc.name || offset != tc.offset {
+			t.Errorf("at %s: got %s %d, want %s %d", tc.at, name, offset, tc.name, tc.offset)
+		}
+	}
+	if footer := footerOf(data); footer != "IST-5:30" {
+		t.Errorf("footer = %q", footer)
+	}
+	if link := compile(t, "Test/Calcutta", source); !bytes.Equal(link, data) {
+		t.Errorf("the link compiled to a different file than its zone")
+	}
+}
+
+// TestFooterShiftedWeekday checks a rule on a weekday whose bound does not
+// start a week: "Fri>=23" becomes "Thu>=22" one day later, which needs the
+// version 3 extension for hours past 24.
+func TestFooterShiftedWeekday(t *testing.T) {
+	data := compile(t, "Test/Jerusalem", `
+R Zion 2013 ma - Mar F>=23 2 1 D
+R Zion 2013 ma - O lastSu 2 0 S
+Z Test/Jerusalem 2 Zion I%sT
+`)
+	if footer := footerOf(data); footer != "IST-2IDT,M3.4.4/26,M10.5.0" {
+		t.Errorf("footer = %q", footer)
+	}
+	if !bytes.HasPrefix(data, []byte("TZif3")) {
+		t.Errorf("data starts with %q, want a version 3 TZif file", data[:5])
+	}
+	compareWithReference(t, data, "Asia/Jerusalem",
+		time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// TestParseErrors checks that mistakes in a source name the file and line.
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		want   string
+	}{
+		{"Rule X 2000 only - Foo 1 0 1:00 D\n", `f:1: invalid month "Foo"`},
+		{"\nZone A 1:00 - A 2000\n", "zone A ends with an UNTIL but has no continuation line"},
+		{"Zone A 1:00 - A\nLink B A\n", "f:2: A is already defined at f:1"},
+		{"Link A ../etc\n", `invalid zone name "../etc"`},
+		{"Leap 2016 Dec 31 23:59:60 + S\n", `unknown line type "Leap"`},
+		{"Rule X 2000 only - Ma 1 0 1:00 D\n", `invalid month "Ma"`},
+	} {
+		err := NewDatabase().Parse(strings.NewReader(tc.source), "f")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Parse(%q) = %v, want an error containing %q", tc.source, err, tc.want)
+		}
+	}
+
+	db := NewDatabase()
+	if err := db.Parse(strings.NewReader("Zone A 1:00 Nope A%sT\n"), "f"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Compile("A"); err == nil || !strings.Contains(err.Error(), `f:1: unknown rule "Nope"`) {
+		t.Errorf("Compile = %v, want an unknown rule error", err)
+	}
+	if _, err := db.Compile("B"); err == nil {
+		t.Errorf("Compile of an undefined zone succeeded")
+	}
+}
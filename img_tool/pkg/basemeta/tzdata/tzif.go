@@ -0,0 +1,83 @@
+package tzdata
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// encodeTZif writes a compiled zone as a TZif file (RFC 8536).
+//
+// The version 1 block, which only 32-bit readers that predate 2005 use, is
+// left minimal -- one type and no transitions -- the way zic's default "slim"
+// output does. Every reader in an image today reads the 64-bit block after it
+// and the TZ string footer.
+func encodeTZif(c *compiled) []byte {
+	version := byte('2')
+	if c.extended {
+		version = '3'
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, version, 0, 1, 1)
+	// The single version 1 type: UT, no abbreviation.
+	buf.Write([]byte{0, 0, 0, 0, 0, 0})
+	buf.WriteByte(0)
+
+	// Types are numbered in order of first use, starting with the initial
+	// type: a reader takes type 0 for times before the first transition.
+	typeIndex := make(map[localTimeType]int)
+	var types []localTimeType
+	addType := func(typ localTimeType) int {
+		if index, ok := typeIndex[typ]; ok {
+			return index
+		}
+		typeIndex[typ] = len(types)
+		types = append(types, typ)
+		return len(types) - 1
+	}
+	addType(c.initial)
+	indices := make([]byte, len(c.transitions))
+	for i, tr := range c.transitions {
+		indices[i] = byte(addType(tr.typ))
+	}
+
+	var chars []byte
+	abbrIndex := make(map[string]int)
+	for _, typ := range types {
+		if _, ok := abbrIndex[typ.abbr]; !ok {
+			abbrIndex[typ.abbr] = len(chars)
+			chars = append(chars, typ.abbr...)
+			chars = append(chars, 0)
+		}
+	}
+
+	writeHeader(&buf, version, len(c.transitions), len(types), len(chars))
+	for _, tr := range c.transitions {
+		binary.Write(&buf, binary.BigEndian, tr.at)
+	}
+	buf.Write(indices)
+	for _, typ := range types {
+		binary.Write(&buf, binary.BigEndian, int32(typ.utoff))
+		dst := byte(0)
+		if typ.dst {
+			dst = 1
+		}
+		buf.WriteByte(dst)
+		buf.WriteByte(byte(abbrIndex[typ.abbr]))
+	}
+	buf.Write(chars)
+
+	buf.WriteString("\n" + c.footer + "\n")
+	return buf.Bytes()
+}
+
+// writeHeader writes a TZif header. There are no leap seconds and no
+// standard/wall or UT/local indicators: the counts of all three are zero.
+func writeHeader(buf *bytes.Buffer, version byte, timecnt, typecnt, charcnt int) {
+	buf.WriteString("TZif")
+	buf.WriteByte(version)
+	buf.Write(make([]byte, 15))
+	for _, count := range []int{0, 0, 0, timecnt, typecnt, charcnt} {
+		binary.Write(buf, binary.BigEndian, uint32(count))
+	}
+}
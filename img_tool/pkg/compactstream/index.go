@@ -0,0 +1,470 @@
+package compactstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"slices"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compress"
+)
+
+const (
+	indexMagic = "CSTIDX"
+
+	// IndexFormatVersion is the on-disk format version of a random access
+	// index, written to and validated in its header.
+	IndexFormatVersion uint8 = 0x01
+
+	indexHeaderSize = 80
+	frameEntrySize  = 36
+
+	// maxIndexFrames and maxIndexTailSize bound what ReadIndex allocates for
+	// a malformed index. An eStargz layer has one frame per file chunk, and
+	// its tail is the compressed TOC, which lists every entry once.
+	maxIndexFrames   uint64 = 1 << 26
+	maxIndexTailSize uint64 = 1 << 30 // 1 GiB
+)
+
+// Index maps offsets of the layer a compact stream reconstructs to the data
+// that produces them, so a RandomAccessReader can serve a read at any offset
+// without reconstructing the layer from the start. See docs/compact-stream.md
+// for the on-disk layout of an index.
+//
+// Offsets of the uncompressed tar follow from the compact stream alone: the CAS
+// reference table records where every referenced range starts, and the byte
+// stream holds everything in between. Offsets of the compressed layer also
+// need the points at which the compressor started over. An eStargz layer
+// compresses every file chunk as a separate gzip member or zstd frame, so one
+// chunk can be compressed again on its own; these are the Frames. The TOC and
+// footer that follow the last frame are not derived from the tar, so the index
+// keeps them verbatim as the Tail.
+//
+// Building the frames needs the compressed layer once, which is why an index
+// is meant to be built next to the compact stream and cached alongside it.
+type Index struct {
+	// CompactStreamDigest is the sha256 of the compact stream the index was
+	// built from. A RandomAccessReader refuses an index built for another
+	// stream.
+	CompactStreamDigest []byte
+	// UncompressedSize is the size of the reconstructed, uncompressed tar.
+	UncompressedSize uint64
+	// CompressedSize is the size of the reconstructed layer blob, including
+	// any end padding. For an uncompressed layer it is the tar plus padding.
+	CompressedSize uint64
+	// Frames are the independently compressed parts of a seekable layer, in
+	// order and without gaps, starting at offset zero. They are empty for an
+	// uncompressed layer and for compressed layers that cannot be recompressed
+	// piecewise; those are served by recompressing from the start.
+	Frames []Frame
+	// TailOffset is where the payload derived from the tar ends in the layer
+	// blob: the end of the last frame, or of the whole compressed stream when
+	// there are no frames. Tail and then the end padding follow it.
+	TailOffset uint64
+	// Tail holds the bytes of a seekable layer after its last frame (the TOC
+	// and footer).
+	Tail []byte
+}
+
+// Frame is a range of the compressed layer that decompresses to a range of
+// the uncompressed tar on its own.
+type Frame struct {
+	UncompressedOffset uint64
+	UncompressedSize   uint64
+	CompressedOffset   uint64
+	CompressedSize     uint64
+	// CRC32 is the IEEE CRC-32 of the compressed frame. A recompressed frame
+	// must match it, which catches content store blobs that changed since the
+	// index was built.
+	CRC32 uint32
+}
+
+// compactStream is a compact stream held in memory, with its byte stream
+// decompressed, as random access needs it.
+type compactStream struct {
+	header Header
+	refs   []CASReference
+	// refBytes[i] is the total size of refs[:i], so the inline bytes before
+	// uncompressed offset o with refs[:i] ending at or before o start at
+	// o - refBytes[i] in stream.
+	refBytes []uint64
+	stream   []byte
+}
+
+func parseCompactStream(data []byte) (*compactStream, error) {
+	r := bytes.NewReader(data)
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := readRefTable(r, header)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := streamReader(r, header.StreamCompression)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := sr.(io.Closer); ok {
+		defer closer.Close()
+	}
+	stream, err := io.ReadAll(sr)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing byte stream: %w", err)
+	}
+
+	refBytes := make([]uint64, len(refs)+1)
+	for i, ref := range refs {
+		// A ref cannot start inside the byte stream bytes that precede it.
+		if ref.Offset < refBytes[i] || ref.Offset-refBytes[i] > uint64(len(stream)) {
+			return nil, fmt.Errorf("CAS ref %d at offset %d lies beyond the byte stream", i, ref.Offset)
+		}
+		refBytes[i+1] = refBytes[i] + ref.Size
+	}
+	return &compactStream{
+		header:   header,
+		refs:     refs,
+		refBytes: refBytes,
+		stream:   stream,
+	}, nil
+}
+
+// size is the size of the reconstructed, uncompressed tar.
+func (cs *compactStream) size() uint64 {
+	return uint64(len(cs.stream)) + cs.refBytes[len(cs.refs)]
+}
+
+// BuildIndex builds the random access index of a compact stream. blob is the
+// layer the compact stream reconstructs, of blobSize bytes (for example the
+// layer file written next to the compact stream, or its reconstruction). It
+// may be nil for an uncompressed layer, whose offsets follow from the compact
+// stream alone.
+//
+// For a seekable (eStargz) layer, every frame is decompressed, checked against
+// the compact stream (inline bytes verbatim, CAS references by digest) and
+// compressed again to prove that it can be reproduced on its own. Layers with
+// prioritized files are reordered relative to the compact stream, so they get
+// no frames, like non-seekable layers. So do zstd:chunked layers, whose frames
+// are not indexed (yet).
+func BuildIndex(compactStreamData []byte, blob io.ReaderAt, blobSize int64) (*Index, error) {
+	cs, err := parseCompactStream(compactStreamData)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(compactStreamData)
+	idx := &Index{
+		CompactStreamDigest: digest[:],
+		UncompressedSize:    cs.size(),
+	}
+
+	origComp := cs.header.OriginalCompression
+	if origComp.Compression == OriginalCompressionNone {
+		idx.TailOffset = idx.UncompressedSize
+		idx.CompressedSize = idx.UncompressedSize + uint64(origComp.EndPadding)
+		return idx, nil
+	}
+
+	if blob == nil {
+		return nil, fmt.Errorf("building the index of a compressed layer needs the layer blob")
+	}
+	if cs.header.HasCompressedStreamInfo && uint64(blobSize) != cs.header.CompressedStreamSize {
+		return nil, fmt.Errorf("layer blob is %d bytes, but the compact stream reconstructs %d bytes", blobSize, cs.header.CompressedStreamSize)
+	}
+	if blobSize < int64(origComp.EndPadding) {
+		return nil, fmt.Errorf("layer blob of %d bytes is shorter than its end padding of %d bytes", blobSize, origComp.EndPadding)
+	}
+	idx.CompressedSize = uint64(blobSize)
+	idx.TailOffset = uint64(blobSize) - uint64(origComp.EndPadding)
+
+	if !origComp.Seekable || origComp.ZstdChunked || len(origComp.PrioritizedFiles) > 0 {
+		return idx, nil
+	}
+	if err := indexEstargzFrames(idx, cs, blob); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// indexEstargzFrames finds the frames of an eStargz layer from its TOC: every
+// chunk of a regular file starts a new gzip member or zstd frame, and so does
+// the start of the layer.
+func indexEstargzFrames(idx *Index, cs *compactStream, blob io.ReaderAt) error {
+	origComp := cs.header.OriginalCompression
+	var format string
+	var decompressor estargz.Decompressor
+	switch origComp.Compression {
+	case OriginalCompressionGzip:
+		format = "gzip"
+		decompressor = new(estargz.GzipDecompressor)
+	case OriginalCompressionZstd:
+		format = "zstd"
+		decompressor = new(zstdchunked.Decompressor)
+	default:
+		return fmt.Errorf("unsupported original compression: %d", origComp.Compression)
+	}
+	compressor, err := compress.NewEstargzCompressor(format, int(origComp.CompressionLevel))
+	if err != nil {
+		return err
+	}
+
+	payloadEnd := int64(idx.TailOffset)
+	footerSize := decompressor.FooterSize()
+	if payloadEnd < footerSize {
+		return fmt.Errorf("layer of %d bytes is too short for an eStargz footer", payloadEnd)
+	}
+	footer := make([]byte, footerSize)
+	if _, err := blob.ReadAt(footer, payloadEnd-footerSize); err != nil {
+		return fmt.Errorf("reading eStargz footer: %w", err)
+	}
+	framesEnd, tocOffset, tocSize, err := decompressor.ParseFooter(footer)
+	if err != nil {
+		return fmt.Errorf("parsing eStargz footer: %w", err)
+	}
+	if tocSize <= 0 {
+		tocSize = payloadEnd - footerSize - tocOffset
+	}
+	if framesEnd < 0 || framesEnd > payloadEnd || tocOffset < 0 || tocSize < 0 || tocOffset+tocSize > payloadEnd {
+		return fmt.Errorf("eStargz footer points outside the layer")
+	}
+	toc, _, err := decompressor.ParseTOC(io.NewSectionReader(blob, tocOffset, tocSize))
+	if err != nil {
+		return fmt.Errorf("parsing eStargz TOC: %w", err)
+	}
+
+	starts := []int64{0}
+	for _, entry := range toc.Entries {
+		if entry.Offset > 0 && entry.Offset < framesEnd {
+			starts = append(starts, entry.Offset)
+		}
+	}
+	slices.Sort(starts)
+	// Entries that share a frame (the chunks of a file below the minimum
+	// chunk size) record the same offset.
+	starts = slices.Compact(starts)
+
+	verifier := &tarVerifier{cs: cs}
+	var frames []Frame
+	for i, start := range starts {
+		end := framesEnd
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+
+		raw := make([]byte, end-start)
+		if _, err := blob.ReadAt(raw, start); err != nil {
+			return fmt.Errorf("reading frame at offset %d: %w", start, err)
+		}
+		zr, err := decompressor.Reader(bytes.NewReader(raw))
+		if err != nil {
+			return fmt.Errorf("decompressing frame at offset %d: %w", start, err)
+		}
+		data, err := io.ReadAll(zr)
+		zr.Close()
+		if err != nil {
+			return fmt.Errorf("decompressing frame at offset %d: %w", start, err)
+		}
+
+		uncompressedOffset := verifier.pos
+		if _, err := verifier.Write(data); err != nil {
+			return err
+		}
+
+		var recompressed bytes.Buffer
+		if err := compressFrame(compressor, &recompressed, data, end == framesEnd); err != nil {
+			return fmt.Errorf("recompressing frame at offset %d: %w", start, err)
+		}
+		if !bytes.Equal(recompressed.Bytes(), raw) {
+			return fmt.Errorf("frame at offset %d cannot be reproduced by compressing it on its own", start)
+		}
+
+		frames = append(frames, Frame{
+			UncompressedOffset: uncompressedOffset,
+			UncompressedSize:   uint64(len(data)),
+			CompressedOffset:   uint64(start),
+			CompressedSize:     uint64(len(raw)),
+			CRC32:              crc32.ChecksumIEEE(raw),
+		})
+	}
+
+	tail := make([]byte, payloadEnd-framesEnd)
+	if _, err := blob.ReadAt(tail, framesEnd); err != nil {
+		return fmt.Errorf("reading eStargz TOC and footer: %w", err)
+	}
+	idx.Frames = frames
+	idx.TailOffset = uint64(framesEnd)
+	idx.Tail = tail
+	return nil
+}
+
+// compressFrame compresses data as a single gzip member or zstd frame, the way
+// the estargz writer compresses a chunk: it flushes before closing every
+// frame but the last one, which is closed when the writer is closed.
+func compressFrame(compressor estargz.Compressor, w io.Writer, data []byte, last bool) error {
+	zw, err := compressor.Writer(w)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		zw.Close()
+		return err
+	}
+	if !last {
+		if err := zw.Flush(); err != nil {
+			zw.Close()
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// tarVerifier checks that the bytes written to it are the uncompressed tar the
+// compact stream reconstructs: inline bytes must equal the byte stream, and
+// every CAS-referenced range must hash to its recorded digest. It verifies
+// without the content store, so an index can be built from a layer blob alone.
+type tarVerifier struct {
+	cs     *compactStream
+	pos    uint64
+	refIdx int
+	refH   hash.Hash
+}
+
+func (v *tarVerifier) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		rest := p[written:]
+		var n int
+		if v.refIdx < len(v.cs.refs) && v.pos >= v.cs.refs[v.refIdx].Offset {
+			ref := v.cs.refs[v.refIdx]
+			n = int(min(uint64(len(rest)), ref.Offset+ref.Size-v.pos))
+			if v.refH == nil {
+				v.refH = sha256.New()
+			}
+			v.refH.Write(rest[:n])
+			if v.pos+uint64(n) == ref.Offset+ref.Size {
+				if !bytes.Equal(v.refH.Sum(nil), ref.Digest) {
+					return written, fmt.Errorf("layer does not match the compact stream: content at offset %d does not match CAS ref %d", ref.Offset, v.refIdx)
+				}
+				v.refH = nil
+				v.refIdx++
+			}
+		} else {
+			end := v.cs.size()
+			if v.refIdx < len(v.cs.refs) {
+				end = v.cs.refs[v.refIdx].Offset
+			}
+			if v.pos >= end {
+				return written, fmt.Errorf("layer does not match the compact stream: it continues past offset %d", v.pos)
+			}
+			n = int(min(uint64(len(rest)), end-v.pos))
+			streamPos := v.pos - v.cs.refBytes[v.refIdx]
+			if !bytes.Equal(rest[:n], v.cs.stream[streamPos:streamPos+uint64(n)]) {
+				return written, fmt.Errorf("layer does not match the compact stream between offsets %d and %d", v.pos, v.pos+uint64(n))
+			}
+		}
+		v.pos += uint64(n)
+		written += n
+	}
+	return written, nil
+}
+
+// WriteTo writes the index in its on-disk format.
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+	if len(idx.CompactStreamDigest) != sha256.Size {
+		return 0, fmt.Errorf("compact stream digest length %d does not match SHA-256", len(idx.CompactStreamDigest))
+	}
+	buf := make([]byte, indexHeaderSize, indexHeaderSize+len(idx.Frames)*frameEntrySize+len(idx.Tail))
+	copy(buf[0:6], indexMagic)
+	buf[6] = 0x00
+	buf[7] = IndexFormatVersion
+	copy(buf[8:40], idx.CompactStreamDigest)
+	binary.BigEndian.PutUint64(buf[40:48], idx.UncompressedSize)
+	binary.BigEndian.PutUint64(buf[48:56], idx.CompressedSize)
+	binary.BigEndian.PutUint64(buf[56:64], idx.TailOffset)
+	binary.BigEndian.PutUint64(buf[64:72], uint64(len(idx.Tail)))
+	binary.BigEndian.PutUint64(buf[72:80], uint64(len(idx.Frames)))
+	for _, f := range idx.Frames {
+		var entry [frameEntrySize]byte
+		binary.BigEndian.PutUint64(entry[0:8], f.UncompressedOffset)
+		binary.BigEndian.PutUint64(entry[8:16], f.UncompressedSize)
+		binary.BigEndian.PutUint64(entry[16:24], f.CompressedOffset)
+		binary.BigEndian.PutUint64(entry[24:32], f.CompressedSize)
+		binary.BigEndian.PutUint32(entry[32:36], f.CRC32)
+		buf = append(buf, entry[:]...)
+	}
+	buf = append(buf, idx.Tail...)
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadIndex reads and validates an index written by Index.WriteTo.
+func ReadIndex(r io.Reader) (*Index, error) {
+	var raw [indexHeaderSize]byte
+	if _, err := io.ReadFull(r, raw[:]); err != nil {
+		return nil, fmt.Errorf("reading random access index header: %w", err)
+	}
+	if string(raw[0:6]) != indexMagic || raw[6] != 0x00 {
+		return nil, fmt.Errorf("invalid random access index magic: %q", raw[0:7])
+	}
+	if raw[7] != IndexFormatVersion {
+		return nil, fmt.Errorf("unsupported random access index version: %d", raw[7])
+	}
+	idx := &Index{
+		CompactStreamDigest: bytes.Clone(raw[8:40]),
+		UncompressedSize:    binary.BigEndian.Uint64(raw[40:48]),
+		CompressedSize:      binary.BigEndian.Uint64(raw[48:56]),
+		TailOffset:          binary.BigEndian.Uint64(raw[56:64]),
+	}
+	tailSize := binary.BigEndian.Uint64(raw[64:72])
+	frameCount := binary.BigEndian.Uint64(raw[72:80])
+	if frameCount > maxIndexFrames {
+		return nil, fmt.Errorf("frame count %d exceeds maximum %d", frameCount, maxIndexFrames)
+	}
+	if tailSize > maxIndexTailSize {
+		return nil, fmt.Errorf("tail size %d exceeds maximum %d", tailSize, maxIndexTailSize)
+	}
+	if idx.TailOffset > idx.CompressedSize || tailSize > idx.CompressedSize-idx.TailOffset {
+		return nil, fmt.Errorf("tail at offset %d (%d bytes) exceeds the compressed size %d", idx.TailOffset, tailSize, idx.CompressedSize)
+	}
+
+	frameData := make([]byte, frameCount*frameEntrySize)
+	if _, err := io.ReadFull(r, frameData); err != nil {
+		return nil, fmt.Errorf("reading frames: %w", err)
+	}
+	var uncompressedEnd, compressedEnd uint64
+	for i := uint64(0); i < frameCount; i++ {
+		entry := frameData[i*frameEntrySize : (i+1)*frameEntrySize]
+		f := Frame{
+			UncompressedOffset: binary.BigEndian.Uint64(entry[0:8]),
+			UncompressedSize:   binary.BigEndian.Uint64(entry[8:16]),
+			CompressedOffset:   binary.BigEndian.Uint64(entry[16:24]),
+			CompressedSize:     binary.BigEndian.Uint64(entry[24:32]),
+			CRC32:              binary.BigEndian.Uint32(entry[32:36]),
+		}
+		// Frames tile the payload in both the uncompressed tar and the blob.
+		if f.UncompressedOffset != uncompressedEnd || f.CompressedOffset != compressedEnd {
+			return nil, fmt.Errorf("frame %d does not follow the previous frame", i)
+		}
+		if f.UncompressedSize > idx.UncompressedSize-uncompressedEnd || f.CompressedSize > idx.TailOffset-compressedEnd {
+			return nil, fmt.Errorf("frame %d exceeds the layer", i)
+		}
+		uncompressedEnd += f.UncompressedSize
+		compressedEnd += f.CompressedSize
+		idx.Frames = append(idx.Frames, f)
+	}
+	if frameCount > 0 && compressedEnd != idx.TailOffset {
+		return nil, fmt.Errorf("frames end at offset %d, not at the tail offset %d", compressedEnd, idx.TailOffset)
+	}
+
+	idx.Tail = make([]byte, tailSize)
+	if _, err := io.ReadFull(r, idx.Tail); err != nil {
+		return nil, fmt.Errorf("reading tail: %w", err)
+	}
+	return idx, nil
+}
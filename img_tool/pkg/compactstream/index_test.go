@@ -0,0 +1,355 @@
+package compactstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compress"
+)
+
+// randomAccessLayer is a layer built for random access tests: the compact
+// stream, the blobs it references, and the tar and blob it reconstructs.
+type randomAccessLayer struct {
+	compactStream []byte
+	store         mapBlobStore
+	tar           []byte
+	blob          []byte
+}
+
+// buildRandomAccessLayer writes a tar with directories, small (inlined) files
+// and large (CAS-referenced) files, its compact stream, and the layer blob
+// compressed the way `img layer` compresses it. The largest file spans several
+// eStargz chunks.
+func buildRandomAccessLayer(t *testing.T, origComp OriginalCompressionInfo) randomAccessLayer {
+	t.Helper()
+	rng := rand.New(rand.NewSource(42))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	entries := []struct {
+		hdr     tar.Header
+		content []byte
+	}{
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{hdr: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644}, content: []byte("box\n")},
+		{hdr: tar.Header{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0o644}, content: []byte(strings.Repeat("key = value\n", 2000))},
+		{hdr: tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{hdr: tar.Header{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{hdr: tar.Header{Name: "usr/lib/big.so", Typeflag: tar.TypeReg, Mode: 0o755}, content: randomBytes(9 << 20)},
+		{hdr: tar.Header{Name: "usr/lib/link.so", Typeflag: tar.TypeSymlink, Linkname: "big.so"}},
+		{hdr: tar.Header{Name: "usr/lib/empty", Typeflag: tar.TypeReg, Mode: 0o644}},
+		{hdr: tar.Header{Name: "usr/lib/data.bin", Typeflag: tar.TypeReg, Mode: 0o644}, content: randomBytes(70000)},
+	}
+
+	store := mapBlobStore{}
+	var cstream bytes.Buffer
+	csWriter := NewWriter(&cstream, HashAlgoSHA256, sha256.Size, StreamCompressionZstd, origComp, 64)
+	var tarBuf bytes.Buffer
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.content))
+		hdrBytes, err := CaptureTarHeaderBytes(&e.hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := csWriter.WriteStreamBytes(hdrBytes); err != nil {
+			t.Fatal(err)
+		}
+		tarBuf.Write(hdrBytes)
+		if int64(len(e.content)) > csWriter.InlineThreshold() {
+			if err := csWriter.WriteCASRef(store.put(e.content), uint64(len(e.content))); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := csWriter.WriteStreamBytes(e.content); err != nil {
+			t.Fatal(err)
+		}
+		tarBuf.Write(e.content)
+		if pad := (512 - len(e.content)%512) % 512; pad > 0 {
+			if err := csWriter.WriteStreamBytes(make([]byte, pad)); err != nil {
+				t.Fatal(err)
+			}
+			tarBuf.Write(make([]byte, pad))
+		}
+	}
+	if err := csWriter.WriteStreamBytes(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	tarBuf.Write(make([]byte, 1024))
+
+	var blob bytes.Buffer
+	if origComp.Compression == OriginalCompressionNone {
+		blob.Write(tarBuf.Bytes())
+	} else {
+		algorithm := "gzip"
+		if origComp.Compression == OriginalCompressionZstd {
+			algorithm = "zstd"
+		}
+		var opts []compress.Option
+		if origComp.CompressionLevel >= 0 {
+			opts = append(opts, compress.CompressionLevel(int(origComp.CompressionLevel)))
+		}
+		if origComp.ZstdChunked {
+			opts = append(opts, compress.ZstdChunked(true))
+		}
+		appender, err := compress.TarAppenderFactory("sha256", algorithm, origComp.Seekable, &blob, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := appender.AppendTar(bytes.NewReader(tarBuf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := appender.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob.Write(make([]byte, origComp.EndPadding))
+
+	blobDigest := sha256.Sum256(blob.Bytes())
+	if err := csWriter.SetCompressedStreamInfo(blobDigest[:], uint64(blob.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if err := csWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compact stream must reconstruct the blob in full before random
+	// access is worth testing.
+	var reconstructed bytes.Buffer
+	if err := Reconstruct(context.Background(), bytes.NewReader(cstream.Bytes()), store, &reconstructed); err != nil {
+		t.Fatalf("Reconstruct: %v", err)
+	}
+	return randomAccessLayer{
+		compactStream: cstream.Bytes(),
+		store:         store,
+		tar:           tarBuf.Bytes(),
+		blob:          blob.Bytes(),
+	}
+}
+
+// checkReadAt compares reads at offsets near the interesting boundaries (and a
+// few random ones) against want.
+func checkReadAt(t *testing.T, name string, readAt func(p []byte, off int64) (int, error), want []byte, boundaries []int64) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(7))
+	offsets := []int64{0, 1, 511, 512, int64(len(want)) - 1}
+	for _, b := range boundaries {
+		offsets = append(offsets, b-3, b, b+1)
+	}
+	for range 8 {
+		offsets = append(offsets, rng.Int63n(int64(len(want))))
+	}
+	for _, off := range offsets {
+		if off < 0 || off >= int64(len(want)) {
+			continue
+		}
+		for _, size := range []int{1, 100, 70000} {
+			p := make([]byte, size)
+			n, err := readAt(p, off)
+			wantN := min(size, len(want)-int(off))
+			if n != wantN {
+				t.Fatalf("%s ReadAt(%d bytes, %d) = %d bytes (%v), want %d", name, size, off, n, err, wantN)
+			}
+			if n < size && err == nil {
+				t.Fatalf("%s ReadAt(%d bytes, %d) = %d bytes without an error", name, size, off, n)
+			}
+			if !bytes.Equal(p[:n], want[off:off+int64(n)]) {
+				t.Fatalf("%s ReadAt(%d bytes, %d) returned the wrong bytes", name, size, off)
+			}
+		}
+	}
+	if n, err := readAt(make([]byte, 1), int64(len(want))); n != 0 || err == nil {
+		t.Fatalf("%s ReadAt at the end = %d bytes, %v; want 0 bytes and io.EOF", name, n, err)
+	}
+}
+
+func TestRandomAccessSeekable(t *testing.T) {
+	layer := buildRandomAccessLayer(t, OriginalCompressionInfo{
+		Compression:      OriginalCompressionZstd,
+		Seekable:         true,
+		CompressionLevel: -1,
+		EndPadding:       100,
+	})
+
+	idx, err := BuildIndex(layer.compactStream, bytes.NewReader(layer.blob), int64(len(layer.blob)))
+	if err != nil {
+		t.Fatalf("BuildIndex: %v", err)
+	}
+	// Every regular file with content starts a frame per chunk, after the
+	// frame at the start of the layer: one each for hostname, config and
+	// data.bin, and three for big.so.
+	if len(idx.Frames) != 7 {
+		t.Fatalf("got %d frames, want 7", len(idx.Frames))
+	}
+	if idx.UncompressedSize != uint64(len(layer.tar)) || idx.CompressedSize != uint64(len(layer.blob)) {
+		t.Fatalf("sizes = %d/%d, want %d/%d", idx.UncompressedSize, idx.CompressedSize, len(layer.tar), len(layer.blob))
+	}
+
+	// The index survives being cached on disk.
+	var encoded bytes.Buffer
+	if _, err := idx.WriteTo(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadIndex(&encoded)
+	if err != nil {
+		t.Fatalf("ReadIndex: %v", err)
+	}
+
+	r, err := NewRandomAccessReader(context.Background(), layer.compactStream, decoded, layer.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var boundaries []int64
+	var uncompressedBoundaries []int64
+	for _, f := range decoded.Frames {
+		boundaries = append(boundaries, int64(f.CompressedOffset))
+		uncompressedBoundaries = append(uncompressedBoundaries, int64(f.UncompressedOffset))
+	}
+	boundaries = append(boundaries, int64(decoded.TailOffset), int64(decoded.TailOffset)+int64(len(decoded.Tail)))
+	checkReadAt(t, "compressed", r.ReadAt, layer.blob, boundaries)
+	checkReadAt(t, "uncompressed", r.Uncompressed().ReadAt, layer.tar, uncompressedBoundaries)
+}
+
+func TestRandomAccessNotSeekable(t *testing.T) {
+	layer := buildRandomAccessLayer(t, OriginalCompressionInfo{
+		Compression:      OriginalCompressionGzip,
+		CompressionLevel: 1,
+	})
+
+	idx, err := BuildIndex(layer.compactStream, bytes.NewReader(layer.blob), int64(len(layer.blob)))
+	if err != nil {
+		t.Fatalf("BuildIndex: %v", err)
+	}
+	if len(idx.Frames) != 0 || idx.TailOffset != uint64(len(layer.blob)) {
+		t.Fatalf("got %d frames and tail offset %d, want none and %d", len(idx.Frames), idx.TailOffset, len(layer.blob))
+	}
+	r, err := NewRandomAccessReader(context.Background(), layer.compactStream, idx, layer.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReadAt(t, "compressed", r.ReadAt, layer.blob, nil)
+}
+
+// TestRandomAccessZstdChunked checks that a zstd:chunked layer reconstructs
+// bit for bit and is read like a layer without frames.
+func TestRandomAccessZstdChunked(t *testing.T) {
+	layer := buildRandomAccessLayer(t, OriginalCompressionInfo{
+		Compression:      OriginalCompressionZstd,
+		Seekable:         true,
+		ZstdChunked:      true,
+		CompressionLevel: -1,
+	})
+
+	idx, err := BuildIndex(layer.compactStream, bytes.NewReader(layer.blob), int64(len(layer.blob)))
+	if err != nil {
+		t.Fatalf("BuildIndex: %v", err)
+	}
+	if len(idx.Frames) != 0 {
+		t.Fatalf("got %d frames, want none", len(idx.Frames))
+	}
+	r, err := NewRandomAccessReader(context.Background(), layer.compactStream, idx, layer.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReadAt(t, "compressed", r.ReadAt, layer.blob, nil)
+}
+
+func TestRandomAccessUncompressed(t *testing.T) {
+	layer := buildRandomAccessLayer(t, OriginalCompressionInfo{
+		Compression:      OriginalCompressionNone,
+		CompressionLevel: -1,
+		EndPadding:       4096,
+	})
+
+	// An uncompressed layer needs no blob to be indexed.
+	idx, err := BuildIndex(layer.compactStream, nil, 0)
+	if err != nil {
+		t.Fatalf("BuildIndex: %v", err)
+	}
+	r, err := NewRandomAccessReader(context.Background(), layer.compactStream, idx, layer.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boundaries := []int64{int64(len(layer.tar))}
+	for _, ref := range r.cs.refs {
+		boundaries = append(boundaries, int64(ref.Offset), int64(ref.Offset+ref.Size))
+	}
+	checkReadAt(t, "compressed", r.ReadAt, layer.blob, boundaries)
+	checkReadAt(t, "uncompressed", r.Uncompressed().ReadAt, layer.tar, boundaries)
+}
+
+func TestBuildIndexRejectsMismatchedBlob(t *testing.T) {
+	layer := buildRandomAccessLayer(t, OriginalCompressionInfo{
+		Compression:      OriginalCompressionZstd,
+		Seekable:         true,
+		CompressionLevel: -1,
+	})
+	other := buildRandomAccessLayer(t, OriginalCompressionInfo{
+		Compression:      OriginalCompressionZstd,
+		Seekable:         true,
+		CompressionLevel: 1,
+	})
+	if _, err := BuildIndex(layer.compactStream, bytes.NewReader(other.blob), int64(len(other.blob))); err == nil {
+		t.Fatal("BuildIndex accepted the blob of another layer")
+	}
+}
+
+func TestRandomAccessRejectsChangedInputs(t *testing.T) {
+	layer := buildRandomAccessLayer(t, OriginalCompressionInfo{
+		Compression:      OriginalCompressionZstd,
+		Seekable:         true,
+		CompressionLevel: -1,
+	})
+	idx, err := BuildIndex(layer.compactStream, bytes.NewReader(layer.blob), int64(len(layer.blob)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An index built for another compact stream is refused up front.
+	empty := validEmptyIndex(t)
+	if _, err := NewRandomAccessReader(context.Background(), empty, idx, layer.store); err == nil {
+		t.Fatal("NewRandomAccessReader accepted an index built for another compact stream")
+	}
+
+	// A CAS blob that no longer matches fails the frame's CRC-32 instead of
+	// serving the wrong bytes.
+	corrupted := mapBlobStore{}
+	for digest, data := range layer.store {
+		changed := bytes.Clone(data)
+		changed[len(changed)/2] ^= 0xff
+		corrupted[digest] = changed
+	}
+	r, err := NewRandomAccessReader(context.Background(), layer.compactStream, idx, corrupted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := idx.Frames[4]
+	if _, err := r.ReadAt(make([]byte, 10), int64(big.CompressedOffset)); err == nil {
+		t.Fatal("ReadAt served a frame recompressed from a changed blob")
+	}
+}
+
+func TestReadIndexRejectsGaps(t *testing.T) {
+	idx := &Index{
+		CompactStreamDigest: make([]byte, sha256.Size),
+		UncompressedSize:    100,
+		CompressedSize:      100,
+		TailOffset:          60,
+		Frames: []Frame{
+			{UncompressedOffset: 0, UncompressedSize: 50, CompressedOffset: 0, CompressedSize: 30},
+			{UncompressedOffset: 50, UncompressedSize: 50, CompressedOffset: 31, CompressedSize: 29},
+		},
+	}
+	var buf bytes.Buffer
+	if _, err := idx.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadIndex(&buf); err == nil {
+		t.Fatal("ReadIndex accepted frames with a gap")
+	}
+}
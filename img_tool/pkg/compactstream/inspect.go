@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"strings"
 
 	"github.com/klauspost/compress/zstd"
 )
@@ -18,6 +19,10 @@ import (
 // layer), which we never expect to reach in practice.
 const maxRefTableSize uint64 = 1 << 31 // 2 GiB
 
+// maxPrioritizedFilesSize bounds the prioritized files section for the same
+// reason. A startup file list is a few thousand paths at most.
+const maxPrioritizedFilesSize uint64 = 64 << 20 // 64 MiB
+
 // Header holds the parsed fields of a compact stream header. See
 // docs/compact-stream.md for the on-disk layout.
 type Header struct {
@@ -104,14 +109,38 @@ func HasMagic(prefix []byte) bool {
 }
 
 // ReadHeader reads and validates the fixed-size compact stream header from
-// r. It consumes exactly headerSize bytes, leaving r positioned at the start
-// of the CAS reference table.
+// r, followed by the prioritized files section when the header announces one.
+// It leaves r positioned at the start of the CAS reference table.
 func ReadHeader(r io.Reader) (Header, error) {
 	var raw [headerSize]byte
 	if _, err := io.ReadFull(r, raw[:]); err != nil {
 		return Header{}, fmt.Errorf("reading compact stream header: %w", err)
 	}
-	return parseHeader(raw)
+	h, err := parseHeader(raw)
+	if err != nil {
+		return Header{}, err
+	}
+	if raw[56]&flagPrioritizedFiles != 0 {
+		files, err := readPrioritizedFiles(r, h.RefTableOffset-headerSize)
+		if err != nil {
+			return Header{}, err
+		}
+		h.OriginalCompression.PrioritizedFiles = files
+	}
+	return h, nil
+}
+
+// readPrioritizedFiles parses the NUL-terminated paths of the prioritized
+// files section.
+func readPrioritizedFiles(r io.Reader, size uint64) ([]string, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("reading prioritized files: %w", err)
+	}
+	if data[len(data)-1] != 0 {
+		return nil, fmt.Errorf("prioritized files section is not NUL-terminated")
+	}
+	return strings.Split(string(data[:len(data)-1]), "\x00"), nil
 }
 
 func parseHeader(raw [headerSize]byte) (Header, error) {
@@ -132,7 +161,8 @@ func parseHeader(raw [headerSize]byte) (Header, error) {
 		StreamCompression: raw[12],
 		OriginalCompression: OriginalCompressionInfo{
 			Compression:      raw[13],
-			Seekable:         raw[14] == 1,
+			Seekable:         raw[14] == 1 || raw[14] == 2,
+			ZstdChunked:      raw[14] == 2,
 			CompressionLevel: int8(raw[15]),
 			CompressorJobs:   raw[16],
 			EndPadding:       binary.BigEndian.Uint32(raw[20:24]),
@@ -143,6 +173,12 @@ func parseHeader(raw [headerSize]byte) (Header, error) {
 		StreamSize:     binary.BigEndian.Uint64(raw[48:56]),
 	}
 
+	if raw[14] > 2 {
+		return Header{}, fmt.Errorf("unsupported seekable compression: %d", raw[14])
+	}
+	if h.OriginalCompression.ZstdChunked && h.OriginalCompression.Compression != OriginalCompressionZstd {
+		return Header{}, fmt.Errorf("zstd:chunked layer with original compression %d", h.OriginalCompression.Compression)
+	}
 	if h.HashAlgo != HashAlgoSHA256 {
 		return Header{}, fmt.Errorf("unsupported hash algorithm: %d", h.HashAlgo)
 	}
@@ -160,6 +196,16 @@ func parseHeader(raw [headerSize]byte) (Header, error) {
 		return Header{}, fmt.Errorf("ref table size %d is not a multiple of entry size %d", h.RefTableSize, h.RefEntrySize())
 	}
 
+	// The optional prioritized files section fills the space between the
+	// header and the reference table.
+	if raw[56]&flagPrioritizedFiles != 0 {
+		if h.RefTableOffset <= headerSize || h.RefTableOffset-headerSize > maxPrioritizedFilesSize {
+			return Header{}, fmt.Errorf("invalid prioritized files section: reference table at offset %d", h.RefTableOffset)
+		}
+	} else if h.RefTableOffset != headerSize {
+		return Header{}, fmt.Errorf("reference table offset %d does not follow the %d-byte header", h.RefTableOffset, headerSize)
+	}
+
 	// Optional compressed-stream info (header Flags byte at offset 56).
 	if raw[56]&flagCompressedStreamInfo != 0 {
 		if 72+h.HashSize > headerSize {
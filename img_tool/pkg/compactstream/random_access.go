@@ -0,0 +1,301 @@
+package compactstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compress"
+)
+
+// RandomAccessReader serves reads at arbitrary offsets of the layer a compact
+// stream reconstructs, guided by its Index. ReadAt reads the layer blob as it
+// is pushed (compressed, with any end padding), which is what an HTTP Range
+// request for the blob asks for; Uncompressed reads the tar, which is what a
+// SOCI span or a single file needs.
+//
+// An uncompressed read only touches the byte stream (held in memory) and the
+// CAS blobs overlapping the requested range. A compressed read of a seekable
+// layer compresses the overlapping frames again, each on its own, and checks
+// them against the CRC-32 the index recorded; the TOC and footer come from the
+// index. A compressed layer without frames has to be compressed from its
+// start, so a read at a high offset costs as much as reconstructing the layer
+// up to that point.
+//
+// A RandomAccessReader is safe for concurrent use. It keeps the most recently
+// compressed frame, so that consecutive small reads of one frame compress it
+// only once.
+type RandomAccessReader struct {
+	ctx           context.Context
+	compactStream []byte
+	cs            *compactStream
+	index         *Index
+	store         BlobStore
+	compressor    estargz.Compressor
+
+	mu          sync.Mutex
+	cachedFrame int
+	cachedData  []byte
+}
+
+// NewRandomAccessReader returns a reader over the layer that compactStreamData
+// reconstructs with the blobs from store. index must have been built from the
+// same compact stream (see BuildIndex).
+func NewRandomAccessReader(ctx context.Context, compactStreamData []byte, index *Index, store BlobStore) (*RandomAccessReader, error) {
+	if digest := sha256.Sum256(compactStreamData); !bytes.Equal(digest[:], index.CompactStreamDigest) {
+		return nil, errors.New("random access index was built for a different compact stream")
+	}
+	cs, err := parseCompactStream(compactStreamData)
+	if err != nil {
+		return nil, err
+	}
+	if cs.size() != index.UncompressedSize {
+		return nil, fmt.Errorf("random access index describes a %d byte tar, but the compact stream reconstructs %d bytes", index.UncompressedSize, cs.size())
+	}
+
+	r := &RandomAccessReader{
+		ctx:           ctx,
+		compactStream: compactStreamData,
+		cs:            cs,
+		index:         index,
+		store:         store,
+		cachedFrame:   -1,
+	}
+	if len(index.Frames) > 0 {
+		var format string
+		switch cs.header.OriginalCompression.Compression {
+		case OriginalCompressionGzip:
+			format = "gzip"
+		case OriginalCompressionZstd:
+			format = "zstd"
+		default:
+			return nil, fmt.Errorf("random access index has frames, but the layer is not compressed")
+		}
+		r.compressor, err = compress.NewEstargzCompressor(format, int(cs.header.OriginalCompression.CompressionLevel))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Size returns the size of the layer blob.
+func (r *RandomAccessReader) Size() int64 { return int64(r.index.CompressedSize) }
+
+// UncompressedSize returns the size of the uncompressed tar.
+func (r *RandomAccessReader) UncompressedSize() int64 { return int64(r.index.UncompressedSize) }
+
+// Uncompressed returns an io.ReaderAt over the uncompressed tar. For a seekable
+// layer with prioritized files, this is the tar before the estargz writer moved
+// the prioritized files to the front (see ReconstructUncompressed).
+func (r *RandomAccessReader) Uncompressed() io.ReaderAt { return uncompressedReaderAt{r} }
+
+type uncompressedReaderAt struct{ r *RandomAccessReader }
+
+func (u uncompressedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return u.r.readUncompressedAt(p, off)
+}
+
+// ReadAt reads len(p) bytes of the layer blob starting at off.
+func (r *RandomAccessReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("compactstream: negative offset")
+	}
+	origComp := r.cs.header.OriginalCompression
+	n := 0
+	for n < len(p) && uint64(off) < r.index.CompressedSize {
+		pos := uint64(off)
+		rest := p[n:]
+		var m int
+		var err error
+		switch {
+		case pos >= r.index.TailOffset:
+			tailPos := pos - r.index.TailOffset
+			if tailPos < uint64(len(r.index.Tail)) {
+				m = copy(rest, r.index.Tail[tailPos:])
+			} else {
+				// End padding.
+				m = int(min(uint64(len(rest)), r.index.CompressedSize-pos))
+				clear(rest[:m])
+			}
+		case origComp.Compression == OriginalCompressionNone:
+			m, err = r.readUncompressedAt(rest[:min(uint64(len(rest)), r.index.TailOffset-pos)], off)
+		case len(r.index.Frames) > 0:
+			m, err = r.readFrameAt(rest, pos)
+		default:
+			m, err = r.readRecompressedAt(rest[:min(uint64(len(rest)), r.index.TailOffset-pos)], off)
+		}
+		n += m
+		off += int64(m)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readFrameAt serves a read within the frames of a seekable layer from the
+// frame containing pos.
+func (r *RandomAccessReader) readFrameAt(p []byte, pos uint64) (int, error) {
+	frames := r.index.Frames
+	i := sort.Search(len(frames), func(i int) bool {
+		return frames[i].CompressedOffset+frames[i].CompressedSize > pos
+	})
+	if i == len(frames) {
+		return 0, fmt.Errorf("no frame at offset %d", pos)
+	}
+	data, err := r.frame(i)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, data[pos-frames[i].CompressedOffset:]), nil
+}
+
+// frame compresses frame i again, or returns it from the cache.
+func (r *RandomAccessReader) frame(i int) ([]byte, error) {
+	r.mu.Lock()
+	if r.cachedFrame == i {
+		data := r.cachedData
+		r.mu.Unlock()
+		return data, nil
+	}
+	r.mu.Unlock()
+
+	f := r.index.Frames[i]
+	uncompressed := make([]byte, f.UncompressedSize)
+	if _, err := r.readUncompressedAt(uncompressed, int64(f.UncompressedOffset)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(f.CompressedSize))
+	if err := compressFrame(r.compressor, &buf, uncompressed, i == len(r.index.Frames)-1); err != nil {
+		return nil, fmt.Errorf("compressing frame at offset %d: %w", f.CompressedOffset, err)
+	}
+	data := buf.Bytes()
+	if uint64(len(data)) != f.CompressedSize || crc32.ChecksumIEEE(data) != f.CRC32 {
+		return nil, fmt.Errorf("frame at offset %d does not match the random access index: the CAS blobs or the compressor differ from when it was built", f.CompressedOffset)
+	}
+
+	r.mu.Lock()
+	r.cachedFrame, r.cachedData = i, data
+	r.mu.Unlock()
+	return data, nil
+}
+
+// readRecompressedAt serves a read of a compressed layer without frames by
+// compressing the layer from its start, discarding everything before off.
+func (r *RandomAccessReader) readRecompressedAt(p []byte, off int64) (int, error) {
+	w := &windowWriter{buf: p, skip: off}
+	err := Reconstruct(r.ctx, bytes.NewReader(r.compactStream), r.store, w)
+	if w.full() {
+		return len(p), nil
+	}
+	if err != nil {
+		return w.n, err
+	}
+	return w.n, io.EOF
+}
+
+// errWindowFull stops a reconstruction once a windowWriter has what it needs.
+var errWindowFull = errors.New("read window filled")
+
+// windowWriter keeps the bytes of a write stream from offset skip on, until
+// buf is full.
+type windowWriter struct {
+	buf  []byte
+	skip int64
+	n    int
+}
+
+func (w *windowWriter) full() bool { return w.n == len(w.buf) }
+
+func (w *windowWriter) Write(p []byte) (int, error) {
+	if w.full() {
+		return 0, errWindowFull
+	}
+	written := len(p)
+	if w.skip >= int64(len(p)) {
+		w.skip -= int64(len(p))
+		return written, nil
+	}
+	p = p[w.skip:]
+	w.skip = 0
+	w.n += copy(w.buf[w.n:], p)
+	return written, nil
+}
+
+// readUncompressedAt reads the uncompressed tar, interleaving the byte stream
+// with the CAS blobs the range overlaps.
+func (r *RandomAccessReader) readUncompressedAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("compactstream: negative offset")
+	}
+	cs := r.cs
+	total := cs.size()
+	n := 0
+	for n < len(p) && uint64(off) < total {
+		pos := uint64(off)
+		rest := p[n:]
+		// i is the first ref that ends after pos.
+		i := sort.Search(len(cs.refs), func(i int) bool {
+			return cs.refs[i].Offset+cs.refs[i].Size > pos
+		})
+		var m int
+		if i < len(cs.refs) && cs.refs[i].Offset <= pos {
+			ref := cs.refs[i]
+			var err error
+			m, err = r.readRef(rest[:min(uint64(len(rest)), ref.Offset+ref.Size-pos)], ref, pos-ref.Offset)
+			if err != nil {
+				return n + m, err
+			}
+		} else {
+			end := total
+			if i < len(cs.refs) {
+				end = cs.refs[i].Offset
+			}
+			streamPos := pos - cs.refBytes[i]
+			m = copy(rest[:min(uint64(len(rest)), end-pos)], cs.stream[streamPos:])
+		}
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readRef fills p with the content of ref starting skip bytes into the blob.
+func (r *RandomAccessReader) readRef(p []byte, ref CASReference, skip uint64) (int, error) {
+	blob, err := r.store.ReaderForBlob(r.ctx, ref.Digest, int64(ref.Size))
+	if err != nil {
+		return 0, fmt.Errorf("fetching blob at offset %d: %w", ref.Offset, err)
+	}
+	defer blob.Close()
+
+	var src io.Reader
+	if ra, ok := blob.(io.ReaderAt); ok {
+		src = io.NewSectionReader(ra, int64(skip), int64(ref.Size-skip))
+	} else {
+		if _, err := io.CopyN(io.Discard, blob, int64(skip)); err != nil {
+			return 0, fmt.Errorf("reading blob at offset %d: %w", ref.Offset, err)
+		}
+		src = blob
+	}
+	n, err := io.ReadFull(src, p)
+	if err != nil {
+		return n, fmt.Errorf("reading blob at offset %d: %w", ref.Offset, err)
+	}
+	return n, nil
+}
@@ -69,6 +69,12 @@ func Reconstruct(ctx context.Context, index io.Reader, store BlobStore, output i
 		if origComp.CompressorJobs > 0 {
 			compressOpts = append(compressOpts, compress.CompressorJobs(int(origComp.CompressorJobs)))
 		}
+		if len(origComp.PrioritizedFiles) > 0 {
+			compressOpts = append(compressOpts, compress.PrioritizedFiles(origComp.PrioritizedFiles))
+		}
+		if origComp.ZstdChunked {
+			compressOpts = append(compressOpts, compress.ZstdChunked(true))
+		}
 
 		appender, err := compress.TarAppenderFactory("sha256", compressionAlgorithm, origComp.Seekable, out, compressOpts...)
 		if err != nil {
@@ -284,7 +290,9 @@ func (r *ReconstructingReader) Close() error {
 // stream by interleaving the decompressed byte stream with the blobs supplied
 // by store, writing the raw tar bytes to output. Unlike Reconstruct it performs
 // no re-compression and does not validate the compressed-stream digest: the
-// output is the plain tar, not the original compressed file.
+// output is the plain tar, not the original compressed file. For a seekable
+// layer with prioritized files, it holds the entries in the order they were
+// appended, before the estargz writer moved the prioritized ones to the front.
 //
 // Pair it with NullBlobStore to recover only the tar structure (all headers,
 // any inlined small files, and tar block padding) when the content-addressed
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/klauspost/compress/zstd"
 )
@@ -23,6 +24,11 @@ const (
 	// optional compressed-stream digest and size fields are present and valid.
 	flagCompressedStreamInfo uint8 = 0x01
 
+	// flagPrioritizedFiles marks (in the header Flags byte) that the
+	// prioritized files section sits between the header and the CAS reference
+	// table.
+	flagPrioritizedFiles uint8 = 0x02
+
 	HashAlgoSHA256 uint16 = 1
 
 	StreamCompressionNone uint8 = 0
@@ -39,6 +45,13 @@ type OriginalCompressionInfo struct {
 	CompressionLevel int8
 	CompressorJobs   uint8
 	EndPadding       uint32
+	// ZstdChunked marks a seekable zstd layer in the zstd:chunked layout of
+	// containers/storage rather than eStargz.
+	ZstdChunked bool
+	// PrioritizedFiles are the paths a seekable layer wrote first, followed by
+	// the prefetch landmark. The byte stream records the tar before this
+	// reordering, so reconstruction has to repeat it.
+	PrioritizedFiles []string
 }
 
 type casRef struct {
@@ -144,9 +157,19 @@ func (w *Writer) Close() error {
 		return w.err
 	}
 
+	var prioritizedFiles []byte
+	for _, file := range w.originalCompression.PrioritizedFiles {
+		if strings.IndexByte(file, 0) >= 0 {
+			w.err = fmt.Errorf("compact stream: prioritized file %q contains a NUL byte", file)
+			return w.err
+		}
+		prioritizedFiles = append(prioritizedFiles, file...)
+		prioritizedFiles = append(prioritizedFiles, 0)
+	}
+
 	refEntrySize := 16 + w.hashSize
 	refTableSize := uint64(len(w.refs) * refEntrySize)
-	refTableOffset := uint64(headerSize)
+	refTableOffset := uint64(headerSize + len(prioritizedFiles))
 
 	streamOffset := refTableOffset + refTableSize
 
@@ -181,7 +204,10 @@ func (w *Writer) Close() error {
 	binary.BigEndian.PutUint16(header[10:12], uint16(w.hashSize))
 	header[12] = w.streamCompression
 	header[13] = w.originalCompression.Compression
-	if w.originalCompression.Seekable {
+	switch {
+	case w.originalCompression.ZstdChunked:
+		header[14] = 2
+	case w.originalCompression.Seekable:
 		header[14] = 1
 	}
 	header[15] = byte(w.originalCompression.CompressionLevel)
@@ -201,6 +227,9 @@ func (w *Writer) Close() error {
 		// the slot are supported (SHA-256 uses 32 of 56 bytes).
 		copy(header[72:72+w.hashSize], w.compressedStreamDigest)
 	}
+	if len(prioritizedFiles) > 0 {
+		header[56] |= flagPrioritizedFiles
+	}
 	// remaining bytes up to headerSize: reserved
 
 	if _, err := w.output.Write(header[:]); err != nil {
@@ -208,6 +237,11 @@ func (w *Writer) Close() error {
 		return err
 	}
 
+	if _, err := w.output.Write(prioritizedFiles); err != nil {
+		w.err = err
+		return err
+	}
+
 	for _, ref := range w.refs {
 		var entry [16]byte
 		binary.BigEndian.PutUint64(entry[0:8], ref.offset)
@@ -85,6 +85,31 @@ func TestWriterOriginalCompressionMetadata(t *testing.T) {
 	}
 }
 
+func TestWriterZstdChunked(t *testing.T) {
+	var buf bytes.Buffer
+	iw := NewWriter(&buf, HashAlgoSHA256, 32, StreamCompressionNone, OriginalCompressionInfo{
+		Compression:      OriginalCompressionZstd,
+		Seekable:         true,
+		CompressionLevel: -1,
+		ZstdChunked:      true,
+	}, 0)
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if data[14] != 2 {
+		t.Fatalf("expected seekable compression 2 (zstd:chunked), got %d", data[14])
+	}
+	header, err := ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.OriginalCompression.Seekable || !header.OriginalCompression.ZstdChunked {
+		t.Fatalf("expected a seekable zstd:chunked layer, got %+v", header.OriginalCompression)
+	}
+}
+
 func TestWriterEndPadding(t *testing.T) {
 	var buf bytes.Buffer
 	iw := NewWriter(&buf, HashAlgoSHA256, 32, StreamCompressionNone, OriginalCompressionInfo{
@@ -101,6 +126,50 @@ func TestWriterEndPadding(t *testing.T) {
 	}
 }
 
+func TestWriterPrioritizedFiles(t *testing.T) {
+	files := []string{"app/bin/server", "etc/app/config.json"}
+	var buf bytes.Buffer
+	iw := NewWriter(&buf, HashAlgoSHA256, 32, StreamCompressionNone, OriginalCompressionInfo{
+		Compression:      OriginalCompressionZstd,
+		Seekable:         true,
+		PrioritizedFiles: files,
+	}, 0)
+	digest := sha256.Sum256([]byte("blob"))
+	if err := iw.WriteStreamBytes([]byte("header")); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.WriteCASRef(digest[:], 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if data[56]&flagPrioritizedFiles == 0 {
+		t.Fatalf("expected the prioritized files flag, got flags %x", data[56])
+	}
+	section := "app/bin/server\x00etc/app/config.json\x00"
+	if got := string(data[headerSize : headerSize+len(section)]); got != section {
+		t.Fatalf("prioritized files section = %q, want %q", got, section)
+	}
+
+	info, err := Inspect(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Header.RefTableOffset != uint64(headerSize+len(section)) {
+		t.Fatalf("expected ref table offset %d, got %d", headerSize+len(section), info.Header.RefTableOffset)
+	}
+	got := info.Header.OriginalCompression.PrioritizedFiles
+	if len(got) != len(files) || got[0] != files[0] || got[1] != files[1] {
+		t.Fatalf("prioritized files = %q, want %q", got, files)
+	}
+	if len(info.Refs) != 1 || info.Refs[0].Offset != 6 || info.StreamUncompressedSize != 6 {
+		t.Fatalf("unexpected refs %+v and stream size %d", info.Refs, info.StreamUncompressedSize)
+	}
+}
+
 func TestWriterStreamBytesOnly(t *testing.T) {
 	var buf bytes.Buffer
 	iw := NewWriter(&buf, HashAlgoSHA256, 32, StreamCompressionNone, OriginalCompressionInfo{}, 0)
@@ -1,8 +1,10 @@
 package compress
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
@@ -61,6 +63,10 @@ func ResumeTar[C TarCompressor, HM hashMaker, CM tarCompressorMaker[C]](state ap
 	for _, opt := range opts {
 		opt.apply(&options)
 	}
+	if len(options.prioritizedFiles) > 0 {
+		// The entries of a previous run have already been written in order.
+		return TarAppender[C]{}, errors.New("prioritized files cannot be used when resuming a tar")
+	}
 
 	var hashMaker HM
 	outerHash := hashMaker.New()
@@ -120,6 +126,14 @@ func (a *TarAppender[C]) Finalize() (api.AppenderState, error) {
 		return api.AppenderState{}, err
 	}
 
+	contentHash := a.contentHash.Sum(nil)
+	if reordering, ok := any(a.compressor).(reorderingCompressor); ok {
+		if digest, size, reordered := reordering.reorderedContent(); reordered {
+			contentHash = digest
+			a.uncompressedSize = size
+		}
+	}
+
 	outerHashState, err := a.outerHash.MarshalBinary()
 	if err != nil {
 		return api.AppenderState{}, err
@@ -129,17 +143,22 @@ func (a *TarAppender[C]) Finalize() (api.AppenderState, error) {
 		return api.AppenderState{}, err
 	}
 
-	// Populate layer annotations for estargz
+	// Populate layer annotations for estargz, unless the compressor
+	// describes its layout with annotations of its own.
 	layerAnnotations := make(map[string]string)
-	layerAnnotations[api.TocDigestAnnotation] = tocDigest
-	layerAnnotations[api.UncompressedSizeAnnotation] = fmt.Sprintf("%d", a.uncompressedSize)
+	if annotating, ok := any(a.compressor).(annotatingCompressor); ok {
+		maps.Copy(layerAnnotations, annotating.layerAnnotations())
+	} else {
+		layerAnnotations[api.TocDigestAnnotation] = tocDigest
+		layerAnnotations[api.UncompressedSizeAnnotation] = fmt.Sprintf("%d", a.uncompressedSize)
+	}
 
 	state := api.AppenderState{
 		Magic:            a.magic(),
 		OuterHashState:   outerHashState,
 		OuterHash:        a.outerHash.Sum(nil),
 		ContentHashState: contentHashState,
-		ContentHash:      a.contentHash.Sum(nil),
+		ContentHash:      contentHash,
 		CompressedSize:   a.outputWriter.n,
 		UncompressedSize: a.uncompressedSize,
 		LayerAnnotations: layerAnnotations,
@@ -172,6 +191,16 @@ func setupTarWriterPipeline[C TarCompressor, CM tarCompressorMaker[C]](output io
 		compress = compressorMaker.NewWriter(outputTee)
 	}
 
+	if len(opts.prioritizedFiles) > 0 {
+		prioritizing, ok := any(compress).(prioritizingCompressor)
+		if !ok {
+			return compress, fmt.Errorf("prioritized files are only supported for seekable (estargz) layers, not %s", compressorMaker.Name())
+		}
+		if err := prioritizing.prioritizeFiles(opts.prioritizedFiles); err != nil {
+			return compress, err
+		}
+	}
+
 	return compress, nil
 }
 
@@ -181,6 +210,24 @@ type TarCompressor interface {
 	Close() (string, error)
 }
 
+// prioritizingCompressor is a TarCompressor that can put prioritized files
+// first, as the estargz writer does.
+type prioritizingCompressor interface {
+	prioritizeFiles(files []string) error
+}
+
+// reorderingCompressor is a TarCompressor whose uncompressed output may differ
+// from the tar appended to it.
+type reorderingCompressor interface {
+	reorderedContent() (digest []byte, size int64, ok bool)
+}
+
+// annotatingCompressor is a TarCompressor that provides the annotations of
+// the layer descriptor itself, instead of the estargz ones.
+type annotatingCompressor interface {
+	layerAnnotations() map[string]string
+}
+
 type tarCompressorMaker[T TarCompressor] interface {
 	NewWriter(w io.Writer) T
 	NewWriterLevel(w io.Writer, level int) (T, error)
@@ -203,6 +250,9 @@ func (c *countingReader) Read(p []byte) (int, error) {
 type EstargzWriter struct {
 	writer            *estargz.Writer
 	compressionFormat string
+	// prioritizer, when set, holds back all entries until Close so that the
+	// prioritized files and the prefetch landmark can be written first.
+	prioritizer *prioritizer
 }
 
 // NewEstargzWriter creates a new EstargzWriter with default gzip compression
@@ -218,35 +268,100 @@ func NewEstargzWriterLevel(w io.Writer, level int) (*EstargzWriter, error) {
 	return &EstargzWriter{writer: writer, compressionFormat: "gzip"}, nil
 }
 
-// NewEstargzWriterWithCompression creates a new EstargzWriter with specified compression
-func NewEstargzWriterWithCompression(w io.Writer, compressionFormat string, level int) (*EstargzWriter, error) {
-	var compressor estargz.Compressor
+// NewEstargzWriterWithCompression creates a new EstargzWriter with specified compression.
+// The prioritizedFiles (paths in the image) are written first, followed by the
+// prefetch landmark, so stargz-snapshotter can prefetch them when a container
+// starts. Without prioritized files, entries keep their order and no landmark
+// is written.
+func NewEstargzWriterWithCompression(w io.Writer, compressionFormat string, level int, prioritizedFiles ...string) (*EstargzWriter, error) {
+	compressor, err := NewEstargzCompressor(compressionFormat, level)
+	if err != nil {
+		return nil, err
+	}
+	writer := estargz.NewWriterWithCompressor(w, compressor)
+	estargzWriter := &EstargzWriter{writer: writer, compressionFormat: compressionFormat}
+	if err := estargzWriter.prioritizeFiles(prioritizedFiles); err != nil {
+		return nil, err
+	}
+	return estargzWriter, nil
+}
+
+// NewEstargzCompressor returns the compressor an EstargzWriter uses for the
+// given compression format and level. A negative level selects the default of
+// the writer constructors without a level: gzip.BestCompression for gzip (the
+// estargz default) and 3 for zstd.
+//
+// Every chunk of an eStargz layer is compressed independently, so a single
+// chunk can be compressed again on its own with a compressor from here (see
+// pkg/compactstream's random access reader).
+func NewEstargzCompressor(compressionFormat string, level int) (estargz.Compressor, error) {
 	switch compressionFormat {
 	case "gzip":
-		compressor = estargz.NewGzipCompressorWithLevel(level)
+		if level < 0 {
+			return estargz.NewGzipCompressor(), nil
+		}
+		return estargz.NewGzipCompressorWithLevel(level), nil
 	case "zstd":
-		compressor = &zstdchunked.Compressor{
+		if level < 0 {
+			level = defaultEstargzZstdLevel
+		}
+		return &zstdchunked.Compressor{
 			CompressionLevel: zstd.EncoderLevel(level),
 			Metadata:         make(map[string]string),
-		}
+		}, nil
 	default:
 		return nil, fmt.Errorf("unsupported compression format: %s", compressionFormat)
 	}
-	writer := estargz.NewWriterWithCompressor(w, compressor)
-	return &EstargzWriter{writer: writer, compressionFormat: compressionFormat}, nil
+}
+
+// prioritizeFiles makes the writer put the given files first. It must be
+// called before the first AppendTar.
+func (e *EstargzWriter) prioritizeFiles(files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	p, err := newPrioritizer(files)
+	if err != nil {
+		return err
+	}
+	e.prioritizer = p
+	return nil
 }
 
 // AppendTar appends a tar entry using estargz Writer.AppendTar
 func (e *EstargzWriter) AppendTar(r io.Reader) error {
+	if e.prioritizer != nil {
+		return e.prioritizer.add(r)
+	}
 	return e.writer.AppendTar(r)
 }
 
 // Close closes the estargz writer
 func (e *EstargzWriter) Close() (string, error) {
+	if e.prioritizer != nil {
+		err := e.prioritizer.write(e.writer)
+		if closeErr := e.prioritizer.close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", err
+		}
+	}
 	digest, err := e.writer.Close()
 	return digest.String(), err
 }
 
+// reorderedContent reports the digest and size of the uncompressed tar the
+// writer produced when it reordered the entries for prioritized files. The
+// tar differs from the one appended, so these replace the appender's content
+// hash. Valid after Close.
+func (e *EstargzWriter) reorderedContent() (digest []byte, size int64, ok bool) {
+	if e.prioritizer == nil {
+		return nil, 0, false
+	}
+	return e.prioritizer.digest, e.prioritizer.uncompressedSize, true
+}
+
 // EstargzGzipCompressorMaker implements tarCompressorMaker for EstargzWriter with gzip
 type EstargzGzipCompressorMaker struct{}
 
@@ -262,11 +377,15 @@ func (EstargzGzipCompressorMaker) Name() string {
 	return "gzip"
 }
 
+// defaultEstargzZstdLevel is the zstd level of eStargz layers built without an
+// explicit compression level.
+const defaultEstargzZstdLevel = 3
+
 // EstargzZstdCompressorMaker implements tarCompressorMaker for EstargzWriter with zstd
 type EstargzZstdCompressorMaker struct{}
 
 func (EstargzZstdCompressorMaker) NewWriter(w io.Writer) *EstargzWriter {
-	writer, _ := NewEstargzWriterWithCompression(w, "zstd", 3) // default level
+	writer, _ := NewEstargzWriterWithCompression(w, "zstd", defaultEstargzZstdLevel)
 	return writer
 }
 
@@ -121,6 +121,14 @@ func ResumeSHA256ZstdAppender(state api.AppenderState, w io.Writer, options ...O
 	return Resume[*zstd.Encoder, SHA256Maker, ZstdMaker](state, w, options...)
 }
 
+func NewSHA256ZstdChunkedTarAppender(w io.Writer, options ...Option) (*TarAppender[*ZstdChunkedWriter], error) {
+	appender, err := NewTar[*ZstdChunkedWriter, SHA256Maker, ZstdChunkedCompressorMaker](w, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &appender, nil
+}
+
 func NewSHA256EstargzGzipTarAppender(w io.Writer, options ...Option) (*TarAppender[*EstargzWriter], error) {
 	appender, err := NewTar[*EstargzWriter, SHA256Maker, EstargzGzipCompressorMaker](w, options...)
 	if err != nil {
@@ -216,7 +224,12 @@ func ResumeFactory(hashAlgorithm, compressionAlgorithm string, state api.Appende
 
 func TarAppenderFactory(hashAlgorithm, compressionAlgorithm string, seekable bool, w io.Writer, optionsList ...Option) (api.TarAppender, error) {
 	opts := collectOptions(optionsList...)
+	if opts.zstdChunked && (compressionAlgorithm != "zstd" || !seekable) {
+		return nil, errors.New("zstd:chunked requires seekable zstd compression")
+	}
 	switch {
+	case hashAlgorithm == "sha256" && compressionAlgorithm == "zstd" && seekable && opts.zstdChunked:
+		return NewSHA256ZstdChunkedTarAppender(w, optionsList...)
 	case hashAlgorithm == "sha256" && compressionAlgorithm == "gzip" && seekable:
 		// estargz path: cannot (easily) parallelize gzip here
 		return NewSHA256EstargzGzipTarAppender(w, optionsList...)
@@ -263,6 +276,11 @@ func TarAppenderFactory(hashAlgorithm, compressionAlgorithm string, seekable boo
 
 func ResumeTarFactory(hashAlgorithm, compressionAlgorithm string, seekable bool, state api.AppenderState, w io.Writer, optionsList ...Option) (api.TarAppender, error) {
 	opts := collectOptions(optionsList...)
+	if opts.zstdChunked {
+		// The TOC and tar-split data cover the whole layer and are only
+		// written when it is finalized.
+		return nil, errors.New("zstd:chunked layers cannot be resumed")
+	}
 	switch {
 	case hashAlgorithm == "sha256" && compressionAlgorithm == "gzip" && seekable:
 		return ResumeSHA256EstargzGzipTarAppender(state, w, optionsList...)
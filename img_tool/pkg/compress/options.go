@@ -16,9 +16,21 @@ type options struct {
     contentType      ContentType
     compressionLevel *CompressionLevel
     compressorJobs   *int
+    prioritizedFiles []string
+    zstdChunked      bool
 }
 
 func (c ContentType) apply(opts *options)      { opts.contentType = c }
 func (l CompressionLevel) apply(opts *options) { opts.compressionLevel = &l }
 type CompressorJobs int
 func (j CompressorJobs) apply(opts *options)   { v := int(j); opts.compressorJobs = &v }
+
+// PrioritizedFiles are paths in the image that a seekable (estargz) layer
+// writes first, followed by the prefetch landmark. Other compressors reject it.
+type PrioritizedFiles []string
+func (p PrioritizedFiles) apply(opts *options) { opts.prioritizedFiles = p }
+
+// ZstdChunked makes a seekable zstd layer use the zstd:chunked layout of
+// containers/storage instead of eStargz. Other compressors reject it.
+type ZstdChunked bool
+func (z ZstdChunked) apply(opts *options) { opts.zstdChunked = bool(z) }
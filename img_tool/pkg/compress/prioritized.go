@@ -0,0 +1,241 @@
+package compress
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+// landmarkContents is the single byte stored in the prefetch landmark entries,
+// matching what estargz.Build writes.
+const landmarkContents = 0xf
+
+// prioritizer holds back the entries of an eStargz layer so that the
+// prioritized files can be written first, followed by the prefetch landmark
+// and then everything else in the order it was appended. This is the layout
+// estargz.Build produces for its prioritized files, which stargz-snapshotter
+// uses to prefetch the files a container needs at startup in one request.
+//
+// Entries are appended one tar fragment at a time (or as a whole tar, when a
+// compact stream is reconstructed), so the payloads are spooled to a temporary
+// file until the writer is closed and the final order is known. The order only
+// depends on the entries and the prioritized files, never on how the tar was
+// split into fragments, which keeps reconstruction bit-for-bit.
+type prioritizer struct {
+	files []string
+	spool *os.File
+	// spoolPath is the name of the spool while it is still linked: only on
+	// systems that cannot remove an open file.
+	spoolPath string
+	size      int64
+	entries   []spooledEntry
+	// byName maps a cleaned entry name to the indices of its entries, in the
+	// order they were appended.
+	byName map[string][]int
+
+	// digest and uncompressedSize describe the reordered tar as it was handed
+	// to the estargz writer. They are valid after write.
+	digest           []byte
+	uncompressedSize int64
+}
+
+type spooledEntry struct {
+	hdr    *tar.Header
+	offset int64
+	size   int64
+}
+
+func newPrioritizer(files []string) (*prioritizer, error) {
+	spool, err := os.CreateTemp("", "estargz-prioritized-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating spool for prioritized files: %w", err)
+	}
+	p := &prioritizer{
+		files:  files,
+		spool:  spool,
+		byName: make(map[string][]int),
+	}
+	// The spool is only ever read through its descriptor, so it is unlinked
+	// right away: a writer abandoned after a failed AppendTar, or a process that
+	// dies before Close, leaves nothing behind. Where an open file cannot be
+	// removed (Windows), close removes it instead.
+	if err := os.Remove(spool.Name()); err != nil {
+		p.spoolPath = spool.Name()
+	}
+	return p, nil
+}
+
+// add spools the entries of a tar stream.
+func (p *prioritizer) add(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar entry for prioritization: %w", err)
+		}
+		switch cleanEntryName(hdr.Name) {
+		case estargz.PrefetchLandmark, estargz.NoPrefetchLandmark, estargz.TOCTarName:
+			// Written by the estargz writer itself.
+			continue
+		}
+		n, err := io.Copy(p.spool, tr)
+		if err != nil {
+			return fmt.Errorf("spooling %s: %w", hdr.Name, err)
+		}
+		name := cleanEntryName(hdr.Name)
+		p.byName[name] = append(p.byName[name], len(p.entries))
+		p.entries = append(p.entries, spooledEntry{hdr: hdr, offset: p.size, size: n})
+		p.size += n
+	}
+	// Consume the end-of-archive blocks, like estargz.Writer.AppendTar does.
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// order returns the indices of the spooled entries in the order they are
+// written, and how many of them precede the landmark.
+//
+// A prioritized file is moved to the front together with its parent
+// directories and, for a hard link, its target, so that extracting the
+// prioritized part alone yields a consistent tree. Prioritized files that are
+// not in this layer are skipped: a list recorded from a container run covers
+// every layer of the image.
+func (p *prioritizer) order() (order []int, prioritized int) {
+	picked := make([]bool, len(p.entries))
+	order = make([]int, 0, len(p.entries))
+
+	var pick func(name string)
+	pick = func(name string) {
+		name = cleanEntryName(name)
+		if name != "" {
+			parent := path.Dir(name)
+			if parent == "." {
+				parent = ""
+			}
+			pick(parent)
+		}
+		for _, i := range p.byName[name] {
+			if picked[i] {
+				continue
+			}
+			picked[i] = true
+			if hdr := p.entries[i].hdr; hdr.Typeflag == tar.TypeLink {
+				pick(hdr.Linkname)
+			}
+			order = append(order, i)
+		}
+	}
+	for _, file := range p.files {
+		name := cleanEntryName(file)
+		if _, ok := p.byName[name]; ok && name != "" {
+			pick(name)
+		}
+	}
+	prioritized = len(order)
+
+	for i := range p.entries {
+		if !picked[i] {
+			order = append(order, i)
+		}
+	}
+	return order, prioritized
+}
+
+// write hands the spooled entries to the estargz writer in their final order,
+// recording the digest and size of the tar it was given.
+func (p *prioritizer) write(writer *estargz.Writer) error {
+	order, prioritized := p.order()
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(p.writeTar(pw, order, prioritized))
+	}()
+
+	h := sha256.New()
+	counter := &countingWriter{w: h}
+	err := writer.AppendTar(io.TeeReader(pr, counter))
+	// Unblock the producer if the estargz writer stopped reading early, and
+	// wait for it to stop reading the spool.
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if err != nil {
+		return err
+	}
+	p.digest = h.Sum(nil)
+	p.uncompressedSize = counter.n
+	return nil
+}
+
+// writeTar writes the entries in order, with the prefetch landmark after the
+// first prioritized entries. Without any, the no-prefetch landmark comes first
+// instead, telling stargz-snapshotter not to prefetch this layer.
+func (p *prioritizer) writeTar(w io.Writer, order []int, prioritized int) error {
+	landmark := estargz.PrefetchLandmark
+	if prioritized == 0 {
+		landmark = estargz.NoPrefetchLandmark
+	}
+	tw := tar.NewWriter(w)
+	writeLandmark := func() error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     landmark,
+			Typeflag: tar.TypeReg,
+			Size:     1,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write([]byte{landmarkContents})
+		return err
+	}
+
+	for pos, i := range order {
+		if pos == prioritized {
+			if err := writeLandmark(); err != nil {
+				return err
+			}
+		}
+		entry := p.entries[i]
+		if err := tw.WriteHeader(entry.hdr); err != nil {
+			return err
+		}
+		if entry.size > 0 {
+			if _, err := io.Copy(tw, io.NewSectionReader(p.spool, entry.offset, entry.size)); err != nil {
+				return err
+			}
+		}
+	}
+	if prioritized == len(order) {
+		if err := writeLandmark(); err != nil {
+			return err
+		}
+	}
+	// Like the fragments written by tarcas, the stream ends without the
+	// end-of-archive blocks.
+	return tw.Flush()
+}
+
+func (p *prioritizer) close() error {
+	err := p.spool.Close()
+	if p.spoolPath == "" {
+		return err
+	}
+	if removeErr := os.Remove(p.spoolPath); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// cleanEntryName normalizes a tar entry name the way estargz does when it
+// looks up entries: relative to the root, without a leading or trailing slash.
+func cleanEntryName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
@@ -0,0 +1,60 @@
+package compress
+
+import (
+	"bytes"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// spooledFiles lists the prioritizer spools left in dir.
+func spooledFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "estargz-prioritized-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+// TestPrioritizerLeavesNoSpool checks that the spool of a writer with
+// prioritized files never outlives it: not when AppendTar fails and the writer
+// is abandoned without Close, and not after a successful Close.
+func TestPrioritizerLeavesNoSpool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("an open file cannot be removed on Windows; close removes the spool there")
+	}
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	abandoned, err := NewEstargzWriterWithCompression(&bytes.Buffer{}, "zstd", -1, "etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := abandoned.AppendTar(strings.NewReader(strings.Repeat("not a tar header ", 64))); err == nil {
+		t.Fatal("AppendTar accepted a corrupt tar")
+	}
+	if spooled := spooledFiles(t, tmp); len(spooled) != 0 {
+		t.Errorf("abandoned writer left spools %v", spooled)
+	}
+	// Its descriptor is still open, and released by close.
+	if err := abandoned.prioritizer.close(); err != nil {
+		t.Errorf("closing the abandoned spool: %v", err)
+	}
+
+	data, _ := zstdChunkedTestTar(t)
+	w, err := NewEstargzWriterWithCompression(&bytes.Buffer{}, "zstd", -1, "etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AppendTar(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if spooled := spooledFiles(t, tmp); len(spooled) != 0 {
+		t.Errorf("closed writer left spools %v", spooled)
+	}
+}
@@ -0,0 +1,444 @@
+package compress
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Annotations that describe a zstd:chunked layer to containers/storage (podman,
+// CRI-O). They must be set on the layer descriptor for partial pulls.
+const (
+	// ZstdChunkedManifestChecksumAnnotation is the digest of the compressed TOC.
+	ZstdChunkedManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+	// ZstdChunkedManifestPositionAnnotation locates the compressed TOC in the
+	// blob as "offset:compressed size:uncompressed size:manifest type".
+	ZstdChunkedManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+	// ZstdChunkedTarSplitPositionAnnotation locates the compressed tar-split
+	// data as "offset:compressed size:uncompressed size".
+	ZstdChunkedTarSplitPositionAnnotation = "io.github.containers.zstd-chunked.tarsplit-position"
+)
+
+const (
+	// zstdChunkedManifestTypeCRFS is the only manifest type containers/storage
+	// reads.
+	zstdChunkedManifestTypeCRFS = 1
+	// zstdChunkedFooterSize is the size of the footer data, which is stored in
+	// the skippable frame that ends the blob.
+	zstdChunkedFooterSize = 64
+	// zstdSkippableFrameHeaderSize is the size of the magic and the length
+	// that precede the data of a skippable frame.
+	zstdSkippableFrameHeaderSize = 8
+)
+
+var (
+	zstdSkippableFrameMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
+	// zstdChunkedFrameMagic ends the footer ("GNUlInUx").
+	zstdChunkedFrameMagic = []byte{0x47, 0x4e, 0x55, 0x6c, 0x49, 0x6e, 0x55, 0x78}
+	// tarSplitCRCTable is the table tar-split checksums file payloads with.
+	tarSplitCRCTable = crc64.MakeTable(crc64.ISO)
+)
+
+// ZstdChunkedWriter compresses a tar into the zstd:chunked layout of
+// containers/storage: every file's content is a zstd frame of its own, and
+// the tar headers (with the padding in between) go into the frames between
+// them. Skippable frames at the end hold a TOC listing every entry with the
+// offsets of its content frame, the tar-split data that restores the exact
+// tar from the files, and a footer locating both. Decompressing the blob as a
+// whole yields the tar that was appended, so the diff ID is unchanged, while a
+// client that has some of the files already fetches only the frames of the
+// others.
+//
+// Unlike containers/storage, files are not split further at rolling checksum
+// boundaries, and runs of zeros are stored like any other data: every file is
+// a single chunk. Both layouts are valid zstd:chunked.
+type ZstdChunkedWriter struct {
+	dest    *countingWriter
+	level   zstd.EncoderLevel
+	encoder *zstd.Encoder
+	// inFrame reports whether data was written to the current frame.
+	inFrame bool
+
+	entries  []zstdChunkedFileMetadata
+	tarSplit bytes.Buffer
+	// segment holds the raw tar bytes since the last file. They become a
+	// single tar-split segment once the next file (or the end) is reached,
+	// so that the tar-split data does not depend on how the tar was split
+	// into AppendTar calls.
+	segment []byte
+	// tarSplitPos is the position of the next tar-split entry.
+	tarSplitPos int
+
+	annotations map[string]string
+}
+
+// NewZstdChunkedWriter creates a ZstdChunkedWriter with the default zstd level.
+func NewZstdChunkedWriter(w io.Writer) (*ZstdChunkedWriter, error) {
+	return newZstdChunkedWriter(w, zstd.SpeedDefault)
+}
+
+// NewZstdChunkedWriterLevel creates a ZstdChunkedWriter with a zstd level.
+func NewZstdChunkedWriterLevel(w io.Writer, level int) (*ZstdChunkedWriter, error) {
+	return newZstdChunkedWriter(w, zstd.EncoderLevel(level))
+}
+
+func newZstdChunkedWriter(w io.Writer, level zstd.EncoderLevel) (*ZstdChunkedWriter, error) {
+	dest := &countingWriter{w: w}
+	encoder, err := zstd.NewWriter(dest, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	return &ZstdChunkedWriter{dest: dest, level: level, encoder: encoder}, nil
+}
+
+// zstdChunkedFileMetadata is a TOC entry, as containers/storage reads it.
+type zstdChunkedFileMetadata struct {
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Linkname   string            `json:"linkName,omitempty"`
+	Mode       int64             `json:"mode,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	UID        int               `json:"uid,omitempty"`
+	GID        int               `json:"gid,omitempty"`
+	ModTime    *time.Time        `json:"modtime,omitempty"`
+	AccessTime *time.Time        `json:"accesstime,omitempty"`
+	ChangeTime *time.Time        `json:"changetime,omitempty"`
+	Devmajor   int64             `json:"devMajor,omitempty"`
+	Devminor   int64             `json:"devMinor,omitempty"`
+	Xattrs     map[string]string `json:"xattrs,omitempty"`
+	Digest     string            `json:"digest,omitempty"`
+	Offset     int64             `json:"offset,omitempty"`
+	EndOffset  int64             `json:"endOffset,omitempty"`
+}
+
+// zstdChunkedTOC is the manifest stored in the blob.
+type zstdChunkedTOC struct {
+	Version        int                       `json:"version"`
+	Entries        []zstdChunkedFileMetadata `json:"entries"`
+	TarSplitDigest string                    `json:"tarSplitDigest,omitempty"`
+}
+
+// tarSplitEntry is a line of tar-split data: either a segment of raw tar
+// bytes (headers and padding) or a file, whose content is taken from the
+// extracted file and checked against the CRC-64 in the payload.
+type tarSplitEntry struct {
+	Type     int    `json:"type"`
+	Name     string `json:"name,omitempty"`
+	NameRaw  []byte `json:"name_raw,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Payload  []byte `json:"payload"`
+	Position int    `json:"position"`
+}
+
+const (
+	tarSplitFileType    = 1
+	tarSplitSegmentType = 2
+)
+
+// AppendTar compresses the entries of a tar stream. The stream may be a
+// fragment of a tar (as written by tarcas) that ends without the
+// end-of-archive blocks.
+func (z *ZstdChunkedWriter) AppendTar(r io.Reader) error {
+	rec := &recordingReader{r: r, recording: true}
+	tr := tar.NewReader(rec)
+	for {
+		hdr, err := tr.Next()
+		// The padding of the previous entry and the header blocks.
+		if err := z.writeSegment(rec.take()); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar entry for zstd:chunked: %w", err)
+		}
+
+		entry, err := newZstdChunkedFileMetadata(hdr)
+		if err != nil {
+			return err
+		}
+		var checksum []byte
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			if err := z.endFrame(); err != nil {
+				return err
+			}
+			entry.Offset = z.dest.n
+			payloadDigest := sha256.New()
+			payloadCRC := crc64.New(tarSplitCRCTable)
+			rec.recording = false
+			z.inFrame = true
+			_, err := io.Copy(io.MultiWriter(z.encoder, payloadDigest, payloadCRC), tr)
+			rec.recording = true
+			if err != nil {
+				return fmt.Errorf("compressing %s: %w", hdr.Name, err)
+			}
+			if err := z.endFrame(); err != nil {
+				return err
+			}
+			entry.EndOffset = z.dest.n
+			entry.Digest = fmt.Sprintf("sha256:%x", payloadDigest.Sum(nil))
+			checksum = payloadCRC.Sum(nil)
+		}
+		z.entries = append(z.entries, entry)
+		if err := z.flushSegment(); err != nil {
+			return err
+		}
+		if err := z.addTarSplitEntry(tarSplitEntry{Type: tarSplitFileType, Name: hdr.Name, Size: hdr.Size, Payload: checksum}); err != nil {
+			return err
+		}
+	}
+	// The end-of-archive blocks were read with the last header; keep
+	// whatever follows them, too.
+	rest, err := io.ReadAll(rec)
+	if err != nil {
+		return err
+	}
+	return z.writeSegment(rest)
+}
+
+// writeSegment compresses raw tar bytes other than file content into the
+// current frame.
+func (z *ZstdChunkedWriter) writeSegment(raw []byte) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	z.inFrame = true
+	if _, err := z.encoder.Write(raw); err != nil {
+		return err
+	}
+	z.segment = append(z.segment, raw...)
+	return nil
+}
+
+// flushSegment adds the raw tar bytes written since the last file to the
+// tar-split data.
+func (z *ZstdChunkedWriter) flushSegment() error {
+	if len(z.segment) == 0 {
+		return nil
+	}
+	err := z.addTarSplitEntry(tarSplitEntry{Type: tarSplitSegmentType, Payload: z.segment})
+	z.segment = nil
+	return err
+}
+
+// endFrame ends the current zstd frame, if anything was written to it, so
+// that the next write starts a new one.
+func (z *ZstdChunkedWriter) endFrame() error {
+	if !z.inFrame {
+		return nil
+	}
+	if err := z.encoder.Close(); err != nil {
+		return err
+	}
+	z.encoder.Reset(z.dest)
+	z.inFrame = false
+	return nil
+}
+
+func (z *ZstdChunkedWriter) addTarSplitEntry(entry tarSplitEntry) error {
+	if entry.Name != "" && !utf8.ValidString(entry.Name) {
+		entry.NameRaw = []byte(entry.Name)
+		entry.Name = ""
+	}
+	entry.Position = z.tarSplitPos
+	z.tarSplitPos++
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	z.tarSplit.Write(line)
+	z.tarSplit.WriteByte('\n')
+	return nil
+}
+
+// Close ends the last frame and writes the TOC, the tar-split data and the
+// footer. It returns the manifest checksum (the digest of the compressed TOC).
+func (z *ZstdChunkedWriter) Close() (string, error) {
+	if err := z.flushSegment(); err != nil {
+		return "", err
+	}
+	if err := z.endFrame(); err != nil {
+		return "", err
+	}
+
+	compressedTarSplit, err := z.compress(z.tarSplit.Bytes())
+	if err != nil {
+		return "", err
+	}
+	toc, err := json.Marshal(zstdChunkedTOC{
+		Version:        1,
+		Entries:        z.entries,
+		TarSplitDigest: fmt.Sprintf("sha256:%x", sha256.Sum256(z.tarSplit.Bytes())),
+	})
+	if err != nil {
+		return "", err
+	}
+	compressedTOC, err := z.compress(toc)
+	if err != nil {
+		return "", err
+	}
+
+	tocOffset := uint64(z.dest.n) + zstdSkippableFrameHeaderSize
+	tarSplitOffset := tocOffset + uint64(len(compressedTOC)) + zstdSkippableFrameHeaderSize
+	footer := make([]byte, zstdChunkedFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], tocOffset)
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(compressedTOC)))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(toc)))
+	binary.LittleEndian.PutUint64(footer[24:], zstdChunkedManifestTypeCRFS)
+	binary.LittleEndian.PutUint64(footer[32:], tarSplitOffset)
+	binary.LittleEndian.PutUint64(footer[40:], uint64(len(compressedTarSplit)))
+	binary.LittleEndian.PutUint64(footer[48:], uint64(z.tarSplit.Len()))
+	copy(footer[56:], zstdChunkedFrameMagic)
+
+	for _, data := range [][]byte{compressedTOC, compressedTarSplit, footer} {
+		if err := z.writeSkippableFrame(data); err != nil {
+			return "", err
+		}
+	}
+
+	manifestChecksum := fmt.Sprintf("sha256:%x", sha256.Sum256(compressedTOC))
+	z.annotations = map[string]string{
+		ZstdChunkedManifestChecksumAnnotation: manifestChecksum,
+		ZstdChunkedManifestPositionAnnotation: fmt.Sprintf("%d:%d:%d:%d", tocOffset, len(compressedTOC), len(toc), zstdChunkedManifestTypeCRFS),
+		ZstdChunkedTarSplitPositionAnnotation: fmt.Sprintf("%d:%d:%d", tarSplitOffset, len(compressedTarSplit), z.tarSplit.Len()),
+	}
+	return manifestChecksum, nil
+}
+
+// compress compresses data as a single zstd frame.
+func (z *ZstdChunkedWriter) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder, err := zstd.NewWriter(&buf, zstd.WithEncoderLevel(z.level))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encoder.Write(data); err != nil {
+		encoder.Close()
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (z *ZstdChunkedWriter) writeSkippableFrame(data []byte) error {
+	var header [zstdSkippableFrameHeaderSize]byte
+	copy(header[:], zstdSkippableFrameMagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(data)))
+	if _, err := z.dest.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := z.dest.Write(data)
+	return err
+}
+
+// layerAnnotations returns the annotations the layer descriptor needs. Valid
+// after Close.
+func (z *ZstdChunkedWriter) layerAnnotations() map[string]string {
+	return z.annotations
+}
+
+func newZstdChunkedFileMetadata(hdr *tar.Header) (zstdChunkedFileMetadata, error) {
+	var typ string
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		typ = "reg"
+	case tar.TypeLink:
+		typ = "hardlink"
+	case tar.TypeSymlink:
+		typ = "symlink"
+	case tar.TypeDir:
+		typ = "dir"
+	case tar.TypeChar:
+		typ = "char"
+	case tar.TypeBlock:
+		typ = "block"
+	case tar.TypeFifo:
+		typ = "fifo"
+	default:
+		return zstdChunkedFileMetadata{}, fmt.Errorf("zstd:chunked: unsupported type %q of tar entry %s", hdr.Typeflag, hdr.Name)
+	}
+	var xattrs map[string]string
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if xattrs == nil {
+				xattrs = make(map[string]string)
+			}
+			xattrs[name] = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+	}
+	return zstdChunkedFileMetadata{
+		Type:       typ,
+		Name:       hdr.Name,
+		Linkname:   hdr.Linkname,
+		Mode:       hdr.Mode,
+		Size:       hdr.Size,
+		UID:        hdr.Uid,
+		GID:        hdr.Gid,
+		ModTime:    timeIfNotZero(hdr.ModTime),
+		AccessTime: timeIfNotZero(hdr.AccessTime),
+		ChangeTime: timeIfNotZero(hdr.ChangeTime),
+		Devmajor:   hdr.Devmajor,
+		Devminor:   hdr.Devminor,
+		Xattrs:     xattrs,
+	}, nil
+}
+
+func timeIfNotZero(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// recordingReader keeps the bytes read through it while recording is set, so
+// that the raw header blocks archive/tar consumed can be passed on verbatim.
+type recordingReader struct {
+	r         io.Reader
+	recording bool
+	buf       []byte
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.recording {
+		r.buf = append(r.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// take returns the recorded bytes and starts over.
+func (r *recordingReader) take() []byte {
+	b := r.buf
+	r.buf = nil
+	return b
+}
+
+// ZstdChunkedCompressorMaker implements tarCompressorMaker for ZstdChunkedWriter
+type ZstdChunkedCompressorMaker struct{}
+
+func (ZstdChunkedCompressorMaker) NewWriter(w io.Writer) *ZstdChunkedWriter {
+	writer, _ := NewZstdChunkedWriter(w)
+	return writer
+}
+
+func (ZstdChunkedCompressorMaker) NewWriterLevel(w io.Writer, level int) (*ZstdChunkedWriter, error) {
+	return NewZstdChunkedWriterLevel(w, level)
+}
+
+func (ZstdChunkedCompressorMaker) Name() string {
+	return "zstd"
+}
@@ -0,0 +1,220 @@
+package compress
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+// zstdChunkedTestTar is a tar fragment like tarcas writes: entries without the
+// end-of-archive blocks.
+func zstdChunkedTestTar(t *testing.T) ([]byte, map[string][]byte) {
+	t.Helper()
+	contents := map[string][]byte{
+		"etc/hostname": []byte("box\n"),
+		"etc/config":   []byte(strings.Repeat("key = value\n", 2000)),
+		"etc/empty":    nil,
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(hdr *tar.Header, content []byte) {
+		hdr.Size = int64(len(content))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}, nil)
+	write(&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644, PAXRecords: map[string]string{"SCHILY.xattr.user.test": "yes"}}, contents["etc/hostname"])
+	write(&tar.Header{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 1000, Gid: 1000}, contents["etc/config"])
+	write(&tar.Header{Name: "etc/empty", Typeflag: tar.TypeReg, Mode: 0o644}, nil)
+	write(&tar.Header{Name: "etc/localtime", Typeflag: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC"}, nil)
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), contents
+}
+
+func decompressZstd(t *testing.T, data []byte) []byte {
+	t.Helper()
+	decoder, err := zstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	out, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatalf("decompressing: %v", err)
+	}
+	return out
+}
+
+func TestZstdChunkedLayout(t *testing.T) {
+	tarData, contents := zstdChunkedTestTar(t)
+
+	var blob bytes.Buffer
+	appender, err := TarAppenderFactory("sha256", "zstd", true, &blob, ZstdChunked(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Append in two parts at an entry boundary (the directory and
+	// etc/hostname with its PAX header take 2560 bytes), like tarcas appends
+	// one entry at a time.
+	half := 2560
+	if err := appender.AppendTar(bytes.NewReader(tarData[:half])); err != nil {
+		t.Fatal(err)
+	}
+	if err := appender.AppendTar(bytes.NewReader(tarData[half:])); err != nil {
+		t.Fatal(err)
+	}
+	state, err := appender.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := blob.Bytes()
+
+	// Compact stream reconstruction appends the whole tar at once, and must
+	// get the same blob.
+	var oneCall bytes.Buffer
+	oneCallAppender, err := TarAppenderFactory("sha256", "zstd", true, &oneCall, ZstdChunked(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := oneCallAppender.AppendTar(bytes.NewReader(tarData)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oneCallAppender.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(oneCall.Bytes(), data) {
+		t.Fatalf("blob depends on how the tar was split into AppendTar calls")
+	}
+
+	// The blob is a zstd stream of the tar; the skippable frames are ignored.
+	if got := decompressZstd(t, data); !bytes.Equal(got, tarData) {
+		t.Fatalf("decompressed blob differs from the tar (%d vs %d bytes)", len(got), len(tarData))
+	}
+	if want := sha256.Sum256(tarData); !bytes.Equal(state.ContentHash, want[:]) {
+		t.Fatalf("content hash %x, want %x", state.ContentHash, want)
+	}
+	if _, ok := state.LayerAnnotations[api.TocDigestAnnotation]; ok {
+		t.Fatalf("zstd:chunked layer has the estargz TOC digest annotation")
+	}
+
+	// The footer locates the TOC and the tar-split data, as do the
+	// annotations.
+	footer := data[len(data)-zstdChunkedFooterSize:]
+	if !bytes.Equal(footer[56:], zstdChunkedFrameMagic) {
+		t.Fatalf("footer magic = %q", footer[56:])
+	}
+	field := func(i int) uint64 { return binary.LittleEndian.Uint64(footer[i*8:]) }
+	tocOffset, tocSize, tocUncompressedSize := field(0), field(1), field(2)
+	tarSplitOffset, tarSplitSize, tarSplitUncompressedSize := field(4), field(5), field(6)
+	if field(3) != zstdChunkedManifestTypeCRFS {
+		t.Fatalf("manifest type = %d", field(3))
+	}
+	if got, want := state.LayerAnnotations[ZstdChunkedManifestPositionAnnotation], fmt.Sprintf("%d:%d:%d:1", tocOffset, tocSize, tocUncompressedSize); got != want {
+		t.Fatalf("manifest position annotation = %q, want %q", got, want)
+	}
+	if got, want := state.LayerAnnotations[ZstdChunkedTarSplitPositionAnnotation], fmt.Sprintf("%d:%d:%d", tarSplitOffset, tarSplitSize, tarSplitUncompressedSize); got != want {
+		t.Fatalf("tar-split position annotation = %q, want %q", got, want)
+	}
+	compressedTOC := data[tocOffset : tocOffset+tocSize]
+	if got, want := state.LayerAnnotations[ZstdChunkedManifestChecksumAnnotation], fmt.Sprintf("sha256:%x", sha256.Sum256(compressedTOC)); got != want {
+		t.Fatalf("manifest checksum annotation = %q, want %q", got, want)
+	}
+
+	var toc zstdChunkedTOC
+	if err := json.Unmarshal(decompressZstd(t, compressedTOC), &toc); err != nil {
+		t.Fatal(err)
+	}
+	if toc.Version != 1 || len(toc.Entries) != 5 {
+		t.Fatalf("TOC has version %d and %d entries, want 1 and 5", toc.Version, len(toc.Entries))
+	}
+	for _, entry := range toc.Entries {
+		content := contents[entry.Name]
+		if entry.Type != "reg" || len(content) == 0 {
+			if entry.Offset != 0 || entry.Digest != "" {
+				t.Fatalf("entry %s without content has offset %d and digest %q", entry.Name, entry.Offset, entry.Digest)
+			}
+			continue
+		}
+		// Every file's content is a frame of its own.
+		frame := data[entry.Offset:entry.EndOffset]
+		if got := decompressZstd(t, frame); !bytes.Equal(got, content) {
+			t.Fatalf("frame of %s decompresses to %q", entry.Name, got)
+		}
+		if want := fmt.Sprintf("sha256:%x", sha256.Sum256(content)); entry.Digest != want {
+			t.Fatalf("digest of %s = %s, want %s", entry.Name, entry.Digest, want)
+		}
+	}
+	if got := toc.Entries[1].Xattrs["user.test"]; got != "eWVz" {
+		t.Fatalf("xattr of etc/hostname = %q, want base64 of \"yes\"", got)
+	}
+	if toc.Entries[4].Type != "symlink" || toc.Entries[4].Linkname != "/usr/share/zoneinfo/UTC" {
+		t.Fatalf("symlink entry = %+v", toc.Entries[4])
+	}
+
+	// The tar-split data restores the tar from the segments and the files.
+	tarSplit := decompressZstd(t, data[tarSplitOffset:tarSplitOffset+tarSplitSize])
+	if toc.TarSplitDigest != fmt.Sprintf("sha256:%x", sha256.Sum256(tarSplit)) {
+		t.Fatalf("tar-split digest mismatch")
+	}
+	var restored bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(tarSplit))
+	for position := 0; scanner.Scan(); position++ {
+		var entry tarSplitEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Position != position {
+			t.Fatalf("tar-split entry at position %d, want %d", entry.Position, position)
+		}
+		switch entry.Type {
+		case tarSplitSegmentType:
+			restored.Write(entry.Payload)
+		case tarSplitFileType:
+			content := contents[entry.Name]
+			if int64(len(content)) != entry.Size {
+				t.Fatalf("tar-split size of %s = %d, want %d", entry.Name, entry.Size, len(content))
+			}
+			if len(content) > 0 {
+				want := crc64.New(tarSplitCRCTable)
+				want.Write(content)
+				if !bytes.Equal(entry.Payload, want.Sum(nil)) {
+					t.Fatalf("tar-split checksum of %s mismatch", entry.Name)
+				}
+			}
+			restored.Write(content)
+		}
+	}
+	if !bytes.Equal(restored.Bytes(), tarData) {
+		t.Fatalf("tar restored from tar-split differs from the tar")
+	}
+}
+
+func TestZstdChunkedRejectsOtherLayouts(t *testing.T) {
+	if _, err := TarAppenderFactory("sha256", "gzip", true, io.Discard, ZstdChunked(true)); err == nil {
+		t.Fatal("zstd:chunked with gzip succeeded")
+	}
+	if _, err := TarAppenderFactory("sha256", "zstd", true, io.Discard, ZstdChunked(true), PrioritizedFiles{"etc/hostname"}); err == nil {
+		t.Fatal("zstd:chunked with prioritized files succeeded")
+	}
+	if _, err := ResumeTarFactory("sha256", "zstd", true, api.AppenderState{}, io.Discard, ZstdChunked(true)); err == nil {
+		t.Fatal("resuming zstd:chunked succeeded")
+	}
+}
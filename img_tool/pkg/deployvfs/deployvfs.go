@@ -386,6 +386,37 @@ func (vfs *VFS) SizeOf(digest registryv1.Hash) (int64, error) {
 	return entry.Size()
 }
 
+// Location reports where the bytes of a blob would be read from: "file",
+// "registry", "remote_cache", "compact_stream" or "stub" (see blobEntry). It
+// opens nothing, so it is safe to call when describing a deploy rather than
+// performing it. The second result is false for a digest the VFS does not know.
+func (vfs *VFS) Location(digest registryv1.Hash) (string, bool) {
+	entry, found := vfs.blobs[digest.String()]
+	if !found {
+		if entry, found = vfs.manifests[digest.String()]; !found {
+			return "", false
+		}
+	}
+	return entry.Location, true
+}
+
+// CrossMountSource returns the repository the manifest push would try to mount
+// the blob from, as Layer would wrap it: a plan installed by WithCrossMountPlan
+// wins over the hints the VFS was built with. The second result is false when
+// the blob is not mounted at all.
+func (vfs *VFS) CrossMountSource(digest registryv1.Hash) (api.CrossMountSource, bool) {
+	src, found := vfs.crossMountHints[digest.String()]
+	return src, found
+}
+
+// MountOnly reports whether Layer serves the layer without its bytes, so it
+// can only be mounted or skipped: globally because layer pushes are forbidden,
+// or because the deploy planned to put the blob in its mount source itself.
+func (vfs *VFS) MountOnly(digest registryv1.Hash) bool {
+	_, mountOnly := vfs.mountOnly[digest.String()]
+	return vfs.dm.Settings.ForbidLayerPush || mountOnly
+}
+
 // Builder constructs a VFS by configuring blob sources and resolving layers.
 // Use NewBuilder to create one, configure with With* methods, then call Build().
 // Use Clone() to create an independent copy for per-request customization.
@@ -0,0 +1,340 @@
+// Package imagecopy copies an image or a whole index, with the referrers hanging
+// off it (signatures, SBOMs, SOCI indexes, ...), from one registry reference to
+// another -- promoting a tested staging digest to production without rebuilding
+// it and without a detour through a local store.
+//
+// Manifests are copied byte for byte, so the digest at the destination is the
+// digest at the source. How the blobs travel depends on where they are going:
+//
+//   - Within one registry, every blob is cross-mounted from the source
+//     repository: the registry links what it already stores and no byte moves.
+//     This is the rule the deduplicated push of `img deploy` follows too --
+//     mounts never cross a registry boundary.
+//   - Across registries, every layer is streamed from the source straight into
+//     the upload at the destination, read ahead through pkg/prefetch so a slow
+//     destination does not stall the source connection (and vice versa).
+//
+// Referrers are found with the OCI 1.1 referrers API (falling back to the
+// referrers tag schema, as go-containerregistry does) for the root and for
+// every manifest of an index, since a SOCI index refers to the per-platform
+// manifest rather than to the index. They are copied recursively, so the
+// signature of an SBOM travels along with the SBOM.
+package imagecopy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/prefetch"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+type builder struct {
+	source       []remote.Option
+	destination  []remote.Option
+	jobs         int
+	prefetchSize int
+	referrers    bool
+}
+
+// NewBuilder returns a builder for a Copier that copies referrers, runs
+// registryopts.DefaultJobs requests in flight and reads ahead
+// prefetch.DefaultSize bytes of every streamed layer.
+func NewBuilder() *builder {
+	return &builder{
+		jobs:         registryopts.DefaultJobs,
+		prefetchSize: prefetch.DefaultSize,
+		referrers:    true,
+	}
+}
+
+// WithSourceRemoteOptions sets the options the source is read with: auth and
+// the transport (usually routed through the pull gateway).
+func (b *builder) WithSourceRemoteOptions(opts ...remote.Option) *builder {
+	b.source = opts
+	return b
+}
+
+// WithDestinationRemoteOptions sets the options the destination is written
+// with: auth and the transport (usually routed through the push gateway).
+func (b *builder) WithDestinationRemoteOptions(opts ...remote.Option) *builder {
+	b.destination = opts
+	return b
+}
+
+// WithJobs sets how many blobs and manifests are copied at once.
+func (b *builder) WithJobs(jobs int) *builder {
+	if jobs > 0 {
+		b.jobs = jobs
+	}
+	return b
+}
+
+// WithPrefetchSize sets how many bytes of a streamed layer are read ahead of the
+// upload. Zero or less streams without reading ahead.
+func (b *builder) WithPrefetchSize(size int) *builder {
+	b.prefetchSize = size
+	return b
+}
+
+// WithReferrers turns copying referrers on or off.
+func (b *builder) WithReferrers(referrers bool) *builder {
+	b.referrers = referrers
+	return b
+}
+
+func (b *builder) Build() *Copier {
+	return &Copier{
+		source:       b.source,
+		destination:  b.destination,
+		jobs:         b.jobs,
+		prefetchSize: b.prefetchSize,
+		referrers:    b.referrers,
+	}
+}
+
+// Copier copies images between registries. It is safe for concurrent use.
+type Copier struct {
+	source       []remote.Option
+	destination  []remote.Option
+	jobs         int
+	prefetchSize int
+	referrers    bool
+}
+
+// Result is what Copy wrote.
+type Result struct {
+	// Source is the source reference, resolved to a digest.
+	Source name.Digest
+	// Digest, MediaType and Manifest describe the root manifest, which is the same
+	// at both ends.
+	Digest    registryv1.Hash
+	MediaType types.MediaType
+	Manifest  []byte
+	// References are the destination digest reference followed by every tag.
+	References []name.Reference
+	// Referrers are the digests of the referrers copied along, sorted.
+	Referrers []registryv1.Hash
+	// Mounted is true when source and destination share a registry, so the blobs
+	// were cross-mounted rather than streamed.
+	Mounted bool
+}
+
+// Resolve reads the root manifest src names, without copying anything.
+func (c *Copier) Resolve(ctx context.Context, src name.Reference) (*remote.Descriptor, error) {
+	descriptor, err := remote.Get(src, c.sourceOptions(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", src, err)
+	}
+	return descriptor, nil
+}
+
+// Copy copies the image or index src names to dst, by digest and under every
+// tag in tags, followed by its referrers (unless turned off). The referrers are
+// only copied once the root is in place, since a registry may refuse a referrer
+// whose subject it does not hold.
+func (c *Copier) Copy(ctx context.Context, src name.Reference, dst name.Repository, tags []string) (*Result, error) {
+	descriptor, err := c.Resolve(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{
+		Source:    src.Context().Digest(descriptor.Digest.String()),
+		Digest:    descriptor.Digest,
+		MediaType: descriptor.MediaType,
+		Manifest:  descriptor.Manifest,
+		Mounted:   sameRegistry(src.Context(), dst),
+	}
+	refs := []name.Reference{dst.Digest(descriptor.Digest.String())}
+	for _, tag := range tags {
+		ref, err := name.NewTag(dst.Tag(tag).String(), registryopts.NameOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %w", tag, err)
+		}
+		refs = append(refs, ref)
+	}
+	result.References = refs
+
+	pusher, err := remote.NewPusher(append(c.destinationOptions(), remote.WithJobs(c.jobs))...)
+	if err != nil {
+		return nil, fmt.Errorf("creating pusher: %w", err)
+	}
+	taggable, err := c.taggable(descriptor, result.Mounted)
+	if err != nil {
+		return nil, err
+	}
+	// The digest reference first: it writes every blob and child manifest, so the
+	// tags that follow only write the root manifest.
+	for _, ref := range refs {
+		if err := pusher.Push(ctx, ref, taggable); err != nil {
+			return nil, fmt.Errorf("copying %s to %s: %w", result.Source, ref, err)
+		}
+	}
+
+	if c.referrers {
+		referrers, err := c.copyReferrers(ctx, pusher, src.Context(), dst, descriptor)
+		if err != nil {
+			return nil, err
+		}
+		result.Referrers = referrers
+	}
+	return result, nil
+}
+
+// copyReferrers copies every referrer of the root and of every manifest below
+// it, and the referrers of those, breadth first. Each level is listed and copied
+// with c.jobs requests in flight.
+func (c *Copier) copyReferrers(ctx context.Context, pusher *remote.Pusher, src, dst name.Repository, root *remote.Descriptor) ([]registryv1.Hash, error) {
+	subjects, err := manifestDigests(root)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[registryv1.Hash]bool)
+	for _, subject := range subjects {
+		seen[subject] = true
+	}
+	var copied []registryv1.Hash
+	mounted := sameRegistry(src, dst)
+	for len(subjects) > 0 {
+		var mu sync.Mutex
+		var next []registryv1.Hash
+		g, groupCtx := errgroup.WithContext(ctx)
+		g.SetLimit(c.jobs)
+		for _, subject := range subjects {
+			g.Go(func() error {
+				index, err := remote.Referrers(src.Digest(subject.String()), c.sourceOptions(groupCtx)...)
+				if err != nil {
+					return fmt.Errorf("listing referrers of %s: %w", src.Digest(subject.String()), err)
+				}
+				listed, err := index.IndexManifest()
+				if err != nil {
+					return fmt.Errorf("listing referrers of %s: %w", src.Digest(subject.String()), err)
+				}
+				for _, referrer := range listed.Manifests {
+					mu.Lock()
+					isNew := !seen[referrer.Digest]
+					seen[referrer.Digest] = true
+					mu.Unlock()
+					if !isNew {
+						continue
+					}
+					descriptor, err := remote.Get(src.Digest(referrer.Digest.String()), c.sourceOptions(groupCtx)...)
+					if err != nil {
+						return fmt.Errorf("reading referrer %s of %s: %w", referrer.Digest, subject, err)
+					}
+					taggable, err := c.taggable(descriptor, mounted)
+					if err != nil {
+						return err
+					}
+					if err := pusher.Push(groupCtx, dst.Digest(referrer.Digest.String()), taggable); err != nil {
+						return fmt.Errorf("copying referrer %s of %s: %w", referrer.Digest, subject, err)
+					}
+					children, err := manifestDigests(descriptor)
+					if err != nil {
+						return err
+					}
+					mu.Lock()
+					copied = append(copied, referrer.Digest)
+					next = append(next, children...)
+					mu.Unlock()
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+		subjects = next
+	}
+	sort.Slice(copied, func(i, j int) bool { return copied[i].String() < copied[j].String() })
+	return copied, nil
+}
+
+// taggable returns what the pusher writes for a source manifest: the remote
+// image or index itself when the blobs can be mounted -- its layers are
+// remote.MountableLayers pointing at the source repository -- and a wrapper that
+// streams every layer through pkg/prefetch otherwise.
+func (c *Copier) taggable(descriptor *remote.Descriptor, mounted bool) (remote.Taggable, error) {
+	switch {
+	case descriptor.MediaType.IsIndex():
+		index, err := descriptor.ImageIndex()
+		if err != nil {
+			return nil, fmt.Errorf("reading index %s: %w", descriptor.Digest, err)
+		}
+		if mounted {
+			return index, nil
+		}
+		return &prefetchIndex{index: index, size: c.prefetchSize}, nil
+	case descriptor.MediaType.IsImage():
+		image, err := descriptor.Image()
+		if err != nil {
+			return nil, fmt.Errorf("reading image %s: %w", descriptor.Digest, err)
+		}
+		if mounted {
+			return image, nil
+		}
+		return &prefetchImage{Image: image, size: c.prefetchSize}, nil
+	}
+	return nil, fmt.Errorf("copying %s: unsupported media type %q", descriptor.Digest, descriptor.MediaType)
+}
+
+func (c *Copier) sourceOptions(ctx context.Context) []remote.Option {
+	return append(append([]remote.Option(nil), c.source...), remote.WithContext(ctx))
+}
+
+func (c *Copier) destinationOptions() []remote.Option {
+	return append([]remote.Option(nil), c.destination...)
+}
+
+// manifestDigests returns the digest of a manifest and, for an index, of every
+// manifest below it.
+func manifestDigests(descriptor *remote.Descriptor) ([]registryv1.Hash, error) {
+	digests := []registryv1.Hash{descriptor.Digest}
+	if !descriptor.MediaType.IsIndex() {
+		return digests, nil
+	}
+	index, err := descriptor.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("reading index %s: %w", descriptor.Digest, err)
+	}
+	var walk func(registryv1.ImageIndex) error
+	walk = func(index registryv1.ImageIndex) error {
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return err
+		}
+		for _, child := range manifest.Manifests {
+			digests = append(digests, child.Digest)
+			if !child.MediaType.IsIndex() {
+				continue
+			}
+			nested, err := index.ImageIndex(child.Digest)
+			if err != nil {
+				return err
+			}
+			if err := walk(nested); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(index); err != nil {
+		return nil, fmt.Errorf("reading index %s: %w", descriptor.Digest, err)
+	}
+	return digests, nil
+}
+
+// sameRegistry reports whether two repositories live in one registry, which is
+// when a blob can be cross-mounted from one into the other.
+func sameRegistry(a, b name.Repository) bool {
+	return a.RegistryStr() == b.RegistryStr()
+}
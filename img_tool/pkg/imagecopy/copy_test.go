@@ -0,0 +1,184 @@
+package imagecopy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testregistry"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+func mustRepository(t *testing.T, repository string) name.Repository {
+	t.Helper()
+	repo, err := name.NewRepository(repository, registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", repository, err)
+	}
+	return repo
+}
+
+// attachReferrer writes an artifact referring to subject into repo, and
+// returns its digest.
+func attachReferrer(t *testing.T, regs *testregistry.Registries, repo name.Repository, subject partial.Describable, artifactType string) registryv1.Hash {
+	t.Helper()
+	descriptor, err := partial.Descriptor(subject)
+	if err != nil {
+		t.Fatalf("describing subject: %v", err)
+	}
+	artifact := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.MediaType(artifactType))
+	referrer := mutate.Subject(artifact, *descriptor).(registryv1.Image)
+	digest, err := referrer.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if err := remote.Write(repo.Digest(digest.String()), referrer, regs.Options()...); err != nil {
+		t.Fatalf("writing referrer: %v", err)
+	}
+	return digest
+}
+
+// referrersAt lists the digests of the referrers of subject in repo.
+func referrersAt(t *testing.T, regs *testregistry.Registries, repo name.Repository, subject registryv1.Hash) map[registryv1.Hash]bool {
+	t.Helper()
+	index, err := remote.Referrers(repo.Digest(subject.String()), regs.Options()...)
+	if err != nil {
+		t.Fatalf("listing referrers: %v", err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatalf("listing referrers: %v", err)
+	}
+	found := make(map[registryv1.Hash]bool)
+	for _, descriptor := range manifest.Manifests {
+		found[descriptor.Digest] = true
+	}
+	return found
+}
+
+// TestCopyImageWithReferrersAcrossRegistries promotes an image from staging to
+// production: the manifest keeps its digest, the layers are streamed, and the
+// signature travels along -- and so does the signature of the signature.
+func TestCopyImageWithReferrersAcrossRegistries(t *testing.T) {
+	regs := testregistry.New("staging.example.com", "prod.example.com")
+	src := mustRepository(t, "staging.example.com/team/app")
+	dst := mustRepository(t, "prod.example.com/team/app")
+
+	image, err := random.Image(2048, 3)
+	if err != nil {
+		t.Fatalf("random image: %v", err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if err := remote.Write(src.Tag("candidate"), image, regs.Options()...); err != nil {
+		t.Fatalf("writing source: %v", err)
+	}
+	signature := attachReferrer(t, regs, src, image, "application/vnd.dev.cosign.artifact.sig.v1+json")
+	signatureManifest, err := remote.Image(src.Digest(signature.String()), regs.Options()...)
+	if err != nil {
+		t.Fatalf("reading signature: %v", err)
+	}
+	countersignature := attachReferrer(t, regs, src, signatureManifest, "application/vnd.dev.cosign.artifact.sig.v1+json")
+
+	copier := NewBuilder().
+		WithSourceRemoteOptions(regs.Options()...).
+		WithDestinationRemoteOptions(regs.Options()...).
+		Build()
+	result, err := copier.Copy(context.Background(), src.Tag("candidate"), dst, []string{"v1.2.3"})
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if result.Digest != digest || result.Mounted {
+		t.Errorf("result digest %s (mounted %v), want %s streamed", result.Digest, result.Mounted, digest)
+	}
+	if len(result.Referrers) != 2 {
+		t.Errorf("copied referrers %v, want the signature and its countersignature", result.Referrers)
+	}
+
+	copied, err := remote.Get(dst.Tag("v1.2.3"), regs.Options()...)
+	if err != nil {
+		t.Fatalf("reading copy: %v", err)
+	}
+	if copied.Digest != digest {
+		t.Errorf("copied tag points at %s, want %s", copied.Digest, digest)
+	}
+	if !referrersAt(t, regs, dst, digest)[signature] {
+		t.Errorf("signature %s not a referrer of the copy", signature)
+	}
+	if !referrersAt(t, regs, dst, signature)[countersignature] {
+		t.Errorf("countersignature %s not a referrer of the copied signature", countersignature)
+	}
+	if len(regs.Uploads("prod.example.com")) == 0 {
+		t.Error("no blob was uploaded to the other registry")
+	}
+}
+
+// TestCopyIndexWithinRegistryMounts copies an index into another repository of
+// the same registry: nothing is uploaded, and a referrer of a child manifest --
+// where a SOCI index hangs -- is copied too.
+func TestCopyIndexWithinRegistryMounts(t *testing.T) {
+	regs := testregistry.New("reg.example.com")
+	src := mustRepository(t, "reg.example.com/staging/app")
+	dst := mustRepository(t, "reg.example.com/prod/app")
+
+	index, err := random.Index(1024, 2, 2)
+	if err != nil {
+		t.Fatalf("random index: %v", err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	if err := remote.WriteIndex(src.Digest(digest.String()), index, regs.Options()...); err != nil {
+		t.Fatalf("writing source: %v", err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatalf("index manifest: %v", err)
+	}
+	child, err := index.Image(manifest.Manifests[0].Digest)
+	if err != nil {
+		t.Fatalf("child: %v", err)
+	}
+	soci := attachReferrer(t, regs, src, child, "application/vnd.amazon.soci.index.v2+json")
+	uploadsBefore := len(regs.Uploads("reg.example.com"))
+
+	copier := NewBuilder().
+		WithSourceRemoteOptions(regs.Options()...).
+		WithDestinationRemoteOptions(regs.Options()...).
+		Build()
+	result, err := copier.Copy(context.Background(), src.Digest(digest.String()), dst, nil)
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if !result.Mounted || result.Digest != digest {
+		t.Errorf("result %s (mounted %v), want %s mounted", result.Digest, result.Mounted, digest)
+	}
+	if got := len(regs.Uploads("reg.example.com")) - uploadsBefore; got != 0 {
+		t.Errorf("%d blob uploads within one registry, want every blob mounted", got)
+	}
+	if !referrersAt(t, regs, dst, manifest.Manifests[0].Digest)[soci] {
+		t.Errorf("SOCI index %s not a referrer of the copied child manifest", soci)
+	}
+
+	// Without referrers, only the index travels.
+	other := mustRepository(t, "reg.example.com/prod/app-bare")
+	bare, err := NewBuilder().WithSourceRemoteOptions(regs.Options()...).WithDestinationRemoteOptions(regs.Options()...).WithReferrers(false).Build().
+		Copy(context.Background(), src.Digest(digest.String()), other, nil)
+	if err != nil {
+		t.Fatalf("copy without referrers: %v", err)
+	}
+	if len(bare.Referrers) != 0 || len(referrersAt(t, regs, other, manifest.Manifests[0].Digest)) != 0 {
+		t.Errorf("copy without referrers copied %v", bare.Referrers)
+	}
+}
@@ -0,0 +1,83 @@
+package imagecopy
+
+import (
+	"fmt"
+
+	registryv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/prefetch"
+)
+
+// prefetchImage is an image whose layers are read ahead through pkg/prefetch.
+// Everything else, the raw manifest and config in particular, is the wrapped
+// image's, so the copy keeps its digest.
+type prefetchImage struct {
+	registryv1.Image
+	size int
+}
+
+func (i *prefetchImage) Layers() ([]registryv1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]registryv1.Layer, len(layers))
+	for n, layer := range layers {
+		wrapped[n] = prefetch.NewLayer(layer, prefetch.WithSize(i.size))
+	}
+	return wrapped, nil
+}
+
+func (i *prefetchImage) LayerByDigest(digest registryv1.Hash) (registryv1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return prefetch.NewLayer(layer, prefetch.WithSize(i.size)), nil
+}
+
+// prefetchIndex is an index whose images read their layers ahead. Its own
+// manifest is the wrapped index's.
+type prefetchIndex struct {
+	index registryv1.ImageIndex
+	size  int
+}
+
+func (x *prefetchIndex) MediaType() (types.MediaType, error) { return x.index.MediaType() }
+func (x *prefetchIndex) Digest() (registryv1.Hash, error)    { return x.index.Digest() }
+func (x *prefetchIndex) Size() (int64, error)                { return x.index.Size() }
+func (x *prefetchIndex) RawManifest() ([]byte, error)        { return x.index.RawManifest() }
+
+func (x *prefetchIndex) IndexManifest() (*registryv1.IndexManifest, error) {
+	return x.index.IndexManifest()
+}
+
+func (x *prefetchIndex) Image(digest registryv1.Hash) (registryv1.Image, error) {
+	image, err := x.index.Image(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &prefetchImage{Image: image, size: x.size}, nil
+}
+
+func (x *prefetchIndex) ImageIndex(digest registryv1.Hash) (registryv1.ImageIndex, error) {
+	index, err := x.index.ImageIndex(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &prefetchIndex{index: index, size: x.size}, nil
+}
+
+// Layer serves an index entry that is neither an image nor an index (an
+// artifact manifest, say) the way the wrapped index does, so the pusher can
+// still copy it.
+func (x *prefetchIndex) Layer(digest registryv1.Hash) (registryv1.Layer, error) {
+	withLayer, ok := x.index.(interface {
+		Layer(registryv1.Hash) (registryv1.Layer, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("index entry %s is neither an image nor an index", digest)
+	}
+	return withLayer.Layer(digest)
+}
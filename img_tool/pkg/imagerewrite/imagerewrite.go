@@ -0,0 +1,90 @@
+// Package imagerewrite replaces the layers of an image: it points a manifest
+// and its config at a new list of layers and updates the config descriptor to
+// match. It is shared by the commands that change the layers of an image that
+// is already built (`img optimize`, `img flatten` and `img rebase`), so that
+// they agree on what is kept.
+package imagerewrite
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+// ReadManifest reads an image manifest from a JSON file.
+func ReadManifest(path string) (specv1.Manifest, error) {
+	var manifest specv1.Manifest
+	if err := readJSON(path, &manifest); err != nil {
+		return specv1.Manifest{}, fmt.Errorf("reading manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+// ReadConfig reads an image config from a JSON file.
+func ReadConfig(path string) (specv1.Image, error) {
+	var config specv1.Image
+	if err := readJSON(path, &config); err != nil {
+		return specv1.Image{}, fmt.Errorf("reading config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ReplaceLayers points an image manifest and its config at a new list of
+// layers, in order: the config's rootfs.diff_ids and the manifest's layer
+// descriptors are replaced, and the config descriptor is updated to the
+// rewritten config. The other fields of both documents are kept. manifest and
+// config are updated in place, and their serialized forms are returned.
+func ReplaceLayers(manifest *specv1.Manifest, config *specv1.Image, layers []api.Descriptor) (manifestRaw, configRaw []byte, err error) {
+	descriptors := make([]specv1.Descriptor, 0, len(layers))
+	diffIDs := make([]digest.Digest, 0, len(layers))
+	for _, layer := range layers {
+		descriptors = append(descriptors, specv1.Descriptor{
+			MediaType:   layer.MediaType,
+			Digest:      digest.Digest(layer.Digest),
+			Size:        layer.Size,
+			Annotations: layer.Annotations,
+		})
+		diffIDs = append(diffIDs, digest.Digest(layer.DiffID))
+	}
+	config.RootFS = specv1.RootFS{Type: "layers", DiffIDs: diffIDs}
+
+	configRaw, err = json.Marshal(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling rewritten config: %w", err)
+	}
+
+	if manifest.Config.MediaType == "" {
+		manifest.Config.MediaType = specv1.MediaTypeImageConfig
+	}
+	manifest.Config.Digest = digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256(configRaw)))
+	manifest.Config.Size = int64(len(configRaw))
+	manifest.Config.Data = nil
+	if manifest.SchemaVersion == 0 {
+		manifest.Versioned = specs.Versioned{SchemaVersion: 2}
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = specv1.MediaTypeImageManifest
+	}
+	manifest.Layers = descriptors
+
+	manifestRaw, err = json.Marshal(manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling rewritten manifest: %w", err)
+	}
+	return manifestRaw, configRaw, nil
+}
+
+func readJSON(path string, value any) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, value)
+}
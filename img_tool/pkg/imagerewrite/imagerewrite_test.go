@@ -0,0 +1,76 @@
+package imagerewrite
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+func TestReplaceLayers(t *testing.T) {
+	manifest := specv1.Manifest{
+		Config: specv1.Descriptor{
+			MediaType: specv1.MediaTypeImageConfig,
+			Digest:    "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			Size:      1,
+			Data:      []byte("{}"),
+		},
+		Layers: []specv1.Descriptor{
+			{MediaType: specv1.MediaTypeImageLayerGzip, Digest: "sha256:1111111111111111111111111111111111111111111111111111111111111111", Size: 10},
+		},
+		Annotations: map[string]string{"org.opencontainers.image.source": "https://example.com/app"},
+	}
+	config := specv1.Image{
+		Platform: specv1.Platform{OS: "linux", Architecture: "amd64"},
+		Config:   specv1.ImageConfig{Entrypoint: []string{"/app"}},
+		RootFS:   specv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{"sha256:2222222222222222222222222222222222222222222222222222222222222222"}},
+		History:  []specv1.History{{CreatedBy: "base"}},
+	}
+	layers := []api.Descriptor{{
+		MediaType:   specv1.MediaTypeImageLayerZstd,
+		Digest:      "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+		DiffID:      "sha256:4444444444444444444444444444444444444444444444444444444444444444",
+		Size:        20,
+		Annotations: map[string]string{"containerd.io/snapshot/stargz/toc.digest": "sha256:toc"},
+	}}
+
+	manifestRaw, configRaw, err := ReplaceLayers(&manifest, &config, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotManifest specv1.Manifest
+	if err := json.Unmarshal(manifestRaw, &gotManifest); err != nil {
+		t.Fatal(err)
+	}
+	var gotConfig specv1.Image
+	if err := json.Unmarshal(configRaw, &gotConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if gotManifest.SchemaVersion != 2 || gotManifest.MediaType != specv1.MediaTypeImageManifest {
+		t.Errorf("manifest version = %d, media type = %q", gotManifest.SchemaVersion, gotManifest.MediaType)
+	}
+	if len(gotManifest.Layers) != 1 || gotManifest.Layers[0].Digest.String() != layers[0].Digest || gotManifest.Layers[0].Annotations["containerd.io/snapshot/stargz/toc.digest"] != "sha256:toc" {
+		t.Errorf("layers = %+v, want the new layer with its annotations", gotManifest.Layers)
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256(configRaw)); gotManifest.Config.Digest.String() != want || gotManifest.Config.Size != int64(len(configRaw)) {
+		t.Errorf("config descriptor = %+v, want digest %s and size %d", gotManifest.Config, want, len(configRaw))
+	}
+	if gotManifest.Config.Data != nil {
+		t.Errorf("config descriptor keeps the data of the old config")
+	}
+	if gotManifest.Annotations["org.opencontainers.image.source"] == "" {
+		t.Errorf("manifest annotations were dropped")
+	}
+	if len(gotConfig.RootFS.DiffIDs) != 1 || gotConfig.RootFS.DiffIDs[0].String() != layers[0].DiffID {
+		t.Errorf("diff_ids = %v, want the new layer's diff ID", gotConfig.RootFS.DiffIDs)
+	}
+	if gotConfig.OS != "linux" || len(gotConfig.Config.Entrypoint) != 1 || len(gotConfig.History) != 1 {
+		t.Errorf("config = %+v, want its platform, run config and history kept", gotConfig)
+	}
+}
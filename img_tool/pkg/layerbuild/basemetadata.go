@@ -1,4 +1,4 @@
-package layer
+package layerbuild
 
 import (
 	"archive/tar"
@@ -21,7 +21,7 @@ import (
 // exceptions applied by the layer's own metadata provider: an entry whose mtime
 // is unset picks up the layer's default mtime, and a --file-metadata override
 // for the entry's path wins outright.
-func writeBaseEntries(recorder tree.Recorder, streamPaths []string, createParentDirectories bool, layerMetadata *LayerMetadata) error {
+func writeBaseEntries(recorder tree.Recorder, streamPaths []string, createParentDirectories bool, layerMetadata *Metadata) error {
 	streams := make([][]*baselayer.BaseEntry, 0, len(streamPaths))
 	for _, streamPath := range streamPaths {
 		entries, err := basemeta.ReadFile(streamPath)
@@ -48,7 +48,7 @@ func writeBaseEntries(recorder tree.Recorder, streamPaths []string, createParent
 }
 
 // writeBaseEntry records a single entry.
-func writeBaseEntry(recorder tree.Recorder, entry *baselayer.BaseEntry, layerMetadata *LayerMetadata) error {
+func writeBaseEntry(recorder tree.Recorder, entry *baselayer.BaseEntry, layerMetadata *Metadata) error {
 	header, err := basemeta.ToTarHeader(entry)
 	if err != nil {
 		return err
@@ -85,7 +85,7 @@ func writeBaseEntry(recorder tree.Recorder, entry *baselayer.BaseEntry, layerMet
 // applyBaseEntryOverrides folds the layer's own metadata into a base entry's
 // header: the default mtime fills in for an entry that has none, and a
 // per-path --file-metadata override replaces whatever the entry chose.
-func applyBaseEntryOverrides(header *tar.Header, entry *baselayer.BaseEntry, layerMetadata *LayerMetadata) error {
+func applyBaseEntryOverrides(header *tar.Header, entry *baselayer.BaseEntry, layerMetadata *Metadata) error {
 	if entry.GetMtimeUnixNanos() == 0 && layerMetadata.Defaults != nil && layerMetadata.Defaults.Mtime != nil {
 		if err := applyFileMetadata(header, &FileMetadata{Mtime: layerMetadata.Defaults.Mtime}); err != nil {
 			return err
@@ -0,0 +1,154 @@
+package layerbuild
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compress"
+)
+
+// FileFlags are the flags of `img layer` that put files into a layer: --add,
+// --add-from-file, --import-tar, --symlink, --symlinks-from-file,
+// --empty-files-from-file, --default-metadata, --file-metadata and
+// --create-parent-directories. Commands that build a layer of their own
+// (`img mutate`) register them to take files exactly the way `img layer` does.
+type FileFlags struct {
+	addFiles                Files
+	addFromFile             Paths
+	importTars              Paths
+	symlinks                Symlinks
+	symlinksFromFiles       Paths
+	emptyFilesFromFiles     Paths
+	defaultMetadata         string
+	fileMetadata            FileMetadataFlag
+	createParentDirectories bool
+}
+
+// Register adds the flags to flagSet.
+func (f *FileFlags) Register(flagSet *flag.FlagSet) {
+	f.fileMetadata = make(FileMetadataFlag)
+	flagSet.Var(&f.addFiles, "add", `Add a file or directory to the layer, as <path_in_image>=<file> (see "img layer --add").`)
+	flagSet.Var(&f.addFromFile, "add-from-file", `Add all files listed in the parameter file to the layer (see "img layer --add-from-file").`)
+	flagSet.Var(&f.importTars, "import-tar", `Import all files from the given tar file into the layer.`)
+	flagSet.Var(&f.symlinks, "symlink", `Add a symlink to the layer, as <path_in_image>=<target>.`)
+	flagSet.Var(&f.symlinksFromFiles, "symlinks-from-file", `Add all symlinks listed in the parameter file to the layer (see "img layer --symlinks-from-file").`)
+	flagSet.Var(&f.emptyFilesFromFiles, "empty-files-from-file", `Create zero-size regular files at the paths listed in the parameter file (one path per line).`)
+	flagSet.StringVar(&f.defaultMetadata, "default-metadata", "", `JSON-encoded default metadata to apply to all files in the layer (mode, uid, gid, uname, gname, mtime, pax_records).`)
+	flagSet.Var(&f.fileMetadata, "file-metadata", `Per-file metadata override in the format path=json. Can be specified multiple times.`)
+	flagSet.BoolVar(&f.createParentDirectories, "create-parent-directories", false, `Create parent directory entries in the layer for all files.`)
+}
+
+// Empty reports whether the flags add nothing to a layer.
+func (f *FileFlags) Empty() bool {
+	return len(f.addFiles) == 0 && len(f.addFromFile) == 0 && len(f.importTars) == 0 &&
+		len(f.symlinks) == 0 && len(f.symlinksFromFiles) == 0 && len(f.emptyFilesFromFiles) == 0
+}
+
+// WriteLayer writes a layer with the files to w, compressed with
+// compressionAlgorithm, and returns its metadata as `img layer --metadata`
+// writes it, with history as the created_by of its history entry.
+func (f *FileFlags) WriteLayer(compressionAlgorithm api.CompressionAlgorithm, history string, w io.Writer) (api.Descriptor, error) {
+	layerMetadata, err := ParseMetadata(f.defaultMetadata, f.fileMetadata)
+	if err != nil {
+		return api.Descriptor{}, fmt.Errorf("parsing metadata: %w", err)
+	}
+	contents := Contents{
+		ImportTars: f.importTars,
+		Files:      append(Files{}, f.addFiles...),
+		Symlinks:   append(Symlinks{}, f.symlinks...),
+	}
+	for _, paramFile := range f.addFromFile {
+		ops, err := ReadParamFile(paramFile)
+		if err != nil {
+			return api.Descriptor{}, fmt.Errorf("reading parameter file: %w", err)
+		}
+		contents.Files = append(contents.Files, ops...)
+	}
+	for _, paramFile := range f.symlinksFromFiles {
+		ops, err := ReadSymlinkParamFile(paramFile)
+		if err != nil {
+			return api.Descriptor{}, fmt.Errorf("reading symlink parameter file: %w", err)
+		}
+		contents.Symlinks = append(contents.Symlinks, ops...)
+	}
+	for _, paramFile := range f.emptyFilesFromFiles {
+		paths, err := ReadEmptyFilesParamFile(paramFile)
+		if err != nil {
+			return api.Descriptor{}, fmt.Errorf("reading empty files parameter file: %w", err)
+		}
+		contents.EmptyFiles = append(contents.EmptyFiles, paths...)
+	}
+
+	state, err := Write(w, contents, Options{
+		Compression:             compressionAlgorithm,
+		CompressOptions:         []compress.Option{compress.CompressorJobs(1)},
+		CreateParentDirectories: f.createParentDirectories,
+		Metadata:                layerMetadata,
+	})
+	if err != nil {
+		return api.Descriptor{}, err
+	}
+
+	var raw bytes.Buffer
+	if err := WriteMetadata(history, compressionAlgorithm, false, "", nil, state, &raw); err != nil {
+		return api.Descriptor{}, err
+	}
+	var desc api.Descriptor
+	if err := json.Unmarshal(raw.Bytes(), &desc); err != nil {
+		return api.Descriptor{}, fmt.Errorf("decoding layer metadata: %w", err)
+	}
+	return desc, nil
+}
+
+// Paths is a flag taking the path of an existing file, e.g. a parameter file
+// or a tar to import. It can be repeated.
+type Paths []string
+
+func (p *Paths) String() string {
+	return strings.Join(*p, ", ")
+}
+
+func (p *Paths) Set(value string) error {
+	if _, err := os.Stat(value); err != nil {
+		return fmt.Errorf("file %s does not exist: %w", value, err)
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+// FileMetadataFlag implements flag.Value for path=json metadata pairs
+type FileMetadataFlag map[string]string
+
+func (f FileMetadataFlag) String() string {
+	var keys []string
+	for k := range f {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, f[k]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f FileMetadataFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("file metadata must be in format path=json, got: %s", value)
+	}
+	path := strings.TrimSpace(parts[0])
+	jsonMetadata := strings.TrimSpace(parts[1])
+	if path == "" {
+		return fmt.Errorf("file path cannot be empty")
+	}
+	f[path] = jsonMetadata
+	return nil
+}
@@ -0,0 +1,184 @@
+package layerbuild
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/tree/treeartifact"
+)
+
+// File is a file, directory or symlink of the host filesystem added to a
+// layer at PathInImage.
+type File struct {
+	PathInImage string
+	File        string
+	FileType    api.FileType
+}
+
+func (a File) Type() api.FileType {
+	return a.FileType
+}
+
+func (a File) Open() (fs.File, error) {
+	return os.Open(a.File)
+}
+
+func (a File) Tree() (fs.FS, error) {
+	if a.FileType != api.Directory {
+		return nil, fmt.Errorf("cannot get tree for non-directory file: %s", a.File)
+	}
+	// TODO: consider using a special
+	// file system for tree artifacts
+	// that filters out non-regular files.
+	return treeartifact.TreeArtifactFS(a.File), nil
+}
+
+func (a File) Readlink() (string, error) {
+	if a.FileType != api.Symlink {
+		return "", fmt.Errorf("cannot get link target for non-symlink file: %s", a.File)
+	}
+	return os.Readlink(a.File)
+}
+
+func (a File) Path() string {
+	return a.File
+}
+
+// Files is the --add flag: files added as <path_in_image>=<file>.
+type Files []File
+
+func (a *Files) String() string {
+	var sb strings.Builder
+	for i, a := range *a {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(a.PathInImage)
+		sb.WriteString("=")
+		sb.WriteString(a.File)
+	}
+	return sb.String()
+}
+
+func (a *Files) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid format for --add: %s", value)
+	}
+	if len(parts[0]) == 0 {
+		return fmt.Errorf("path in image cannot be empty: %s", value)
+	}
+	if parts[0][0] == '/' {
+		// remove leading slash in target
+		parts[0] = parts[0][1:]
+	}
+	fInfo, err := os.Stat(parts[1])
+	if err != nil {
+		return fmt.Errorf("file %s does not exist: %w", parts[1], err)
+	}
+	var fileType api.FileType
+	if fInfo.Mode()&fs.ModeSymlink != 0 {
+		fileType = api.Symlink
+	} else if fInfo.IsDir() {
+		fileType = api.Directory
+	} else {
+		fileType = api.RegularFile
+	}
+	*a = append(*a, File{
+		PathInImage: parts[0],
+		File:        parts[1],
+		FileType:    fileType,
+	})
+	return nil
+}
+
+// Executable is an executable added to a layer with the runfiles listed in
+// its parameter file.
+type Executable struct {
+	PathInImage           string
+	Executable            string
+	RunfilesParameterFile string
+}
+
+// Executables is the --executable flag: executables added as
+// <path_in_image>=<executable>.
+type Executables []Executable
+
+func (e *Executables) String() string {
+	var sb strings.Builder
+	for i, e := range *e {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(e.PathInImage)
+		sb.WriteString("=")
+		sb.WriteString(e.Executable)
+	}
+	return sb.String()
+}
+
+func (e *Executables) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid format for --executable: %s", value)
+	}
+	if _, err := os.Stat(parts[1]); err != nil {
+		return fmt.Errorf("executable %s does not exist: %w", parts[1], err)
+	}
+	if len(parts[0]) == 0 {
+		return fmt.Errorf("path in image cannot be empty: %s", value)
+	}
+	if parts[0][0] == '/' {
+		// remove leading slash in target
+		parts[0] = parts[0][1:]
+	}
+	*e = append(*e, Executable{
+		PathInImage: parts[0],
+		Executable:  parts[1],
+	})
+	return nil
+}
+
+// Symlink is a symlink added to a layer.
+type Symlink struct {
+	LinkName string
+	Target   string
+}
+
+// Symlinks is the --symlink flag: symlinks added as <path_in_image>=<target>.
+type Symlinks []Symlink
+
+func (s *Symlinks) String() string {
+	var sb strings.Builder
+	for i, s := range *s {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(s.LinkName)
+		sb.WriteString(" → ")
+		sb.WriteString(s.Target)
+	}
+	return sb.String()
+}
+
+func (s *Symlinks) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid format for --symlink: %s", value)
+	}
+	if len(parts[0]) == 0 {
+		return fmt.Errorf("link name cannot be empty: %s", value)
+	}
+	if parts[0][0] == '/' {
+		// remove leading slash in link name
+		parts[0] = parts[0][1:]
+	}
+	*s = append(*s, Symlink{
+		LinkName: parts[0],
+		Target:   parts[1],
+	})
+	return nil
+}
@@ -0,0 +1,321 @@
+// Package layerbuild writes container image layers from files of the host
+// filesystem: the engine behind `img layer`, shared with the commands that
+// build a layer of their own (`img mutate`). Write records Contents into a tar
+// stream with content deduplication, compresses it and returns the state of
+// the compressor, from which WriteMetadata writes the layer metadata the
+// image_manifest rule reads.
+package layerbuild
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/compress"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/digestfs"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/metadata"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/tarcas"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/tree"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/tree/runfiles"
+)
+
+// Contents are what goes into a layer. They are written in this order: the
+// entries of the base metadata streams, the imported tars, the files, the
+// executables with their runfiles, the symlinks and the empty files.
+type Contents struct {
+	// BaseMetadataPaths are base metadata streams written by `img base`. For
+	// a path described by several streams, the last one wins.
+	BaseMetadataPaths []string
+	ImportTars        []string
+	Files             Files
+	Executables       Executables
+	Symlinks          Symlinks
+	// EmptyFiles are paths in the image of zero-size regular files.
+	EmptyFiles []string
+}
+
+// Options say how a layer is written.
+type Options struct {
+	Compression api.CompressionAlgorithm
+	// Seekable writes a seekable stream: estargz for gzip, or zstd:chunked
+	// for zstd together with compress.ZstdChunked.
+	Seekable bool
+	// CompressOptions tune the compressor, e.g. its level and jobs.
+	CompressOptions []compress.Option
+	// TarCASOptions are added to those the options below imply, e.g. a
+	// compact stream writer.
+	TarCASOptions           []tarcas.Option
+	CreateParentDirectories bool
+	// DeduplicateTreeArtifacts replaces tree artifacts that were already
+	// written with symlinks to the first copy.
+	DeduplicateTreeArtifacts bool
+	// Metadata sets the modes, owners and times of the entries; nil keeps
+	// those of the host filesystem.
+	Metadata *Metadata
+	// CASImporter lists content of previous layers that is not written
+	// again, and CASExporter receives the content of this layer. Either may
+	// be nil.
+	CASImporter api.CASStateSupplier
+	CASExporter api.CASStateExporter
+}
+
+// Write writes a layer with the contents to w and returns the state of its
+// compressor: the diff ID, digest and size of the layer, and the annotations
+// the compression adds. The compressor is finalized when Write returns.
+func Write(w io.Writer, contents Contents, opts Options) (api.AppenderState, error) {
+	// Create shared digestfs with precaching
+	digestFS := digestfs.New(&tarcas.SHA256Helper{})
+	precacher := digestfs.NewPrecacher(digestFS, 4)
+	defer precacher.Close()
+
+	// Start precaching files in the background
+	startPrecaching(precacher, contents)
+
+	compressor, err := compress.TarAppenderFactory("sha256", string(opts.Compression), opts.Seekable, w, opts.CompressOptions...)
+	if err != nil {
+		return api.AppenderState{}, fmt.Errorf("creating compressor: %w", err)
+	}
+	tarcasOpts := append([]tarcas.Option{
+		tarcas.CreateParentDirectories(opts.CreateParentDirectories),
+		tarcas.DeduplicateTreeArtifacts(opts.DeduplicateTreeArtifacts),
+	}, opts.TarCASOptions...)
+	tw, err := tarcas.CASFactoryWithDigestFS("sha256", compressor, digestFS, tarcasOpts...)
+	if err != nil {
+		return api.AppenderState{}, fmt.Errorf("creating Content-addressable storage inside tar file: %w", err)
+	}
+	if opts.CASImporter != nil {
+		if err := tw.Import(opts.CASImporter); err != nil {
+			return api.AppenderState{}, fmt.Errorf("importing content manifests for deduplication: %w", err)
+		}
+	}
+
+	recorder := tree.NewRecorder(tw)
+	if opts.Metadata != nil {
+		recorder = recorder.WithMetadata(opts.Metadata)
+	}
+	if err := writeContents(recorder, contents, opts.CreateParentDirectories, opts.Metadata); err != nil {
+		return api.AppenderState{}, err
+	}
+	if opts.CASExporter != nil {
+		if err := tw.Export(opts.CASExporter); err != nil {
+			return api.AppenderState{}, err
+		}
+	}
+
+	// Closing the tar writer flushes all tar data into the compressor, which
+	// only knows the digest and size of the compressed stream once it is
+	// finalized.
+	if err := tw.Close(); err != nil {
+		return api.AppenderState{}, fmt.Errorf("closing tar writer: %w", err)
+	}
+	state, err := compressor.Finalize()
+	if err != nil {
+		return api.AppenderState{}, fmt.Errorf("closing compressor: %w", err)
+	}
+	return state, nil
+}
+
+// writeContents records the contents of a layer, in the order documented on
+// Contents.
+func writeContents(recorder tree.Recorder, contents Contents, createParentDirectories bool, layerMetadata *Metadata) error {
+	// Base metadata comes first: it describes the scaffolding of the image (the
+	// directory skeleton, /etc, the trust store), and writing it ahead of
+	// everything else keeps parent directories in front of the files placed
+	// into them.
+	if len(contents.BaseMetadataPaths) > 0 {
+		if err := writeBaseEntries(recorder, contents.BaseMetadataPaths, createParentDirectories, layerMetadata); err != nil {
+			return err
+		}
+	}
+
+	for _, tarFile := range contents.ImportTars {
+		if err := recorder.ImportTar(tarFile); err != nil {
+			return fmt.Errorf("importing tar file: %w", err)
+		}
+	}
+
+	for _, op := range contents.Files {
+		switch op.FileType {
+		case api.RegularFile:
+			if err := recorder.RegularFileFromPath(op.File, op.PathInImage); err != nil {
+				return fmt.Errorf("writing regular file: %w", err)
+			}
+		case api.Directory:
+			if err := recorder.TreeFromPath(op.File, op.PathInImage); err != nil {
+				return fmt.Errorf("writing directory: %w", err)
+			}
+		case api.Symlink:
+			link, err := op.Readlink()
+			if err != nil {
+				return fmt.Errorf("reading symlink: %w", err)
+			}
+			if err := recorder.Symlink(link, op.PathInImage); err != nil {
+				return fmt.Errorf("writing symlink: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown type %s for file %s", op.FileType.String(), op.File)
+		}
+	}
+
+	for _, op := range contents.Executables {
+		runfilesList, err := ReadParamFile(op.RunfilesParameterFile)
+		if err != nil {
+			return fmt.Errorf("reading runfiles parameter file: %w", err)
+		}
+		accessor := runfiles.NewRunfilesFS()
+		for _, f := range runfilesList {
+			accessor.Add(f.PathInImage, f)
+		}
+		if err := recorder.Executable(op.Executable, op.PathInImage, accessor); err != nil {
+			return fmt.Errorf("writing executable: %w", err)
+		}
+	}
+
+	for _, op := range contents.Symlinks {
+		if err := recorder.Symlink(op.Target, op.LinkName); err != nil {
+			return fmt.Errorf("writing symlink: %w", err)
+		}
+	}
+
+	for _, path := range contents.EmptyFiles {
+		if err := recorder.EmptyFile(path); err != nil {
+			return fmt.Errorf("writing empty file: %w", err)
+		}
+	}
+
+	// Verify that all file metadata entries were used
+	if layerMetadata != nil {
+		if err := layerMetadata.VerifyAllFileMetadataUsed(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeMetadata(history string, compressionAlgorithm api.CompressionAlgorithm, useEstargz bool, mediaTypeOverride string, annotations map[string]string, compressorState api.AppenderState, outputFile io.Writer) error {
+	// Record the created_by history from the user-provided --history; a missing
+	// value becomes "history missing" (LayerHistory).
+	layerHistory := api.LayerHistory(history)
+	var mediaType string
+	if mediaTypeOverride != "" {
+		mediaType = mediaTypeOverride
+	} else {
+		switch compressionAlgorithm {
+		case api.Uncompressed:
+			mediaType = "application/vnd.oci.image.layer.v1.tar"
+		case api.Gzip:
+			mediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+		case api.Zstd:
+			mediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+		default:
+			return fmt.Errorf("unsupported compression algorithm: %s", compressionAlgorithm)
+		}
+	}
+
+	// Merge user annotations with layer annotations from the appender state
+	mergedAnnotations := metadata.MergeAnnotations(annotations, compressorState.LayerAnnotations)
+
+	// Replace sentinel annotation values with computed diff ID
+	diffID := fmt.Sprintf("sha256:%x", compressorState.ContentHash)
+	for _, key := range annotationKeysWithDerivableDiffID {
+		if v, ok := mergedAnnotations[key]; ok && v == "DERIVE_FROM_DIFF_ID" {
+			mergedAnnotations[key] = diffID
+		}
+	}
+
+	return metadata.WriteLayerMetadata(
+		fmt.Sprintf("sha256:%x", compressorState.ContentHash),
+		mediaType,
+		fmt.Sprintf("sha256:%x", compressorState.OuterHash),
+		compressorState.CompressedSize,
+		mergedAnnotations,
+		layerHistory,
+		outputFile,
+	)
+}
+
+// WriteMetadata writes the metadata of a layer as `img layer --metadata`
+// does: its diff ID, media type, digest, size, annotations and history entry
+// with history as created_by. The media type follows the compression unless
+// mediaTypeOverride is set.
+func WriteMetadata(history string, compressionAlgorithm api.CompressionAlgorithm, useEstargz bool, mediaTypeOverride string, annotations map[string]string, compressorState api.AppenderState, outputFile io.Writer) error {
+	// Record the created_by history from the user-provided --history; a missing
+	// value becomes "history missing" (LayerHistory).
+	layerHistory := api.LayerHistory(history)
+	var mediaType string
+	if mediaTypeOverride != "" {
+		mediaType = mediaTypeOverride
+	} else {
+		switch compressionAlgorithm {
+		case api.Uncompressed:
+			mediaType = "application/vnd.oci.image.layer.v1.tar"
+		case api.Gzip:
+			mediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+		case api.Zstd:
+			mediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+		default:
+			return fmt.Errorf("unsupported compression algorithm: %s", compressionAlgorithm)
+		}
+	}
+
+	// Merge user annotations with layer annotations from the appender state
+	mergedAnnotations := metadata.MergeAnnotations(annotations, compressorState.LayerAnnotations)
+
+	// Replace sentinel annotation values with computed diff ID
+	diffID := fmt.Sprintf("sha256:%x", compressorState.ContentHash)
+	for _, key := range annotationKeysWithDerivableDiffID {
+		if v, ok := mergedAnnotations[key]; ok && v == "DERIVE_FROM_DIFF_ID" {
+			mergedAnnotations[key] = diffID
+		}
+	}
+
+	return metadata.WriteLayerMetadata(
+		fmt.Sprintf("sha256:%x", compressorState.ContentHash),
+		mediaType,
+		fmt.Sprintf("sha256:%x", compressorState.OuterHash),
+		compressorState.CompressedSize,
+		mergedAnnotations,
+		layerHistory,
+		outputFile,
+	)
+}
+
+// startPrecaching begins background digest calculation for files that will be processed
+func startPrecaching(precacher *digestfs.Precacher, contents Contents) {
+	// Collect all files that will need digest calculation
+	var filesToPrecache []string
+
+	// Add files from the --add operations
+	for _, op := range contents.Files {
+		if op.FileType == api.RegularFile {
+			filesToPrecache = append(filesToPrecache, op.File)
+		}
+	}
+
+	// Add executable files and their runfiles
+	for _, op := range contents.Executables {
+		filesToPrecache = append(filesToPrecache, op.Executable)
+
+		// Add runfiles if available
+		if op.RunfilesParameterFile != "" {
+			runfilesList, err := ReadParamFile(op.RunfilesParameterFile)
+			if err == nil {
+				for _, f := range runfilesList {
+					if f.FileType == api.RegularFile {
+						filesToPrecache = append(filesToPrecache, f.File)
+					}
+				}
+			}
+		}
+	}
+
+	// Start precaching in the background
+	precacher.PrecacheFiles(filesToPrecache)
+}
+
+// any annotation keys in this list can be set to the magic sentinel
+// "DERIVE_FROM_DIFF_ID" to inject the diff_id as a layer annotation.
+var annotationKeysWithDerivableDiffID = []string{
+	"io.deis.oras.content.digest",
+}
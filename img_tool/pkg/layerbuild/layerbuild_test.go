@@ -0,0 +1,61 @@
+package layerbuild
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	hello := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(hello, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	state, err := Write(&buf, Contents{
+		Files:      Files{{PathInImage: "app/hello.txt", File: hello, FileType: api.RegularFile}},
+		Symlinks:   Symlinks{{LinkName: "app/greeting", Target: "hello.txt"}},
+		EmptyFiles: []string{"app/.keep"},
+	}, Options{
+		Compression:             api.Uncompressed,
+		CreateParentDirectories: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CompressedSize != int64(buf.Len()) {
+		t.Errorf("CompressedSize = %d, want the %d bytes written", state.CompressedSize, buf.Len())
+	}
+
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = hdr
+	}
+	if hdr := entries["app/hello.txt"]; hdr == nil || hdr.Size != 5 {
+		t.Errorf("app/hello.txt = %+v, want a 5 byte file", hdr)
+	}
+	if hdr := entries["app/greeting"]; hdr == nil || hdr.Linkname != "hello.txt" {
+		t.Errorf("app/greeting = %+v, want a symlink to hello.txt", hdr)
+	}
+	if hdr := entries["app/.keep"]; hdr == nil || hdr.Size != 0 {
+		t.Errorf("app/.keep = %+v, want an empty file", hdr)
+	}
+	if entries["app/"] == nil && entries["app"] == nil {
+		t.Errorf("entries = %v, want the parent directory app created", entries)
+	}
+}
@@ -1,4 +1,4 @@
-package layer
+package layerbuild
 
 import (
 	"archive/tar"
@@ -21,16 +21,16 @@ type FileMetadata struct {
 	PAXRecords map[string]string `json:"pax_records,omitempty"`
 }
 
-// LayerMetadata holds all metadata configuration for a layer
-type LayerMetadata struct {
+// Metadata holds all metadata configuration for a layer
+type Metadata struct {
 	Defaults      *FileMetadata
 	FileOverrides map[string]*FileMetadata
 	usageCounts   map[string]int // tracks how many times each FileOverride entry is used
 }
 
-// ParseLayerMetadata parses the default metadata and file-specific metadata
-func ParseLayerMetadata(defaultJSON string, fileMetadata map[string]string) (*LayerMetadata, error) {
-	result := &LayerMetadata{
+// ParseMetadata parses the default metadata and file-specific metadata
+func ParseMetadata(defaultJSON string, fileMetadata map[string]string) (*Metadata, error) {
+	result := &Metadata{
 		FileOverrides: make(map[string]*FileMetadata),
 		usageCounts:   make(map[string]int),
 	}
@@ -62,7 +62,7 @@ func ParseLayerMetadata(defaultJSON string, fileMetadata map[string]string) (*La
 
 // ApplyToHeader applies the metadata to a tar header, with file-specific overrides taking precedence
 // This implements the tree.MetadataProvider interface
-func (lm *LayerMetadata) ApplyToHeader(hdr *tar.Header, pathInImage string) error {
+func (lm *Metadata) ApplyToHeader(hdr *tar.Header, pathInImage string) error {
 	// First apply defaults
 	if lm.Defaults != nil {
 		if err := applyFileMetadata(hdr, lm.Defaults); err != nil {
@@ -84,7 +84,7 @@ func (lm *LayerMetadata) ApplyToHeader(hdr *tar.Header, pathInImage string) erro
 // markUsed records that a file metadata override was applied, so
 // VerifyAllFileMetadataUsed does not report it as unused. Callers that apply an
 // override themselves (rather than going through ApplyToHeader) must call this.
-func (lm *LayerMetadata) markUsed(pathInImage string) {
+func (lm *Metadata) markUsed(pathInImage string) {
 	if lm == nil {
 		return
 	}
@@ -93,7 +93,7 @@ func (lm *LayerMetadata) markUsed(pathInImage string) {
 
 // VerifyAllFileMetadataUsed checks if all file metadata entries have been used at least once
 // Returns an error if any entries are unused, listing all unused paths
-func (lm *LayerMetadata) VerifyAllFileMetadataUsed() error {
+func (lm *Metadata) VerifyAllFileMetadataUsed() error {
 	if lm == nil || len(lm.FileOverrides) == 0 {
 		return nil // no file metadata to verify
 	}
@@ -0,0 +1,172 @@
+package layerbuild
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+// ReadParamFile reads the files of an --add-from-file parameter file, written
+// by Bazel: one line per file with its path in the image, a null byte, a type
+// character ('f', 'd' or 'l') and its path in the host filesystem.
+func ReadParamFile(paramFile string) (Files, error) {
+	file, err := os.Open(paramFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening parameter file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	var files Files
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		pathInImage, typeOfFile, file, err := SplitParamFileLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("parsing parameter file: %w", err)
+		}
+		typ, err := ParseFileType(typeOfFile, file)
+		if err != nil {
+			return nil, fmt.Errorf("parsing parameter file: %w", err)
+		}
+		files = append(files, File{
+			PathInImage: pathInImage,
+			File:        file,
+			FileType:    typ,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading parameter file: %w", err)
+	}
+	return files, nil
+}
+
+// ParseFileType maps the single-character type prefix used in parameter files to
+// an api.FileType. Bazel's is_directory attribute doesn't work for source
+// directories, so source directories are marked as "f" even though they're
+// actually directories; we check the actual filesystem type to handle this.
+func ParseFileType(typeOfFile, file string) (api.FileType, error) {
+	switch typeOfFile {
+	case "f":
+		if fileInfo, err := os.Stat(file); err == nil && fileInfo.IsDir() {
+			return api.Directory, nil
+		}
+		return api.RegularFile, nil
+	case "d":
+		return api.Directory, nil
+	case "l":
+		return api.Symlink, nil
+	default:
+		return api.FileType{}, fmt.Errorf("invalid type %q", typeOfFile)
+	}
+}
+
+// SplitParamFileLine splits a line of an --add-from-file parameter file into
+// the path in the image, the type character and the path in the host
+// filesystem.
+func SplitParamFileLine(line string) (string, string, string, error) {
+	// Split the line into three parts: pathInImage, type, and file
+	parts := strings.SplitN(line, "\x00", 2)
+	if len(parts) != 2 {
+		return "", "", "", fmt.Errorf("invalid format for line: %s", line)
+	}
+	pathInImage := parts[0]
+	if len(pathInImage) == 0 {
+		return "", "", "", fmt.Errorf("path in image cannot be empty: %s", line)
+	}
+	if pathInImage[0] == '/' {
+		return "", "", "", fmt.Errorf("path in image cannot start with '/'. Use %q instead", line[1:])
+	}
+	rest := parts[1]
+	if len(rest) < 2 {
+		return "", "", "", fmt.Errorf("invalid format for line: %s", line)
+	}
+	typeOfFile := rest[:1]
+	file := rest[1:]
+	if typeOfFile != "f" && typeOfFile != "d" && typeOfFile != "l" {
+		return "", "", "", fmt.Errorf("invalid type for line: %s", line)
+	}
+	return pathInImage, typeOfFile, file, nil
+}
+
+// ReadSymlinkParamFile reads the symlinks of a --symlinks-from-file parameter
+// file: one line per symlink with its path in the image, a null byte and its
+// target.
+func ReadSymlinkParamFile(paramFile string) (Symlinks, error) {
+	file, err := os.Open(paramFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening parameter file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	var links Symlinks
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		pathInImage, file, err := splitParamFileLineKV(line)
+		if err != nil {
+			return nil, fmt.Errorf("parsing parameter file: %w", err)
+		}
+		links = append(links, Symlink{
+			LinkName: pathInImage,
+			Target:   file,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading parameter file: %w", err)
+	}
+	return links, nil
+}
+
+// splitParamFileLineKV splits a line in the parameter file into key and value.
+// This can be used if the file doesn't contain a type character.
+func splitParamFileLineKV(line string) (string, string, error) {
+	parts := strings.SplitN(line, "\x00", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid format for line: %s", line)
+	}
+	pathInImage := parts[0]
+	if len(pathInImage) == 0 {
+		return "", "", fmt.Errorf("path in image cannot be empty: %s", line)
+	}
+	value := parts[1]
+	return pathInImage, value, nil
+}
+
+// ReadEmptyFilesParamFile reads the paths of an --empty-files-from-file
+// parameter file, one per line.
+func ReadEmptyFilesParamFile(paramFile string) ([]string, error) {
+	file, err := os.Open(paramFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening parameter file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	var paths []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if line[0] == '/' {
+			line = line[1:]
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading parameter file: %w", err)
+	}
+	return paths, nil
+}
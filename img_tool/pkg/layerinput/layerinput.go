@@ -0,0 +1,77 @@
+// Package layerinput implements the --tar, --cstream and --mtree flags of the
+// commands that read a stack of layers (img mtree, img analyze and img
+// flatten). The layers may be given with any mix of the flags, and their order
+// is the order of the command line.
+package layerinput
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Kind is the format of a layer input.
+type Kind int
+
+const (
+	// Tar is a layer tar blob, which may be gzip- or zstd-compressed.
+	Tar Kind = iota
+	// CStream is a compact stream (.cstream) of a layer.
+	CStream
+	// Mtree is an mtree spec of a layer.
+	Mtree
+)
+
+// Input is one layer flag.
+type Input struct {
+	Kind Kind
+	Path string
+	// ContentManifest is the content manifest given for the layer with
+	// ContentManifestFlag, if any.
+	ContentManifest string
+}
+
+// List is the layer inputs of a command line, in order.
+type List []Input
+
+// Flag returns a flag.Value that appends each occurrence of a layer flag of
+// the given kind to the list. flag.Parse calls Set in argument order, so the
+// order of the list across all flags is the order of the command line.
+func (l *List) Flag(kind Kind) flag.Value {
+	return orderedFlag{kind: kind, inputs: l}
+}
+
+// ContentManifestFlag returns a flag.Value that attaches a content manifest
+// to the layer flag before it.
+func (l *List) ContentManifestFlag() flag.Value {
+	return contentManifestFlag{inputs: l}
+}
+
+type orderedFlag struct {
+	kind   Kind
+	inputs *List
+}
+
+func (o orderedFlag) String() string { return "" }
+
+func (o orderedFlag) Set(v string) error {
+	*o.inputs = append(*o.inputs, Input{Kind: o.kind, Path: v})
+	return nil
+}
+
+type contentManifestFlag struct {
+	inputs *List
+}
+
+func (c contentManifestFlag) String() string { return "" }
+
+func (c contentManifestFlag) Set(v string) error {
+	if len(*c.inputs) == 0 {
+		return fmt.Errorf("--content-manifest must follow the --tar, --cstream or --mtree flag of its layer")
+	}
+	last := &(*c.inputs)[len(*c.inputs)-1]
+	if last.ContentManifest != "" {
+		return fmt.Errorf("layer %s already has the content manifest %s", last.Path, last.ContentManifest)
+	}
+	last.ContentManifest = v
+	return nil
+}
@@ -0,0 +1,48 @@
+package layerinput
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListKeepsCommandLineOrder(t *testing.T) {
+	var inputs List
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagSet.Var(inputs.Flag(Tar), "tar", "")
+	flagSet.Var(inputs.Flag(CStream), "cstream", "")
+	flagSet.Var(inputs.Flag(Mtree), "mtree", "")
+	flagSet.Var(inputs.ContentManifestFlag(), "content-manifest", "")
+	args := []string{"--mtree", "base.mtree", "--content-manifest", "base.cm", "--tar", "a.tgz", "--cstream", "b.cstream", "--tar", "c.tar"}
+	if err := flagSet.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	want := List{
+		{Kind: Mtree, Path: "base.mtree", ContentManifest: "base.cm"},
+		{Kind: Tar, Path: "a.tgz"},
+		{Kind: CStream, Path: "b.cstream"},
+		{Kind: Tar, Path: "c.tar"},
+	}
+	if !reflect.DeepEqual(inputs, want) {
+		t.Errorf("inputs = %+v, want %+v", inputs, want)
+	}
+}
+
+func TestContentManifestNeedsOneLayer(t *testing.T) {
+	for _, args := range [][]string{
+		{"--content-manifest", "a.cm"},
+		{"--tar", "a.tgz", "--content-manifest", "a.cm", "--content-manifest", "b.cm"},
+	} {
+		var inputs List
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		flagSet.SetOutput(io.Discard)
+		flagSet.Var(inputs.Flag(Tar), "tar", "")
+		flagSet.Var(inputs.ContentManifestFlag(), "content-manifest", "")
+		err := flagSet.Parse(args)
+		if err == nil || !strings.Contains(err.Error(), "content") {
+			t.Errorf("Parse(%q) error = %v, want an error about the content manifest", args, err)
+		}
+	}
+}
@@ -121,6 +121,12 @@ func (l *loader) tags(op api.IndexedLoadDeployOperation) ([]string, error) {
 	return deduplicateAndSort(allTags), nil
 }
 
+// Tags returns the full image references LoadAll applies for the operation (see
+// tags). It performs no I/O, so a dry run can show what a load would tag.
+func (l *loader) Tags(op api.IndexedLoadDeployOperation) ([]string, error) {
+	return l.tags(op)
+}
+
 func (l *loader) LoadAll(ctx context.Context, ops []api.IndexedLoadDeployOperation) ([]string, error) {
 	ctx = containerd.WithNamespace(ctx, "moby")
 	var pushedTags []string
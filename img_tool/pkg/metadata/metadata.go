@@ -59,6 +59,39 @@ func WriteLayerMetadata(
 	return nil
 }
 
+// ManifestFragment lists the layers of a split layer (img layer
+// --split-strategy) in order, each as the layer metadata WriteLayerMetadata
+// writes for it. img manifest --layers-from-manifest-fragment adds them to an
+// image in this order.
+type ManifestFragment struct {
+	Layers []api.Descriptor `json:"layers"`
+}
+
+// WriteManifestFragment writes a ManifestFragment listing layers.
+func WriteManifestFragment(layers []api.Descriptor, outputFile io.Writer) error {
+	if layers == nil {
+		layers = []api.Descriptor{}
+	}
+	encoder := json.NewEncoder(outputFile)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(ManifestFragment{Layers: layers}); err != nil {
+		return fmt.Errorf("encoding manifest fragment: %w", err)
+	}
+	return nil
+}
+
+// ReadManifestFragment reads a ManifestFragment. Unknown fields are rejected,
+// like they are in layer metadata.
+func ReadManifestFragment(r io.Reader) (ManifestFragment, error) {
+	var fragment ManifestFragment
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fragment); err != nil {
+		return ManifestFragment{}, fmt.Errorf("decoding manifest fragment: %w", err)
+	}
+	return fragment, nil
+}
+
 // MergeAnnotations merges user annotations with layer annotations, with layer annotations taking precedence.
 // Returns a new map with sorted keys for determinism.
 func MergeAnnotations(userAnnotations map[string]string, layerAnnotations map[string]string) map[string]string {
@@ -1,7 +1,8 @@
 // Package ocilayout is the single writer for every container image layout
 // format produced by the img tool: OCI image layouts (directory or tar),
 // Docker "save" tarballs (the hybrid oci-layout + manifest.json form), and the
-// sparse OCI layout (layer blobs replaced by descriptor stubs).
+// sparse OCI layout (layer blobs replaced by descriptor stubs). Read is its
+// reading side, for the commands that take an OCI layout as input.
 //
 // It exposes two entry points that share one emission engine:
 //
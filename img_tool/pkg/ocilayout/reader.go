@@ -0,0 +1,238 @@
+package ocilayout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+// maxIndexDepth bounds how deep ImageForPlatform follows indexes nested in
+// indexes.
+const maxIndexDepth = 8
+
+// Layout is an OCI layout directory opened for reading, with the entries of
+// its index.json sorted into the images it holds and the artifacts referring
+// to them. This is the reading side used by the commands that take an OCI
+// layout as input (img inspect, img diff, img mutate and img validate
+// reproducible); Builder and Editor are the writing side.
+type Layout struct {
+	Dir string
+	// Index is the index.json of the layout, with its blobs read from the
+	// layout's blobs directory.
+	Index v1.ImageIndex
+	// Roots are the entries of index.json that are images or indexes of
+	// their own, in index.json order.
+	Roots []v1.Descriptor
+	// Referrers maps the digest of a manifest to the entries whose subject
+	// it is, the way `oras` and rules_img store signatures and SBOMs next to
+	// an image. Their artifact type is filled in from the manifest when the
+	// entry does not carry it.
+	Referrers map[v1.Hash][]v1.Descriptor
+}
+
+// Read opens the OCI layout in dir. Entries of index.json that are neither
+// images, indexes nor referrers (an artifact without a subject, say) are
+// skipped.
+func Read(dir string) (*Layout, error) {
+	path, err := layout.FromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading OCI layout %s: %w", dir, err)
+	}
+	index, err := path.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("reading OCI layout %s: %w", dir, err)
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("reading index.json of %s: %w", dir, err)
+	}
+	l := &Layout{Dir: dir, Index: index, Referrers: make(map[v1.Hash][]v1.Descriptor)}
+	for _, desc := range indexManifest.Manifests {
+		raw, err := path.Bytes(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest %s: %w", desc.Digest, err)
+		}
+		if subject, artifactType := SubjectOf(raw); subject != nil {
+			if desc.ArtifactType == "" {
+				desc.ArtifactType = artifactType
+			}
+			l.Referrers[subject.Digest] = append(l.Referrers[subject.Digest], desc)
+			continue
+		}
+		if desc.MediaType.IsIndex() || desc.MediaType.IsImage() {
+			l.Roots = append(l.Roots, desc)
+		}
+	}
+	return l, nil
+}
+
+// Root returns the single image or index of the layout. A layout holding
+// several is an error, since there is no telling which one is meant.
+func (l *Layout) Root() (v1.Descriptor, error) {
+	if len(l.Roots) != 1 {
+		return v1.Descriptor{}, fmt.Errorf("OCI layout %s holds %d images, want exactly one", l.Dir, len(l.Roots))
+	}
+	return l.Roots[0], nil
+}
+
+// Image returns the image of the layout's single root. When the root is an
+// index, the image is chosen by platform with ImageForPlatform, and its
+// platform is returned too; it is empty when the root is an image.
+func (l *Layout) Image(platform string) (v1.Image, string, error) {
+	root, err := l.Root()
+	if err != nil {
+		return nil, "", err
+	}
+	if !root.MediaType.IsIndex() {
+		image, err := l.Index.Image(root.Digest)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading %s: %w", root.Digest, err)
+		}
+		return image, "", nil
+	}
+	child, err := l.Index.ImageIndex(root.Digest)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading %s: %w", root.Digest, err)
+	}
+	image, p, err := ImageForPlatform(child, platform)
+	if err != nil {
+		return nil, "", fmt.Errorf("OCI layout %s: %w", l.Dir, err)
+	}
+	return image, p, nil
+}
+
+// FetchRoot fetches the manifest ref points at from its registry: the
+// registry counterpart of Layout.Root. Anything but an image or an index is an
+// error.
+func FetchRoot(ctx context.Context, ref name.Reference, opts ...remote.Option) (*remote.Descriptor, error) {
+	desc, err := remote.Get(ref, append(opts, remote.WithContext(ctx))...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", ref, err)
+	}
+	if !desc.MediaType.IsIndex() && !desc.MediaType.IsImage() {
+		return nil, fmt.Errorf("%s is a %s, not an image or an index", ref, desc.MediaType)
+	}
+	return desc, nil
+}
+
+// FetchImage fetches the image ref points at from its registry: the registry
+// counterpart of Layout.Image. When ref points at an index, the image is
+// chosen by platform with ImageForPlatform, and its platform is returned too;
+// it is empty when ref points at an image.
+func FetchImage(ctx context.Context, ref name.Reference, platform string, opts ...remote.Option) (v1.Image, string, error) {
+	desc, err := FetchRoot(ctx, ref, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	if !desc.MediaType.IsIndex() {
+		image, err := desc.Image()
+		if err != nil {
+			return nil, "", fmt.Errorf("reading %s: %w", ref, err)
+		}
+		return image, "", nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, "", fmt.Errorf("reading %s: %w", ref, err)
+	}
+	image, p, err := ImageForPlatform(index, platform)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", ref, err)
+	}
+	return image, p, nil
+}
+
+// ImageForPlatform returns the image of an index for the platform, and the
+// platform of its entry, or the only image of the index when no platform is
+// asked for. A platform without a variant matches every variant. Indexes
+// nested in the index are searched too. SOCI indexes listed in the index are
+// not images of a platform.
+func ImageForPlatform(index v1.ImageIndex, platform string) (v1.Image, string, error) {
+	return imageForPlatform(index, platform, 0)
+}
+
+func imageForPlatform(index v1.ImageIndex, platform string, depth int) (v1.Image, string, error) {
+	if depth > maxIndexDepth {
+		return nil, "", fmt.Errorf("index nesting too deep")
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, "", err
+	}
+	var available []string
+	var selected []v1.Descriptor
+	for _, desc := range indexManifest.Manifests {
+		if IsSoci(desc) {
+			continue
+		}
+		if desc.MediaType.IsIndex() {
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, "", err
+			}
+			if image, p, err := imageForPlatform(child, platform, depth+1); err == nil {
+				return image, p, nil
+			}
+			continue
+		}
+		if !desc.MediaType.IsImage() {
+			continue
+		}
+		p := PlatformOf(desc)
+		available = append(available, p)
+		if platform == "" || p == platform || strings.HasPrefix(p, platform+"/") {
+			selected = append(selected, desc)
+		}
+	}
+	switch {
+	case len(selected) == 1:
+		image, err := index.Image(selected[0].Digest)
+		return image, PlatformOf(selected[0]), err
+	case len(selected) == 0:
+		return nil, "", fmt.Errorf("no image for platform %q in the index (platforms: %s)", platform, strings.Join(available, ", "))
+	default:
+		return nil, "", fmt.Errorf("the index holds images for %s; choose one with --platform", strings.Join(available, ", "))
+	}
+}
+
+// PlatformOf returns the platform of an index entry as os/arch[/variant], or
+// "" when the entry has none.
+func PlatformOf(desc v1.Descriptor) string {
+	if desc.Platform == nil {
+		return ""
+	}
+	return desc.Platform.String()
+}
+
+// IsSoci reports whether an index entry is a SOCI index, or names one, rather
+// than being an image of a platform.
+func IsSoci(desc v1.Descriptor) bool {
+	return desc.Annotations[api.SociImageManifestDigestAnnotation] != "" || desc.ArtifactType == api.SociIndexArtifactTypeV2
+}
+
+// SubjectOf returns the subject of a manifest, if it has one, which makes the
+// manifest a referrer of another, and its artifact type: the artifactType
+// field, or else the config media type, as the referrers API reports it.
+func SubjectOf(raw []byte) (*v1.Descriptor, string) {
+	var manifest struct {
+		ArtifactType string         `json:"artifactType"`
+		Config       *v1.Descriptor `json:"config"`
+		Subject      *v1.Descriptor `json:"subject"`
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, ""
+	}
+	artifactType := manifest.ArtifactType
+	if artifactType == "" && manifest.Config != nil {
+		artifactType = string(manifest.Config.MediaType)
+	}
+	return manifest.Subject, artifactType
+}
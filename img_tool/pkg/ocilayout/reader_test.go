@@ -0,0 +1,174 @@
+package ocilayout
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testregistry"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+func TestReadSortsRootsAndReferrers(t *testing.T) {
+	dir := t.TempDir()
+	amd64 := randomImage(t)
+	arm64 := randomImage(t)
+	index := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}}},
+	)
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := path.AppendIndex(index); err != nil {
+		t.Fatal(err)
+	}
+	indexDigest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := mutate.Subject(mutate.ConfigMediaType(randomImage(t), "application/vnd.example.signature"), v1.Descriptor{
+		MediaType: types.OCIImageIndex,
+		Digest:    indexDigest,
+	}).(v1.Image)
+	if err := path.AppendImage(signature); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Roots) != 1 || l.Roots[0].Digest != indexDigest {
+		t.Fatalf("roots = %+v, want only the index", l.Roots)
+	}
+	referrers := l.Referrers[indexDigest]
+	if len(referrers) != 1 || referrers[0].ArtifactType != "application/vnd.example.signature" {
+		t.Errorf("referrers = %+v, want the signature with its artifact type", referrers)
+	}
+
+	image, platform, err := l.Image("linux/arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform != "linux/arm64/v8" || digestOf(t, image) != digestOf(t, arm64) {
+		t.Errorf("Image(linux/arm64) = %s for %s, want the arm64 image", digestOf(t, image), platform)
+	}
+	if _, _, err := l.Image(""); err == nil || !strings.Contains(err.Error(), "choose one with --platform") {
+		t.Errorf("Image(\"\") error = %v, want an error asking for a platform", err)
+	}
+	if _, _, err := l.Image("linux/s390x"); err == nil || !strings.Contains(err.Error(), "linux/amd64, linux/arm64/v8") {
+		t.Errorf("Image(linux/s390x) error = %v, want an error listing the platforms", err)
+	}
+}
+
+func TestRootWantsOneImage(t *testing.T) {
+	dir := t.TempDir()
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := path.AppendImage(randomImage(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := Read(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Root(); err == nil || !strings.Contains(err.Error(), "holds 2 images") {
+		t.Errorf("Root() error = %v, want an error about the two images", err)
+	}
+}
+
+// rawArtifact is a manifest that is neither an image nor an index.
+type rawArtifact struct{}
+
+func (rawArtifact) RawManifest() ([]byte, error) {
+	return []byte(`{"mediaType":"application/vnd.example.artifact.v1+json"}`), nil
+}
+
+func (rawArtifact) MediaType() (types.MediaType, error) {
+	return "application/vnd.example.artifact.v1+json", nil
+}
+
+func TestFetchImage(t *testing.T) {
+	regs := testregistry.New("reg.example.com")
+	ctx := context.Background()
+	tag := func(t *testing.T, tag string) name.Tag {
+		t.Helper()
+		ref, err := name.NewTag("reg.example.com/team/app:"+tag, registryopts.NameOptions()...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+	amd64 := randomImage(t)
+	arm64 := randomImage(t)
+	index := mutate.AppendManifests(mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}}},
+	)
+	if err := remote.WriteIndex(tag(t, "multi"), index, regs.Options()...); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag(t, "single"), amd64, regs.Options()...); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Put(tag(t, "artifact"), rawArtifact{}, regs.Options()...); err != nil {
+		t.Fatal(err)
+	}
+
+	image, platform, err := FetchImage(ctx, tag(t, "multi"), "linux/arm64", regs.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform != "linux/arm64/v8" || digestOf(t, image) != digestOf(t, arm64) {
+		t.Errorf("FetchImage(multi, linux/arm64) = %s for %s, want the arm64 image", digestOf(t, image), platform)
+	}
+	if _, _, err := FetchImage(ctx, tag(t, "multi"), "", regs.Options()...); err == nil || !strings.Contains(err.Error(), "choose one with --platform") {
+		t.Errorf("FetchImage(multi, \"\") error = %v, want an error asking for a platform", err)
+	}
+	image, platform, err = FetchImage(ctx, tag(t, "single"), "linux/arm64", regs.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform != "" || digestOf(t, image) != digestOf(t, amd64) {
+		t.Errorf("FetchImage(single) = %s for %q, want the image itself and no platform", digestOf(t, image), platform)
+	}
+	if _, _, err := FetchImage(ctx, tag(t, "artifact"), "", regs.Options()...); err == nil || !strings.Contains(err.Error(), "not an image or an index") {
+		t.Errorf("FetchImage(artifact) error = %v, want an error about the media type", err)
+	}
+	if _, _, err := FetchImage(ctx, tag(t, "missing"), "", regs.Options()...); err == nil || !strings.Contains(err.Error(), "fetching") {
+		t.Errorf("FetchImage(missing) error = %v, want a fetch error", err)
+	}
+}
+
+func randomImage(t *testing.T) v1.Image {
+	t.Helper()
+	image, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func digestOf(t *testing.T, image v1.Image) v1.Hash {
+	t.Helper()
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
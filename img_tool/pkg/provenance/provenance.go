@@ -0,0 +1,179 @@
+// Package provenance builds the in-toto Statements with a SLSA v1 provenance
+// predicate that `img deploy` attests for the images it pushes.
+//
+// A signature alone only says that some key vouched for a manifest digest. The
+// provenance statement says where the image came from: which builder produced
+// it, for which Bazel target, from which stamped source revision, and on top of
+// which base image. Admission controllers verify the DSSE envelope around it
+// (the signer plugin's job) and then check these fields.
+//
+// Statements are deterministic for a given input: they record no wall-clock
+// time, so deploying the same image twice attests the same payload.
+package provenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+const (
+	// PayloadType is the DSSE payload type of an in-toto Statement.
+	PayloadType = "application/vnd.in-toto+json"
+	// StatementType is the in-toto attestation framework v1 Statement type.
+	StatementType = "https://in-toto.io/Statement/v1"
+	// PredicateType is the SLSA provenance v1 predicate type.
+	PredicateType = "https://slsa.dev/provenance/v1"
+	// BuildType identifies the shape of the buildDefinition written here: a
+	// Bazel target built by rules_img and pushed by `img deploy`.
+	BuildType = "https://github.com/bazel-contrib/rules_img/provenance/bazel/v1"
+	// DefaultBuilderID is the builder.id used when neither the deploy manifest
+	// nor the deploy command line names the build platform. Verifiers should
+	// not trust it: it says nothing about who ran the build.
+	DefaultBuilderID = "https://github.com/bazel-contrib/rules_img/img-deploy"
+)
+
+// Statement is an in-toto v1 Statement with a SLSA v1 provenance predicate.
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Predicate            `json:"predicate"`
+}
+
+// ResourceDescriptor names an artifact by digest, as in-toto and SLSA do.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Predicate is the SLSA v1 provenance predicate.
+type Predicate struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes the build's inputs.
+type BuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   ExternalParameters   `json:"externalParameters"`
+	InternalParameters   *InternalParameters  `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+// ExternalParameters are the parameters under the control of whoever started
+// the build: what was built and where it was pushed.
+type ExternalParameters struct {
+	Target     string `json:"target,omitempty"`
+	Repository string `json:"repository"`
+}
+
+// InternalParameters are the parameters set by the build platform itself: the
+// workspace status values of a stamped build.
+type InternalParameters struct {
+	Stamp map[string]string `json:"stamp,omitempty"`
+}
+
+// RunDetails describes the builder.
+type RunDetails struct {
+	Builder Builder `json:"builder"`
+}
+
+// Builder is the SLSA builder, identified by its ID.
+type Builder struct {
+	ID string `json:"id"`
+}
+
+// Input is everything a statement is built from.
+type Input struct {
+	// Subject is the pushed root (manifest or index) the statement is about.
+	Subject api.Descriptor
+	// Registry and Repository are the push destination.
+	Registry   string
+	Repository string
+	// Config is the build invocation recorded in the deploy manifest.
+	Config api.ProvenanceConfig
+	// BuilderID overrides Config.BuilderID when set.
+	BuilderID string
+	// Base is the pulled base image of the pushed root, if any.
+	Base api.PullInfo
+}
+
+// NewStatement builds the provenance statement for in.
+func NewStatement(in Input) (*Statement, error) {
+	algorithm, hex, ok := strings.Cut(in.Subject.Digest, ":")
+	if !ok || hex == "" {
+		return nil, fmt.Errorf("invalid subject digest %q", in.Subject.Digest)
+	}
+	repository := in.Repository
+	if in.Registry != "" {
+		repository = in.Registry + "/" + in.Repository
+	}
+	builderID := in.BuilderID
+	if builderID == "" {
+		builderID = in.Config.BuilderID
+	}
+	if builderID == "" {
+		builderID = DefaultBuilderID
+	}
+
+	statement := &Statement{
+		Type: StatementType,
+		Subject: []ResourceDescriptor{{
+			Name:   repository,
+			Digest: map[string]string{algorithm: hex},
+		}},
+		PredicateType: PredicateType,
+		Predicate: Predicate{
+			BuildDefinition: BuildDefinition{
+				BuildType: BuildType,
+				ExternalParameters: ExternalParameters{
+					Target:     in.Config.Target,
+					Repository: repository,
+				},
+			},
+			RunDetails: RunDetails{Builder: Builder{ID: builderID}},
+		},
+	}
+	if len(in.Config.Stamp) > 0 {
+		statement.Predicate.BuildDefinition.InternalParameters = &InternalParameters{Stamp: in.Config.Stamp}
+	}
+	if base, ok := baseImage(in.Base); ok {
+		statement.Predicate.BuildDefinition.ResolvedDependencies = []ResourceDescriptor{base}
+	}
+	return statement, nil
+}
+
+// Marshal returns the JSON payload of the statement. encoding/json sorts map
+// keys, so the payload is deterministic.
+func (s *Statement) Marshal() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// baseImage describes the pulled base image as a resolved dependency. Only a
+// base image pinned by digest is recorded: a tag alone does not say which
+// image the build used.
+func baseImage(pull api.PullInfo) (ResourceDescriptor, bool) {
+	algorithm, hex, ok := strings.Cut(pull.OriginalBaseImageDigest, ":")
+	if !ok || hex == "" || pull.OriginalBaseImageRepository == "" {
+		return ResourceDescriptor{}, false
+	}
+	// The first registry is the one the image was pulled from; the rest are
+	// mirrors serving the same digest.
+	registry := "docker.io"
+	if len(pull.OriginalBaseImageRegistries) > 0 {
+		registry = pull.OriginalBaseImageRegistries[0]
+	}
+	reference := registry + "/" + pull.OriginalBaseImageRepository
+	if pull.OriginalBaseImageTag != "" {
+		reference += ":" + pull.OriginalBaseImageTag
+	}
+	return ResourceDescriptor{
+		Name:   "base-image",
+		URI:    "oci://" + reference + "@" + pull.OriginalBaseImageDigest,
+		Digest: map[string]string{algorithm: hex},
+	}, true
+}
@@ -0,0 +1,118 @@
+package provenance
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestNewStatement(t *testing.T) {
+	in := Input{
+		Subject:    api.Descriptor{MediaType: "application/vnd.oci.image.index.v1+json", Digest: testDigest, Size: 512},
+		Registry:   "registry.example.com",
+		Repository: "team/app",
+		Config: api.ProvenanceConfig{
+			BuilderID: "https://ci.example.com/builders/main",
+			Target:    "//app:push",
+			Stamp:     map[string]string{"BUILD_SCM_REVISION": "4f2a9c1", "BUILD_USER": "ci"},
+		},
+		Base: api.PullInfo{
+			OriginalBaseImageRegistries: []string{"mirror.gcr.io", "index.docker.io"},
+			OriginalBaseImageRepository: "library/debian",
+			OriginalBaseImageTag:        "bookworm",
+			OriginalBaseImageDigest:     "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+		},
+	}
+	statement, err := NewStatement(in)
+	if err != nil {
+		t.Fatalf("NewStatement: %v", err)
+	}
+	first, err := statement.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	again, _ := NewStatement(in)
+	second, _ := again.Marshal()
+	if !bytes.Equal(first, second) {
+		t.Error("statement payload is not deterministic")
+	}
+
+	var out Statement
+	if err := json.Unmarshal(first, &out); err != nil {
+		t.Fatalf("parsing statement: %v", err)
+	}
+	if out.Type != StatementType || out.PredicateType != PredicateType {
+		t.Errorf("header = %s %s", out.Type, out.PredicateType)
+	}
+	if len(out.Subject) != 1 || out.Subject[0].Name != "registry.example.com/team/app" || out.Subject[0].Digest["sha256"] != testDigest[len("sha256:"):] {
+		t.Errorf("subject = %+v", out.Subject)
+	}
+	definition := out.Predicate.BuildDefinition
+	if definition.ExternalParameters.Target != "//app:push" || definition.InternalParameters.Stamp["BUILD_SCM_REVISION"] != "4f2a9c1" {
+		t.Errorf("build definition = %+v", definition)
+	}
+	if len(definition.ResolvedDependencies) != 1 || definition.ResolvedDependencies[0].URI != "oci://mirror.gcr.io/library/debian:bookworm@sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210" {
+		t.Errorf("resolved dependencies = %+v", definition.ResolvedDependencies)
+	}
+	if out.Predicate.RunDetails.Builder.ID != "https://ci.example.com/builders/main" {
+		t.Errorf("builder = %q", out.Predicate.RunDetails.Builder.ID)
+	}
+}
+
+func TestNewStatementDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		in            Input
+		wantBuilderID string
+	}{
+		{
+			name:          "default builder",
+			in:            Input{Subject: api.Descriptor{Digest: testDigest}, Repository: "app"},
+			wantBuilderID: DefaultBuilderID,
+		},
+		{
+			name: "runtime builder wins",
+			in: Input{
+				Subject:    api.Descriptor{Digest: testDigest},
+				Repository: "app",
+				Config:     api.ProvenanceConfig{BuilderID: "https://ci.example.com/a"},
+				BuilderID:  "https://ci.example.com/b",
+			},
+			wantBuilderID: "https://ci.example.com/b",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			statement, err := NewStatement(tc.in)
+			if err != nil {
+				t.Fatalf("NewStatement: %v", err)
+			}
+			if got := statement.Predicate.RunDetails.Builder.ID; got != tc.wantBuilderID {
+				t.Errorf("builder = %q, want %q", got, tc.wantBuilderID)
+			}
+			if statement.Predicate.BuildDefinition.InternalParameters != nil || statement.Predicate.BuildDefinition.ResolvedDependencies != nil {
+				t.Errorf("unstamped build without base image has parameters: %+v", statement.Predicate.BuildDefinition)
+			}
+		})
+	}
+
+	// A base image known only by tag is not a resolved dependency.
+	statement, err := NewStatement(Input{
+		Subject:    api.Descriptor{Digest: testDigest},
+		Repository: "app",
+		Base:       api.PullInfo{OriginalBaseImageRepository: "library/debian", OriginalBaseImageTag: "bookworm"},
+	})
+	if err != nil {
+		t.Fatalf("NewStatement: %v", err)
+	}
+	if statement.Predicate.BuildDefinition.ResolvedDependencies != nil {
+		t.Errorf("resolved dependencies = %+v, want none for a tag-only base", statement.Predicate.BuildDefinition.ResolvedDependencies)
+	}
+
+	if _, err := NewStatement(Input{Subject: api.Descriptor{Digest: "nodigest"}}); err == nil {
+		t.Error("NewStatement accepted an invalid subject digest")
+	}
+}
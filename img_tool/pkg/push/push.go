@@ -192,6 +192,14 @@ func (u *uploader) vfsFor(op api.IndexedPushDeployOperation) VFS {
 	return u.vfs
 }
 
+// References returns the references PushAll writes for the operation: its
+// digest reference followed by every tag, with the builder's overrides and extra
+// tags applied. It performs no I/O, so a dry run can show what a push would
+// write.
+func (u *uploader) References(op api.IndexedPushDeployOperation) ([]name.Reference, error) {
+	return u.tags(op)
+}
+
 // tags returns the list of tags to push for the given operation, applying any overrides and extra tags.
 func (u *uploader) tags(op api.IndexedPushDeployOperation) ([]name.Reference, error) {
 	registry := op.Registry
@@ -0,0 +1,162 @@
+// Package runconfig applies the run settings of the image_manifest rule (user,
+// working directory, stop signal, environment, entrypoint, cmd and labels) to
+// the "config" object of an image config. `img manifest` merges them into the
+// config inherited from the base image, and `img mutate` edits the config of
+// an existing image with the same rules.
+package runconfig
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// InheritFromBase is the sentinel value used by the image_manifest rule to
+// distinguish a config field that was left untouched (inherit the base image's
+// value) from one explicitly set to an empty value (unset the field). It matches
+// INHERIT_FROM_BASE in img/private/common/inherit.bzl.
+const InheritFromBase = "<inherit from base>"
+
+// Settings are the settings of an image config that say how its container
+// runs, as given by the flags of `img manifest` and `img mutate`.
+type Settings struct {
+	// User, WorkingDir and StopSignal replace the inherited value. The
+	// InheritFromBase sentinel keeps it, and an empty string unsets it.
+	User       string
+	WorkingDir string
+	StopSignal string
+	// Env replaces the variables the config already sets, in place, and
+	// appends new ones in sorted order.
+	Env map[string]string
+	// Entrypoint and Cmd replace the inherited lists, with every
+	// InheritFromBase item expanded to the inherited value. A list that is
+	// just the sentinel keeps the inherited value, and an empty list unsets
+	// it. Setting the entrypoint clears the inherited cmd.
+	Entrypoint []string
+	Cmd        []string
+	// Labels are added to the inherited labels, replacing those of the same
+	// name.
+	Labels map[string]string
+}
+
+// Apply merges the settings into config.
+func (s Settings) Apply(config *specv1.ImageConfig) {
+	applyStringConfig(&config.User, s.User)
+
+	if len(s.Env) > 0 {
+		// First, build a map of existing env vars
+		existingEnv := make(map[string]bool)
+		for i, envVar := range config.Env {
+			key := strings.SplitN(envVar, "=", 2)[0]
+			if _, exists := s.Env[key]; exists {
+				// Update existing env var
+				config.Env[i] = fmt.Sprintf("%s=%s", key, s.Env[key])
+				existingEnv[key] = true
+			}
+		}
+		// Add new env vars in sorted order to ensure determinism
+		keys := make([]string, 0, len(s.Env))
+		for key := range s.Env {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if !existingEnv[key] {
+				config.Env = append(config.Env, fmt.Sprintf("%s=%s", key, s.Env[key]))
+			}
+		}
+	}
+
+	// NOTE: Setting entrypoint clears Cmd, which is consistent with Docker/Dockerfile behavior.
+	// This matches the behavior of rules_oci and crane.
+	// See: https://github.com/bazel-contrib/rules_img/issues/368
+	// See: https://github.com/bazel-contrib/rules_oci/issues/649
+	// See: https://github.com/google/go-containerregistry/blob/c3d1dcc932076c15b65b8b9acfff1d47ded2ebf9/cmd/crane/cmd/mutate.go#L107
+	//
+	// Capture the inherited (base + fragment) entrypoint and cmd before either is
+	// modified, so a sentinel item can be expanded to the original base value even
+	// when setting the entrypoint has already cleared the inherited cmd.
+	baseEntrypoint := slices.Clone(config.Entrypoint)
+	baseCmd := slices.Clone(config.Cmd)
+
+	// entrypoint and cmd use three-way semantics driven by the flag values:
+	// a lone sentinel is a no-op (inherit), so inheriting the entrypoint does not
+	// clear an inherited cmd; an empty list unsets the field; any other list is
+	// set after expanding sentinel items against the captured base value. Setting
+	// the entrypoint clears cmd (Docker semantics), matching the historical rule.
+	switch {
+	case isPureInherit(s.Entrypoint):
+		// inherit: leave the base entrypoint (and cmd) untouched
+	case len(s.Entrypoint) == 0:
+		config.Entrypoint = nil // unset; leave cmd to its own resolution
+	default:
+		config.Entrypoint = expandInherit(s.Entrypoint, baseEntrypoint)
+		config.Cmd = nil
+	}
+
+	switch {
+	case isPureInherit(s.Cmd):
+		// inherit: leave cmd as-is (base value, or cleared by setting entrypoint)
+	case len(s.Cmd) == 0:
+		config.Cmd = nil // unset
+	default:
+		config.Cmd = expandInherit(s.Cmd, baseCmd)
+	}
+
+	applyStringConfig(&config.WorkingDir, s.WorkingDir)
+
+	if len(s.Labels) > 0 {
+		if config.Labels == nil {
+			config.Labels = make(map[string]string)
+		}
+		// Add labels in sorted order to ensure determinism
+		keys := make([]string, 0, len(s.Labels))
+		for key := range s.Labels {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			config.Labels[key] = s.Labels[key]
+		}
+	}
+
+	applyStringConfig(&config.StopSignal, s.StopSignal)
+}
+
+// applyStringConfig resolves a scalar config string field from its flag value
+// with three-way semantics: the InheritFromBase sentinel leaves the inherited
+// (base) value in place, an empty string unsets the field, and any other value
+// overrides it.
+func applyStringConfig(field *string, value string) {
+	switch value {
+	case InheritFromBase:
+		// inherit: leave the base value in place
+	case "":
+		*field = "" // unset
+	default:
+		*field = value
+	}
+}
+
+// isPureInherit reports whether a list is exactly the InheritFromBase sentinel,
+// i.e. a plain "inherit from base" with no additional items. Such a list is a
+// no-op so that inheriting the base entrypoint does not clear an inherited cmd.
+func isPureInherit(list []string) bool {
+	return len(list) == 1 && list[0] == InheritFromBase
+}
+
+// expandInherit returns list with every InheritFromBase sentinel item replaced,
+// in place, by the items of base. A sentinel with no base expands to nothing.
+func expandInherit(list, base []string) []string {
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		if item == InheritFromBase {
+			out = append(out, base...)
+		} else {
+			out = append(out, item)
+		}
+	}
+	return out
+}
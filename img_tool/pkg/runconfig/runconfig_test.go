@@ -0,0 +1,52 @@
+package runconfig
+
+import (
+	"slices"
+	"testing"
+
+	specv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestApply(t *testing.T) {
+	config := specv1.ImageConfig{
+		User:       "root",
+		WorkingDir: "/",
+		Env:        []string{"PATH=/bin", "HOME=/root"},
+		Entrypoint: []string{"/bin/sh"},
+		Cmd:        []string{"-c", "true"},
+		Labels:     map[string]string{"base": "yes"},
+	}
+	Settings{
+		User:       InheritFromBase,
+		WorkingDir: "",
+		StopSignal: "SIGTERM",
+		Env:        map[string]string{"PATH": "/usr/bin", "LANG": "C"},
+		Entrypoint: []string{"/tini", "--", InheritFromBase},
+		Cmd:        []string{InheritFromBase},
+		Labels:     map[string]string{"app": "demo"},
+	}.Apply(&config)
+
+	if config.User != "root" {
+		t.Errorf("User = %q, want the inherited root", config.User)
+	}
+	if config.WorkingDir != "" {
+		t.Errorf("WorkingDir = %q, want it unset", config.WorkingDir)
+	}
+	if config.StopSignal != "SIGTERM" {
+		t.Errorf("StopSignal = %q", config.StopSignal)
+	}
+	if want := []string{"PATH=/usr/bin", "HOME=/root", "LANG=C"}; !slices.Equal(config.Env, want) {
+		t.Errorf("Env = %q, want %q", config.Env, want)
+	}
+	if want := []string{"/tini", "--", "/bin/sh"}; !slices.Equal(config.Entrypoint, want) {
+		t.Errorf("Entrypoint = %q, want %q", config.Entrypoint, want)
+	}
+	// Setting the entrypoint clears the inherited cmd, even when cmd itself
+	// is inherited.
+	if config.Cmd != nil {
+		t.Errorf("Cmd = %q, want it cleared by the new entrypoint", config.Cmd)
+	}
+	if config.Labels["base"] != "yes" || config.Labels["app"] != "demo" {
+		t.Errorf("Labels = %v, want both the inherited and the new label", config.Labels)
+	}
+}
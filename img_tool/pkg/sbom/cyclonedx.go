@@ -0,0 +1,125 @@
+package sbom
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// cdxDocument is the subset of CycloneDX 1.5 JSON written here.
+type cdxDocument struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Type       string        `json:"type"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// WriteCycloneDX writes doc as a CycloneDX 1.5 JSON document. The image is the
+// metadata component; the base image is a container component, every package a
+// library and every file a file component.
+func WriteCycloneDX(w io.Writer, doc *Document) error {
+	id := contentID(doc, FormatCycloneDX)
+	// A version 4 UUID built from the content ID, so the serial number is
+	// reproducible.
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	uuid := hex.EncodeToString(id[:16])
+	out := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: fmt.Sprintf("urn:uuid:%s-%s-%s-%s-%s", uuid[0:8], uuid[8:12], uuid[12:16], uuid[16:20], uuid[20:32]),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: doc.Created.UTC().Format(time.RFC3339),
+			Tools:     cdxTools{Components: []cdxComponent{{Type: "application", Name: "rules_img"}}},
+			Component: cdxComponent{
+				BOMRef:  "image",
+				Type:    "container",
+				Name:    doc.Name,
+				Version: doc.Digest,
+				PURL:    imagePURL(doc.Name, doc.Digest),
+			},
+		},
+		Components: []cdxComponent{},
+	}
+	if algorithm, value, found := strings.Cut(doc.Digest, ":"); found && algorithm == "sha256" {
+		out.Metadata.Component.Hashes = []cdxHash{{Alg: "SHA-256", Content: value}}
+	}
+
+	if doc.BaseImage != "" {
+		out.Components = append(out.Components, cdxComponent{
+			BOMRef:     "base-image",
+			Type:       "container",
+			Name:       doc.BaseImage,
+			PURL:       imagePURL(doc.BaseImage, ""),
+			Properties: []cdxProperty{{Name: "rules_img:role", Value: "base-image"}},
+		})
+	}
+	for _, pkg := range doc.Packages {
+		purl := pkg.PURL(doc.Distro)
+		component := cdxComponent{
+			BOMRef:  purl,
+			Type:    "library",
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    purl,
+		}
+		if pkg.Source != "" && pkg.Source != pkg.Name {
+			component.Properties = []cdxProperty{{Name: "rules_img:source-package", Value: pkg.Source}}
+		}
+		out.Components = append(out.Components, component)
+	}
+	for _, file := range doc.Files {
+		hashes := []cdxHash{{Alg: "SHA-256", Content: file.SHA256}}
+		if file.SHA1 != "" {
+			hashes = append(hashes, cdxHash{Alg: "SHA-1", Content: file.SHA1})
+		}
+		out.Components = append(out.Components, cdxComponent{
+			BOMRef:     "file:" + file.Path,
+			Type:       "file",
+			Name:       file.Path,
+			Hashes:     hashes,
+			Properties: []cdxProperty{{Name: "rules_img:size", Value: fmt.Sprint(file.Size)}},
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(out)
+}
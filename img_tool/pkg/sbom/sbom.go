@@ -0,0 +1,421 @@
+// Package sbom writes software bills of materials for the images rules_img
+// builds, from what the build already knows about them rather than from
+// scanning the finished image:
+//
+//   - the files of the image, with their sha256 digests and sizes, from the
+//     image's mtree (the per-layer mtrees applied as an OCI changeset), from the
+//     layer blobs themselves, or from base metadata streams (see pkg/basemeta);
+//   - the Debian, RPM and Alpine packages it was assembled from, read from the
+//     package files (see pkg/basemeta/pkgfile) or from a dpkg status database
+//     or apk installed database found in a layer or a base metadata stream;
+//   - the reference of the pulled base image it builds on, which the SBOM names
+//     rather than inventories: its layers are often never downloaded.
+//
+// Content manifests (`img layer --content-manifest`) are not an input: they
+// record the digests of a layer's contents but not their paths, which the mtree
+// carries alongside the same digests.
+//
+// Two formats are written: SPDX 2.3 JSON (WriteSPDX) and CycloneDX 1.5 JSON
+// (WriteCycloneDX). Both are deterministic: the same inputs, including the
+// creation time, produce the same bytes, so an SBOM built by Bazel is cached
+// like any other action output and its digest is stable. The document
+// namespace (SPDX) and serial number (CycloneDX) are derived from the content.
+//
+// An SBOM travels with its image as an OCI referrer: the image_sbom rule writes
+// it, an image_manifest with the image as its subject wraps it, and image_push
+// pushes that manifest through its referrers attribute during `img deploy`.
+package sbom
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta/pkgfile"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/mtree"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/proto/baselayer"
+)
+
+// Media types of the two SBOM formats, the artifact type of the referrer an SBOM
+// is attached as.
+const (
+	MediaTypeSPDX      = "application/spdx+json"
+	MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+)
+
+// Values of --format.
+const (
+	FormatSPDX      = "spdx"
+	FormatCycloneDX = "cyclonedx"
+)
+
+// Document is the inventory of one image, in the shape both formats are
+// written from.
+type Document struct {
+	// Name names the image, e.g. "registry.example.com/team/app". It is also
+	// the name of the document.
+	Name string
+	// Digest is the digest of the image manifest, or empty when unknown.
+	Digest string
+	// BaseImage is the reference of the pulled base image the image builds on
+	// (registry/repository@sha256:...), or empty.
+	BaseImage string
+	// Distro is the ID of /etc/os-release (e.g. "debian"), used as the vendor
+	// of the package URLs of the image's packages. Empty leaves it out.
+	Distro string
+	// Created is the creation time recorded in the document.
+	Created time.Time
+	// Files are the regular files of the image, sorted by path.
+	Files []File
+	// Packages are the packages installed in the image, sorted by format, name
+	// and version.
+	Packages []Package
+}
+
+// File is one regular file of the image.
+type File struct {
+	// Path is the absolute path of the file in the image.
+	Path string
+	// SHA256 is the hex sha256 of the content. SHA1 is the hex sha1, which
+	// SPDX requires of every file; it is empty when only the sha256 is known
+	// (from an mtree), and SPDX then leaves the file out.
+	SHA256 string
+	SHA1   string
+	Size   int64
+}
+
+// Package is one installed package.
+type Package struct {
+	pkgfile.Info
+}
+
+// PURL returns the package URL of p: pkg:deb/<distro>/<name>@<version>?arch=...,
+// pkg:rpm/<distro>/... or pkg:apk/<distro>/..., the distro left out when
+// unknown.
+func (p Package) PURL(distro string) string {
+	var sb strings.Builder
+	sb.WriteString("pkg:")
+	sb.WriteString(p.Format)
+	sb.WriteString("/")
+	if distro != "" {
+		sb.WriteString(purlEscape(distro))
+		sb.WriteString("/")
+	}
+	sb.WriteString(purlEscape(p.Name))
+	sb.WriteString("@")
+	sb.WriteString(purlEscape(p.Version))
+	var qualifiers []string
+	if p.Architecture != "" {
+		qualifiers = append(qualifiers, "arch="+url.QueryEscape(p.Architecture))
+	}
+	if p.Source != "" && p.Source != p.Name {
+		qualifiers = append(qualifiers, "upstream="+url.QueryEscape(p.Source))
+	}
+	if len(qualifiers) > 0 {
+		sb.WriteString("?")
+		sb.WriteString(strings.Join(qualifiers, "&"))
+	}
+	return sb.String()
+}
+
+// imagePURL returns the package URL of an image: pkg:oci/<name>@<digest> with
+// the repository_url qualifier, as the purl spec defines for OCI artifacts.
+func imagePURL(reference, digest string) string {
+	repository := reference
+	if at := strings.Index(repository, "@"); at >= 0 {
+		if digest == "" {
+			digest = repository[at+1:]
+		}
+		repository = repository[:at]
+	}
+	if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository = repository[:colon]
+	}
+	purl := "pkg:oci/" + purlEscape(path.Base(repository))
+	if digest != "" {
+		purl += "@" + purlEscape(digest)
+	}
+	if strings.Contains(repository, "/") {
+		purl += "?repository_url=" + url.QueryEscape(repository)
+	}
+	return purl
+}
+
+// purlEscape percent-encodes a package URL segment. Unlike a URL path, a purl
+// encodes ":" as well, as in the "%3A" of an epoch or a digest.
+func purlEscape(s string) string {
+	return strings.ReplaceAll(url.PathEscape(s), ":", "%3A")
+}
+
+// Collector gathers the files and packages of an image from the build's
+// inputs. Files are keyed by path, so a later input describing a path replaces
+// what an earlier one said about it; add the inputs in layer order.
+type Collector struct {
+	files    map[string]File
+	packages map[string]Package
+	distro   string
+}
+
+// NewCollector returns an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{files: make(map[string]File), packages: make(map[string]Package)}
+}
+
+// AddPackage records an installed package.
+func (c *Collector) AddPackage(info pkgfile.Info) {
+	c.packages[info.Format+"\x00"+info.Name+"\x00"+info.Architecture] = Package{Info: info}
+}
+
+// AddMtree records the regular files of an mtree spec, as written for an image
+// or a layer by pkg/mtree. Whiteouts are not applied: pass the mtree of the
+// image, which has them applied already.
+func (c *Collector) AddMtree(r io.Reader) error {
+	entries, err := mtree.ParseEntries(r)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Keywords["type"] != "file" {
+			continue
+		}
+		size, _ := strconv.ParseInt(entry.Keywords["size"], 10, 64)
+		digest := entry.Keywords["sha256digest"]
+		if digest == "" && size == 0 {
+			// Empty files carry no digest keyword.
+			digest = emptySHA256
+		}
+		c.files["/"+entry.Path] = File{Path: "/" + entry.Path, SHA256: digest, Size: size}
+	}
+	return nil
+}
+
+// emptySHA256 is the sha256 of no bytes.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// AddLayer records the regular files of a layer blob (an uncompressed, gzip or
+// zstd tar), applying its whiteouts to what earlier layers recorded, and the
+// packages of the dpkg status database and the os-release it holds.
+func (c *Collector) AddLayer(r io.Reader) error {
+	tr, err := openTar(r)
+	if err != nil {
+		return err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading layer: %w", err)
+		}
+		p := basemeta.NormalizePath(hdr.Name)
+		dir, base := path.Split(p)
+		if base == ".wh..wh..opq" {
+			c.removeUnder(path.Clean("/" + dir))
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			removed := "/" + path.Join(dir, strings.TrimPrefix(base, ".wh."))
+			delete(c.files, removed)
+			c.removeUnder(removed)
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", p, err)
+		}
+		c.addFile(p, content)
+	}
+}
+
+// AddBaseMetadata records the regular files a base metadata stream describes.
+// open returns the content of an entry backed by a file on disk.
+func (c *Collector) AddBaseMetadata(entries []*baselayer.BaseEntry, open func(srcPath string) ([]byte, error)) error {
+	for _, entry := range entries {
+		if entry.GetType() != baselayer.EntryType_ENTRY_TYPE_REGULAR {
+			continue
+		}
+		var content []byte
+		switch {
+		case entry.GetFilePath() != "":
+			data, err := open(entry.GetFilePath())
+			if err != nil {
+				return fmt.Errorf("reading content of %s: %w", entry.GetPath(), err)
+			}
+			content = data
+		default:
+			content = entry.GetInline()
+		}
+		c.addFile(basemeta.NormalizePath(entry.GetPath()), content)
+	}
+	return nil
+}
+
+// addFile records a file whose content is known, and reads the packages and
+// distro from it when it is a dpkg status database, apk's installed database or
+// the os-release.
+func (c *Collector) addFile(p string, content []byte) {
+	sha256sum := sha256.Sum256(content)
+	sha1sum := sha1.Sum(content)
+	c.files["/"+p] = File{
+		Path:   "/" + p,
+		SHA256: hex.EncodeToString(sha256sum[:]),
+		SHA1:   hex.EncodeToString(sha1sum[:]),
+		Size:   int64(len(content)),
+	}
+	switch {
+	case p == "var/lib/dpkg/status" || strings.HasPrefix(p, "var/lib/dpkg/status.d/"):
+		// status.d also holds the md5sums of each package, which are not
+		// control files.
+		if strings.HasSuffix(p, ".md5sums") {
+			return
+		}
+		for _, info := range pkgfile.ParseDpkgStatus(content) {
+			c.AddPackage(info)
+		}
+	case p == "lib/apk/db/installed":
+		for _, info := range pkgfile.ParseAPKInstalled(content) {
+			c.AddPackage(info)
+		}
+	case p == "etc/os-release" || p == "usr/lib/os-release":
+		if id := osReleaseID(content); id != "" {
+			c.distro = id
+		}
+	}
+}
+
+// removeUnder forgets every file below dir.
+func (c *Collector) removeUnder(dir string) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for p := range c.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.files, p)
+		}
+	}
+}
+
+// Document returns what was collected. The distro read from an os-release is
+// used unless doc names one.
+func (c *Collector) Document(doc Document) *Document {
+	if doc.Distro == "" {
+		doc.Distro = c.distro
+	}
+	doc.Files = make([]File, 0, len(c.files))
+	for _, file := range c.files {
+		doc.Files = append(doc.Files, file)
+	}
+	sort.Slice(doc.Files, func(i, j int) bool { return doc.Files[i].Path < doc.Files[j].Path })
+	doc.Packages = make([]Package, 0, len(c.packages))
+	for _, pkg := range c.packages {
+		doc.Packages = append(doc.Packages, pkg)
+	}
+	sort.Slice(doc.Packages, func(i, j int) bool {
+		a, b := doc.Packages[i], doc.Packages[j]
+		if a.Format != b.Format {
+			return a.Format < b.Format
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Architecture != b.Architecture {
+			return a.Architecture < b.Architecture
+		}
+		return a.Version < b.Version
+	})
+	return &doc
+}
+
+// osReleaseID reads the ID field of an os-release file.
+func osReleaseID(content []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if found && key == "ID" {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
+
+// openTar returns a tar reader over a layer blob, decompressing it as its
+// magic bytes call for.
+func openTar(r io.Reader) (*tar.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("reading layer: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing layer: %w", err)
+		}
+		return tar.NewReader(zr), nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing layer: %w", err)
+		}
+		return tar.NewReader(zr.IOReadCloser()), nil
+	}
+	return tar.NewReader(buffered), nil
+}
+
+// contentID returns a digest of everything a document says, from which the
+// SPDX namespace and the CycloneDX serial number are derived, so both are
+// unique per content and yet reproducible.
+func contentID(doc *Document, format string) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00", format, doc.Name, doc.Digest, doc.BaseImage, doc.Distro, doc.Created.UTC().Format(time.RFC3339))
+	for _, file := range doc.Files {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00", file.Path, file.SHA256, file.Size)
+	}
+	for _, pkg := range doc.Packages {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", pkg.Format, pkg.Name, pkg.Version, pkg.Architecture)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// MediaType returns the media type of the SBOM format named by format.
+func MediaType(format string) (string, error) {
+	switch format {
+	case FormatSPDX:
+		return MediaTypeSPDX, nil
+	case FormatCycloneDX:
+		return MediaTypeCycloneDX, nil
+	}
+	return "", fmt.Errorf("unknown SBOM format %q (want %q or %q)", format, FormatSPDX, FormatCycloneDX)
+}
+
+// Write writes doc in the format named by format.
+func Write(w io.Writer, doc *Document, format string) error {
+	switch format {
+	case FormatSPDX:
+		return WriteSPDX(w, doc)
+	case FormatCycloneDX:
+		return WriteCycloneDX(w, doc)
+	}
+	_, err := MediaType(format)
+	return err
+}
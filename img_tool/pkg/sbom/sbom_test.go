@@ -0,0 +1,242 @@
+package sbom
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testimage"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/basemeta/pkgfile"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/proto/baselayer"
+)
+
+// layerBlob builds a gzip-compressed layer of the entries, in order.
+func layerBlob(t *testing.T, entries ...testimage.Entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(testimage.Tar(t, entries)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const dpkgStatus = `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Source: glibc
+Version: 2.36-9
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0
+`
+
+func collectTestDocument(t *testing.T) *Document {
+	t.Helper()
+	c := NewCollector()
+	if err := c.AddLayer(bytes.NewReader(layerBlob(t,
+		testimage.Entry{Name: "etc/os-release", Content: "NAME=\"Debian GNU/Linux\"\nID=debian\n"},
+		testimage.Entry{Name: "var/lib/dpkg/status", Content: dpkgStatus},
+		testimage.Entry{Name: "tmp/scratch", Content: "gone"},
+	))); err != nil {
+		t.Fatalf("AddLayer: %v", err)
+	}
+	if err := c.AddLayer(bytes.NewReader(layerBlob(t, testimage.Entry{Name: "tmp/.wh.scratch"}))); err != nil {
+		t.Fatalf("AddLayer: %v", err)
+	}
+	mtreeSpec := "#mtree v2.0\n" +
+		"./app type=dir mode=0755\n" +
+		"./app/server type=file size=5 sha256digest=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n" +
+		"./app/empty type=file size=0\n"
+	if err := c.AddMtree(strings.NewReader(mtreeSpec)); err != nil {
+		t.Fatalf("AddMtree: %v", err)
+	}
+	if err := c.AddBaseMetadata([]*baselayer.BaseEntry{
+		basemeta.File("/etc/hostname", 0o644, []byte("box\n")),
+		basemeta.Dir("/etc/ssl", 0o755),
+	}, nil); err != nil {
+		t.Fatalf("AddBaseMetadata: %v", err)
+	}
+	c.AddPackage(pkgfile.Info{Format: pkgfile.FormatDeb, Name: "ca-certificates", Version: "20230311", Architecture: "all"})
+	return c.Document(Document{
+		Name:      "registry.example.com/team/app",
+		Digest:    "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		BaseImage: "index.docker.io/library/debian@sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+		Created:   time.Unix(0, 0),
+	})
+}
+
+func TestCollector(t *testing.T) {
+	doc := collectTestDocument(t)
+
+	var paths []string
+	for _, file := range doc.Files {
+		paths = append(paths, file.Path)
+	}
+	wantPaths := []string{"/app/empty", "/app/server", "/etc/hostname", "/etc/os-release", "/var/lib/dpkg/status"}
+	if strings.Join(paths, ",") != strings.Join(wantPaths, ",") {
+		t.Errorf("files = %v, want %v", paths, wantPaths)
+	}
+	if doc.Files[0].SHA256 != emptySHA256 || doc.Files[0].SHA1 != "" {
+		t.Errorf("empty file from mtree = %+v, want the empty sha256 and no sha1", doc.Files[0])
+	}
+	if doc.Files[2].SHA1 == "" || doc.Files[2].Size != 4 {
+		t.Errorf("file from base metadata has no sha1: %+v", doc.Files[2])
+	}
+	if doc.Distro != "debian" {
+		t.Errorf("distro = %q, want debian from os-release", doc.Distro)
+	}
+
+	var purls []string
+	for _, pkg := range doc.Packages {
+		purls = append(purls, pkg.PURL(doc.Distro))
+	}
+	wantPURLs := []string{
+		"pkg:deb/debian/ca-certificates@20230311?arch=all",
+		"pkg:deb/debian/libc6@2.36-9?arch=amd64&upstream=glibc",
+	}
+	if strings.Join(purls, ",") != strings.Join(wantPURLs, ",") {
+		t.Errorf("packages = %v, want %v", purls, wantPURLs)
+	}
+}
+
+// TestCollectorAPKInstalled checks that the packages of an Alpine image come
+// from apk's installed database, with the origin as the upstream qualifier.
+func TestCollectorAPKInstalled(t *testing.T) {
+	c := NewCollector()
+	installed := "C:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:musl\nV:1.2.4-r2\nA:x86_64\no:musl\nF:lib\nR:ld-musl-x86_64.so.1\n\n" +
+		"C:Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA=\nP:libcrypto3\nV:3.1.4-r5\nA:x86_64\no:openssl\n\n"
+	if err := c.AddLayer(bytes.NewReader(layerBlob(t,
+		testimage.Entry{Name: "etc/os-release", Content: "NAME=\"Alpine Linux\"\nID=alpine\n"},
+		testimage.Entry{Name: "lib/apk/db/installed", Content: installed},
+	))); err != nil {
+		t.Fatalf("AddLayer: %v", err)
+	}
+	doc := c.Document(Document{Name: "alpine", Created: time.Unix(0, 0)})
+	var purls []string
+	for _, pkg := range doc.Packages {
+		purls = append(purls, pkg.PURL(doc.Distro))
+	}
+	wantPURLs := []string{
+		"pkg:apk/alpine/libcrypto3@3.1.4-r5?arch=x86_64&upstream=openssl",
+		"pkg:apk/alpine/musl@1.2.4-r2?arch=x86_64",
+	}
+	if strings.Join(purls, ",") != strings.Join(wantPURLs, ",") {
+		t.Errorf("packages = %v, want %v", purls, wantPURLs)
+	}
+}
+
+func TestWriteSPDX(t *testing.T) {
+	doc := collectTestDocument(t)
+	var first, second bytes.Buffer
+	if err := WriteSPDX(&first, doc); err != nil {
+		t.Fatalf("WriteSPDX: %v", err)
+	}
+	if err := WriteSPDX(&second, doc); err != nil {
+		t.Fatalf("WriteSPDX: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("WriteSPDX is not deterministic")
+	}
+
+	var out spdxDocument
+	if err := json.Unmarshal(first.Bytes(), &out); err != nil {
+		t.Fatalf("parsing SPDX: %v", err)
+	}
+	if out.SPDXVersion != "SPDX-2.3" || out.CreationInfo.Created != "1970-01-01T00:00:00Z" {
+		t.Errorf("header = %s created %s", out.SPDXVersion, out.CreationInfo.Created)
+	}
+	if got := len(out.Packages); got != 4 {
+		t.Errorf("%d packages, want image, base image and two packages", got)
+	}
+	// The two files known only from the mtree have no SHA1 and are left out.
+	if got := len(out.Files); got != 3 {
+		t.Errorf("%d files, want 3", got)
+	}
+	checkSPDXFileChecksums(t, out)
+	relationships := map[string]int{}
+	for _, r := range out.Relationships {
+		relationships[r.RelationshipType]++
+	}
+	if relationships["DESCRIBES"] != 1 || relationships["DESCENDANT_OF"] != 1 || relationships["CONTAINS"] != 5 {
+		t.Errorf("relationships = %v", relationships)
+	}
+}
+
+// TestWriteSPDXFromMtree checks the document image_sbom writes by default,
+// from the image's mtree alone, which knows no SHA1 of any file.
+func TestWriteSPDXFromMtree(t *testing.T) {
+	c := NewCollector()
+	mtreeSpec := "#mtree v2.0\n" +
+		"./app type=dir mode=0755\n" +
+		"./app/server type=file size=5 sha256digest=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n"
+	if err := c.AddMtree(strings.NewReader(mtreeSpec)); err != nil {
+		t.Fatalf("AddMtree: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSPDX(&buf, c.Document(Document{Name: "app", Created: time.Unix(0, 0)})); err != nil {
+		t.Fatalf("WriteSPDX: %v", err)
+	}
+	var out spdxDocument
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("parsing SPDX: %v", err)
+	}
+	checkSPDXFileChecksums(t, out)
+	if len(out.Files) != 0 {
+		t.Errorf("files = %+v, want none without a SHA1", out.Files)
+	}
+	if out.Packages[0].FilesAnalyzed {
+		t.Errorf("image package claims its files were analyzed")
+	}
+}
+
+// checkSPDXFileChecksums fails unless every file of the document has the SHA1
+// checksum SPDX requires.
+func checkSPDXFileChecksums(t *testing.T, out spdxDocument) {
+	t.Helper()
+	for _, file := range out.Files {
+		hasSHA1 := false
+		for _, checksum := range file.Checksums {
+			if checksum.Algorithm == "SHA1" && checksum.ChecksumValue != "" {
+				hasSHA1 = true
+			}
+		}
+		if !hasSHA1 {
+			t.Errorf("file %s has no SHA1 checksum: %+v", file.FileName, file.Checksums)
+		}
+	}
+}
+
+func TestWriteCycloneDX(t *testing.T) {
+	doc := collectTestDocument(t)
+	var buf bytes.Buffer
+	if err := WriteCycloneDX(&buf, doc); err != nil {
+		t.Fatalf("WriteCycloneDX: %v", err)
+	}
+	var out cdxDocument
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("parsing CycloneDX: %v", err)
+	}
+	if out.BOMFormat != "CycloneDX" || out.SpecVersion != "1.5" || !strings.HasPrefix(out.SerialNumber, "urn:uuid:") {
+		t.Errorf("header = %s %s %s", out.BOMFormat, out.SpecVersion, out.SerialNumber)
+	}
+	if out.Metadata.Component.Type != "container" || out.Metadata.Component.PURL != "pkg:oci/app@sha256%3A0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef?repository_url=registry.example.com%2Fteam%2Fapp" {
+		t.Errorf("metadata component = %+v", out.Metadata.Component)
+	}
+	types := map[string]int{}
+	for _, component := range out.Components {
+		types[component.Type]++
+	}
+	if types["container"] != 1 || types["library"] != 2 || types["file"] != 5 {
+		t.Errorf("component types = %v", types)
+	}
+}
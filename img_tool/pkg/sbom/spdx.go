@@ -0,0 +1,195 @@
+package sbom
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// spdxDocument is the subset of SPDX 2.3 JSON written here.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Files             []spdxFile         `json:"files,omitempty"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	SourceInfo            string            `json:"sourceInfo,omitempty"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	CopyrightText         string            `json:"copyrightText"`
+}
+
+type spdxFile struct {
+	SPDXID           string         `json:"SPDXID"`
+	FileName         string         `json:"fileName"`
+	Checksums        []spdxChecksum `json:"checksums"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	CopyrightText    string         `json:"copyrightText"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// noAssertion is SPDX's "this document makes no claim" value, used for the
+// licenses and copyrights the build does not know.
+const noAssertion = "NOASSERTION"
+
+// spdxImageID is the SPDX identifier of the image package.
+const spdxImageID = "SPDXRef-Image"
+
+// WriteSPDX writes doc as an SPDX 2.3 JSON document. The image is the primary
+// package, which the document DESCRIBES and which CONTAINS every file and
+// package; the base image is a package the image is a DESCENDANT_OF.
+//
+// SPDX requires a SHA1 of every file. Files known from an mtree carry only their
+// sha256, so they are left out of the document rather than written without
+// one; the image package does not claim its files were analyzed either way.
+// Reading the layers (img sbom --layer) yields the SHA1 of every file.
+func WriteSPDX(w io.Writer, doc *Document) error {
+	id := contentID(doc, FormatSPDX)
+	out := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              doc.Name,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/%s-%s", spdxName(doc.Name), hex.EncodeToString(id[:16])),
+		CreationInfo: spdxCreationInfo{
+			Created:  doc.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: rules_img"},
+		},
+		Packages:      []spdxPackage{},
+		Relationships: []spdxRelationship{{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: spdxImageID}},
+	}
+
+	image := spdxPackage{
+		SPDXID:                spdxImageID,
+		Name:                  doc.Name,
+		VersionInfo:           doc.Digest,
+		DownloadLocation:      noAssertion,
+		PrimaryPackagePurpose: "CONTAINER",
+		ExternalRefs:          []spdxExternalRef{purlRef(imagePURL(doc.Name, doc.Digest))},
+		LicenseConcluded:      noAssertion,
+		LicenseDeclared:       noAssertion,
+		CopyrightText:         noAssertion,
+	}
+	if algorithm, value, found := strings.Cut(doc.Digest, ":"); found && algorithm == "sha256" {
+		image.Checksums = []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: value}}
+	}
+	out.Packages = append(out.Packages, image)
+
+	if doc.BaseImage != "" {
+		out.Packages = append(out.Packages, spdxPackage{
+			SPDXID:                "SPDXRef-BaseImage",
+			Name:                  doc.BaseImage,
+			DownloadLocation:      noAssertion,
+			PrimaryPackagePurpose: "CONTAINER",
+			ExternalRefs:          []spdxExternalRef{purlRef(imagePURL(doc.BaseImage, ""))},
+			LicenseConcluded:      noAssertion,
+			LicenseDeclared:       noAssertion,
+			CopyrightText:         noAssertion,
+		})
+		out.Relationships = append(out.Relationships, spdxRelationship{SPDXElementID: spdxImageID, RelationshipType: "DESCENDANT_OF", RelatedSPDXElement: "SPDXRef-BaseImage"})
+	}
+
+	for i, pkg := range doc.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%d", spdxName(pkg.Name), i)
+		entry := spdxPackage{
+			SPDXID:                id,
+			Name:                  pkg.Name,
+			VersionInfo:           pkg.Version,
+			DownloadLocation:      noAssertion,
+			PrimaryPackagePurpose: "LIBRARY",
+			ExternalRefs:          []spdxExternalRef{purlRef(pkg.PURL(doc.Distro))},
+			LicenseConcluded:      noAssertion,
+			LicenseDeclared:       noAssertion,
+			CopyrightText:         noAssertion,
+		}
+		if pkg.Source != "" && pkg.Source != pkg.Name {
+			entry.SourceInfo = "built from source package " + pkg.Source
+		}
+		out.Packages = append(out.Packages, entry)
+		out.Relationships = append(out.Relationships, spdxRelationship{SPDXElementID: spdxImageID, RelationshipType: "CONTAINS", RelatedSPDXElement: id})
+	}
+
+	for i, file := range doc.Files {
+		if file.SHA1 == "" {
+			continue
+		}
+		id := fmt.Sprintf("SPDXRef-File-%d", i)
+		out.Files = append(out.Files, spdxFile{
+			SPDXID:   id,
+			FileName: "." + file.Path,
+			Checksums: []spdxChecksum{
+				{Algorithm: "SHA1", ChecksumValue: file.SHA1},
+				{Algorithm: "SHA256", ChecksumValue: file.SHA256},
+			},
+			LicenseConcluded: noAssertion,
+			CopyrightText:    noAssertion,
+		})
+		out.Relationships = append(out.Relationships, spdxRelationship{SPDXElementID: spdxImageID, RelationshipType: "CONTAINS", RelatedSPDXElement: id})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(out)
+}
+
+// purlRef is the external reference of a package URL.
+func purlRef(purl string) spdxExternalRef {
+	return spdxExternalRef{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: purl}
+}
+
+// spdxName turns s into the letters, digits, "." and "-" SPDX identifiers allow.
+func spdxName(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('-')
+		}
+	}
+	if sb.Len() == 0 {
+		return "image"
+	}
+	return sb.String()
+}
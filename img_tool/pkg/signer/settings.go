@@ -7,7 +7,12 @@
 // manifests in that layout carry the OCI 1.1 `subject` field and are pushed to
 // the subject's repository as referrers by the caller.
 //
-// The single api.OCIArtifactSigner implementation here is Subprocess.
+// Verification is the same RPC in reverse: `img` fetches the referrers of a
+// digest and hands them to `<tool> verify-oci-artifact [flags]`, which reports
+// whether one of them is a valid signature (see verify.go).
+//
+// The single api.OCIArtifactSigner (and api.OCIArtifactVerifier)
+// implementation here is Subprocess.
 package signer
 
 import (
@@ -42,6 +47,10 @@ type SignSettingConfig struct {
 	Tool          string            `json:"tool"` // runfiles rlocation path or host command
 	Args          []string          `json:"args,omitempty"`
 	Env           map[string]string `json:"env,omitempty"`
+	// VerifyArgs are passed to the plugin after the verify-oci-artifact verb,
+	// in place of Args: the public key or trust policy a signature is checked
+	// against, rather than the private key it was made with.
+	VerifyArgs []string `json:"verify_args,omitempty"`
 }
 
 // SettingStore maps a sign_setting content digest ("sha256:<hex>") to the raw
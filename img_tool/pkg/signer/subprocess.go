@@ -18,13 +18,41 @@ import (
 // `img deploy`. It delegates signing to an external plugin invoked as
 // `<tool> sign-oci-artifact [args...]`, feeding the subject descriptor JSON on
 // stdin and reading an OCI image layout tar on stdout.
+//
+// Attestations use the same framing under a second verb,
+// `<tool> sign-dsse-payload [args...]`: stdin carries an api.DSSEPayloadRequest
+// (the subject plus the payload to wrap in a DSSE envelope) and stdout the OCI
+// layout of the resulting artifact. A plugin that does not know the verb exits
+// non-zero, which fails only the attestation.
+//
+// Verification runs the plugin as `<tool> verify-oci-artifact [verify args...]`
+// with the verify_args of the sign_setting rather than its args: a verifier
+// needs the public half of what the signer was given. stdin carries an
+// api.VerifyRequest and stdout an api.VerifyResult, both JSON.
 type Subprocess struct {
-	toolPath string
-	args     []string // ["sign-oci-artifact", <plugin args>...]
-	env      []string
+	toolPath   string
+	args       []string // ["sign-oci-artifact", <plugin args>...]
+	dsseArgs   []string // ["sign-dsse-payload", <plugin args>...]
+	verifyArgs []string // ["verify-oci-artifact", <plugin verify args>...]
+	env        []string
 }
 
-var _ api.OCIArtifactSigner = (*Subprocess)(nil)
+var (
+	_ api.OCIArtifactSigner   = (*Subprocess)(nil)
+	_ api.DSSESigner          = (*Subprocess)(nil)
+	_ api.OCIArtifactVerifier = (*Subprocess)(nil)
+)
+
+const (
+	// SignSubcommand is the plugin verb that signs a subject descriptor.
+	SignSubcommand = "sign-oci-artifact"
+	// DSSESubcommand is the plugin verb that signs a DSSE payload about a
+	// subject, such as a provenance statement.
+	DSSESubcommand = "sign-dsse-payload"
+	// VerifySubcommand is the plugin verb that checks the referrers of a
+	// subject for a valid signature.
+	VerifySubcommand = "verify-oci-artifact"
+)
 
 // maxSignerStdout caps how much of a plugin's stdout we buffer. Signature
 // artifacts are at most a few KiB; 64 MiB is a generous safety limit that
@@ -67,9 +95,11 @@ func NewSubprocess(cfg SignSettingConfig, rf *runfiles.Runfiles) (*Subprocess, e
 	}
 
 	return &Subprocess{
-		toolPath: toolPath,
-		args:     append([]string{"sign-oci-artifact"}, cfg.Args...),
-		env:      env,
+		toolPath:   toolPath,
+		args:       append([]string{SignSubcommand}, cfg.Args...),
+		dsseArgs:   append([]string{DSSESubcommand}, cfg.Args...),
+		verifyArgs: append([]string{VerifySubcommand}, cfg.VerifyArgs...),
+		env:        env,
 	}, nil
 }
 
@@ -81,9 +111,46 @@ func (s *Subprocess) SignArtifacts(ctx context.Context, subject v1.Descriptor) (
 	if err != nil {
 		return nil, fmt.Errorf("marshalling subject descriptor: %w", err)
 	}
+	return s.run(ctx, s.args, subjJSON)
+}
+
+// SignDSSEArtifacts runs the plugin's sign-dsse-payload verb: it hands the
+// plugin payload to sign as a DSSE envelope of payloadType about subject, and
+// returns every artifact image in the plugin's OCI-layout output.
+func (s *Subprocess) SignDSSEArtifacts(ctx context.Context, subject v1.Descriptor, payloadType string, payload []byte) ([]v1.Image, error) {
+	reqJSON, err := json.Marshal(api.DSSEPayloadRequest{
+		Subject:     subject,
+		PayloadType: payloadType,
+		Payload:     payload,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshalling DSSE payload request: %w", err)
+	}
+	return s.run(ctx, s.dsseArgs, reqJSON)
+}
+
+// run executes the plugin with args, writes stdin to it and parses the OCI
+// layout tar it writes to stdout.
+func (s *Subprocess) run(ctx context.Context, args []string, stdin []byte) ([]v1.Image, error) {
+	out, err := s.output(ctx, args, stdin)
+	if err != nil {
+		return nil, err
+	}
+	imgs, err := ReadArtifactLayout(out)
+	if err != nil {
+		return nil, fmt.Errorf("reading signer plugin %q output: %w", s.toolPath, err)
+	}
+	if len(imgs) == 0 {
+		return nil, fmt.Errorf("signer plugin %q produced an empty OCI layout", s.toolPath)
+	}
+	return imgs, nil
+}
 
-	cmd := exec.CommandContext(ctx, s.toolPath, s.args...)
-	cmd.Stdin = bytes.NewReader(subjJSON) // os/exec closes the write end at EOF
+// output executes the plugin with args, writes stdin to it and returns what it
+// writes to stdout.
+func (s *Subprocess) output(ctx context.Context, args []string, stdin []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, s.toolPath, args...)
+	cmd.Stdin = bytes.NewReader(stdin) // os/exec closes the write end at EOF
 	cmd.Env = s.env
 	// Stream stderr to the user so interactive prompts (security-key touch, PIN,
 	// OIDC device flow) are visible.
@@ -97,15 +164,7 @@ func (s *Subprocess) SignArtifacts(ctx context.Context, subject v1.Descriptor) (
 		}
 		return nil, fmt.Errorf("signer plugin %q failed: %w", s.toolPath, err)
 	}
-
-	imgs, err := ReadArtifactLayout(stdout.buf.Bytes())
-	if err != nil {
-		return nil, fmt.Errorf("reading signer plugin %q output: %w", s.toolPath, err)
-	}
-	if len(imgs) == 0 {
-		return nil, fmt.Errorf("signer plugin %q produced an empty OCI layout", s.toolPath)
-	}
-	return imgs, nil
+	return stdout.buf.Bytes(), nil
 }
 
 // Sign implements api.OCIArtifactSigner. It returns the primary (first) artifact
@@ -119,6 +178,16 @@ func (s *Subprocess) Sign(ctx context.Context, subject v1.Descriptor) (v1.Image,
 	return imgs[0], nil
 }
 
+// SignDSSE implements api.DSSESigner. Like Sign, it returns the primary (first)
+// artifact image.
+func (s *Subprocess) SignDSSE(ctx context.Context, subject v1.Descriptor, payloadType string, payload []byte) (v1.Image, error) {
+	imgs, err := s.SignDSSEArtifacts(ctx, subject, payloadType, payload)
+	if err != nil {
+		return nil, err
+	}
+	return imgs[0], nil
+}
+
 // limitedBuffer is a bytes.Buffer that refuses to grow beyond limit, so a
 // runaway plugin cannot exhaust memory. Once the limit is exceeded, over is set
 // and further writes error (which fails cmd.Run).
@@ -3,27 +3,65 @@ package signer
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"os"
 	"testing"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
 )
 
 // TestHelperProcess is not a real test: when GO_WANT_HELPER_PROCESS=1 it acts as
 // a signer plugin, reading the subject descriptor from stdin and writing a fake
 // signature artifact as an OCI layout tar to stdout. TestSubprocessSignArtifacts
 // runs this binary in that mode.
+//
+// With GO_WANT_HELPER_PROCESS=dsse it acts as the sign-dsse-payload verb
+// instead: it reads an api.DSSEPayloadRequest and returns the payload itself as
+// the artifact's layer, so the test can check what the plugin was handed.
+//
+// With GO_WANT_HELPER_PROCESS=verify it acts as the verify-oci-artifact verb: an
+// artifact verifies when one of its blobs is the fake signature mode "1" makes.
 func TestHelperProcess(t *testing.T) {
-	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
-		return
-	}
 	var subject v1.Descriptor
-	if err := json.NewDecoder(os.Stdin).Decode(&subject); err != nil {
-		os.Exit(2)
+	var layer testArtifactLayer
+	switch os.Getenv("GO_WANT_HELPER_PROCESS") {
+	case "1":
+		if err := json.NewDecoder(os.Stdin).Decode(&subject); err != nil {
+			os.Exit(2)
+		}
+		layer = testArtifactLayer{MediaType: "application/octet-stream", Data: []byte("sig-of-" + subject.Digest.Hex)}
+	case "dsse":
+		var req api.DSSEPayloadRequest
+		if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+			os.Exit(2)
+		}
+		subject = req.Subject
+		layer = testArtifactLayer{MediaType: req.PayloadType, Data: req.Payload}
+	case "verify":
+		var req api.VerifyRequest
+		if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+			os.Exit(2)
+		}
+		result := api.VerifyResult{Reason: "no signature by the test key"}
+		for _, artifact := range req.Artifacts {
+			for _, blob := range artifact.Blobs {
+				if string(blob) == "sig-of-"+req.Subject.Digest.Hex {
+					result = api.VerifyResult{Verified: true, Artifact: artifact.Descriptor.Digest.String(), Identity: "test key"}
+				}
+			}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			os.Exit(4)
+		}
+		os.Exit(0)
+	default:
+		return
 	}
 	img, err := buildTestArtifact(
 		"application/vnd.test.signature",
-		[]testArtifactLayer{{MediaType: "application/octet-stream", Data: []byte("sig-of-" + subject.Digest.Hex)}},
+		[]testArtifactLayer{layer},
 		&subject,
 		nil,
 	)
@@ -69,3 +107,50 @@ func TestSubprocessSignArtifacts(t *testing.T) {
 		t.Errorf("subject = %+v, want %s", manifest.Subject, subject.Digest)
 	}
 }
+
+// TestSubprocessSignDSSEArtifacts runs the sign-dsse-payload verb against this
+// test binary and checks the plugin received the subject and the payload.
+func TestSubprocessSignDSSEArtifacts(t *testing.T) {
+	sub := &Subprocess{
+		toolPath: os.Args[0],
+		dsseArgs: []string{"-test.run=TestHelperProcess"},
+		env:      append(os.Environ(), "GO_WANT_HELPER_PROCESS=dsse"),
+	}
+	subject := v1.Descriptor{
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Digest:    v1.Hash{Algorithm: "sha256", Hex: "4444444444444444444444444444444444444444444444444444444444444444"},
+		Size:      99,
+	}
+	payload := []byte(`{"_type":"https://in-toto.io/Statement/v1"}`)
+
+	img, err := sub.SignDSSE(context.Background(), subject, "application/vnd.in-toto+json", payload)
+	if err != nil {
+		t.Fatalf("SignDSSE: %v", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != subject.Digest {
+		t.Errorf("subject = %+v, want %s", manifest.Subject, subject.Digest)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != "application/vnd.in-toto+json" {
+		t.Fatalf("layers = %+v, want the payload type", manifest.Layers)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Layers: %v", err)
+	}
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(payload) {
+		t.Errorf("plugin received payload %q, want %q", got, payload)
+	}
+}
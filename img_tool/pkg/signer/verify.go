@@ -0,0 +1,156 @@
+package signer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/api"
+)
+
+// maxVerifyArtifactSize caps the blobs of a single referrer handed to a plugin
+// for verification. Signature artifacts are a few KiB; a referrer beyond this
+// (an SBOM, a SOCI index) is not a signature, and is left out instead of being
+// read into memory and base64-encoded onto the plugin's stdin.
+const maxVerifyArtifactSize = 4 << 20 // 4 MiB
+
+// Verify implements api.OCIArtifactVerifier by running the plugin's
+// verify-oci-artifact verb over the candidate artifacts. Referrers too large to
+// be signatures are skipped; when none is left, the plugin is not run at all.
+func (s *Subprocess) Verify(ctx context.Context, subject v1.Descriptor, artifacts []v1.Image) (api.VerifyResult, error) {
+	req := api.VerifyRequest{Subject: subject}
+	for _, img := range artifacts {
+		artifact, ok, err := verifyArtifact(img)
+		if err != nil {
+			return api.VerifyResult{}, err
+		}
+		if ok {
+			req.Artifacts = append(req.Artifacts, artifact)
+		}
+	}
+	if len(req.Artifacts) == 0 {
+		return api.VerifyResult{Reason: fmt.Sprintf("no signature artifacts refer to %s", subject.Digest)}, nil
+	}
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return api.VerifyResult{}, fmt.Errorf("marshalling verify request: %w", err)
+	}
+	out, err := s.output(ctx, s.verifyArgs, reqJSON)
+	if err != nil {
+		return api.VerifyResult{}, err
+	}
+	var result api.VerifyResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		return api.VerifyResult{}, fmt.Errorf("parsing signer plugin %q verify result: %w", s.toolPath, err)
+	}
+	return result, nil
+}
+
+// verifyArtifact packs a referrer for the plugin. It reports false for a
+// referrer whose blobs exceed maxVerifyArtifactSize.
+func verifyArtifact(img v1.Image) (api.VerifyArtifact, bool, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return api.VerifyArtifact{}, false, fmt.Errorf("computing referrer digest: %w", err)
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return api.VerifyArtifact{}, false, fmt.Errorf("reading media type of referrer %s: %w", digest, err)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return api.VerifyArtifact{}, false, fmt.Errorf("reading manifest of referrer %s: %w", digest, err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return api.VerifyArtifact{}, false, fmt.Errorf("parsing manifest of referrer %s: %w", digest, err)
+	}
+	total := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		total += layer.Size
+	}
+	if total > maxVerifyArtifactSize {
+		return api.VerifyArtifact{}, false, nil
+	}
+
+	blobs := map[string][]byte{}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return api.VerifyArtifact{}, false, fmt.Errorf("reading config of referrer %s: %w", digest, err)
+	}
+	blobs[manifest.Config.Digest.String()] = config
+	for _, desc := range manifest.Layers {
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return api.VerifyArtifact{}, false, fmt.Errorf("reading layer %s of referrer %s: %w", desc.Digest, digest, err)
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return api.VerifyArtifact{}, false, fmt.Errorf("reading layer %s of referrer %s: %w", desc.Digest, digest, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, maxVerifyArtifactSize+1))
+		_ = rc.Close()
+		if err != nil {
+			return api.VerifyArtifact{}, false, fmt.Errorf("reading layer %s of referrer %s: %w", desc.Digest, digest, err)
+		}
+		blobs[desc.Digest.String()] = data
+	}
+	return api.VerifyArtifact{
+		Descriptor: v1.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw)), ArtifactType: manifest.ArtifactType},
+		Manifest:   raw,
+		Blobs:      blobs,
+	}, true, nil
+}
+
+// FetchReferrers returns the image manifests referring to subject, as listed by
+// the registry's referrers API (or its tag-schema fallback). Nested indexes are
+// not signatures and are skipped.
+func FetchReferrers(ctx context.Context, subject name.Digest, opts ...remote.Option) ([]v1.Image, error) {
+	opts = append([]remote.Option{remote.WithContext(ctx)}, opts...)
+	index, err := remote.Referrers(subject, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("listing referrers of %s: %w", subject, err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("listing referrers of %s: %w", subject, err)
+	}
+	var imgs []v1.Image
+	for _, desc := range manifest.Manifests {
+		if desc.MediaType.IsIndex() {
+			continue
+		}
+		img, err := remote.Image(subject.Context().Digest(desc.Digest.String()), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("fetching referrer %s of %s: %w", desc.Digest, subject, err)
+		}
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+// VerifyReference resolves ref to a digest, fetches the referrers of that
+// digest and asks verifier whether one of them is a valid signature. It
+// returns the resolved digest along with the verifier's result.
+func VerifyReference(ctx context.Context, verifier api.OCIArtifactVerifier, ref name.Reference, opts ...remote.Option) (name.Digest, api.VerifyResult, error) {
+	desc, err := remote.Get(ref, append([]remote.Option{remote.WithContext(ctx)}, opts...)...)
+	if err != nil {
+		return name.Digest{}, api.VerifyResult{}, fmt.Errorf("resolving %s: %w", ref, err)
+	}
+	digest := ref.Context().Digest(desc.Digest.String())
+	referrers, err := FetchReferrers(ctx, digest, opts...)
+	if err != nil {
+		return digest, api.VerifyResult{}, err
+	}
+	subject := v1.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size}
+	result, err := verifier.Verify(ctx, subject, referrers)
+	if err != nil {
+		return digest, api.VerifyResult{}, fmt.Errorf("verifying %s: %w", digest, err)
+	}
+	return digest, result, nil
+}
@@ -0,0 +1,137 @@
+package signer
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/bazel-contrib/rules_img/img_tool/internal/testregistry"
+	"github.com/bazel-contrib/rules_img/img_tool/pkg/registryopts"
+)
+
+// verifyingSubprocess runs this test binary as a plugin in verify mode (see
+// TestHelperProcess).
+func verifyingSubprocess() *Subprocess {
+	return &Subprocess{
+		toolPath:   os.Args[0],
+		verifyArgs: []string{"-test.run=TestHelperProcess"},
+		env:        append(os.Environ(), "GO_WANT_HELPER_PROCESS=verify"),
+	}
+}
+
+func TestSubprocessVerify(t *testing.T) {
+	subject := v1.Descriptor{
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Digest:    v1.Hash{Algorithm: "sha256", Hex: "5555555555555555555555555555555555555555555555555555555555555555"},
+		Size:      99,
+	}
+	signature, err := buildTestArtifact("application/vnd.test.signature", []testArtifactLayer{{MediaType: "application/octet-stream", Data: []byte("sig-of-" + subject.Digest.Hex)}}, &subject, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := buildTestArtifact("application/vnd.test.signature", []testArtifactLayer{{MediaType: "application/octet-stream", Data: []byte("sig-of-something-else")}}, &subject, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatureDigest, err := signature.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := verifyingSubprocess().Verify(context.Background(), subject, []v1.Image{forged, signature})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !result.Verified || result.Artifact != signatureDigest.String() || result.Identity != "test key" {
+		t.Errorf("result = %+v, want verified by %s", result, signatureDigest)
+	}
+
+	result, err = verifyingSubprocess().Verify(context.Background(), subject, []v1.Image{forged})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if result.Verified || result.Reason == "" {
+		t.Errorf("result = %+v, want unverified with a reason", result)
+	}
+}
+
+// TestSubprocessVerifyWithoutArtifacts checks that a subject without referrers
+// is reported unverified without running the plugin.
+func TestSubprocessVerifyWithoutArtifacts(t *testing.T) {
+	sub := &Subprocess{toolPath: "/nonexistent/plugin"}
+	subject := v1.Descriptor{Digest: v1.Hash{Algorithm: "sha256", Hex: "6666666666666666666666666666666666666666666666666666666666666666"}}
+	result, err := sub.Verify(context.Background(), subject, nil)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if result.Verified || result.Reason == "" {
+		t.Errorf("result = %+v, want unverified with a reason", result)
+	}
+}
+
+// TestVerifyReference signs an image in an in-memory registry the way
+// `img deploy` does and verifies it by tag.
+func TestVerifyReference(t *testing.T) {
+	regs := testregistry.New("reg.example.com")
+	ctx := context.Background()
+	tag, err := name.NewTag("reg.example.com/team/app:v1", registryopts.NameOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag, img, regs.Options()...); err != nil {
+		t.Fatal(err)
+	}
+	imgDigest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, result, err := VerifyReference(ctx, verifyingSubprocess(), tag, regs.Options()...)
+	if err != nil {
+		t.Fatalf("VerifyReference: %v", err)
+	}
+	if digest.DigestStr() != imgDigest.String() {
+		t.Errorf("resolved %s, want %s", digest, imgDigest)
+	}
+	if result.Verified {
+		t.Fatalf("unsigned image verified: %+v", result)
+	}
+
+	signing := &Subprocess{
+		toolPath: os.Args[0],
+		args:     []string{"-test.run=TestHelperProcess"},
+		env:      append(os.Environ(), "GO_WANT_HELPER_PROCESS=1"),
+	}
+	subject, err := remote.Head(tag, regs.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatures, err := signing.SignArtifacts(ctx, *subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pusher, err := remote.NewPusher(regs.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PushReferrers(ctx, pusher, tag.Context(), signatures); err != nil {
+		t.Fatal(err)
+	}
+
+	_, result, err = VerifyReference(ctx, verifyingSubprocess(), tag, regs.Options()...)
+	if err != nil {
+		t.Fatalf("VerifyReference: %v", err)
+	}
+	if !result.Verified {
+		t.Errorf("signed image did not verify: %+v", result)
+	}
+}
@@ -12,6 +12,9 @@ type Request struct {
 	Spec string `json:"spec"`
 	// Configs are the rlocation paths of the CST config files (YAML or JSON).
 	Configs []string `json:"configs"`
+	// RunCommands opts into running commandTests in a sandbox built from the
+	// image's layers (so Spec must carry them).
+	RunCommands bool `json:"run_commands,omitempty"`
 }
 
 // Spec is the set of images to validate. Images known at analysis time
@@ -23,6 +26,11 @@ type Request struct {
 type Spec struct {
 	Images      []ImageSpec `json:"images,omitempty"`
 	LayoutTrees []string    `json:"layout_trees,omitempty"`
+	// LayoutDirs, when set, runs parallel to LayoutTrees: LayoutDirs[i] is the
+	// rlocation path of the OCI image layout directory LayoutTrees[i] was
+	// extracted from. The layer blob paths in that tree's images.json are
+	// relative to it. Set only when the test reads layer contents.
+	LayoutDirs []string `json:"layout_dirs,omitempty"`
 }
 
 // ImageSpec describes a single image (one platform) to validate.
@@ -36,6 +44,29 @@ type ImageSpec struct {
 	// Complete is false when the mtree reflects only a subset of the image's
 	// layers, so `shouldExist: false` assertions cannot be trusted.
 	Complete bool `json:"complete"`
+	// Layers are the image's tar layers, bottom to top, for the checks that
+	// read file contents (fileContentTests). At the top level of a Spec they are
+	// set only when the test asked for layer contents: nil (absent from the
+	// JSON) means the contents are unavailable, while an empty list is an image
+	// without tar layers. Inside a LayoutTree's images.json they are always
+	// recorded, relative to the OCI layout directory, and used only when the
+	// Spec lists that directory in LayoutDirs.
+	Layers []LayerSpec `json:"layers,omitempty"`
+}
+
+// LayerSpec locates the content of one tar layer. Exactly one of Blob or
+// CompactStream is set; both are empty for a layer whose content is not
+// available (a shallow base layer that was never downloaded, or a non-tar
+// layer in an OCI layout), which makes any path it might have changed
+// unknowable.
+type LayerSpec struct {
+	// Blob is the layer blob, compressed or not.
+	Blob string `json:"blob,omitempty"`
+	// CompactStream is the layer's compact stream (.cstream) and CASDir the
+	// content-addressed directory (sha256/<hex>, as written by `img cas-dir`)
+	// holding the file contents it references.
+	CompactStream string `json:"compact_stream,omitempty"`
+	CASDir        string `json:"cas_dir,omitempty"`
 }
 
 // Platform identifies the OS/arch/variant an image targets.
@@ -4,8 +4,13 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"io"
+	"slices"
 	"testing"
 
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/klauspost/compress/zstd"
+
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/compactstream"
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/compress"
 )
@@ -45,6 +50,62 @@ func TestReconstructEstargzZstd(t *testing.T) {
 	}
 }
 
+// TestReconstructEstargzPrioritizedFiles checks that prioritized files come
+// first, with their parent directories and hard link targets, followed by the
+// prefetch landmark, and that reconstruction repeats the reordering.
+func TestReconstructEstargzPrioritizedFiles(t *testing.T) {
+	settings := tarSettings{
+		compression:      "zstd",
+		estargz:          true,
+		compressionLevel: 3,
+		compressorJobs:   1,
+		prioritizedFiles: []string{"/app/bin/server", "app/config.json", "not/in/this/layer"},
+	}
+	server := []byte("server binary")
+	config := []byte(`{"listen": ":8080"}`)
+	other := []byte("not needed at startup")
+	entries := []testEntry{
+		{hdr: &tar.Header{Typeflag: tar.TypeReg, Name: "other.txt", Size: int64(len(other)), Mode: 0o644}, content: other},
+		{hdr: &tar.Header{Typeflag: tar.TypeReg, Name: "app/bin/real-server", Size: int64(len(server)), Mode: 0o755}, content: server},
+		{hdr: &tar.Header{Typeflag: tar.TypeReg, Name: "app/config.json", Size: int64(len(config)), Mode: 0o644}, content: config},
+		{hdr: &tar.Header{Typeflag: tar.TypeDir, Name: "app/", Mode: 0o755}},
+		{hdr: &tar.Header{Typeflag: tar.TypeDir, Name: "app/bin/", Mode: 0o755}},
+		{hdr: &tar.Header{Typeflag: tar.TypeLink, Name: "app/bin/server", Linkname: "app/bin/real-server"}},
+	}
+
+	direct := buildTarDirect(t, entries, settings)
+	reconstructed := buildIndexAndReconstruct(t, entries, settings, compactstream.StreamCompressionZstd, 0)
+	if !bytes.Equal(direct, reconstructed) {
+		t.Fatalf("prioritized estargz mismatch: direct=%d bytes, reconstructed=%d bytes", len(direct), len(reconstructed))
+	}
+
+	zr, err := zstd.NewReader(bytes.NewReader(direct))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	want := []string{
+		"app/", "app/bin/", "app/bin/real-server", "app/bin/server", "app/config.json",
+		estargz.PrefetchLandmark,
+		"other.txt",
+	}
+	if !slices.Equal(names, want) {
+		t.Fatalf("entries = %q, want %q", names, want)
+	}
+}
+
 func TestReconstructHardlink(t *testing.T) {
 	settings := tarSettings{compression: "gzip", compressionLevel: 6, compressorJobs: 1}
 	content := []byte("shared content that a hardlink points to")
@@ -42,6 +42,7 @@ type tarSettings struct {
 	estargz          bool
 	compressionLevel int
 	compressorJobs   int
+	prioritizedFiles []string
 }
 
 func (s tarSettings) originalCompression() uint8 {
@@ -63,6 +64,9 @@ func (s tarSettings) compressOpts() []compress.Option {
 	if s.compressorJobs > 0 {
 		opts = append(opts, compress.CompressorJobs(s.compressorJobs))
 	}
+	if len(s.prioritizedFiles) > 0 {
+		opts = append(opts, compress.PrioritizedFiles(s.prioritizedFiles))
+	}
 	return opts
 }
 
@@ -109,6 +113,7 @@ func buildIndexAndReconstruct(t *testing.T, entries []testEntry, settings tarSet
 			Seekable:         settings.estargz,
 			CompressionLevel: int8(settings.compressionLevel),
 			CompressorJobs:   uint8(settings.compressorJobs),
+			PrioritizedFiles: settings.prioritizedFiles,
 		}, inlineThreshold)
 
 	obs := newCompactStreamObserver[SHA256Helper](iw)
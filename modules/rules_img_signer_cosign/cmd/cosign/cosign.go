@@ -1,7 +1,11 @@
 // Command cosign is a rules_img signer plugin that produces Sigstore signatures
 // using sigstore-go. It implements the `sign-oci-artifact` protocol: it reads
 // the subject descriptor from stdin and writes an OCI image layout tar (a
-// Sigstore-bundle signature artifact) to stdout. It never contacts a container
+// Sigstore-bundle signature artifact) to stdout. It also implements
+// `sign-dsse-payload`, which signs an in-toto Statement handed over by
+// `img deploy` (SLSA provenance) into the same kind of bundle, and
+// `verify-oci-artifact`, which checks such bundles among the referrers `img
+// verify` hands over (see verify.go). It never contacts a container
 // registry (it may contact Fulcio/Rekor and an RFC3161 timestamp authority,
 // which are signing infrastructure).
 //
@@ -78,7 +82,7 @@ const (
 )
 
 func main() {
-	if err := plugin.Dispatch(context.Background(), os.Args[1:], newSigner); err != nil {
+	if err := plugin.DispatchWithVerifier(context.Background(), os.Args[1:], newSigner, newVerifier); err != nil {
 		fmt.Fprintln(os.Stderr, "cosign-plugin:", err)
 		os.Exit(1)
 	}
@@ -207,13 +211,39 @@ func (s *cosignSigner) Sign(ctx context.Context, subject v1.Descriptor) (v1.Imag
 	if err != nil {
 		return nil, err
 	}
+	return s.bundleArtifact(ctx, subject, dsseIntotoPayloadType, statement, cosignSignPredicateType)
+}
+
+// SignDSSE signs payload, an in-toto Statement handed over by `img deploy`
+// (such as SLSA provenance), exactly as given. The bundle is annotated with the
+// statement's predicate type, as `cosign attest --new-bundle-format` does, so
+// `cosign verify-attestation --type` finds it.
+func (s *cosignSigner) SignDSSE(ctx context.Context, subject v1.Descriptor, payloadType string, payload []byte) (v1.Image, error) {
+	if payloadType != dsseIntotoPayloadType {
+		return nil, fmt.Errorf("unsupported DSSE payload type %q (want %q)", payloadType, dsseIntotoPayloadType)
+	}
+	var statement struct {
+		Type          string `json:"_type"`
+		PredicateType string `json:"predicateType"`
+	}
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, fmt.Errorf("parsing in-toto statement: %w", err)
+	}
+	if statement.Type != inTotoStatementType || statement.PredicateType == "" {
+		return nil, fmt.Errorf("payload is not an in-toto v1 statement with a predicate type")
+	}
+	return s.bundleArtifact(ctx, subject, payloadType, payload, statement.PredicateType)
+}
 
+// bundleArtifact DSSE-signs payload into a Sigstore bundle and wraps the bundle
+// in a referrer artifact of subject.
+func (s *cosignSigner) bundleArtifact(ctx context.Context, subject v1.Descriptor, payloadType string, payload []byte, predicateType string) (v1.Image, error) {
 	opts := s.bundleOpts
 	opts.Context = ctx
 	// DSSE-sign the in-toto statement. The signature is over the DSSE PAE, so the
 	// keypair's normal hash-then-sign is used (no pre-hashing), and Fulcio/Rekor
 	// work unchanged.
-	content := &sign.DSSEData{Data: statement, PayloadType: dsseIntotoPayloadType}
+	content := &sign.DSSEData{Data: payload, PayloadType: payloadType}
 	bundle, err := sign.Bundle(content, s.keypair, opts)
 	if err != nil {
 		return nil, fmt.Errorf("creating sigstore bundle: %w", err)
@@ -225,7 +255,7 @@ func (s *cosignSigner) Sign(ctx context.Context, subject v1.Descriptor) (v1.Imag
 
 	annotations := map[string]string{
 		annotationBundleContent:       "dsse-envelope",
-		annotationBundlePredicateType: cosignSignPredicateType,
+		annotationBundlePredicateType: predicateType,
 	}
 	// Reproducible by default: only stamp a creation time when explicitly asked,
 	// matching cosign's --record-creation-timestamp (default false).
@@ -26,6 +26,8 @@ import (
 	"github.com/sigstore/sigstore-go/pkg/bundle"
 	"github.com/sigstore/sigstore/pkg/cryptoutils"
 
+	"github.com/bazel-contrib/rules_img_signer_cosign/pkg/signerapi"
+
 	// Registers the fakekms:// provider so the KMS --key path can be tested
 	// end-to-end without a real cloud KMS.
 	_ "github.com/sigstore/sigstore/pkg/signature/kms/fake"
@@ -208,6 +210,50 @@ func TestCosignKeyBasedSign(t *testing.T) {
 	}
 }
 
+// TestCosignSignDSSE checks the sign-dsse-payload path signs the statement it is
+// handed byte for byte and labels the bundle with the statement's predicate.
+func TestCosignSignDSSE(t *testing.T) {
+	keyPath, pub := writeECDSAKeyPair(t)
+	s, err := newSigner([]string{"--key", keyPath, "--tlog-upload=false"})
+	if err != nil {
+		t.Fatalf("newSigner: %v", err)
+	}
+	dsseSigner, ok := s.(signerapi.DSSESigner)
+	if !ok {
+		t.Fatal("cosign signer does not implement signerapi.DSSESigner")
+	}
+
+	subject := testSubject()
+	const slsaPredicateType = "https://slsa.dev/provenance/v1"
+	statement := []byte(`{"_type":"` + inTotoStatementType + `","subject":[{"name":"reg.example/app","digest":{"sha256":"` + subject.Digest.Hex + `"}}],"predicateType":"` + slsaPredicateType + `","predicate":{"runDetails":{"builder":{"id":"https://ci.example.com"}}}}`)
+	img, err := dsseSigner.SignDSSE(context.Background(), subject, dsseIntotoPayloadType, statement)
+	if err != nil {
+		t.Fatalf("SignDSSE: %v", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != subject.Digest {
+		t.Errorf("subject not set to %s: %+v", subject.Digest, manifest.Subject)
+	}
+	if got := manifest.Annotations[annotationBundlePredicateType]; got != slsaPredicateType {
+		t.Errorf("%s = %q, want %q", annotationBundlePredicateType, got, slsaPredicateType)
+	}
+	payloadType, payload, sig := dsseParts(t, img)
+	if payloadType != dsseIntotoPayloadType || string(payload) != string(statement) {
+		t.Errorf("signed %s payload %s, want the statement as given", payloadType, payload)
+	}
+	sum := sha256.Sum256(dssePAE(payloadType, payload))
+	if !ecdsa.VerifyASN1(pub, sum[:], sig) {
+		t.Error("DSSE signature does not verify against the signing public key")
+	}
+
+	if _, err := dsseSigner.SignDSSE(context.Background(), subject, "text/plain", []byte("hello")); err == nil {
+		t.Error("SignDSSE accepted a payload that is not an in-toto statement")
+	}
+}
+
 // dssePAE reconstructs the DSSE v1 pre-authentication encoding.
 func dssePAE(payloadType string, payload []byte) []byte {
 	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
@@ -533,3 +579,110 @@ func TestCertificateFlagsRequireKey(t *testing.T) {
 		t.Error("expected error for --certificate without --key")
 	}
 }
+
+// verifyArtifactOf packs a signature artifact the way `img verify` hands it to
+// the verify-oci-artifact verb.
+func verifyArtifactOf(t *testing.T, img v1.Image) signerapi.VerifyArtifact {
+	t.Helper()
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	return signerapi.VerifyArtifact{
+		Descriptor: v1.Descriptor{MediaType: manifest.MediaType, Digest: digest, Size: int64(len(raw)), ArtifactType: manifest.ArtifactType},
+		Manifest:   raw,
+		Blobs:      map[string][]byte{manifest.Layers[0].Digest.String(): bundleLayer(t, img)},
+	}
+}
+
+func writePublicKey(t *testing.T, pub crypto.PublicKey) string {
+	t.Helper()
+	data, err := cryptoutils.MarshalPublicKeyToPEM(pub)
+	if err != nil {
+		t.Fatalf("marshalling public key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("writing public key: %v", err)
+	}
+	return path
+}
+
+// TestCosignVerifyKey round-trips the offline key path: a signature made with
+// --key verifies against the public key, and not against another key, another
+// subject, or an attestation in place of a signature.
+func TestCosignVerifyKey(t *testing.T) {
+	keyPath, pub := writeECDSAKeyPair(t)
+	s, err := newSigner([]string{"--key", keyPath, "--tlog-upload=false"})
+	if err != nil {
+		t.Fatalf("newSigner: %v", err)
+	}
+	subject := testSubject()
+	sig, err := s.Sign(context.Background(), subject)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	statement := []byte(`{"_type":"` + inTotoStatementType + `","subject":[{"digest":{"sha256":"` + subject.Digest.Hex + `"}}],"predicateType":"https://slsa.dev/provenance/v1","predicate":{}}`)
+	attestation, err := s.(signerapi.DSSESigner).SignDSSE(context.Background(), subject, dsseIntotoPayloadType, statement)
+	if err != nil {
+		t.Fatalf("SignDSSE: %v", err)
+	}
+
+	v, err := newVerifier([]string{"--key", writePublicKey(t, pub), "--insecure-ignore-tlog"})
+	if err != nil {
+		t.Fatalf("newVerifier: %v", err)
+	}
+	result, err := v.Verify(context.Background(), subject, []signerapi.VerifyArtifact{verifyArtifactOf(t, attestation), verifyArtifactOf(t, sig)})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	sigDigest, _ := sig.Digest()
+	if !result.Verified || result.Artifact != sigDigest.String() || !strings.HasPrefix(result.Identity, "key sha256:") {
+		t.Errorf("Verify = %+v, want the signature %s verified by key", result, sigDigest)
+	}
+
+	if result, err := v.Verify(context.Background(), subject, []signerapi.VerifyArtifact{verifyArtifactOf(t, attestation)}); err != nil || result.Verified {
+		t.Errorf("Verify(attestation only) = %+v, %v; want not verified", result, err)
+	}
+
+	other := subject
+	other.Digest.Hex = strings.Repeat("3", 64)
+	if result, err := v.Verify(context.Background(), other, []signerapi.VerifyArtifact{verifyArtifactOf(t, sig)}); err != nil || result.Verified || result.Reason == "" {
+		t.Errorf("Verify(other subject) = %+v, %v; want not verified with a reason", result, err)
+	}
+
+	_, otherPub := writeECDSAKeyPair(t)
+	wrongKey, err := newVerifier([]string{"--key", writePublicKey(t, otherPub), "--insecure-ignore-tlog"})
+	if err != nil {
+		t.Fatalf("newVerifier: %v", err)
+	}
+	if result, err := wrongKey.Verify(context.Background(), subject, []signerapi.VerifyArtifact{verifyArtifactOf(t, sig)}); err != nil || result.Verified {
+		t.Errorf("Verify(wrong key) = %+v, %v; want not verified", result, err)
+	}
+}
+
+// TestNewVerifierFlags checks the verifier refuses configurations that would
+// silently trust too much or cannot work offline.
+func TestNewVerifierFlags(t *testing.T) {
+	_, pub := writeECDSAKeyPair(t)
+	pubPath := writePublicKey(t, pub)
+	t.Setenv("SIGSTORE_TRUSTED_ROOT", "")
+	t.Setenv("RULES_IMG_COSIGN_PUBLIC_KEY", "")
+	for _, args := range [][]string{
+		{"--key", pubPath}, // tlog check without a trusted root
+		{"--key", pubPath, "--insecure-ignore-tlog", "--certificate-identity", "me@example.com"},
+		{"--certificate-identity", "me@example.com", "--certificate-oidc-issuer", "https://accounts.google.com"}, // no trusted root
+	} {
+		if _, err := newVerifier(args); err == nil {
+			t.Errorf("newVerifier(%q) succeeded, want an error", args)
+		}
+	}
+}
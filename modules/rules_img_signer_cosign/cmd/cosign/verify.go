@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sigstore/sigstore-go/pkg/bundle"
+	"github.com/sigstore/sigstore-go/pkg/root"
+	"github.com/sigstore/sigstore-go/pkg/verify"
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	sigsig "github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/kms"
+
+	"github.com/bazel-contrib/rules_img_signer_cosign/pkg/plugin"
+	"github.com/bazel-contrib/rules_img_signer_cosign/pkg/signerapi"
+)
+
+// cosignVerifier checks the Sigstore bundles this plugin (or `cosign sign
+// --new-bundle-format`) attaches as referrers. Only bundles signing the
+// cosign sign predicate count: an attestation, such as SLSA provenance, is a
+// statement about the image, not a signature of it.
+type cosignVerifier struct {
+	verifier *verify.Verifier
+	policy   verify.PolicyOption
+	// keyID names the trusted key in results (key mode only).
+	keyID string
+}
+
+func newVerifier(args []string) (signerapi.OCIArtifactVerifier, error) {
+	fs := flag.NewFlagSet(plugin.VerifySubcommand, flag.ContinueOnError)
+	keyRef := fs.String("key", "", "path to the public key file (PEM), or a KMS URI (awskms://, gcpkms://, azurekms://, hashivault://) whose public key is used (or $RULES_IMG_COSIGN_PUBLIC_KEY). If unset, verify keyless signatures against --trusted-root.")
+	trustedRootPath := fs.String("trusted-root", "", "path to a Sigstore trusted_root.json holding the Fulcio, Rekor, CT log, and timestamp authority keys to trust (or $SIGSTORE_TRUSTED_ROOT). Required for keyless verification and for the transparency log check.")
+	certIdentity := fs.String("certificate-identity", "", "the identity expected in a valid Fulcio certificate. Valid values include email address, DNS names, IP addresses, and URIs.")
+	certIdentityRegexp := fs.String("certificate-identity-regexp", "", "a regular expression alternative to --certificate-identity.")
+	certOIDCIssuer := fs.String("certificate-oidc-issuer", "", "the OIDC issuer expected in a valid Fulcio certificate, e.g. https://token.actions.githubusercontent.com or https://oauth2.sigstore.dev/auth.")
+	certOIDCIssuerRegexp := fs.String("certificate-oidc-issuer-regexp", "", "a regular expression alternative to --certificate-oidc-issuer.")
+	ignoreTlog := fs.Bool("insecure-ignore-tlog", false, "ignore transparency log verification, to be used when an artifact signature has not been uploaded to the transparency log.")
+	ignoreSCT := fs.Bool("insecure-ignore-sct", false, "when set, verification will not check that a certificate contains an embedded SCT, a proof of inclusion in a certificate transparency log.")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var trustedRoot *root.TrustedRoot
+	if path := envOr(*trustedRootPath, "SIGSTORE_TRUSTED_ROOT"); path != "" {
+		tr, err := root.NewTrustedRootFromPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading trusted root: %w", err)
+		}
+		trustedRoot = tr
+	}
+
+	if ref := envOr(*keyRef, "RULES_IMG_COSIGN_PUBLIC_KEY"); ref != "" {
+		if *certIdentity != "" || *certIdentityRegexp != "" || *certOIDCIssuer != "" || *certOIDCIssuerRegexp != "" {
+			return nil, errors.New("--certificate-identity and --certificate-oidc-issuer apply to keyless signatures, not to --key")
+		}
+		pub, err := loadPublicKey(ref)
+		if err != nil {
+			return nil, fmt.Errorf("loading verification key: %w", err)
+		}
+		v, err := sigsig.LoadDefaultVerifier(pub)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported verification key: %w", err)
+		}
+		keyID, err := keyFingerprint(pub)
+		if err != nil {
+			return nil, err
+		}
+		// The bundle's key hint is not trusted to pick a key: there is only one.
+		keyMaterial := root.NewTrustedPublicKeyMaterial(func(string) (root.TimeConstrainedVerifier, error) {
+			return root.NewExpiringKey(v, time.Time{}, time.Time{}), nil
+		})
+		var opts []verify.VerifierOption
+		var material root.TrustedMaterial = keyMaterial
+		if *ignoreTlog {
+			opts = append(opts, verify.WithNoObserverTimestamps())
+		} else {
+			if trustedRoot == nil {
+				return nil, errors.New("checking the transparency log requires the Rekor keys from --trusted-root (or pass --insecure-ignore-tlog for signatures made with --tlog-upload=false)")
+			}
+			material = root.TrustedMaterialCollection{keyMaterial, trustedRoot}
+			opts = append(opts, verify.WithTransparencyLog(1), verify.WithObserverTimestamps(1))
+		}
+		verifier, err := verify.NewVerifier(material, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &cosignVerifier{verifier: verifier, policy: verify.WithKey(), keyID: keyID}, nil
+	}
+
+	if trustedRoot == nil {
+		return nil, errors.New("keyless verification requires --trusted-root (or pass --key to verify key-based signatures)")
+	}
+	if (*certIdentity == "") == (*certIdentityRegexp == "") {
+		return nil, errors.New("keyless verification requires exactly one of --certificate-identity or --certificate-identity-regexp")
+	}
+	if (*certOIDCIssuer == "") == (*certOIDCIssuerRegexp == "") {
+		return nil, errors.New("keyless verification requires exactly one of --certificate-oidc-issuer or --certificate-oidc-issuer-regexp")
+	}
+	identity, err := verify.NewShortCertificateIdentity(*certOIDCIssuer, *certOIDCIssuerRegexp, *certIdentity, *certIdentityRegexp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate identity: %w", err)
+	}
+	var opts []verify.VerifierOption
+	if !*ignoreSCT {
+		opts = append(opts, verify.WithSignedCertificateTimestamps(1))
+	}
+	if *ignoreTlog {
+		// The short-lived certificate still needs a trusted time: an RFC3161
+		// timestamp from --timestamp-server-url at signing time.
+		opts = append(opts, verify.WithSignedTimestamps(1))
+	} else {
+		opts = append(opts, verify.WithTransparencyLog(1), verify.WithObserverTimestamps(1))
+	}
+	verifier, err := verify.NewVerifier(trustedRoot, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &cosignVerifier{verifier: verifier, policy: verify.WithCertificateIdentity(identity)}, nil
+}
+
+// Verify returns the first artifact holding a valid cosign signature of
+// subject. The reasons the others were rejected are collected for the result.
+func (v *cosignVerifier) Verify(_ context.Context, subject v1.Descriptor, artifacts []signerapi.VerifyArtifact) (signerapi.VerifyResult, error) {
+	digest, err := hex.DecodeString(subject.Digest.Hex)
+	if err != nil {
+		return signerapi.VerifyResult{}, fmt.Errorf("invalid subject digest %s: %w", subject.Digest, err)
+	}
+	policy := verify.NewPolicy(verify.WithArtifactDigest(subject.Digest.Algorithm, digest), v.policy)
+
+	var reasons []string
+	for _, artifact := range artifacts {
+		b, ok, err := signatureBundle(artifact)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", artifact.Descriptor.Digest, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		result, err := v.verifier.Verify(b, policy)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", artifact.Descriptor.Digest, err))
+			continue
+		}
+		if result.Statement == nil || result.Statement.GetPredicateType() != cosignSignPredicateType {
+			reasons = append(reasons, fmt.Sprintf("%s: not a cosign signature statement", artifact.Descriptor.Digest))
+			continue
+		}
+		return signerapi.VerifyResult{
+			Verified: true,
+			Artifact: artifact.Descriptor.Digest.String(),
+			Identity: v.identity(result),
+		}, nil
+	}
+	if len(reasons) == 0 {
+		return signerapi.VerifyResult{Reason: "no Sigstore signature bundle among the referrers"}, nil
+	}
+	return signerapi.VerifyResult{Reason: strings.Join(reasons, "; ")}, nil
+}
+
+func (v *cosignVerifier) identity(result *verify.VerificationResult) string {
+	if v.keyID != "" {
+		return "key " + v.keyID
+	}
+	if result.Signature != nil && result.Signature.Certificate != nil {
+		cert := result.Signature.Certificate
+		return fmt.Sprintf("%s (issuer %s)", cert.SubjectAlternativeName, cert.Issuer)
+	}
+	return ""
+}
+
+// signatureBundle extracts the Sigstore bundle from a referrer. It reports
+// false for referrers that are not cosign signatures, going by the artifact
+// type and the predicate type annotation cosign writes; those are skipped
+// without a reason.
+func signatureBundle(artifact signerapi.VerifyArtifact) (*bundle.Bundle, bool, error) {
+	var manifest v1.Manifest
+	if err := json.Unmarshal(artifact.Manifest, &manifest); err != nil {
+		return nil, false, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if manifest.ArtifactType != bundleMediaType || len(manifest.Layers) != 1 || string(manifest.Layers[0].MediaType) != bundleMediaType {
+		return nil, false, nil
+	}
+	if pt, ok := manifest.Annotations[annotationBundlePredicateType]; ok && pt != cosignSignPredicateType {
+		return nil, false, nil
+	}
+	layer := manifest.Layers[0]
+	data, ok := artifact.Blobs[layer.Digest.String()]
+	if !ok {
+		return nil, false, fmt.Errorf("bundle blob %s missing", layer.Digest)
+	}
+	if sum := sha256.Sum256(data); layer.Digest.Algorithm != "sha256" || hex.EncodeToString(sum[:]) != layer.Digest.Hex {
+		return nil, false, fmt.Errorf("bundle blob does not match its digest %s", layer.Digest)
+	}
+	var b bundle.Bundle
+	if err := b.UnmarshalJSON(data); err != nil {
+		return nil, false, fmt.Errorf("parsing Sigstore bundle: %w", err)
+	}
+	return &b, true, nil
+}
+
+// loadPublicKey reads a PEM public key, or the public half of a KMS key.
+func loadPublicKey(keyRef string) (crypto.PublicKey, error) {
+	if isKMSKeyRef(keyRef) {
+		ctx := context.Background()
+		sv, err := kms.Get(ctx, keyRef, crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("initializing KMS verifier for %q: %w", keyRef, err)
+		}
+		return sv.PublicKey()
+	}
+	data, err := os.ReadFile(keyRef)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key in %s: %w", keyRef, err)
+	}
+	return pub, nil
+}
+
+// keyFingerprint is the SHA-256 of the PKIX encoding of pub, the identity a
+// key-mode result reports.
+func keyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
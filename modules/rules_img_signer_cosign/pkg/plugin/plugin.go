@@ -18,6 +18,29 @@ import (
 // Subcommand is the verb `img deploy` invokes signer plugins with.
 const Subcommand = "sign-oci-artifact"
 
+// DSSESubcommand is the verb `img deploy` invokes signer plugins with to sign a
+// DSSE payload, such as a provenance statement, about a subject.
+const DSSESubcommand = "sign-dsse-payload"
+
+// VerifySubcommand is the verb `img verify` and `img deploy --verify` invoke
+// signer plugins with to check the signatures of a subject.
+const VerifySubcommand = "verify-oci-artifact"
+
+// DSSERequest is what `img deploy` writes to stdin for DSSESubcommand. Payload
+// is base64-encoded in JSON.
+type DSSERequest struct {
+	Subject     v1.Descriptor `json:"subject"`
+	PayloadType string        `json:"payloadType"`
+	Payload     []byte        `json:"payload"`
+}
+
+// VerifyRequest is what `img` writes to stdin for VerifySubcommand: the subject
+// and the candidate signature artifacts found among its referrers.
+type VerifyRequest struct {
+	Subject   v1.Descriptor              `json:"subject"`
+	Artifacts []signerapi.VerifyArtifact `json:"artifacts"`
+}
+
 // Run reads the subject descriptor from stdin, signs it, and writes the OCI
 // image layout tar of the signature artifact to stdout.
 func Run(ctx context.Context, signer signerapi.OCIArtifactSigner, stdin io.Reader, stdout io.Writer) error {
@@ -41,16 +64,89 @@ func Run(ctx context.Context, signer signerapi.OCIArtifactSigner, stdin io.Reade
 	return nil
 }
 
+// RunDSSE reads a DSSERequest from stdin, signs its payload about its subject,
+// and writes the OCI image layout tar of the attestation artifact to stdout.
+func RunDSSE(ctx context.Context, signer signerapi.DSSESigner, stdin io.Reader, stdout io.Writer) error {
+	var req DSSERequest
+	if err := json.NewDecoder(stdin).Decode(&req); err != nil {
+		return fmt.Errorf("decoding DSSE payload request from stdin: %w", err)
+	}
+	if req.Subject.Digest.Hex == "" {
+		return fmt.Errorf("subject descriptor has no digest")
+	}
+	if req.PayloadType == "" || len(req.Payload) == 0 {
+		return fmt.Errorf("DSSE payload request has no payload")
+	}
+	img, err := signer.SignDSSE(ctx, req.Subject, req.PayloadType, req.Payload)
+	if err != nil {
+		return fmt.Errorf("signing %s payload about %s: %w", req.PayloadType, req.Subject.Digest, err)
+	}
+	if img == nil {
+		return fmt.Errorf("signer returned no artifact")
+	}
+	if err := WriteArtifact(stdout, []v1.Image{img}); err != nil {
+		return fmt.Errorf("writing attestation OCI layout: %w", err)
+	}
+	return nil
+}
+
+// RunVerify reads a VerifyRequest from stdin, checks its artifacts, and writes
+// the signerapi.VerifyResult as JSON to stdout. A subject that does not verify
+// is reported in the result, not as an error.
+func RunVerify(ctx context.Context, verifier signerapi.OCIArtifactVerifier, stdin io.Reader, stdout io.Writer) error {
+	var req VerifyRequest
+	if err := json.NewDecoder(stdin).Decode(&req); err != nil {
+		return fmt.Errorf("decoding verify request from stdin: %w", err)
+	}
+	if req.Subject.Digest.Hex == "" {
+		return fmt.Errorf("subject descriptor has no digest")
+	}
+	result, err := verifier.Verify(ctx, req.Subject, req.Artifacts)
+	if err != nil {
+		return fmt.Errorf("verifying subject %s: %w", req.Subject.Digest, err)
+	}
+	if err := json.NewEncoder(stdout).Encode(result); err != nil {
+		return fmt.Errorf("writing verify result: %w", err)
+	}
+	return nil
+}
+
 // Dispatch is a convenience for plugin main functions: it requires the
-// sign-oci-artifact subcommand, builds a signer from the remaining args, and
-// runs the protocol over stdin/stdout.
+// sign-oci-artifact or sign-dsse-payload subcommand, builds a signer from the
+// remaining args, and runs the protocol over stdin/stdout. sign-dsse-payload
+// fails for a signer that does not implement signerapi.DSSESigner.
 func Dispatch(ctx context.Context, args []string, newSigner func(args []string) (signerapi.OCIArtifactSigner, error)) error {
-	if len(args) == 0 || args[0] != Subcommand {
-		return fmt.Errorf("expected %q subcommand", Subcommand)
+	return DispatchWithVerifier(ctx, args, newSigner, nil)
+}
+
+// DispatchWithVerifier is Dispatch for plugins that also verify: the
+// verify-oci-artifact subcommand builds a verifier from the remaining args,
+// which take flags of their own (a public key instead of a private one). A nil
+// newVerifier rejects the verb.
+func DispatchWithVerifier(ctx context.Context, args []string, newSigner func(args []string) (signerapi.OCIArtifactSigner, error), newVerifier func(args []string) (signerapi.OCIArtifactVerifier, error)) error {
+	if len(args) > 0 && args[0] == VerifySubcommand {
+		if newVerifier == nil {
+			return fmt.Errorf("this plugin does not support the %q subcommand", VerifySubcommand)
+		}
+		verifier, err := newVerifier(args[1:])
+		if err != nil {
+			return err
+		}
+		return RunVerify(ctx, verifier, os.Stdin, os.Stdout)
+	}
+	if len(args) == 0 || (args[0] != Subcommand && args[0] != DSSESubcommand) {
+		return fmt.Errorf("expected %q, %q or %q subcommand", Subcommand, DSSESubcommand, VerifySubcommand)
 	}
 	signer, err := newSigner(args[1:])
 	if err != nil {
 		return err
 	}
+	if args[0] == DSSESubcommand {
+		dsseSigner, ok := signer.(signerapi.DSSESigner)
+		if !ok {
+			return fmt.Errorf("this plugin does not support the %q subcommand", DSSESubcommand)
+		}
+		return RunDSSE(ctx, dsseSigner, os.Stdin, os.Stdout)
+	}
 	return Run(ctx, signer, os.Stdin, os.Stdout)
 }
@@ -1,8 +1,9 @@
 // Command notation is a rules_img signer plugin that produces Notary Project
 // (Notation) signatures using notation-core-go. It implements the
 // `sign-oci-artifact` protocol: it reads the subject descriptor from stdin and
-// writes an OCI image layout tar (the signature artifact) to stdout. It never
-// contacts a container registry.
+// writes an OCI image layout tar (the signature artifact) to stdout. Its
+// `verify-oci-artifact` verb checks such signatures against a trust store (see
+// verify.go). It never contacts a container registry.
 //
 // It signs with a local PEM private key and X.509 certificate chain, matching
 // the common `notation sign` key-based flow. Key material comes from flags or
@@ -59,7 +60,7 @@ const (
 )
 
 func main() {
-	if err := plugin.Dispatch(context.Background(), os.Args[1:], newSigner); err != nil {
+	if err := plugin.DispatchWithVerifier(context.Background(), os.Args[1:], newSigner, newVerifier); err != nil {
 		fmt.Fprintln(os.Stderr, "notation-plugin:", err)
 		os.Exit(1)
 	}
@@ -19,6 +19,8 @@ import (
 	"github.com/notaryproject/notation-core-go/signature"
 	"github.com/notaryproject/notation-core-go/signature/cose"
 	"github.com/notaryproject/notation-core-go/signature/jws"
+
+	"github.com/bazel-contrib/rules_img_signer_notation/pkg/signerapi"
 )
 
 func writeTestKeyAndCert(t *testing.T) (keyPath, certPath string) {
@@ -321,3 +323,94 @@ func TestLegacyEnvVarFallback(t *testing.T) {
 		t.Errorf("legacy NOTATION_KEY/NOTATION_CERTIFICATE_CHAIN fallback failed: %v", err)
 	}
 }
+
+// verifyArtifactOf packs a signature artifact the way `img verify` hands it to
+// the verify-oci-artifact verb.
+func verifyArtifactOf(t *testing.T, img v1.Image) signerapi.VerifyArtifact {
+	t.Helper()
+	raw, err := img.RawManifest()
+	if err != nil {
+		t.Fatalf("RawManifest: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Layers: %v", err)
+	}
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatalf("Compressed: %v", err)
+	}
+	defer rc.Close()
+	envelope := make([]byte, manifest.Layers[0].Size)
+	if _, err := readFull(rc, envelope); err != nil {
+		t.Fatalf("reading envelope: %v", err)
+	}
+	return signerapi.VerifyArtifact{
+		Descriptor: v1.Descriptor{MediaType: manifest.MediaType, Digest: digest, Size: int64(len(raw)), ArtifactType: manifest.ArtifactType},
+		Manifest:   raw,
+		Blobs:      map[string][]byte{manifest.Layers[0].Digest.String(): envelope},
+	}
+}
+
+// TestNotationVerify checks a signature verifies against the signing
+// certificate as trust store, and not against another trust store, another
+// subject, or an untrusted identity.
+func TestNotationVerify(t *testing.T) {
+	keyPath, certPath := writeTestKeyAndCert(t)
+	s, err := newSigner([]string{"--key", keyPath, "--certificate-chain", certPath})
+	if err != nil {
+		t.Fatalf("newSigner: %v", err)
+	}
+	subject := testSubject()
+	img, err := s.Sign(context.Background(), subject)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	artifacts := []signerapi.VerifyArtifact{verifyArtifactOf(t, img)}
+	digest, _ := img.Digest()
+
+	verifyWith := func(subject v1.Descriptor, args ...string) signerapi.VerifyResult {
+		t.Helper()
+		v, err := newVerifier(args)
+		if err != nil {
+			t.Fatalf("newVerifier: %v", err)
+		}
+		result, err := v.Verify(context.Background(), subject, artifacts)
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+		return result
+	}
+
+	if result := verifyWith(subject, "--trust-store", certPath); !result.Verified || result.Artifact != digest.String() || result.Identity != "CN=rules_img test signer" {
+		t.Errorf("Verify = %+v, want %s verified", result, digest)
+	}
+	if result := verifyWith(subject, "--trust-store", certPath, "--trusted-identity", "x509.subject: CN=rules_img test signer"); !result.Verified {
+		t.Errorf("Verify(trusted identity) = %+v, want verified", result)
+	}
+	if result := verifyWith(subject, "--trust-store", certPath, "--trusted-identity", "x509.subject: CN=someone else"); result.Verified {
+		t.Errorf("Verify(untrusted identity) = %+v, want not verified", result)
+	}
+	other := subject
+	other.Digest.Hex = "3333333333333333333333333333333333333333333333333333333333333333"
+	if result := verifyWith(other, "--trust-store", certPath); result.Verified || result.Reason == "" {
+		t.Errorf("Verify(other subject) = %+v, want not verified with a reason", result)
+	}
+	_, otherCertPath := writeTestKeyAndCert(t)
+	if result := verifyWith(subject, "--trust-store", otherCertPath); result.Verified {
+		t.Errorf("Verify(other trust store) = %+v, want not verified", result)
+	}
+
+	t.Setenv("RULES_IMG_NOTATION_TRUST_STORE", "")
+	if _, err := newVerifier(nil); err == nil {
+		t.Error("newVerifier accepted no trust store")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/notaryproject/notation-core-go/signature"
+	"github.com/notaryproject/notation-core-go/signature/cose"
+	"github.com/notaryproject/notation-core-go/signature/jws"
+
+	"github.com/bazel-contrib/rules_img_signer_notation/pkg/plugin"
+	"github.com/bazel-contrib/rules_img_signer_notation/pkg/signerapi"
+)
+
+// notationVerifier checks Notary Project signatures against a trust store of
+// root certificates and, optionally, a list of trusted leaf identities. It is
+// the core of notation's "strict" verification level for a single trust
+// policy: integrity, authenticity against the trust store, expiry, and the
+// signed target digest. Per-registry trust policy scopes and revocation checks
+// are out of scope; use `notation verify` where those are needed.
+type notationVerifier struct {
+	roots      *x509.CertPool
+	identities map[string]bool
+	now        func() time.Time
+}
+
+func newVerifier(args []string) (signerapi.OCIArtifactVerifier, error) {
+	fs := flag.NewFlagSet(plugin.VerifySubcommand, flag.ContinueOnError)
+	var trustStores, trustedIdentities stringSlice
+	fs.Var(&trustStores, "trust-store", "path to a PEM file of trusted root CA certificates (repeatable; or $RULES_IMG_NOTATION_TRUST_STORE). The signing certificate chain must lead to one of them.")
+	fs.Var(&trustedIdentities, "trusted-identity", `the subject of a trusted signing certificate, as in a notation trust policy (e.g. "x509.subject: C=US, O=Example, CN=release") (repeatable). If unset, any certificate chaining to the trust store is trusted.`)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if len(trustStores) == 0 {
+		if env := envOr("", "RULES_IMG_NOTATION_TRUST_STORE"); env != "" {
+			trustStores = append(trustStores, env)
+		}
+	}
+	if len(trustStores) == 0 {
+		return nil, errors.New("verification requires --trust-store (or $RULES_IMG_NOTATION_TRUST_STORE)")
+	}
+	roots := x509.NewCertPool()
+	for _, path := range trustStores {
+		certs, err := loadCertChain(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading trust store: %w", err)
+		}
+		for _, cert := range certs {
+			roots.AddCert(cert)
+		}
+	}
+	var identities map[string]bool
+	for _, identity := range trustedIdentities {
+		if identities == nil {
+			identities = map[string]bool{}
+		}
+		identities[normalizeSubject(strings.TrimPrefix(identity, "x509.subject:"))] = true
+	}
+	return &notationVerifier{roots: roots, identities: identities, now: time.Now}, nil
+}
+
+// Verify returns the first artifact holding a valid Notary Project signature
+// of subject. The reasons the others were rejected are collected for the
+// result.
+func (v *notationVerifier) Verify(_ context.Context, subject v1.Descriptor, artifacts []signerapi.VerifyArtifact) (signerapi.VerifyResult, error) {
+	var reasons []string
+	for _, artifact := range artifacts {
+		identity, ok, err := v.verifyArtifact(subject, artifact)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", artifact.Descriptor.Digest, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		return signerapi.VerifyResult{
+			Verified: true,
+			Artifact: artifact.Descriptor.Digest.String(),
+			Identity: identity,
+		}, nil
+	}
+	if len(reasons) == 0 {
+		return signerapi.VerifyResult{Reason: "no Notary Project signature among the referrers"}, nil
+	}
+	return signerapi.VerifyResult{Reason: strings.Join(reasons, "; ")}, nil
+}
+
+// verifyArtifact checks one referrer and returns the subject of its signing
+// certificate. It reports false, without an error, for referrers that are not
+// Notary Project signatures.
+func (v *notationVerifier) verifyArtifact(subject v1.Descriptor, artifact signerapi.VerifyArtifact) (string, bool, error) {
+	var manifest v1.Manifest
+	if err := json.Unmarshal(artifact.Manifest, &manifest); err != nil {
+		return "", false, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if manifest.ArtifactType != artifactTypeNotation || len(manifest.Layers) != 1 {
+		return "", false, nil
+	}
+	layer := manifest.Layers[0]
+	envelopeType := string(layer.MediaType)
+	if envelopeType != jws.MediaTypeEnvelope && envelopeType != cose.MediaTypeEnvelope {
+		return "", false, nil
+	}
+	data, ok := artifact.Blobs[layer.Digest.String()]
+	if !ok {
+		return "", false, fmt.Errorf("signature envelope blob %s missing", layer.Digest)
+	}
+	if sum := sha256.Sum256(data); layer.Digest.Algorithm != "sha256" || hex.EncodeToString(sum[:]) != layer.Digest.Hex {
+		return "", false, fmt.Errorf("signature envelope does not match its digest %s", layer.Digest)
+	}
+
+	env, err := signature.ParseEnvelope(envelopeType, data)
+	if err != nil {
+		return "", false, fmt.Errorf("parsing signature envelope: %w", err)
+	}
+	// Integrity: the envelope's signature over its payload and signed
+	// attributes, made by the leaf certificate it carries.
+	content, err := env.Verify()
+	if err != nil {
+		return "", false, fmt.Errorf("integrity: %w", err)
+	}
+	now := v.now()
+	if expiry := content.SignerInfo.SignedAttributes.Expiry; !expiry.IsZero() && now.After(expiry) {
+		return "", false, fmt.Errorf("signature expired at %s", expiry.Format(time.RFC3339))
+	}
+
+	// Authenticity: the carried chain leads to a trusted root.
+	chain := content.SignerInfo.CertificateChain
+	if len(chain) == 0 {
+		return "", false, errors.New("signature carries no certificate chain")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return "", false, fmt.Errorf("authenticity: %w", err)
+	}
+	identity := chain[0].Subject.String()
+	if v.identities != nil && !v.identities[normalizeSubject(identity)] {
+		return "", false, fmt.Errorf("signing certificate %q is not a trusted identity", identity)
+	}
+
+	// The signed payload must name the subject.
+	if content.Payload.ContentType != payloadContentType {
+		return "", false, fmt.Errorf("unsupported payload content type %q", content.Payload.ContentType)
+	}
+	var payload struct {
+		TargetArtifact struct {
+			Digest string `json:"digest"`
+		} `json:"targetArtifact"`
+	}
+	if err := json.Unmarshal(content.Payload.Content, &payload); err != nil {
+		return "", false, fmt.Errorf("parsing signed payload: %w", err)
+	}
+	if payload.TargetArtifact.Digest != subject.Digest.String() {
+		return "", false, fmt.Errorf("signature is for %s, not %s", payload.TargetArtifact.Digest, subject.Digest)
+	}
+	return identity, true, nil
+}
+
+// normalizeSubject makes distinguished names comparable regardless of the
+// spacing after commas and the order of their attributes.
+func normalizeSubject(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	// Attribute order differs between notation's trust policy syntax
+	// (C=..., O=..., CN=...) and Go's pkix.Name.String (CN=..., O=..., C=...).
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
@@ -18,3 +18,43 @@ import (
 type OCIArtifactSigner interface {
 	Sign(ctx context.Context, subject v1.Descriptor) (v1.Image, error)
 }
+
+// DSSESigner is implemented by signers that can also sign an arbitrary DSSE
+// payload about a subject, such as the in-toto Statement with a SLSA provenance
+// predicate that `img deploy` attests. SignDSSE wraps payload in a DSSE envelope
+// of payloadType and returns the attestation artifact, linked to subject via
+// the OCI 1.1 subject field. It backs the sign-dsse-payload verb.
+type DSSESigner interface {
+	SignDSSE(ctx context.Context, subject v1.Descriptor, payloadType string, payload []byte) (v1.Image, error)
+}
+
+// OCIArtifactVerifier is implemented by plugins that can also check
+// signatures. It backs the verify-oci-artifact verb that `img verify` and the
+// pre-flight of `img deploy --verify` run. Unlike rules_img's own interface it
+// receives the referrers as the raw bytes `img` fetched, which is what a
+// verifier parses anyway.
+//
+// A subject without a trusted signature is not an error: the result says so,
+// with a reason. Errors are reserved for a verifier that could not do its job.
+type OCIArtifactVerifier interface {
+	Verify(ctx context.Context, subject v1.Descriptor, artifacts []VerifyArtifact) (VerifyResult, error)
+}
+
+// VerifyArtifact is one referrer of the subject: its manifest verbatim and the
+// blobs (config and layers) it references, keyed by digest.
+type VerifyArtifact struct {
+	Descriptor v1.Descriptor     `json:"descriptor"`
+	Manifest   []byte            `json:"manifest"`
+	Blobs      map[string][]byte `json:"blobs,omitempty"`
+}
+
+// VerifyResult reports whether one of the artifacts is a valid signature of
+// the subject by a trusted signer. Artifact is the digest of that referrer and
+// Identity names the signer (a certificate subject, a key fingerprint); Reason
+// says why nothing verified.
+type VerifyResult struct {
+	Verified bool   `json:"verified"`
+	Artifact string `json:"artifact,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}